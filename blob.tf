@@ -33,6 +33,14 @@ resource "azurerm_storage_blob" "state" {
   }
 }
 
+# the state blob seeds the table on its first use
+resource "azurerm_storage_table" "state" {
+  count                = var.state_backend == "table" ? 1 : 0
+  name                 = "${local.alphanumeric_prefix_name}${local.alphanumeric_cluster_name}state"
+  storage_account_name = local.deployment_storage_account_name
+  depends_on           = [azurerm_storage_account.deployment_sa]
+}
+
 data azurerm_storage_account "deployment_blob" {
   count               = var.deployment_storage_account_name != "" ? 1 : 0
   name                = var.deployment_storage_account_name
@@ -43,4 +51,10 @@ data "azurerm_storage_account" "obs_sa" {
   count               = var.obs_name != "" ? 1 : 0
   name                = var.obs_name
   resource_group_name = var.rg_name
-}
\ No newline at end of file
+}
+
+data "azurerm_user_assigned_identity" "obs_cmk" {
+  count               = try(var.obs_customer_managed_key.user_assigned_identity_id, "") != "" ? 1 : 0
+  name                = element(split("/", var.obs_customer_managed_key.user_assigned_identity_id), 8)
+  resource_group_name = element(split("/", var.obs_customer_managed_key.user_assigned_identity_id), 4)
+}
@@ -0,0 +1,63 @@
+package common
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// IsDpdkUdpFallbackEnabled tells whether weka falls back to udp mode when the vms nics don't have accelerated
+// networking, configured by DPDK_UDP_FALLBACK, the clusterization fails with a per vm report otherwise
+func IsDpdkUdpFallbackEnabled(ctx context.Context) bool {
+	fallback, _ := strconv.ParseBool(Getenv(ctx, "DPDK_UDP_FALLBACK"))
+	return fallback
+}
+
+// GetScaleSetsVmsNicsWithoutAcceleratedNetworking returns the names of the nics without accelerated networking,
+// by vm name, vms whose nics all have accelerated networking are not in the map
+func GetScaleSetsVmsNicsWithoutAcceleratedNetworking(ctx context.Context, subscriptionId, resourceGroupName string, vmScaleSetNames []string) (vmsNics map[string][]string, err error) {
+	vmsNics = make(map[string][]string)
+	var lock sync.Mutex
+	err = ForEachParallel(ctx, len(vmScaleSetNames), AzureApiMaxParallelism, func(ctx context.Context, i int) error {
+		networkInterfaces, err := getScaleSetVmsNetworkInterfaces(ctx, subscriptionId, resourceGroupName, vmScaleSetNames[i])
+		if err != nil {
+			return err
+		}
+		lock.Lock()
+		defer lock.Unlock()
+		for _, networkInterface := range networkInterfaces {
+			if networkInterface.Properties == nil || networkInterface.Properties.VirtualMachine == nil || networkInterface.Properties.VirtualMachine.ID == nil {
+				continue
+			}
+			if networkInterface.Properties.EnableAcceleratedNetworking != nil && *networkInterface.Properties.EnableAcceleratedNetworking {
+				continue
+			}
+			vmNameParts := strings.Split(*networkInterface.Properties.VirtualMachine.ID, "/")
+			vmNamePartsLen := len(vmNameParts)
+			vmName := fmt.Sprintf("%s_%s", vmNameParts[vmNamePartsLen-3], vmNameParts[vmNamePartsLen-1])
+			vmsNics[vmName] = append(vmsNics[vmName], *networkInterface.Name)
+		}
+		return nil
+	})
+	return
+}
+
+// GetAcceleratedNetworkingReport returns a line per vm listing its nics without accelerated networking
+func GetAcceleratedNetworkingReport(vmsNics map[string][]string) string {
+	vmNames := make([]string, 0, len(vmsNics))
+	for vmName := range vmsNics {
+		vmNames = append(vmNames, vmName)
+	}
+	sort.Strings(vmNames)
+
+	var lines []string
+	for _, vmName := range vmNames {
+		nics := vmsNics[vmName]
+		sort.Strings(nics)
+		lines = append(lines, fmt.Sprintf("%s: %s", vmName, strings.Join(nics, ", ")))
+	}
+	return strings.Join(lines, "\n")
+}
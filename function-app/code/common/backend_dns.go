@@ -0,0 +1,102 @@
+package common
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// the backends get an A record each in the customer private dns zone, so the clients mount by stable names, the
+// record of a backend is named by its scale set vm index and is kept until the vm is terminated
+const backendDnsRecordPrefix = "weka-backend"
+
+type backendDnsZone struct {
+	SubscriptionId    string
+	ResourceGroupName string
+	ZoneName          string
+	ClusterName       string
+}
+
+func getBackendDnsZone(ctx context.Context) backendDnsZone {
+	return backendDnsZone{
+		SubscriptionId:    Getenv(ctx, "SUBSCRIPTION_ID"),
+		ResourceGroupName: Getenv(ctx, "PRIVATE_DNS_RG_NAME"),
+		ZoneName:          Getenv(ctx, "PRIVATE_DNS_ZONE_NAME"),
+		ClusterName:       Getenv(ctx, "CLUSTER_NAME"),
+	}
+}
+
+// IsBackendDnsEnabled tells whether the backend records are registered, set by BACKEND_DNS_RECORDS_ENABLED with a
+// private dns zone
+func IsBackendDnsEnabled(ctx context.Context) bool {
+	enabled, _ := strconv.ParseBool(Getenv(ctx, "BACKEND_DNS_RECORDS_ENABLED"))
+	return enabled && Getenv(ctx, "PRIVATE_DNS_ZONE_NAME") != ""
+}
+
+// GetBackendDnsRecordName returns the record of a backend vm, weka-backend-<index> or weka-backend-zone<zone>-<index>
+// in a zonal deployment
+func GetBackendDnsRecordName(ctx context.Context, vmName string) string {
+	vmScaleSetName := GetVmScaleSetNameFromVmName(vmName)
+	zoneSuffix := strings.TrimPrefix(vmScaleSetName, GetVmScaleSetName(Getenv(ctx, "PREFIX"), Getenv(ctx, "CLUSTER_NAME")))
+	return fmt.Sprintf("%s%s-%s", backendDnsRecordPrefix, zoneSuffix, GetScaleSetVmIndex(vmName))
+}
+
+// GetBackendDnsFqdn returns the fully qualified name of the backend record
+func GetBackendDnsFqdn(ctx context.Context, vmName string) string {
+	return fmt.Sprintf("%s.%s", GetBackendDnsRecordName(ctx, vmName), Getenv(ctx, "PRIVATE_DNS_ZONE_NAME"))
+}
+
+// RegisterBackendDnsRecords creates or refreshes the records of the backends, by vm name
+func RegisterBackendDnsRecords(ctx context.Context, backendsIps map[string]string) error {
+	zone := getBackendDnsZone(ctx)
+	var vmNames []string
+	for vmName := range backendsIps {
+		vmNames = append(vmNames, vmName)
+	}
+	return ForEachParallel(ctx, len(vmNames), AzureApiMaxParallelism, func(ctx context.Context, i int) error {
+		return UpsertPrivateDNSARecord(ctx, zone.SubscriptionId, zone.ResourceGroupName, zone.ZoneName, GetBackendDnsRecordName(ctx, vmNames[i]), []string{backendsIps[vmNames[i]]})
+	})
+}
+
+// DeregisterBackendDnsRecords deletes the records of the backends, a missing record is not an error
+func DeregisterBackendDnsRecords(ctx context.Context, vmNames []string) error {
+	zone := getBackendDnsZone(ctx)
+	return ForEachParallel(ctx, len(vmNames), AzureApiMaxParallelism, func(ctx context.Context, i int) error {
+		return DeletePrivateDNSARecord(ctx, zone.SubscriptionId, zone.ResourceGroupName, zone.ZoneName, GetBackendDnsRecordName(ctx, vmNames[i]))
+	})
+}
+
+// SyncBackendDnsRecords registers the records of the backends which are missing or point to another ip, and deletes
+// the backend records of the cluster which don't belong to any of them
+func SyncBackendDnsRecords(ctx context.Context, backendsIps map[string]string) (err error) {
+	zone := getBackendDnsZone(ctx)
+	records, err := ListPrivateDNSARecords(ctx, zone.SubscriptionId, zone.ResourceGroupName, zone.ZoneName, zone.ClusterName)
+	if err != nil {
+		return
+	}
+
+	outdated := make(map[string]string)
+	expected := make(map[string]bool)
+	for vmName, ip := range backendsIps {
+		recordName := GetBackendDnsRecordName(ctx, vmName)
+		expected[recordName] = true
+		if ips, ok := records[recordName]; !ok || len(ips) != 1 || ips[0] != ip {
+			outdated[vmName] = ip
+		}
+	}
+	err = RegisterBackendDnsRecords(ctx, outdated)
+	if err != nil {
+		return
+	}
+
+	var stale []string
+	for recordName := range records {
+		if strings.HasPrefix(recordName, backendDnsRecordPrefix+"-") && !expected[recordName] {
+			stale = append(stale, recordName)
+		}
+	}
+	return ForEachParallel(ctx, len(stale), AzureApiMaxParallelism, func(ctx context.Context, i int) error {
+		return DeletePrivateDNSARecord(ctx, zone.SubscriptionId, zone.ResourceGroupName, zone.ZoneName, stale[i])
+	})
+}
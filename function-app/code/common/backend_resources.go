@@ -0,0 +1,134 @@
+package common
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/weka/go-cloud-lib/logging"
+)
+
+// BackendResources is the weka containers layout of a backend vm size, the json fields match the terraform
+// container_number_map
+type BackendResources struct {
+	Compute  int `json:"compute"`
+	Drive    int `json:"drive"`
+	Frontend int `json:"frontend"`
+	Nvmes    int `json:"nvme"`
+	Nics     int `json:"nics"`
+	// compute containers memory, without and with a frontend container
+	Memory []string `json:"memory"`
+}
+
+// backendResourcesBySku holds the tested layouts, the sizes of the same series share the layout of their vcpus count
+var backendResourcesBySku = map[string]BackendResources{
+	"Standard_L8s_v3":   {Compute: 1, Drive: 1, Frontend: 1, Nvmes: 1, Nics: 4, Memory: []string{"33GB", "31GB"}},
+	"Standard_L16s_v3":  {Compute: 4, Drive: 2, Frontend: 1, Nvmes: 2, Nics: 8, Memory: []string{"79GB", "72GB"}},
+	"Standard_L32s_v3":  {Compute: 4, Drive: 2, Frontend: 1, Nvmes: 4, Nics: 8, Memory: []string{"197GB", "189GB"}},
+	"Standard_L48s_v3":  {Compute: 3, Drive: 3, Frontend: 1, Nvmes: 6, Nics: 8, Memory: []string{"314GB", "306GB"}},
+	"Standard_L64s_v3":  {Compute: 4, Drive: 2, Frontend: 1, Nvmes: 8, Nics: 8, Memory: []string{"357GB", "418GB"}},
+	"Standard_L8as_v3":  {Compute: 1, Drive: 1, Frontend: 1, Nvmes: 1, Nics: 4, Memory: []string{"33GB", "31GB"}},
+	"Standard_L16as_v3": {Compute: 4, Drive: 2, Frontend: 1, Nvmes: 2, Nics: 8, Memory: []string{"79GB", "72GB"}},
+	"Standard_L32as_v3": {Compute: 4, Drive: 2, Frontend: 1, Nvmes: 4, Nics: 8, Memory: []string{"197GB", "189GB"}},
+	"Standard_L48as_v3": {Compute: 3, Drive: 3, Frontend: 1, Nvmes: 6, Nics: 8, Memory: []string{"314GB", "306GB"}},
+	"Standard_L64as_v3": {Compute: 4, Drive: 2, Frontend: 1, Nvmes: 8, Nics: 8, Memory: []string{"357GB", "418GB"}},
+}
+
+// BackendContainers is the layout applied on a backend, resolved from its vm size
+type BackendContainers struct {
+	VmSize        string
+	Compute       int
+	Drive         int
+	Frontend      int
+	ComputeMemory string
+	Nics          int
+}
+
+// getBackendContainersFromSettings returns the layout terraform resolved from container_number_map for instance_type
+func getBackendContainersFromSettings(ctx context.Context) BackendContainers {
+	compute, _ := strconv.Atoi(Getenv(ctx, "NUM_COMPUTE_CONTAINERS"))
+	drive, _ := strconv.Atoi(Getenv(ctx, "NUM_DRIVE_CONTAINERS"))
+	frontend, _ := strconv.Atoi(Getenv(ctx, "NUM_FRONTEND_CONTAINERS"))
+	nics, _ := strconv.Atoi(Getenv(ctx, "NICS_NUM"))
+	return BackendContainers{
+		Compute:       compute,
+		Drive:         drive,
+		Frontend:      frontend,
+		ComputeMemory: Getenv(ctx, "COMPUTE_MEMORY"),
+		Nics:          nics,
+	}
+}
+
+// getBackendResources returns the layout of the vm size, BACKEND_RESOURCES_OVERRIDE (a json map of vm size to
+// layout) takes precedence over the built-in table
+func getBackendResources(ctx context.Context, vmSize string) (resources BackendResources, found bool, err error) {
+	if value := Getenv(ctx, "BACKEND_RESOURCES_OVERRIDE"); value != "" {
+		var overrides map[string]BackendResources
+		if err = json.Unmarshal([]byte(value), &overrides); err != nil {
+			err = fmt.Errorf("cannot parse BACKEND_RESOURCES_OVERRIDE: %w", err)
+			return
+		}
+		for sku, override := range overrides {
+			if strings.EqualFold(sku, vmSize) {
+				return override, true, nil
+			}
+		}
+	}
+	for sku, builtin := range backendResourcesBySku {
+		if strings.EqualFold(sku, vmSize) {
+			return builtin, true, nil
+		}
+	}
+	return
+}
+
+// GetBackendContainers returns the containers layout of the scale set vm size. Sizes without a layout keep the
+// app settings, the nics are capped by the nics terraform attached to the vms
+func GetBackendContainers(ctx context.Context, subscriptionId, resourceGroupName, vmScaleSetName string) (containers BackendContainers, err error) {
+	logger := logging.LoggerFromCtx(ctx)
+
+	containers = getBackendContainersFromSettings(ctx)
+	scaleSet, err := getScaleSet(ctx, subscriptionId, resourceGroupName, vmScaleSetName)
+	if err != nil {
+		return
+	}
+	if scaleSet.SKU == nil || scaleSet.SKU.Name == nil {
+		err = fmt.Errorf("scale set %s has no vm size", vmScaleSetName)
+		logger.Error().Err(err).Send()
+		return
+	}
+	containers.VmSize = *scaleSet.SKU.Name
+
+	resources, found, err := getBackendResources(ctx, containers.VmSize)
+	if err != nil {
+		logger.Error().Err(err).Send()
+		return
+	}
+	if !found {
+		logger.Info().Msgf("No containers layout for vm size %s, using the app settings", containers.VmSize)
+		return
+	}
+	if len(resources.Memory) < 2 {
+		err = fmt.Errorf("containers layout of vm size %s must have the compute memory without and with a frontend", containers.VmSize)
+		logger.Error().Err(err).Send()
+		return
+	}
+
+	// the frontend container is added by the deployment, a backend without it runs an extra compute container
+	if containers.Frontend > 0 {
+		containers.Compute = resources.Compute
+		containers.Frontend = resources.Frontend
+		containers.ComputeMemory = resources.Memory[1]
+	} else {
+		containers.Compute = resources.Compute + 1
+		containers.ComputeMemory = resources.Memory[0]
+	}
+	containers.Drive = resources.Drive
+	if attachedNics := containers.Nics; attachedNics == 0 || resources.Nics < attachedNics {
+		containers.Nics = resources.Nics
+	}
+	logger.Info().Msgf("Vm size %s containers layout: %+v", containers.VmSize, containers)
+	return
+}
@@ -0,0 +1,525 @@
+package common
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"time"
+
+	"github.com/Azure/azure-sdk-for-go/sdk/azcore"
+	"github.com/Azure/azure-sdk-for-go/sdk/azcore/streaming"
+	"github.com/Azure/azure-sdk-for-go/sdk/azcore/to"
+	"github.com/Azure/azure-sdk-for-go/sdk/azidentity"
+	"github.com/Azure/azure-sdk-for-go/sdk/data/aztables"
+	"github.com/Azure/azure-sdk-for-go/sdk/keyvault/azsecrets"
+	"github.com/Azure/azure-sdk-for-go/sdk/resourcemanager/compute/armcompute"
+	"github.com/Azure/azure-sdk-for-go/sdk/resourcemanager/network/armnetwork"
+	"github.com/Azure/azure-sdk-for-go/sdk/storage/azblob"
+	"github.com/Azure/azure-sdk-for-go/sdk/storage/azblob/blob"
+	"github.com/Azure/azure-sdk-for-go/sdk/storage/azblob/bloberror"
+	"github.com/Azure/azure-sdk-for-go/sdk/storage/azblob/blockblob"
+	"github.com/Azure/azure-sdk-for-go/sdk/storage/azblob/lease"
+	"github.com/weka/go-cloud-lib/logging"
+	"github.com/weka/go-cloud-lib/protocol"
+)
+
+// StorageClient reads and writes the blobs of the state container
+type StorageClient interface {
+	// ReadBlob returns the blob content and its etag, a missing blob is returned as empty with a nil etag when
+	// allowMissing is set
+	ReadBlob(ctx context.Context, storageName, containerName, blobName string, allowMissing bool) (data []byte, etag *azcore.ETag, err error)
+	WriteBlob(ctx context.Context, storageName, containerName, blobName string, data []byte) error
+	// WriteBlobIfMatch fails with bloberror.ConditionNotMet when the blob was changed since it was read, a nil etag
+	// means the blob must not exist yet (bloberror.BlobAlreadyExists otherwise)
+	WriteBlobIfMatch(ctx context.Context, storageName, containerName, blobName string, data []byte, etag *azcore.ETag) error
+	DeleteBlob(ctx context.Context, storageName, containerName, blobName string) error
+	// AcquireBlobLease fails with bloberror.LeaseAlreadyPresent when the lease is held by another owner
+	AcquireBlobLease(ctx context.Context, storageName, containerName, blobName string, duration time.Duration) (leaseId string, err error)
+	RenewBlobLease(ctx context.Context, storageName, containerName, blobName, leaseId string) error
+	ReleaseBlobLease(ctx context.Context, storageName, containerName, blobName, leaseId string) error
+}
+
+// SecretsClient reads and writes the key vault secrets, without the instance cache of GetKeyVaultValue
+type SecretsClient interface {
+	GetSecret(ctx context.Context, keyVaultUri, secretName string) (string, error)
+	SetSecret(ctx context.Context, keyVaultUri, secretName, value string) error
+}
+
+// ComputeClient lists the scale set resources the deployment functions work on
+type ComputeClient interface {
+	ListScaleSetVms(ctx context.Context, subscriptionId, resourceGroupName, vmScaleSetName string, expand *string) ([]*armcompute.VirtualMachineScaleSetVM, error)
+	ListScaleSetNetworkInterfaces(ctx context.Context, subscriptionId, resourceGroupName, vmScaleSetName string) ([]*armnetwork.Interface, error)
+	GetPublicIp(ctx context.Context, subscriptionId, resourceGroupName, vmScaleSetName, prefix, clusterName, instanceIndex string) (string, error)
+}
+
+// TableClient reads and writes the rows of a table partition
+type TableClient interface {
+	// ListPartition returns the json entities of the partition rows, with their odata.etag
+	ListPartition(ctx context.Context, storageName, tableName, partitionKey string) ([][]byte, error)
+	// SubmitTransaction runs the actions in an entity group transaction, it fails with an azcore.ResponseError of
+	// the failed action error code, e.g. aztables.UpdateConditionNotSatisfied when its row was changed
+	SubmitTransaction(ctx context.Context, storageName, tableName string, actions []aztables.TransactionAction) error
+}
+
+// StateStore persists the cluster state
+type StateStore interface {
+	ReadState(ctx context.Context, stateStorageName, containerName string) (protocol.ClusterState, error)
+	WriteState(ctx context.Context, stateStorageName, containerName string, state protocol.ClusterState) error
+	// UpdateState applies update on the current state and writes it only if no other writer changed it in between,
+	// on conflict the state is read again and the update is re-applied, so concurrent updates are never lost.
+	// An error returned by update aborts the update without writing the state
+	UpdateState(ctx context.Context, stateStorageName, containerName string, update func(state *protocol.ClusterState) error) (protocol.ClusterState, error)
+}
+
+// Clients are the dependencies of the functions on azure, the fakes package has in memory implementations for tests
+type Clients struct {
+	State   StateStore
+	Storage StorageClient
+	Secrets SecretsClient
+	Compute ComputeClient
+	Tables  TableClient
+}
+
+type clientsCtxKey struct{}
+
+func AzureClients(ctx context.Context) Clients {
+	return Clients{
+		State:   GetStateStore(ctx),
+		Storage: azureStorageClient{},
+		Secrets: azureSecretsClient{},
+		Compute: azureComputeClient{},
+		Tables:  azureTableClient{},
+	}
+}
+
+// WithClients returns a context the common functions use the clients of, instead of the azure clients
+func WithClients(ctx context.Context, clients Clients) context.Context {
+	return context.WithValue(ctx, clientsCtxKey{}, clients)
+}
+
+// ClientsFromCtx returns the clients set by WithClients, the clients which are not set are the azure clients
+func ClientsFromCtx(ctx context.Context) Clients {
+	clients, _ := ctx.Value(clientsCtxKey{}).(Clients)
+	defaults := AzureClients(ctx)
+	if clients.State == nil {
+		clients.State = defaults.State
+	}
+	if clients.Storage == nil {
+		clients.Storage = defaults.Storage
+	}
+	if clients.Secrets == nil {
+		clients.Secrets = defaults.Secrets
+	}
+	if clients.Compute == nil {
+		clients.Compute = defaults.Compute
+	}
+	if clients.Tables == nil {
+		clients.Tables = defaults.Tables
+	}
+	return clients
+}
+
+// BlobStateStore keeps the state in the "state" blob of the state container, through the StorageClient
+type BlobStateStore struct{}
+
+func (BlobStateStore) ReadState(ctx context.Context, stateStorageName, containerName string) (state protocol.ClusterState, err error) {
+	logger := logging.LoggerFromCtx(ctx)
+
+	stateAsByteArray, err := ReadBlobObject(ctx, stateStorageName, containerName, "state")
+	if err != nil {
+		return
+	}
+	err = json.Unmarshal(stateAsByteArray, &state)
+	if err != nil {
+		logger.Error().Err(err).Send()
+		return
+	}
+
+	return
+}
+
+func (BlobStateStore) WriteState(ctx context.Context, stateStorageName, containerName string, state protocol.ClusterState) (err error) {
+	logger := logging.LoggerFromCtx(ctx)
+
+	stateAsByteArray, err := json.Marshal(state)
+	if err != nil {
+		logger.Error().Err(err).Send()
+		return
+	}
+
+	err = WriteBlobObject(ctx, stateStorageName, containerName, "state", stateAsByteArray)
+	return
+}
+
+func (BlobStateStore) UpdateState(ctx context.Context, stateStorageName, containerName string, update func(state *protocol.ClusterState) error) (state protocol.ClusterState, err error) {
+	logger := logging.LoggerFromCtx(ctx)
+
+	for attempt := 1; attempt <= stateUpdateMaxAttempts; attempt++ {
+		var etag *azcore.ETag
+		state, etag, err = readStateWithETag(ctx, stateStorageName, containerName)
+		if err != nil {
+			return
+		}
+
+		err = update(&state)
+		if err != nil {
+			return
+		}
+
+		err = writeStateIfMatch(ctx, stateStorageName, containerName, state, etag)
+		if err == nil || !isBlobWriteConflict(err) {
+			return
+		}
+
+		delay := getBlobUpdateRetryDelay(attempt)
+		logger.Info().Msgf("state was changed by another writer, retrying in %s (attempt %d/%d)", delay, attempt, stateUpdateMaxAttempts)
+		time.Sleep(delay)
+	}
+	err = fmt.Errorf("failed to update state after %d attempts: %w", stateUpdateMaxAttempts, err)
+	logger.Error().Err(err).Send()
+	return
+}
+
+type azureStorageClient struct{}
+
+type azureSecretsClient struct{}
+
+type azureComputeClient struct{}
+
+func (azureStorageClient) ReadBlob(ctx context.Context, storageName, containerName, blobName string, allowMissing bool) (data []byte, etag *azcore.ETag, err error) {
+	logger := logging.LoggerFromCtx(ctx)
+
+	credential, err := azidentity.NewDefaultAzureCredential(getCredentialOptions())
+	if err != nil {
+		logger.Error().Err(err).Send()
+		return
+	}
+
+	blobClient, err := azblob.NewClient(GetBlobUrl(storageName), credential, &azblob.ClientOptions{ClientOptions: getClientOptions()})
+	if err != nil {
+		logger.Error().Err(err).Send()
+		return
+	}
+
+	downloadResponse, err := blobClient.DownloadStream(ctx, containerName, blobName, nil)
+	if err != nil {
+		if allowMissing && bloberror.HasCode(err, bloberror.BlobNotFound) {
+			err = nil
+			return
+		}
+		logger.Error().Err(err).Send()
+		return
+	}
+	defer downloadResponse.Body.Close()
+
+	data, err = io.ReadAll(downloadResponse.Body)
+	if err != nil {
+		logger.Error().Err(err).Send()
+		return
+	}
+	etag = downloadResponse.ETag
+	return
+}
+
+func (azureStorageClient) WriteBlobIfMatch(ctx context.Context, storageName, containerName, blobName string, data []byte, etag *azcore.ETag) (err error) {
+	logger := logging.LoggerFromCtx(ctx)
+
+	credential, err := azidentity.NewDefaultAzureCredential(getCredentialOptions())
+	if err != nil {
+		logger.Error().Err(err).Send()
+		return
+	}
+
+	blobClient, err := azblob.NewClient(GetBlobUrl(storageName), credential, &azblob.ClientOptions{ClientOptions: getClientOptions()})
+	if err != nil {
+		logger.Error().Err(err).Send()
+		return
+	}
+
+	accessConditions := &blob.ModifiedAccessConditions{IfMatch: etag}
+	if etag == nil {
+		accessConditions = &blob.ModifiedAccessConditions{IfNoneMatch: to.Ptr(azcore.ETagAny)}
+	}
+	_, err = blobClient.UploadBuffer(ctx, containerName, blobName, data, &azblob.UploadBufferOptions{
+		AccessConditions: &blob.AccessConditions{
+			ModifiedAccessConditions: accessConditions,
+		},
+	})
+	return
+}
+
+func (azureStorageClient) WriteBlob(ctx context.Context, stateStorageName, containerName, blobName string, state []byte) (err error) {
+	logger := logging.LoggerFromCtx(ctx)
+
+	credential, err := azidentity.NewDefaultAzureCredential(getCredentialOptions())
+	if err != nil {
+		logger.Error().Err(err).Send()
+		return
+	}
+
+	blobClient, err := azblob.NewClient(GetBlobUrl(stateStorageName), credential, &azblob.ClientOptions{ClientOptions: getClientOptions()})
+	if err != nil {
+		logger.Error().Err(err).Send()
+		return
+	}
+
+	_, err = blobClient.UploadBuffer(ctx, containerName, blobName, state, &azblob.UploadBufferOptions{})
+	return
+}
+
+// WriteImmutableBlob uploads a blob with a locked time based immutability policy, it can't be changed or deleted
+// until retainUntil
+func WriteImmutableBlob(ctx context.Context, storageName, containerName, blobName string, data []byte, retainUntil time.Time) (err error) {
+	logger := logging.LoggerFromCtx(ctx)
+
+	credential, err := azidentity.NewDefaultAzureCredential(getCredentialOptions())
+	if err != nil {
+		logger.Error().Err(err).Send()
+		return
+	}
+
+	blobClient, err := azblob.NewClient(GetBlobUrl(storageName), credential, &azblob.ClientOptions{ClientOptions: getClientOptions()})
+	if err != nil {
+		logger.Error().Err(err).Send()
+		return
+	}
+
+	blockBlobClient := blobClient.ServiceClient().NewContainerClient(containerName).NewBlockBlobClient(blobName)
+	_, err = blockBlobClient.Upload(ctx, streaming.NopCloser(bytes.NewReader(data)), &blockblob.UploadOptions{
+		ImmutabilityPolicyMode:       to.Ptr(blob.ImmutabilityPolicySettingLocked),
+		ImmutabilityPolicyExpiryTime: &retainUntil,
+	})
+	return
+}
+
+func (azureStorageClient) DeleteBlob(ctx context.Context, storageName, containerName, blobName string) (err error) {
+	logger := logging.LoggerFromCtx(ctx)
+
+	credential, err := azidentity.NewDefaultAzureCredential(getCredentialOptions())
+	if err != nil {
+		logger.Error().Err(err).Send()
+		return
+	}
+
+	blobClient, err := azblob.NewClient(GetBlobUrl(storageName), credential, &azblob.ClientOptions{ClientOptions: getClientOptions()})
+	if err != nil {
+		logger.Error().Err(err).Send()
+		return
+	}
+
+	_, err = blobClient.DeleteBlob(ctx, containerName, blobName, nil)
+	if err != nil && bloberror.HasCode(err, bloberror.BlobNotFound) {
+		err = nil
+	}
+	if err != nil {
+		logger.Error().Err(err).Send()
+	}
+	return
+}
+
+// blobLeaseClient returns the lease client of a blob, a nil lease id is generated by the client on acquire
+func blobLeaseClient(ctx context.Context, storageName, containerName, blobName string, leaseId *string) (leaseClient *lease.BlobClient, err error) {
+	logger := logging.LoggerFromCtx(ctx)
+
+	credential, err := azidentity.NewDefaultAzureCredential(getCredentialOptions())
+	if err != nil {
+		logger.Error().Err(err).Send()
+		return
+	}
+
+	client, err := azblob.NewClient(GetBlobUrl(storageName), credential, &azblob.ClientOptions{ClientOptions: getClientOptions()})
+	if err != nil {
+		logger.Error().Err(err).Send()
+		return
+	}
+
+	blobClient := client.ServiceClient().NewContainerClient(containerName).NewBlobClient(blobName)
+	leaseClient, err = lease.NewBlobClient(blobClient, &lease.BlobClientOptions{LeaseID: leaseId})
+	if err != nil {
+		logger.Error().Err(err).Send()
+	}
+	return
+}
+
+func (azureStorageClient) AcquireBlobLease(ctx context.Context, storageName, containerName, blobName string, duration time.Duration) (leaseId string, err error) {
+	leaseClient, err := blobLeaseClient(ctx, storageName, containerName, blobName, nil)
+	if err != nil {
+		return
+	}
+	response, err := leaseClient.AcquireLease(ctx, int32(duration.Seconds()), nil)
+	if err != nil {
+		return
+	}
+	leaseId = *response.LeaseID
+	return
+}
+
+func (azureStorageClient) RenewBlobLease(ctx context.Context, storageName, containerName, blobName, leaseId string) (err error) {
+	leaseClient, err := blobLeaseClient(ctx, storageName, containerName, blobName, &leaseId)
+	if err != nil {
+		return
+	}
+	_, err = leaseClient.RenewLease(ctx, nil)
+	return
+}
+
+func (azureStorageClient) ReleaseBlobLease(ctx context.Context, storageName, containerName, blobName, leaseId string) (err error) {
+	leaseClient, err := blobLeaseClient(ctx, storageName, containerName, blobName, &leaseId)
+	if err != nil {
+		return
+	}
+	_, err = leaseClient.ReleaseLease(ctx, nil)
+	return
+}
+
+func (azureSecretsClient) GetSecret(ctx context.Context, keyVaultUri, secretName string) (secret string, err error) {
+	logger := logging.LoggerFromCtx(ctx)
+	logger.Info().Msgf("fetching key vault secret: %s", secretName)
+
+	credential, err := azidentity.NewDefaultAzureCredential(getCredentialOptions())
+	if err != nil {
+		logger.Error().Err(err).Send()
+		return
+	}
+
+	client, err := azsecrets.NewClient(GetKeyVaultEndpoint(keyVaultUri), credential, getSecretsClientOptions())
+	if err != nil {
+		logger.Error().Err(err).Send()
+		return
+	}
+	var resp azsecrets.GetSecretResponse
+	err = withKeyVaultDnsRetry(ctx, keyVaultUri, func() (getErr error) {
+		resp, getErr = client.GetSecret(ctx, secretName, "", nil)
+		return
+	})
+	if err != nil {
+		logger.Error().Err(err).Send()
+		return
+	}
+
+	secret = *resp.Value
+
+	return
+}
+
+func (azureComputeClient) ListScaleSetNetworkInterfaces(ctx context.Context, subscriptionId, resourceGroupName, vmScaleSetName string) (networkInterfaces []*armnetwork.Interface, err error) {
+	logger := logging.LoggerFromCtx(ctx)
+
+	credential, err := azidentity.NewDefaultAzureCredential(getCredentialOptions())
+	if err != nil {
+		logger.Error().Err(err).Send()
+		return
+	}
+
+	client, err := armnetwork.NewInterfacesClient(subscriptionId, credential, getArmClientOptions())
+	if err != nil {
+		logger.Error().Err(err).Send()
+		return
+	}
+
+	pager := client.NewListVirtualMachineScaleSetNetworkInterfacesPager(resourceGroupName, vmScaleSetName, nil)
+
+	for pager.More() {
+		nextResult, err := pager.NextPage(ctx)
+		if err != nil {
+			logger.Error().Err(err).Send()
+			return nil, err
+		}
+		networkInterfaces = append(networkInterfaces, nextResult.Value...)
+	}
+	return
+}
+
+func (azureComputeClient) ListScaleSetVms(ctx context.Context, subscriptionId, resourceGroupName, vmScaleSetName string, expand *string) (vms []*armcompute.VirtualMachineScaleSetVM, err error) {
+	logger := logging.LoggerFromCtx(ctx)
+
+	credential, err := azidentity.NewDefaultAzureCredential(getCredentialOptions())
+	if err != nil {
+		logger.Error().Err(err).Send()
+		return
+	}
+
+	client, err := armcompute.NewVirtualMachineScaleSetVMsClient(subscriptionId, credential, getArmClientOptions())
+	if err != nil {
+		logger.Error().Err(err).Send()
+		return
+	}
+
+	pager := client.NewListPager(
+		resourceGroupName, vmScaleSetName, &armcompute.VirtualMachineScaleSetVMsClientListOptions{
+			Expand: expand,
+		})
+
+	for pager.More() {
+		nextResult, err := pager.NextPage(ctx)
+		if err != nil {
+			err = fmt.Errorf("failed to advance page getting images list: %v", err)
+			logger.Error().Err(err).Send()
+			return nil, err
+		}
+		vms = append(vms, nextResult.Value...)
+	}
+	return
+}
+
+func (azureComputeClient) GetPublicIp(ctx context.Context, subscriptionId, resourceGroupName, vmScaleSetName, prefix, clusterName, instanceIndex string) (publicIp string, err error) {
+	logger := logging.LoggerFromCtx(ctx)
+
+	credential, err := azidentity.NewDefaultAzureCredential(getCredentialOptions())
+	if err != nil {
+		logger.Error().Err(err).Send()
+		return
+	}
+
+	client, err := armnetwork.NewPublicIPAddressesClient(subscriptionId, credential, getArmClientOptions())
+	if err != nil {
+		logger.Error().Err(err).Send()
+		return
+	}
+	interfaceName := fmt.Sprintf("%s-%s-backend-nic", prefix, clusterName)
+	pager := client.NewListVirtualMachineScaleSetVMPublicIPAddressesPager(resourceGroupName, vmScaleSetName, instanceIndex, interfaceName, "ipconfig1", nil)
+
+	for pager.More() {
+		nextResult, err1 := pager.NextPage(ctx)
+		if err1 != nil {
+			logger.Error().Err(err1).Send()
+			return "", err1
+		}
+		for _, ip := range nextResult.Value {
+			if ip.Properties != nil && ip.Properties.IPAddress != nil {
+				publicIp = *ip.Properties.IPAddress
+				return
+			}
+		}
+	}
+	return
+}
+
+func (azureSecretsClient) SetSecret(ctx context.Context, keyVaultUri, secretName, value string) (err error) {
+	logger := logging.LoggerFromCtx(ctx)
+
+	credential, err := azidentity.NewDefaultAzureCredential(getCredentialOptions())
+	if err != nil {
+		logger.Error().Err(err).Send()
+		return
+	}
+
+	client, err := azsecrets.NewClient(GetKeyVaultEndpoint(keyVaultUri), credential, getSecretsClientOptions())
+	if err != nil {
+		logger.Error().Err(err).Send()
+		return
+	}
+
+	// every set creates a new version of the secret, previous values remain available
+	err = withKeyVaultDnsRetry(ctx, keyVaultUri, func() (setErr error) {
+		_, setErr = client.SetSecret(ctx, secretName, azsecrets.SetSecretParameters{Value: &value}, nil)
+		return
+	})
+	if err != nil {
+		logger.Error().Err(err).Send()
+		return
+	}
+	return
+}
@@ -0,0 +1,76 @@
+package common_test
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"weka-deployment/common"
+	"weka-deployment/common/fakes"
+
+	"github.com/weka/go-cloud-lib/protocol"
+)
+
+func Test_BlobStateStoreUpdateRetriesOnConflict(t *testing.T) {
+	clients := fakes.NewClients()
+	ctx := clients.Context(context.Background())
+	store := common.BlobStateStore{}
+	err := store.WriteState(ctx, testStorageName, testContainerName, protocol.ClusterState{InitialSize: 6, DesiredSize: 6})
+	if err != nil {
+		t.Fatalf("failed writing state: %s", err)
+	}
+
+	// another writer adds an instance between the read and the write of the first attempt
+	clients.Storage.BeforeWriteIfMatch = func() {
+		clients.Storage.BeforeWriteIfMatch = nil
+		if _, err := store.UpdateState(ctx, testStorageName, testContainerName, addInstance("vm_1")); err != nil {
+			t.Errorf("failed concurrent update: %s", err)
+		}
+	}
+	attempts := 0
+	state, err := store.UpdateState(ctx, testStorageName, testContainerName, func(state *protocol.ClusterState) error {
+		attempts++
+		return addInstance("vm_0")(state)
+	})
+	if err != nil {
+		t.Fatalf("failed update: %s", err)
+	}
+	if attempts != 2 {
+		t.Errorf("expected the update to be retried once, it was applied %d times", attempts)
+	}
+	if fmt.Sprint(state.Instances) != "[vm_1 vm_0]" {
+		t.Errorf("unexpected instances: %v", state.Instances)
+	}
+
+	state, err = store.ReadState(ctx, testStorageName, testContainerName)
+	if err != nil {
+		t.Fatalf("failed reading state: %s", err)
+	}
+	if fmt.Sprint(state.Instances) != "[vm_1 vm_0]" || state.DesiredSize != 6 {
+		t.Errorf("unexpected state: %+v", state)
+	}
+}
+
+func Test_BlobStateStoreUpdateAborted(t *testing.T) {
+	clients := fakes.NewClients()
+	ctx := clients.Context(context.Background())
+	store := common.BlobStateStore{}
+	err := store.WriteState(ctx, testStorageName, testContainerName, protocol.ClusterState{InitialSize: 6, DesiredSize: 6})
+	if err != nil {
+		t.Fatalf("failed writing state: %s", err)
+	}
+
+	_, err = store.UpdateState(ctx, testStorageName, testContainerName, func(state *protocol.ClusterState) error {
+		state.Instances = append(state.Instances, "vm_0")
+		return fmt.Errorf("aborted")
+	})
+	if err == nil {
+		t.Fatalf("expected the update error")
+	}
+	state, err := store.ReadState(ctx, testStorageName, testContainerName)
+	if err != nil {
+		t.Fatalf("failed reading state: %s", err)
+	}
+	if len(state.Instances) != 0 {
+		t.Errorf("the aborted update was written: %v", state.Instances)
+	}
+}
@@ -0,0 +1,83 @@
+package common
+
+import (
+	"fmt"
+	"os"
+
+	"github.com/Azure/azure-sdk-for-go/sdk/azcore/cloud"
+)
+
+const (
+	CloudEnvironmentPublic       = "public"
+	CloudEnvironmentUsGovernment = "usgovernment"
+	CloudEnvironmentChina        = "china"
+)
+
+// CloudEnvironment holds the endpoints which differ between the public and the sovereign azure clouds
+type CloudEnvironment struct {
+	Name string
+	// active directory authority and resource manager endpoint used by the sdk clients
+	Configuration cloud.Configuration
+	// storage accounts endpoints suffix, e.g. blob.<suffix>
+	StorageSuffix string
+	// function apps host name suffix
+	FunctionAppSuffix string
+	// log analytics data collector api host name suffix
+	LogAnalyticsSuffix string
+	// token scope of the key vault data plane api
+	KeyVaultScope string
+}
+
+var cloudEnvironments = map[string]CloudEnvironment{
+	CloudEnvironmentPublic: {
+		Name:               CloudEnvironmentPublic,
+		Configuration:      cloud.AzurePublic,
+		StorageSuffix:      "core.windows.net",
+		FunctionAppSuffix:  "azurewebsites.net",
+		LogAnalyticsSuffix: "ods.opinsights.azure.com",
+		KeyVaultScope:      "https://vault.azure.net/.default",
+	},
+	CloudEnvironmentUsGovernment: {
+		Name:               CloudEnvironmentUsGovernment,
+		Configuration:      cloud.AzureGovernment,
+		StorageSuffix:      "core.usgovcloudapi.net",
+		FunctionAppSuffix:  "azurewebsites.us",
+		LogAnalyticsSuffix: "ods.opinsights.azure.us",
+		KeyVaultScope:      "https://vault.usgovcloudapi.net/.default",
+	},
+	CloudEnvironmentChina: {
+		Name:               CloudEnvironmentChina,
+		Configuration:      cloud.AzureChina,
+		StorageSuffix:      "core.chinacloudapi.cn",
+		FunctionAppSuffix:  "chinacloudsites.cn",
+		LogAnalyticsSuffix: "ods.opinsights.azure.cn",
+		KeyVaultScope:      "https://vault.azure.cn/.default",
+	},
+}
+
+// GetCloudEnvironment returns the azure cloud the function app runs in, configured by AZURE_ENVIRONMENT,
+// the public cloud is used when it is empty or unknown
+func GetCloudEnvironment() CloudEnvironment {
+	if environment, ok := cloudEnvironments[os.Getenv("AZURE_ENVIRONMENT")]; ok {
+		return environment
+	}
+	return cloudEnvironments[CloudEnvironmentPublic]
+}
+
+// GetBlobHostname returns the blob endpoint host name of the storage account, the private link one is resolved
+// by the privatelink dns zone
+func GetBlobHostname(storageName string, privateLink bool) string {
+	if privateLink {
+		return fmt.Sprintf("%s.privatelink.blob.%s", storageName, GetCloudEnvironment().StorageSuffix)
+	}
+	return fmt.Sprintf("%s.blob.%s", storageName, GetCloudEnvironment().StorageSuffix)
+}
+
+func GetBlobUrl(storageName string) string {
+	return fmt.Sprintf("https://%s/", GetBlobHostname(storageName, false))
+}
+
+// GetFunctionAppBaseUrl returns the url the function app functions are called at
+func GetFunctionAppBaseUrl(functionAppName string) string {
+	return fmt.Sprintf("https://%s.%s/api/", functionAppName, GetCloudEnvironment().FunctionAppSuffix)
+}
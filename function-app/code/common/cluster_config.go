@@ -0,0 +1,265 @@
+package common
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/Azure/azure-sdk-for-go/sdk/azcore"
+	"github.com/weka/go-cloud-lib/logging"
+)
+
+// the cluster configuration set after the deployment is kept in its own blob next to the state, its settings
+// override the app settings of the same name, so the cluster is reconfigured without redeploying the function app
+const clusterConfigBlobName = "config"
+
+// the functions instance reads the config blob at most once per ttl, set_config refreshes it right away
+const clusterConfigCacheTtl = 30 * time.Second
+
+var ErrClusterConfigVersionConflict = errors.New("cluster config version conflict")
+
+type ClusterConfig struct {
+	// incremented on every update, callers pass the version they read to avoid overwriting concurrent updates
+	Version   int               `json:"version"`
+	UpdatedAt time.Time         `json:"updated_at"`
+	Settings  map[string]string `json:"settings"`
+}
+
+// bootstrap settings locate the config blob and the cluster resources, or set up the azure clients and caches of
+// the functions instance once, they can only be set as app settings
+var bootstrapSettings = map[string]bool{
+	"SUBSCRIPTION_ID":      true,
+	"RESOURCE_GROUP_NAME":  true,
+	"LOCATION":             true,
+	"PREFIX":               true,
+	"CLUSTER_NAME":         true,
+	"STATE_STORAGE_NAME":   true,
+	"STATE_CONTAINER_NAME": true,
+	"STATE_BACKEND":        true,
+	"STATE_TABLE_NAME":     true,
+	"KEY_VAULT_URI":        true,
+	"AVAILABILITY_ZONES":   true,
+	// the functions instance settings
+	"KEY_VAULT_ENDPOINT":          true,
+	"AZURE_ENVIRONMENT":           true,
+	"AZURE_API_MAX_RETRIES":       true,
+	"KEY_VAULT_CACHE_TTL_SECONDS": true,
+	"CLUSTERIZE_MAX_CONCURRENCY":  true,
+}
+
+// ClusterConfigSnapshot is the configuration an invocation runs with, the config blob settings over the app
+// settings, it's loaded once per invocation and never changed, so concurrent invocations don't see each other's
+// updates half applied
+type ClusterConfigSnapshot struct {
+	Version  int
+	LoadedAt time.Time
+	settings map[string]string
+}
+
+func newClusterConfigSnapshot(config ClusterConfig) *ClusterConfigSnapshot {
+	settings := make(map[string]string, len(config.Settings))
+	for name, value := range config.Settings {
+		if !bootstrapSettings[name] {
+			settings[name] = value
+		}
+	}
+	return &ClusterConfigSnapshot{Version: config.Version, LoadedAt: time.Now(), settings: settings}
+}
+
+// Lookup returns the config blob setting, or the app setting when the blob doesn't set it
+func (s *ClusterConfigSnapshot) Lookup(name string) (string, bool) {
+	if s != nil {
+		if value, ok := s.settings[name]; ok {
+			return value, true
+		}
+	}
+	return os.LookupEnv(name)
+}
+
+func (s *ClusterConfigSnapshot) Get(name string) string {
+	value, _ := s.Lookup(name)
+	return value
+}
+
+var (
+	clusterConfigLock sync.Mutex
+	// the snapshot the invocations of this functions instance start with, replaced as a whole when it expires
+	cachedClusterConfig *ClusterConfigSnapshot
+)
+
+type clusterConfigCtxKey struct{}
+
+func ContextWithClusterConfig(ctx context.Context, config *ClusterConfigSnapshot) context.Context {
+	return context.WithValue(ctx, clusterConfigCtxKey{}, config)
+}
+
+// ClusterConfigFromCtx returns the snapshot of the invocation, outside of an invocation the last loaded snapshot
+func ClusterConfigFromCtx(ctx context.Context) *ClusterConfigSnapshot {
+	if config, ok := ctx.Value(clusterConfigCtxKey{}).(*ClusterConfigSnapshot); ok {
+		return config
+	}
+	clusterConfigLock.Lock()
+	defer clusterConfigLock.Unlock()
+	return cachedClusterConfig
+}
+
+// Getenv returns the setting the invocation runs with, the app settings are only read through it so the config
+// blob overrides them
+func Getenv(ctx context.Context, name string) string {
+	return ClusterConfigFromCtx(ctx).Get(name)
+}
+
+func LookupEnv(ctx context.Context, name string) (string, bool) {
+	return ClusterConfigFromCtx(ctx).Lookup(name)
+}
+
+func readClusterConfig(ctx context.Context, stateStorageName, stateContainerName string) (config ClusterConfig, etag *azcore.ETag, err error) {
+	logger := logging.LoggerFromCtx(ctx)
+
+	data, etag, err := readBlobWithETag(ctx, stateStorageName, stateContainerName, clusterConfigBlobName, true)
+	if err != nil || len(data) == 0 {
+		return
+	}
+	err = json.Unmarshal(data, &config)
+	if err != nil {
+		logger.Error().Err(err).Send()
+	}
+	return
+}
+
+func GetClusterConfig(ctx context.Context, stateStorageName, stateContainerName string) (config ClusterConfig, err error) {
+	config, _, err = readClusterConfig(ctx, stateStorageName, stateContainerName)
+	return
+}
+
+// ValidateClusterConfigSettings returns the issues of the settings to store in the config blob, a nil value
+// removes the setting, so the app setting applies again
+func ValidateClusterConfigSettings(settings map[string]*string) (issues []ConfigIssue) {
+	issues = make([]ConfigIssue, 0)
+	names := make([]string, 0, len(settings))
+	for name := range settings {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		if bootstrapSettings[name] {
+			issues = append(issues, ConfigIssue{Name: name, Error: "bootstrap setting, it can only be set as an app setting"})
+			continue
+		}
+		setting, ok := getAppSetting(name)
+		if !ok {
+			issues = append(issues, ConfigIssue{Name: name, Error: "unknown setting"})
+			continue
+		}
+		if settings[name] == nil {
+			continue
+		}
+		if *settings[name] == "" {
+			issues = append(issues, ConfigIssue{Name: name, Error: "empty value, remove the setting with null instead"})
+			continue
+		}
+		if issue := validateSetting(setting, *settings[name]); issue != nil {
+			issues = append(issues, *issue)
+		}
+	}
+	return
+}
+
+func getAppSetting(name string) (setting appSetting, ok bool) {
+	for _, setting = range functionAppSettings {
+		if setting.Name == name {
+			return setting, true
+		}
+	}
+	return
+}
+
+// UpdateClusterConfig stores the settings in the config blob and applies them to this functions instance, version is
+// the config version the settings are based on, nil skips the check
+func UpdateClusterConfig(ctx context.Context, stateStorageName, stateContainerName string, version *int, settings map[string]*string) (config ClusterConfig, err error) {
+	logger := logging.LoggerFromCtx(ctx)
+
+	if err = ConfigIssuesError(ValidateClusterConfigSettings(settings)); err != nil {
+		return
+	}
+
+	for attempt := 1; attempt <= stateUpdateMaxAttempts; attempt++ {
+		var etag *azcore.ETag
+		config, etag, err = readClusterConfig(ctx, stateStorageName, stateContainerName)
+		if err != nil {
+			return
+		}
+		if version != nil && *version != config.Version {
+			err = fmt.Errorf("%w: the settings are based on version %d, the current version is %d", ErrClusterConfigVersionConflict, *version, config.Version)
+			return
+		}
+
+		if config.Settings == nil {
+			config.Settings = make(map[string]string)
+		}
+		for name, value := range settings {
+			if value == nil {
+				delete(config.Settings, name)
+			} else {
+				config.Settings[name] = *value
+			}
+		}
+		config.Version++
+		config.UpdatedAt = time.Now().UTC()
+
+		var data []byte
+		data, err = json.Marshal(config)
+		if err != nil {
+			logger.Error().Err(err).Send()
+			return
+		}
+
+		err = writeBlobIfMatch(ctx, stateStorageName, stateContainerName, clusterConfigBlobName, data, etag)
+		if err == nil {
+			// the next invocations of this instance run with the update, the running ones keep their snapshot
+			setCachedClusterConfig(newClusterConfigSnapshot(config))
+			return
+		}
+		if !isBlobWriteConflict(err) {
+			return
+		}
+		time.Sleep(getBlobUpdateRetryDelay(attempt))
+	}
+	err = fmt.Errorf("failed to update cluster config after %d attempts: %w", stateUpdateMaxAttempts, err)
+	logger.Error().Err(err).Send()
+	return
+}
+
+func setCachedClusterConfig(config *ClusterConfigSnapshot) {
+	clusterConfigLock.Lock()
+	defer clusterConfigLock.Unlock()
+	cachedClusterConfig = config
+}
+
+// LoadClusterConfig returns the snapshot of the config blob, it's read again once the cache ttl expired, the last
+// snapshot (or the app settings only) stays in effect while the blob can't be read
+func LoadClusterConfig(ctx context.Context) (*ClusterConfigSnapshot, error) {
+	clusterConfigLock.Lock()
+	cached := cachedClusterConfig
+	clusterConfigLock.Unlock()
+	if cached != nil && time.Since(cached.LoadedAt) < clusterConfigCacheTtl {
+		return cached, nil
+	}
+
+	config, err := GetClusterConfig(ctx, Getenv(ctx, "STATE_STORAGE_NAME"), Getenv(ctx, "STATE_CONTAINER_NAME"))
+	if err != nil {
+		if cached == nil {
+			cached = newClusterConfigSnapshot(ClusterConfig{})
+		}
+		return cached, err
+	}
+	snapshot := newClusterConfigSnapshot(config)
+	setCachedClusterConfig(snapshot)
+	return snapshot, nil
+}
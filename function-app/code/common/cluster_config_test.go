@@ -0,0 +1,87 @@
+package common_test
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"weka-deployment/common"
+	"weka-deployment/common/fakes"
+)
+
+func Test_ClusterConfigOverlay(t *testing.T) {
+	t.Setenv("STATE_STORAGE_NAME", testStorageName)
+	t.Setenv("STATE_CONTAINER_NAME", testContainerName)
+	t.Setenv("HOSTS_NUM", "6")
+	t.Setenv("NFS_PROTOCOL_GATEWAYS_NUM", "0")
+	t.Cleanup(common.ResetClusterConfigCache)
+	clients := fakes.NewClients()
+	ctx := clients.Context(context.Background())
+
+	// an invocation started before the update keeps its snapshot
+	snapshot, err := common.LoadClusterConfig(ctx)
+	if err != nil {
+		t.Fatalf("failed loading the cluster config: %s", err)
+	}
+	before := common.ContextWithClusterConfig(ctx, snapshot)
+
+	hostsNum, nfsGatewaysNum := "8", "2"
+	config, err := common.UpdateClusterConfig(ctx, testStorageName, testContainerName, nil, map[string]*string{
+		"HOSTS_NUM":                 &hostsNum,
+		"NFS_PROTOCOL_GATEWAYS_NUM": &nfsGatewaysNum,
+	})
+	if err != nil {
+		t.Fatalf("failed updating the cluster config: %s", err)
+	}
+	if config.Version != 1 {
+		t.Errorf("unexpected config version: %d", config.Version)
+	}
+
+	if common.Getenv(before, "HOSTS_NUM") != "6" {
+		t.Errorf("the running invocation sees the update: HOSTS_NUM=%s", common.Getenv(before, "HOSTS_NUM"))
+	}
+	snapshot, err = common.LoadClusterConfig(ctx)
+	if err != nil {
+		t.Fatalf("failed loading the cluster config: %s", err)
+	}
+	after := common.ContextWithClusterConfig(ctx, snapshot)
+	if common.Getenv(after, "HOSTS_NUM") != "8" || common.Getenv(after, "NFS_PROTOCOL_GATEWAYS_NUM") != "2" {
+		t.Errorf("the config blob doesn't override the app settings: HOSTS_NUM=%s, NFS_PROTOCOL_GATEWAYS_NUM=%s",
+			common.Getenv(after, "HOSTS_NUM"), common.Getenv(after, "NFS_PROTOCOL_GATEWAYS_NUM"))
+	}
+
+	// a removed setting falls back to the app setting
+	version := 1
+	if _, err = common.UpdateClusterConfig(ctx, testStorageName, testContainerName, &version, map[string]*string{"HOSTS_NUM": nil}); err != nil {
+		t.Fatalf("failed updating the cluster config: %s", err)
+	}
+	snapshot, err = common.LoadClusterConfig(ctx)
+	if err != nil {
+		t.Fatalf("failed loading the cluster config: %s", err)
+	}
+	after = common.ContextWithClusterConfig(ctx, snapshot)
+	if common.Getenv(after, "HOSTS_NUM") != "6" || common.Getenv(after, "NFS_PROTOCOL_GATEWAYS_NUM") != "2" {
+		t.Errorf("unexpected settings after the removal: HOSTS_NUM=%s, NFS_PROTOCOL_GATEWAYS_NUM=%s",
+			common.Getenv(after, "HOSTS_NUM"), common.Getenv(after, "NFS_PROTOCOL_GATEWAYS_NUM"))
+	}
+
+	// an update based on a stale version is rejected
+	_, err = common.UpdateClusterConfig(ctx, testStorageName, testContainerName, &version, map[string]*string{"HOSTS_NUM": &hostsNum})
+	if !errors.Is(err, common.ErrClusterConfigVersionConflict) {
+		t.Errorf("expected a version conflict, got: %v", err)
+	}
+}
+
+func Test_ClusterConfigRejectsBootstrapSettings(t *testing.T) {
+	t.Cleanup(common.ResetClusterConfigCache)
+	clients := fakes.NewClients()
+	ctx := clients.Context(context.Background())
+
+	stateStorageName, hostsNum := "otherstorage", "5"
+	issues := common.ValidateClusterConfigSettings(map[string]*string{"STATE_STORAGE_NAME": &stateStorageName, "HOSTS_NUM": &hostsNum})
+	if len(issues) != 2 || issues[0].Name != "HOSTS_NUM" || issues[1].Name != "STATE_STORAGE_NAME" {
+		t.Errorf("unexpected issues: %v", issues)
+	}
+	if _, err := common.UpdateClusterConfig(ctx, testStorageName, testContainerName, nil, map[string]*string{"STATE_STORAGE_NAME": &stateStorageName}); err == nil {
+		t.Errorf("the bootstrap setting was stored in the config blob")
+	}
+}
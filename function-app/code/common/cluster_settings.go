@@ -0,0 +1,127 @@
+package common
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/Azure/azure-sdk-for-go/sdk/azcore"
+	"github.com/weka/go-cloud-lib/logging"
+)
+
+// settings changed after the deployment are kept in their own blob next to the state,
+// the state format is shared with the other clouds
+const clusterSettingsBlobName = "settings"
+
+type ClusterSettings struct {
+	// desired hot spare count, nil until set post deployment
+	Hotspare *int `json:"hotspare,omitempty"`
+	// stripe of the live cluster, nil until recorded by data_protection, e.g. for an adopted cluster created with
+	// other values than the app settings
+	StripeWidth     *int `json:"stripe_width,omitempty"`
+	ProtectionLevel *int `json:"protection_level,omitempty"`
+	// the failure domains of the containers are the azure fault domains of their vms, set by clusterize
+	AzureFaultDomains bool `json:"azure_fault_domains,omitempty"`
+	// nil until maintenance mode is toggled
+	Maintenance *MaintenanceMode `json:"maintenance,omitempty"`
+}
+
+func readClusterSettings(ctx context.Context, stateStorageName, stateContainerName string) (settings ClusterSettings, etag *azcore.ETag, err error) {
+	logger := logging.LoggerFromCtx(ctx)
+
+	data, etag, err := readBlobWithETag(ctx, stateStorageName, stateContainerName, clusterSettingsBlobName, true)
+	if err != nil || len(data) == 0 {
+		return
+	}
+	err = json.Unmarshal(data, &settings)
+	if err != nil {
+		logger.Error().Err(err).Send()
+	}
+	return
+}
+
+func GetClusterSettings(ctx context.Context, stateStorageName, stateContainerName string) (settings ClusterSettings, err error) {
+	settings, _, err = readClusterSettings(ctx, stateStorageName, stateContainerName)
+	return
+}
+
+// UpdateClusterSettings applies update on the current settings with the same conflict handling as UpdateState
+func UpdateClusterSettings(ctx context.Context, stateStorageName, stateContainerName string, update func(settings *ClusterSettings) error) (settings ClusterSettings, err error) {
+	logger := logging.LoggerFromCtx(ctx)
+
+	for attempt := 1; attempt <= stateUpdateMaxAttempts; attempt++ {
+		var etag *azcore.ETag
+		settings, etag, err = readClusterSettings(ctx, stateStorageName, stateContainerName)
+		if err != nil {
+			return
+		}
+		err = update(&settings)
+		if err != nil {
+			return
+		}
+
+		var data []byte
+		data, err = json.Marshal(settings)
+		if err != nil {
+			logger.Error().Err(err).Send()
+			return
+		}
+
+		err = writeBlobIfMatch(ctx, stateStorageName, stateContainerName, clusterSettingsBlobName, data, etag)
+		if err == nil || !isBlobWriteConflict(err) {
+			return
+		}
+		time.Sleep(getBlobUpdateRetryDelay(attempt))
+	}
+	err = fmt.Errorf("failed to update cluster settings after %d attempts: %w", stateUpdateMaxAttempts, err)
+	logger.Error().Err(err).Send()
+	return
+}
+
+// DataProtection is the stripe layout of the weka cluster
+type DataProtection struct {
+	StripeWidth     int `json:"stripe_width"`
+	ProtectionLevel int `json:"protection_level"`
+	Hotspare        int `json:"hotspare"`
+}
+
+// GetDataProtection returns the data protection the cluster was created with, overridden by the values recorded
+// in the settings after the clusterization
+func (s ClusterSettings) GetDataProtection(ctx context.Context) (protection DataProtection) {
+	protection.StripeWidth, _ = strconv.Atoi(Getenv(ctx, "STRIPE_WIDTH"))
+	protection.ProtectionLevel, _ = strconv.Atoi(Getenv(ctx, "PROTECTION_LEVEL"))
+	protection.Hotspare, _ = strconv.Atoi(Getenv(ctx, "HOTSPARE"))
+	if s.StripeWidth != nil {
+		protection.StripeWidth = *s.StripeWidth
+	}
+	if s.ProtectionLevel != nil {
+		protection.ProtectionLevel = *s.ProtectionLevel
+	}
+	if s.Hotspare != nil {
+		protection.Hotspare = *s.Hotspare
+	}
+	return
+}
+
+func GetDataProtection(ctx context.Context, stateStorageName, stateContainerName string) (protection DataProtection, err error) {
+	settings, err := GetClusterSettings(ctx, stateStorageName, stateContainerName)
+	if err != nil {
+		return
+	}
+	protection = settings.GetDataProtection(ctx)
+	return
+}
+
+// ValidateHotspare checks the stripe still fits the failure domains (one per backend) once the hot spares are reserved
+func ValidateHotspare(hotspare, stripeWidth, protectionLevel, backendsNum int) error {
+	if hotspare < 0 {
+		return fmt.Errorf("invalid hot spare %d, it can't be negative", hotspare)
+	}
+	if stripeWidth+protectionLevel+hotspare > backendsNum {
+		return fmt.Errorf("invalid hot spare %d, stripe width %d + protection level %d + hot spare must not exceed the %d backends",
+			hotspare, stripeWidth, protectionLevel, backendsNum)
+	}
+	return nil
+}
@@ -0,0 +1,110 @@
+package common
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/Azure/azure-sdk-for-go/sdk/azcore"
+	"github.com/weka/go-cloud-lib/logging"
+)
+
+// the result of the last cluster validation is kept in its own blob next to the state
+const clusterValidationBlobName = "cluster_validation"
+
+const (
+	// the reports of the cluster validation script have this phase
+	ClusterValidationReportPhase = "cluster_validation"
+	// the filesystem created by the clusterization
+	DefaultFilesystemName = "default"
+)
+
+const (
+	ClusterValidationStatusUnknown = "unknown"
+	ClusterValidationStatusPending = "pending"
+	ClusterValidationStatusPassed  = "passed"
+	ClusterValidationStatusFailed  = "failed"
+)
+
+type ClusterValidation struct {
+	Status     string `json:"status"`
+	Message    string `json:"message,omitempty"`
+	Filesystem string `json:"filesystem,omitempty"`
+	// the checks results, the object store upload is only checked when obs is attached
+	IoPassed    *bool `json:"io_passed,omitempty"`
+	ObsUploaded *bool `json:"obs_uploaded,omitempty"`
+	// the backend the validation ran on
+	Instance    string    `json:"instance,omitempty"`
+	CheckedAt   time.Time `json:"checked_at,omitempty"`
+	RequestedAt time.Time `json:"requested_at,omitempty"`
+}
+
+func readClusterValidation(ctx context.Context, stateStorageName, stateContainerName string) (validation ClusterValidation, etag *azcore.ETag, err error) {
+	logger := logging.LoggerFromCtx(ctx)
+
+	data, etag, err := readBlobWithETag(ctx, stateStorageName, stateContainerName, clusterValidationBlobName, true)
+	if err != nil {
+		return
+	}
+	if len(data) == 0 {
+		validation = ClusterValidation{Status: ClusterValidationStatusUnknown}
+		return
+	}
+	if err = json.Unmarshal(data, &validation); err != nil {
+		logger.Error().Err(err).Send()
+	}
+	return
+}
+
+func GetClusterValidation(ctx context.Context, stateStorageName, stateContainerName string) (validation ClusterValidation, err error) {
+	validation, _, err = readClusterValidation(ctx, stateStorageName, stateContainerName)
+	return
+}
+
+// UpdateClusterValidation applies the update to the cluster validation, with the same conflict handling as UpdateState
+func UpdateClusterValidation(ctx context.Context, stateStorageName, stateContainerName string, update func(validation *ClusterValidation)) (validation ClusterValidation, err error) {
+	logger := logging.LoggerFromCtx(ctx)
+
+	for attempt := 1; attempt <= stateUpdateMaxAttempts; attempt++ {
+		var etag *azcore.ETag
+		validation, etag, err = readClusterValidation(ctx, stateStorageName, stateContainerName)
+		if err != nil {
+			return
+		}
+		update(&validation)
+
+		var data []byte
+		data, err = json.Marshal(validation)
+		if err != nil {
+			logger.Error().Err(err).Send()
+			return
+		}
+
+		err = writeBlobIfMatch(ctx, stateStorageName, stateContainerName, clusterValidationBlobName, data, etag)
+		if err == nil || !isBlobWriteConflict(err) {
+			return
+		}
+		time.Sleep(getBlobUpdateRetryDelay(attempt))
+	}
+	err = fmt.Errorf("failed to update cluster validation after %d attempts: %w", stateUpdateMaxAttempts, err)
+	logger.Error().Err(err).Send()
+	return
+}
+
+// RecordClusterValidation stores the result reported by the cluster validation script, the validation passed when
+// the test object was read back and, if it was checked, uploaded to the object store
+func RecordClusterValidation(ctx context.Context, stateStorageName, stateContainerName string, report ProgressReport) error {
+	_, err := UpdateClusterValidation(ctx, stateStorageName, stateContainerName, func(validation *ClusterValidation) {
+		validation.IoPassed = report.IoPassed
+		validation.ObsUploaded = report.ObsUploaded
+		validation.Status = ClusterValidationStatusFailed
+		if report.IoPassed != nil && *report.IoPassed && (report.ObsUploaded == nil || *report.ObsUploaded) {
+			validation.Status = ClusterValidationStatusPassed
+		}
+		validation.Message = report.Message
+		validation.Instance = report.Instance
+		validation.CheckedAt = time.Now().UTC()
+	})
+	return err
+}
@@ -0,0 +1,80 @@
+package common
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/Azure/azure-sdk-for-go/sdk/azcore"
+	"github.com/weka/go-cloud-lib/logging"
+)
+
+// the clusterize responses are kept until the clusterization is finalized, so an instance retrying
+// the clusterize call gets the same script instead of generating it again
+const clusterizeResponsesBlobName = "clusterize_responses"
+
+// ClusterizeResponses holds the clusterize response of each instance by vm name
+type ClusterizeResponses map[string]string
+
+func readClusterizeResponses(ctx context.Context, stateStorageName, stateContainerName string) (responses ClusterizeResponses, etag *azcore.ETag, err error) {
+	logger := logging.LoggerFromCtx(ctx)
+
+	data, etag, err := readBlobWithETag(ctx, stateStorageName, stateContainerName, clusterizeResponsesBlobName, true)
+	if err != nil {
+		return
+	}
+	responses = make(ClusterizeResponses)
+	if len(data) == 0 {
+		return
+	}
+	err = json.Unmarshal(data, &responses)
+	if err != nil {
+		logger.Error().Err(err).Send()
+	}
+	return
+}
+
+func GetClusterizeResponse(ctx context.Context, stateStorageName, stateContainerName, instanceName string) (response string, found bool, err error) {
+	responses, _, err := readClusterizeResponses(ctx, stateStorageName, stateContainerName)
+	if err != nil {
+		return
+	}
+	response, found = responses[instanceName]
+	return
+}
+
+func SaveClusterizeResponse(ctx context.Context, stateStorageName, stateContainerName, instanceName, response string) (err error) {
+	logger := logging.LoggerFromCtx(ctx)
+
+	for attempt := 1; attempt <= stateUpdateMaxAttempts; attempt++ {
+		var responses ClusterizeResponses
+		var etag *azcore.ETag
+		responses, etag, err = readClusterizeResponses(ctx, stateStorageName, stateContainerName)
+		if err != nil {
+			return
+		}
+		responses[instanceName] = response
+
+		var data []byte
+		data, err = json.Marshal(responses)
+		if err != nil {
+			logger.Error().Err(err).Send()
+			return
+		}
+
+		err = writeBlobIfMatch(ctx, stateStorageName, stateContainerName, clusterizeResponsesBlobName, data, etag)
+		if err == nil || !isBlobWriteConflict(err) {
+			return
+		}
+		time.Sleep(getBlobUpdateRetryDelay(attempt))
+	}
+	err = fmt.Errorf("failed to save clusterize response after %d attempts: %w", stateUpdateMaxAttempts, err)
+	logger.Error().Err(err).Send()
+	return
+}
+
+// DeleteClusterizeResponses is called once the cluster is clusterized, the responses hold the weka password
+func DeleteClusterizeResponses(ctx context.Context, stateStorageName, stateContainerName string) error {
+	return DeleteBlobObject(ctx, stateStorageName, stateContainerName, clusterizeResponsesBlobName)
+}
@@ -3,20 +3,37 @@ package common
 import (
 	"bytes"
 	"context"
+	cryptoRand "crypto/rand"
 	"encoding/json"
+	"errors"
 	"fmt"
-	"io"
+	"math/big"
+	"math/rand"
+	"net/http"
+	"net/url"
+	"path"
+	"sort"
+	"strconv"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/Azure/azure-sdk-for-go/sdk/azcore"
+	"github.com/Azure/azure-sdk-for-go/sdk/azcore/arm"
+	"github.com/Azure/azure-sdk-for-go/sdk/azcore/runtime"
+	"github.com/Azure/azure-sdk-for-go/sdk/azcore/to"
 	"github.com/Azure/azure-sdk-for-go/sdk/azidentity"
-	"github.com/Azure/azure-sdk-for-go/sdk/keyvault/azsecrets"
 	"github.com/Azure/azure-sdk-for-go/sdk/resourcemanager/authorization/armauthorization/v2"
+	"github.com/Azure/azure-sdk-for-go/sdk/resourcemanager/cdn/armcdn"
 	"github.com/Azure/azure-sdk-for-go/sdk/resourcemanager/compute/armcompute"
+	"github.com/Azure/azure-sdk-for-go/sdk/resourcemanager/dataprotection/armdataprotection"
+	"github.com/Azure/azure-sdk-for-go/sdk/resourcemanager/keyvault/armkeyvault"
 	"github.com/Azure/azure-sdk-for-go/sdk/resourcemanager/network/armnetwork"
+	"github.com/Azure/azure-sdk-for-go/sdk/resourcemanager/privatedns/armprivatedns"
+	"github.com/Azure/azure-sdk-for-go/sdk/resourcemanager/resources/armlocks"
 	"github.com/Azure/azure-sdk-for-go/sdk/resourcemanager/storage/armstorage"
 	"github.com/Azure/azure-sdk-for-go/sdk/storage/azblob"
+	"github.com/Azure/azure-sdk-for-go/sdk/storage/azblob/bloberror"
 	"github.com/google/uuid"
 	"github.com/weka/go-cloud-lib/lib/types"
 	"github.com/weka/go-cloud-lib/logging"
@@ -43,16 +60,38 @@ for d in json.load(sys.stdin)['disks']:
 	print(d['devPath'])
 `
 
+// FindHostDrivesScript prints the nvme devices of a weka container hardware info, the disks are nested under the
+// container id and the host info, they are searched for in the whole document
+const FindHostDrivesScript = `
+import json
+import sys
+def disks(o):
+	if isinstance(o, dict):
+		if 'devPath' in o and 'isRotational' in o:
+			yield o
+			return
+		for v in o.values():
+			yield from disks(v)
+	elif isinstance(o, list):
+		for v in o:
+			yield from disks(v)
+seen = set()
+for d in disks(json.load(sys.stdin)):
+	if d['isRotational'] or 'nvme' not in d['devPath'] or d['devPath'] in seen: continue
+	seen.add(d['devPath'])
+	print(d['devPath'])
+`
+
 func leaseContainer(ctx context.Context, subscriptionId, resourceGroupName, storageAccountName, containerName string, leaseIdIn *string, action armstorage.LeaseContainerRequestAction) (leaseIdOut *string, err error) {
 	logger := logging.LoggerFromCtx(ctx)
 
-	credential, err := azidentity.NewDefaultAzureCredential(nil)
+	credential, err := azidentity.NewDefaultAzureCredential(getCredentialOptions())
 	if err != nil {
 		logger.Error().Msgf("azidentity.NewDefaultAzureCredential: %s", err)
 		return
 	}
 
-	containerClient, err := armstorage.NewBlobContainersClient(subscriptionId, credential, nil)
+	containerClient, err := armstorage.NewBlobContainersClient(subscriptionId, credential, getArmClientOptions())
 	duration := int32(60)
 	for i := 1; i < 1000; i++ {
 		lease, err2 := containerClient.Lease(ctx, resourceGroupName, storageAccountName, containerName,
@@ -100,73 +139,59 @@ func UnlockContainer(ctx context.Context, subscriptionId, resourceGroupName, sto
 }
 
 func ReadBlobObject(ctx context.Context, stateStorageName, containerName, blobName string) (state []byte, err error) {
-	logger := logging.LoggerFromCtx(ctx)
-
-	credential, err := azidentity.NewDefaultAzureCredential(nil)
-	if err != nil {
-		logger.Error().Msgf("azidentity.NewDefaultAzureCredential: %s", err)
-		return
-	}
+	state, _, err = readBlobWithETag(ctx, stateStorageName, containerName, blobName, false)
+	return
+}
 
-	blobClient, err := azblob.NewClient(getBlobUrl(stateStorageName), credential, nil)
-	if err != nil {
-		logger.Error().Msgf("azblob.NewClient: %s", err)
-		return
-	}
+func ReadState(ctx context.Context, stateStorageName, containerName string) (state protocol.ClusterState, err error) {
+	return ClientsFromCtx(ctx).State.ReadState(ctx, stateStorageName, containerName)
+}
 
-	downloadResponse, err := blobClient.DownloadStream(ctx, containerName, blobName, nil)
-	if err != nil {
-		logger.Error().Msgf("blobClient.DownloadStream: %s", err)
-		return
-	}
+func WriteBlobObject(ctx context.Context, stateStorageName, containerName, blobName string, state []byte) (err error) {
+	return ClientsFromCtx(ctx).Storage.WriteBlob(ctx, stateStorageName, containerName, blobName, state)
+}
 
-	state, err = io.ReadAll(downloadResponse.Body)
-	if err != nil {
-		logger.Error().Err(err).Send()
-	}
+func WriteState(ctx context.Context, stateStorageName, containerName string, state protocol.ClusterState) (err error) {
+	return ClientsFromCtx(ctx).State.WriteState(ctx, stateStorageName, containerName, state)
+}
 
-	return
+const (
+	stateUpdateMaxAttempts = 10
+	stateUpdateRetryDelay  = 200 * time.Millisecond
+)
 
+// readBlobWithETag returns the blob content and the etag used for a conditional write,
+// a missing blob is returned as empty with a nil etag when allowMissing is set
+func readBlobWithETag(ctx context.Context, storageName, containerName, blobName string, allowMissing bool) (data []byte, etag *azcore.ETag, err error) {
+	return ClientsFromCtx(ctx).Storage.ReadBlob(ctx, storageName, containerName, blobName, allowMissing)
 }
 
-func ReadState(ctx context.Context, stateStorageName, containerName string) (state protocol.ClusterState, err error) {
-	logger := logging.LoggerFromCtx(ctx)
-
-	stateAsByteArray, err := ReadBlobObject(ctx, stateStorageName, containerName, "state")
-	if err != nil {
-		return
-	}
-	err = json.Unmarshal(stateAsByteArray, &state)
-	if err != nil {
-		logger.Error().Err(err).Send()
-		return
-	}
+// writeBlobIfMatch fails with bloberror.ConditionNotMet when the blob was changed since it was read,
+// a nil etag means the blob must not exist yet (bloberror.BlobAlreadyExists otherwise)
+func writeBlobIfMatch(ctx context.Context, storageName, containerName, blobName string, data []byte, etag *azcore.ETag) (err error) {
+	return ClientsFromCtx(ctx).Storage.WriteBlobIfMatch(ctx, storageName, containerName, blobName, data, etag)
+}
 
-	return
+// isBlobWriteConflict is true when a conditional write lost the race to another writer
+func isBlobWriteConflict(err error) bool {
+	return bloberror.HasCode(err, bloberror.ConditionNotMet, bloberror.BlobAlreadyExists)
 }
 
-func WriteBlobObject(ctx context.Context, stateStorageName, containerName, blobName string, state []byte) (err error) {
+func readStateWithETag(ctx context.Context, stateStorageName, containerName string) (state protocol.ClusterState, etag *azcore.ETag, err error) {
 	logger := logging.LoggerFromCtx(ctx)
 
-	credential, err := azidentity.NewDefaultAzureCredential(nil)
+	stateAsByteArray, etag, err := readBlobWithETag(ctx, stateStorageName, containerName, "state", false)
 	if err != nil {
-		logger.Error().Err(err).Send()
 		return
 	}
-
-	blobClient, err := azblob.NewClient(getBlobUrl(stateStorageName), credential, nil)
+	err = json.Unmarshal(stateAsByteArray, &state)
 	if err != nil {
 		logger.Error().Err(err).Send()
-		return
 	}
-
-	_, err = blobClient.UploadBuffer(ctx, containerName, blobName, state, &azblob.UploadBufferOptions{})
-
 	return
-
 }
 
-func WriteState(ctx context.Context, stateStorageName, containerName string, state protocol.ClusterState) (err error) {
+func writeStateIfMatch(ctx context.Context, stateStorageName, containerName string, state protocol.ClusterState, etag *azcore.ETag) (err error) {
 	logger := logging.LoggerFromCtx(ctx)
 
 	stateAsByteArray, err := json.Marshal(state)
@@ -174,13 +199,17 @@ func WriteState(ctx context.Context, stateStorageName, containerName string, sta
 		logger.Error().Err(err).Send()
 		return
 	}
+	return writeBlobIfMatch(ctx, stateStorageName, containerName, "state", stateAsByteArray, etag)
+}
 
-	err = WriteBlobObject(ctx, stateStorageName, containerName, "state", stateAsByteArray)
-	return
+// randomized backoff spreads the writers that lost the race
+func getBlobUpdateRetryDelay(attempt int) time.Duration {
+	return stateUpdateRetryDelay*time.Duration(attempt) + time.Duration(rand.Int63n(int64(stateUpdateRetryDelay)))
 }
 
-func getBlobUrl(storageName string) string {
-	return fmt.Sprintf("https://%s.blob.core.windows.net/", storageName)
+// UpdateState applies update on the current state, see StateStore
+func UpdateState(ctx context.Context, stateStorageName, containerName string, update func(state *protocol.ClusterState) error) (state protocol.ClusterState, err error) {
+	return ClientsFromCtx(ctx).State.UpdateState(ctx, stateStorageName, containerName, update)
 }
 
 type ShutdownRequired struct {
@@ -194,91 +223,111 @@ func (e *ShutdownRequired) Error() string {
 func AddInstanceToState(ctx context.Context, subscriptionId, resourceGroupName, stateStorageName, stateContainerName, newInstance string) (state protocol.ClusterState, err error) {
 	logger := logging.LoggerFromCtx(ctx)
 
-	leaseId, err := LockContainer(ctx, subscriptionId, resourceGroupName, stateStorageName, stateContainerName)
-	if err != nil {
-		return
-	}
-
-	state, err = ReadState(ctx, stateStorageName, stateContainerName)
-	if err != nil {
-		return
-	}
-
-	if len(state.Instances) >= state.InitialSize {
-		message := "cluster size is already satisfied"
-		err = &ShutdownRequired{
-			Message: message,
+	// a retried call of the same instance must not be counted twice, instances are keyed by the vm name
+	newInstanceName := strings.Split(newInstance, ":")[0]
+	state, err = UpdateState(ctx, stateStorageName, stateContainerName, func(state *protocol.ClusterState) error {
+		for _, instance := range state.Instances {
+			if strings.Split(instance, ":")[0] == newInstanceName {
+				logger.Info().Msgf("instance %s is already in state", newInstanceName)
+				return nil
+			}
 		}
-		logger.Error().Err(err).Send()
-	} else if state.Clusterized {
-		err = &ShutdownRequired{
-			Message: "cluster is already clusterized",
+		if len(state.Instances) >= state.InitialSize {
+			return &ShutdownRequired{
+				Message: "cluster size is already satisfied",
+			}
+		} else if state.Clusterized {
+			return &ShutdownRequired{
+				Message: "cluster is already clusterized",
+			}
 		}
-		logger.Error().Err(err).Send()
-	} else {
 		state.Instances = append(state.Instances, newInstance)
-		err = WriteState(ctx, stateStorageName, stateContainerName, state)
-	}
-	_, err2 := UnlockContainer(ctx, subscriptionId, resourceGroupName, stateStorageName, stateContainerName, leaseId)
-	if err2 != nil {
-		if err == nil {
-			err = err2
-		}
-		logger.Error().Msgf("unlocking %s failed", stateStorageName)
+		return nil
+	})
+	if _, ok := err.(*ShutdownRequired); ok {
+		logger.Error().Err(err).Send()
 	}
 	return
 }
 
-func UpdateClusterized(ctx context.Context, subscriptionId, resourceGroupName, stateStorageName, stateContainerName string) (state protocol.ClusterState, err error) {
+// UpdateDesiredSize persists the desired backends number, after clusterization it replaces HOSTS_NUM as the cluster size
+func UpdateDesiredSize(ctx context.Context, subscriptionId, resourceGroupName, stateStorageName, stateContainerName string, newSize int) (oldSize int, err error) {
 	logger := logging.LoggerFromCtx(ctx)
 
-	leaseId, err := LockContainer(ctx, subscriptionId, resourceGroupName, stateStorageName, stateContainerName)
-	if err != nil {
-		return
-	}
-
-	state, err = ReadState(ctx, stateStorageName, stateContainerName)
+	_, err = UpdateState(ctx, stateStorageName, stateContainerName, func(state *protocol.ClusterState) error {
+		if !state.Clusterized {
+			return fmt.Errorf("weka cluster is not ready")
+		}
+		oldSize = state.DesiredSize
+		state.DesiredSize = newSize
+		return nil
+	})
 	if err != nil {
-		return
+		logger.Error().Err(err).Send()
 	}
+	return
+}
 
-	state.Instances = []string{}
-	state.Clusterized = true
-	err = WriteState(ctx, stateStorageName, stateContainerName, state)
-	_, err2 := UnlockContainer(ctx, subscriptionId, resourceGroupName, stateStorageName, stateContainerName, leaseId)
-	if err2 != nil {
-		if err == nil {
-			err = err2
-		}
-		logger.Error().Msgf("unlocking %s failed", stateStorageName)
-	}
+func UpdateClusterized(ctx context.Context, subscriptionId, resourceGroupName, stateStorageName, stateContainerName string) (state protocol.ClusterState, err error) {
+	state, err = UpdateState(ctx, stateStorageName, stateContainerName, func(state *protocol.ClusterState) error {
+		state.Instances = []string{}
+		state.Clusterized = true
+		return nil
+	})
 	return
 }
 
-func CreateStorageAccount(ctx context.Context, subscriptionId, resourceGroupName, obsName, location string) (accessKey string, err error) {
+// StoragePrivateEndpoint places a storage account behind a private endpoint, public network access is disabled
+type StoragePrivateEndpoint struct {
+	SubnetId string
+	// resource id of the privatelink.blob.<storage suffix> private dns zone
+	PrivateDnsZoneId string
+}
+
+// storage accounts created by the function app are tagged, so they can be told apart from the user provided ones on cleanup
+const (
+	CreatedByTag         = "created_by"
+	CreatedByFunctionApp = "weka-function-app"
+	WekaClusterTag       = "weka_cluster"
+)
+
+// CreateStorageAccount creates the obs storage account, with a customer managed key the account is encrypted
+// with it once created
+func CreateStorageAccount(
+	ctx context.Context, subscriptionId, resourceGroupName, obsName, location, clusterName string,
+	privateEndpoint *StoragePrivateEndpoint, customerManagedKey *StorageCustomerManagedKey,
+) (accessKey string, err error) {
 	logger := logging.LoggerFromCtx(ctx)
 	logger.Info().Msgf("creating storage account: %s", obsName)
 
-	credential, err := azidentity.NewDefaultAzureCredential(nil)
+	credential, err := azidentity.NewDefaultAzureCredential(getCredentialOptions())
 	if err != nil {
 		logger.Error().Err(err).Send()
 		return
 	}
 
-	client, err := armstorage.NewAccountsClient(subscriptionId, credential, nil)
+	client, err := armstorage.NewAccountsClient(subscriptionId, credential, getArmClientOptions())
 	if err != nil {
 		logger.Error().Err(err).Send()
 		return
 	}
 	skuName := armstorage.SKUNameStandardZRS
 	kind := armstorage.KindStorageV2
-	_, err = client.BeginCreate(ctx, resourceGroupName, obsName, armstorage.AccountCreateParameters{
+	createParameters := armstorage.AccountCreateParameters{
 		Kind:     &kind,
 		Location: &location,
 		SKU: &armstorage.SKU{
 			Name: &skuName,
 		},
-	}, nil)
+		Tags:     GetResourceTags(ctx, clusterName),
+		Identity: getStorageAccountIdentity(customerManagedKey),
+	}
+	if privateEndpoint != nil {
+		createParameters.Properties = &armstorage.AccountPropertiesCreateParameters{
+			PublicNetworkAccess: to.Ptr(armstorage.PublicNetworkAccessDisabled),
+		}
+	}
+	_, err = client.BeginCreate(ctx, resourceGroupName, obsName, createParameters, nil)
 
 	if err != nil {
 		if azerr, ok := err.(*azcore.ResponseError); ok {
@@ -317,207 +366,312 @@ func CreateStorageAccount(ctx context.Context, subscriptionId, resourceGroupName
 		}
 	}
 
+	if err == nil && customerManagedKey != nil {
+		err = configureStorageCustomerManagedKey(ctx, subscriptionId, resourceGroupName, obsName, *customerManagedKey)
+	}
+
+	if err == nil && privateEndpoint != nil {
+		err = createStoragePrivateEndpoint(ctx, subscriptionId, resourceGroupName, obsName, location, *privateEndpoint)
+	}
+
 	return
 }
 
-func getStorageAccountAccessKey(ctx context.Context, subscriptionId, resourceGroupName, obsName string) (accessKey string, err error) {
+// Creates a blob private endpoint for the storage account and registers it in the private dns zone
+// see https://learn.microsoft.com/en-us/azure/storage/common/storage-private-endpoints
+func getStoragePrivateEndpointName(storageAccountName string) string {
+	return fmt.Sprintf("%s-blob-pe", storageAccountName)
+}
+
+// ListFunctionCreatedStorageAccounts returns the storage accounts the function app created for the cluster
+func ListFunctionCreatedStorageAccounts(ctx context.Context, subscriptionId, resourceGroupName, clusterName string) (storageAccountNames []string, err error) {
 	logger := logging.LoggerFromCtx(ctx)
 
-	credential, err := azidentity.NewDefaultAzureCredential(nil)
+	credential, err := azidentity.NewDefaultAzureCredential(getCredentialOptions())
 	if err != nil {
 		logger.Error().Err(err).Send()
 		return
 	}
 
-	client, err := armstorage.NewAccountsClient(subscriptionId, credential, nil)
+	client, err := armstorage.NewAccountsClient(subscriptionId, credential, getArmClientOptions())
 	if err != nil {
 		logger.Error().Err(err).Send()
 		return
 	}
-	keys, err := client.ListKeys(ctx, resourceGroupName, obsName, nil)
-	if err != nil {
-		logger.Error().Err(err).Send()
-		return
+
+	pager := client.NewListByResourceGroupPager(resourceGroupName, nil)
+	for pager.More() {
+		nextResult, pageErr := pager.NextPage(ctx)
+		if pageErr != nil {
+			err = pageErr
+			logger.Error().Err(err).Send()
+			return
+		}
+		for _, account := range nextResult.Value {
+			createdBy, cluster := account.Tags[CreatedByTag], account.Tags[WekaClusterTag]
+			if createdBy != nil && *createdBy == CreatedByFunctionApp && cluster != nil && *cluster == clusterName {
+				storageAccountNames = append(storageAccountNames, *account.Name)
+			}
+		}
 	}
-	accessKey = *keys.Keys[0].Value
 	return
 }
 
-func CreateContainer(ctx context.Context, storageAccountName, containerName string) (err error) {
+// DeleteStorageAccount deletes the storage account along with the private endpoint created for it
+func DeleteStorageAccount(ctx context.Context, subscriptionId, resourceGroupName, storageAccountName string) (err error) {
 	logger := logging.LoggerFromCtx(ctx)
-	logger.Info().Msgf("creating obs container %s in storage account %s", containerName, storageAccountName)
+	logger.Info().Msgf("deleting storage account: %s", storageAccountName)
 
-	credential, err := azidentity.NewDefaultAzureCredential(nil)
+	credential, err := azidentity.NewDefaultAzureCredential(getCredentialOptions())
 	if err != nil {
 		logger.Error().Err(err).Send()
 		return
 	}
 
-	blobClient, err := azblob.NewClient(getBlobUrl(storageAccountName), credential, nil)
+	endpointsClient, err := armnetwork.NewPrivateEndpointsClient(subscriptionId, credential, getArmClientOptions())
 	if err != nil {
 		logger.Error().Err(err).Send()
 		return
 	}
-
-	_, err = blobClient.CreateContainer(ctx, containerName, nil)
-	if err != nil {
-		if azerr, ok := err.(*azcore.ResponseError); ok {
-			if azerr.ErrorCode == "ContainerAlreadyExists" {
-				logger.Info().Msgf("obs container %s already exists", containerName)
-				err = nil
-				return
-			}
-		}
-		logger.Error().Msgf("obs container creation failed: %s", err)
+	poller, err := endpointsClient.BeginDelete(ctx, resourceGroupName, getStoragePrivateEndpointName(storageAccountName), nil)
+	if err == nil {
+		_, err = poller.PollUntilDone(ctx, nil)
 	}
-	return
-}
-
-func GetKeyVaultValue(ctx context.Context, keyVaultUri, secretName string) (secret string, err error) {
-	logger := logging.LoggerFromCtx(ctx)
-	logger.Info().Msgf("fetching key vault secret: %s", secretName)
-
-	credential, err := azidentity.NewDefaultAzureCredential(nil)
 	if err != nil {
 		logger.Error().Err(err).Send()
 		return
 	}
 
-	client, err := azsecrets.NewClient(keyVaultUri, credential, nil)
+	client, err := armstorage.NewAccountsClient(subscriptionId, credential, getArmClientOptions())
 	if err != nil {
 		logger.Error().Err(err).Send()
 		return
 	}
-	resp, err := client.GetSecret(ctx, secretName, "", nil)
+	_, err = client.Delete(ctx, resourceGroupName, storageAccountName, nil)
 	if err != nil {
 		logger.Error().Err(err).Send()
-		return
 	}
-
-	secret = *resp.Value
-
 	return
 }
 
-// Gets all network interfaces in a VM scale set
-// see https://learn.microsoft.com/en-us/rest/api/virtualnetwork/network-interface-in-vm-ss/list-virtual-machine-scale-set-network-interfaces
-func getScaleSetVmsNetworkInterfaces(ctx context.Context, subscriptionId, resourceGroupName, vmScaleSetName string) (networkInterfaces []*armnetwork.Interface, err error) {
+func createStoragePrivateEndpoint(ctx context.Context, subscriptionId, resourceGroupName, storageAccountName, location string, privateEndpoint StoragePrivateEndpoint) (err error) {
 	logger := logging.LoggerFromCtx(ctx)
+	logger.Info().Msgf("creating private endpoint for storage account: %s", storageAccountName)
 
-	credential, err := azidentity.NewDefaultAzureCredential(nil)
+	credential, err := azidentity.NewDefaultAzureCredential(getCredentialOptions())
 	if err != nil {
 		logger.Error().Err(err).Send()
 		return
 	}
 
-	client, err := armnetwork.NewInterfacesClient(subscriptionId, credential, nil)
+	endpointsClient, err := armnetwork.NewPrivateEndpointsClient(subscriptionId, credential, getArmClientOptions())
 	if err != nil {
 		logger.Error().Err(err).Send()
 		return
 	}
 
-	pager := client.NewListVirtualMachineScaleSetNetworkInterfacesPager(resourceGroupName, vmScaleSetName, nil)
+	storageAccountId := fmt.Sprintf("/subscriptions/%s/resourceGroups/%s/providers/Microsoft.Storage/storageAccounts/%s", subscriptionId, resourceGroupName, storageAccountName)
+	endpointName := getStoragePrivateEndpointName(storageAccountName)
+	poller, err := endpointsClient.BeginCreateOrUpdate(ctx, resourceGroupName, endpointName, armnetwork.PrivateEndpoint{
+		Location: &location,
+		Tags:     GetResourceTags(ctx, Getenv(ctx, "CLUSTER_NAME")),
+		Properties: &armnetwork.PrivateEndpointProperties{
+			Subnet: &armnetwork.Subnet{
+				ID: &privateEndpoint.SubnetId,
+			},
+			PrivateLinkServiceConnections: []*armnetwork.PrivateLinkServiceConnection{
+				{
+					Name: to.Ptr(endpointName),
+					Properties: &armnetwork.PrivateLinkServiceConnectionProperties{
+						PrivateLinkServiceID: &storageAccountId,
+						GroupIDs:             []*string{to.Ptr("blob")},
+					},
+				},
+			},
+		},
+	}, nil)
+	if err != nil {
+		logger.Error().Err(err).Send()
+		return
+	}
+	_, err = poller.PollUntilDone(ctx, nil)
+	if err != nil {
+		logger.Error().Err(err).Send()
+		return
+	}
 
-	for pager.More() {
-		nextResult, err := pager.NextPage(ctx)
-		if err != nil {
-			logger.Error().Err(err).Send()
-			return nil, err
-		}
-		networkInterfaces = append(networkInterfaces, nextResult.Value...)
+	if privateEndpoint.PrivateDnsZoneId == "" {
+		return
 	}
-	return
-}
 
-func GetScaleSetVmsNetworkPrimaryNICs(ctx context.Context, subscriptionId, resourceGroupName, vmScaleSetName string) (networkInterfaces []*armnetwork.Interface, err error) {
-	nics, err := getScaleSetVmsNetworkInterfaces(ctx, subscriptionId, resourceGroupName, vmScaleSetName)
+	zoneGroupsClient, err := armnetwork.NewPrivateDNSZoneGroupsClient(subscriptionId, credential, getArmClientOptions())
 	if err != nil {
-		return nil, err
+		logger.Error().Err(err).Send()
+		return
 	}
 
-	for _, ni := range nics {
-		if ni.Properties == nil || ni.Properties.VirtualMachine == nil || len(ni.Properties.IPConfigurations) < 1 {
-			continue
-		}
-		if ni.Properties.Primary == nil || !*ni.Properties.Primary {
-			// get only primary NICs
-			continue
-		}
-		networkInterfaces = append(networkInterfaces, ni)
+	zoneGroupPoller, err := zoneGroupsClient.BeginCreateOrUpdate(ctx, resourceGroupName, endpointName, "default", armnetwork.PrivateDNSZoneGroup{
+		Properties: &armnetwork.PrivateDNSZoneGroupPropertiesFormat{
+			PrivateDNSZoneConfigs: []*armnetwork.PrivateDNSZoneConfig{
+				{
+					Name: to.Ptr("blob"),
+					Properties: &armnetwork.PrivateDNSZonePropertiesFormat{
+						PrivateDNSZoneID: &privateEndpoint.PrivateDnsZoneId,
+					},
+				},
+			},
+		},
+	}, nil)
+	if err != nil {
+		logger.Error().Err(err).Send()
+		return
+	}
+	_, err = zoneGroupPoller.PollUntilDone(ctx, nil)
+	if err != nil {
+		logger.Error().Err(err).Send()
 	}
 	return
 }
 
-func GetPublicIp(ctx context.Context, subscriptionId, resourceGroupName, vmScaleSetName, prefix, clusterName, instanceIndex string) (publicIp string, err error) {
+func getStorageAccountAccessKey(ctx context.Context, subscriptionId, resourceGroupName, obsName string) (accessKey string, err error) {
 	logger := logging.LoggerFromCtx(ctx)
 
-	credential, err := azidentity.NewDefaultAzureCredential(nil)
+	credential, err := azidentity.NewDefaultAzureCredential(getCredentialOptions())
 	if err != nil {
 		logger.Error().Err(err).Send()
 		return
 	}
 
-	client, err := armnetwork.NewPublicIPAddressesClient(subscriptionId, credential, nil)
+	client, err := armstorage.NewAccountsClient(subscriptionId, credential, getArmClientOptions())
 	if err != nil {
 		logger.Error().Err(err).Send()
 		return
 	}
-	interfaceName := fmt.Sprintf("%s-%s-backend-nic", prefix, clusterName)
-	pager := client.NewListVirtualMachineScaleSetVMPublicIPAddressesPager(resourceGroupName, vmScaleSetName, instanceIndex, interfaceName, "ipconfig1", nil)
-
-	for pager.More() {
-		nextResult, err1 := pager.NextPage(ctx)
-		if err1 != nil {
-			logger.Error().Err(err1).Send()
-			return "", err1
-		}
-		publicIp = *nextResult.Value[0].Properties.IPAddress
+	keys, err := client.ListKeys(ctx, resourceGroupName, obsName, nil)
+	if err != nil {
+		logger.Error().Err(err).Send()
 		return
 	}
+	accessKey = *keys.Keys[0].Value
 	return
 }
 
-func GetVmsPrivateIps(ctx context.Context, subscriptionId, resourceGroupName, vmScaleSetName string) (vmsPrivateIps map[string]string, err error) {
-	//returns compute_name to private ip map
+const (
+	BlobAccessTierHot  = "Hot"
+	BlobAccessTierCool = "Cool"
+	BlobAccessTierCold = "Cold"
+)
 
+// ContainerLifecycle moves the container blobs to a cheaper access tier once they were not modified for the given days.
+// Cool and cold blobs have a minimum retention (30 and 90 days), blobs deleted earlier are charged for the remaining days
+type ContainerLifecycle struct {
+	AccessTier            string
+	DaysAfterModification int
+}
+
+func ValidateBlobAccessTier(accessTier string) error {
+	switch accessTier {
+	case "", BlobAccessTierHot, BlobAccessTierCool, BlobAccessTierCold:
+		return nil
+	}
+	return fmt.Errorf("invalid blob access tier %s, supported tiers: %s, %s, %s", accessTier, BlobAccessTierHot, BlobAccessTierCool, BlobAccessTierCold)
+}
+
+func CreateContainer(ctx context.Context, subscriptionId, resourceGroupName, storageAccountName, containerName string, lifecycle *ContainerLifecycle) (err error) {
 	logger := logging.LoggerFromCtx(ctx)
-	logger.Info().Msg("fetching scale set vms private ips")
+	logger.Info().Msgf("creating obs container %s in storage account %s", containerName, storageAccountName)
 
-	networkInterfaces, err := GetScaleSetVmsNetworkPrimaryNICs(ctx, subscriptionId, resourceGroupName, vmScaleSetName)
+	credential, err := azidentity.NewDefaultAzureCredential(getCredentialOptions())
 	if err != nil {
+		logger.Error().Err(err).Send()
 		return
 	}
 
-	vmsPrivateIps = make(map[string]string)
-	for _, networkInterface := range networkInterfaces {
-		vmNameParts := strings.Split(*networkInterface.Properties.VirtualMachine.ID, "/")
-		vmNamePartsLen := len(vmNameParts)
-		vmName := fmt.Sprintf("%s_%s", vmNameParts[vmNamePartsLen-3], vmNameParts[vmNamePartsLen-1])
-		if _, ok := vmsPrivateIps[vmName]; !ok {
-			vmsPrivateIps[vmName] = *networkInterface.Properties.IPConfigurations[0].Properties.PrivateIPAddress
+	blobClient, err := azblob.NewClient(GetBlobUrl(storageAccountName), credential, &azblob.ClientOptions{ClientOptions: getClientOptions()})
+	if err != nil {
+		logger.Error().Err(err).Send()
+		return
+	}
+
+	_, err = blobClient.CreateContainer(ctx, containerName, &azblob.CreateContainerOptions{
+		Metadata: GetContainerMetadata(ctx, Getenv(ctx, "CLUSTER_NAME")),
+	})
+	if err != nil {
+		if azerr, ok := err.(*azcore.ResponseError); ok {
+			if azerr.ErrorCode == "ContainerAlreadyExists" {
+				logger.Info().Msgf("obs container %s already exists", containerName)
+				err = nil
+				return
+			}
 		}
+		logger.Error().Msgf("obs container creation failed: %s", err)
+		return
+	}
+
+	if lifecycle != nil && lifecycle.AccessTier != "" && lifecycle.AccessTier != BlobAccessTierHot {
+		err = setContainerLifecyclePolicy(ctx, subscriptionId, resourceGroupName, storageAccountName, containerName, *lifecycle)
 	}
 	return
 }
 
-func UpdateVmScaleSetNum(ctx context.Context, subscriptionId, resourceGroupName, vmScaleSetName string, newSize int64) (err error) {
+// Adds a lifecycle management rule for the container to the storage account policy, rules of other containers are kept
+// see https://learn.microsoft.com/en-us/azure/storage/blobs/lifecycle-management-overview
+func setContainerLifecyclePolicy(ctx context.Context, subscriptionId, resourceGroupName, storageAccountName, containerName string, lifecycle ContainerLifecycle) (err error) {
 	logger := logging.LoggerFromCtx(ctx)
-	logger.Info().Msg("updating scale set vms num")
+	logger.Info().Msgf("setting %s tier lifecycle policy for container %s", lifecycle.AccessTier, containerName)
 
-	credential, err := azidentity.NewDefaultAzureCredential(nil)
+	credential, err := azidentity.NewDefaultAzureCredential(getCredentialOptions())
 	if err != nil {
 		logger.Error().Err(err).Send()
 		return
 	}
-	client, err := armcompute.NewVirtualMachineScaleSetsClient(subscriptionId, credential, nil)
+
+	client, err := armstorage.NewManagementPoliciesClient(subscriptionId, credential, getArmClientOptions())
 	if err != nil {
 		logger.Error().Err(err).Send()
 		return
 	}
 
-	_, err = client.BeginUpdate(ctx, resourceGroupName, vmScaleSetName, armcompute.VirtualMachineScaleSetUpdate{
-		SKU: &armcompute.SKU{
-			Capacity: &newSize,
+	days := &armstorage.DateAfterModification{
+		DaysAfterModificationGreaterThan: to.Ptr(float32(lifecycle.DaysAfterModification)),
+	}
+	baseBlob := &armstorage.ManagementPolicyBaseBlob{}
+	if lifecycle.AccessTier == BlobAccessTierCold {
+		baseBlob.TierToCold = days
+	} else {
+		baseBlob.TierToCool = days
+	}
+	ruleName := fmt.Sprintf("%s-tiering", containerName)
+	rule := &armstorage.ManagementPolicyRule{
+		Name:    &ruleName,
+		Enabled: to.Ptr(true),
+		Type:    to.Ptr(armstorage.RuleTypeLifecycle),
+		Definition: &armstorage.ManagementPolicyDefinition{
+			Actions: &armstorage.ManagementPolicyAction{
+				BaseBlob: baseBlob,
+			},
+			Filters: &armstorage.ManagementPolicyFilter{
+				BlobTypes:   []*string{to.Ptr("blockBlob")},
+				PrefixMatch: []*string{to.Ptr(containerName + "/")},
+			},
+		},
+	}
+
+	rules := []*armstorage.ManagementPolicyRule{rule}
+	existing, getErr := client.Get(ctx, resourceGroupName, storageAccountName, armstorage.ManagementPolicyNameDefault, nil)
+	if getErr == nil && existing.Properties != nil && existing.Properties.Policy != nil {
+		for _, existingRule := range existing.Properties.Policy.Rules {
+			if existingRule.Name != nil && *existingRule.Name != ruleName {
+				rules = append(rules, existingRule)
+			}
+		}
+	}
+
+	_, err = client.CreateOrUpdate(ctx, resourceGroupName, storageAccountName, armstorage.ManagementPolicyNameDefault, armstorage.ManagementPolicy{
+		Properties: &armstorage.ManagementPolicyProperties{
+			Policy: &armstorage.ManagementPolicySchema{
+				Rules: rules,
+			},
 		},
 	}, nil)
 	if err != nil {
@@ -526,297 +680,1681 @@ func UpdateVmScaleSetNum(ctx context.Context, subscriptionId, resourceGroupName,
 	return
 }
 
-func GetRoleDefinitionByRoleName(ctx context.Context, roleName, scope string) (*armauthorization.RoleDefinition, error) {
+func SetKeyVaultValue(ctx context.Context, keyVaultUri, secretName, value string) (err error) {
 	logger := logging.LoggerFromCtx(ctx)
+	logger.Info().Msgf("setting key vault secret: %s", secretName)
 
-	cred, err := azidentity.NewDefaultAzureCredential(nil)
+	err = ClientsFromCtx(ctx).Secrets.SetSecret(ctx, keyVaultUri, secretName, value)
 	if err != nil {
-		logger.Error().Err(err).Send()
-		return nil, err
+		return
 	}
+	cacheKeyVaultValue(keyVaultUri, secretName, value)
+	return
+}
 
-	client, err := armauthorization.NewRoleDefinitionsClient(cred, nil)
+// GetKeyVaultValue returns the secret from the instance cache while within its ttl, a stale cached secret is
+// returned when the key vault can't be read
+func GetKeyVaultValue(ctx context.Context, keyVaultUri, secretName string) (secret string, err error) {
+	logger := logging.LoggerFromCtx(ctx)
+
+	cached, found, fresh := getCachedKeyVaultValue(keyVaultUri, secretName)
+	if fresh {
+		return cached, nil
+	}
+
+	secret, err = fetchKeyVaultValue(ctx, keyVaultUri, secretName)
+	if err != nil {
+		if found {
+			logger.Warn().Err(err).Msgf("failed to fetch key vault secret %s, using the cached value", secretName)
+			return cached, nil
+		}
+		return
+	}
+	cacheKeyVaultValue(keyVaultUri, secretName, secret)
+	return
+}
+
+func fetchKeyVaultValue(ctx context.Context, keyVaultUri, secretName string) (secret string, err error) {
+	return ClientsFromCtx(ctx).Secrets.GetSecret(ctx, keyVaultUri, secretName)
+}
+
+// Gets all network interfaces in a VM scale set
+// see https://learn.microsoft.com/en-us/rest/api/virtualnetwork/network-interface-in-vm-ss/list-virtual-machine-scale-set-network-interfaces
+func getScaleSetVmsNetworkInterfaces(ctx context.Context, subscriptionId, resourceGroupName, vmScaleSetName string) (networkInterfaces []*armnetwork.Interface, err error) {
+	return ClientsFromCtx(ctx).Compute.ListScaleSetNetworkInterfaces(ctx, subscriptionId, resourceGroupName, vmScaleSetName)
+}
+
+func GetScaleSetVmsNetworkPrimaryNICs(ctx context.Context, subscriptionId, resourceGroupName, vmScaleSetName string) (networkInterfaces []*armnetwork.Interface, err error) {
+	nics, err := getScaleSetVmsNetworkInterfaces(ctx, subscriptionId, resourceGroupName, vmScaleSetName)
 	if err != nil {
-		logger.Error().Err(err).Send()
 		return nil, err
 	}
 
-	var results []*armauthorization.RoleDefinition
-	filter := fmt.Sprintf("roleName eq '%s'", roleName)
+	for _, ni := range nics {
+		if ni.Properties == nil || ni.Properties.VirtualMachine == nil || len(ni.Properties.IPConfigurations) < 1 {
+			continue
+		}
+		if ni.Properties.Primary == nil || !*ni.Properties.Primary {
+			// get only primary NICs
+			continue
+		}
+		networkInterfaces = append(networkInterfaces, ni)
+	}
+	return
+}
 
-	pager := client.NewListPager("/", &armauthorization.RoleDefinitionsClientListOptions{Filter: &filter})
+// IsPrivateNetwork tells whether the backends are deployed without public ips, configured by PRIVATE_NETWORK
+func IsPrivateNetwork(ctx context.Context) bool {
+	privateNetwork, _ := strconv.ParseBool(Getenv(ctx, "PRIVATE_NETWORK"))
+	return privateNetwork
+}
+
+// GetPublicIp returns the public ip of the scale set vm, empty when it has none
+func GetPublicIp(ctx context.Context, subscriptionId, resourceGroupName, vmScaleSetName, prefix, clusterName, instanceIndex string) (publicIp string, err error) {
+	return ClientsFromCtx(ctx).Compute.GetPublicIp(ctx, subscriptionId, resourceGroupName, vmScaleSetName, prefix, clusterName, instanceIndex)
+}
+
+// GetScaleSetVmsPublicIps returns scale set vm index to public ip map, vms without public ip are not included
+func GetScaleSetVmsPublicIps(ctx context.Context, subscriptionId, resourceGroupName, vmScaleSetName string) (publicIps map[string]string, err error) {
+	logger := logging.LoggerFromCtx(ctx)
+
+	credential, err := azidentity.NewDefaultAzureCredential(getCredentialOptions())
+	if err != nil {
+		logger.Error().Err(err).Send()
+		return
+	}
+
+	client, err := armnetwork.NewPublicIPAddressesClient(subscriptionId, credential, getArmClientOptions())
+	if err != nil {
+		logger.Error().Err(err).Send()
+		return
+	}
+
+	publicIps = make(map[string]string)
+	pager := client.NewListVirtualMachineScaleSetPublicIPAddressesPager(resourceGroupName, vmScaleSetName, nil)
 	for pager.More() {
-		nextResult, err := pager.NextPage(ctx)
-		if err != nil {
+		nextResult, err1 := pager.NextPage(ctx)
+		if err1 != nil {
+			logger.Error().Err(err1).Send()
+			return nil, err1
+		}
+		for _, publicIp := range nextResult.Value {
+			if publicIp.Properties == nil || publicIp.Properties.IPAddress == nil || publicIp.Properties.IPConfiguration == nil {
+				continue
+			}
+			// ip configuration id: .../virtualMachineScaleSets/<vmss>/virtualMachines/<index>/networkInterfaces/...
+			idParts := strings.Split(*publicIp.Properties.IPConfiguration.ID, "/")
+			for i, part := range idParts {
+				if strings.EqualFold(part, "virtualMachines") && i+1 < len(idParts) {
+					publicIps[idParts[i+1]] = *publicIp.Properties.IPAddress
+					break
+				}
+			}
+		}
+	}
+	return
+}
+
+const privateDnsRecordTTL = int64(300)
+
+// Creates or updates an A record set in a private DNS zone
+// see https://learn.microsoft.com/en-us/rest/api/dns/privatednszones/recordsets/create-or-update
+func UpsertPrivateDNSARecord(ctx context.Context, subscriptionId, resourceGroupName, zoneName, recordName string, ips []string) (err error) {
+	logger := logging.LoggerFromCtx(ctx)
+	logger.Info().Msgf("upserting private dns A record %s.%s", recordName, zoneName)
+
+	credential, err := azidentity.NewDefaultAzureCredential(getCredentialOptions())
+	if err != nil {
+		logger.Error().Err(err).Send()
+		return
+	}
+
+	client, err := armprivatedns.NewRecordSetsClient(subscriptionId, credential, getArmClientOptions())
+	if err != nil {
+		logger.Error().Err(err).Send()
+		return
+	}
+
+	var aRecords []*armprivatedns.ARecord
+	for i := range ips {
+		aRecords = append(aRecords, &armprivatedns.ARecord{IPv4Address: &ips[i]})
+	}
+	ttl := privateDnsRecordTTL
+	_, err = client.CreateOrUpdate(ctx, resourceGroupName, zoneName, armprivatedns.RecordTypeA, recordName, armprivatedns.RecordSet{
+		Properties: &armprivatedns.RecordSetProperties{
+			TTL:      &ttl,
+			ARecords: aRecords,
+			Metadata: GetResourceTags(ctx, Getenv(ctx, "CLUSTER_NAME")),
+		},
+	}, nil)
+	if err != nil {
+		logger.Error().Err(err).Send()
+	}
+	return
+}
+
+// ListPrivateDNSARecords returns the ips of the A record sets of a private DNS zone tagged with the cluster, by name
+func ListPrivateDNSARecords(ctx context.Context, subscriptionId, resourceGroupName, zoneName, clusterName string) (records map[string][]string, err error) {
+	logger := logging.LoggerFromCtx(ctx)
+
+	credential, err := azidentity.NewDefaultAzureCredential(getCredentialOptions())
+	if err != nil {
+		logger.Error().Err(err).Send()
+		return
+	}
+
+	client, err := armprivatedns.NewRecordSetsClient(subscriptionId, credential, getArmClientOptions())
+	if err != nil {
+		logger.Error().Err(err).Send()
+		return
+	}
+
+	records = make(map[string][]string)
+	pager := client.NewListByTypePager(resourceGroupName, zoneName, armprivatedns.RecordTypeA, nil)
+	for pager.More() {
+		page, pageErr := pager.NextPage(ctx)
+		if pageErr != nil {
+			err = pageErr
 			logger.Error().Err(err).Send()
-			return nil, err
+			return
 		}
-		results = append(results, nextResult.Value...)
+		for _, recordSet := range page.Value {
+			if recordSet.Name == nil || recordSet.Properties == nil {
+				continue
+			}
+			if tag := recordSet.Properties.Metadata[WekaClusterTag]; tag == nil || *tag != clusterName {
+				continue
+			}
+			ips := []string{}
+			for _, aRecord := range recordSet.Properties.ARecords {
+				if aRecord.IPv4Address != nil {
+					ips = append(ips, *aRecord.IPv4Address)
+				}
+			}
+			records[*recordSet.Name] = ips
+		}
+	}
+	return
+}
+
+func DeletePrivateDNSARecord(ctx context.Context, subscriptionId, resourceGroupName, zoneName, recordName string) (err error) {
+	logger := logging.LoggerFromCtx(ctx)
+	logger.Info().Msgf("deleting private dns A record %s.%s", recordName, zoneName)
+
+	credential, err := azidentity.NewDefaultAzureCredential(getCredentialOptions())
+	if err != nil {
+		logger.Error().Err(err).Send()
+		return
 	}
 
-	// filter the needed role out of all built-in ones
-	var roleDefs []*armauthorization.RoleDefinition
-	for _, res := range results {
-		if *res.Properties.RoleName == roleName {
-			roleDefs = append(roleDefs, res)
+	client, err := armprivatedns.NewRecordSetsClient(subscriptionId, credential, getArmClientOptions())
+	if err != nil {
+		logger.Error().Err(err).Send()
+		return
+	}
+
+	_, err = client.Delete(ctx, resourceGroupName, zoneName, armprivatedns.RecordTypeA, recordName, nil)
+	if err != nil {
+		logger.Error().Err(err).Send()
+	}
+	return
+}
+
+// Creates or updates an SRV record set in a private DNS zone, targets should be resolvable host names
+func UpsertPrivateDNSSRVRecord(ctx context.Context, subscriptionId, resourceGroupName, zoneName, recordName string, targets []string, port int) (err error) {
+	logger := logging.LoggerFromCtx(ctx)
+	logger.Info().Msgf("upserting private dns SRV record %s.%s", recordName, zoneName)
+
+	credential, err := azidentity.NewDefaultAzureCredential(getCredentialOptions())
+	if err != nil {
+		logger.Error().Err(err).Send()
+		return
+	}
+
+	client, err := armprivatedns.NewRecordSetsClient(subscriptionId, credential, getArmClientOptions())
+	if err != nil {
+		logger.Error().Err(err).Send()
+		return
+	}
+
+	srvPort := int32(port)
+	priority := int32(0)
+	weight := int32(10)
+	var srvRecords []*armprivatedns.SrvRecord
+	for i := range targets {
+		srvRecords = append(srvRecords, &armprivatedns.SrvRecord{
+			Port:     &srvPort,
+			Priority: &priority,
+			Weight:   &weight,
+			Target:   &targets[i],
+		})
+	}
+	ttl := privateDnsRecordTTL
+	_, err = client.CreateOrUpdate(ctx, resourceGroupName, zoneName, armprivatedns.RecordTypeSRV, recordName, armprivatedns.RecordSet{
+		Properties: &armprivatedns.RecordSetProperties{
+			TTL:        &ttl,
+			SrvRecords: srvRecords,
+			Metadata:   GetResourceTags(ctx, Getenv(ctx, "CLUSTER_NAME")),
+		},
+	}, nil)
+	if err != nil {
+		logger.Error().Err(err).Send()
+	}
+	return
+}
+
+// FrontDoorPrivateLinkOrigin is the origin front door reaches the weka s3 through, front door can't reach the
+// backends private ips, so it connects through a private link service fronting a load balancer of the s3 port
+type FrontDoorPrivateLinkOrigin struct {
+	// the load balancer frontend ip or dns name behind the private link service
+	HostName             string
+	Port                 int
+	PrivateLinkServiceId string
+	// the region of the private link service
+	PrivateLinkLocation string
+}
+
+func isResourceNotFound(err error) bool {
+	var responseErr *azcore.ResponseError
+	return errors.As(err, &responseErr) && responseErr.StatusCode == http.StatusNotFound
+}
+
+// Creates an azure front door endpoint routing to an origin group with the private link origin, the premium profile
+// must exist. The resources are reused when they exist, so it can be retried, the private endpoint connection front
+// door requests on the private link service is approved. Returns the endpoint host name
+func CreateFrontDoorEndpoint(ctx context.Context, subscriptionId, resourceGroupName, profileName string, origin FrontDoorPrivateLinkOrigin) (endpointHostName string, err error) {
+	logger := logging.LoggerFromCtx(ctx)
+	logger.Info().Msgf("Creating front door endpoint on profile %s for private link service %s", profileName, origin.PrivateLinkServiceId)
+
+	credential, err := azidentity.NewDefaultAzureCredential(getCredentialOptions())
+	if err != nil {
+		logger.Error().Err(err).Send()
+		return
+	}
+
+	endpointsClient, err := armcdn.NewAFDEndpointsClient(subscriptionId, credential, getArmClientOptions())
+	if err != nil {
+		logger.Error().Err(err).Send()
+		return
+	}
+	originGroupsClient, err := armcdn.NewAFDOriginGroupsClient(subscriptionId, credential, getArmClientOptions())
+	if err != nil {
+		logger.Error().Err(err).Send()
+		return
+	}
+	originsClient, err := armcdn.NewAFDOriginsClient(subscriptionId, credential, getArmClientOptions())
+	if err != nil {
+		logger.Error().Err(err).Send()
+		return
+	}
+	routesClient, err := armcdn.NewRoutesClient(subscriptionId, credential, getArmClientOptions())
+	if err != nil {
+		logger.Error().Err(err).Send()
+		return
+	}
+
+	endpointName := fmt.Sprintf("%s-weka-s3", profileName)
+	originGroupName := "weka-s3"
+	originName := "weka-s3"
+	routeName := "weka-s3"
+
+	var endpoint armcdn.AFDEndpoint
+	endpointResp, err := endpointsClient.Get(ctx, resourceGroupName, profileName, endpointName, nil)
+	if err == nil {
+		endpoint = endpointResp.AFDEndpoint
+	} else if isResourceNotFound(err) {
+		var endpointPoller *runtime.Poller[armcdn.AFDEndpointsClientCreateResponse]
+		endpointPoller, err = endpointsClient.BeginCreate(ctx, resourceGroupName, profileName, endpointName, armcdn.AFDEndpoint{
+			Location: to.Ptr("global"),
+			Tags:     GetResourceTags(ctx, Getenv(ctx, "CLUSTER_NAME")),
+			Properties: &armcdn.AFDEndpointProperties{
+				EnabledState: to.Ptr(armcdn.EnabledStateEnabled),
+			},
+		}, nil)
+		if err == nil {
+			var created armcdn.AFDEndpointsClientCreateResponse
+			created, err = endpointPoller.PollUntilDone(ctx, nil)
+			endpoint = created.AFDEndpoint
+		}
+	}
+	if err != nil {
+		logger.Error().Err(err).Send()
+		return
+	}
+
+	var originGroup armcdn.AFDOriginGroup
+	originGroupResp, err := originGroupsClient.Get(ctx, resourceGroupName, profileName, originGroupName, nil)
+	if err == nil {
+		originGroup = originGroupResp.AFDOriginGroup
+	} else if isResourceNotFound(err) {
+		var originGroupPoller *runtime.Poller[armcdn.AFDOriginGroupsClientCreateResponse]
+		originGroupPoller, err = originGroupsClient.BeginCreate(ctx, resourceGroupName, profileName, originGroupName, armcdn.AFDOriginGroup{
+			Properties: &armcdn.AFDOriginGroupProperties{
+				LoadBalancingSettings: &armcdn.LoadBalancingSettingsParameters{
+					SampleSize:                      to.Ptr[int32](4),
+					SuccessfulSamplesRequired:       to.Ptr[int32](3),
+					AdditionalLatencyInMilliseconds: to.Ptr[int32](50),
+				},
+				HealthProbeSettings: &armcdn.HealthProbeParameters{
+					ProbePath:              to.Ptr("/"),
+					ProbeProtocol:          to.Ptr(armcdn.ProbeProtocolHTTP),
+					ProbeRequestType:       to.Ptr(armcdn.HealthProbeRequestTypeHEAD),
+					ProbeIntervalInSeconds: to.Ptr[int32](30),
+				},
+			},
+		}, nil)
+		if err == nil {
+			var created armcdn.AFDOriginGroupsClientCreateResponse
+			created, err = originGroupPoller.PollUntilDone(ctx, nil)
+			originGroup = created.AFDOriginGroup
 		}
 	}
+	if err != nil {
+		logger.Error().Err(err).Send()
+		return
+	}
 
-	if len(roleDefs) < 1 {
-		err := fmt.Errorf("cannot find az role definition with name '%s'", roleName)
+	// the origin is created again when it exists, its host name or port may have changed
+	requestMessage := fmt.Sprintf("weka s3 front door %s", endpointName)
+	originPoller, err := originsClient.BeginCreate(ctx, resourceGroupName, profileName, originGroupName, originName, armcdn.AFDOrigin{
+		Properties: &armcdn.AFDOriginProperties{
+			HostName:     to.Ptr(origin.HostName),
+			HTTPPort:     to.Ptr(int32(origin.Port)),
+			HTTPSPort:    to.Ptr(int32(origin.Port)),
+			EnabledState: to.Ptr(armcdn.EnabledStateEnabled),
+			Priority:     to.Ptr[int32](1),
+			Weight:       to.Ptr[int32](1000),
+			SharedPrivateLinkResource: &armcdn.SharedPrivateLinkResourceProperties{
+				PrivateLink:         &armcdn.ResourceReference{ID: to.Ptr(origin.PrivateLinkServiceId)},
+				PrivateLinkLocation: to.Ptr(origin.PrivateLinkLocation),
+				RequestMessage:      to.Ptr(requestMessage),
+			},
+		},
+	}, nil)
+	if err != nil {
 		logger.Error().Err(err).Send()
-		return nil, err
+		return
 	}
-	if len(roleDefs) > 1 {
-		err := fmt.Errorf("found several az role definitions with name '%s', check the name", roleName)
+	_, err = originPoller.PollUntilDone(ctx, nil)
+	if err != nil {
 		logger.Error().Err(err).Send()
-		return nil, err
+		return
+	}
+
+	_, err = routesClient.Get(ctx, resourceGroupName, profileName, endpointName, routeName, nil)
+	if isResourceNotFound(err) {
+		var routePoller *runtime.Poller[armcdn.RoutesClientCreateResponse]
+		routePoller, err = routesClient.BeginCreate(ctx, resourceGroupName, profileName, endpointName, routeName, armcdn.Route{
+			Properties: &armcdn.RouteProperties{
+				OriginGroup:         &armcdn.ResourceReference{ID: originGroup.ID},
+				SupportedProtocols:  []*armcdn.AFDEndpointProtocols{to.Ptr(armcdn.AFDEndpointProtocolsHTTPS)},
+				PatternsToMatch:     []*string{to.Ptr("/*")},
+				ForwardingProtocol:  to.Ptr(armcdn.ForwardingProtocolMatchRequest),
+				LinkToDefaultDomain: to.Ptr(armcdn.LinkToDefaultDomainEnabled),
+				HTTPSRedirect:       to.Ptr(armcdn.HTTPSRedirectDisabled),
+				EnabledState:        to.Ptr(armcdn.EnabledStateEnabled),
+			},
+		}, nil)
+		if err == nil {
+			_, err = routePoller.PollUntilDone(ctx, nil)
+		}
+	}
+	if err != nil {
+		logger.Error().Err(err).Send()
+		return
+	}
+
+	err = approvePrivateLinkServiceConnections(ctx, origin.PrivateLinkServiceId, requestMessage)
+	if err != nil {
+		return
+	}
+
+	endpointHostName = *endpoint.Properties.HostName
+	return
+}
+
+// approvePrivateLinkServiceConnections approves the pending private endpoint connections requested with the message
+func approvePrivateLinkServiceConnections(ctx context.Context, privateLinkServiceId, requestMessage string) (err error) {
+	logger := logging.LoggerFromCtx(ctx)
+
+	privateLinkServiceResourceId, err := arm.ParseResourceID(privateLinkServiceId)
+	if err != nil {
+		logger.Error().Err(err).Send()
+		return
+	}
+
+	credential, err := azidentity.NewDefaultAzureCredential(getCredentialOptions())
+	if err != nil {
+		logger.Error().Err(err).Send()
+		return
+	}
+	client, err := armnetwork.NewPrivateLinkServicesClient(privateLinkServiceResourceId.SubscriptionID, credential, getArmClientOptions())
+	if err != nil {
+		logger.Error().Err(err).Send()
+		return
+	}
+
+	resourceGroupName := privateLinkServiceResourceId.ResourceGroupName
+	serviceName := privateLinkServiceResourceId.Name
+	pager := client.NewListPrivateEndpointConnectionsPager(resourceGroupName, serviceName, nil)
+	for pager.More() {
+		var page armnetwork.PrivateLinkServicesClientListPrivateEndpointConnectionsResponse
+		page, err = pager.NextPage(ctx)
+		if err != nil {
+			logger.Error().Err(err).Send()
+			return
+		}
+		for _, connection := range page.Value {
+			state := connection.Properties.PrivateLinkServiceConnectionState
+			if state == nil || state.Status == nil || *state.Status != "Pending" || state.Description == nil || *state.Description != requestMessage {
+				continue
+			}
+			logger.Info().Msgf("Approving private endpoint connection %s of private link service %s", *connection.Name, serviceName)
+			state.Status = to.Ptr("Approved")
+			_, err = client.UpdatePrivateEndpointConnection(ctx, resourceGroupName, serviceName, *connection.Name, *connection, nil)
+			if err != nil {
+				logger.Error().Err(err).Send()
+				return
+			}
+		}
+	}
+	return
+}
+
+func GetVmsPrivateIps(ctx context.Context, subscriptionId, resourceGroupName, vmScaleSetName string) (vmsPrivateIps map[string]string, err error) {
+	//returns compute_name to private ip map
+
+	logger := logging.LoggerFromCtx(ctx)
+	logger.Info().Msg("fetching scale set vms private ips")
+
+	networkInterfaces, err := GetScaleSetVmsNetworkPrimaryNICs(ctx, subscriptionId, resourceGroupName, vmScaleSetName)
+	if err != nil {
+		return
+	}
+
+	vmsPrivateIps = make(map[string]string)
+	for _, networkInterface := range networkInterfaces {
+		vmNameParts := strings.Split(*networkInterface.Properties.VirtualMachine.ID, "/")
+		vmNamePartsLen := len(vmNameParts)
+		vmName := fmt.Sprintf("%s_%s", vmNameParts[vmNamePartsLen-3], vmNameParts[vmNamePartsLen-1])
+		if _, ok := vmsPrivateIps[vmName]; !ok {
+			vmsPrivateIps[vmName] = *networkInterface.Properties.IPConfigurations[0].Properties.PrivateIPAddress
+		}
+	}
+	return
+}
+
+// GetScaleSetsVmsPrivateIps aggregates the vm name to private ip maps of the given scale sets,
+// the scale sets are listed concurrently
+func GetScaleSetsVmsPrivateIps(ctx context.Context, subscriptionId, resourceGroupName string, vmScaleSetNames []string) (vmsPrivateIps map[string]string, err error) {
+	vmsPrivateIps = make(map[string]string)
+	var lock sync.Mutex
+	err = ForEachParallel(ctx, len(vmScaleSetNames), AzureApiMaxParallelism, func(ctx context.Context, i int) error {
+		scaleSetPrivateIps, err := GetVmsPrivateIps(ctx, subscriptionId, resourceGroupName, vmScaleSetNames[i])
+		if err != nil {
+			return err
+		}
+		lock.Lock()
+		defer lock.Unlock()
+		// vm names are prefixed by the scale set name, so they are unique across scale sets
+		for vmName, ip := range scaleSetPrivateIps {
+			vmsPrivateIps[vmName] = ip
+		}
+		return nil
+	})
+	return
+}
+
+// getNicIndex returns the index terraform suffixes the backend nic names with (<prefix>-<cluster>-backend-nic-<index>)
+func getNicIndex(nicName string) int {
+	index, err := strconv.Atoi(nicName[strings.LastIndex(nicName, "-")+1:])
+	if err != nil {
+		return -1
+	}
+	return index
+}
+
+// GetVmNicsPrivateIps returns the private ip of each nic of the scale set vm, by nic index, the primary nic (eth0)
+// first. The secondary nics get their address from dhcp after the vm is up, azure knows them before
+func GetVmNicsPrivateIps(ctx context.Context, subscriptionId, resourceGroupName, vmScaleSetName, vmName string) (nicsIps []string, err error) {
+	logger := logging.LoggerFromCtx(ctx)
+
+	networkInterfaces, err := getScaleSetVmsNetworkInterfaces(ctx, subscriptionId, resourceGroupName, vmScaleSetName)
+	if err != nil {
+		return
+	}
+
+	var vmNics []*armnetwork.Interface
+	for _, networkInterface := range networkInterfaces {
+		if networkInterface.Name == nil || networkInterface.Properties == nil || networkInterface.Properties.VirtualMachine == nil || len(networkInterface.Properties.IPConfigurations) < 1 {
+			continue
+		}
+		vmNameParts := strings.Split(*networkInterface.Properties.VirtualMachine.ID, "/")
+		vmNamePartsLen := len(vmNameParts)
+		if fmt.Sprintf("%s_%s", vmNameParts[vmNamePartsLen-3], vmNameParts[vmNamePartsLen-1]) != vmName {
+			continue
+		}
+		vmNics = append(vmNics, networkInterface)
+	}
+	sort.Slice(vmNics, func(i, j int) bool {
+		iPrimary := vmNics[i].Properties.Primary != nil && *vmNics[i].Properties.Primary
+		jPrimary := vmNics[j].Properties.Primary != nil && *vmNics[j].Properties.Primary
+		if iPrimary != jPrimary {
+			return iPrimary
+		}
+		return getNicIndex(*vmNics[i].Name) < getNicIndex(*vmNics[j].Name)
+	})
+
+	for _, networkInterface := range vmNics {
+		ipConfiguration := networkInterface.Properties.IPConfigurations[0]
+		if ipConfiguration.Properties == nil || ipConfiguration.Properties.PrivateIPAddress == nil {
+			err = fmt.Errorf("nic %s of vm %s has no private ip yet", *networkInterface.Name, vmName)
+			logger.Error().Err(err).Send()
+			return
+		}
+		nicsIps = append(nicsIps, *ipConfiguration.Properties.PrivateIPAddress)
+	}
+	if len(nicsIps) == 0 {
+		err = fmt.Errorf("no nics found for vm %s", vmName)
+		logger.Error().Err(err).Send()
+	}
+	return
+}
+
+// GetScaleSetsVmsFaultDomains returns the azure platform fault domain of the scale sets vms, by vm name
+func GetScaleSetsVmsFaultDomains(ctx context.Context, subscriptionId, resourceGroupName string, vmScaleSetNames []string) (faultDomains map[string]int, err error) {
+	faultDomains = make(map[string]int)
+	expand := "instanceView"
+	var lock sync.Mutex
+	err = ForEachParallel(ctx, len(vmScaleSetNames), AzureApiMaxParallelism, func(ctx context.Context, i int) error {
+		vms, err := GetScaleSetInstances(ctx, subscriptionId, resourceGroupName, vmScaleSetNames[i], &expand)
+		if err != nil {
+			return err
+		}
+		lock.Lock()
+		defer lock.Unlock()
+		for _, vm := range vms {
+			if vm.Name == nil || vm.Properties == nil || vm.Properties.InstanceView == nil || vm.Properties.InstanceView.PlatformFaultDomain == nil {
+				continue
+			}
+			faultDomains[*vm.Name] = int(*vm.Properties.InstanceView.PlatformFaultDomain)
+		}
+		return nil
+	})
+	return
+}
+
+func UpdateVmScaleSetNum(ctx context.Context, subscriptionId, resourceGroupName, vmScaleSetName string, newSize int64) (err error) {
+	logger := logging.LoggerFromCtx(ctx)
+	logger.Info().Msg("updating scale set vms num")
+
+	credential, err := azidentity.NewDefaultAzureCredential(getCredentialOptions())
+	if err != nil {
+		logger.Error().Err(err).Send()
+		return
+	}
+	client, err := armcompute.NewVirtualMachineScaleSetsClient(subscriptionId, credential, getArmClientOptions())
+	if err != nil {
+		logger.Error().Err(err).Send()
+		return
+	}
+
+	_, err = client.BeginUpdate(ctx, resourceGroupName, vmScaleSetName, armcompute.VirtualMachineScaleSetUpdate{
+		SKU: &armcompute.SKU{
+			Capacity: &newSize,
+		},
+	}, nil)
+	if err != nil {
+		logger.Error().Err(err).Send()
+	}
+	return
+}
+
+// splitScaleSetsCapacity spreads the capacity over the scale sets, the missing vms are added to the scale sets with
+// the fewest vms first, a scale set is never shrunk, the scale down terminates the chosen vms instead
+func splitScaleSetsCapacity(sizes []int64, capacity int64) (capacities []int64) {
+	capacities = append([]int64(nil), sizes...)
+	var total int64
+	for _, size := range sizes {
+		total += size
+	}
+	for ; total < capacity; total++ {
+		smallest := 0
+		for i := range capacities {
+			if capacities[i] < capacities[smallest] {
+				smallest = i
+			}
+		}
+		capacities[smallest]++
+	}
+	return
+}
+
+// UpdateScaleSetsCapacity sets the capacity of the cluster, a zonal deployment spreads it over the zone scale sets
+func UpdateScaleSetsCapacity(ctx context.Context, subscriptionId, resourceGroupName string, vmScaleSetNames []string, capacity int64) (err error) {
+	if len(vmScaleSetNames) == 1 {
+		return UpdateVmScaleSetNum(ctx, subscriptionId, resourceGroupName, vmScaleSetNames[0], capacity)
+	}
+
+	sizes := make([]int64, len(vmScaleSetNames))
+	for i, vmScaleSetName := range vmScaleSetNames {
+		var vms []*armcompute.VirtualMachineScaleSetVM
+		vms, err = GetScaleSetInstances(ctx, subscriptionId, resourceGroupName, vmScaleSetName, nil)
+		if err != nil {
+			return
+		}
+		sizes[i] = int64(len(vms))
+	}
+	for i, scaleSetCapacity := range splitScaleSetsCapacity(sizes, capacity) {
+		if scaleSetCapacity == sizes[i] {
+			continue
+		}
+		err = UpdateVmScaleSetNum(ctx, subscriptionId, resourceGroupName, vmScaleSetNames[i], scaleSetCapacity)
+		if err != nil {
+			return
+		}
+	}
+	return
+}
+
+func GetRoleDefinitionByRoleName(ctx context.Context, roleName, scope string) (*armauthorization.RoleDefinition, error) {
+	logger := logging.LoggerFromCtx(ctx)
+
+	cred, err := azidentity.NewDefaultAzureCredential(getCredentialOptions())
+	if err != nil {
+		logger.Error().Err(err).Send()
+		return nil, err
+	}
+
+	client, err := armauthorization.NewRoleDefinitionsClient(cred, getArmClientOptions())
+	if err != nil {
+		logger.Error().Err(err).Send()
+		return nil, err
+	}
+
+	var results []*armauthorization.RoleDefinition
+	filter := fmt.Sprintf("roleName eq '%s'", roleName)
+
+	pager := client.NewListPager("/", &armauthorization.RoleDefinitionsClientListOptions{Filter: &filter})
+	for pager.More() {
+		nextResult, err := pager.NextPage(ctx)
+		if err != nil {
+			logger.Error().Err(err).Send()
+			return nil, err
+		}
+		results = append(results, nextResult.Value...)
+	}
+
+	// filter the needed role out of all built-in ones
+	var roleDefs []*armauthorization.RoleDefinition
+	for _, res := range results {
+		if *res.Properties.RoleName == roleName {
+			roleDefs = append(roleDefs, res)
+		}
+	}
+
+	if len(roleDefs) < 1 {
+		err := fmt.Errorf("cannot find az role definition with name '%s'", roleName)
+		logger.Error().Err(err).Send()
+		return nil, err
+	}
+	if len(roleDefs) > 1 {
+		err := fmt.Errorf("found several az role definitions with name '%s', check the name", roleName)
+		logger.Error().Err(err).Send()
+		return nil, err
+	}
+	return roleDefs[0], nil
+}
+
+func AssignStorageBlobDataContributorRoleToScaleSet(
+	ctx context.Context, subscriptionId, resourceGroupName, vmScaleSetName, storageAccountName, containerName string,
+) (*armauthorization.RoleAssignment, error) {
+	return assignContainerRoleToScaleSet(ctx, subscriptionId, resourceGroupName, vmScaleSetName, storageAccountName, containerName, "Storage Blob Data Contributor")
+}
+
+// AssignStorageBlobDataReaderRoleToScaleSet lets the scale set identity read the blobs of the container
+func AssignStorageBlobDataReaderRoleToScaleSet(
+	ctx context.Context, subscriptionId, resourceGroupName, vmScaleSetName, storageAccountName, containerName string,
+) (*armauthorization.RoleAssignment, error) {
+	return assignContainerRoleToScaleSet(ctx, subscriptionId, resourceGroupName, vmScaleSetName, storageAccountName, containerName, "Storage Blob Data Reader")
+}
+
+func assignContainerRoleToScaleSet(
+	ctx context.Context, subscriptionId, resourceGroupName, vmScaleSetName, storageAccountName, containerName, roleName string,
+) (*armauthorization.RoleAssignment, error) {
+	logger := logging.LoggerFromCtx(ctx)
+
+	cred, err := azidentity.NewDefaultAzureCredential(getCredentialOptions())
+	if err != nil {
+		logger.Error().Err(err).Send()
+		return nil, err
+	}
+
+	client, err := armauthorization.NewRoleAssignmentsClient(subscriptionId, cred, getArmClientOptions())
+	if err != nil {
+		logger.Error().Err(err).Send()
+		return nil, err
+	}
+
+	scaleSet, err := getScaleSet(ctx, subscriptionId, resourceGroupName, vmScaleSetName)
+	if err != nil {
+		logger.Error().Err(err).Send()
+		return nil, err
+	}
+
+	scope := fmt.Sprintf(
+		"/subscriptions/%s/resourceGroups/%s/providers/Microsoft.Storage/storageAccounts/%s/blobServices/default/containers/%s",
+		subscriptionId,
+		resourceGroupName,
+		storageAccountName,
+		containerName,
+	)
+
+	roleDefinition, err := GetRoleDefinitionByRoleName(ctx, roleName, scope)
+	if err != nil {
+		err = fmt.Errorf("cannot get the role definition: %v", err)
+		logger.Error().Err(err).Send()
+		return nil, err
+	}
+
+	// see https://learn.microsoft.com/en-us/rest/api/authorization/role-assignments/create
+	res, err := client.Create(
+		ctx,
+		scope,
+		uuid.New().String(), // az docs say it should be GUID
+		armauthorization.RoleAssignmentCreateParameters{
+			Properties: &armauthorization.RoleAssignmentProperties{
+				RoleDefinitionID: roleDefinition.ID,
+				PrincipalID:      scaleSet.Identity.PrincipalID,
+			},
+		},
+		nil,
+	)
+	// the assignment is left from a previous clusterization attempt
+	if azerr, ok := err.(*azcore.ResponseError); ok && azerr.ErrorCode == "RoleAssignmentExists" {
+		return nil, nil
+	}
+	if err != nil {
+		err = fmt.Errorf("cannot create the role assignment: %v", err)
+		logger.Error().Err(err).Send()
+		return nil, err
+	}
+
+	return &res.RoleAssignment, nil
+}
+
+// CreateKeyVaultKey creates the rsa key used as the weka kms master key, an existing key is kept and validated
+// since the weka encryption keys are wrapped with it; returns the key vault uri
+func CreateKeyVaultKey(ctx context.Context, subscriptionId, keyVaultId, keyName string) (keyVaultUri string, err error) {
+	logger := logging.LoggerFromCtx(ctx)
+	logger.Info().Msgf("Creating key vault key %s in %s", keyName, keyVaultId)
+
+	keyVaultResourceId, err := arm.ParseResourceID(keyVaultId)
+	if err != nil {
+		logger.Error().Err(err).Send()
+		return
+	}
+
+	credential, err := azidentity.NewDefaultAzureCredential(getCredentialOptions())
+	if err != nil {
+		logger.Error().Err(err).Send()
+		return
+	}
+
+	vaultsClient, err := armkeyvault.NewVaultsClient(subscriptionId, credential, getArmClientOptions())
+	if err != nil {
+		logger.Error().Err(err).Send()
+		return
+	}
+
+	vault, err := vaultsClient.Get(ctx, keyVaultResourceId.ResourceGroupName, keyVaultResourceId.Name, nil)
+	if err != nil {
+		logger.Error().Err(err).Send()
+		return
+	}
+	keyVaultUri = *vault.Properties.VaultURI
+
+	keysClient, err := armkeyvault.NewKeysClient(subscriptionId, credential, getArmClientOptions())
+	if err != nil {
+		logger.Error().Err(err).Send()
+		return
+	}
+
+	key, err := keysClient.CreateIfNotExist(ctx, keyVaultResourceId.ResourceGroupName, keyVaultResourceId.Name, keyName, armkeyvault.KeyCreateParameters{
+		Tags: GetResourceTags(ctx, Getenv(ctx, "CLUSTER_NAME")),
+		Properties: &armkeyvault.KeyProperties{
+			Kty:     to.Ptr(armkeyvault.JSONWebKeyTypeRSA),
+			KeySize: to.Ptr[int32](2048),
+			KeyOps: []*armkeyvault.JSONWebKeyOperation{
+				to.Ptr(armkeyvault.JSONWebKeyOperationWrapKey),
+				to.Ptr(armkeyvault.JSONWebKeyOperationUnwrapKey),
+			},
+		},
+	}, nil)
+	if err != nil {
+		logger.Error().Err(err).Send()
+		return
+	}
+
+	if key.Properties.Attributes != nil && key.Properties.Attributes.Enabled != nil && !*key.Properties.Attributes.Enabled {
+		err = fmt.Errorf("key vault key %s is disabled", keyName)
+		logger.Error().Err(err).Send()
+		return
+	}
+	keyOps := make(map[armkeyvault.JSONWebKeyOperation]bool)
+	for _, keyOp := range key.Properties.KeyOps {
+		keyOps[*keyOp] = true
+	}
+	// no key ops means all operations are permitted
+	if len(keyOps) > 0 && (!keyOps[armkeyvault.JSONWebKeyOperationWrapKey] || !keyOps[armkeyvault.JSONWebKeyOperationUnwrapKey]) {
+		err = fmt.Errorf("key vault key %s doesn't permit wrapKey and unwrapKey", keyName)
+		logger.Error().Err(err).Send()
+		return
+	}
+	return
+}
+
+// GrantKeyVaultKeysAccessToScaleSet adds an access policy which lets the scale set identity wrap and unwrap keys
+func GrantKeyVaultKeysAccessToScaleSet(ctx context.Context, subscriptionId, resourceGroupName, vmScaleSetName, keyVaultId string) (err error) {
+	logger := logging.LoggerFromCtx(ctx)
+	logger.Info().Msgf("Granting scale set %s access to key vault %s keys", vmScaleSetName, keyVaultId)
+
+	return grantKeyVaultAccessToScaleSet(ctx, subscriptionId, resourceGroupName, vmScaleSetName, keyVaultId, &armkeyvault.Permissions{
+		Keys: []*armkeyvault.KeyPermissions{
+			to.Ptr(armkeyvault.KeyPermissionsGet),
+			to.Ptr(armkeyvault.KeyPermissionsWrapKey),
+			to.Ptr(armkeyvault.KeyPermissionsUnwrapKey),
+		},
+	})
+}
+
+// GrantKeyVaultSecretsAccessToScaleSet adds an access policy which lets the scale set identity read secrets,
+// the vms fetch the secrets with their managed identity instead of getting them in the scripts
+func GrantKeyVaultSecretsAccessToScaleSet(ctx context.Context, subscriptionId, resourceGroupName, vmScaleSetName, keyVaultId string) (err error) {
+	logger := logging.LoggerFromCtx(ctx)
+	logger.Info().Msgf("Granting scale set %s access to key vault %s secrets", vmScaleSetName, keyVaultId)
+
+	return grantKeyVaultAccessToScaleSet(ctx, subscriptionId, resourceGroupName, vmScaleSetName, keyVaultId, &armkeyvault.Permissions{
+		Secrets: []*armkeyvault.SecretPermissions{to.Ptr(armkeyvault.SecretPermissionsGet)},
+	})
+}
+
+func grantKeyVaultAccessToScaleSet(
+	ctx context.Context, subscriptionId, resourceGroupName, vmScaleSetName, keyVaultId string, permissions *armkeyvault.Permissions,
+) (err error) {
+	logger := logging.LoggerFromCtx(ctx)
+
+	keyVaultResourceId, err := arm.ParseResourceID(keyVaultId)
+	if err != nil {
+		logger.Error().Err(err).Send()
+		return
+	}
+
+	scaleSet, err := getScaleSet(ctx, subscriptionId, resourceGroupName, vmScaleSetName)
+	if err != nil {
+		return
+	}
+	if scaleSet.Identity == nil || scaleSet.Identity.PrincipalID == nil {
+		err = fmt.Errorf("scale set %s has no system assigned identity", vmScaleSetName)
+		logger.Error().Err(err).Send()
+		return
+	}
+
+	credential, err := azidentity.NewDefaultAzureCredential(getCredentialOptions())
+	if err != nil {
+		logger.Error().Err(err).Send()
+		return
+	}
+
+	client, err := armkeyvault.NewVaultsClient(subscriptionId, credential, getArmClientOptions())
+	if err != nil {
+		logger.Error().Err(err).Send()
+		return
+	}
+
+	_, err = client.UpdateAccessPolicy(ctx, keyVaultResourceId.ResourceGroupName, keyVaultResourceId.Name, armkeyvault.AccessPolicyUpdateKindAdd, armkeyvault.VaultAccessPolicyParameters{
+		Properties: &armkeyvault.VaultAccessPolicyProperties{
+			AccessPolicies: []*armkeyvault.AccessPolicyEntry{
+				{
+					TenantID:    scaleSet.Identity.TenantID,
+					ObjectID:    scaleSet.Identity.PrincipalID,
+					Permissions: permissions,
+				},
+			},
+		},
+	}, nil)
+	if err != nil {
+		logger.Error().Err(err).Send()
+	}
+	return
+}
+
+// DeleteScaleSetRoleAssignments deletes the role assignments of the scale set identity in the resource group,
+// they are not removed along with the identity and are left orphaned otherwise
+func DeleteScaleSetRoleAssignments(ctx context.Context, subscriptionId, resourceGroupName, vmScaleSetName string) (deleted int, err error) {
+	logger := logging.LoggerFromCtx(ctx)
+
+	scaleSet, err := getScaleSet(ctx, subscriptionId, resourceGroupName, vmScaleSetName)
+	if err != nil {
+		return
+	}
+	if scaleSet.Identity == nil || scaleSet.Identity.PrincipalID == nil {
+		return
+	}
+
+	cred, err := azidentity.NewDefaultAzureCredential(getCredentialOptions())
+	if err != nil {
+		logger.Error().Err(err).Send()
+		return
+	}
+
+	client, err := armauthorization.NewRoleAssignmentsClient(subscriptionId, cred, getArmClientOptions())
+	if err != nil {
+		logger.Error().Err(err).Send()
+		return
+	}
+
+	filter := fmt.Sprintf("principalId eq '%s'", *scaleSet.Identity.PrincipalID)
+	pager := client.NewListForResourceGroupPager(resourceGroupName, &armauthorization.RoleAssignmentsClientListForResourceGroupOptions{Filter: &filter})
+	for pager.More() {
+		nextResult, pageErr := pager.NextPage(ctx)
+		if pageErr != nil {
+			err = pageErr
+			logger.Error().Err(err).Send()
+			return
+		}
+		for _, roleAssignment := range nextResult.Value {
+			logger.Info().Msgf("deleting role assignment %s", *roleAssignment.ID)
+			_, err = client.DeleteByID(ctx, *roleAssignment.ID, nil)
+			if err != nil {
+				logger.Error().Err(err).Send()
+				return
+			}
+			deleted++
+		}
+	}
+	return
+}
+
+type ScaleSetInfo struct {
+	Id            string
+	Name          string
+	AdminUsername string
+	AdminPassword string
+	Capacity      int
+	VMSize        string
+}
+
+// Gets scale set
+// see https://learn.microsoft.com/en-us/rest/api/compute/virtual-machine-scale-sets/get
+func getScaleSet(ctx context.Context, subscriptionId, resourceGroupName, vmScaleSetName string) (*armcompute.VirtualMachineScaleSet, error) {
+	logger := logging.LoggerFromCtx(ctx)
+	logger.Info().Msgf("Getting scale set %s info", vmScaleSetName)
+
+	credential, err := azidentity.NewDefaultAzureCredential(getCredentialOptions())
+	if err != nil {
+		logger.Error().Err(err).Send()
+		return nil, err
+	}
+
+	client, err := armcompute.NewVirtualMachineScaleSetsClient(subscriptionId, credential, getArmClientOptions())
+	if err != nil {
+		logger.Error().Err(err).Send()
+		return nil, err
+	}
+
+	scaleSet, err := client.Get(ctx, resourceGroupName, vmScaleSetName, nil)
+	if err != nil {
+		logger.Error().Err(err).Send()
+		return nil, err
+	}
+	return &scaleSet.VirtualMachineScaleSet, nil
+}
+
+// Gets single scale set info
+func GetScaleSetInfo(ctx context.Context, subscriptionId, resourceGroupName, vmScaleSetName, keyVaultUri string) (*ScaleSetInfo, error) {
+	logger := logging.LoggerFromCtx(ctx)
+
+	scaleSet, err := getScaleSet(ctx, subscriptionId, resourceGroupName, vmScaleSetName)
+	if err != nil {
+		logger.Error().Err(err).Send()
+		return nil, err
+	}
+
+	wekaUsername, wekaPassword, err := GetWekaCredentials(ctx, keyVaultUri)
+	if err != nil {
+		logger.Error().Err(err).Send()
+		return nil, err
+	}
+
+	scaleSetInfo := ScaleSetInfo{
+		Id:            *scaleSet.ID,
+		Name:          *scaleSet.Name,
+		AdminUsername: wekaUsername,
+		AdminPassword: wekaPassword,
+		Capacity:      int(*scaleSet.SKU.Capacity),
+		VMSize:        *scaleSet.SKU.Name,
+	}
+	return &scaleSetInfo, err
+}
+
+// Gets a list of all VMs in a scale set
+// see https://learn.microsoft.com/en-us/rest/api/compute/virtual-machine-scale-set-vms/list
+func GetScaleSetInstances(ctx context.Context, subscriptionId, resourceGroupName, vmScaleSetName string, expand *string) (vms []*armcompute.VirtualMachineScaleSetVM, err error) {
+	return ClientsFromCtx(ctx).Compute.ListScaleSetVms(ctx, subscriptionId, resourceGroupName, vmScaleSetName, expand)
+}
+
+type ScaleSetInstanceInfo struct {
+	Id        string
+	PrivateIp string
+}
+
+func GetScaleSetVmId(resourceId string) string {
+	vmNameParts := strings.Split(resourceId, "/")
+	vmNamePartsLen := len(vmNameParts)
+	vmId := vmNameParts[vmNamePartsLen-1]
+	return vmId
+}
+
+func GetScaleSetInstancesInfo(ctx context.Context, subscriptionId, resourceGroupName, vmScaleSetName string) (instances []ScaleSetInstanceInfo, err error) {
+	logger := logging.LoggerFromCtx(ctx)
+	logger.Info().Msgf("Getting scale set instances %s info", vmScaleSetName)
+
+	netInterfaces, err := GetScaleSetVmsNetworkPrimaryNICs(ctx, subscriptionId, resourceGroupName, vmScaleSetName)
+	if err != nil {
+		return
+	}
+	instanceIdPrivateIp := map[string]string{}
+
+	for _, ni := range netInterfaces {
+		id := GetScaleSetVmId(*ni.Properties.VirtualMachine.ID)
+		privateIp := *ni.Properties.IPConfigurations[0].Properties.PrivateIPAddress
+		instanceIdPrivateIp[id] = privateIp
+	}
+
+	vms, err := GetScaleSetInstances(ctx, subscriptionId, resourceGroupName, vmScaleSetName, nil)
+	if err != nil {
+		return
+	}
+	for _, vm := range vms {
+		id := GetScaleSetVmId(*vm.ID)
+		// get private ip if exists
+		var privateIp string
+		if val, ok := instanceIdPrivateIp[id]; ok {
+			privateIp = val
+		}
+		instanceInfo := ScaleSetInstanceInfo{
+			Id:        id,
+			PrivateIp: privateIp,
+		}
+		instances = append(instances, instanceInfo)
+	}
+	return
+}
+
+func GetScaleSetVmIndex(vmName string) string {
+	instanceNameParts := strings.Split(vmName, "_")
+	return instanceNameParts[len(instanceNameParts)-1]
+}
+
+// SetDeletionProtection protects the instance from both scale in (autoscale or capacity changes) and scale set actions,
+// protection is removed only by the termination step once the instance weka containers were deactivated
+func SetDeletionProtection(ctx context.Context, subscriptionId, resourceGroupName, vmScaleSetName, instanceId string, protect bool) (err error) {
+	logger := logging.LoggerFromCtx(ctx)
+	logger.Info().Msgf("Setting deletion protection: %t on instanceId %s", protect, instanceId)
+
+	credential, err := azidentity.NewDefaultAzureCredential(getCredentialOptions())
+	if err != nil {
+		logger.Error().Err(err).Send()
+		return
+	}
+
+	client, err := armcompute.NewVirtualMachineScaleSetVMsClient(subscriptionId, credential, getArmClientOptions())
+	if err != nil {
+		logger.Error().Err(err).Send()
+		return
+	}
+
+	_, err = client.BeginUpdate(
+		ctx,
+		resourceGroupName,
+		vmScaleSetName,
+		instanceId,
+		armcompute.VirtualMachineScaleSetVM{
+			Properties: &armcompute.VirtualMachineScaleSetVMProperties{
+				ProtectionPolicy: &armcompute.VirtualMachineScaleSetVMProtectionPolicy{
+					ProtectFromScaleIn:         &protect,
+					ProtectFromScaleSetActions: &protect,
+				},
+			},
+		},
+		nil)
+
+	return
+}
+
+// StartScaleSetVmRunCommand starts a shell script on a scale set vm without waiting for it,
+// the returned resume token allows a later invocation to follow the command
+func StartScaleSetVmRunCommand(ctx context.Context, subscriptionId, resourceGroupName, vmScaleSetName, instanceId, script string) (resumeToken string, err error) {
+	return StartScaleSetVmRunCommandWithParameters(ctx, subscriptionId, resourceGroupName, vmScaleSetName, instanceId, script, nil)
+}
+
+// StartScaleSetVmRunCommandWithParameters is StartScaleSetVmRunCommand with parameters set as environment
+// variables of the script, secrets passed as parameters are not part of the script
+func StartScaleSetVmRunCommandWithParameters(ctx context.Context, subscriptionId, resourceGroupName, vmScaleSetName, instanceId, script string, parameters map[string]string) (resumeToken string, err error) {
+	logger := logging.LoggerFromCtx(ctx)
+	logger.Info().Msgf("Starting run command on %s instance %s", vmScaleSetName, instanceId)
+
+	credential, err := azidentity.NewDefaultAzureCredential(getCredentialOptions())
+	if err != nil {
+		logger.Error().Err(err).Send()
+		return
+	}
+
+	client, err := armcompute.NewVirtualMachineScaleSetVMsClient(subscriptionId, credential, getArmClientOptions())
+	if err != nil {
+		logger.Error().Err(err).Send()
+		return
+	}
+
+	var runCommandParameters []*armcompute.RunCommandInputParameter
+	for name, value := range parameters {
+		runCommandParameters = append(runCommandParameters, &armcompute.RunCommandInputParameter{
+			Name:  to.Ptr(name),
+			Value: to.Ptr(value),
+		})
+	}
+
+	poller, err := client.BeginRunCommand(
+		ctx,
+		resourceGroupName,
+		vmScaleSetName,
+		instanceId,
+		armcompute.RunCommandInput{
+			CommandID:  to.Ptr("RunShellScript"),
+			Script:     []*string{&script},
+			Parameters: runCommandParameters,
+		},
+		nil)
+	if err != nil {
+		logger.Error().Err(err).Send()
+		return
+	}
+
+	resumeToken, err = poller.ResumeToken()
+	if err != nil {
+		logger.Error().Err(err).Send()
+	}
+	return
+}
+
+// getBackendVmNames returns the sorted names of the backends which are not evicted nor idle in the warm pool
+func getBackendVmNames(ctx context.Context, subscriptionId, resourceGroupName, stateStorageName, stateContainerName, prefix, clusterName string) (vmNames []string, err error) {
+	vmsPrivateIps, err := GetScaleSetsVmsPrivateIps(ctx, subscriptionId, resourceGroupName, GetVmScaleSetNames(ctx, prefix, clusterName))
+	if err != nil {
+		return
+	}
+	evictions, err := GetEvictions(ctx, stateStorageName, stateContainerName)
+	if err != nil {
+		return
+	}
+	warmPool, err := GetWarmPool(ctx, stateStorageName, stateContainerName)
+	if err != nil {
+		return
+	}
+	for name := range vmsPrivateIps {
+		if _, evicted := evictions[name]; !evicted && !warmPool.IsIdle(name) {
+			vmNames = append(vmNames, name)
+		}
+	}
+	sort.Strings(vmNames)
+	return
+}
+
+func getWekaCredentialsParameters(ctx context.Context, keyVaultUri string) (parameters map[string]string, err error) {
+	wekaUsername, wekaPassword, err := GetWekaCredentials(ctx, keyVaultUri)
+	if err != nil {
+		return
+	}
+	parameters = map[string]string{
+		"WEKA_USERNAME": wekaUsername,
+		"WEKA_PASSWORD": wekaPassword,
+	}
+	return
+}
+
+// StartBackendScript starts the script with the weka credentials as parameters on the first non evicted backend it
+// can be started on, the scripts report their result to the report function
+func StartBackendScript(ctx context.Context, subscriptionId, resourceGroupName, stateStorageName, stateContainerName, keyVaultUri, prefix, clusterName, script string) (vmName string, err error) {
+	logger := logging.LoggerFromCtx(ctx)
+
+	parameters, err := getWekaCredentialsParameters(ctx, keyVaultUri)
+	if err != nil {
+		return
+	}
+	vmNames, err := getBackendVmNames(ctx, subscriptionId, resourceGroupName, stateStorageName, stateContainerName, prefix, clusterName)
+	if err != nil {
+		return
+	}
+
+	err = fmt.Errorf("no backends found for cluster %s", clusterName)
+	for _, name := range vmNames {
+		_, err = StartScaleSetVmRunCommandWithParameters(
+			ctx, subscriptionId, resourceGroupName, GetVmScaleSetNameFromVmName(name), GetScaleSetVmIndex(name), script, parameters,
+		)
+		if err == nil {
+			vmName = name
+			return
+		}
+		logger.Warn().Err(err).Msgf("failed to start the script on %s", name)
+	}
+	logger.Error().Err(err).Send()
+	return
+}
+
+// StartAllBackendsScript starts the script with the weka credentials as parameters on every non evicted backend,
+// the first backend the script is started on gets the LEADER=true parameter, so the cluster wide commands run once.
+// The backends the script failed to start on are returned with their error
+func StartAllBackendsScript(ctx context.Context, subscriptionId, resourceGroupName, stateStorageName, stateContainerName, keyVaultUri, prefix, clusterName, script string) (leader string, started []string, failed map[string]string, err error) {
+	logger := logging.LoggerFromCtx(ctx)
+
+	credentials, err := getWekaCredentialsParameters(ctx, keyVaultUri)
+	if err != nil {
+		return
+	}
+	vmNames, err := getBackendVmNames(ctx, subscriptionId, resourceGroupName, stateStorageName, stateContainerName, prefix, clusterName)
+	if err != nil {
+		return
+	}
+	if len(vmNames) == 0 {
+		err = fmt.Errorf("no backends found for cluster %s", clusterName)
+		return
+	}
+
+	failed = make(map[string]string)
+	for _, name := range vmNames {
+		parameters := map[string]string{"LEADER": strconv.FormatBool(leader == "")}
+		for key, value := range credentials {
+			parameters[key] = value
+		}
+		_, startErr := StartScaleSetVmRunCommandWithParameters(
+			ctx, subscriptionId, resourceGroupName, GetVmScaleSetNameFromVmName(name), GetScaleSetVmIndex(name), script, parameters,
+		)
+		if startErr != nil {
+			logger.Warn().Err(startErr).Msgf("failed to start the script on %s", name)
+			failed[name] = startErr.Error()
+			continue
+		}
+		if leader == "" {
+			leader = name
+		}
+		started = append(started, name)
+	}
+	if leader == "" {
+		err = fmt.Errorf("failed to start the script on the backends of cluster %s", clusterName)
+		logger.Error().Err(err).Send()
+	}
+	return
+}
+
+// PollScaleSetVmRunCommand polls a run command started by StartScaleSetVmRunCommand once,
+// the script output is returned once it is done
+func PollScaleSetVmRunCommand(ctx context.Context, subscriptionId, resourceGroupName, vmScaleSetName, instanceId, resumeToken string) (done bool, output string, err error) {
+	logger := logging.LoggerFromCtx(ctx)
+
+	credential, err := azidentity.NewDefaultAzureCredential(getCredentialOptions())
+	if err != nil {
+		logger.Error().Err(err).Send()
+		return
+	}
+
+	client, err := armcompute.NewVirtualMachineScaleSetVMsClient(subscriptionId, credential, getArmClientOptions())
+	if err != nil {
+		logger.Error().Err(err).Send()
+		return
+	}
+
+	poller, err := client.BeginRunCommand(
+		ctx,
+		resourceGroupName,
+		vmScaleSetName,
+		instanceId,
+		armcompute.RunCommandInput{},
+		&armcompute.VirtualMachineScaleSetVMsClientBeginRunCommandOptions{ResumeToken: resumeToken})
+	if err != nil {
+		logger.Error().Err(err).Send()
+		return
+	}
+
+	if !poller.Done() {
+		_, err = poller.Poll(ctx)
+		if err != nil {
+			logger.Error().Err(err).Send()
+			return
+		}
+		if !poller.Done() {
+			return
+		}
+	}
+	done = true
+
+	result, err := poller.Result(ctx)
+	if err != nil {
+		logger.Error().Err(err).Send()
+		return
+	}
+	var messages []string
+	for _, status := range result.Value {
+		if status.Message != nil {
+			messages = append(messages, *status.Message)
+		}
+	}
+	output = strings.Join(messages, "\n")
+	return
+}
+
+type ScriptExtensionConfig struct {
+	StorageAccountName string
+	ContainerName      string
+	ScriptBlobName     string
+}
+
+// ParseScriptExtensionBlobUrl splits a blob url of the form https://<account>.blob.<suffix>/<container>/<blob>
+func ParseScriptExtensionBlobUrl(blobUrl string) (config ScriptExtensionConfig, err error) {
+	parsed, err := url.Parse(blobUrl)
+	if err != nil {
+		return
+	}
+	containerName, blobName, _ := strings.Cut(strings.TrimPrefix(parsed.Path, "/"), "/")
+	if parsed.Scheme != "https" || containerName == "" || blobName == "" {
+		err = fmt.Errorf("%s is not a blob url", blobUrl)
+		return
+	}
+	config = ScriptExtensionConfig{
+		StorageAccountName: strings.Split(parsed.Host, ".")[0],
+		ContainerName:      containerName,
+		ScriptBlobName:     blobName,
 	}
-	return roleDefs[0], nil
+	return
 }
 
-func AssignStorageBlobDataContributorRoleToScaleSet(
-	ctx context.Context, subscriptionId, resourceGroupName, vmScaleSetName, storageAccountName, containerName string,
-) (*armauthorization.RoleAssignment, error) {
-	logger := logging.LoggerFromCtx(ctx)
+// ScriptUrl is the url the extension downloads the script from
+func (c ScriptExtensionConfig) ScriptUrl() string {
+	return fmt.Sprintf("%s%s/%s", GetBlobUrl(c.StorageAccountName), c.ContainerName, c.ScriptBlobName)
+}
 
-	cred, err := azidentity.NewDefaultAzureCredential(nil)
-	if err != nil {
-		logger.Error().Err(err).Send()
-		return nil, err
-	}
+// ScriptCommand runs the script, the extension downloads it to its working directory by its file name
+func (c ScriptExtensionConfig) ScriptCommand() string {
+	return fmt.Sprintf("bash %s", path.Base(c.ScriptBlobName))
+}
 
-	client, err := armauthorization.NewRoleAssignmentsClient(subscriptionId, cred, nil)
-	if err != nil {
-		logger.Error().Err(err).Send()
-		return nil, err
-	}
+// Configures the Custom Script Extension on the scale set, so the bootstrap script is re-run after reimaging, the
+// script blob is uploaded by the operator and read with the scale set identity
+// see https://learn.microsoft.com/en-us/azure/virtual-machines/extensions/custom-script-linux
+func ConfigureVMSSCustomScriptExtension(ctx context.Context, subscriptionId, resourceGroupName, vmScaleSetName string, config ScriptExtensionConfig) (err error) {
+	logger := logging.LoggerFromCtx(ctx)
+	logger.Info().Msgf("Configuring custom script extension on scale set %s", vmScaleSetName)
 
-	scaleSet, err := getScaleSet(ctx, subscriptionId, resourceGroupName, vmScaleSetName)
+	credential, err := azidentity.NewDefaultAzureCredential(getCredentialOptions())
 	if err != nil {
 		logger.Error().Err(err).Send()
-		return nil, err
+		return
 	}
 
-	scope := fmt.Sprintf(
-		"/subscriptions/%s/resourceGroups/%s/providers/Microsoft.Storage/storageAccounts/%s/blobServices/default/containers/%s",
-		subscriptionId,
-		resourceGroupName,
-		storageAccountName,
-		containerName,
-	)
-
-	roleDefinition, err := GetRoleDefinitionByRoleName(ctx, "Storage Blob Data Contributor", scope)
+	client, err := armcompute.NewVirtualMachineScaleSetExtensionsClient(subscriptionId, credential, getArmClientOptions())
 	if err != nil {
-		err = fmt.Errorf("cannot get the role definition: %v", err)
 		logger.Error().Err(err).Send()
-		return nil, err
+		return
 	}
 
-	// see https://learn.microsoft.com/en-us/rest/api/authorization/role-assignments/create
-	res, err := client.Create(
-		ctx,
-		scope,
-		uuid.New().String(), // az docs say it should be GUID
-		armauthorization.RoleAssignmentCreateParameters{
-			Properties: &armauthorization.RoleAssignmentProperties{
-				RoleDefinitionID: roleDefinition.ID,
-				PrincipalID:      scaleSet.Identity.PrincipalID,
+	extensionName := "weka-reimage-recovery"
+	publisher := "Microsoft.Azure.Extensions"
+	extensionType := "CustomScript"
+	typeHandlerVersion := "2.1"
+	autoUpgradeMinorVersion := true
+
+	_, err = client.BeginCreateOrUpdate(ctx, resourceGroupName, vmScaleSetName, extensionName, armcompute.VirtualMachineScaleSetExtension{
+		Name: &extensionName,
+		Properties: &armcompute.VirtualMachineScaleSetExtensionProperties{
+			Publisher:               &publisher,
+			Type:                    &extensionType,
+			TypeHandlerVersion:      &typeHandlerVersion,
+			AutoUpgradeMinorVersion: &autoUpgradeMinorVersion,
+			// the script is fetched using the scale set system assigned identity
+			ProtectedSettings: map[string]interface{}{
+				"fileUris":         []string{config.ScriptUrl()},
+				"commandToExecute": config.ScriptCommand(),
+				"managedIdentity":  map[string]interface{}{},
 			},
 		},
-		nil,
-	)
+	}, nil)
 	if err != nil {
-		err = fmt.Errorf("cannot create the role assignment: %v", err)
 		logger.Error().Err(err).Send()
-		return nil, err
 	}
-
-	return &res.RoleAssignment, nil
+	return
 }
 
-type ScaleSetInfo struct {
-	Id            string
-	Name          string
-	AdminUsername string
-	AdminPassword string
-	Capacity      int
-	VMSize        string
-}
+const stateBlobBackupRetention = "P30D"
 
-// Gets scale set
-// see https://learn.microsoft.com/en-us/rest/api/compute/virtual-machine-scale-sets/get
-func getScaleSet(ctx context.Context, subscriptionId, resourceGroupName, vmScaleSetName string) (*armcompute.VirtualMachineScaleSet, error) {
+// Protects the state storage account with an operational blob backup policy and makes sure key vault secrets are
+// recoverable via soft delete (key vault has no azure backup datasource, soft delete is the supported recovery path)
+// the backup vault identity must have "Storage Account Backup Contributor" role on the state storage account
+func ConfigureAzureBackup(ctx context.Context, subscriptionId, resourceGroupName, vaultName, storageAccountId, keyVaultId string) (err error) {
 	logger := logging.LoggerFromCtx(ctx)
-	logger.Info().Msgf("Getting scale set %s info", vmScaleSetName)
+	logger.Info().Msgf("Configuring azure backup using backup vault %s", vaultName)
 
-	credential, err := azidentity.NewDefaultAzureCredential(nil)
+	storageAccountResourceId, err := arm.ParseResourceID(storageAccountId)
 	if err != nil {
 		logger.Error().Err(err).Send()
-		return nil, err
+		return
 	}
-
-	client, err := armcompute.NewVirtualMachineScaleSetsClient(subscriptionId, credential, nil)
+	keyVaultResourceId, err := arm.ParseResourceID(keyVaultId)
 	if err != nil {
 		logger.Error().Err(err).Send()
-		return nil, err
+		return
 	}
 
-	scaleSet, err := client.Get(ctx, resourceGroupName, vmScaleSetName, nil)
+	credential, err := azidentity.NewDefaultAzureCredential(getCredentialOptions())
 	if err != nil {
 		logger.Error().Err(err).Send()
-		return nil, err
+		return
 	}
-	return &scaleSet.VirtualMachineScaleSet, nil
-}
-
-// Gets single scale set info
-func GetScaleSetInfo(ctx context.Context, subscriptionId, resourceGroupName, vmScaleSetName, keyVaultUri string) (*ScaleSetInfo, error) {
-	logger := logging.LoggerFromCtx(ctx)
 
-	scaleSet, err := getScaleSet(ctx, subscriptionId, resourceGroupName, vmScaleSetName)
+	policiesClient, err := armdataprotection.NewBackupPoliciesClient(subscriptionId, credential, getArmClientOptions())
 	if err != nil {
 		logger.Error().Err(err).Send()
-		return nil, err
+		return
 	}
 
-	wekaPassword, err := GetWekaClusterPassword(ctx, keyVaultUri)
+	datasourceType := "Microsoft.Storage/storageAccounts/blobServices"
+	policyName := fmt.Sprintf("%s-state-policy", storageAccountResourceId.Name)
+	policy, err := policiesClient.CreateOrUpdate(ctx, resourceGroupName, vaultName, policyName, armdataprotection.BaseBackupPolicyResource{
+		Properties: &armdataprotection.BackupPolicy{
+			ObjectType:      to.Ptr("BackupPolicy"),
+			DatasourceTypes: []*string{&datasourceType},
+			PolicyRules: []armdataprotection.BasePolicyRuleClassification{
+				&armdataprotection.AzureRetentionRule{
+					Name:       to.Ptr("Default"),
+					ObjectType: to.Ptr("AzureRetentionRule"),
+					IsDefault:  to.Ptr(true),
+					Lifecycles: []*armdataprotection.SourceLifeCycle{
+						{
+							DeleteAfter: &armdataprotection.AbsoluteDeleteOption{
+								ObjectType: to.Ptr("AbsoluteDeleteOption"),
+								Duration:   to.Ptr(stateBlobBackupRetention),
+							},
+							SourceDataStore: &armdataprotection.DataStoreInfoBase{
+								ObjectType:    to.Ptr("DataStoreInfoBase"),
+								DataStoreType: to.Ptr(armdataprotection.DataStoreTypesOperationalStore),
+							},
+						},
+					},
+				},
+			},
+		},
+	}, nil)
 	if err != nil {
 		logger.Error().Err(err).Send()
-		return nil, err
+		return
 	}
 
-	scaleSetInfo := ScaleSetInfo{
-		Id:            *scaleSet.ID,
-		Name:          *scaleSet.Name,
-		AdminUsername: "admin",
-		AdminPassword: wekaPassword,
-		Capacity:      int(*scaleSet.SKU.Capacity),
-		VMSize:        *scaleSet.SKU.Name,
+	instancesClient, err := armdataprotection.NewBackupInstancesClient(subscriptionId, credential, getArmClientOptions())
+	if err != nil {
+		logger.Error().Err(err).Send()
+		return
 	}
-	return &scaleSetInfo, err
-}
-
-// Gets a list of all VMs in a scale set
-// see https://learn.microsoft.com/en-us/rest/api/compute/virtual-machine-scale-set-vms/list
-func GetScaleSetInstances(ctx context.Context, subscriptionId, resourceGroupName, vmScaleSetName string, expand *string) (vms []*armcompute.VirtualMachineScaleSetVM, err error) {
-	logger := logging.LoggerFromCtx(ctx)
 
-	credential, err := azidentity.NewDefaultAzureCredential(nil)
+	poller, err := instancesClient.BeginCreateOrUpdate(ctx, resourceGroupName, vaultName, storageAccountResourceId.Name, armdataprotection.BackupInstanceResource{
+		Properties: &armdataprotection.BackupInstance{
+			ObjectType:   to.Ptr("BackupInstance"),
+			FriendlyName: &storageAccountResourceId.Name,
+			DataSourceInfo: &armdataprotection.Datasource{
+				ObjectType:     to.Ptr("Datasource"),
+				DatasourceType: &datasourceType,
+				ResourceID:     &storageAccountId,
+				ResourceName:   &storageAccountResourceId.Name,
+				ResourceType:   to.Ptr("Microsoft.Storage/storageAccounts"),
+				ResourceURI:    &storageAccountId,
+			},
+			PolicyInfo: &armdataprotection.PolicyInfo{
+				PolicyID: policy.ID,
+			},
+		},
+	}, nil)
 	if err != nil {
 		logger.Error().Err(err).Send()
 		return
 	}
-
-	client, err := armcompute.NewVirtualMachineScaleSetVMsClient(subscriptionId, credential, nil)
+	_, err = poller.PollUntilDone(ctx, nil)
 	if err != nil {
 		logger.Error().Err(err).Send()
 		return
 	}
 
-	pager := client.NewListPager(
-		resourceGroupName, vmScaleSetName, &armcompute.VirtualMachineScaleSetVMsClientListOptions{
-			Expand: expand,
-		})
+	vaultsClient, err := armkeyvault.NewVaultsClient(subscriptionId, credential, getArmClientOptions())
+	if err != nil {
+		logger.Error().Err(err).Send()
+		return
+	}
 
-	for pager.More() {
-		nextResult, err := pager.NextPage(ctx)
-		if err != nil {
-			err = fmt.Errorf("failed to advance page getting images list: %v", err)
-			logger.Error().Err(err).Send()
-			return nil, err
-		}
-		vms = append(vms, nextResult.Value...)
+	// purge protection is irreversible and is left to terraform (purge_protection_enabled)
+	_, err = vaultsClient.Update(ctx, keyVaultResourceId.ResourceGroupName, keyVaultResourceId.Name, armkeyvault.VaultPatchParameters{
+		Properties: &armkeyvault.VaultPatchProperties{
+			EnableSoftDelete: to.Ptr(true),
+		},
+	}, nil)
+	if err != nil {
+		logger.Error().Err(err).Send()
 	}
 	return
 }
 
-type ScaleSetInstanceInfo struct {
-	Id        string
-	PrivateIp string
-}
-
-func GetScaleSetVmId(resourceId string) string {
-	vmNameParts := strings.Split(resourceId, "/")
-	vmNamePartsLen := len(vmNameParts)
-	vmId := vmNameParts[vmNamePartsLen-1]
-	return vmId
-}
-
-func GetScaleSetInstancesInfo(ctx context.Context, subscriptionId, resourceGroupName, vmScaleSetName string) (instances []ScaleSetInstanceInfo, err error) {
+// Applies a management lock on the given resource, lockLevel is either ReadOnly or CanNotDelete
+// note: locks must be removed before decommissioning the cluster (terraform destroy fails on locked resources)
+func ApplyResourceManagerLock(ctx context.Context, subscriptionId, resourceGroupName, resourceId, lockName, lockLevel string) (err error) {
 	logger := logging.LoggerFromCtx(ctx)
-	logger.Info().Msgf("Getting scale set instances %s info", vmScaleSetName)
+	logger.Info().Msgf("Applying %s lock %s on %s", lockLevel, lockName, resourceId)
 
-	netInterfaces, err := GetScaleSetVmsNetworkPrimaryNICs(ctx, subscriptionId, resourceGroupName, vmScaleSetName)
+	level := armlocks.LockLevel(lockLevel)
+	if level != armlocks.LockLevelReadOnly && level != armlocks.LockLevelCanNotDelete {
+		err = fmt.Errorf("unsupported lock level %s, supported levels: %s, %s", lockLevel, armlocks.LockLevelReadOnly, armlocks.LockLevelCanNotDelete)
+		logger.Error().Err(err).Send()
+		return
+	}
+
+	resource, err := arm.ParseResourceID(resourceId)
 	if err != nil {
+		logger.Error().Err(err).Send()
 		return
 	}
-	instanceIdPrivateIp := map[string]string{}
 
-	for _, ni := range netInterfaces {
-		id := GetScaleSetVmId(*ni.Properties.VirtualMachine.ID)
-		privateIp := *ni.Properties.IPConfigurations[0].Properties.PrivateIPAddress
-		instanceIdPrivateIp[id] = privateIp
+	credential, err := azidentity.NewDefaultAzureCredential(getCredentialOptions())
+	if err != nil {
+		logger.Error().Err(err).Send()
+		return
 	}
 
-	vms, err := GetScaleSetInstances(ctx, subscriptionId, resourceGroupName, vmScaleSetName, nil)
+	client, err := armlocks.NewManagementLocksClient(subscriptionId, credential, getArmClientOptions())
 	if err != nil {
+		logger.Error().Err(err).Send()
 		return
 	}
-	for _, vm := range vms {
-		id := GetScaleSetVmId(*vm.ID)
-		// get private ip if exists
-		var privateIp string
-		if val, ok := instanceIdPrivateIp[id]; ok {
-			privateIp = val
-		}
-		instanceInfo := ScaleSetInstanceInfo{
-			Id:        id,
-			PrivateIp: privateIp,
-		}
-		instances = append(instances, instanceInfo)
+
+	notes := "Applied by weka function app, remove before decommissioning the cluster"
+	_, err = client.CreateOrUpdateAtResourceLevel(
+		ctx,
+		resourceGroupName,
+		resource.ResourceType.Namespace,
+		"",
+		strings.Join(resource.ResourceType.Types, "/"),
+		resource.Name,
+		lockName,
+		armlocks.ManagementLockObject{
+			Properties: &armlocks.ManagementLockProperties{
+				Level: &level,
+				Notes: &notes,
+			},
+		},
+		nil,
+	)
+	if err != nil {
+		logger.Error().Err(err).Send()
 	}
 	return
 }
 
-func GetScaleSetVmIndex(vmName string) string {
-	instanceNameParts := strings.Split(vmName, "_")
-	return instanceNameParts[len(instanceNameParts)-1]
+func GetDeletionLockName(prefix, clusterName string) string {
+	return fmt.Sprintf("%s-%s-deletion-lock", prefix, clusterName)
 }
 
-func SetDeletionProtection(ctx context.Context, subscriptionId, resourceGroupName, vmScaleSetName, instanceId string, protect bool) (err error) {
+// RemoveResourceManagerLocks removes the locks named lockName from all the resource group resources,
+// the locks applied by ApplyResourceManagerLock block terraform destroy
+func RemoveResourceManagerLocks(ctx context.Context, subscriptionId, resourceGroupName, lockName string) (removedLockIds []string, err error) {
 	logger := logging.LoggerFromCtx(ctx)
-	logger.Info().Msgf("Setting deletion protection: %t on instanceId %s", protect, instanceId)
+	logger.Info().Msgf("Removing locks %s from resource group %s", lockName, resourceGroupName)
 
-	credential, err := azidentity.NewDefaultAzureCredential(nil)
+	credential, err := azidentity.NewDefaultAzureCredential(getCredentialOptions())
 	if err != nil {
 		logger.Error().Err(err).Send()
 		return
 	}
 
-	client, err := armcompute.NewVirtualMachineScaleSetVMsClient(subscriptionId, credential, nil)
+	client, err := armlocks.NewManagementLocksClient(subscriptionId, credential, getArmClientOptions())
 	if err != nil {
 		logger.Error().Err(err).Send()
 		return
 	}
 
-	_, err = client.BeginUpdate(
-		ctx,
-		resourceGroupName,
-		vmScaleSetName,
-		instanceId,
-		armcompute.VirtualMachineScaleSetVM{
-			Properties: &armcompute.VirtualMachineScaleSetVMProperties{
-				ProtectionPolicy: &armcompute.VirtualMachineScaleSetVMProtectionPolicy{
-					ProtectFromScaleSetActions: &protect,
-				},
-			},
-		},
-		nil)
-
+	lockSuffix := "/providers/Microsoft.Authorization/locks/" + lockName
+	pager := client.NewListAtResourceGroupLevelPager(resourceGroupName, nil)
+	for pager.More() {
+		nextResult, pageErr := pager.NextPage(ctx)
+		if pageErr != nil {
+			err = pageErr
+			logger.Error().Err(err).Send()
+			return
+		}
+		for _, lock := range nextResult.Value {
+			if lock.ID == nil || !strings.HasSuffix(strings.ToLower(*lock.ID), strings.ToLower(lockSuffix)) {
+				continue
+			}
+			scope := (*lock.ID)[:len(*lock.ID)-len(lockSuffix)]
+			_, err = client.DeleteByScope(ctx, scope, lockName, nil)
+			if err != nil {
+				logger.Error().Err(err).Send()
+				return
+			}
+			removedLockIds = append(removedLockIds, *lock.ID)
+		}
+	}
 	return
 }
 
+// DeleteBlobObject deletes the blob, a missing blob is not an error
+func DeleteBlobObject(ctx context.Context, storageName, containerName, blobName string) (err error) {
+	return ClientsFromCtx(ctx).Storage.DeleteBlob(ctx, storageName, containerName, blobName)
+}
+
 func RetrySetDeletionProtectionAndReport(
 	ctx context.Context, subscriptionId, resourceGroupName, stateContainerName, stateStorageName, vmScaleSetName, instanceId, hostName string,
 	maxAttempts int, sleepInterval time.Duration,
@@ -866,13 +2404,129 @@ func ReportMsg(ctx context.Context, hostName, subscriptionId, resourceGroupName,
 }
 
 func GetWekaClusterPassword(ctx context.Context, keyVaultUri string) (password string, err error) {
-	return GetKeyVaultValue(ctx, keyVaultUri, "weka-password")
+	return GetKeyVaultValue(ctx, keyVaultUri, WekaPasswordSecretName)
+}
+
+const (
+	defaultWekaAdminUsername         = "admin"
+	WekaPasswordSecretName           = "weka-password"
+	WekaDeploymentPasswordSecretName = "weka-deployment-password"
+	WekaClientPasswordSecretName     = "weka-client-password"
+)
+
+const passwordCharsets = "abcdefghijklmnopqrstuvwxyz|ABCDEFGHIJKLMNOPQRSTUVWXYZ|0123456789|!@#-_=+"
+
+// GeneratePassword returns a random password containing lowercase, uppercase, digit and special characters,
+// quotes and other characters that need shell escaping are never used
+func GeneratePassword(length int) (password string, err error) {
+	charsets := strings.Split(passwordCharsets, "|")
+	if length < len(charsets) {
+		err = fmt.Errorf("password length must be at least %d", len(charsets))
+		return
+	}
+	allChars := strings.Join(charsets, "")
+
+	randomChar := func(chars string) (byte, error) {
+		n, err := cryptoRand.Int(cryptoRand.Reader, big.NewInt(int64(len(chars))))
+		if err != nil {
+			return 0, err
+		}
+		return chars[n.Int64()], nil
+	}
+
+	passwordBytes := make([]byte, length)
+	for i := range passwordBytes {
+		chars := allChars
+		// the first characters guarantee every charset is used, their positions are shuffled below
+		if i < len(charsets) {
+			chars = charsets[i]
+		}
+		passwordBytes[i], err = randomChar(chars)
+		if err != nil {
+			return
+		}
+	}
+	for i := len(passwordBytes) - 1; i > 0; i-- {
+		n, randErr := cryptoRand.Int(cryptoRand.Reader, big.NewInt(int64(i+1)))
+		if randErr != nil {
+			err = randErr
+			return
+		}
+		j := n.Int64()
+		passwordBytes[i], passwordBytes[j] = passwordBytes[j], passwordBytes[i]
+	}
+	password = string(passwordBytes)
+	return
+}
+
+// GetWekaAdminUsername returns the cluster admin username, configured by WEKA_ADMIN_USERNAME
+func GetWekaAdminUsername(ctx context.Context) string {
+	username := Getenv(ctx, "WEKA_ADMIN_USERNAME")
+	if username == "" {
+		return defaultWekaAdminUsername
+	}
+	return username
+}
+
+// GetWekaDeploymentUsername returns the service account used by the functions, empty when the admin user is used
+func GetWekaDeploymentUsername(ctx context.Context) string {
+	return Getenv(ctx, "WEKA_DEPLOYMENT_USERNAME")
+}
+
+// GetWekaClientUsername returns the regular user the clients mount with, empty when the clients don't authenticate
+func GetWekaClientUsername(ctx context.Context) string {
+	return Getenv(ctx, "WEKA_CLIENT_USERNAME")
+}
+
+// GetWekaCredentials returns the credentials the functions use to operate the cluster,
+// with a dedicated service account the admin password can be rotated without breaking the automation
+func GetWekaCredentials(ctx context.Context, keyVaultUri string) (username, password string, err error) {
+	username = GetWekaDeploymentUsername(ctx)
+	if username != "" {
+		password, err = GetKeyVaultValue(ctx, keyVaultUri, WekaDeploymentPasswordSecretName)
+		return
+	}
+	username = GetWekaAdminUsername(ctx)
+	password, err = GetWekaClusterPassword(ctx, keyVaultUri)
+	return
 }
 
 func GetVmScaleSetName(prefix, clusterName string) string {
 	return fmt.Sprintf("%s-%s-vmss", prefix, clusterName)
 }
 
+// GetAvailabilityZones returns the zones of a zonal deployment, configured by AVAILABILITY_ZONES (e.g. "1,2,3")
+func GetAvailabilityZones(ctx context.Context) (zones []string) {
+	for _, zone := range strings.Split(Getenv(ctx, "AVAILABILITY_ZONES"), ",") {
+		zone = strings.TrimSpace(zone)
+		if zone != "" {
+			zones = append(zones, zone)
+		}
+	}
+	return
+}
+
+// GetVmScaleSetNames returns all the cluster scale sets, a zonal deployment has a scale set per availability zone
+func GetVmScaleSetNames(ctx context.Context, prefix, clusterName string) (names []string) {
+	zones := GetAvailabilityZones(ctx)
+	if len(zones) == 0 {
+		return []string{GetVmScaleSetName(prefix, clusterName)}
+	}
+	for _, zone := range zones {
+		names = append(names, fmt.Sprintf("%s-zone%s", GetVmScaleSetName(prefix, clusterName), zone))
+	}
+	return
+}
+
+// GetVmScaleSetNameFromVmName returns the scale set of a scale set vm name ("<scale set name>_<index>")
+func GetVmScaleSetNameFromVmName(vmName string) string {
+	index := strings.LastIndex(vmName, "_")
+	if index < 0 {
+		return vmName
+	}
+	return vmName[:index]
+}
+
 func GetScaleSetInstanceIds(ctx context.Context, subscriptionId, resourceGroupName, vmScaleSetName string) (instanceIds []string, err error) {
 	vms, err := GetScaleSetInstances(ctx, subscriptionId, resourceGroupName, vmScaleSetName, nil)
 	if err != nil {
@@ -914,13 +2568,13 @@ func FilterSpecificScaleSetInstances(ctx context.Context, allVms []*armcompute.V
 func TerminateScaleSetInstances(ctx context.Context, subscriptionId, resourceGroupName, vmScaleSetName string, terminateInstanceIds []string) (terminatedInstances []string, errs []error) {
 	logger := logging.LoggerFromCtx(ctx)
 
-	credential, err := azidentity.NewDefaultAzureCredential(nil)
+	credential, err := azidentity.NewDefaultAzureCredential(getCredentialOptions())
 	if err != nil {
 		logger.Error().Err(err).Send()
 		return
 	}
 
-	client, err := armcompute.NewVirtualMachineScaleSetVMsClient(subscriptionId, credential, nil)
+	client, err := armcompute.NewVirtualMachineScaleSetVMsClient(subscriptionId, credential, getArmClientOptions())
 	if err != nil {
 		logger.Error().Err(err).Send()
 		return
@@ -952,22 +2606,12 @@ func TerminateScaleSetInstances(ctx context.Context, subscriptionId, resourceGro
 }
 
 func UpdateStateReporting(ctx context.Context, subscriptionId, resourceGroupName, stateContainerName, stateStorageName string, report protocol.Report) (err error) {
-	logger := logging.LoggerFromCtx(ctx)
-
-	leaseId, err := LockContainer(ctx, subscriptionId, resourceGroupName, stateStorageName, stateContainerName)
-	if err != nil {
-		return
-	}
-
-	err = UpdateStateReportingWithoutLocking(ctx, stateContainerName, stateStorageName, report)
-
-	_, err2 := UnlockContainer(ctx, subscriptionId, resourceGroupName, stateStorageName, stateContainerName, leaseId)
-	if err2 != nil {
-		if err == nil {
-			err = err2
+	_, err = UpdateState(ctx, stateStorageName, stateContainerName, func(state *protocol.ClusterState) error {
+		if reportErr := reportLib.UpdateReport(report, state); reportErr != nil {
+			return fmt.Errorf("failed updating state report")
 		}
-		logger.Error().Msgf("unlocking %s failed", stateStorageName)
-	}
+		return nil
+	})
 	return
 }
 
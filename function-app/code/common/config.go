@@ -0,0 +1,217 @@
+package common
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+type settingKind string
+
+const (
+	settingString settingKind = "string"
+	settingInt    settingKind = "integer"
+	settingBool   settingKind = "boolean"
+	settingJson   settingKind = "json"
+)
+
+type appSetting struct {
+	Name     string
+	Kind     settingKind
+	Required bool
+	// bounds of integer settings, nil means unbounded
+	Min *int
+	Max *int
+	// Check validates the value beyond its kind and bounds
+	Check func(value string) error
+}
+
+func intBound(value int) *int {
+	return &value
+}
+
+// functionAppSettings lists the app settings read by the functions, the required ones are always set by terraform
+var functionAppSettings = []appSetting{
+	{Name: "SUBSCRIPTION_ID", Kind: settingString, Required: true},
+	{Name: "RESOURCE_GROUP_NAME", Kind: settingString, Required: true},
+	{Name: "LOCATION", Kind: settingString, Required: true},
+	{Name: "PREFIX", Kind: settingString, Required: true},
+	{Name: "CLUSTER_NAME", Kind: settingString, Required: true},
+	{Name: "STATE_STORAGE_NAME", Kind: settingString, Required: true},
+	{Name: "STATE_CONTAINER_NAME", Kind: settingString, Required: true},
+	{Name: "STATE_BACKEND", Kind: settingString},
+	{Name: "STATE_TABLE_NAME", Kind: settingString},
+	{Name: "KEY_VAULT_URI", Kind: settingString, Required: true},
+	{Name: "KEY_VAULT_ENDPOINT", Kind: settingString},
+	{Name: "AZURE_ENVIRONMENT", Kind: settingString},
+	{Name: "HOSTS_NUM", Kind: settingInt, Required: true, Min: intBound(6)},
+	{Name: "WARM_POOL_SIZE", Kind: settingInt, Min: intBound(0)},
+	{Name: "AVAILABILITY_ZONES", Kind: settingString},
+	{Name: "STRIPE_WIDTH", Kind: settingInt, Required: true, Min: intBound(3), Max: intBound(16)},
+	{Name: "PROTECTION_LEVEL", Kind: settingInt, Required: true, Min: intBound(2), Max: intBound(4)},
+	{Name: "HOTSPARE", Kind: settingInt, Required: true, Min: intBound(0)},
+	{Name: "NFS_PROTOCOL_GATEWAYS_NUM", Kind: settingInt, Min: intBound(0)},
+	{Name: "SMB_PROTOCOL_GATEWAYS_NUM", Kind: settingInt, Min: intBound(0)},
+	{Name: "NVMES_NUM", Kind: settingInt, Required: true, Min: intBound(0)},
+	{Name: "NICS_NUM", Kind: settingInt, Required: true, Min: intBound(1)},
+	{Name: "TIERING_SSD_PERCENT", Kind: settingInt, Required: true, Min: intBound(0), Max: intBound(100)},
+	{Name: "NUM_DRIVE_CONTAINERS", Kind: settingInt, Min: intBound(0)},
+	{Name: "NUM_COMPUTE_CONTAINERS", Kind: settingInt, Min: intBound(0)},
+	{Name: "NUM_FRONTEND_CONTAINERS", Kind: settingInt, Min: intBound(0)},
+	{Name: "DRIVE_CONTAINER_CORES", Kind: settingInt, Min: intBound(0)},
+	{Name: "COMPUTE_CONTAINER_CORES", Kind: settingInt, Min: intBound(0)},
+	{Name: "FRONTEND_CONTAINER_CORES", Kind: settingInt, Min: intBound(0)},
+	{Name: "OBS_ACCESS_TIER_AFTER_DAYS", Kind: settingInt, Min: intBound(0)},
+	{Name: "OBS_DRIVE_RETENTION_PERIOD_SECONDS", Kind: settingInt, Min: intBound(0)},
+	{Name: "OBS_TIERING_CUE_SECONDS", Kind: settingInt, Min: intBound(0)},
+	{Name: "OBS_COMPACTION_SCHEDULE_HOURS", Kind: settingInt, Min: intBound(0), Check: checkCronHours},
+	{Name: "NETWORK_SPEED_TEST_DURATION_SECONDS", Kind: settingInt, Min: intBound(0)},
+	{Name: "NETWORK_SPEED_TEST_MIN_GBPS", Kind: settingInt, Min: intBound(0)},
+	{Name: "PERFORMANCE_BASELINE_MIN_MBPS", Kind: settingInt, Min: intBound(0)},
+	{Name: "AZURE_API_MAX_RETRIES", Kind: settingInt, Min: intBound(0)},
+	{Name: "AUTO_REPAIR_GRACE_PERIOD_MINUTES", Kind: settingInt, Min: intBound(1)},
+	{Name: "KEY_VAULT_CACHE_TTL_SECONDS", Kind: settingInt, Min: intBound(0)},
+	{Name: "SET_OBS", Kind: settingBool},
+	{Name: "SMBW_ENABLED", Kind: settingBool},
+	{Name: "INSTALL_DPDK", Kind: settingBool},
+	{Name: "NFS_ENABLED", Kind: settingBool},
+	{Name: "DNS_SRV_ENABLED", Kind: settingBool},
+	{Name: "BACKEND_DNS_RECORDS_ENABLED", Kind: settingBool},
+	{Name: "APPLY_DELETION_LOCK", Kind: settingBool},
+	{Name: "CONFIGURE_AUTO_REIMAGE_RECOVERY", Kind: settingBool},
+	{Name: "REIMAGE_RECOVERY_SCRIPT_URL", Kind: settingString},
+	{Name: "NETWORK_SPEED_TEST_ENABLED", Kind: settingBool},
+	{Name: "PERFORMANCE_BASELINE_ENABLED", Kind: settingBool},
+	{Name: "AUTO_REPAIR_ENABLED", Kind: settingBool},
+	{Name: "FILESYSTEMS", Kind: settingJson},
+	{Name: "PROTOCOL_SHARES", Kind: settingJson},
+	{Name: "SCRIPT_SIGNING_KEY_NAME", Kind: settingString},
+	{Name: "PERFORMANCE_BASELINE_STORAGE_ACCOUNT", Kind: settingString},
+	{Name: "PERFORMANCE_BASELINE_CONTAINER_NAME", Kind: settingString},
+	{Name: "ADDITIONAL_OBS", Kind: settingJson},
+	{Name: "STORAGE_POOLS", Kind: settingJson},
+	{Name: "ACL_CONFIG", Kind: settingJson},
+	{Name: "EDR_CONFIG", Kind: settingJson},
+	{Name: "SENTINEL_CONFIG", Kind: settingJson},
+	{Name: "FLASH_CACHE_CONFIG", Kind: settingJson},
+	{Name: "FRONT_DOOR_CONFIG", Kind: settingJson},
+	{Name: "CONTAINER_NETWORK_CONFIG", Kind: settingJson},
+	{Name: "CRASH_CONSISTENCY_CONFIG", Kind: settingJson},
+	{Name: "DEFAULT_FS_WRITECACHE_CONFIG", Kind: settingJson},
+	{Name: "OBS_CUSTOMER_MANAGED_KEY", Kind: settingJson},
+	{Name: "VM_SECURITY_TYPE", Kind: settingString},
+	{Name: "DPDK_UDP_FALLBACK", Kind: settingBool},
+	{Name: "SMB_DOMAIN_JOIN_CONFIG", Kind: settingJson},
+	{Name: "DEFAULT_NET_CONFIG", Kind: settingJson},
+	{Name: "TAGS", Kind: settingJson},
+	{Name: "CLUSTERIZE_SEGMENT_THRESHOLD", Kind: settingInt, Min: intBound(0)},
+	{Name: "CLUSTERIZE_SEGMENT_TIMEOUT_MINUTES", Kind: settingInt, Min: intBound(1)},
+	{Name: "CLUSTERIZATION_TIMEOUT_MINUTES", Kind: settingInt, Min: intBound(0)},
+	{Name: "CLUSTERIZATION_MIN_HOSTS", Kind: settingInt, Min: intBound(0)},
+	{Name: "CLUSTERIZE_MAX_CONCURRENCY", Kind: settingInt, Min: intBound(1)},
+	{Name: "PRE_CLUSTERIZE_SCRIPT", Kind: settingString},
+	{Name: "PRE_CLUSTERIZE_SCRIPT_BLOB", Kind: settingString},
+	{Name: "POST_CLUSTERIZE_SCRIPT", Kind: settingString},
+	{Name: "POST_CLUSTERIZE_SCRIPT_BLOB", Kind: settingString},
+	{Name: "NOTIFICATION_WEBHOOK_URL", Kind: settingString},
+	{Name: "NOTIFICATION_EVENT_GRID_ENDPOINT", Kind: settingString},
+	{Name: "NOTIFICATION_MIN_SEVERITY", Kind: settingString},
+	{Name: "NOTIFICATION_DEDUP_MINUTES", Kind: settingInt},
+	{Name: "LIFECYCLE_EVENT_GRID_ENDPOINT", Kind: settingString},
+	{Name: "INSTANCE_AUTH_MODE", Kind: settingString},
+	{Name: "INSTANCE_AUTH_AUDIENCE", Kind: settingString},
+	{Name: "TENANT_ID", Kind: settingString},
+	{Name: "STATE_BACKUP_RETENTION", Kind: settingInt, Min: intBound(1)},
+	{Name: "PRIVATE_NETWORK", Kind: settingBool},
+	{Name: "BACKEND_RESOURCES_OVERRIDE", Kind: settingJson},
+	{Name: "WEKA_CLIENT_USERNAME", Kind: settingString},
+}
+
+// ConfigIssue describes a missing or malformed app setting, values of string and json settings are not
+// returned since they may hold secrets
+type ConfigIssue struct {
+	Name  string `json:"name"`
+	Value string `json:"value,omitempty"`
+	Error string `json:"error"`
+}
+
+func validateSetting(setting appSetting, value string) *ConfigIssue {
+	if value == "" {
+		if setting.Required {
+			return &ConfigIssue{Name: setting.Name, Error: "required setting is missing"}
+		}
+		return nil
+	}
+
+	switch setting.Kind {
+	case settingInt:
+		number, err := strconv.Atoi(value)
+		if err != nil {
+			return &ConfigIssue{Name: setting.Name, Value: value, Error: fmt.Sprintf("expected an %s", setting.Kind)}
+		}
+		if setting.Min != nil && number < *setting.Min {
+			return &ConfigIssue{Name: setting.Name, Value: value, Error: fmt.Sprintf("must be at least %d", *setting.Min)}
+		}
+		if setting.Max != nil && number > *setting.Max {
+			return &ConfigIssue{Name: setting.Name, Value: value, Error: fmt.Sprintf("must be at most %d", *setting.Max)}
+		}
+	case settingBool:
+		if _, err := strconv.ParseBool(value); err != nil {
+			return &ConfigIssue{Name: setting.Name, Value: value, Error: fmt.Sprintf("expected a %s", setting.Kind)}
+		}
+	case settingJson:
+		if !json.Valid([]byte(value)) {
+			return &ConfigIssue{Name: setting.Name, Error: "malformed json"}
+		}
+	}
+	if setting.Check != nil {
+		if err := setting.Check(value); err != nil {
+			issue := &ConfigIssue{Name: setting.Name, Error: err.Error()}
+			if setting.Kind == settingInt || setting.Kind == settingBool {
+				issue.Value = value
+			}
+			return issue
+		}
+	}
+	return nil
+}
+
+// checkCronHours accepts the intervals a cron schedule runs at: hours below a day or whole days
+func checkCronHours(value string) error {
+	if hours, _ := strconv.Atoi(value); hours >= 24 && hours%24 != 0 {
+		return errors.New("an interval of a day or more must be a multiple of 24 hours")
+	}
+	return nil
+}
+
+// ValidateConfig returns the missing or malformed app settings, the functions would otherwise read them as zero values
+func ValidateConfig(ctx context.Context) (issues []ConfigIssue) {
+	issues = make([]ConfigIssue, 0)
+	for _, setting := range functionAppSettings {
+		if issue := validateSetting(setting, Getenv(ctx, setting.Name)); issue != nil {
+			issues = append(issues, *issue)
+		}
+	}
+	return
+}
+
+func (i ConfigIssue) String() string {
+	if i.Value != "" {
+		return fmt.Sprintf("%s=%q: %s", i.Name, i.Value, i.Error)
+	}
+	return fmt.Sprintf("%s: %s", i.Name, i.Error)
+}
+
+func ConfigIssuesError(issues []ConfigIssue) error {
+	if len(issues) == 0 {
+		return nil
+	}
+	messages := make([]string, 0, len(issues))
+	for _, issue := range issues {
+		messages = append(messages, issue.String())
+	}
+	return fmt.Errorf("invalid function app settings: %s", strings.Join(messages, "; "))
+}
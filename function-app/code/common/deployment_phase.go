@@ -0,0 +1,177 @@
+package common
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/Azure/azure-sdk-for-go/sdk/azcore"
+	"github.com/weka/go-cloud-lib/logging"
+)
+
+// the deployment phase is kept in its own blob next to the state, the state format is shared with the other clouds
+const (
+	deploymentPhaseBlobName   = "phase"
+	maxPhaseTransitionEntries = 50
+)
+
+const (
+	// the vms are added to the state until the initial cluster size is reached
+	DeploymentPhaseCollecting = "collecting"
+	// the last vm runs the clusterization script
+	DeploymentPhaseClusterizing = "clusterizing"
+	// the cluster is formed, the obs is attached to the filesystems
+	DeploymentPhaseConfiguringObs = "configuring_obs"
+	DeploymentPhaseReady          = "ready"
+	DeploymentPhaseError          = "error"
+)
+
+// deploymentPhaseTransitions lists the phases each phase may move to, a failed deployment is retried from the phase
+// that failed
+var deploymentPhaseTransitions = map[string][]string{
+	// an existing cluster adopted by the function app is ready right away
+	DeploymentPhaseCollecting:     {DeploymentPhaseClusterizing, DeploymentPhaseReady, DeploymentPhaseError},
+	DeploymentPhaseClusterizing:   {DeploymentPhaseConfiguringObs, DeploymentPhaseReady, DeploymentPhaseError},
+	DeploymentPhaseConfiguringObs: {DeploymentPhaseReady, DeploymentPhaseError},
+	DeploymentPhaseError:          {DeploymentPhaseCollecting, DeploymentPhaseClusterizing, DeploymentPhaseConfiguringObs, DeploymentPhaseReady},
+	DeploymentPhaseReady:          {},
+}
+
+var ErrInvalidPhaseTransition = errors.New("invalid deployment phase transition")
+
+type PhaseTransition struct {
+	From   string    `json:"from"`
+	To     string    `json:"to"`
+	Time   time.Time `json:"time"`
+	Reason string    `json:"reason,omitempty"`
+}
+
+type DeploymentPhase struct {
+	Phase     string    `json:"phase"`
+	Reason    string    `json:"reason,omitempty"`
+	UpdatedAt time.Time `json:"updated_at"`
+	// when the deployment entered the phase, the first clusterize call for the collecting phase
+	StartedAt time.Time `json:"started_at,omitempty"`
+	// the phase failed in, set in the error phase
+	FailedPhase string `json:"failed_phase,omitempty"`
+	// latest transitions, oldest first
+	Transitions []PhaseTransition `json:"transitions"`
+}
+
+func isValidPhaseTransition(from, to string) bool {
+	for _, allowed := range deploymentPhaseTransitions[from] {
+		if allowed == to {
+			return true
+		}
+	}
+	return false
+}
+
+// readDeploymentPhase returns the persisted phase, deployments older than the phase blob get the phase of their state
+func readDeploymentPhase(ctx context.Context, stateStorageName, stateContainerName string) (phase DeploymentPhase, etag *azcore.ETag, err error) {
+	logger := logging.LoggerFromCtx(ctx)
+
+	data, etag, err := readBlobWithETag(ctx, stateStorageName, stateContainerName, deploymentPhaseBlobName, true)
+	if err != nil {
+		return
+	}
+	if len(data) > 0 {
+		err = json.Unmarshal(data, &phase)
+		if err != nil {
+			logger.Error().Err(err).Send()
+		}
+		return
+	}
+
+	state, err := ReadState(ctx, stateStorageName, stateContainerName)
+	if err != nil {
+		return
+	}
+	phase.Phase = DeploymentPhaseCollecting
+	if state.Clusterized {
+		phase.Phase = DeploymentPhaseReady
+	}
+	return
+}
+
+func GetDeploymentPhase(ctx context.Context, stateStorageName, stateContainerName string) (phase DeploymentPhase, err error) {
+	phase, _, err = readDeploymentPhase(ctx, stateStorageName, stateContainerName)
+	return
+}
+
+// TransitionDeploymentPhase moves the deployment to the phase if the transition is allowed, with the same conflict
+// handling as UpdateState. Moving to the current phase only updates the reason
+func TransitionDeploymentPhase(ctx context.Context, stateStorageName, stateContainerName, to, reason string) (phase DeploymentPhase, err error) {
+	logger := logging.LoggerFromCtx(ctx)
+
+	for attempt := 1; attempt <= stateUpdateMaxAttempts; attempt++ {
+		var etag *azcore.ETag
+		phase, etag, err = readDeploymentPhase(ctx, stateStorageName, stateContainerName)
+		if err != nil {
+			return
+		}
+
+		from := phase.Phase
+		if from != to && !isValidPhaseTransition(from, to) {
+			err = fmt.Errorf("%w from %s to %s", ErrInvalidPhaseTransition, from, to)
+			logger.Error().Err(err).Send()
+			return
+		}
+
+		now := time.Now().UTC()
+		if from != to || phase.StartedAt.IsZero() {
+			phase.StartedAt = now
+		}
+		if from != to {
+			phase.Transitions = append(phase.Transitions, PhaseTransition{From: from, To: to, Time: now, Reason: reason})
+			if len(phase.Transitions) > maxPhaseTransitionEntries {
+				phase.Transitions = phase.Transitions[len(phase.Transitions)-maxPhaseTransitionEntries:]
+			}
+		}
+		if to == DeploymentPhaseError && from != DeploymentPhaseError {
+			phase.FailedPhase = from
+		} else if to != DeploymentPhaseError {
+			phase.FailedPhase = ""
+		}
+		phase.Phase = to
+		phase.Reason = reason
+		phase.UpdatedAt = now
+
+		var data []byte
+		data, err = json.Marshal(phase)
+		if err != nil {
+			logger.Error().Err(err).Send()
+			return
+		}
+
+		err = writeBlobIfMatch(ctx, stateStorageName, stateContainerName, deploymentPhaseBlobName, data, etag)
+		if err == nil {
+			if from != to {
+				logger.Info().Msgf("Deployment phase changed from %s to %s: %s", from, to, reason)
+				if to == DeploymentPhaseReady {
+					PublishLifecycleEvent(ctx, LifecycleEventClusterReady, "", map[string]string{"reason": reason})
+				}
+			}
+			return
+		}
+		if !isBlobWriteConflict(err) {
+			return
+		}
+		time.Sleep(getBlobUpdateRetryDelay(attempt))
+	}
+	err = fmt.Errorf("failed to update deployment phase after %d attempts: %w", stateUpdateMaxAttempts, err)
+	logger.Error().Err(err).Send()
+	return
+}
+
+// SetDeploymentPhase is TransitionDeploymentPhase for the callers the phase is informative for, failures are
+// only logged
+func SetDeploymentPhase(ctx context.Context, stateStorageName, stateContainerName, to, reason string) {
+	logger := logging.LoggerFromCtx(ctx)
+
+	if _, err := TransitionDeploymentPhase(ctx, stateStorageName, stateContainerName, to, reason); err != nil {
+		logger.Error().Err(err).Msgf("failed to set the deployment phase %s", to)
+	}
+}
@@ -0,0 +1,99 @@
+package common
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+)
+
+// the functions host wraps the http trigger request in the custom handler envelope, a request without it is a
+// direct invocation of the handler, local testing, curl debugging or another hosting, whose payload is the function body
+
+// IsInvokeRequest tells whether the payload is a custom handler request, its keys are case sensitive unlike the
+// decoding of InvokeRequest, so a function body with a data field is not mistaken for it
+func IsInvokeRequest(payload []byte) bool {
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal(payload, &fields); err != nil {
+		return false
+	}
+	data, hasData := fields["Data"]
+	_, hasMetadata := fields["Metadata"]
+	return hasData && hasMetadata && bytes.HasPrefix(bytes.TrimSpace(data), []byte("{"))
+}
+
+// NewDirectInvokeRequest wraps a direct request in the custom handler envelope, with the http trigger request
+// fields the functions read
+func NewDirectInvokeRequest(r *http.Request, body []byte) ([]byte, error) {
+	query := make(map[string]string)
+	for name, values := range r.URL.Query() {
+		if len(values) > 0 {
+			query[name] = values[0]
+		}
+	}
+	req, err := json.Marshal(map[string]interface{}{
+		"Url":     r.URL.String(),
+		"Method":  r.Method,
+		"Query":   query,
+		"Headers": r.Header,
+		"Params":  map[string]string{},
+		"Body":    string(body),
+	})
+	if err != nil {
+		return nil, err
+	}
+	return json.Marshal(InvokeRequest{
+		Data:     map[string]json.RawMessage{"req": req},
+		Metadata: map[string]interface{}{},
+	})
+}
+
+// DirectResponseWriter buffers the custom handler response of a direct invocation, Finish writes its "res" output
+// as a plain http response
+type DirectResponseWriter struct {
+	http.ResponseWriter
+	buffer bytes.Buffer
+}
+
+func NewDirectResponseWriter(w http.ResponseWriter) *DirectResponseWriter {
+	return &DirectResponseWriter{ResponseWriter: w}
+}
+
+func (w *DirectResponseWriter) Write(data []byte) (int, error) {
+	return w.buffer.Write(data)
+}
+
+// WriteHeader is ignored, the status code of the custom handler response is the one of its "res" output
+func (w *DirectResponseWriter) WriteHeader(int) {}
+
+// Finish writes the "res" output, the responses without one, of the timer and logic app functions, are written as is
+func (w *DirectResponseWriter) Finish() {
+	var invokeResponse struct {
+		Outputs map[string]struct {
+			StatusCode int               `json:"statusCode"`
+			Headers    map[string]string `json:"headers"`
+			Body       json.RawMessage   `json:"body"`
+		}
+	}
+	_ = json.Unmarshal(w.buffer.Bytes(), &invokeResponse)
+	res, ok := invokeResponse.Outputs["res"]
+	if !ok {
+		w.ResponseWriter.Header().Set("Content-Type", "application/json")
+		w.ResponseWriter.Write(w.buffer.Bytes())
+		return
+	}
+
+	body := []byte(res.Body)
+	// the scripts are returned as json strings
+	var text string
+	if json.Unmarshal(res.Body, &text) == nil {
+		body = []byte(text)
+	}
+	for name, value := range res.Headers {
+		w.ResponseWriter.Header().Set(name, value)
+	}
+	if res.StatusCode == 0 {
+		res.StatusCode = http.StatusOK
+	}
+	w.ResponseWriter.WriteHeader(res.StatusCode)
+	w.ResponseWriter.Write(body)
+}
@@ -0,0 +1,94 @@
+package common
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/Azure/azure-sdk-for-go/sdk/azcore"
+	"github.com/weka/go-cloud-lib/logging"
+)
+
+// drive replacements are kept in their own blob next to the state, the state format is shared with the other clouds
+const driveReplacementsBlobName = "drive_replacements"
+
+const (
+	// the drive is deactivated, weka rebuilds its data on the other drives
+	DriveReplacementStatusDeactivating = "deactivating"
+	// the drive is removed from the cluster, the operator replaces the vm to restore the capacity
+	DriveReplacementStatusRemoved = "removed"
+)
+
+type DriveReplacement struct {
+	VmName       string    `json:"vm_name"`
+	DriveUuid    string    `json:"drive_uuid"`
+	Serial       string    `json:"serial,omitempty"`
+	Status       string    `json:"status"`
+	RequestedAt  time.Time `json:"requested_at"`
+	UpdatedAt    time.Time `json:"updated_at"`
+	Instructions string    `json:"instructions,omitempty"`
+}
+
+// DriveReplacements holds the replacements by drive uuid
+type DriveReplacements map[string]DriveReplacement
+
+func readDriveReplacements(ctx context.Context, stateStorageName, stateContainerName string) (replacements DriveReplacements, etag *azcore.ETag, err error) {
+	logger := logging.LoggerFromCtx(ctx)
+
+	data, etag, err := readBlobWithETag(ctx, stateStorageName, stateContainerName, driveReplacementsBlobName, true)
+	if err != nil {
+		return
+	}
+	replacements = make(DriveReplacements)
+	if len(data) == 0 {
+		return
+	}
+	err = json.Unmarshal(data, &replacements)
+	if err != nil {
+		logger.Error().Err(err).Send()
+	}
+	return
+}
+
+func GetDriveReplacements(ctx context.Context, stateStorageName, stateContainerName string) (replacements DriveReplacements, err error) {
+	replacements, _, err = readDriveReplacements(ctx, stateStorageName, stateContainerName)
+	return
+}
+
+// UpdateDriveReplacement sets the replacement of the drive, keeping the time it was first requested
+func UpdateDriveReplacement(ctx context.Context, stateStorageName, stateContainerName string, replacement DriveReplacement) (err error) {
+	logger := logging.LoggerFromCtx(ctx)
+
+	for attempt := 1; attempt <= stateUpdateMaxAttempts; attempt++ {
+		var replacements DriveReplacements
+		var etag *azcore.ETag
+		replacements, etag, err = readDriveReplacements(ctx, stateStorageName, stateContainerName)
+		if err != nil {
+			return
+		}
+		now := time.Now().UTC()
+		replacement.RequestedAt = now
+		if existing, ok := replacements[replacement.DriveUuid]; ok {
+			replacement.RequestedAt = existing.RequestedAt
+		}
+		replacement.UpdatedAt = now
+		replacements[replacement.DriveUuid] = replacement
+
+		var data []byte
+		data, err = json.Marshal(replacements)
+		if err != nil {
+			logger.Error().Err(err).Send()
+			return
+		}
+
+		err = writeBlobIfMatch(ctx, stateStorageName, stateContainerName, driveReplacementsBlobName, data, etag)
+		if err == nil || !isBlobWriteConflict(err) {
+			return
+		}
+		time.Sleep(getBlobUpdateRetryDelay(attempt))
+	}
+	err = fmt.Errorf("failed to update drive replacements after %d attempts: %w", stateUpdateMaxAttempts, err)
+	logger.Error().Err(err).Send()
+	return
+}
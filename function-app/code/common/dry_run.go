@@ -0,0 +1,93 @@
+package common
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/weka/go-cloud-lib/logging"
+)
+
+// DryRunResponse is returned by the script generating functions in dry run mode,
+// the azure operations that would change resources or state are listed instead of being applied
+type DryRunResponse struct {
+	DryRun            bool     `json:"dry_run"`
+	Script            string   `json:"script,omitempty"`
+	PlannedOperations []string `json:"planned_operations"`
+}
+
+// IsDryRun returns true when the request has the dryRun query parameter or the dry_run body flag set
+func IsDryRun(reqData map[string]interface{}) bool {
+	if query, ok := reqData["Query"].(map[string]interface{}); ok {
+		if value, ok := query["dryRun"].(string); ok {
+			if dryRun, _ := strconv.ParseBool(value); dryRun {
+				return true
+			}
+		}
+	}
+
+	body, _ := reqData["Body"].(string)
+	var flags struct {
+		DryRun bool `json:"dry_run"`
+	}
+	_ = json.Unmarshal([]byte(body), &flags)
+	return flags.DryRun
+}
+
+// RedactedValue replaces the secrets of the scripts returned in dry run mode
+const RedactedValue = "****"
+
+// DryRunPlan records the operations which change azure resources or state instead of running them
+type DryRunPlan struct {
+	Operations []string
+}
+
+func (p *DryRunPlan) Enabled() bool {
+	return p != nil
+}
+
+// Apply runs the operation, in dry run mode (non nil plan) the operation is only recorded. failures are notified
+func (p *DryRunPlan) Apply(ctx context.Context, description string, operation func() error) error {
+	if !p.Enabled() {
+		err := operation()
+		if err != nil {
+			Notify(ctx, NotificationSeverityError, NotificationAzureOperationFailed, fmt.Sprintf("%s: %v", description, err), nil)
+		}
+		return err
+	}
+	p.Record(ctx, description)
+	return nil
+}
+
+// Record adds an operation which is not run in dry run mode to the plan
+func (p *DryRunPlan) Record(ctx context.Context, description string) {
+	logger := logging.LoggerFromCtx(ctx)
+	logger.Info().Msgf("dry run, skipping: %s", description)
+	p.Operations = append(p.Operations, description)
+}
+
+// Redact replaces the secrets in the script in dry run mode, the dry run response is returned to the operator, not to
+// a cluster vm
+func (p *DryRunPlan) Redact(script string, secrets ...string) string {
+	if !p.Enabled() {
+		return script
+	}
+	for _, secret := range secrets {
+		if secret != "" {
+			script = strings.ReplaceAll(script, secret, RedactedValue)
+		}
+	}
+	return script
+}
+
+func (p *DryRunPlan) Response(script string) DryRunResponse {
+	operations := make([]string, 0, len(p.Operations))
+	operations = append(operations, p.Operations...)
+	return DryRunResponse{
+		DryRun:            true,
+		Script:            script,
+		PlannedOperations: operations,
+	}
+}
@@ -0,0 +1,125 @@
+package common
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/Azure/azure-sdk-for-go/sdk/azcore"
+	"github.com/weka/go-cloud-lib/logging"
+)
+
+// spot evictions are kept in their own blob next to the state, the state format is shared with the other clouds
+const evictionsBlobName = "evictions"
+
+type EvictedInstance struct {
+	Hostname          string    `json:"hostname"`
+	EvictedAt         time.Time `json:"evicted_at"`
+	DrivesDeactivated int       `json:"drives_deactivated"`
+	ReplacedBy        string    `json:"replaced_by,omitempty"`
+	ReplacedAt        time.Time `json:"replaced_at,omitempty"`
+}
+
+// Evictions holds the evicted instances by vm name
+type Evictions map[string]EvictedInstance
+
+func readEvictions(ctx context.Context, stateStorageName, stateContainerName string) (evictions Evictions, etag *azcore.ETag, err error) {
+	logger := logging.LoggerFromCtx(ctx)
+
+	data, etag, err := readBlobWithETag(ctx, stateStorageName, stateContainerName, evictionsBlobName, true)
+	if err != nil {
+		return
+	}
+	evictions = make(Evictions)
+	if len(data) == 0 {
+		return
+	}
+	err = json.Unmarshal(data, &evictions)
+	if err != nil {
+		logger.Error().Err(err).Send()
+	}
+	return
+}
+
+func updateEvictions(ctx context.Context, stateStorageName, stateContainerName string, update func(evictions Evictions) error) (evictions Evictions, err error) {
+	logger := logging.LoggerFromCtx(ctx)
+
+	for attempt := 1; attempt <= stateUpdateMaxAttempts; attempt++ {
+		var etag *azcore.ETag
+		evictions, etag, err = readEvictions(ctx, stateStorageName, stateContainerName)
+		if err != nil {
+			return
+		}
+		err = update(evictions)
+		if err != nil {
+			return
+		}
+
+		var data []byte
+		data, err = json.Marshal(evictions)
+		if err != nil {
+			logger.Error().Err(err).Send()
+			return
+		}
+
+		err = writeBlobIfMatch(ctx, stateStorageName, stateContainerName, evictionsBlobName, data, etag)
+		if err == nil || !isBlobWriteConflict(err) {
+			return
+		}
+		time.Sleep(getBlobUpdateRetryDelay(attempt))
+	}
+	err = fmt.Errorf("failed to update evictions after %d attempts: %w", stateUpdateMaxAttempts, err)
+	logger.Error().Err(err).Send()
+	return
+}
+
+func GetEvictions(ctx context.Context, stateStorageName, stateContainerName string) (evictions Evictions, err error) {
+	evictions, _, err = readEvictions(ctx, stateStorageName, stateContainerName)
+	return
+}
+
+// AddEvictedInstance marks the vm as evicted, a repeated eviction notice of the same vm keeps the first eviction time
+func AddEvictedInstance(ctx context.Context, stateStorageName, stateContainerName, vmName, hostname string, drivesDeactivated int) (err error) {
+	_, err = updateEvictions(ctx, stateStorageName, stateContainerName, func(evictions Evictions) error {
+		evicted, ok := evictions[vmName]
+		if !ok {
+			evicted = EvictedInstance{Hostname: hostname, EvictedAt: time.Now().UTC()}
+		}
+		evicted.DrivesDeactivated += drivesDeactivated
+		evictions[vmName] = evicted
+		return nil
+	})
+	return
+}
+
+// ReplaceEvictedInstance marks the oldest evicted vm that wasn't replaced yet as replaced by the given vm,
+// replaced is empty when there is no pending eviction or the vm already replaced one
+func ReplaceEvictedInstance(ctx context.Context, stateStorageName, stateContainerName, vmName string) (replaced string, err error) {
+	_, err = updateEvictions(ctx, stateStorageName, stateContainerName, func(evictions Evictions) error {
+		replaced = ""
+		var pending []string
+		for evictedVmName, evicted := range evictions {
+			if evicted.ReplacedBy == vmName {
+				return nil
+			}
+			if evicted.ReplacedBy == "" && evictedVmName != vmName {
+				pending = append(pending, evictedVmName)
+			}
+		}
+		if len(pending) == 0 {
+			return nil
+		}
+		sort.Slice(pending, func(i, j int) bool {
+			return evictions[pending[i]].EvictedAt.Before(evictions[pending[j]].EvictedAt)
+		})
+		replaced = pending[0]
+		evicted := evictions[replaced]
+		evicted.ReplacedBy = vmName
+		evicted.ReplacedAt = time.Now().UTC()
+		evictions[replaced] = evicted
+		return nil
+	})
+	return
+}
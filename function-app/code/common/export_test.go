@@ -0,0 +1,7 @@
+package common
+
+// ResetClusterConfigCache drops the config snapshot of the functions instance, a test updating the config blob
+// must not leave it to the other tests
+func ResetClusterConfigCache() {
+	setCachedClusterConfig(nil)
+}
@@ -0,0 +1,342 @@
+// Package fakes has in memory implementations of the common clients, for testing the functions without azure
+package fakes
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+	"weka-deployment/common"
+
+	"github.com/Azure/azure-sdk-for-go/sdk/azcore"
+	"github.com/Azure/azure-sdk-for-go/sdk/data/aztables"
+	"github.com/Azure/azure-sdk-for-go/sdk/resourcemanager/compute/armcompute"
+	"github.com/Azure/azure-sdk-for-go/sdk/resourcemanager/network/armnetwork"
+	"github.com/Azure/azure-sdk-for-go/sdk/storage/azblob/bloberror"
+)
+
+// blobError is the error azure returns, so the error code checks of common work on the fakes too
+func blobError(statusCode int, code bloberror.Code) error {
+	return &azcore.ResponseError{StatusCode: statusCode, ErrorCode: string(code)}
+}
+
+type storedBlob struct {
+	data    []byte
+	version int
+}
+
+type blobLease struct {
+	id        string
+	duration  time.Duration
+	expiresAt time.Time
+}
+
+// Storage keeps the blobs in memory, the etag of a blob is its version
+type Storage struct {
+	mu     sync.Mutex
+	blobs  map[string]storedBlob
+	leases map[string]blobLease
+	// leaseIds numbers the acquired leases
+	leaseIds int
+	// BeforeWriteIfMatch is called before a conditional write is applied, e.g. to change the blob like another writer
+	BeforeWriteIfMatch func()
+}
+
+func NewStorage() *Storage {
+	return &Storage{blobs: map[string]storedBlob{}, leases: map[string]blobLease{}}
+}
+
+func blobKey(storageName, containerName, blobName string) string {
+	return fmt.Sprintf("%s/%s/%s", storageName, containerName, blobName)
+}
+
+func (s *Storage) ReadBlob(ctx context.Context, storageName, containerName, blobName string, allowMissing bool) (data []byte, etag *azcore.ETag, err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	b, ok := s.blobs[blobKey(storageName, containerName, blobName)]
+	if !ok {
+		if !allowMissing {
+			err = blobError(http.StatusNotFound, bloberror.BlobNotFound)
+		}
+		return
+	}
+	data = append([]byte{}, b.data...)
+	tag := azcore.ETag(strconv.Itoa(b.version))
+	etag = &tag
+	return
+}
+
+func (s *Storage) WriteBlob(ctx context.Context, storageName, containerName, blobName string, data []byte) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	key := blobKey(storageName, containerName, blobName)
+	s.blobs[key] = storedBlob{data: append([]byte{}, data...), version: s.blobs[key].version + 1}
+	return nil
+}
+
+func (s *Storage) WriteBlobIfMatch(ctx context.Context, storageName, containerName, blobName string, data []byte, etag *azcore.ETag) error {
+	if s.BeforeWriteIfMatch != nil {
+		s.BeforeWriteIfMatch()
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	key := blobKey(storageName, containerName, blobName)
+	b, ok := s.blobs[key]
+	if etag == nil && ok {
+		return blobError(http.StatusConflict, bloberror.BlobAlreadyExists)
+	}
+	if etag != nil && (!ok || string(*etag) != strconv.Itoa(b.version)) {
+		return blobError(http.StatusPreconditionFailed, bloberror.ConditionNotMet)
+	}
+	s.blobs[key] = storedBlob{data: append([]byte{}, data...), version: b.version + 1}
+	return nil
+}
+
+func (s *Storage) DeleteBlob(ctx context.Context, storageName, containerName, blobName string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	delete(s.blobs, blobKey(storageName, containerName, blobName))
+	return nil
+}
+
+func (s *Storage) AcquireBlobLease(ctx context.Context, storageName, containerName, blobName string, duration time.Duration) (string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	key := blobKey(storageName, containerName, blobName)
+	if _, ok := s.blobs[key]; !ok {
+		return "", blobError(http.StatusNotFound, bloberror.BlobNotFound)
+	}
+	if l, ok := s.leases[key]; ok && time.Now().Before(l.expiresAt) {
+		return "", blobError(http.StatusConflict, bloberror.LeaseAlreadyPresent)
+	}
+	s.leaseIds++
+	l := blobLease{id: fmt.Sprintf("lease-%d", s.leaseIds), duration: duration, expiresAt: time.Now().Add(duration)}
+	s.leases[key] = l
+	return l.id, nil
+}
+
+func (s *Storage) RenewBlobLease(ctx context.Context, storageName, containerName, blobName, leaseId string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	key := blobKey(storageName, containerName, blobName)
+	l, ok := s.leases[key]
+	if !ok || l.id != leaseId {
+		return blobError(http.StatusConflict, bloberror.LeaseIDMismatchWithLeaseOperation)
+	}
+	l.expiresAt = time.Now().Add(l.duration)
+	s.leases[key] = l
+	return nil
+}
+
+func (s *Storage) ReleaseBlobLease(ctx context.Context, storageName, containerName, blobName, leaseId string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	key := blobKey(storageName, containerName, blobName)
+	if l, ok := s.leases[key]; !ok || l.id != leaseId {
+		return blobError(http.StatusConflict, bloberror.LeaseIDMismatchWithLeaseOperation)
+	}
+	delete(s.leases, key)
+	return nil
+}
+
+// Secrets keeps the secrets in memory, by key vault uri and secret name
+type Secrets struct {
+	mu      sync.Mutex
+	secrets map[string]string
+}
+
+func NewSecrets() *Secrets {
+	return &Secrets{secrets: map[string]string{}}
+}
+
+func (s *Secrets) GetSecret(ctx context.Context, keyVaultUri, secretName string) (string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	secret, ok := s.secrets[keyVaultUri+"/"+secretName]
+	if !ok {
+		return "", &azcore.ResponseError{StatusCode: http.StatusNotFound, ErrorCode: "SecretNotFound"}
+	}
+	return secret, nil
+}
+
+func (s *Secrets) SetSecret(ctx context.Context, keyVaultUri, secretName, value string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.secrets[keyVaultUri+"/"+secretName] = value
+	return nil
+}
+
+// Compute returns the scale set resources it was set up with, by scale set name
+type Compute struct {
+	Vms               map[string][]*armcompute.VirtualMachineScaleSetVM
+	NetworkInterfaces map[string][]*armnetwork.Interface
+	// public ips by scale set name and instance index, "<scale set>/<index>"
+	PublicIps map[string]string
+}
+
+func NewCompute() *Compute {
+	return &Compute{
+		Vms:               map[string][]*armcompute.VirtualMachineScaleSetVM{},
+		NetworkInterfaces: map[string][]*armnetwork.Interface{},
+		PublicIps:         map[string]string{},
+	}
+}
+
+func (c *Compute) ListScaleSetVms(ctx context.Context, subscriptionId, resourceGroupName, vmScaleSetName string, expand *string) ([]*armcompute.VirtualMachineScaleSetVM, error) {
+	return c.Vms[vmScaleSetName], nil
+}
+
+func (c *Compute) ListScaleSetNetworkInterfaces(ctx context.Context, subscriptionId, resourceGroupName, vmScaleSetName string) ([]*armnetwork.Interface, error) {
+	return c.NetworkInterfaces[vmScaleSetName], nil
+}
+
+func (c *Compute) GetPublicIp(ctx context.Context, subscriptionId, resourceGroupName, vmScaleSetName, prefix, clusterName, instanceIndex string) (string, error) {
+	return c.PublicIps[vmScaleSetName+"/"+instanceIndex], nil
+}
+
+type tableRow struct {
+	entity map[string]interface{}
+	etag   string
+}
+
+// Tables keeps the table rows in memory, by storage, table and partition, an etag is never reused
+type Tables struct {
+	mu         sync.Mutex
+	partitions map[string]map[string]tableRow
+	etags      int
+	// BeforeTransaction is called before a transaction is applied, e.g. to change its rows like another writer
+	BeforeTransaction func()
+}
+
+func NewTables() *Tables {
+	return &Tables{partitions: map[string]map[string]tableRow{}}
+}
+
+func tableError(statusCode int, code aztables.TableErrorCode) error {
+	return &azcore.ResponseError{StatusCode: statusCode, ErrorCode: string(code)}
+}
+
+func (t *Tables) ListPartition(ctx context.Context, storageName, tableName, partitionKey string) (entities [][]byte, err error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	rows := t.partitions[fmt.Sprintf("%s/%s/%s", storageName, tableName, partitionKey)]
+	rowKeys := make([]string, 0, len(rows))
+	for rowKey := range rows {
+		rowKeys = append(rowKeys, rowKey)
+	}
+	sort.Strings(rowKeys)
+	for _, rowKey := range rowKeys {
+		entity := map[string]interface{}{"odata.etag": rows[rowKey].etag}
+		for name, value := range rows[rowKey].entity {
+			entity[name] = value
+		}
+		data, err := json.Marshal(entity)
+		if err != nil {
+			return nil, err
+		}
+		entities = append(entities, data)
+	}
+	return
+}
+
+// SubmitTransaction applies all the actions or none, like an entity group transaction
+func (t *Tables) SubmitTransaction(ctx context.Context, storageName, tableName string, actions []aztables.TransactionAction) error {
+	if t.BeforeTransaction != nil {
+		t.BeforeTransaction()
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	var key string
+	rows := map[string]tableRow{}
+	for i, action := range actions {
+		var entity map[string]interface{}
+		if err := json.Unmarshal(action.Entity, &entity); err != nil {
+			return err
+		}
+		partitionKey, _ := entity["PartitionKey"].(string)
+		rowKey, _ := entity["RowKey"].(string)
+		if i == 0 {
+			key = fmt.Sprintf("%s/%s/%s", storageName, tableName, partitionKey)
+			for k, row := range t.partitions[key] {
+				rows[k] = row
+			}
+		}
+
+		current, found := rows[rowKey]
+		if action.ActionType == aztables.TransactionTypeAdd && found {
+			return tableError(http.StatusConflict, aztables.EntityAlreadyExists)
+		}
+		if action.ActionType == aztables.TransactionTypeUpdateReplace || action.ActionType == aztables.TransactionTypeUpdateMerge ||
+			action.ActionType == aztables.TransactionTypeDelete {
+			if !found {
+				return tableError(http.StatusNotFound, aztables.ResourceNotFound)
+			}
+			if action.IfMatch != nil && *action.IfMatch != azcore.ETagAny && string(*action.IfMatch) != current.etag {
+				return tableError(http.StatusPreconditionFailed, aztables.UpdateConditionNotSatisfied)
+			}
+		}
+
+		if action.ActionType == aztables.TransactionTypeDelete {
+			delete(rows, rowKey)
+			continue
+		}
+		if (action.ActionType == aztables.TransactionTypeUpdateMerge || action.ActionType == aztables.TransactionTypeInsertMerge) && found {
+			for name, value := range current.entity {
+				if _, ok := entity[name]; !ok {
+					entity[name] = value
+				}
+			}
+		}
+		t.etags++
+		rows[rowKey] = tableRow{entity: entity, etag: fmt.Sprintf("W/\"etag-%d\"", t.etags)}
+	}
+	if key != "" {
+		t.partitions[key] = rows
+	}
+	return nil
+}
+
+// Clients are the fake clients, the state is kept in the fake storage like in azure
+type Clients struct {
+	Storage *Storage
+	Secrets *Secrets
+	Compute *Compute
+	Tables  *Tables
+}
+
+func NewClients() *Clients {
+	return &Clients{
+		Storage: NewStorage(),
+		Secrets: NewSecrets(),
+		Compute: NewCompute(),
+		Tables:  NewTables(),
+	}
+}
+
+// Context returns a context the common functions use the fake clients of
+func (c *Clients) Context(ctx context.Context) context.Context {
+	return common.WithClients(ctx, common.Clients{
+		State:   common.BlobStateStore{},
+		Storage: c.Storage,
+		Secrets: c.Secrets,
+		Compute: c.Compute,
+		Tables:  c.Tables,
+	})
+}
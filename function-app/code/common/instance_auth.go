@@ -0,0 +1,225 @@
+package common
+
+import (
+	"context"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/big"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Azure/azure-sdk-for-go/sdk/azcore/cloud"
+	"github.com/golang-jwt/jwt/v4"
+)
+
+// instance authentication modes, the function key alone is accepted when it is disabled
+const (
+	InstanceAuthDisabled = "disabled"
+	InstanceAuthAudit    = "audit"
+	InstanceAuthEnforce  = "enforce"
+)
+
+const (
+	signingKeysTtl = 24 * time.Hour
+	// a token signed by an unknown key refreshes the keys at most once in this interval
+	signingKeysMinRefresh = time.Minute
+)
+
+var ErrInstanceUnauthorized = errors.New("instance is not authorized")
+
+// instanceClaims are the managed identity token claims we check, xms_mirid is the resource id of the identity owner
+type instanceClaims struct {
+	jwt.RegisteredClaims
+	TenantId   string `json:"tid"`
+	ResourceId string `json:"xms_mirid"`
+}
+
+type jsonWebKeys struct {
+	Keys []struct {
+		Kid string `json:"kid"`
+		Kty string `json:"kty"`
+		N   string `json:"n"`
+		E   string `json:"e"`
+	} `json:"keys"`
+}
+
+var (
+	signingKeysLock      sync.Mutex
+	signingKeys          map[string]*rsa.PublicKey
+	signingKeysFetchedAt time.Time
+)
+
+// GetInstanceAuthMode returns INSTANCE_AUTH_MODE, authentication is disabled when it is empty or unknown
+func GetInstanceAuthMode(ctx context.Context) string {
+	mode := Getenv(ctx, "INSTANCE_AUTH_MODE")
+	if mode != InstanceAuthAudit && mode != InstanceAuthEnforce {
+		return InstanceAuthDisabled
+	}
+	return mode
+}
+
+// GetInstanceAuthAudience returns the resource the vms request their managed identity token for, the resource
+// manager audience of the cloud when INSTANCE_AUTH_AUDIENCE is empty
+func GetInstanceAuthAudience(ctx context.Context) string {
+	if audience := Getenv(ctx, "INSTANCE_AUTH_AUDIENCE"); audience != "" {
+		return audience
+	}
+	return GetCloudEnvironment().Configuration.Services[cloud.ResourceManager].Audience
+}
+
+func getSigningKeysUrl(ctx context.Context) string {
+	tenant := Getenv(ctx, "TENANT_ID")
+	if tenant == "" {
+		tenant = "common"
+	}
+	return fmt.Sprintf("%s%s/discovery/keys", GetCloudEnvironment().Configuration.ActiveDirectoryAuthorityHost, tenant)
+}
+
+func fetchSigningKeys(ctx context.Context) (keys map[string]*rsa.PublicKey, err error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, getSigningKeysUrl(ctx), nil)
+	if err != nil {
+		return
+	}
+	resp, err := getHttpClient().Do(req)
+	if err != nil {
+		return
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		err = fmt.Errorf("failed to get the token signing keys, status: %s", resp.Status)
+		return
+	}
+
+	var jwks jsonWebKeys
+	if err = json.NewDecoder(resp.Body).Decode(&jwks); err != nil {
+		return
+	}
+	keys = make(map[string]*rsa.PublicKey)
+	for _, key := range jwks.Keys {
+		if key.Kty != "RSA" {
+			continue
+		}
+		n, nErr := base64.RawURLEncoding.DecodeString(key.N)
+		e, eErr := base64.RawURLEncoding.DecodeString(key.E)
+		if nErr != nil || eErr != nil {
+			continue
+		}
+		keys[key.Kid] = &rsa.PublicKey{N: new(big.Int).SetBytes(n), E: int(new(big.Int).SetBytes(e).Int64())}
+	}
+	return
+}
+
+// getSigningKey returns the active directory key the token was signed with, the keys are cached and refreshed
+// when they expire or when an unknown key shows up after a rotation
+func getSigningKey(ctx context.Context, kid string) (*rsa.PublicKey, error) {
+	signingKeysLock.Lock()
+	defer signingKeysLock.Unlock()
+
+	key, ok := signingKeys[kid]
+	fetchedAgo := time.Since(signingKeysFetchedAt)
+	if (ok && fetchedAgo < signingKeysTtl) || (!ok && signingKeys != nil && fetchedAgo < signingKeysMinRefresh) {
+		if !ok {
+			return nil, fmt.Errorf("unknown token signing key %s", kid)
+		}
+		return key, nil
+	}
+
+	keys, err := fetchSigningKeys(ctx)
+	if err != nil {
+		return nil, err
+	}
+	signingKeys = keys
+	signingKeysFetchedAt = time.Now()
+	if key, ok = signingKeys[kid]; !ok {
+		return nil, fmt.Errorf("unknown token signing key %s", kid)
+	}
+	return key, nil
+}
+
+// getScaleSetFromResourceId returns the cluster scale set the resource id belongs to, empty for other resources
+func getScaleSetFromResourceId(ctx context.Context, resourceId string) string {
+	for _, vmScaleSetName := range GetVmScaleSetNames(ctx, Getenv(ctx, "PREFIX"), Getenv(ctx, "CLUSTER_NAME")) {
+		scaleSetId := fmt.Sprintf(
+			"/subscriptions/%s/resourceGroups/%s/providers/Microsoft.Compute/virtualMachineScaleSets/%s",
+			Getenv(ctx, "SUBSCRIPTION_ID"), Getenv(ctx, "RESOURCE_GROUP_NAME"), vmScaleSetName,
+		)
+		if strings.EqualFold(resourceId, scaleSetId) {
+			return vmScaleSetName
+		}
+	}
+	return ""
+}
+
+// AuthenticateInstance validates the managed identity token of the calling vm: it must be issued for the instance
+// auth audience to the identity of one of the cluster scale sets, and the vm named in the request, if any, must be
+// an instance of that scale set
+func AuthenticateInstance(ctx context.Context, token, vmName string) error {
+	claims := &instanceClaims{}
+	_, err := jwt.ParseWithClaims(token, claims, func(t *jwt.Token) (interface{}, error) {
+		kid, _ := t.Header["kid"].(string)
+		return getSigningKey(ctx, kid)
+	}, jwt.WithValidMethods([]string{"RS256"}))
+	if err != nil {
+		return fmt.Errorf("%w: invalid token: %v", ErrInstanceUnauthorized, err)
+	}
+
+	audience := GetInstanceAuthAudience(ctx)
+	if !claims.VerifyAudience(audience, true) && !claims.VerifyAudience(strings.TrimSuffix(audience, "/"), true) {
+		return fmt.Errorf("%w: token audience %v is not %s", ErrInstanceUnauthorized, claims.Audience, audience)
+	}
+	if tenantId := Getenv(ctx, "TENANT_ID"); tenantId != "" && !strings.EqualFold(claims.TenantId, tenantId) {
+		return fmt.Errorf("%w: token tenant %s is not %s", ErrInstanceUnauthorized, claims.TenantId, tenantId)
+	}
+
+	vmScaleSetName := getScaleSetFromResourceId(ctx, claims.ResourceId)
+	if vmScaleSetName == "" {
+		return fmt.Errorf("%w: %s is not a cluster scale set", ErrInstanceUnauthorized, claims.ResourceId)
+	}
+	if vmName != "" && !strings.EqualFold(GetVmScaleSetNameFromVmName(vmName), vmScaleSetName) {
+		return fmt.Errorf("%w: vm %s is not an instance of %s", ErrInstanceUnauthorized, vmName, vmScaleSetName)
+	}
+	return nil
+}
+
+// AuthenticateInstanceRequest authenticates the invoke request of a function called by the vms, the token is the
+// bearer of the http trigger request and the vm is the "vm" (<vm name>:<host name>) or "instance" of its body
+func AuthenticateInstanceRequest(ctx context.Context, invokeRequestBody []byte) error {
+	var invokeRequest InvokeRequest
+	if err := json.Unmarshal(invokeRequestBody, &invokeRequest); err != nil {
+		return fmt.Errorf("%w: cannot decode the request: %v", ErrInstanceUnauthorized, err)
+	}
+	var req struct {
+		Headers map[string][]string
+		Body    string
+	}
+	if err := json.Unmarshal(invokeRequest.Data["req"], &req); err != nil {
+		return fmt.Errorf("%w: cannot decode the request: %v", ErrInstanceUnauthorized, err)
+	}
+
+	var token string
+	for name, values := range req.Headers {
+		if strings.EqualFold(name, "Authorization") && len(values) > 0 {
+			token = strings.TrimSpace(strings.TrimPrefix(values[0], "Bearer "))
+		}
+	}
+	if token == "" {
+		return fmt.Errorf("%w: the request has no bearer token", ErrInstanceUnauthorized)
+	}
+
+	var body struct {
+		Vm       string `json:"vm"`
+		Instance string `json:"instance"`
+	}
+	// functions with a non json body, or without a vm in it, are only checked to be called by a cluster scale set
+	_ = json.Unmarshal([]byte(req.Body), &body)
+	vmName := body.Instance
+	if body.Vm != "" {
+		vmName = strings.Split(body.Vm, ":")[0]
+	}
+	return AuthenticateInstance(ctx, token, vmName)
+}
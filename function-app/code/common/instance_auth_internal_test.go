@@ -0,0 +1,125 @@
+package common
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/json"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt/v4"
+)
+
+const testScaleSetId = "/subscriptions/sub-id/resourceGroups/weka-rg/providers/Microsoft.Compute/virtualMachineScaleSets/weka-test-vmss"
+
+// setTestSigningKey replaces the cached active directory keys with a test key, the tokens are signed with it
+func setTestSigningKey(t *testing.T) *rsa.PrivateKey {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatalf("failed generating the signing key: %s", err)
+	}
+	signingKeysLock.Lock()
+	defer signingKeysLock.Unlock()
+	cachedKeys, cachedFetchedAt := signingKeys, signingKeysFetchedAt
+	signingKeys = map[string]*rsa.PublicKey{"test-kid": &key.PublicKey}
+	signingKeysFetchedAt = time.Now()
+	t.Cleanup(func() {
+		signingKeysLock.Lock()
+		defer signingKeysLock.Unlock()
+		signingKeys, signingKeysFetchedAt = cachedKeys, cachedFetchedAt
+	})
+	return key
+}
+
+func signInstanceToken(t *testing.T, key *rsa.PrivateKey, audience, resourceId string) string {
+	token := jwt.NewWithClaims(jwt.SigningMethodRS256, instanceClaims{
+		RegisteredClaims: jwt.RegisteredClaims{
+			Audience:  jwt.ClaimStrings{audience},
+			ExpiresAt: jwt.NewNumericDate(time.Now().Add(time.Hour)),
+		},
+		TenantId:   "tenant-id",
+		ResourceId: resourceId,
+	})
+	token.Header["kid"] = "test-kid"
+	signed, err := token.SignedString(key)
+	if err != nil {
+		t.Fatalf("failed signing the token: %s", err)
+	}
+	return signed
+}
+
+func setInstanceAuthEnv(t *testing.T) {
+	t.Setenv("SUBSCRIPTION_ID", "sub-id")
+	t.Setenv("RESOURCE_GROUP_NAME", "weka-rg")
+	t.Setenv("PREFIX", "weka")
+	t.Setenv("CLUSTER_NAME", "test")
+	t.Setenv("AVAILABILITY_ZONES", "")
+	t.Setenv("TENANT_ID", "tenant-id")
+	t.Setenv("INSTANCE_AUTH_AUDIENCE", "")
+}
+
+func Test_AuthenticateInstance(t *testing.T) {
+	setInstanceAuthEnv(t)
+	key := setTestSigningKey(t)
+	ctx := context.Background()
+	audience := GetInstanceAuthAudience(ctx)
+	if audience == "" {
+		t.Fatalf("the default audience of the cloud is empty")
+	}
+
+	token := signInstanceToken(t, key, audience, testScaleSetId)
+	if err := AuthenticateInstance(ctx, token, "weka-test-vmss_3"); err != nil {
+		t.Errorf("failed authenticating a cluster instance: %s", err)
+	}
+	if err := AuthenticateInstance(ctx, token, ""); err != nil {
+		t.Errorf("failed authenticating a cluster scale set: %s", err)
+	}
+
+	unauthorized := map[string]struct {
+		token  string
+		vmName string
+	}{
+		"vm of another scale set": {token, "weka-other-vmss_0"},
+		"identity of another scale set": {
+			signInstanceToken(t, key, audience, "/subscriptions/sub-id/resourceGroups/weka-rg/providers/Microsoft.Compute/virtualMachineScaleSets/other-vmss"), "",
+		},
+		"token of another audience": {signInstanceToken(t, key, "https://vault.azure.net", testScaleSetId), ""},
+		"token signed by another key": {
+			func() string {
+				otherKey, _ := rsa.GenerateKey(rand.Reader, 2048)
+				return signInstanceToken(t, otherKey, audience, testScaleSetId)
+			}(), "",
+		},
+	}
+	for name, request := range unauthorized {
+		if err := AuthenticateInstance(ctx, request.token, request.vmName); !errors.Is(err, ErrInstanceUnauthorized) {
+			t.Errorf("%s: expected the instance to be unauthorized, got: %v", name, err)
+		}
+	}
+}
+
+func Test_AuthenticateInstanceRequest(t *testing.T) {
+	setInstanceAuthEnv(t)
+	key := setTestSigningKey(t)
+	ctx := context.Background()
+	token := signInstanceToken(t, key, GetInstanceAuthAudience(ctx), testScaleSetId)
+
+	invokeRequest := func(headers map[string][]string, body string) []byte {
+		req, _ := json.Marshal(map[string]interface{}{"Headers": headers, "Body": body})
+		data, _ := json.Marshal(InvokeRequest{Data: map[string]json.RawMessage{"req": req}})
+		return data
+	}
+
+	authorization := map[string][]string{"Authorization": {"Bearer " + token}}
+	if err := AuthenticateInstanceRequest(ctx, invokeRequest(authorization, `{"vm": "weka-test-vmss_1:weka-host-1"}`)); err != nil {
+		t.Errorf("failed authenticating the clusterize request: %s", err)
+	}
+	if err := AuthenticateInstanceRequest(ctx, invokeRequest(authorization, `{"instance": "weka-other-vmss_1"}`)); !errors.Is(err, ErrInstanceUnauthorized) {
+		t.Errorf("expected the report of another scale set vm to be unauthorized, got: %v", err)
+	}
+	if err := AuthenticateInstanceRequest(ctx, invokeRequest(nil, `{"vm": "weka-test-vmss_1:weka-host-1"}`)); !errors.Is(err, ErrInstanceUnauthorized) {
+		t.Errorf("expected the request without a token to be unauthorized, got: %v", err)
+	}
+}
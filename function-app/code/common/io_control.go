@@ -0,0 +1,215 @@
+package common
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/Azure/azure-sdk-for-go/sdk/azcore"
+	"github.com/weka/go-cloud-lib/logging"
+)
+
+// the io of the cluster is stopped and started by the stop_io and start_io functions, which run the io control
+// script on every backend, the progress of the last run is kept in its own blob next to the state
+const ioControlBlobName = "io_control"
+
+const (
+	// the reports of the io control script have this phase
+	IoControlReportPhase = "io_control"
+	IoActionStop         = "stop"
+	IoActionStart        = "start"
+	// the maintenance mode reason set by stop_io, start_io disables only the maintenance mode it set
+	IoStoppedMaintenanceReason = "cluster io is stopped"
+)
+
+const (
+	IoStatusRunning  = "running"
+	IoStatusStopping = "stopping"
+	IoStatusStopped  = "stopped"
+	IoStatusStarting = "starting"
+	IoStatusFailed   = "failed"
+)
+
+const (
+	ioBackendDone   = "done"
+	ioBackendFailed = "failed"
+)
+
+type IoControlStatus struct {
+	Status  string `json:"status"`
+	Action  string `json:"action,omitempty"`
+	Message string `json:"message,omitempty"`
+	// the backend running the cluster wide stop-io / start-io, and the result of each backend by its hostname
+	Leader   string            `json:"leader,omitempty"`
+	Backends map[string]string `json:"backends,omitempty"`
+	// the backends the script was started on, the run is done once all of them reported
+	Expected int `json:"expected"`
+	// set when stop_io enabled the maintenance mode, which start_io disables once the io is started
+	MaintenanceSet bool      `json:"maintenance_set,omitempty"`
+	RequestedAt    time.Time `json:"requested_at,omitempty"`
+	UpdatedAt      time.Time `json:"updated_at,omitempty"`
+}
+
+func readIoControlStatus(ctx context.Context, stateStorageName, stateContainerName string) (status IoControlStatus, etag *azcore.ETag, err error) {
+	logger := logging.LoggerFromCtx(ctx)
+
+	data, etag, err := readBlobWithETag(ctx, stateStorageName, stateContainerName, ioControlBlobName, true)
+	if err != nil {
+		return
+	}
+	if len(data) == 0 {
+		status = IoControlStatus{Status: IoStatusRunning}
+		return
+	}
+	if err = json.Unmarshal(data, &status); err != nil {
+		logger.Error().Err(err).Send()
+	}
+	return
+}
+
+func GetIoControlStatus(ctx context.Context, stateStorageName, stateContainerName string) (status IoControlStatus, err error) {
+	status, _, err = readIoControlStatus(ctx, stateStorageName, stateContainerName)
+	return
+}
+
+// UpdateIoControlStatus applies the update to the io control status, with the same conflict handling as UpdateState
+func UpdateIoControlStatus(ctx context.Context, stateStorageName, stateContainerName string, update func(status *IoControlStatus)) (status IoControlStatus, err error) {
+	logger := logging.LoggerFromCtx(ctx)
+
+	for attempt := 1; attempt <= stateUpdateMaxAttempts; attempt++ {
+		var etag *azcore.ETag
+		status, etag, err = readIoControlStatus(ctx, stateStorageName, stateContainerName)
+		if err != nil {
+			return
+		}
+		update(&status)
+
+		var data []byte
+		data, err = json.Marshal(status)
+		if err != nil {
+			logger.Error().Err(err).Send()
+			return
+		}
+
+		err = writeBlobIfMatch(ctx, stateStorageName, stateContainerName, ioControlBlobName, data, etag)
+		if err == nil || !isBlobWriteConflict(err) {
+			return
+		}
+		time.Sleep(getBlobUpdateRetryDelay(attempt))
+	}
+	err = fmt.Errorf("failed to update io control status after %d attempts: %w", stateUpdateMaxAttempts, err)
+	logger.Error().Err(err).Send()
+	return
+}
+
+// completeIoControlRun fails the run on the first failed backend, the run is done once all the backends it was started
+// on reported
+func completeIoControlRun(status *IoControlStatus) {
+	if status.Status != IoStatusStopping && status.Status != IoStatusStarting {
+		return
+	}
+	for backend, result := range status.Backends {
+		if result == ioBackendFailed {
+			status.Status = IoStatusFailed
+			status.Message = fmt.Sprintf("the io %s failed on %s", status.Action, backend)
+			return
+		}
+	}
+	if status.Expected == 0 || len(status.Backends) < status.Expected {
+		return
+	}
+	if status.Action == IoActionStop {
+		status.Status = IoStatusStopped
+	} else {
+		status.Status = IoStatusRunning
+	}
+	status.Message = fmt.Sprintf("io %s completed on %d backends", status.Action, status.Expected)
+}
+
+// releaseIoMaintenanceMode disables the maintenance mode stop_io set, once the io is running again
+func releaseIoMaintenanceMode(ctx context.Context, stateStorageName, stateContainerName string, status IoControlStatus) (err error) {
+	if status.Status != IoStatusRunning || !status.MaintenanceSet {
+		return
+	}
+	_, err = UpdateClusterSettings(ctx, stateStorageName, stateContainerName, func(settings *ClusterSettings) error {
+		if settings.Maintenance != nil && settings.Maintenance.Reason == IoStoppedMaintenanceReason {
+			settings.Maintenance = &MaintenanceMode{Enabled: false, UpdatedAt: time.Now().UTC()}
+		}
+		return nil
+	})
+	if err != nil {
+		return
+	}
+	_, err = UpdateIoControlStatus(ctx, stateStorageName, stateContainerName, func(status *IoControlStatus) {
+		status.MaintenanceSet = false
+	})
+	return
+}
+
+// StartIoControlRun resets the status before the io control script is started, so no report of the run is lost
+func StartIoControlRun(ctx context.Context, stateStorageName, stateContainerName, action string, maintenanceSet bool) (IoControlStatus, error) {
+	return UpdateIoControlStatus(ctx, stateStorageName, stateContainerName, func(status *IoControlStatus) {
+		*status = IoControlStatus{
+			Status:         IoStatusStopping,
+			Action:         action,
+			Backends:       make(map[string]string),
+			MaintenanceSet: maintenanceSet,
+			RequestedAt:    time.Now().UTC(),
+		}
+		if action == IoActionStart {
+			status.Status = IoStatusStarting
+		}
+	})
+}
+
+// SetIoControlRunBackends records the backends the io control script was started on, the backends it failed to
+// start on fail the run
+func SetIoControlRunBackends(ctx context.Context, stateStorageName, stateContainerName, leader string, started []string, failedToStart map[string]string) (status IoControlStatus, err error) {
+	status, err = UpdateIoControlStatus(ctx, stateStorageName, stateContainerName, func(status *IoControlStatus) {
+		status.Leader = leader
+		status.Expected = len(started)
+		status.UpdatedAt = time.Now().UTC()
+		completeIoControlRun(status)
+		if len(failedToStart) > 0 && status.Status != IoStatusFailed {
+			var names []string
+			for name := range failedToStart {
+				names = append(names, name)
+			}
+			sort.Strings(names)
+			status.Status = IoStatusFailed
+			status.Message = fmt.Sprintf("the io %s script could not be started on: %s", status.Action, strings.Join(names, ", "))
+		}
+	})
+	if err != nil {
+		return
+	}
+	err = releaseIoMaintenanceMode(ctx, stateStorageName, stateContainerName, status)
+	return
+}
+
+// RecordIoControlReport stores the result a backend reported, the maintenance mode set by stop_io is disabled once
+// the io is started again
+func RecordIoControlReport(ctx context.Context, stateStorageName, stateContainerName string, report ProgressReport) error {
+	status, err := UpdateIoControlStatus(ctx, stateStorageName, stateContainerName, func(status *IoControlStatus) {
+		if status.Backends == nil {
+			status.Backends = make(map[string]string)
+		}
+		if report.Type == ReportTypeError {
+			status.Backends[report.Hostname] = ioBackendFailed
+		} else {
+			status.Backends[report.Hostname] = ioBackendDone
+		}
+		status.UpdatedAt = time.Now().UTC()
+		completeIoControlRun(status)
+		if report.Type == ReportTypeError && status.Status == IoStatusFailed {
+			status.Message = fmt.Sprintf("%s: %s", report.Hostname, report.Message)
+		}
+	})
+	if err != nil {
+		return err
+	}
+	return releaseIoMaintenanceMode(ctx, stateStorageName, stateContainerName, status)
+}
@@ -0,0 +1,91 @@
+package common
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/Azure/azure-sdk-for-go/sdk/keyvault/azsecrets"
+	"github.com/weka/go-cloud-lib/logging"
+)
+
+// a private key vault is resolved through its privatelink dns zone, right after the deployment the zone link may
+// not have propagated yet, so the key vault calls are retried while its name can't be resolved
+const (
+	keyVaultDnsMaxAttempts   = 10
+	keyVaultDnsRetryDelay    = 5 * time.Second
+	keyVaultDnsMaxRetryDelay = 30 * time.Second
+)
+
+// GetKeyVaultEndpoint returns the endpoint the key vault is reached at, KEY_VAULT_ENDPOINT overrides the key vault
+// uri, e.g. with a custom dns name of its private endpoint. The uri stays the key of the secrets cache
+func GetKeyVaultEndpoint(keyVaultUri string) string {
+	if endpoint := os.Getenv("KEY_VAULT_ENDPOINT"); endpoint != "" {
+		return endpoint
+	}
+	return keyVaultUri
+}
+
+// getSecretsClientOptions returns the key vault client options, the authentication challenge names the key vault
+// domain, which doesn't match an overridden endpoint, so its verification is skipped then
+func getSecretsClientOptions() *azsecrets.ClientOptions {
+	return &azsecrets.ClientOptions{
+		ClientOptions:                        getClientOptions(),
+		DisableChallengeResourceVerification: os.Getenv("KEY_VAULT_ENDPOINT") != "",
+	}
+}
+
+// getKeyVaultNoProxyHosts returns the key vault hosts reached without the proxy, with an endpoint override the key
+// vault is reached through the vnet (service endpoint or private endpoint), where the proxy source ip is not allowed
+func getKeyVaultNoProxyHosts() (hosts []string) {
+	endpoint := os.Getenv("KEY_VAULT_ENDPOINT")
+	if endpoint == "" {
+		return
+	}
+	for _, uri := range []string{endpoint, os.Getenv("KEY_VAULT_URI")} {
+		if parsed, err := url.Parse(uri); err == nil && parsed.Hostname() != "" {
+			hosts = append(hosts, parsed.Hostname())
+		}
+	}
+	return
+}
+
+func isDnsError(err error) bool {
+	var dnsErr *net.DNSError
+	return errors.As(err, &dnsErr)
+}
+
+func getKeyVaultDnsRetryDelay(attempt int) time.Duration {
+	delay := keyVaultDnsRetryDelay * time.Duration(attempt)
+	if delay > keyVaultDnsMaxRetryDelay {
+		return keyVaultDnsMaxRetryDelay
+	}
+	return delay
+}
+
+// withKeyVaultDnsRetry runs the key vault call again while the key vault name doesn't resolve, other errors are
+// returned right away
+func withKeyVaultDnsRetry(ctx context.Context, keyVaultUri string, call func() error) (err error) {
+	logger := logging.LoggerFromCtx(ctx)
+
+	for attempt := 1; attempt <= keyVaultDnsMaxAttempts; attempt++ {
+		err = call()
+		if err == nil || !isDnsError(err) || attempt == keyVaultDnsMaxAttempts {
+			return
+		}
+		delay := getKeyVaultDnsRetryDelay(attempt)
+		logger.Warn().Err(err).Msgf(
+			"key vault %s can't be resolved yet, retrying in %s (%d/%d)", strings.TrimSuffix(keyVaultUri, "/"), delay, attempt, keyVaultDnsMaxAttempts,
+		)
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(delay):
+		}
+	}
+	return
+}
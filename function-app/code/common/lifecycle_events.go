@@ -0,0 +1,75 @@
+package common
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/weka/go-cloud-lib/logging"
+)
+
+// lifecycle events published to the LIFECYCLE_EVENT_GRID_ENDPOINT topic, so the automation depending on the cluster
+// is triggered by them instead of polling the status
+const (
+	LifecycleEventClusterReady     = "Weka.Cluster.Ready"
+	LifecycleEventObsAttached      = "Weka.Cluster.ObsAttached"
+	LifecycleEventScaleUpCompleted = "Weka.Cluster.ScaleUpCompleted"
+	LifecycleEventHostFailed       = "Weka.Cluster.HostFailed"
+)
+
+const cloudEventsBatchContentType = "application/cloudevents-batch+json; charset=utf-8"
+
+// cloudEvent is an event of the cloud events 1.0 schema, the input schema of the lifecycle topic
+type cloudEvent struct {
+	SpecVersion     string            `json:"specversion"`
+	Type            string            `json:"type"`
+	Source          string            `json:"source"`
+	Id              string            `json:"id"`
+	Time            time.Time         `json:"time"`
+	Subject         string            `json:"subject,omitempty"`
+	DataContentType string            `json:"datacontenttype"`
+	Data            map[string]string `json:"data"`
+}
+
+// getLifecycleEventSource identifies the cluster the events are about, clusters of the same topic differ by it
+func getLifecycleEventSource(ctx context.Context) string {
+	return fmt.Sprintf("/subscriptions/%s/resourceGroups/%s/weka/%s-%s",
+		Getenv(ctx, "SUBSCRIPTION_ID"), Getenv(ctx, "RESOURCE_GROUP_NAME"), Getenv(ctx, "PREFIX"), Getenv(ctx, "CLUSTER_NAME"))
+}
+
+// PublishLifecycleEvent publishes the event when a lifecycle topic is configured, the subject is the vm the event
+// is about if any. Like the notifications, publishing failures never fail the calling function
+func PublishLifecycleEvent(ctx context.Context, eventType, subject string, data map[string]string) {
+	logger := logging.LoggerFromCtx(ctx)
+
+	topicEndpoint := Getenv(ctx, "LIFECYCLE_EVENT_GRID_ENDPOINT")
+	if topicEndpoint == "" {
+		return
+	}
+
+	eventData := map[string]string{"cluster_name": Getenv(ctx, "CLUSTER_NAME")}
+	for key, value := range data {
+		eventData[key] = value
+	}
+	events := []cloudEvent{{
+		SpecVersion:     "1.0",
+		Type:            eventType,
+		Source:          getLifecycleEventSource(ctx),
+		Id:              uuid.New().String(),
+		Time:            time.Now().UTC(),
+		Subject:         subject,
+		DataContentType: "application/json",
+		Data:            eventData,
+	}}
+
+	token, err := getEventGridToken(ctx)
+	if err == nil {
+		err = postNotification(ctx, topicEndpoint, cloudEventsBatchContentType, events, token)
+	}
+	if err != nil {
+		logger.Error().Err(err).Msgf("failed to publish the %s lifecycle event", eventType)
+		return
+	}
+	logger.Info().Msgf("published the %s lifecycle event", eventType)
+}
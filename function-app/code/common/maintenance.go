@@ -0,0 +1,59 @@
+package common
+
+import (
+	"context"
+	"fmt"
+	"time"
+)
+
+// maintenance mode freezes the automation changing the cluster, the instances which need the cluster
+// to be changed wait until it is disabled
+type MaintenanceMode struct {
+	Enabled   bool      `json:"enabled"`
+	Reason    string    `json:"reason,omitempty"`
+	UpdatedAt time.Time `json:"updated_at"`
+}
+
+// instances waiting for the maintenance mode to be disabled call the function again after this delay
+const maintenanceModeRetrySeconds = 60
+
+func (s ClusterSettings) IsMaintenanceModeEnabled() bool {
+	return s.Maintenance != nil && s.Maintenance.Enabled
+}
+
+func IsMaintenanceModeEnabled(ctx context.Context, stateStorageName, stateContainerName string) (enabled bool, err error) {
+	settings, err := GetClusterSettings(ctx, stateStorageName, stateContainerName)
+	if err != nil {
+		return
+	}
+	enabled = settings.IsMaintenanceModeEnabled()
+	return
+}
+
+// GetMaintenanceModeScript returns a script waiting and then calling the function again with the same payload,
+// and running the script it returns, the returned script waits again while maintenance mode is enabled
+func GetMaintenanceModeScript(reportFuncDef, retryFuncDef, retryFuncName, payload string) string {
+	return GetRetryScript(reportFuncDef, retryFuncDef, retryFuncName, payload, "Cluster is in maintenance mode", maintenanceModeRetrySeconds)
+}
+
+// GetRetryScript returns a script reporting the reason, waiting and then calling the function again with the same
+// payload, and running the script it returns
+func GetRetryScript(reportFuncDef, retryFuncDef, retryFuncName, payload, reason string, retrySeconds int) string {
+	return fmt.Sprintf(`
+#!/bin/bash
+set -ex
+
+# report function definition
+%s
+
+# %s function definition
+%s
+
+report "{\"hostname\": \"$HOSTNAME\", \"type\": \"progress\", \"message\": \"%s, retrying %s in %d seconds\"}"
+sleep %d
+%s '%s' > /tmp/%s_retry.sh
+chmod +x /tmp/%s_retry.sh
+exec /tmp/%s_retry.sh
+`, reportFuncDef, retryFuncName, retryFuncDef, reason, retryFuncName, retrySeconds, retrySeconds,
+		retryFuncName, payload, retryFuncName, retryFuncName, retryFuncName)
+}
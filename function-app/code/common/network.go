@@ -0,0 +1,32 @@
+package common
+
+import (
+	"net"
+)
+
+// GetSubnetGateway returns the first address of the subnet, azure reserves it for the subnet default gateway,
+// empty when it is not a valid cidr
+func GetSubnetGateway(subnet string) string {
+	ip, ipNet, err := net.ParseCIDR(subnet)
+	if err != nil {
+		return ""
+	}
+	ip = ip.Mask(ipNet.Mask)
+	for i := len(ip) - 1; i >= 0; i-- {
+		ip[i]++
+		if ip[i] > 0 {
+			break
+		}
+	}
+	return ip.String()
+}
+
+// GetSubnetNetmaskBits returns the prefix length of the subnet, 0 when it is not a valid cidr
+func GetSubnetNetmaskBits(subnet string) int {
+	_, ipNet, err := net.ParseCIDR(subnet)
+	if err != nil {
+		return 0
+	}
+	ones, _ := ipNet.Mask.Size()
+	return ones
+}
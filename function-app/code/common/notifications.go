@@ -0,0 +1,213 @@
+package common
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/Azure/azure-sdk-for-go/sdk/azcore/policy"
+	"github.com/Azure/azure-sdk-for-go/sdk/azidentity"
+	"github.com/google/uuid"
+	"github.com/weka/go-cloud-lib/logging"
+)
+
+// notification severities, only the ones at least NOTIFICATION_MIN_SEVERITY are sent
+const (
+	NotificationSeverityInfo     = "info"
+	NotificationSeverityWarning  = "warning"
+	NotificationSeverityError    = "error"
+	NotificationSeverityCritical = "critical"
+)
+
+// notification events sent by the functions
+const (
+	NotificationDeployFailed         = "DeployFailed"
+	NotificationClusterizeFailed     = "ClusterizationFailed"
+	NotificationClusterizeTimedOut   = "ClusterizationTimedOut"
+	NotificationScaleDownFailed      = "ScaleDownFailed"
+	NotificationAzureOperationFailed = "AzureOperationFailed"
+)
+
+const (
+	notificationRequestTimeout = 5 * time.Second
+	defaultNotificationDedup   = 30 * time.Minute
+	eventGridScope             = "https://eventgrid.azure.net/.default"
+)
+
+var notificationSeverityRanks = map[string]int{
+	NotificationSeverityInfo:     0,
+	NotificationSeverityWarning:  1,
+	NotificationSeverityError:    2,
+	NotificationSeverityCritical: 3,
+}
+
+// Notification is posted as is to the webhook, slack and teams incoming webhooks display its text,
+// it is the data of the event grid events
+type Notification struct {
+	Text        string            `json:"text"`
+	Event       string            `json:"event"`
+	Severity    string            `json:"severity"`
+	ClusterName string            `json:"cluster_name"`
+	Message     string            `json:"message"`
+	Properties  map[string]string `json:"properties,omitempty"`
+	Time        time.Time         `json:"time"`
+}
+
+type eventGridEvent struct {
+	Id          string       `json:"id"`
+	EventType   string       `json:"eventType"`
+	Subject     string       `json:"subject"`
+	EventTime   time.Time    `json:"eventTime"`
+	Data        Notification `json:"data"`
+	DataVersion string       `json:"dataVersion"`
+}
+
+var (
+	notificationsLock sync.Mutex
+	// the time each notification was last sent, by event and message
+	notificationsSentAt = make(map[string]time.Time)
+)
+
+func getNotificationMinSeverity(ctx context.Context) string {
+	severity := Getenv(ctx, "NOTIFICATION_MIN_SEVERITY")
+	if _, ok := notificationSeverityRanks[severity]; !ok {
+		return NotificationSeverityError
+	}
+	return severity
+}
+
+// getNotificationDedup returns the window repeated notifications are dropped within, configured by NOTIFICATION_DEDUP_MINUTES
+func getNotificationDedup(ctx context.Context) time.Duration {
+	minutes, err := strconv.Atoi(Getenv(ctx, "NOTIFICATION_DEDUP_MINUTES"))
+	if err != nil || minutes < 0 {
+		return defaultNotificationDedup
+	}
+	return time.Duration(minutes) * time.Minute
+}
+
+// isDuplicateNotification tells whether the same notification was sent within the dedup window, the notifications
+// are deduplicated by each functions instance
+func isDuplicateNotification(ctx context.Context, key string) bool {
+	notificationsLock.Lock()
+	defer notificationsLock.Unlock()
+
+	now := time.Now()
+	if sentAt, ok := notificationsSentAt[key]; ok && now.Sub(sentAt) < getNotificationDedup(ctx) {
+		return true
+	}
+	for sentKey, sentAt := range notificationsSentAt {
+		if now.Sub(sentAt) >= getNotificationDedup(ctx) {
+			delete(notificationsSentAt, sentKey)
+		}
+	}
+	notificationsSentAt[key] = now
+	return false
+}
+
+func postNotification(ctx context.Context, url, contentType string, body interface{}, token string) error {
+	data, err := json.Marshal(body)
+	if err != nil {
+		return err
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, notificationRequestTimeout)
+	defer cancel()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, url, bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", contentType)
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+
+	resp, err := getHttpClient().Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return fmt.Errorf("notification rejected, status: %s", resp.Status)
+	}
+	return nil
+}
+
+// getEventGridToken returns a token of the function app identity for publishing to the event grid topics
+func getEventGridToken(ctx context.Context) (string, error) {
+	credential, err := azidentity.NewDefaultAzureCredential(getCredentialOptions())
+	if err != nil {
+		return "", err
+	}
+	token, err := credential.GetToken(ctx, policy.TokenRequestOptions{Scopes: []string{eventGridScope}})
+	if err != nil {
+		return "", err
+	}
+	return token.Token, nil
+}
+
+// publishEventGridNotification publishes the notification to the event grid topic, the function app identity
+// is an event grid data sender of the topic
+func publishEventGridNotification(ctx context.Context, topicEndpoint string, notification Notification) error {
+	token, err := getEventGridToken(ctx)
+	if err != nil {
+		return err
+	}
+
+	events := []eventGridEvent{{
+		Id:          uuid.New().String(),
+		EventType:   fmt.Sprintf("Weka.Deployment.%s", notification.Event),
+		Subject:     fmt.Sprintf("clusters/%s", notification.ClusterName),
+		EventTime:   notification.Time,
+		Data:        notification,
+		DataVersion: "1.0",
+	}}
+	return postNotification(ctx, topicEndpoint, "application/json", events, token)
+}
+
+// Notify sends the notification to the webhook and the event grid topic configured by NOTIFICATION_WEBHOOK_URL and
+// NOTIFICATION_EVENT_GRID_ENDPOINT, notification failures never fail the calling function
+func Notify(ctx context.Context, severity, event, message string, properties map[string]string) {
+	logger := logging.LoggerFromCtx(ctx)
+
+	webhookUrl := Getenv(ctx, "NOTIFICATION_WEBHOOK_URL")
+	topicEndpoint := Getenv(ctx, "NOTIFICATION_EVENT_GRID_ENDPOINT")
+	if webhookUrl == "" && topicEndpoint == "" {
+		return
+	}
+	if notificationSeverityRanks[severity] < notificationSeverityRanks[getNotificationMinSeverity(ctx)] {
+		return
+	}
+	if isDuplicateNotification(ctx, event+"|"+message) {
+		logger.Debug().Msgf("notification %s was already sent: %s", event, message)
+		return
+	}
+
+	clusterName := Getenv(ctx, "CLUSTER_NAME")
+	notification := Notification{
+		Text:        fmt.Sprintf("[%s] weka cluster %s: %s: %s", severity, clusterName, event, message),
+		Event:       event,
+		Severity:    severity,
+		ClusterName: clusterName,
+		Message:     message,
+		Properties:  properties,
+		Time:        time.Now().UTC(),
+	}
+
+	if webhookUrl != "" {
+		if err := postNotification(ctx, webhookUrl, "application/json", notification, ""); err != nil {
+			logger.Error().Err(err).Msg("failed to send the webhook notification")
+		}
+	}
+	if topicEndpoint != "" {
+		if err := publishEventGridNotification(ctx, topicEndpoint, notification); err != nil {
+			logger.Error().Err(err).Msg("failed to publish the event grid notification")
+		}
+	}
+}
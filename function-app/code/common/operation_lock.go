@@ -0,0 +1,151 @@
+package common
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/Azure/azure-sdk-for-go/sdk/storage/azblob/bloberror"
+	"github.com/weka/go-cloud-lib/logging"
+)
+
+// the operations changing the cluster hold the lease of this blob, so two of them never run concurrently, the
+// holder blob tells which operation holds it
+const (
+	operationLockBlobName       = "operation-lock"
+	operationLockHolderBlobName = "operation-lock-holder"
+)
+
+// the lease is renewed well before it expires, a function app instance which dies releases it after its duration
+const (
+	operationLockDuration      = 60 * time.Second
+	operationLockRenewInterval = 20 * time.Second
+)
+
+var ErrOperationLocked = errors.New("another operation is in progress")
+
+type OperationLockHolder struct {
+	Operation  string    `json:"operation"`
+	AcquiredAt time.Time `json:"acquired_at"`
+}
+
+// OperationLock is the lease of the operation lock blob, renewed in the background until it is released
+type OperationLock struct {
+	stateStorageName   string
+	stateContainerName string
+	leaseId            string
+	ctx                context.Context
+	cancel             context.CancelFunc
+	done               chan struct{}
+}
+
+// AcquireOperationLock takes the operation lock without waiting, ErrOperationLocked is returned with the current
+// holder when another operation holds it
+func AcquireOperationLock(ctx context.Context, stateStorageName, stateContainerName, operation string) (lock *OperationLock, err error) {
+	logger := logging.LoggerFromCtx(ctx)
+	storage := ClientsFromCtx(ctx).Storage
+
+	leaseId, err := storage.AcquireBlobLease(ctx, stateStorageName, stateContainerName, operationLockBlobName, operationLockDuration)
+	if bloberror.HasCode(err, bloberror.BlobNotFound) {
+		// only a blob can be leased, it is created on the first lock
+		err = storage.WriteBlobIfMatch(ctx, stateStorageName, stateContainerName, operationLockBlobName, []byte{}, nil)
+		if err != nil && !bloberror.HasCode(err, bloberror.BlobAlreadyExists) {
+			logger.Error().Err(err).Send()
+			return
+		}
+		leaseId, err = storage.AcquireBlobLease(ctx, stateStorageName, stateContainerName, operationLockBlobName, operationLockDuration)
+	}
+	if bloberror.HasCode(err, bloberror.LeaseAlreadyPresent) {
+		err = ErrOperationLocked
+		if holder, holderErr := GetOperationLockHolder(ctx, stateStorageName, stateContainerName); holderErr == nil && holder.Operation != "" {
+			err = fmt.Errorf("%w: %s started at %s", ErrOperationLocked, holder.Operation, holder.AcquiredAt.Format(time.RFC3339))
+		}
+		logger.Info().Msgf("%s cannot start: %s", operation, err)
+		return
+	}
+	if err != nil {
+		logger.Error().Err(err).Send()
+		return
+	}
+
+	holder, err := json.Marshal(OperationLockHolder{Operation: operation, AcquiredAt: time.Now().UTC()})
+	if err == nil {
+		err = storage.WriteBlob(ctx, stateStorageName, stateContainerName, operationLockHolderBlobName, holder)
+	}
+	if err != nil {
+		// the holder is informative only
+		logger.Warn().Err(err).Msg("failed to record the operation lock holder")
+	}
+
+	lockCtx, cancel := context.WithCancel(ctx)
+	lock = &OperationLock{
+		stateStorageName:   stateStorageName,
+		stateContainerName: stateContainerName,
+		leaseId:            leaseId,
+		ctx:                lockCtx,
+		cancel:             cancel,
+		done:               make(chan struct{}),
+	}
+	go lock.renew()
+	logger.Debug().Msgf("%s acquired the operation lock", operation)
+	err = nil
+	return
+}
+
+// renew keeps the lease until the lock is released, the lock context is cancelled when the lease can't be renewed
+// since another operation may take it once it expires
+func (l *OperationLock) renew() {
+	defer close(l.done)
+	logger := logging.LoggerFromCtx(l.ctx)
+	storage := ClientsFromCtx(l.ctx).Storage
+
+	ticker := time.NewTicker(operationLockRenewInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-l.ctx.Done():
+			return
+		case <-ticker.C:
+			err := storage.RenewBlobLease(l.ctx, l.stateStorageName, l.stateContainerName, operationLockBlobName, l.leaseId)
+			if err != nil && l.ctx.Err() == nil {
+				logger.Error().Err(err).Msg("failed to renew the operation lock, cancelling the operation")
+				l.cancel()
+				return
+			}
+		}
+	}
+}
+
+// Context is cancelled when the lock is released or its lease is lost, the operation must run with it
+func (l *OperationLock) Context() context.Context {
+	return l.ctx
+}
+
+// Release stops the renewal and releases the lease, a lease which can't be released expires after its duration
+func (l *OperationLock) Release(ctx context.Context) {
+	logger := logging.LoggerFromCtx(ctx)
+
+	l.cancel()
+	<-l.done
+	storage := ClientsFromCtx(ctx).Storage
+	// the holder is deleted while the lease is held, so the holder of the next operation is never deleted
+	if err := storage.DeleteBlob(ctx, l.stateStorageName, l.stateContainerName, operationLockHolderBlobName); err != nil {
+		logger.Warn().Err(err).Msg("failed to delete the operation lock holder")
+	}
+	if err := storage.ReleaseBlobLease(ctx, l.stateStorageName, l.stateContainerName, operationLockBlobName, l.leaseId); err != nil {
+		logger.Warn().Err(err).Msgf("failed to release the operation lock, it expires in %s", operationLockDuration)
+	}
+}
+
+// GetOperationLockHolder returns the operation holding the lock, or the last one which held it when its lease
+// expired without being released
+func GetOperationLockHolder(ctx context.Context, stateStorageName, stateContainerName string) (holder OperationLockHolder, err error) {
+	data, _, err := readBlobWithETag(ctx, stateStorageName, stateContainerName, operationLockHolderBlobName, true)
+	if err != nil || len(data) == 0 {
+		return
+	}
+	err = json.Unmarshal(data, &holder)
+	return
+}
@@ -0,0 +1,48 @@
+package common_test
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+	"weka-deployment/common"
+	"weka-deployment/common/fakes"
+)
+
+func Test_OperationLockExclusive(t *testing.T) {
+	clients := fakes.NewClients()
+	ctx := clients.Context(context.Background())
+
+	lock, err := common.AcquireOperationLock(ctx, testStorageName, testContainerName, "scale_down")
+	if err != nil {
+		t.Fatalf("failed acquiring the lock: %s", err)
+	}
+	holder, err := common.GetOperationLockHolder(ctx, testStorageName, testContainerName)
+	if err != nil {
+		t.Fatalf("failed reading the lock holder: %s", err)
+	}
+	if holder.Operation != "scale_down" {
+		t.Errorf("unexpected lock holder: %+v", holder)
+	}
+
+	// a concurrent operation is rejected with the holder
+	_, err = common.AcquireOperationLock(ctx, testStorageName, testContainerName, "upgrade")
+	if !errors.Is(err, common.ErrOperationLocked) || !strings.Contains(err.Error(), "scale_down") {
+		t.Fatalf("expected the lock to be held by scale_down, got: %v", err)
+	}
+
+	lock.Release(ctx)
+	if lock.Context().Err() == nil {
+		t.Errorf("the lock context is not cancelled once released")
+	}
+	holder, err = common.GetOperationLockHolder(ctx, testStorageName, testContainerName)
+	if err != nil || holder.Operation != "" {
+		t.Errorf("the lock holder was not deleted: %+v, %v", holder, err)
+	}
+
+	lock, err = common.AcquireOperationLock(ctx, testStorageName, testContainerName, "upgrade")
+	if err != nil {
+		t.Fatalf("failed acquiring the released lock: %s", err)
+	}
+	lock.Release(ctx)
+}
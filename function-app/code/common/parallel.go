@@ -0,0 +1,58 @@
+package common
+
+import (
+	"context"
+	"sync"
+)
+
+// AzureApiMaxParallelism bounds the concurrent azure api calls of a single function invocation,
+// large clusters must not hit the arm throttling limits
+const AzureApiMaxParallelism = 10
+
+// ForEachParallel calls fn for 0..n-1 with at most limit calls running at once,
+// the first error cancels the context passed to the calls still running and to the ones not started yet
+func ForEachParallel(ctx context.Context, n, limit int, fn func(ctx context.Context, i int) error) error {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	var (
+		wg       sync.WaitGroup
+		errOnce  sync.Once
+		firstErr error
+	)
+	semaphore := make(chan struct{}, limit)
+
+	started := 0
+	for ; started < n; started++ {
+		select {
+		case semaphore <- struct{}{}:
+		case <-ctx.Done():
+		}
+		if ctx.Err() != nil {
+			break
+		}
+
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			defer func() { <-semaphore }()
+
+			if err := fn(ctx, i); err != nil {
+				errOnce.Do(func() {
+					firstErr = err
+					cancel()
+				})
+			}
+		}(started)
+	}
+	wg.Wait()
+
+	if firstErr != nil {
+		return firstErr
+	}
+	if started < n {
+		// the parent context was cancelled before all the calls were started
+		return ctx.Err()
+	}
+	return nil
+}
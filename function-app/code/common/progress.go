@@ -0,0 +1,153 @@
+package common
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/Azure/azure-sdk-for-go/sdk/azcore"
+	"github.com/weka/go-cloud-lib/logging"
+	"github.com/weka/go-cloud-lib/protocol"
+)
+
+// the timeline is kept in its own blob next to the state, so the state stays small
+const (
+	progressBlobName        = "progress"
+	maxProgressEntriesPerVm = 200
+	ReportTypeError         = "error"
+	ProgressPhaseUnknown    = "unknown"
+)
+
+// ProgressReport is the report sent by the vms, instance and phase are optional for older scripts
+type ProgressReport struct {
+	protocol.Report
+	Instance string `json:"instance"`
+	Phase    string `json:"phase"`
+	// set by the weka home validation script
+	Reachable *bool `json:"reachable,omitempty"`
+	// set by the cluster validation script
+	IoPassed    *bool `json:"io_passed,omitempty"`
+	ObsUploaded *bool `json:"obs_uploaded,omitempty"`
+}
+
+type ProgressEntry struct {
+	Time     time.Time `json:"time"`
+	Instance string    `json:"instance,omitempty"`
+	Phase    string    `json:"phase"`
+	Type     string    `json:"type"`
+	Message  string    `json:"message"`
+}
+
+// DeploymentTimeline holds the progress entries of each vm by hostname, oldest first
+type DeploymentTimeline map[string][]ProgressEntry
+
+type VmProgress struct {
+	Hostname   string          `json:"hostname"`
+	Instance   string          `json:"instance,omitempty"`
+	Phase      string          `json:"phase"`
+	LastUpdate time.Time       `json:"last_update"`
+	Errors     int             `json:"errors"`
+	Timeline   []ProgressEntry `json:"timeline"`
+}
+
+func readDeploymentTimeline(ctx context.Context, stateStorageName, stateContainerName string) (timeline DeploymentTimeline, etag *azcore.ETag, err error) {
+	logger := logging.LoggerFromCtx(ctx)
+
+	data, etag, err := readBlobWithETag(ctx, stateStorageName, stateContainerName, progressBlobName, true)
+	if err != nil {
+		return
+	}
+	timeline = make(DeploymentTimeline)
+	if len(data) == 0 {
+		return
+	}
+	err = json.Unmarshal(data, &timeline)
+	if err != nil {
+		logger.Error().Err(err).Send()
+	}
+	return
+}
+
+// AddProgressEntry appends the report to the vm timeline, only the latest entries of each vm are kept
+func AddProgressEntry(ctx context.Context, stateStorageName, stateContainerName string, report ProgressReport) (err error) {
+	logger := logging.LoggerFromCtx(ctx)
+
+	entry := ProgressEntry{
+		Time:     time.Now().UTC(),
+		Instance: report.Instance,
+		Phase:    report.Phase,
+		Type:     report.Type,
+		Message:  report.Message,
+	}
+	if entry.Phase == "" {
+		entry.Phase = ProgressPhaseUnknown
+	}
+
+	for attempt := 1; attempt <= stateUpdateMaxAttempts; attempt++ {
+		var timeline DeploymentTimeline
+		var etag *azcore.ETag
+		timeline, etag, err = readDeploymentTimeline(ctx, stateStorageName, stateContainerName)
+		if err != nil {
+			return
+		}
+
+		entries := append(timeline[report.Hostname], entry)
+		if len(entries) > maxProgressEntriesPerVm {
+			entries = entries[len(entries)-maxProgressEntriesPerVm:]
+		}
+		timeline[report.Hostname] = entries
+
+		var data []byte
+		data, err = json.Marshal(timeline)
+		if err != nil {
+			logger.Error().Err(err).Send()
+			return
+		}
+
+		err = writeBlobIfMatch(ctx, stateStorageName, stateContainerName, progressBlobName, data, etag)
+		if err == nil || !isBlobWriteConflict(err) {
+			return
+		}
+		time.Sleep(getBlobUpdateRetryDelay(attempt))
+	}
+	err = fmt.Errorf("failed to update deployment timeline after %d attempts: %w", stateUpdateMaxAttempts, err)
+	logger.Error().Err(err).Send()
+	return
+}
+
+// GetDeploymentProgress aggregates the timeline per vm, the phase of a vm is the phase of its latest entry
+func GetDeploymentProgress(ctx context.Context, stateStorageName, stateContainerName string) (progress []VmProgress, err error) {
+	timeline, _, err := readDeploymentTimeline(ctx, stateStorageName, stateContainerName)
+	if err != nil {
+		return
+	}
+
+	progress = make([]VmProgress, 0, len(timeline))
+	for hostname, entries := range timeline {
+		if len(entries) == 0 {
+			continue
+		}
+		vmProgress := VmProgress{
+			Hostname: hostname,
+			Timeline: entries,
+		}
+		for _, entry := range entries {
+			if entry.Instance != "" {
+				vmProgress.Instance = entry.Instance
+			}
+			if entry.Type == ReportTypeError {
+				vmProgress.Errors++
+			}
+		}
+		latest := entries[len(entries)-1]
+		vmProgress.Phase = latest.Phase
+		vmProgress.LastUpdate = latest.Time
+		progress = append(progress, vmProgress)
+	}
+	sort.Slice(progress, func(i, j int) bool {
+		return progress[i].Hostname < progress[j].Hostname
+	})
+	return
+}
@@ -0,0 +1,65 @@
+package common
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"github.com/Azure/azure-sdk-for-go/sdk/azidentity"
+	"github.com/Azure/azure-sdk-for-go/sdk/resourcemanager/network/armnetwork"
+	"github.com/weka/go-cloud-lib/logging"
+)
+
+// the protocol gateways are standalone vms of the protocol_gateways module, not scale set vms
+const (
+	NfsProtocolGatewaysNameSuffix = "nfs-protocol-gateway"
+	SmbProtocolGatewaysNameSuffix = "smb-protocol-gateway"
+)
+
+func GetProtocolGatewaysName(prefix, clusterName, suffix string) string {
+	return fmt.Sprintf("%s-%s-%s", prefix, clusterName, suffix)
+}
+
+// GetProtocolGatewaysPrivateIps returns the primary private ip of each protocol gateway by its primary nic name,
+// the nics are named <gateways name>-primary-nic-<index> by the protocol_gateways module
+func GetProtocolGatewaysPrivateIps(ctx context.Context, subscriptionId, resourceGroupName, gatewaysName string) (privateIps map[string]string, err error) {
+	logger := logging.LoggerFromCtx(ctx)
+
+	credential, err := azidentity.NewDefaultAzureCredential(getCredentialOptions())
+	if err != nil {
+		logger.Error().Err(err).Send()
+		return
+	}
+
+	client, err := armnetwork.NewInterfacesClient(subscriptionId, credential, getArmClientOptions())
+	if err != nil {
+		logger.Error().Err(err).Send()
+		return
+	}
+
+	nicPrefix := gatewaysName + "-primary-nic-"
+	privateIps = make(map[string]string)
+	pager := client.NewListPager(resourceGroupName, nil)
+	for pager.More() {
+		nextResult, pageErr := pager.NextPage(ctx)
+		if pageErr != nil {
+			err = pageErr
+			logger.Error().Err(err).Send()
+			return
+		}
+		for _, nic := range nextResult.Value {
+			if nic.Name == nil || !strings.HasPrefix(*nic.Name, nicPrefix) || nic.Properties == nil {
+				continue
+			}
+			for _, ipConfig := range nic.Properties.IPConfigurations {
+				if ipConfig.Properties == nil || ipConfig.Properties.PrivateIPAddress == nil {
+					continue
+				}
+				if ipConfig.Properties.Primary != nil && *ipConfig.Properties.Primary {
+					privateIps[*nic.Name] = *ipConfig.Properties.PrivateIPAddress
+				}
+			}
+		}
+	}
+	return
+}
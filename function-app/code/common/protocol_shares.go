@@ -0,0 +1,210 @@
+package common
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/Azure/azure-sdk-for-go/sdk/azcore"
+	"github.com/weka/go-cloud-lib/logging"
+)
+
+// the declared shares applied to the cluster are kept in their own blob next to the state, only the shares applied
+// by configure_protocols are removed once they are not declared anymore, the ones created by hand are left alone
+const protocolSharesBlobName = "protocol_shares"
+
+const (
+	// the reports of the configure protocols script have this phase
+	ProtocolSharesReportPhase = "configure_protocols"
+	ProtocolSMB               = "SMB"
+	ProtocolNFS               = "NFS"
+	SharePermissionsRW        = "rw"
+	SharePermissionsRO        = "ro"
+	// the client group created by the nfs protocol gateways
+	DefaultNfsClientGroup = "weka-cg"
+)
+
+const (
+	ProtocolSharesStatusUnknown = "unknown"
+	ProtocolSharesStatusPending = "pending"
+	ProtocolSharesStatusApplied = "applied"
+	ProtocolSharesStatusFailed  = "failed"
+)
+
+// ProtocolShare is an smb share or an nfs export of a filesystem path, the name is the smb share name and the
+// client group the nfs client group the export is granted to
+type ProtocolShare struct {
+	Name        string `json:"name,omitempty"`
+	Filesystem  string `json:"filesystem"`
+	Path        string `json:"path"`
+	Protocol    string `json:"protocol"`
+	Permissions string `json:"permissions"`
+	ClientGroup string `json:"client_group,omitempty"`
+}
+
+// Key identifies the share on the cluster, the permissions of an existing share are updated in place
+func (s ProtocolShare) Key() string {
+	if s.Protocol == ProtocolSMB {
+		return fmt.Sprintf("%s/%s", ProtocolSMB, s.Name)
+	}
+	return fmt.Sprintf("%s/%s/%s:%s", ProtocolNFS, s.ClientGroup, s.Filesystem, s.Path)
+}
+
+type ProtocolSharesStatus struct {
+	Status  string `json:"status"`
+	Message string `json:"message,omitempty"`
+	// the shares of the last configuration run, and the shares it applied before
+	Declared []ProtocolShare `json:"declared"`
+	Applied  []ProtocolShare `json:"applied"`
+	// the backend the configuration ran on
+	Instance    string    `json:"instance,omitempty"`
+	CheckedAt   time.Time `json:"checked_at,omitempty"`
+	RequestedAt time.Time `json:"requested_at,omitempty"`
+}
+
+// GetProtocolShares returns the shares declared in PROTOCOL_SHARES with their defaults set
+func GetProtocolShares(ctx context.Context) (shares []ProtocolShare, err error) {
+	value := Getenv(ctx, "PROTOCOL_SHARES")
+	if value == "" {
+		return
+	}
+	if err = json.Unmarshal([]byte(value), &shares); err != nil {
+		err = fmt.Errorf("cannot parse PROTOCOL_SHARES: %w", err)
+		return
+	}
+	for i := range shares {
+		shares[i].Protocol = strings.ToUpper(shares[i].Protocol)
+		shares[i].Permissions = strings.ToLower(shares[i].Permissions)
+		if shares[i].Filesystem == "" {
+			shares[i].Filesystem = DefaultFilesystemName
+		}
+		if shares[i].Path == "" {
+			shares[i].Path = "/"
+		}
+		if shares[i].Permissions == "" {
+			shares[i].Permissions = SharePermissionsRW
+		}
+		if shares[i].Protocol == ProtocolNFS && shares[i].ClientGroup == "" {
+			shares[i].ClientGroup = DefaultNfsClientGroup
+		}
+	}
+	err = ValidateProtocolShares(shares)
+	return
+}
+
+func ValidateProtocolShares(shares []ProtocolShare) error {
+	keys := make(map[string]bool)
+	for _, share := range shares {
+		switch share.Protocol {
+		case ProtocolSMB:
+			if share.Name == "" {
+				return fmt.Errorf("smb share of filesystem %s requires a name", share.Filesystem)
+			}
+		case ProtocolNFS:
+		default:
+			return fmt.Errorf("invalid share protocol %q, expected %s or %s", share.Protocol, ProtocolSMB, ProtocolNFS)
+		}
+		if share.Permissions != SharePermissionsRW && share.Permissions != SharePermissionsRO {
+			return fmt.Errorf("invalid share %s permissions %q, expected %s or %s", share.Key(), share.Permissions, SharePermissionsRW, SharePermissionsRO)
+		}
+		// the fields are quoted in the configure protocols script
+		if strings.ContainsAny(share.Name+share.Filesystem+share.Path+share.ClientGroup, "'\"\\") {
+			return fmt.Errorf("share %s fields must not hold quotes or backslashes", share.Key())
+		}
+		if !strings.HasPrefix(share.Path, "/") {
+			return fmt.Errorf("share %s path must be absolute", share.Key())
+		}
+		if keys[share.Key()] {
+			return fmt.Errorf("share %s is declared more than once", share.Key())
+		}
+		keys[share.Key()] = true
+	}
+	return nil
+}
+
+// GetRemovedProtocolShares returns the applied shares which are not declared anymore
+func GetRemovedProtocolShares(applied, declared []ProtocolShare) (removed []ProtocolShare) {
+	declaredKeys := make(map[string]bool)
+	for _, share := range declared {
+		declaredKeys[share.Key()] = true
+	}
+	for _, share := range applied {
+		if !declaredKeys[share.Key()] {
+			removed = append(removed, share)
+		}
+	}
+	return
+}
+
+func readProtocolSharesStatus(ctx context.Context, stateStorageName, stateContainerName string) (status ProtocolSharesStatus, etag *azcore.ETag, err error) {
+	logger := logging.LoggerFromCtx(ctx)
+
+	data, etag, err := readBlobWithETag(ctx, stateStorageName, stateContainerName, protocolSharesBlobName, true)
+	if err != nil {
+		return
+	}
+	if len(data) == 0 {
+		status = ProtocolSharesStatus{Status: ProtocolSharesStatusUnknown}
+		return
+	}
+	if err = json.Unmarshal(data, &status); err != nil {
+		logger.Error().Err(err).Send()
+	}
+	return
+}
+
+func GetProtocolSharesStatus(ctx context.Context, stateStorageName, stateContainerName string) (status ProtocolSharesStatus, err error) {
+	status, _, err = readProtocolSharesStatus(ctx, stateStorageName, stateContainerName)
+	return
+}
+
+// UpdateProtocolSharesStatus applies the update to the protocol shares status, with the same conflict handling as UpdateState
+func UpdateProtocolSharesStatus(ctx context.Context, stateStorageName, stateContainerName string, update func(status *ProtocolSharesStatus)) (status ProtocolSharesStatus, err error) {
+	logger := logging.LoggerFromCtx(ctx)
+
+	for attempt := 1; attempt <= stateUpdateMaxAttempts; attempt++ {
+		var etag *azcore.ETag
+		status, etag, err = readProtocolSharesStatus(ctx, stateStorageName, stateContainerName)
+		if err != nil {
+			return
+		}
+		update(&status)
+
+		var data []byte
+		data, err = json.Marshal(status)
+		if err != nil {
+			logger.Error().Err(err).Send()
+			return
+		}
+
+		err = writeBlobIfMatch(ctx, stateStorageName, stateContainerName, protocolSharesBlobName, data, etag)
+		if err == nil || !isBlobWriteConflict(err) {
+			return
+		}
+		time.Sleep(getBlobUpdateRetryDelay(attempt))
+	}
+	err = fmt.Errorf("failed to update protocol shares status after %d attempts: %w", stateUpdateMaxAttempts, err)
+	logger.Error().Err(err).Send()
+	return
+}
+
+// RecordProtocolSharesReport stores the result reported by the configure protocols script, after a failure the
+// declared shares are kept with the applied ones, since some of them may exist, so a later run can remove them
+func RecordProtocolSharesReport(ctx context.Context, stateStorageName, stateContainerName string, report ProgressReport) error {
+	_, err := UpdateProtocolSharesStatus(ctx, stateStorageName, stateContainerName, func(status *ProtocolSharesStatus) {
+		if report.Type == ReportTypeError {
+			status.Status = ProtocolSharesStatusFailed
+			removed := GetRemovedProtocolShares(status.Applied, status.Declared)
+			status.Applied = append(append([]ProtocolShare{}, status.Declared...), removed...)
+		} else {
+			status.Status = ProtocolSharesStatusApplied
+			status.Applied = status.Declared
+		}
+		status.Message = report.Message
+		status.Instance = report.Instance
+		status.CheckedAt = time.Now().UTC()
+	})
+	return err
+}
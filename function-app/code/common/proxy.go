@@ -0,0 +1,73 @@
+package common
+
+import (
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+
+	"github.com/Azure/azure-sdk-for-go/sdk/azcore/policy"
+	"github.com/Azure/azure-sdk-for-go/sdk/azidentity"
+	"golang.org/x/net/http/httpproxy"
+)
+
+// the managed identity endpoint is local to the function app host (or the instance metadata service),
+// it must never be reached through the proxy
+const defaultNoProxy = "localhost,127.0.0.1,169.254.169.254"
+
+var (
+	httpClient     *http.Client
+	httpClientOnce sync.Once
+)
+
+// getProxyConfig returns the proxy used for the function app egress,
+// configured by FUNCTION_APP_PROXY_URL and FUNCTION_APP_NO_PROXY (comma separated hosts, domains or cidrs),
+// the key vault is reached without the proxy when KEY_VAULT_ENDPOINT is set
+func getProxyConfig() *httpproxy.Config {
+	proxyUrl := os.Getenv("FUNCTION_APP_PROXY_URL")
+	if proxyUrl == "" {
+		return nil
+	}
+
+	noProxy := []string{defaultNoProxy}
+	if extraNoProxy := os.Getenv("FUNCTION_APP_NO_PROXY"); extraNoProxy != "" {
+		noProxy = append(noProxy, extraNoProxy)
+	}
+	noProxy = append(noProxy, getKeyVaultNoProxyHosts()...)
+	return &httpproxy.Config{
+		HTTPProxy:  proxyUrl,
+		HTTPSProxy: proxyUrl,
+		NoProxy:    strings.Join(noProxy, ","),
+	}
+}
+
+// getHttpClient returns the http client shared by all azure sdk clients and the telemetry,
+// without a configured proxy it falls back to the standard HTTP_PROXY / HTTPS_PROXY / NO_PROXY environment
+func getHttpClient() *http.Client {
+	httpClientOnce.Do(func() {
+		transport := http.DefaultTransport.(*http.Transport).Clone()
+		if config := getProxyConfig(); config != nil {
+			proxyFunc := config.ProxyFunc()
+			transport.Proxy = func(req *http.Request) (*url.URL, error) {
+				return proxyFunc(req.URL)
+			}
+		}
+		httpClient = &http.Client{Transport: transport}
+	})
+	return httpClient
+}
+
+// getClientOptions returns the options shared by the data plane clients (blob, key vault)
+func getClientOptions() policy.ClientOptions {
+	return policy.ClientOptions{
+		Cloud:     GetCloudEnvironment().Configuration,
+		Transport: getHttpClient(),
+	}
+}
+
+func getCredentialOptions() *azidentity.DefaultAzureCredentialOptions {
+	return &azidentity.DefaultAzureCredentialOptions{
+		ClientOptions: getClientOptions(),
+	}
+}
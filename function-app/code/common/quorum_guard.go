@@ -0,0 +1,182 @@
+package common
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"sort"
+
+	"github.com/weka/go-cloud-lib/lib/jrpc"
+	"github.com/weka/go-cloud-lib/lib/weka"
+	"github.com/weka/go-cloud-lib/logging"
+	"github.com/weka/go-cloud-lib/protocol"
+)
+
+// quorum veto reasons, returned as is to the callers of the destructive operations
+const (
+	QuorumVetoIoNotStarted         = "io_not_started"
+	QuorumVetoRebuilding           = "rebuilding"
+	QuorumVetoFailedDrives         = "failed_drives"
+	QuorumVetoProtectionExceeded   = "protection_exceeded"
+	QuorumVetoInsufficientBackends = "insufficient_backends"
+)
+
+// DestructiveOperation describes the backends an operation takes out of the cluster
+type DestructiveOperation struct {
+	Name string
+	// ips of the backends the operation takes down, their failed drives and down containers are expected
+	DownIps []string
+	// backends the operation removes from the cluster, in addition to DownIps
+	RemovedBackends int
+}
+
+// QuorumVeto is the machine-readable reason a destructive operation was refused
+type QuorumVeto struct {
+	Operation string `json:"operation"`
+	Reason    string `json:"reason"`
+	Message   string `json:"message"`
+}
+
+func (v *QuorumVeto) Error() string {
+	return fmt.Sprintf("%s refused (%s): %s", v.Operation, v.Reason, v.Message)
+}
+
+// subset of weka status we need in order to know whether data is being rebuilt
+type quorumStatus struct {
+	protocol.WekaStatus
+	Rebuild struct {
+		ProtectionState []struct {
+			MiB         float64 `json:"MiB"`
+			NumFailures int     `json:"numFailures"`
+		} `json:"protectionState"`
+	} `json:"rebuild"`
+}
+
+// hosts_list fields which are not part of weka.Host
+type quorumHost struct {
+	HostIp string `json:"host_ip"`
+	State  string `json:"state"`
+	Status string `json:"status"`
+	Mode   string `json:"mode"`
+}
+
+// CheckQuorum is the precondition of the scale down, upgrade and repair: the operation is vetoed when the cluster
+// is rebuilding or has failed drives, or when the backends left would not keep the data protection. a nil veto
+// allows the operation
+func CheckQuorum(ctx context.Context, jpool *jrpc.Pool, operation DestructiveOperation) (veto *QuorumVeto, err error) {
+	logger := logging.LoggerFromCtx(ctx)
+
+	veto = &QuorumVeto{Operation: operation.Name}
+	defer func() {
+		if veto != nil {
+			logger.Info().Msg(veto.Error())
+		}
+	}()
+
+	var status quorumStatus
+	err = jpool.Call(weka.JrpcStatus, struct{}{}, &status)
+	if err != nil {
+		logger.Error().Err(err).Send()
+		veto = nil
+		return
+	}
+	if status.IoStatus != "STARTED" {
+		veto.Reason = QuorumVetoIoNotStarted
+		veto.Message = fmt.Sprintf("cluster io status is %s", status.IoStatus)
+		return
+	}
+	for _, protectionState := range status.Rebuild.ProtectionState {
+		if protectionState.NumFailures > 0 && protectionState.MiB > 0 {
+			veto.Reason = QuorumVetoRebuilding
+			veto.Message = fmt.Sprintf("%.0f MiB are rebuilding with %d failures", protectionState.MiB, protectionState.NumFailures)
+			return
+		}
+	}
+
+	hosts := map[weka.HostId]quorumHost{}
+	err = jpool.Call(weka.JrpcHostList, struct{}{}, &hosts)
+	if err != nil {
+		logger.Error().Err(err).Send()
+		veto = nil
+		return
+	}
+	drives := weka.DriveListResponse{}
+	err = jpool.Call(weka.JrpcDrivesList, struct{}{}, &drives)
+	if err != nil {
+		logger.Error().Err(err).Send()
+		veto = nil
+		return
+	}
+
+	goingDown := make(map[string]bool, len(operation.DownIps))
+	for _, ip := range operation.DownIps {
+		goingDown[ip] = true
+	}
+
+	// a backend is up when all its active containers are up, deactivated containers are being removed
+	backendsUp := make(map[string]bool)
+	for _, host := range hosts {
+		if host.Mode == "client" || host.State != "ACTIVE" {
+			continue
+		}
+		if _, ok := backendsUp[host.HostIp]; !ok {
+			backendsUp[host.HostIp] = true
+		}
+		if host.Status != "UP" {
+			backendsUp[host.HostIp] = false
+		}
+	}
+
+	var failedDrives []string
+	for _, drive := range drives {
+		host, ok := hosts[drive.HostId]
+		if !ok || goingDown[host.HostIp] || !backendsUp[host.HostIp] {
+			continue
+		}
+		if drive.ShouldBeActive && drive.Status != "ACTIVE" && drive.Status != "PHASING_IN" {
+			failedDrives = append(failedDrives, fmt.Sprintf("%s (%s)", drive.Uuid, drive.Status))
+		}
+	}
+	if len(failedDrives) > 0 {
+		sort.Strings(failedDrives)
+		veto.Reason = QuorumVetoFailedDrives
+		veto.Message = fmt.Sprintf("drives of the remaining backends are not active: %v", failedDrives)
+		return
+	}
+
+	down := len(goingDown)
+	remaining := -operation.RemovedBackends
+	for ip, up := range backendsUp {
+		if goingDown[ip] {
+			continue
+		}
+		if up {
+			remaining++
+		} else {
+			down++
+		}
+	}
+	if down > status.StripeProtectionDrives {
+		veto.Reason = QuorumVetoProtectionExceeded
+		veto.Message = fmt.Sprintf("%d backends would be down, more than the protection level %d", down, status.StripeProtectionDrives)
+		return
+	}
+	required := status.StripeDataDrives + status.StripeProtectionDrives
+	if remaining < required {
+		veto.Reason = QuorumVetoInsufficientBackends
+		veto.Message = fmt.Sprintf("%d backends would be left, the stripe width %d+%d requires %d", remaining, status.StripeDataDrives, status.StripeProtectionDrives, required)
+		return
+	}
+
+	veto = nil
+	return
+}
+
+// MarshalQuorumVeto returns the veto json, empty for a nil veto
+func MarshalQuorumVeto(veto *QuorumVeto) string {
+	if veto == nil {
+		return ""
+	}
+	data, _ := json.Marshal(veto)
+	return string(data)
+}
@@ -0,0 +1,93 @@
+package common
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/Azure/azure-sdk-for-go/sdk/azcore"
+	"github.com/weka/go-cloud-lib/logging"
+)
+
+// the unhealthy backends are tracked in their own blob next to the state, so a backend is replaced only
+// after it was seen unhealthy for the whole grace period, across invocations
+const repairsBlobName = "repairs"
+
+// repaired instances history kept in the blob
+const repairsHistorySize = 50
+
+type UnhealthyInstance struct {
+	Ip          string    `json:"ip"`
+	Reason      string    `json:"reason"`
+	FirstSeenAt time.Time `json:"first_seen_at"`
+}
+
+type RepairedInstance struct {
+	VmName     string    `json:"vm_name"`
+	Ip         string    `json:"ip"`
+	Reason     string    `json:"reason"`
+	RepairedAt time.Time `json:"repaired_at"`
+}
+
+type Repairs struct {
+	// unhealthy backends by vm name
+	Unhealthy map[string]UnhealthyInstance `json:"unhealthy"`
+	Repaired  []RepairedInstance           `json:"repaired"`
+}
+
+func readRepairs(ctx context.Context, stateStorageName, stateContainerName string) (repairs Repairs, etag *azcore.ETag, err error) {
+	logger := logging.LoggerFromCtx(ctx)
+
+	data, etag, err := readBlobWithETag(ctx, stateStorageName, stateContainerName, repairsBlobName, true)
+	if err != nil {
+		return
+	}
+	if len(data) > 0 {
+		err = json.Unmarshal(data, &repairs)
+		if err != nil {
+			logger.Error().Err(err).Send()
+			return
+		}
+	}
+	if repairs.Unhealthy == nil {
+		repairs.Unhealthy = make(map[string]UnhealthyInstance)
+	}
+	return
+}
+
+// UpdateRepairs applies update on the current repairs with the same conflict handling as UpdateState
+func UpdateRepairs(ctx context.Context, stateStorageName, stateContainerName string, update func(repairs *Repairs) error) (repairs Repairs, err error) {
+	logger := logging.LoggerFromCtx(ctx)
+
+	for attempt := 1; attempt <= stateUpdateMaxAttempts; attempt++ {
+		var etag *azcore.ETag
+		repairs, etag, err = readRepairs(ctx, stateStorageName, stateContainerName)
+		if err != nil {
+			return
+		}
+		err = update(&repairs)
+		if err != nil {
+			return
+		}
+		if len(repairs.Repaired) > repairsHistorySize {
+			repairs.Repaired = repairs.Repaired[len(repairs.Repaired)-repairsHistorySize:]
+		}
+
+		var data []byte
+		data, err = json.Marshal(repairs)
+		if err != nil {
+			logger.Error().Err(err).Send()
+			return
+		}
+
+		err = writeBlobIfMatch(ctx, stateStorageName, stateContainerName, repairsBlobName, data, etag)
+		if err == nil || !isBlobWriteConflict(err) {
+			return
+		}
+		time.Sleep(getBlobUpdateRetryDelay(attempt))
+	}
+	err = fmt.Errorf("failed to update repairs after %d attempts: %w", stateUpdateMaxAttempts, err)
+	logger.Error().Err(err).Send()
+	return
+}
@@ -0,0 +1,64 @@
+package common
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+
+	"github.com/weka/go-cloud-lib/lib/jrpc"
+	"golang.org/x/oauth2"
+)
+
+// Response is the body of the functions called by operators and provisioners, the scripts returned to the
+// instances, the bodies passed between the logic app steps and the metrics keep their raw format
+type Response struct {
+	Code    int         `json:"code"`
+	Message string      `json:"message"`
+	Data    interface{} `json:"data,omitempty"`
+}
+
+// WriteResponse returns the response through the "res" http output binding, the status code is the one
+// of the http response to the caller, the functions host itself always gets a 200 from the custom handler
+func WriteResponse(w http.ResponseWriter, statusCode int, message string, data interface{}) {
+	resData := map[string]interface{}{
+		"statusCode": statusCode,
+		"headers":    map[string]string{"Content-Type": "application/json"},
+		"body":       Response{Code: statusCode, Message: message, Data: data},
+	}
+	invokeResponse := InvokeResponse{Outputs: map[string]interface{}{"res": resData}, Logs: nil, ReturnValue: nil}
+
+	responseJson, _ := json.Marshal(invokeResponse)
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(responseJson)
+}
+
+func WriteErrorResponse(w http.ResponseWriter, statusCode int, err error) {
+	WriteResponse(w, statusCode, err.Error(), nil)
+}
+
+// GetErrorStatusCode returns 401 when the weka credentials of the functions were rejected, 500 otherwise
+func GetErrorStatusCode(err error) int {
+	var retrieveErr *oauth2.RetrieveError
+	if errors.Is(err, jrpc.ErrNoCredentials) || errors.As(err, &retrieveErr) {
+		return http.StatusUnauthorized
+	}
+	return http.StatusInternalServerError
+}
+
+// ParseInvokeRequest returns the http trigger request data of the custom handler request
+func ParseInvokeRequest(r *http.Request) (reqData map[string]interface{}, err error) {
+	var invokeRequest InvokeRequest
+	err = json.NewDecoder(r.Body).Decode(&invokeRequest)
+	if err != nil {
+		return
+	}
+	err = json.Unmarshal(invokeRequest.Data["req"], &reqData)
+	return
+}
+
+// GetRequestBody returns the raw body of the http trigger request, empty when there is none
+func GetRequestBody(reqData map[string]interface{}) string {
+	body, _ := reqData["Body"].(string)
+	return body
+}
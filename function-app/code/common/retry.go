@@ -0,0 +1,57 @@
+package common
+
+import (
+	"net/http"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/Azure/azure-sdk-for-go/sdk/azcore/arm"
+	"github.com/Azure/azure-sdk-for-go/sdk/azcore/policy"
+)
+
+// management plane calls are retried by the sdk retry policy, which uses exponential backoff with jitter,
+// the sdk defaults (3 retries) are too short for ARM throttling during large deployments
+const (
+	defaultAzureApiMaxRetries    = 8
+	defaultAzureApiRetryDelay    = 4 * time.Second
+	defaultAzureApiMaxRetryDelay = 2 * time.Minute
+)
+
+func getEnvDuration(name string, defaultValue time.Duration) time.Duration {
+	value, err := time.ParseDuration(os.Getenv(name))
+	if err != nil || value <= 0 {
+		return defaultValue
+	}
+	return value
+}
+
+// getArmClientOptions returns the options used by all azure management clients,
+// retries are configured by AZURE_API_MAX_RETRIES, AZURE_API_RETRY_DELAY and AZURE_API_MAX_RETRY_DELAY,
+// requests go through the function app proxy when one is configured, to the cloud set by AZURE_ENVIRONMENT
+func getArmClientOptions() *arm.ClientOptions {
+	maxRetries, err := strconv.Atoi(os.Getenv("AZURE_API_MAX_RETRIES"))
+	if err != nil || maxRetries <= 0 {
+		maxRetries = defaultAzureApiMaxRetries
+	}
+
+	return &arm.ClientOptions{
+		ClientOptions: policy.ClientOptions{
+			Cloud:     GetCloudEnvironment().Configuration,
+			Transport: getHttpClient(),
+			Retry: policy.RetryOptions{
+				MaxRetries:    int32(maxRetries),
+				RetryDelay:    getEnvDuration("AZURE_API_RETRY_DELAY", defaultAzureApiRetryDelay),
+				MaxRetryDelay: getEnvDuration("AZURE_API_MAX_RETRY_DELAY", defaultAzureApiMaxRetryDelay),
+				StatusCodes: []int{
+					http.StatusRequestTimeout,
+					http.StatusTooManyRequests,
+					http.StatusInternalServerError,
+					http.StatusBadGateway,
+					http.StatusServiceUnavailable,
+					http.StatusGatewayTimeout,
+				},
+			},
+		},
+	}
+}
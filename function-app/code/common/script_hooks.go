@@ -0,0 +1,69 @@
+package common
+
+import (
+	"context"
+	"encoding/base64"
+	"fmt"
+	"strings"
+
+	"github.com/lithammer/dedent"
+	"github.com/weka/go-cloud-lib/logging"
+)
+
+// custom bash snippets the backends run, they are set by <hook>_SCRIPT (base64) or <hook>_SCRIPT_BLOB, a blob of
+// the state container
+const (
+	// runs on each backend before weka is installed, on the backends of a new cluster and on the joining ones
+	ScriptHookPreClusterize = "PRE_CLUSTERIZE"
+	// runs once the backend is part of the cluster: on the clusterizing backend at the end of the clusterization,
+	// and on each joining backend once it joined
+	ScriptHookPostClusterize = "POST_CLUSTERIZE"
+)
+
+// GetScriptHook returns the snippet of the hook, empty when the hook is not set
+func GetScriptHook(ctx context.Context, stateStorageName, stateContainerName, hook string) (snippet string, err error) {
+	logger := logging.LoggerFromCtx(ctx)
+
+	if encoded := Getenv(ctx, hook+"_SCRIPT"); encoded != "" {
+		var decoded []byte
+		decoded, err = base64.StdEncoding.DecodeString(encoded)
+		if err != nil {
+			err = fmt.Errorf("failed to decode %s_SCRIPT: %w", hook, err)
+			logger.Error().Err(err).Send()
+			return
+		}
+		snippet = string(decoded)
+		return
+	}
+	if blobName := Getenv(ctx, hook+"_SCRIPT_BLOB"); blobName != "" {
+		var data []byte
+		data, err = ReadBlobObject(ctx, stateStorageName, stateContainerName, blobName)
+		if err != nil {
+			err = fmt.Errorf("failed to read the %s script blob %s: %w", hook, blobName, err)
+			logger.Error().Err(err).Send()
+			return
+		}
+		snippet = string(data)
+	}
+	return
+}
+
+// GetScriptHookScript runs the snippet of the hook as a separate script, its failure is reported and fails the
+// script it is embedded in. It supposes 'report' is already defined
+func GetScriptHookScript(hook, snippet string) string {
+	if snippet == "" {
+		return ""
+	}
+	template := `
+	# %[1]s hook
+	cat >/tmp/weka_%[1]s_hook.sh <<'WEKA_HOOK_EOF'
+	%[2]s
+	WEKA_HOOK_EOF
+	report "{\"hostname\": \"$HOSTNAME\", \"type\": \"progress\", \"message\": \"Running the %[1]s hook\"}"
+	if ! bash /tmp/weka_%[1]s_hook.sh; then
+		report "{\"hostname\": \"$HOSTNAME\", \"type\": \"error\", \"message\": \"The %[1]s hook failed\"}"
+		exit 1
+	fi
+	`
+	return fmt.Sprintf(dedent.Dedent(template), strings.ToLower(hook), strings.TrimRight(snippet, "\n"))
+}
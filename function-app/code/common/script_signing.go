@@ -0,0 +1,119 @@
+package common
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/Azure/azure-sdk-for-go/sdk/azcore/policy"
+	"github.com/Azure/azure-sdk-for-go/sdk/azidentity"
+	"github.com/weka/go-cloud-lib/logging"
+)
+
+// the scripts returned to the vms are signed with a key vault rsa key when SCRIPT_SIGNING_KEY_NAME is set, the vms
+// get the public key in their custom data and run only the scripts whose signature is verified
+const (
+	ScriptSignatureHeader = "X-Weka-Script-Signature"
+	// installed by the vms custom data, takes the script file and the base64 signature
+	ScriptVerifierPath     = "/usr/sbin/weka-verify-script"
+	keyVaultApiVersion     = "7.4"
+	scriptSigningTimeout   = 30 * time.Second
+	scriptSigningAlgorithm = "RS256"
+)
+
+func GetScriptSigningKeyName(ctx context.Context) string {
+	return Getenv(ctx, "SCRIPT_SIGNING_KEY_NAME")
+}
+
+func IsScriptSigningEnabled(ctx context.Context) bool {
+	return GetScriptSigningKeyName(ctx) != ""
+}
+
+// SignScript returns the base64 RS256 signature of the script, the sha256 digest is signed by the key vault key so
+// the private key never leaves the key vault
+func SignScript(ctx context.Context, keyVaultUri, script string) (signature string, err error) {
+	logger := logging.LoggerFromCtx(ctx)
+
+	credential, err := azidentity.NewDefaultAzureCredential(getCredentialOptions())
+	if err != nil {
+		logger.Error().Err(err).Send()
+		return
+	}
+	token, err := credential.GetToken(ctx, policy.TokenRequestOptions{Scopes: []string{GetCloudEnvironment().KeyVaultScope}})
+	if err != nil {
+		logger.Error().Err(err).Send()
+		return
+	}
+
+	digest := sha256.Sum256([]byte(script))
+	body, err := json.Marshal(map[string]string{
+		"alg":   scriptSigningAlgorithm,
+		"value": base64.RawURLEncoding.EncodeToString(digest[:]),
+	})
+	if err != nil {
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, scriptSigningTimeout)
+	defer cancel()
+	signUrl := fmt.Sprintf("%s/keys/%s/sign?api-version=%s", strings.TrimSuffix(GetKeyVaultEndpoint(keyVaultUri), "/"), GetScriptSigningKeyName(ctx), keyVaultApiVersion)
+	var resp *http.Response
+	err = withKeyVaultDnsRetry(ctx, keyVaultUri, func() (doErr error) {
+		req, doErr := http.NewRequestWithContext(ctx, http.MethodPost, signUrl, bytes.NewReader(body))
+		if doErr != nil {
+			return
+		}
+		req.Header.Set("Authorization", "Bearer "+token.Token)
+		req.Header.Set("Content-Type", "application/json")
+		resp, doErr = getHttpClient().Do(req)
+		return
+	})
+	if err != nil {
+		logger.Error().Err(err).Send()
+		return
+	}
+	defer resp.Body.Close()
+	data, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return
+	}
+	if resp.StatusCode != http.StatusOK {
+		err = fmt.Errorf("failed to sign the script with key %s, status: %s: %s", GetScriptSigningKeyName(ctx), resp.Status, string(data))
+		logger.Error().Err(err).Send()
+		return
+	}
+
+	var result struct {
+		Value string `json:"value"`
+	}
+	if err = json.Unmarshal(data, &result); err != nil {
+		return
+	}
+	rawSignature, err := base64.RawURLEncoding.DecodeString(strings.TrimRight(result.Value, "="))
+	if err != nil {
+		return
+	}
+	signature = base64.StdEncoding.EncodeToString(rawSignature)
+	return
+}
+
+// SetScriptSignatureHeader adds the signature header to the response of a function returning a script, a script
+// which can't be signed is returned without it and is rejected by the vm, which calls the function again
+func SetScriptSignatureHeader(ctx context.Context, keyVaultUri string, resData map[string]interface{}, script string) {
+	if !IsScriptSigningEnabled(ctx) {
+		return
+	}
+	signature, err := SignScript(ctx, keyVaultUri, script)
+	if err != nil {
+		logging.LoggerFromCtx(ctx).Error().Err(err).Msg("failed to sign the script")
+		return
+	}
+	resData["headers"] = map[string]string{ScriptSignatureHeader: signature}
+}
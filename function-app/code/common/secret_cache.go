@@ -0,0 +1,65 @@
+package common
+
+import (
+	"os"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// key vault secrets are cached by the function app instance, the key vault throttles (429) when every
+// invocation reads the secrets at scale
+const defaultKeyVaultCacheTtl = 5 * time.Minute
+
+type cachedSecret struct {
+	value     string
+	fetchedAt time.Time
+}
+
+var (
+	keyVaultCacheLock sync.Mutex
+	keyVaultCache     = make(map[string]cachedSecret)
+)
+
+// getKeyVaultCacheTtl returns the ttl configured by KEY_VAULT_CACHE_TTL_SECONDS, 0 disables the cache
+func getKeyVaultCacheTtl() time.Duration {
+	seconds, err := strconv.Atoi(os.Getenv("KEY_VAULT_CACHE_TTL_SECONDS"))
+	if err != nil || seconds < 0 {
+		return defaultKeyVaultCacheTtl
+	}
+	return time.Duration(seconds) * time.Second
+}
+
+func getKeyVaultCacheKey(keyVaultUri, secretName string) string {
+	return keyVaultUri + "|" + secretName
+}
+
+// getCachedKeyVaultValue returns the cached secret and whether it is still within the ttl
+func getCachedKeyVaultValue(keyVaultUri, secretName string) (value string, found, fresh bool) {
+	keyVaultCacheLock.Lock()
+	defer keyVaultCacheLock.Unlock()
+
+	secret, found := keyVaultCache[getKeyVaultCacheKey(keyVaultUri, secretName)]
+	if !found {
+		return
+	}
+	return secret.value, true, time.Since(secret.fetchedAt) < getKeyVaultCacheTtl()
+}
+
+func cacheKeyVaultValue(keyVaultUri, secretName, value string) {
+	if getKeyVaultCacheTtl() == 0 {
+		return
+	}
+	keyVaultCacheLock.Lock()
+	defer keyVaultCacheLock.Unlock()
+
+	keyVaultCache[getKeyVaultCacheKey(keyVaultUri, secretName)] = cachedSecret{value: value, fetchedAt: time.Now()}
+}
+
+// InvalidateKeyVaultValue drops the cached secret, so the next read gets the latest version from the key vault
+func InvalidateKeyVaultValue(keyVaultUri, secretName string) {
+	keyVaultCacheLock.Lock()
+	defer keyVaultCacheLock.Unlock()
+
+	delete(keyVaultCache, getKeyVaultCacheKey(keyVaultUri, secretName))
+}
@@ -0,0 +1,171 @@
+package common
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/Azure/azure-sdk-for-go/sdk/azcore/to"
+	"github.com/Azure/azure-sdk-for-go/sdk/azidentity"
+	"github.com/Azure/azure-sdk-for-go/sdk/storage/azblob"
+	"github.com/Azure/azure-sdk-for-go/sdk/storage/azblob/bloberror"
+	"github.com/weka/go-cloud-lib/logging"
+	"github.com/weka/go-cloud-lib/protocol"
+)
+
+const (
+	// the state snapshots are kept in the state container next to the state blob
+	stateBackupPrefix           = "state-backups/"
+	stateBackupTimeFormat       = "20060102T150405Z"
+	defaultStateBackupRetention = 48
+)
+
+var ErrStateBackupNotFound = errors.New("state backup not found")
+
+type StateBackup struct {
+	Name      string    `json:"name"`
+	CreatedAt time.Time `json:"created_at"`
+	Size      int64     `json:"size"`
+}
+
+// getStateBackupRetention returns the number of snapshots kept, configured by STATE_BACKUP_RETENTION
+func getStateBackupRetention(ctx context.Context) int {
+	retention, err := strconv.Atoi(Getenv(ctx, "STATE_BACKUP_RETENTION"))
+	if err != nil || retention < 1 {
+		return defaultStateBackupRetention
+	}
+	return retention
+}
+
+// ListStateBackups returns the state snapshots, the latest first
+func ListStateBackups(ctx context.Context, stateStorageName, stateContainerName string) (backups []StateBackup, err error) {
+	logger := logging.LoggerFromCtx(ctx)
+
+	credential, err := azidentity.NewDefaultAzureCredential(getCredentialOptions())
+	if err != nil {
+		logger.Error().Err(err).Send()
+		return
+	}
+
+	blobClient, err := azblob.NewClient(GetBlobUrl(stateStorageName), credential, &azblob.ClientOptions{ClientOptions: getClientOptions()})
+	if err != nil {
+		logger.Error().Err(err).Send()
+		return
+	}
+
+	pager := blobClient.NewListBlobsFlatPager(stateContainerName, &azblob.ListBlobsFlatOptions{Prefix: to.Ptr(stateBackupPrefix)})
+	for pager.More() {
+		page, pageErr := pager.NextPage(ctx)
+		if pageErr != nil {
+			err = pageErr
+			logger.Error().Err(err).Send()
+			return
+		}
+		for _, item := range page.Segment.BlobItems {
+			backup := StateBackup{Name: strings.TrimPrefix(*item.Name, stateBackupPrefix)}
+			if item.Properties != nil && item.Properties.CreationTime != nil {
+				backup.CreatedAt = *item.Properties.CreationTime
+			}
+			if item.Properties != nil && item.Properties.ContentLength != nil {
+				backup.Size = *item.Properties.ContentLength
+			}
+			backups = append(backups, backup)
+		}
+	}
+	// the names are timestamps, they sort chronologically
+	sort.Slice(backups, func(i, j int) bool {
+		return backups[i].Name > backups[j].Name
+	})
+	return
+}
+
+// BackupState writes a snapshot of the state blob unless it did not change since the latest snapshot, the oldest
+// snapshots beyond the retention are deleted. A nil backup means the state was not changed
+func BackupState(ctx context.Context, stateStorageName, stateContainerName string) (backup *StateBackup, err error) {
+	logger := logging.LoggerFromCtx(ctx)
+
+	state, _, err := readBlobWithETag(ctx, stateStorageName, stateContainerName, "state", false)
+	if err != nil {
+		return
+	}
+	backups, err := ListStateBackups(ctx, stateStorageName, stateContainerName)
+	if err != nil {
+		return
+	}
+
+	if len(backups) > 0 {
+		latest, _, readErr := readBlobWithETag(ctx, stateStorageName, stateContainerName, stateBackupPrefix+backups[0].Name, true)
+		if readErr != nil {
+			err = readErr
+			return
+		}
+		if bytes.Equal(latest, state) {
+			logger.Info().Msgf("state was not changed since backup %s", backups[0].Name)
+			return
+		}
+	}
+
+	now := time.Now().UTC()
+	name := now.Format(stateBackupTimeFormat)
+	err = writeBlobIfMatch(ctx, stateStorageName, stateContainerName, stateBackupPrefix+name, state, nil)
+	if err != nil {
+		logger.Error().Err(err).Msgf("failed to write state backup %s", name)
+		return
+	}
+	backup = &StateBackup{Name: name, CreatedAt: now, Size: int64(len(state))}
+	logger.Info().Msgf("state backed up to %s", name)
+
+	// the new backup is not listed yet
+	retention := getStateBackupRetention(ctx)
+	for i := retention - 1; i < len(backups); i++ {
+		if deleteErr := DeleteBlobObject(ctx, stateStorageName, stateContainerName, stateBackupPrefix+backups[i].Name); deleteErr != nil {
+			logger.Error().Err(deleteErr).Msgf("failed to delete state backup %s", backups[i].Name)
+		}
+	}
+	return
+}
+
+// RestoreState replaces the state blob by the snapshot, the current state is backed up first so the restore
+// can be rolled back too. It fails if the state is changed while it is restored
+func RestoreState(ctx context.Context, stateStorageName, stateContainerName, name string) (state protocol.ClusterState, err error) {
+	logger := logging.LoggerFromCtx(ctx)
+
+	data, etag, err := readBlobWithETag(ctx, stateStorageName, stateContainerName, stateBackupPrefix+name, true)
+	if err != nil {
+		return
+	}
+	if etag == nil {
+		err = fmt.Errorf("%w: %s", ErrStateBackupNotFound, name)
+		return
+	}
+	if err = json.Unmarshal(data, &state); err != nil {
+		err = fmt.Errorf("state backup %s is not a valid state: %w", name, err)
+		logger.Error().Err(err).Send()
+		return
+	}
+
+	_, stateEtag, err := readBlobWithETag(ctx, stateStorageName, stateContainerName, "state", false)
+	if err != nil {
+		return
+	}
+	if _, err = BackupState(ctx, stateStorageName, stateContainerName); err != nil {
+		return
+	}
+
+	err = writeBlobIfMatch(ctx, stateStorageName, stateContainerName, "state", data, stateEtag)
+	if isBlobWriteConflict(err) || bloberror.HasCode(err, bloberror.BlobNotFound) {
+		err = fmt.Errorf("state was changed during the restore of %s, retry: %w", name, err)
+	}
+	if err != nil {
+		logger.Error().Err(err).Send()
+		return
+	}
+	logger.Info().Msgf("state restored from backup %s", name)
+	return
+}
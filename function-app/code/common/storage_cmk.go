@@ -0,0 +1,234 @@
+package common
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/Azure/azure-sdk-for-go/sdk/azcore"
+	"github.com/Azure/azure-sdk-for-go/sdk/azcore/arm"
+	"github.com/Azure/azure-sdk-for-go/sdk/azcore/to"
+	"github.com/Azure/azure-sdk-for-go/sdk/azidentity"
+	"github.com/Azure/azure-sdk-for-go/sdk/resourcemanager/authorization/armauthorization/v2"
+	"github.com/Azure/azure-sdk-for-go/sdk/resourcemanager/keyvault/armkeyvault"
+	"github.com/Azure/azure-sdk-for-go/sdk/resourcemanager/storage/armstorage"
+	"github.com/google/uuid"
+	"github.com/weka/go-cloud-lib/logging"
+)
+
+// StorageCustomerManagedKey encrypts a storage account with a key vault key instead of a microsoft managed key
+type StorageCustomerManagedKey struct {
+	KeyVaultId string `json:"key_vault_id"`
+	KeyName    string `json:"key_name"`
+	// the latest key version is used, and followed on key rotation, when empty
+	KeyVersion string `json:"key_version"`
+	// the storage account system assigned identity accesses the key when empty
+	UserAssignedIdentityId          string `json:"user_assigned_identity_id"`
+	UserAssignedIdentityPrincipalId string `json:"user_assigned_identity_principal_id"`
+}
+
+// the key vault access granted to the storage account identity takes a while to propagate
+const (
+	storageEncryptionMaxAttempts = 10
+	storageEncryptionRetryDelay  = 30 * time.Second
+)
+
+func ValidateStorageCustomerManagedKey(cmk StorageCustomerManagedKey) error {
+	if cmk.KeyVaultId == "" || cmk.KeyName == "" {
+		return fmt.Errorf("customer managed key requires key_vault_id and key_name")
+	}
+	if _, err := arm.ParseResourceID(cmk.KeyVaultId); err != nil {
+		return fmt.Errorf("invalid customer managed key vault id %s: %w", cmk.KeyVaultId, err)
+	}
+	if cmk.UserAssignedIdentityId != "" && cmk.UserAssignedIdentityPrincipalId == "" {
+		return fmt.Errorf("customer managed key user assigned identity requires user_assigned_identity_principal_id")
+	}
+	return nil
+}
+
+func getStorageAccountIdentity(cmk *StorageCustomerManagedKey) *armstorage.Identity {
+	if cmk == nil {
+		return nil
+	}
+	if cmk.UserAssignedIdentityId != "" {
+		return &armstorage.Identity{
+			Type: to.Ptr(armstorage.IdentityTypeUserAssigned),
+			UserAssignedIdentities: map[string]*armstorage.UserAssignedIdentity{
+				cmk.UserAssignedIdentityId: {},
+			},
+		}
+	}
+	return &armstorage.Identity{Type: to.Ptr(armstorage.IdentityTypeSystemAssigned)}
+}
+
+// grantKeyVaultCryptoAccess lets the principal wrap and unwrap keys of the vault, rbac vaults get the
+// "Key Vault Crypto Service Encryption User" role and access policy vaults get an access policy
+func grantKeyVaultCryptoAccess(ctx context.Context, subscriptionId string, vault armkeyvault.Vault, principalId, tenantId string) (err error) {
+	logger := logging.LoggerFromCtx(ctx)
+	logger.Info().Msgf("Granting principal %s crypto access to key vault %s", principalId, *vault.Name)
+
+	credential, err := azidentity.NewDefaultAzureCredential(getCredentialOptions())
+	if err != nil {
+		logger.Error().Err(err).Send()
+		return
+	}
+
+	if vault.Properties.EnableRbacAuthorization != nil && *vault.Properties.EnableRbacAuthorization {
+		var roleDefinition *armauthorization.RoleDefinition
+		roleDefinition, err = GetRoleDefinitionByRoleName(ctx, "Key Vault Crypto Service Encryption User", *vault.ID)
+		if err != nil {
+			err = fmt.Errorf("cannot get the role definition: %v", err)
+			logger.Error().Err(err).Send()
+			return
+		}
+
+		var client *armauthorization.RoleAssignmentsClient
+		client, err = armauthorization.NewRoleAssignmentsClient(subscriptionId, credential, getArmClientOptions())
+		if err != nil {
+			logger.Error().Err(err).Send()
+			return
+		}
+		_, err = client.Create(
+			ctx,
+			*vault.ID,
+			uuid.New().String(),
+			armauthorization.RoleAssignmentCreateParameters{
+				Properties: &armauthorization.RoleAssignmentProperties{
+					RoleDefinitionID: roleDefinition.ID,
+					PrincipalID:      &principalId,
+				},
+			},
+			nil,
+		)
+		if azerr, ok := err.(*azcore.ResponseError); ok && azerr.ErrorCode == "RoleAssignmentExists" {
+			err = nil
+		}
+		if err != nil {
+			err = fmt.Errorf("cannot create the role assignment: %v", err)
+			logger.Error().Err(err).Send()
+		}
+		return
+	}
+
+	keyVaultResourceId, err := arm.ParseResourceID(*vault.ID)
+	if err != nil {
+		logger.Error().Err(err).Send()
+		return
+	}
+	client, err := armkeyvault.NewVaultsClient(subscriptionId, credential, getArmClientOptions())
+	if err != nil {
+		logger.Error().Err(err).Send()
+		return
+	}
+	_, err = client.UpdateAccessPolicy(ctx, keyVaultResourceId.ResourceGroupName, keyVaultResourceId.Name, armkeyvault.AccessPolicyUpdateKindAdd, armkeyvault.VaultAccessPolicyParameters{
+		Properties: &armkeyvault.VaultAccessPolicyProperties{
+			AccessPolicies: []*armkeyvault.AccessPolicyEntry{
+				{
+					TenantID: &tenantId,
+					ObjectID: &principalId,
+					Permissions: &armkeyvault.Permissions{
+						Keys: []*armkeyvault.KeyPermissions{
+							to.Ptr(armkeyvault.KeyPermissionsGet),
+							to.Ptr(armkeyvault.KeyPermissionsWrapKey),
+							to.Ptr(armkeyvault.KeyPermissionsUnwrapKey),
+						},
+					},
+				},
+			},
+		},
+	}, nil)
+	if err != nil {
+		logger.Error().Err(err).Send()
+	}
+	return
+}
+
+// configureStorageCustomerManagedKey grants the storage account identity access to the key and switches the
+// account encryption to it, the account must have been created with the identity of getStorageAccountIdentity
+func configureStorageCustomerManagedKey(ctx context.Context, subscriptionId, resourceGroupName, storageAccountName string, cmk StorageCustomerManagedKey) (err error) {
+	logger := logging.LoggerFromCtx(ctx)
+	logger.Info().Msgf("Configuring storage account %s encryption with key %s", storageAccountName, cmk.KeyName)
+
+	keyVaultResourceId, err := arm.ParseResourceID(cmk.KeyVaultId)
+	if err != nil {
+		logger.Error().Err(err).Send()
+		return
+	}
+
+	credential, err := azidentity.NewDefaultAzureCredential(getCredentialOptions())
+	if err != nil {
+		logger.Error().Err(err).Send()
+		return
+	}
+
+	vaultsClient, err := armkeyvault.NewVaultsClient(keyVaultResourceId.SubscriptionID, credential, getArmClientOptions())
+	if err != nil {
+		logger.Error().Err(err).Send()
+		return
+	}
+	vault, err := vaultsClient.Get(ctx, keyVaultResourceId.ResourceGroupName, keyVaultResourceId.Name, nil)
+	if err != nil {
+		logger.Error().Err(err).Send()
+		return
+	}
+
+	accountsClient, err := armstorage.NewAccountsClient(subscriptionId, credential, getArmClientOptions())
+	if err != nil {
+		logger.Error().Err(err).Send()
+		return
+	}
+	account, err := accountsClient.GetProperties(ctx, resourceGroupName, storageAccountName, nil)
+	if err != nil {
+		logger.Error().Err(err).Send()
+		return
+	}
+
+	principalId := cmk.UserAssignedIdentityPrincipalId
+	if cmk.UserAssignedIdentityId == "" {
+		if account.Identity == nil || account.Identity.PrincipalID == nil {
+			err = fmt.Errorf("storage account %s has no system assigned identity", storageAccountName)
+			logger.Error().Err(err).Send()
+			return
+		}
+		principalId = *account.Identity.PrincipalID
+	}
+	err = grantKeyVaultCryptoAccess(ctx, keyVaultResourceId.SubscriptionID, vault.Vault, principalId, *vault.Properties.TenantID)
+	if err != nil {
+		return
+	}
+
+	encryption := &armstorage.Encryption{
+		KeySource: to.Ptr(armstorage.KeySourceMicrosoftKeyvault),
+		KeyVaultProperties: &armstorage.KeyVaultProperties{
+			KeyName:     &cmk.KeyName,
+			KeyVaultURI: vault.Properties.VaultURI,
+			KeyVersion:  &cmk.KeyVersion,
+		},
+	}
+	if cmk.UserAssignedIdentityId != "" {
+		encryption.EncryptionIdentity = &armstorage.EncryptionIdentity{
+			EncryptionUserAssignedIdentity: &cmk.UserAssignedIdentityId,
+		}
+	}
+
+	for attempt := 1; attempt <= storageEncryptionMaxAttempts; attempt++ {
+		_, err = accountsClient.Update(ctx, resourceGroupName, storageAccountName, armstorage.AccountUpdateParameters{
+			Properties: &armstorage.AccountPropertiesUpdateParameters{
+				Encryption: encryption,
+			},
+		}, nil)
+		if err == nil {
+			return
+		}
+		if azerr, ok := err.(*azcore.ResponseError); !ok || !strings.Contains(azerr.ErrorCode, "KeyVault") {
+			logger.Error().Err(err).Send()
+			return
+		}
+		logger.Info().Msgf("storage account %s key access is not effective yet, will retry in %s: %v", storageAccountName, storageEncryptionRetryDelay, err)
+		time.Sleep(storageEncryptionRetryDelay)
+	}
+	err = fmt.Errorf("failed to configure storage account %s customer managed key: %w", storageAccountName, err)
+	logger.Error().Err(err).Send()
+	return
+}
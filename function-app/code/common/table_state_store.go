@@ -0,0 +1,589 @@
+package common
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Azure/azure-sdk-for-go/sdk/azcore"
+	"github.com/Azure/azure-sdk-for-go/sdk/azcore/runtime"
+	"github.com/Azure/azure-sdk-for-go/sdk/azcore/to"
+	"github.com/Azure/azure-sdk-for-go/sdk/azidentity"
+	"github.com/Azure/azure-sdk-for-go/sdk/data/aztables"
+	"github.com/weka/go-cloud-lib/logging"
+	"github.com/weka/go-cloud-lib/protocol"
+)
+
+// the state backends, STATE_BACKEND selects the one the functions use
+const (
+	StateBackendBlob  = "blob"
+	StateBackendTable = "table"
+)
+
+// the table state store keeps the state in rows of the STATE_TABLE_NAME table of the state storage account, the
+// partition of a cluster is its state container. The instances and the reports of each host are rows of their own,
+// so the vms reporting at once don't conflict and an update writes only the rows it changed
+const (
+	tableBatchMaxOperations = 100
+	tableRequestTimeout     = 30 * time.Second
+
+	clusterRowKey     = "cluster"
+	instanceRowPrefix = "instance_"
+	reportRowPrefix   = "report_"
+)
+
+// errTableWriteConflict is returned when a row of the transaction was changed by another writer since it was read
+var errTableWriteConflict = errors.New("state rows were changed by another writer")
+
+// the error codes of the actions failing because their row was changed, inserted or deleted by another writer
+var tableWriteConflictCodes = map[string]bool{
+	string(aztables.UpdateConditionNotSatisfied): true,
+	string(aztables.EntityAlreadyExists):         true,
+	string(aztables.ResourceNotFound):            true,
+}
+
+var (
+	tableCredentialOnce sync.Once
+	tableCredential     *azidentity.DefaultAzureCredential
+	tableCredentialErr  error
+)
+
+// GetStateStore returns the state store of the STATE_BACKEND setting, the state blob by default
+func GetStateStore(ctx context.Context) StateStore {
+	if Getenv(ctx, "STATE_BACKEND") == StateBackendTable {
+		return TableStateStore{TableName: Getenv(ctx, "STATE_TABLE_NAME")}
+	}
+	return BlobStateStore{}
+}
+
+// TableStateStore keeps the state in table rows, every update is a single entity group transaction conditioned on
+// the etags of the rows it changes. The instance rows are changed along with the cluster row, so the instances are
+// still added one at a time, the report rows only conflict with the reports of the same host
+type TableStateStore struct {
+	TableName string
+}
+
+// stateTableEntity is the union of the cluster, instance and report rows properties
+type stateTableEntity struct {
+	Etag         string `json:"odata.etag"`
+	PartitionKey string
+	RowKey       string
+
+	// cluster row, the instance rows of another generation were cleared
+	InitialSize         int
+	DesiredSize         int
+	Clusterized         bool
+	InstancesGeneration int
+
+	// instance rows
+	Instance   string
+	Position   int
+	Generation int
+
+	// report rows, the lists are json arrays
+	Host     string
+	Progress string
+	Errors   string
+	Debug    string
+}
+
+type tableOperation struct {
+	Action aztables.TransactionType
+	RowKey string
+	// the etag the row was read with, "*" matches any row
+	IfMatch string
+	Entity  map[string]interface{}
+}
+
+// tableStateSnapshot is the state with the rows it was read from
+type tableStateSnapshot struct {
+	state       protocol.ClusterState
+	cluster     *stateTableEntity
+	instances   map[string]stateTableEntity
+	reports     map[string]stateTableEntity
+	staleRows   map[string]stateTableEntity
+	maxPosition int
+}
+
+func getTableServiceUrl(storageName string) string {
+	return fmt.Sprintf("https://%s.table.%s/", storageName, GetCloudEnvironment().StorageSuffix)
+}
+
+// table keys can't have some characters, the vm and host names are encoded
+func encodeTableKey(prefix, name string) string {
+	return prefix + base64.RawURLEncoding.EncodeToString([]byte(name))
+}
+
+func getTableClient(storageName, tableName string) (*aztables.Client, error) {
+	tableCredentialOnce.Do(func() {
+		tableCredential, tableCredentialErr = azidentity.NewDefaultAzureCredential(getCredentialOptions())
+	})
+	if tableCredentialErr != nil {
+		return nil, tableCredentialErr
+	}
+	serviceClient, err := aztables.NewServiceClient(getTableServiceUrl(storageName), tableCredential, &aztables.ClientOptions{ClientOptions: getClientOptions()})
+	if err != nil {
+		return nil, err
+	}
+	return serviceClient.NewClient(tableName), nil
+}
+
+type azureTableClient struct{}
+
+func (azureTableClient) ListPartition(ctx context.Context, storageName, tableName, partitionKey string) (entities [][]byte, err error) {
+	client, err := getTableClient(storageName, tableName)
+	if err != nil {
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, tableRequestTimeout)
+	defer cancel()
+
+	pager := client.NewListEntitiesPager(&aztables.ListEntitiesOptions{
+		Filter: to.Ptr(fmt.Sprintf("PartitionKey eq '%s'", partitionKey)),
+	})
+	for pager.More() {
+		var page aztables.ListEntitiesResponse
+		page, err = pager.NextPage(ctx)
+		if err != nil {
+			return
+		}
+		entities = append(entities, page.Entities...)
+	}
+	return
+}
+
+func (azureTableClient) SubmitTransaction(ctx context.Context, storageName, tableName string, actions []aztables.TransactionAction) error {
+	client, err := getTableClient(storageName, tableName)
+	if err != nil {
+		return err
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, tableRequestTimeout)
+	defer cancel()
+
+	_, err = client.SubmitTransaction(ctx, actions, nil)
+	return err
+}
+
+// getTableErrorCode returns the error code of a table request, a rejected transaction is answered with the
+// response of its failed action, the error code is in its body
+func getTableErrorCode(responseErr *azcore.ResponseError) string {
+	if responseErr.ErrorCode != "" || responseErr.RawResponse == nil {
+		return responseErr.ErrorCode
+	}
+	payload, err := runtime.Payload(responseErr.RawResponse)
+	if err != nil {
+		return ""
+	}
+	start := bytes.IndexByte(payload, '{')
+	if start < 0 {
+		return ""
+	}
+	var body struct {
+		Error struct {
+			Code string `json:"code"`
+		} `json:"odata.error"`
+	}
+	if err = json.NewDecoder(bytes.NewReader(payload[start:])).Decode(&body); err != nil {
+		return ""
+	}
+	return body.Error.Code
+}
+
+// isTableWriteConflict is true when a transaction lost the race to another writer
+func isTableWriteConflict(err error) bool {
+	var responseErr *azcore.ResponseError
+	return errors.As(err, &responseErr) && tableWriteConflictCodes[getTableErrorCode(responseErr)]
+}
+
+// queryPartition returns all the rows of the cluster partition
+func (t TableStateStore) queryPartition(ctx context.Context, storageName, partitionKey string) (entities []stateTableEntity, err error) {
+	rows, err := ClientsFromCtx(ctx).Tables.ListPartition(ctx, storageName, t.TableName, partitionKey)
+	if err != nil {
+		err = fmt.Errorf("failed to query the state table %s: %w", t.TableName, err)
+		return
+	}
+	entities = make([]stateTableEntity, len(rows))
+	for i, row := range rows {
+		if err = json.Unmarshal(row, &entities[i]); err != nil {
+			return
+		}
+	}
+	return
+}
+
+// executeBatch runs the operations in an entity group transaction, errTableWriteConflict is returned when one of
+// the rows was changed, inserted or deleted by another writer
+func (t TableStateStore) executeBatch(ctx context.Context, storageName, partitionKey string, operations []tableOperation) error {
+	actions := make([]aztables.TransactionAction, 0, len(operations))
+	for _, operation := range operations {
+		entity := operation.Entity
+		if entity == nil {
+			entity = make(map[string]interface{})
+		}
+		entity["PartitionKey"] = partitionKey
+		entity["RowKey"] = operation.RowKey
+		data, err := json.Marshal(entity)
+		if err != nil {
+			return err
+		}
+		action := aztables.TransactionAction{ActionType: operation.Action, Entity: data}
+		if operation.IfMatch != "" {
+			action.IfMatch = to.Ptr(azcore.ETag(operation.IfMatch))
+		}
+		actions = append(actions, action)
+	}
+
+	err := ClientsFromCtx(ctx).Tables.SubmitTransaction(ctx, storageName, t.TableName, actions)
+	if isTableWriteConflict(err) {
+		return fmt.Errorf("%w: %v", errTableWriteConflict, err)
+	}
+	if err != nil {
+		return fmt.Errorf("state table transaction failed: %w", err)
+	}
+	return nil
+}
+
+// executeBatches runs the operations in transactions of the maximal size, they aren't atomic as a whole
+func (t TableStateStore) executeBatches(ctx context.Context, storageName, partitionKey string, operations []tableOperation) error {
+	for start := 0; start < len(operations); start += tableBatchMaxOperations {
+		end := start + tableBatchMaxOperations
+		if end > len(operations) {
+			end = len(operations)
+		}
+		if err := t.executeBatch(ctx, storageName, partitionKey, operations[start:end]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func decodeReportList(value string) (list []string) {
+	_ = json.Unmarshal([]byte(value), &list)
+	return
+}
+
+func encodeReportList(list []string) string {
+	if len(list) == 0 {
+		return ""
+	}
+	value, _ := json.Marshal(list)
+	return string(value)
+}
+
+func (t TableStateStore) readSnapshot(ctx context.Context, storageName, partitionKey string) (snapshot tableStateSnapshot, err error) {
+	entities, err := t.queryPartition(ctx, storageName, partitionKey)
+	if err != nil {
+		return
+	}
+
+	snapshot = tableStateSnapshot{
+		state: protocol.ClusterState{
+			Progress:  make(map[string][]string),
+			Errors:    make(map[string][]string),
+			Debug:     make(map[string][]string),
+			Instances: []string{},
+		},
+		instances: make(map[string]stateTableEntity),
+		reports:   make(map[string]stateTableEntity),
+		staleRows: make(map[string]stateTableEntity),
+	}
+	for i := range entities {
+		if entities[i].RowKey == clusterRowKey {
+			snapshot.cluster = &entities[i]
+		}
+	}
+	if snapshot.cluster == nil {
+		return
+	}
+	snapshot.state.InitialSize = snapshot.cluster.InitialSize
+	snapshot.state.DesiredSize = snapshot.cluster.DesiredSize
+	snapshot.state.Clusterized = snapshot.cluster.Clusterized
+
+	var instances []stateTableEntity
+	for _, entity := range entities {
+		switch {
+		case strings.HasPrefix(entity.RowKey, instanceRowPrefix) && entity.Generation == snapshot.cluster.InstancesGeneration:
+			snapshot.instances[entity.RowKey] = entity
+			instances = append(instances, entity)
+			if entity.Position > snapshot.maxPosition {
+				snapshot.maxPosition = entity.Position
+			}
+		case strings.HasPrefix(entity.RowKey, instanceRowPrefix):
+			snapshot.staleRows[entity.RowKey] = entity
+		case strings.HasPrefix(entity.RowKey, reportRowPrefix):
+			snapshot.reports[entity.RowKey] = entity
+			if list := decodeReportList(entity.Progress); len(list) > 0 {
+				snapshot.state.Progress[entity.Host] = list
+			}
+			if list := decodeReportList(entity.Errors); len(list) > 0 {
+				snapshot.state.Errors[entity.Host] = list
+			}
+			if list := decodeReportList(entity.Debug); len(list) > 0 {
+				snapshot.state.Debug[entity.Host] = list
+			}
+		}
+	}
+	sort.SliceStable(instances, func(i, j int) bool {
+		return instances[i].Position < instances[j].Position
+	})
+	for _, instance := range instances {
+		snapshot.state.Instances = append(snapshot.state.Instances, instance.Instance)
+	}
+	return
+}
+
+// operations returns the operations writing the state over the snapshot rows, conditioned on their etags unless
+// unconditional is set. The cluster row is written with any instance change so the instances change one at a time,
+// clearing the instances moves them to a new generation instead of deleting every row in the transaction
+func (s tableStateSnapshot) operations(state protocol.ClusterState, unconditional bool) (operations []tableOperation) {
+	ifMatch := func(entity stateTableEntity) string {
+		if unconditional {
+			return "*"
+		}
+		return entity.Etag
+	}
+	write := func(rowKey string, current *stateTableEntity, entity map[string]interface{}) tableOperation {
+		operation := tableOperation{Action: aztables.TransactionTypeInsertReplace, RowKey: rowKey, Entity: entity}
+		if current != nil && !unconditional {
+			operation.Action = aztables.TransactionTypeUpdateReplace
+			operation.IfMatch = current.Etag
+		} else if current == nil && !unconditional {
+			// an insert fails when another writer inserted the row
+			operation.Action = aztables.TransactionTypeAdd
+		}
+		return operation
+	}
+
+	generation := 0
+	if s.cluster != nil {
+		generation = s.cluster.InstancesGeneration
+	}
+	instancesChanged := false
+	if len(state.Instances) == 0 && len(s.instances) > 0 {
+		generation++
+		instancesChanged = true
+	} else {
+		position := s.maxPosition
+		expected := make(map[string]bool)
+		for _, instance := range state.Instances {
+			rowKey := encodeTableKey(instanceRowPrefix, strings.Split(instance, ":")[0])
+			expected[rowKey] = true
+			current, found := s.instances[rowKey]
+			if found && current.Instance == instance {
+				continue
+			}
+			instancesChanged = true
+			entity := map[string]interface{}{"Instance": instance, "Generation": generation}
+			if found {
+				entity["Position"] = current.Position
+				operations = append(operations, write(rowKey, &current, entity))
+				continue
+			}
+			position++
+			entity["Position"] = position
+			if stale, isStale := s.staleRows[rowKey]; isStale {
+				operations = append(operations, write(rowKey, &stale, entity))
+			} else {
+				operations = append(operations, write(rowKey, nil, entity))
+			}
+		}
+		for rowKey, current := range s.instances {
+			if !expected[rowKey] {
+				instancesChanged = true
+				operations = append(operations, tableOperation{Action: aztables.TransactionTypeDelete, RowKey: rowKey, IfMatch: ifMatch(current)})
+			}
+		}
+	}
+
+	hosts := make(map[string]bool)
+	for _, reports := range []map[string][]string{state.Progress, state.Errors, state.Debug} {
+		for host := range reports {
+			hosts[host] = true
+		}
+	}
+	expectedReports := make(map[string]bool)
+	for host := range hosts {
+		progress, errs, debug := encodeReportList(state.Progress[host]), encodeReportList(state.Errors[host]), encodeReportList(state.Debug[host])
+		if progress == "" && errs == "" && debug == "" {
+			continue
+		}
+		rowKey := encodeTableKey(reportRowPrefix, host)
+		expectedReports[rowKey] = true
+		current, found := s.reports[rowKey]
+		if found && current.Progress == progress && current.Errors == errs && current.Debug == debug {
+			continue
+		}
+		entity := map[string]interface{}{"Host": host, "Progress": progress, "Errors": errs, "Debug": debug}
+		if found {
+			operations = append(operations, write(rowKey, &current, entity))
+		} else {
+			operations = append(operations, write(rowKey, nil, entity))
+		}
+	}
+	for rowKey, current := range s.reports {
+		if !expectedReports[rowKey] {
+			operations = append(operations, tableOperation{Action: aztables.TransactionTypeDelete, RowKey: rowKey, IfMatch: ifMatch(current)})
+		}
+	}
+
+	clusterChanged := s.cluster == nil || instancesChanged ||
+		s.cluster.InitialSize != state.InitialSize || s.cluster.DesiredSize != state.DesiredSize || s.cluster.Clusterized != state.Clusterized
+	if clusterChanged {
+		operations = append(operations, write(clusterRowKey, s.cluster, map[string]interface{}{
+			"InitialSize":         state.InitialSize,
+			"DesiredSize":         state.DesiredSize,
+			"Clusterized":         state.Clusterized,
+			"InstancesGeneration": generation,
+		}))
+	}
+	return
+}
+
+// seed writes the state of the state blob to the table on the first use, the cluster row is inserted last so the
+// state is read from the blob until all the rows are written
+func (t TableStateStore) seed(ctx context.Context, storageName, partitionKey string) error {
+	logger := logging.LoggerFromCtx(ctx)
+
+	state, err := BlobStateStore{}.ReadState(ctx, storageName, partitionKey)
+	if err != nil {
+		return err
+	}
+	logger.Info().Msgf("seeding the state table %s from the state blob", t.TableName)
+
+	operations := tableStateSnapshot{}.operations(state, true)
+	clusterOperation := operations[len(operations)-1]
+	if err = t.executeBatches(ctx, storageName, partitionKey, operations[:len(operations)-1]); err != nil {
+		return err
+	}
+	clusterOperation.Action = aztables.TransactionTypeAdd
+	clusterOperation.IfMatch = ""
+	err = t.executeBatch(ctx, storageName, partitionKey, []tableOperation{clusterOperation})
+	if errors.Is(err, errTableWriteConflict) {
+		// seeded concurrently
+		return nil
+	}
+	return err
+}
+
+func (t TableStateStore) readSeededSnapshot(ctx context.Context, storageName, partitionKey string) (snapshot tableStateSnapshot, err error) {
+	snapshot, err = t.readSnapshot(ctx, storageName, partitionKey)
+	if err != nil || snapshot.cluster != nil {
+		return
+	}
+	if err = t.seed(ctx, storageName, partitionKey); err != nil {
+		return
+	}
+	return t.readSnapshot(ctx, storageName, partitionKey)
+}
+
+// deleteStaleRows deletes the instance rows of the previous generations, the rows left behind are ignored
+func (t TableStateStore) deleteStaleRows(ctx context.Context, storageName, partitionKey string) {
+	logger := logging.LoggerFromCtx(ctx)
+
+	snapshot, err := t.readSnapshot(ctx, storageName, partitionKey)
+	if err != nil || len(snapshot.staleRows) == 0 {
+		return
+	}
+	var operations []tableOperation
+	for rowKey, entity := range snapshot.staleRows {
+		operations = append(operations, tableOperation{Action: aztables.TransactionTypeDelete, RowKey: rowKey, IfMatch: entity.Etag})
+	}
+	if err = t.executeBatches(ctx, storageName, partitionKey, operations); err != nil {
+		logger.Warn().Err(err).Msg("failed to delete the cleared instance rows")
+	}
+}
+
+func (t TableStateStore) ReadState(ctx context.Context, stateStorageName, containerName string) (state protocol.ClusterState, err error) {
+	logger := logging.LoggerFromCtx(ctx)
+
+	snapshot, err := t.readSeededSnapshot(ctx, stateStorageName, containerName)
+	if err != nil {
+		logger.Error().Err(err).Send()
+		return
+	}
+	state = snapshot.state
+	return
+}
+
+// WriteState overwrites the rows without conditions, in several transactions when the state changes more rows
+// than a transaction has
+func (t TableStateStore) WriteState(ctx context.Context, stateStorageName, containerName string, state protocol.ClusterState) (err error) {
+	logger := logging.LoggerFromCtx(ctx)
+
+	for attempt := 1; attempt <= stateUpdateMaxAttempts; attempt++ {
+		var snapshot tableStateSnapshot
+		snapshot, err = t.readSeededSnapshot(ctx, stateStorageName, containerName)
+		if err != nil {
+			logger.Error().Err(err).Send()
+			return
+		}
+		err = t.executeBatches(ctx, stateStorageName, containerName, snapshot.operations(state, true))
+		// a row deleted in between fails the deletion
+		if !errors.Is(err, errTableWriteConflict) {
+			break
+		}
+		time.Sleep(getBlobUpdateRetryDelay(attempt))
+	}
+	if err != nil {
+		logger.Error().Err(err).Send()
+		return
+	}
+	t.deleteStaleRows(ctx, stateStorageName, containerName)
+	return
+}
+
+func (t TableStateStore) UpdateState(ctx context.Context, stateStorageName, containerName string, update func(state *protocol.ClusterState) error) (state protocol.ClusterState, err error) {
+	logger := logging.LoggerFromCtx(ctx)
+
+	for attempt := 1; attempt <= stateUpdateMaxAttempts; attempt++ {
+		var snapshot tableStateSnapshot
+		snapshot, err = t.readSeededSnapshot(ctx, stateStorageName, containerName)
+		if err != nil {
+			logger.Error().Err(err).Send()
+			return
+		}
+
+		state = snapshot.state
+		err = update(&state)
+		if err != nil {
+			return
+		}
+
+		operations := snapshot.operations(state, false)
+		if len(operations) == 0 {
+			return
+		}
+		if len(operations) > tableBatchMaxOperations {
+			err = fmt.Errorf("the state update changes %d rows, a transaction changes up to %d", len(operations), tableBatchMaxOperations)
+			logger.Error().Err(err).Send()
+			return
+		}
+		err = t.executeBatch(ctx, stateStorageName, containerName, operations)
+		if err == nil {
+			if len(snapshot.instances) > 0 && len(state.Instances) == 0 {
+				t.deleteStaleRows(ctx, stateStorageName, containerName)
+			}
+			return
+		}
+		if !errors.Is(err, errTableWriteConflict) {
+			logger.Error().Err(err).Send()
+			return
+		}
+
+		delay := getBlobUpdateRetryDelay(attempt)
+		logger.Info().Msgf("state was changed by another writer, retrying in %s (attempt %d/%d)", delay, attempt, stateUpdateMaxAttempts)
+		time.Sleep(delay)
+	}
+	err = fmt.Errorf("failed to update state after %d attempts: %w", stateUpdateMaxAttempts, err)
+	logger.Error().Err(err).Send()
+	return
+}
@@ -0,0 +1,47 @@
+package common
+
+import (
+	"errors"
+	"io"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/Azure/azure-sdk-for-go/sdk/azcore"
+)
+
+// the response of a transaction rejected by a failed action, the outer status is 202 Accepted
+const rejectedTransactionResponse = "--batchresponse_7ab1c4f4\r\n" +
+	"Content-Type: multipart/mixed; boundary=changesetresponse_35d5a3a8\r\n\r\n" +
+	"--changesetresponse_35d5a3a8\r\n" +
+	"Content-Type: application/http\r\n" +
+	"Content-Transfer-Encoding: binary\r\n\r\n" +
+	"HTTP/1.1 412 Precondition Failed\r\n" +
+	"DataServiceVersion: 3.0;\r\n" +
+	"Content-Type: application/json;odata=minimalmetadata;streaming=true;charset=utf-8\r\n\r\n" +
+	`{"odata.error":{"code":"UpdateConditionNotSatisfied","message":{"lang":"en-US","value":"0:The update condition specified in the request was not satisfied."}}}` + "\r\n" +
+	"--changesetresponse_35d5a3a8--\r\n" +
+	"--batchresponse_7ab1c4f4--\r\n"
+
+func Test_IsTableWriteConflict(t *testing.T) {
+	rejected := &azcore.ResponseError{
+		StatusCode: http.StatusAccepted,
+		RawResponse: &http.Response{
+			StatusCode: http.StatusAccepted,
+			Header:     http.Header{"Content-Type": {"multipart/mixed; boundary=batchresponse_7ab1c4f4"}},
+			Body:       io.NopCloser(strings.NewReader(rejectedTransactionResponse)),
+		},
+	}
+	if !isTableWriteConflict(rejected) {
+		t.Errorf("the rejected transaction is not a conflict")
+	}
+	if !isTableWriteConflict(&azcore.ResponseError{StatusCode: http.StatusConflict, ErrorCode: "EntityAlreadyExists"}) {
+		t.Errorf("an existing row is not a conflict")
+	}
+	if isTableWriteConflict(&azcore.ResponseError{StatusCode: http.StatusForbidden, ErrorCode: "AuthorizationFailure"}) {
+		t.Errorf("an authorization failure is a conflict")
+	}
+	if isTableWriteConflict(errors.New("connection reset")) {
+		t.Errorf("a network error is a conflict")
+	}
+}
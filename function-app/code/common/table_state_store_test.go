@@ -0,0 +1,128 @@
+package common_test
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"sync"
+	"testing"
+	"time"
+	"weka-deployment/common"
+	"weka-deployment/common/fakes"
+
+	"github.com/weka/go-cloud-lib/protocol"
+)
+
+const (
+	testStorageName   = "wekateststorage"
+	testContainerName = "weka-test-state"
+)
+
+// newTableStateStore returns the table store seeded from the state blob, like on its first use
+func newTableStateStore(t *testing.T, ctx context.Context) common.TableStateStore {
+	err := common.BlobStateStore{}.WriteState(ctx, testStorageName, testContainerName, protocol.ClusterState{InitialSize: 6, DesiredSize: 6})
+	if err != nil {
+		t.Fatalf("failed writing state blob: %s", err)
+	}
+	store := common.TableStateStore{TableName: "wekastate"}
+	if _, err = store.ReadState(ctx, testStorageName, testContainerName); err != nil {
+		t.Fatalf("failed seeding state table: %s", err)
+	}
+	return store
+}
+
+func addInstance(instance string) func(state *protocol.ClusterState) error {
+	return func(state *protocol.ClusterState) error {
+		state.Instances = append(state.Instances, instance)
+		return nil
+	}
+}
+
+func Test_TableStateStoreUpdateRetriesOnConflict(t *testing.T) {
+	clients := fakes.NewClients()
+	ctx := clients.Context(context.Background())
+	store := newTableStateStore(t, ctx)
+
+	// another writer adds an instance between the read and the transaction of the first attempt
+	clients.Tables.BeforeTransaction = func() {
+		clients.Tables.BeforeTransaction = nil
+		if _, err := store.UpdateState(ctx, testStorageName, testContainerName, addInstance("vm_1")); err != nil {
+			t.Errorf("failed concurrent update: %s", err)
+		}
+	}
+	attempts := 0
+	state, err := store.UpdateState(ctx, testStorageName, testContainerName, func(state *protocol.ClusterState) error {
+		attempts++
+		return addInstance("vm_0")(state)
+	})
+	if err != nil {
+		t.Fatalf("failed update: %s", err)
+	}
+	if attempts != 2 {
+		t.Errorf("expected the update to be retried once, it was applied %d times", attempts)
+	}
+	if len(state.Instances) != 2 || state.Instances[0] != "vm_1" || state.Instances[1] != "vm_0" {
+		t.Errorf("unexpected instances: %v", state.Instances)
+	}
+
+	state, err = store.ReadState(ctx, testStorageName, testContainerName)
+	if err != nil {
+		t.Fatalf("failed reading state: %s", err)
+	}
+	if len(state.Instances) != 2 || state.DesiredSize != 6 {
+		t.Errorf("unexpected state: %+v", state)
+	}
+}
+
+func Test_TableStateStoreConcurrentUpdates(t *testing.T) {
+	clients := fakes.NewClients()
+	ctx := clients.Context(context.Background())
+	store := newTableStateStore(t, ctx)
+	// the writers read the state before any of them writes it
+	clients.Tables.BeforeTransaction = func() {
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func(instance string) {
+			defer wg.Done()
+			if _, err := store.UpdateState(ctx, testStorageName, testContainerName, addInstance(instance)); err != nil {
+				t.Errorf("failed update of %s: %s", instance, err)
+			}
+		}(fmt.Sprintf("vm_%d", i))
+	}
+	wg.Wait()
+
+	state, err := store.ReadState(ctx, testStorageName, testContainerName)
+	if err != nil {
+		t.Fatalf("failed reading state: %s", err)
+	}
+	instances := append([]string{}, state.Instances...)
+	sort.Strings(instances)
+	if fmt.Sprint(instances) != "[vm_0 vm_1 vm_2 vm_3]" {
+		t.Errorf("updates were lost, instances: %v", state.Instances)
+	}
+}
+
+func Test_TableStateStoreUpdateAborted(t *testing.T) {
+	clients := fakes.NewClients()
+	ctx := clients.Context(context.Background())
+	store := newTableStateStore(t, ctx)
+
+	_, err := store.UpdateState(ctx, testStorageName, testContainerName, func(state *protocol.ClusterState) error {
+		state.Instances = append(state.Instances, "vm_0")
+		return fmt.Errorf("aborted")
+	})
+	if err == nil {
+		t.Fatalf("expected the update error")
+	}
+	state, err := store.ReadState(ctx, testStorageName, testContainerName)
+	if err != nil {
+		t.Fatalf("failed reading state: %s", err)
+	}
+	if len(state.Instances) != 0 {
+		t.Errorf("the aborted update was written: %v", state.Instances)
+	}
+}
@@ -0,0 +1,46 @@
+package common
+
+import (
+	"context"
+	"encoding/json"
+	"regexp"
+
+	"github.com/Azure/azure-sdk-for-go/sdk/azcore/to"
+)
+
+// blob container metadata names must be valid c# identifiers
+var invalidMetadataNameChars = regexp.MustCompile(`[^A-Za-z0-9_]`)
+
+// GetCustomTags returns the customer tags of the deployment, configured by TAGS from the terraform tags_map
+func GetCustomTags(ctx context.Context) map[string]string {
+	tags := make(map[string]string)
+	if value := Getenv(ctx, "TAGS"); value != "" {
+		_ = json.Unmarshal([]byte(value), &tags)
+	}
+	return tags
+}
+
+// GetResourceTags returns the tags of the resources created by the function app, the customer tags can't override
+// the tags telling the resources created by the function app apart on cleanup. azure role assignments don't support tags
+func GetResourceTags(ctx context.Context, clusterName string) map[string]*string {
+	tags := make(map[string]*string)
+	for key, value := range GetCustomTags(ctx) {
+		tags[key] = to.Ptr(value)
+	}
+	tags[CreatedByTag] = to.Ptr(CreatedByFunctionApp)
+	tags[WekaClusterTag] = to.Ptr(clusterName)
+	return tags
+}
+
+// GetContainerMetadata returns the customer tags as blob container metadata, the metadata names are sanitized
+func GetContainerMetadata(ctx context.Context, clusterName string) map[string]*string {
+	metadata := make(map[string]*string)
+	for key, value := range GetResourceTags(ctx, clusterName) {
+		name := invalidMetadataNameChars.ReplaceAllString(key, "_")
+		if name == "" || (name[0] >= '0' && name[0] <= '9') {
+			name = "_" + name
+		}
+		metadata[name] = value
+	}
+	return metadata
+}
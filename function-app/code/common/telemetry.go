@@ -0,0 +1,156 @@
+package common
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/weka/go-cloud-lib/logging"
+)
+
+const (
+	defaultAppInsightsIngestionEndpoint = "https://dc.services.visualstudio.com/"
+	appInsightsRequestTimeout           = 5 * time.Second
+)
+
+// telemetry events emitted by the functions
+const (
+	EventInstanceJoined     = "InstanceJoined"
+	EventObsCreated         = "ObsCreated"
+	EventScriptGenerated    = "ClusterizationScriptGenerated"
+	EventClusterizeFailed   = "ClusterizationFailed"
+	EventScaleDownFailed    = "ScaleDownFailed"
+	MetricInstancesJoined   = "InstancesJoined"
+	MetricInstancesToRemove = "InstancesToTerminate"
+)
+
+type appInsightsEnvelope struct {
+	Name string            `json:"name"`
+	Time string            `json:"time"`
+	IKey string            `json:"iKey"`
+	Tags map[string]string `json:"tags"`
+	Data appInsightsData   `json:"data"`
+}
+
+type appInsightsData struct {
+	BaseType string      `json:"baseType"`
+	BaseData interface{} `json:"baseData"`
+}
+
+type appInsightsEventData struct {
+	Ver        int               `json:"ver"`
+	Name       string            `json:"name"`
+	Properties map[string]string `json:"properties,omitempty"`
+}
+
+type appInsightsMetric struct {
+	Name  string  `json:"name"`
+	Value float64 `json:"value"`
+	Count int     `json:"count"`
+}
+
+type appInsightsMetricData struct {
+	Ver        int                 `json:"ver"`
+	Metrics    []appInsightsMetric `json:"metrics"`
+	Properties map[string]string   `json:"properties,omitempty"`
+}
+
+// getAppInsightsTarget returns the instrumentation key and ingestion endpoint of the function app application insights,
+// APPLICATIONINSIGHTS_CONNECTION_STRING is preferred over the legacy APPINSIGHTS_INSTRUMENTATIONKEY
+func getAppInsightsTarget() (instrumentationKey, ingestionEndpoint string) {
+	ingestionEndpoint = defaultAppInsightsIngestionEndpoint
+	connectionString := os.Getenv("APPLICATIONINSIGHTS_CONNECTION_STRING")
+	if connectionString == "" {
+		instrumentationKey = os.Getenv("APPINSIGHTS_INSTRUMENTATIONKEY")
+		return
+	}
+
+	for _, part := range strings.Split(connectionString, ";") {
+		key, value, found := strings.Cut(part, "=")
+		if !found {
+			continue
+		}
+		switch strings.ToLower(strings.TrimSpace(key)) {
+		case "instrumentationkey":
+			instrumentationKey = strings.TrimSpace(value)
+		case "ingestionendpoint":
+			ingestionEndpoint = strings.TrimSpace(value)
+		}
+	}
+	if !strings.HasSuffix(ingestionEndpoint, "/") {
+		ingestionEndpoint += "/"
+	}
+	return
+}
+
+func sendAppInsightsEnvelope(ctx context.Context, name, baseType string, baseData interface{}) {
+	logger := logging.LoggerFromCtx(ctx)
+
+	instrumentationKey, ingestionEndpoint := getAppInsightsTarget()
+	if instrumentationKey == "" {
+		return
+	}
+
+	envelope := appInsightsEnvelope{
+		Name: fmt.Sprintf("Microsoft.ApplicationInsights.%s", name),
+		Time: time.Now().UTC().Format(time.RFC3339Nano),
+		IKey: instrumentationKey,
+		Tags: map[string]string{
+			"ai.cloud.role": Getenv(ctx, "WEBSITE_SITE_NAME"),
+		},
+		Data: appInsightsData{
+			BaseType: baseType,
+			BaseData: baseData,
+		},
+	}
+
+	body, err := json.Marshal(envelope)
+	if err != nil {
+		logger.Error().Err(err).Msg("failed to marshal telemetry")
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, appInsightsRequestTimeout)
+	defer cancel()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, ingestionEndpoint+"v2/track", bytes.NewReader(body))
+	if err != nil {
+		logger.Error().Err(err).Msg("failed to create telemetry request")
+		return
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := getHttpClient().Do(req)
+	if err != nil {
+		logger.Error().Err(err).Msg("failed to send telemetry")
+		return
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		logger.Error().Msgf("application insights rejected telemetry, status: %s", resp.Status)
+	}
+}
+
+// TrackEvent sends a custom event to application insights, telemetry failures never fail the calling function
+func TrackEvent(ctx context.Context, name string, properties map[string]string) {
+	sendAppInsightsEnvelope(ctx, "Event", "EventData", appInsightsEventData{
+		Ver:        2,
+		Name:       name,
+		Properties: properties,
+	})
+}
+
+// TrackMetric sends a custom metric to application insights, telemetry failures never fail the calling function
+func TrackMetric(ctx context.Context, name string, value float64, properties map[string]string) {
+	sendAppInsightsEnvelope(ctx, "Metric", "MetricData", appInsightsMetricData{
+		Ver:        2,
+		Metrics:    []appInsightsMetric{{Name: name, Value: value, Count: 1}},
+		Properties: properties,
+	})
+}
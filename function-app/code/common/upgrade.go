@@ -0,0 +1,108 @@
+package common
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/Azure/azure-sdk-for-go/sdk/azcore"
+	"github.com/weka/go-cloud-lib/logging"
+)
+
+// the rolling upgrade progress is kept in its own blob next to the state, so an upgrade can be resumed
+// by any function invocation
+const upgradeStateBlobName = "upgrade"
+
+const (
+	UpgradeStatusInProgress = "in_progress"
+	UpgradeStatusCompleted  = "completed"
+	UpgradeStatusFailed     = "failed"
+	UpgradeStatusAborted    = "aborted"
+)
+
+const (
+	// the upgrade script is running on the current vm
+	UpgradePhaseUpgrade = "upgrade"
+	// the current vm was upgraded, waiting for its containers to rejoin the cluster
+	UpgradePhaseVerify = "verify"
+)
+
+// ErrUpgradeStateUnchanged aborts an upgrade state update without writing it
+var ErrUpgradeStateUnchanged = errors.New("upgrade state unchanged")
+
+type UpgradeState struct {
+	FromVersion string `json:"from_version"`
+	ToVersion   string `json:"to_version"`
+	DownloadUrl string `json:"download_url,omitempty"`
+	Status      string `json:"status"`
+	// backend vms by name, upgraded one at a time
+	Pending   []string `json:"pending"`
+	Completed []string `json:"completed"`
+	Current   string   `json:"current,omitempty"`
+	Phase     string   `json:"phase,omitempty"`
+	// resume token of the run command executing the upgrade script on the current vm
+	RunCommandToken string    `json:"run_command_token,omitempty"`
+	PhaseStartedAt  time.Time `json:"phase_started_at"`
+	StartedAt       time.Time `json:"started_at"`
+	UpdatedAt       time.Time `json:"updated_at"`
+	Error           string    `json:"error,omitempty"`
+	// why the next vm is not upgraded yet, the upgrade continues once the quorum guard allows it
+	Veto *QuorumVeto `json:"veto,omitempty"`
+}
+
+func readUpgradeState(ctx context.Context, stateStorageName, stateContainerName string) (state UpgradeState, etag *azcore.ETag, err error) {
+	logger := logging.LoggerFromCtx(ctx)
+
+	data, etag, err := readBlobWithETag(ctx, stateStorageName, stateContainerName, upgradeStateBlobName, true)
+	if err != nil || len(data) == 0 {
+		return
+	}
+	err = json.Unmarshal(data, &state)
+	if err != nil {
+		logger.Error().Err(err).Send()
+	}
+	return
+}
+
+// GetUpgradeState returns the last upgrade, its status is empty if no upgrade was started
+func GetUpgradeState(ctx context.Context, stateStorageName, stateContainerName string) (state UpgradeState, err error) {
+	state, _, err = readUpgradeState(ctx, stateStorageName, stateContainerName)
+	return
+}
+
+// UpdateUpgradeState applies update on the current upgrade state with the same conflict handling as UpdateState,
+// update may return ErrUpgradeStateUnchanged to leave the blob as is
+func UpdateUpgradeState(ctx context.Context, stateStorageName, stateContainerName string, update func(state *UpgradeState) error) (state UpgradeState, err error) {
+	logger := logging.LoggerFromCtx(ctx)
+
+	for attempt := 1; attempt <= stateUpdateMaxAttempts; attempt++ {
+		var etag *azcore.ETag
+		state, etag, err = readUpgradeState(ctx, stateStorageName, stateContainerName)
+		if err != nil {
+			return
+		}
+		err = update(&state)
+		if err != nil {
+			return
+		}
+		state.UpdatedAt = time.Now().UTC()
+
+		var data []byte
+		data, err = json.Marshal(state)
+		if err != nil {
+			logger.Error().Err(err).Send()
+			return
+		}
+
+		err = writeBlobIfMatch(ctx, stateStorageName, stateContainerName, upgradeStateBlobName, data, etag)
+		if err == nil || !isBlobWriteConflict(err) {
+			return
+		}
+		time.Sleep(getBlobUpdateRetryDelay(attempt))
+	}
+	err = fmt.Errorf("failed to update upgrade state after %d attempts: %w", stateUpdateMaxAttempts, err)
+	logger.Error().Err(err).Send()
+	return
+}
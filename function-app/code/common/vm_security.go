@@ -0,0 +1,42 @@
+package common
+
+import (
+	"context"
+	"fmt"
+)
+
+// backend vms security types, matching the vm security profile configured by terraform
+const (
+	VmSecurityTypeStandard       = "Standard"
+	VmSecurityTypeTrustedLaunch  = "TrustedLaunch"
+	VmSecurityTypeConfidentialVM = "ConfidentialVM"
+)
+
+// GetVmSecurityType returns the backend vms security type, configured by VM_SECURITY_TYPE
+func GetVmSecurityType(ctx context.Context) string {
+	securityType := Getenv(ctx, "VM_SECURITY_TYPE")
+	if securityType == "" {
+		return VmSecurityTypeStandard
+	}
+	return securityType
+}
+
+func ValidateVmSecurityType(securityType string) error {
+	switch securityType {
+	case VmSecurityTypeStandard, VmSecurityTypeTrustedLaunch, VmSecurityTypeConfidentialVM:
+		return nil
+	}
+	return fmt.Errorf("invalid vm security type %s, valid values are %s, %s and %s", securityType, VmSecurityTypeStandard, VmSecurityTypeTrustedLaunch, VmSecurityTypeConfidentialVM)
+}
+
+// IsDpdkSupported tells whether weka can run with dpdk on the security type, the nics can't be passed through to
+// dpdk on confidential vms whose memory is encrypted, weka runs in udp mode there
+func IsDpdkSupported(securityType string) bool {
+	return securityType != VmSecurityTypeConfidentialVM
+}
+
+// GetWekaInstallDpdk returns whether weka is installed with dpdk, falling back to udp mode when the security type
+// doesn't support it
+func GetWekaInstallDpdk(installDpdk bool, securityType string) bool {
+	return installDpdk && IsDpdkSupported(securityType)
+}
@@ -0,0 +1,360 @@
+package common
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/Azure/azure-sdk-for-go/sdk/azcore"
+	"github.com/Azure/azure-sdk-for-go/sdk/azidentity"
+	"github.com/Azure/azure-sdk-for-go/sdk/resourcemanager/compute/armcompute"
+	"github.com/weka/go-cloud-lib/logging"
+)
+
+// the warm pool holds WARM_POOL_SIZE deallocated scale set vms on top of the desired size, with the weka software
+// installed, the scale up starts them instead of waiting for new vms. The members are kept in their own blob next to
+// the state by vm name, a scale set vm which is not a member is an active backend
+const warmPoolBlobName = "warm_pool"
+
+const (
+	// the reports of the warm pool script have this phase
+	WarmPoolReportPhase = "warm_pool"
+	// the weka software is being installed, the vm is deallocated once the script reports
+	WarmPoolStatusPreparing = "preparing"
+	// deallocated and ready to join
+	WarmPoolStatusWarm = "warm"
+	// started by the scale up, the member leaves the pool once deploy returns its join script
+	WarmPoolStatusActivating = "activating"
+	// the preparation failed, the vm is left running for inspection and is not used
+	WarmPoolStatusFailed = "failed"
+)
+
+type WarmPoolMember struct {
+	Status    string    `json:"status"`
+	Message   string    `json:"message,omitempty"`
+	UpdatedAt time.Time `json:"updated_at"`
+}
+
+// WarmPool holds the warm pool members by vm name
+type WarmPool map[string]WarmPoolMember
+
+func GetWarmPoolSize(ctx context.Context) int {
+	size, err := strconv.Atoi(Getenv(ctx, "WARM_POOL_SIZE"))
+	if err != nil || size < 0 {
+		return 0
+	}
+	return size
+}
+
+// GetScaleSetCapacity returns the scale set capacity of the desired cluster size, with the warm pool vms
+func GetScaleSetCapacity(ctx context.Context, desiredSize int) int64 {
+	return int64(desiredSize + GetWarmPoolSize(ctx))
+}
+
+// Members returns the sorted names of the members with one of the statuses
+func (p WarmPool) Members(statuses ...string) (vmNames []string) {
+	for vmName, member := range p {
+		for _, status := range statuses {
+			if member.Status == status {
+				vmNames = append(vmNames, vmName)
+				break
+			}
+		}
+	}
+	sort.Strings(vmNames)
+	return
+}
+
+// IsIdle tells whether the vm is a member which is not joining the cluster, it is excluded from the backends
+func (p WarmPool) IsIdle(vmName string) bool {
+	member, ok := p[vmName]
+	return ok && member.Status != WarmPoolStatusActivating
+}
+
+func readWarmPool(ctx context.Context, stateStorageName, stateContainerName string) (pool WarmPool, etag *azcore.ETag, err error) {
+	logger := logging.LoggerFromCtx(ctx)
+
+	data, etag, err := readBlobWithETag(ctx, stateStorageName, stateContainerName, warmPoolBlobName, true)
+	if err != nil {
+		return
+	}
+	pool = make(WarmPool)
+	if len(data) == 0 {
+		return
+	}
+	err = json.Unmarshal(data, &pool)
+	if err != nil {
+		logger.Error().Err(err).Send()
+	}
+	return
+}
+
+func GetWarmPool(ctx context.Context, stateStorageName, stateContainerName string) (pool WarmPool, err error) {
+	pool, _, err = readWarmPool(ctx, stateStorageName, stateContainerName)
+	return
+}
+
+// UpdateWarmPool applies the update to the warm pool, with the same conflict handling as UpdateState
+func UpdateWarmPool(ctx context.Context, stateStorageName, stateContainerName string, update func(pool WarmPool) error) (pool WarmPool, err error) {
+	logger := logging.LoggerFromCtx(ctx)
+
+	for attempt := 1; attempt <= stateUpdateMaxAttempts; attempt++ {
+		var etag *azcore.ETag
+		pool, etag, err = readWarmPool(ctx, stateStorageName, stateContainerName)
+		if err != nil {
+			return
+		}
+		err = update(pool)
+		if err != nil {
+			return
+		}
+
+		var data []byte
+		data, err = json.Marshal(pool)
+		if err != nil {
+			logger.Error().Err(err).Send()
+			return
+		}
+
+		err = writeBlobIfMatch(ctx, stateStorageName, stateContainerName, warmPoolBlobName, data, etag)
+		if err == nil || !isBlobWriteConflict(err) {
+			return
+		}
+		time.Sleep(getBlobUpdateRetryDelay(attempt))
+	}
+	err = fmt.Errorf("failed to update warm pool after %d attempts: %w", stateUpdateMaxAttempts, err)
+	logger.Error().Err(err).Send()
+	return
+}
+
+func SetWarmPoolMember(ctx context.Context, stateStorageName, stateContainerName, vmName, status, message string) (err error) {
+	_, err = UpdateWarmPool(ctx, stateStorageName, stateContainerName, func(pool WarmPool) error {
+		pool[vmName] = WarmPoolMember{Status: status, Message: message, UpdatedAt: time.Now().UTC()}
+		return nil
+	})
+	return
+}
+
+func RemoveWarmPoolMember(ctx context.Context, stateStorageName, stateContainerName, vmName string) (err error) {
+	_, err = UpdateWarmPool(ctx, stateStorageName, stateContainerName, func(pool WarmPool) error {
+		delete(pool, vmName)
+		return nil
+	})
+	return
+}
+
+// Joins tells whether a vm deploying after the clusterization becomes a warm pool member, which is the case while
+// the pool is short of members and the other active vms make the desired size. A member restarted while preparing
+// prepares again, an activating one joins the cluster
+func (p WarmPool) Joins(vmName string, vmNames []string, desiredSize, warmPoolSize int) bool {
+	if member, ok := p[vmName]; ok {
+		return member.Status != WarmPoolStatusActivating
+	}
+	if len(p.Members(WarmPoolStatusPreparing, WarmPoolStatusWarm)) >= warmPoolSize {
+		return false
+	}
+	active := 0
+	for _, name := range vmNames {
+		if name != vmName && !p.IsIdle(name) {
+			active++
+		}
+	}
+	return active >= desiredSize
+}
+
+// JoinWarmPool adds the vm to the warm pool as preparing when it joins the pool, see WarmPool.Joins
+func JoinWarmPool(ctx context.Context, stateStorageName, stateContainerName, vmName string, vmNames []string, desiredSize int) (join bool, err error) {
+	warmPoolSize := GetWarmPoolSize(ctx)
+	if warmPoolSize == 0 {
+		return
+	}
+	_, err = UpdateWarmPool(ctx, stateStorageName, stateContainerName, func(pool WarmPool) error {
+		join = pool.Joins(vmName, vmNames, desiredSize, warmPoolSize)
+		if join {
+			pool[vmName] = WarmPoolMember{Status: WarmPoolStatusPreparing, UpdatedAt: time.Now().UTC()}
+		}
+		return nil
+	})
+	return
+}
+
+func newScaleSetVmsClient(ctx context.Context, subscriptionId string) (client *armcompute.VirtualMachineScaleSetVMsClient, err error) {
+	logger := logging.LoggerFromCtx(ctx)
+
+	credential, err := azidentity.NewDefaultAzureCredential(getCredentialOptions())
+	if err != nil {
+		logger.Error().Err(err).Send()
+		return
+	}
+	client, err = armcompute.NewVirtualMachineScaleSetVMsClient(subscriptionId, credential, getArmClientOptions())
+	if err != nil {
+		logger.Error().Err(err).Send()
+	}
+	return
+}
+
+// DeallocateScaleSetVm starts the deallocation of the vm without waiting for it
+func DeallocateScaleSetVm(ctx context.Context, subscriptionId, resourceGroupName, vmName string) (err error) {
+	logger := logging.LoggerFromCtx(ctx)
+	logger.Info().Msgf("Deallocating %s", vmName)
+
+	client, err := newScaleSetVmsClient(ctx, subscriptionId)
+	if err != nil {
+		return
+	}
+	_, err = client.BeginDeallocate(ctx, resourceGroupName, GetVmScaleSetNameFromVmName(vmName), GetScaleSetVmIndex(vmName), nil)
+	if err != nil {
+		logger.Error().Err(err).Send()
+	}
+	return
+}
+
+// StartScaleSetVm starts the deallocated vm without waiting for it
+func StartScaleSetVm(ctx context.Context, subscriptionId, resourceGroupName, vmName string) (err error) {
+	logger := logging.LoggerFromCtx(ctx)
+	logger.Info().Msgf("Starting %s", vmName)
+
+	client, err := newScaleSetVmsClient(ctx, subscriptionId)
+	if err != nil {
+		return
+	}
+	_, err = client.BeginStart(ctx, resourceGroupName, GetVmScaleSetNameFromVmName(vmName), GetScaleSetVmIndex(vmName), nil)
+	if err != nil {
+		logger.Error().Err(err).Send()
+	}
+	return
+}
+
+// ActivateWarmPoolMembers starts the warm members the desired size misses, the activating members count as active
+func ActivateWarmPoolMembers(ctx context.Context, subscriptionId, resourceGroupName, stateStorageName, stateContainerName string, vmNames []string, desiredSize int) (activated []string, err error) {
+	logger := logging.LoggerFromCtx(ctx)
+
+	_, err = UpdateWarmPool(ctx, stateStorageName, stateContainerName, func(pool WarmPool) error {
+		active := 0
+		for _, name := range vmNames {
+			if !pool.IsIdle(name) {
+				active++
+			}
+		}
+		for _, name := range pool.Members(WarmPoolStatusWarm) {
+			if active >= desiredSize {
+				break
+			}
+			pool[name] = WarmPoolMember{Status: WarmPoolStatusActivating, UpdatedAt: time.Now().UTC()}
+			activated = append(activated, name)
+			active++
+		}
+		return nil
+	})
+	if err != nil {
+		return
+	}
+
+	for _, name := range activated {
+		if startErr := StartScaleSetVm(ctx, subscriptionId, resourceGroupName, name); startErr != nil {
+			// the member is warm again, the next scale up retries it
+			logger.Warn().Err(startErr).Msgf("failed to start the warm pool vm %s", name)
+			err = SetWarmPoolMember(ctx, stateStorageName, stateContainerName, name, WarmPoolStatusWarm, startErr.Error())
+		}
+	}
+	return
+}
+
+// RecordWarmPoolReport stores the result of the warm pool script, a prepared member is deallocated. The report
+// function definition adds the vm name as the instance of the report
+func RecordWarmPoolReport(ctx context.Context, subscriptionId, resourceGroupName, stateStorageName, stateContainerName string, report ProgressReport) (err error) {
+	if report.Instance == "" {
+		return fmt.Errorf("warm pool report of %s has no instance", report.Hostname)
+	}
+	if report.Type == ReportTypeError {
+		return SetWarmPoolMember(ctx, stateStorageName, stateContainerName, report.Instance, WarmPoolStatusFailed, report.Message)
+	}
+	err = SetWarmPoolMember(ctx, stateStorageName, stateContainerName, report.Instance, WarmPoolStatusWarm, "")
+	if err != nil {
+		return
+	}
+	return DeallocateScaleSetVm(ctx, subscriptionId, resourceGroupName, report.Instance)
+}
+
+// GetWarmPoolScript returns the script preparing a warm pool member: the weka software of the cluster version is
+// installed from a backend, and a boot service calling deploy again is installed, deploy returns the join script once
+// the scale up started the member
+func GetWarmPoolScript(reportFuncDef, deployFuncDef, payload, proxyUrl string, backendIps []string) string {
+	return fmt.Sprintf(`
+#!/bin/bash
+set -x
+export REPORT_PHASE=%s
+PROXY_URL="%s"
+IPS=(%s)
+
+# report function definition
+%s
+
+function report_warm_pool {
+	report "{\"hostname\": \"$HOSTNAME\", \"type\": \"$1\", \"message\": \"$2\"}"
+}
+
+VERSION=""
+for backend_ip in ${IPS[@]}; do
+	VERSION=$(curl -s -XPOST --data '{"jsonrpc":"2.0", "method":"client_query_backend", "id":"1"}' $backend_ip:14000/api/v1 | sed 's/.*"software_release":"\([^"]*\)".*$/\1/g')
+	if [[ -n "$VERSION" ]]; then
+		break
+	fi
+done
+if [[ -z "$VERSION" ]]; then
+	report_warm_pool error "No backend returned the weka version"
+	exit 1
+fi
+
+if ! curl --fail $backend_ip:14000/dist/v1/install -o /tmp/install.sh || ! PROXY="$PROXY_URL" bash /tmp/install.sh; then
+	report_warm_pool error "Failed to install the weka agent"
+	exit 1
+fi
+if ! weka version get --from $backend_ip:14000 $VERSION --set-current || ! weka version prepare $VERSION; then
+	report_warm_pool error "Failed to get the weka version $VERSION"
+	exit 1
+fi
+weka local stop && weka local rm --all -f
+
+cat >/usr/local/sbin/weka-warm-pool-join <<'EOF'
+#!/bin/bash
+set -x
+
+# deploy function definition
+%s
+
+for (( i=0; i<60; i++ )); do
+	if deploy '%s' > /tmp/deploy.sh && [ -s /tmp/deploy.sh ]; then
+		break
+	fi
+	sleep 10
+done
+systemctl disable weka-warm-pool-join.service
+chmod +x /tmp/deploy.sh
+/tmp/deploy.sh 2>&1 | tee /tmp/weka_deploy.log
+EOF
+chmod +x /usr/local/sbin/weka-warm-pool-join
+
+cat >/etc/systemd/system/weka-warm-pool-join.service <<'EOF'
+[Unit]
+Description=Join the weka cluster once the warm pool vm is started
+Wants=network-online.target
+After=network-online.target
+
+[Service]
+Type=oneshot
+ExecStart=/usr/local/sbin/weka-warm-pool-join
+
+[Install]
+WantedBy=multi-user.target
+EOF
+systemctl daemon-reload
+systemctl enable weka-warm-pool-join.service
+
+report_warm_pool progress "Warm pool vm is ready"
+`, WarmPoolReportPhase, proxyUrl, strings.Join(backendIps, " "), reportFuncDef, deployFuncDef, payload)
+}
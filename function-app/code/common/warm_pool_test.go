@@ -0,0 +1,84 @@
+package common_test
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"weka-deployment/common"
+	"weka-deployment/common/fakes"
+)
+
+func Test_JoinWarmPool(t *testing.T) {
+	t.Setenv("WARM_POOL_SIZE", "1")
+	clients := fakes.NewClients()
+	ctx := clients.Context(context.Background())
+	vmNames := []string{"vmss_0", "vmss_1", "vmss_2", "vmss_3", "vmss_4"}
+
+	// the active vms don't make the desired size yet, the vm joins the cluster
+	join, err := common.JoinWarmPool(ctx, testStorageName, testContainerName, "vmss_2", vmNames[:3], 3)
+	if err != nil {
+		t.Fatalf("failed joining the warm pool: %s", err)
+	}
+	if join {
+		t.Errorf("vmss_2 is needed by the cluster and joined the warm pool")
+	}
+
+	join, err = common.JoinWarmPool(ctx, testStorageName, testContainerName, "vmss_3", vmNames[:4], 3)
+	if err != nil {
+		t.Fatalf("failed joining the warm pool: %s", err)
+	}
+	if !join {
+		t.Errorf("vmss_3 is beyond the desired size and didn't join the warm pool")
+	}
+
+	// the pool is full
+	join, err = common.JoinWarmPool(ctx, testStorageName, testContainerName, "vmss_4", vmNames, 3)
+	if err != nil {
+		t.Fatalf("failed joining the warm pool: %s", err)
+	}
+	if join {
+		t.Errorf("vmss_4 joined a full warm pool")
+	}
+
+	pool, err := common.GetWarmPool(ctx, testStorageName, testContainerName)
+	if err != nil {
+		t.Fatalf("failed reading the warm pool: %s", err)
+	}
+	if fmt.Sprint(pool.Members(common.WarmPoolStatusPreparing)) != "[vmss_3]" {
+		t.Errorf("unexpected warm pool: %+v", pool)
+	}
+}
+
+func Test_JoinWarmPoolMemberRestarted(t *testing.T) {
+	t.Setenv("WARM_POOL_SIZE", "2")
+	clients := fakes.NewClients()
+	ctx := clients.Context(context.Background())
+	vmNames := []string{"vmss_0", "vmss_1", "vmss_2"}
+
+	for vmName, status := range map[string]string{"vmss_1": common.WarmPoolStatusWarm, "vmss_2": common.WarmPoolStatusActivating} {
+		if err := common.SetWarmPoolMember(ctx, testStorageName, testContainerName, vmName, status, ""); err != nil {
+			t.Fatalf("failed setting warm pool member %s: %s", vmName, err)
+		}
+	}
+
+	// a warm member which restarts prepares again, an activating one joins the cluster
+	join, err := common.JoinWarmPool(ctx, testStorageName, testContainerName, "vmss_1", vmNames, 1)
+	if err != nil || !join {
+		t.Errorf("the restarted warm member didn't prepare again: %t, %v", join, err)
+	}
+	join, err = common.JoinWarmPool(ctx, testStorageName, testContainerName, "vmss_2", vmNames, 1)
+	if err != nil || join {
+		t.Errorf("the activating member didn't join the cluster: %t, %v", join, err)
+	}
+
+	pool, err := common.GetWarmPool(ctx, testStorageName, testContainerName)
+	if err != nil {
+		t.Fatalf("failed reading the warm pool: %s", err)
+	}
+	if pool["vmss_1"].Status != common.WarmPoolStatusPreparing || pool["vmss_2"].Status != common.WarmPoolStatusActivating {
+		t.Errorf("unexpected warm pool: %+v", pool)
+	}
+	if pool.IsIdle("vmss_2") || !pool.IsIdle("vmss_1") || pool.IsIdle("vmss_0") {
+		t.Errorf("unexpected idle members: %+v", pool)
+	}
+}
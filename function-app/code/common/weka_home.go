@@ -0,0 +1,113 @@
+package common
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/Azure/azure-sdk-for-go/sdk/azcore"
+	"github.com/weka/go-cloud-lib/logging"
+)
+
+// the weka home connectivity is kept in its own blob next to the state
+const wekaHomeBlobName = "weka_home"
+
+const (
+	DefaultWekaHomeUrl = "https://api.home.weka.io"
+	// the reports of the weka home validation script have this phase
+	WekaHomeReportPhase = "weka_home"
+)
+
+const (
+	WekaHomeStatusUnknown     = "unknown"
+	WekaHomeStatusPending     = "pending"
+	WekaHomeStatusReachable   = "reachable"
+	WekaHomeStatusUnreachable = "unreachable"
+)
+
+type WekaHomeStatus struct {
+	Url      string `json:"url"`
+	ProxyUrl string `json:"proxy_url,omitempty"`
+	Status   string `json:"status"`
+	Message  string `json:"message,omitempty"`
+	// the backend the validation ran on
+	Instance    string    `json:"instance,omitempty"`
+	CheckedAt   time.Time `json:"checked_at,omitempty"`
+	RequestedAt time.Time `json:"requested_at,omitempty"`
+}
+
+// GetWekaHomeUrl returns WEKA_HOME_URL, weka uses the public weka home when it is not set
+func GetWekaHomeUrl(ctx context.Context) string {
+	if url := Getenv(ctx, "WEKA_HOME_URL"); url != "" {
+		return url
+	}
+	return DefaultWekaHomeUrl
+}
+
+func readWekaHomeStatus(ctx context.Context, stateStorageName, stateContainerName string) (status WekaHomeStatus, etag *azcore.ETag, err error) {
+	logger := logging.LoggerFromCtx(ctx)
+
+	data, etag, err := readBlobWithETag(ctx, stateStorageName, stateContainerName, wekaHomeBlobName, true)
+	if err != nil {
+		return
+	}
+	if len(data) == 0 {
+		// clusters deployed before the validation have the configuration of the app settings
+		status = WekaHomeStatus{Url: GetWekaHomeUrl(ctx), ProxyUrl: Getenv(ctx, "PROXY_URL"), Status: WekaHomeStatusUnknown}
+		return
+	}
+	if err = json.Unmarshal(data, &status); err != nil {
+		logger.Error().Err(err).Send()
+	}
+	return
+}
+
+func GetWekaHomeStatus(ctx context.Context, stateStorageName, stateContainerName string) (status WekaHomeStatus, err error) {
+	status, _, err = readWekaHomeStatus(ctx, stateStorageName, stateContainerName)
+	return
+}
+
+// UpdateWekaHomeStatus applies the update to the weka home status, with the same conflict handling as UpdateState
+func UpdateWekaHomeStatus(ctx context.Context, stateStorageName, stateContainerName string, update func(status *WekaHomeStatus)) (status WekaHomeStatus, err error) {
+	logger := logging.LoggerFromCtx(ctx)
+
+	for attempt := 1; attempt <= stateUpdateMaxAttempts; attempt++ {
+		var etag *azcore.ETag
+		status, etag, err = readWekaHomeStatus(ctx, stateStorageName, stateContainerName)
+		if err != nil {
+			return
+		}
+		update(&status)
+
+		var data []byte
+		data, err = json.Marshal(status)
+		if err != nil {
+			logger.Error().Err(err).Send()
+			return
+		}
+
+		err = writeBlobIfMatch(ctx, stateStorageName, stateContainerName, wekaHomeBlobName, data, etag)
+		if err == nil || !isBlobWriteConflict(err) {
+			return
+		}
+		time.Sleep(getBlobUpdateRetryDelay(attempt))
+	}
+	err = fmt.Errorf("failed to update weka home status after %d attempts: %w", stateUpdateMaxAttempts, err)
+	logger.Error().Err(err).Send()
+	return
+}
+
+// RecordWekaHomeValidation stores the result reported by the weka home validation script
+func RecordWekaHomeValidation(ctx context.Context, stateStorageName, stateContainerName string, report ProgressReport) error {
+	_, err := UpdateWekaHomeStatus(ctx, stateStorageName, stateContainerName, func(status *WekaHomeStatus) {
+		status.Status = WekaHomeStatusUnreachable
+		if report.Reachable != nil && *report.Reachable {
+			status.Status = WekaHomeStatusReachable
+		}
+		status.Message = report.Message
+		status.Instance = report.Instance
+		status.CheckedAt = time.Now().UTC()
+	})
+	return err
+}
@@ -0,0 +1,263 @@
+package adopt
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"weka-deployment/common"
+
+	"github.com/weka/go-cloud-lib/connectors"
+	"github.com/weka/go-cloud-lib/lib/jrpc"
+	"github.com/weka/go-cloud-lib/lib/weka"
+	"github.com/weka/go-cloud-lib/logging"
+	"github.com/weka/go-cloud-lib/protocol"
+)
+
+var (
+	errAlreadyClusterized = errors.New("the function app already manages a clusterized cluster")
+	// the lifecycle functions operate the backends through the scale sets of the deployment
+	errUnmanagedBackends = errors.New("backends which are not vms of the deployment scale sets can't be adopted")
+)
+
+type RequestBody struct {
+	// ips of the backends the cluster is reached on, the cluster backends are listed through them
+	BackendIps []string `json:"backend_ips"`
+	// the user the functions operate the cluster with, WEKA_DEPLOYMENT_USERNAME or WEKA_ADMIN_USERNAME
+	Username string `json:"username"`
+	Password string `json:"password"`
+}
+
+type AdoptParams struct {
+	SubscriptionId     string
+	ResourceGroupName  string
+	StateStorageName   string
+	StateContainerName string
+	KeyVaultUri        string
+	Prefix             string
+	ClusterName        string
+}
+
+type AdoptResponse struct {
+	ClusterName string `json:"cluster_name"`
+	ClusterGuid string `json:"cluster_guid"`
+	Release     string `json:"release"`
+	// the vms of the backends, by vm name
+	Backends map[string]string `json:"backends"`
+	// backend ips which are not vms of the scale sets
+	Unmanaged []string `json:"unmanaged,omitempty"`
+}
+
+// getAdoptedBackends validates the connectivity and credentials on the given backends, and returns the cluster
+// backends by the scale set vms they run on
+func getAdoptedBackends(ctx context.Context, p AdoptParams, body RequestBody) (response AdoptResponse, err error) {
+	logger := logging.LoggerFromCtx(ctx)
+
+	jpool := &jrpc.Pool{
+		Ips:     body.BackendIps,
+		Clients: map[string]*jrpc.BaseClient{},
+		Builder: func(ip string) *jrpc.BaseClient {
+			return connectors.NewJrpcClient(ctx, ip, weka.ManagementJrpcPort, body.Username, body.Password)
+		},
+		Ctx: ctx,
+	}
+	var wekaStatus protocol.WekaStatus
+	if err = jpool.Call(weka.JrpcStatus, struct{}{}, &wekaStatus); err != nil {
+		err = fmt.Errorf("failed to reach the cluster on %v as %s: %w", body.BackendIps, body.Username, err)
+		logger.Error().Err(err).Send()
+		return
+	}
+	if !wekaStatus.IsCluster {
+		err = fmt.Errorf("the backends %v are not clusterized", body.BackendIps)
+		logger.Error().Err(err).Send()
+		return
+	}
+	response.ClusterName = wekaStatus.Name
+	response.ClusterGuid = wekaStatus.Guid
+	response.Release = wekaStatus.Release
+
+	var hostsApiList weka.HostListResponse
+	if err = jpool.Call(weka.JrpcHostList, struct{}{}, &hostsApiList); err != nil {
+		logger.Error().Err(err).Send()
+		return
+	}
+
+	vmsPrivateIps, err := common.GetScaleSetsVmsPrivateIps(ctx, p.SubscriptionId, p.ResourceGroupName, common.GetVmScaleSetNames(ctx, p.Prefix, p.ClusterName))
+	if err != nil {
+		return
+	}
+	vmNames := make(map[string]string, len(vmsPrivateIps))
+	for vmName, ip := range vmsPrivateIps {
+		vmNames[ip] = vmName
+	}
+
+	response.Backends = make(map[string]string)
+	unmanaged := make(map[string]bool)
+	for _, host := range hostsApiList {
+		// the clients and protocol gateways run frontend containers only, they are not part of the scale sets
+		if !strings.HasPrefix(host.ContainerName, "drives") && !strings.HasPrefix(host.ContainerName, "compute") {
+			continue
+		}
+		if vmName, ok := vmNames[host.HostIp]; ok {
+			response.Backends[vmName] = host.HostIp
+		} else {
+			unmanaged[host.HostIp] = true
+		}
+	}
+	for ip := range unmanaged {
+		response.Unmanaged = append(response.Unmanaged, ip)
+	}
+	sort.Strings(response.Unmanaged)
+
+	if len(response.Unmanaged) > 0 {
+		err = fmt.Errorf("%w: %s", errUnmanagedBackends, strings.Join(response.Unmanaged, ", "))
+	} else if len(response.Backends) == 0 {
+		err = fmt.Errorf("no backends found in cluster %s", wekaStatus.Name)
+	}
+	if err != nil {
+		logger.Error().Err(err).Send()
+	}
+	return
+}
+
+// Adopt puts a running cluster, on the vms of the deployment scale sets, under the management of the function app:
+// the credentials are stored in the key vault, the state is clusterized with the cluster size and the vms are
+// protected from scale in, as if the cluster was deployed by the function app
+func Adopt(ctx context.Context, p AdoptParams, body RequestBody, plan *common.DryRunPlan) (response AdoptResponse, err error) {
+	logger := logging.LoggerFromCtx(ctx)
+
+	state, err := common.ReadState(ctx, p.StateStorageName, p.StateContainerName)
+	if err != nil {
+		return
+	}
+	if state.Clusterized {
+		err = errAlreadyClusterized
+		return
+	}
+
+	response, err = getAdoptedBackends(ctx, p, body)
+	if err != nil {
+		return
+	}
+	backendsNum := len(response.Backends)
+
+	secretName := common.WekaPasswordSecretName
+	if common.GetWekaDeploymentUsername(ctx) != "" {
+		secretName = common.WekaDeploymentPasswordSecretName
+	}
+	err = plan.Apply(ctx, fmt.Sprintf("store the password of %s in key vault secret %s", body.Username, secretName), func() error {
+		return common.SetKeyVaultValue(ctx, p.KeyVaultUri, secretName, body.Password)
+	})
+	if err != nil {
+		return
+	}
+
+	vmNames := make([]string, 0, backendsNum)
+	for vmName := range response.Backends {
+		vmNames = append(vmNames, vmName)
+	}
+	sort.Strings(vmNames)
+	for _, vmName := range vmNames {
+		vmName := vmName
+		err = plan.Apply(ctx, fmt.Sprintf("protect vm %s from scale in", vmName), func() error {
+			return common.SetDeletionProtection(
+				ctx, p.SubscriptionId, p.ResourceGroupName, common.GetVmScaleSetNameFromVmName(vmName), common.GetScaleSetVmIndex(vmName), true,
+			)
+		})
+		if err != nil {
+			return
+		}
+	}
+
+	err = plan.Apply(ctx, fmt.Sprintf("set the state of cluster %s as clusterized with %d backends", response.ClusterName, backendsNum), func() error {
+		_, updateErr := common.UpdateState(ctx, p.StateStorageName, p.StateContainerName, func(state *protocol.ClusterState) error {
+			if state.Clusterized {
+				return errAlreadyClusterized
+			}
+			state.Instances = []string{}
+			state.InitialSize = backendsNum
+			state.DesiredSize = backendsNum
+			state.Clusterized = true
+			return nil
+		})
+		return updateErr
+	})
+	if err != nil {
+		return
+	}
+	if plan.Enabled() {
+		return
+	}
+
+	reason := fmt.Sprintf("adopted cluster %s (%s) with %d backends", response.ClusterName, response.ClusterGuid, backendsNum)
+	logger.Info().Msg(reason)
+	common.SetDeploymentPhase(ctx, p.StateStorageName, p.StateContainerName, common.DeploymentPhaseReady, reason)
+	if err := common.DeleteClusterizeResponses(ctx, p.StateStorageName, p.StateContainerName); err != nil {
+		logger.Error().Err(err).Msg("failed to delete clusterize responses")
+	}
+	return
+}
+
+func Handler(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	logger := logging.LoggerFromCtx(ctx)
+
+	p := AdoptParams{
+		SubscriptionId:     common.Getenv(ctx, "SUBSCRIPTION_ID"),
+		ResourceGroupName:  common.Getenv(ctx, "RESOURCE_GROUP_NAME"),
+		StateStorageName:   common.Getenv(ctx, "STATE_STORAGE_NAME"),
+		StateContainerName: common.Getenv(ctx, "STATE_CONTAINER_NAME"),
+		KeyVaultUri:        common.Getenv(ctx, "KEY_VAULT_URI"),
+		Prefix:             common.Getenv(ctx, "PREFIX"),
+		ClusterName:        common.Getenv(ctx, "CLUSTER_NAME"),
+	}
+
+	reqData, err := common.ParseInvokeRequest(r)
+	if err != nil {
+		logger.Error().Msg("Bad request")
+		common.WriteErrorResponse(w, http.StatusBadRequest, fmt.Errorf("cannot decode the request: %v", err))
+		return
+	}
+
+	var data RequestBody
+	if err = json.Unmarshal([]byte(common.GetRequestBody(reqData)), &data); err != nil {
+		logger.Error().Err(err).Msg("cannot unmarshal the request body")
+		common.WriteErrorResponse(w, http.StatusBadRequest, fmt.Errorf("cannot unmarshal the request body: %v", err))
+		return
+	}
+
+	// the functions read the password of this user only
+	username := common.GetWekaDeploymentUsername(ctx)
+	if username == "" {
+		username = common.GetWekaAdminUsername(ctx)
+	}
+	if data.Username == "" {
+		data.Username = username
+	}
+	if len(data.BackendIps) == 0 || data.Password == "" {
+		common.WriteErrorResponse(w, http.StatusBadRequest, fmt.Errorf("backend_ips and password are required"))
+		return
+	}
+	if data.Username != username {
+		common.WriteErrorResponse(w, http.StatusBadRequest, fmt.Errorf("the functions operate the cluster as %s, not %s", username, data.Username))
+		return
+	}
+
+	var plan *common.DryRunPlan
+	if common.IsDryRun(reqData) {
+		plan = &common.DryRunPlan{}
+	}
+	response, err := Adopt(ctx, p, data, plan)
+	if errors.Is(err, errAlreadyClusterized) || errors.Is(err, errUnmanagedBackends) {
+		common.WriteErrorResponse(w, http.StatusConflict, err)
+	} else if err != nil {
+		common.WriteErrorResponse(w, common.GetErrorStatusCode(err), err)
+	} else if plan.Enabled() {
+		common.WriteResponse(w, http.StatusOK, "dry run", plan.Response(""))
+	} else {
+		common.WriteResponse(w, http.StatusOK, fmt.Sprintf("cluster %s adopted", response.ClusterName), response)
+	}
+}
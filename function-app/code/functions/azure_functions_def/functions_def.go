@@ -1,23 +1,56 @@
 package azure_functions_def
 
 import (
+	"context"
 	"fmt"
+	"net/url"
+	"weka-deployment/common"
 
 	"github.com/weka/go-cloud-lib/functions_def"
 )
 
+// azure specific functions, in addition to the ones defined in functions_def
+const (
+	MaintenanceWindow  functions_def.FunctionName = "maintenance_window"
+	ClusterizeSegments functions_def.FunctionName = "clusterize_segments"
+)
+
 type AzureFuncDef struct {
 	baseFunctionUrl string
 	functionKey     string
+	// the settings of the invocation generating the script
+	instanceAuthAudience string
+	privateNetwork       bool
+	scriptSigning        bool
 }
 
-func NewFuncDef(baseFunctionUrl, functionKey string) functions_def.FunctionDef {
+func NewFuncDef(ctx context.Context, baseFunctionUrl, functionKey string) functions_def.FunctionDef {
 	return &AzureFuncDef{
-		baseFunctionUrl: baseFunctionUrl,
-		functionKey:     functionKey,
+		baseFunctionUrl:      baseFunctionUrl,
+		functionKey:          functionKey,
+		instanceAuthAudience: common.GetInstanceAuthAudience(ctx),
+		privateNetwork:       common.IsPrivateNetwork(ctx),
+		scriptSigning:        common.IsScriptSigningEnabled(ctx),
 	}
 }
 
+// getInstanceAuthHeader returns the curl header carrying the vm managed identity token, checked by the function app
+// when the instance authentication is enabled
+func getInstanceAuthHeader(audience string) string {
+	tokenUrl := "http://169.254.169.254/metadata/identity/oauth2/token?api-version=2018-02-01&resource=" + url.QueryEscape(audience)
+	return fmt.Sprintf(`-H "Authorization: Bearer $(curl -s -H Metadata:true --noproxy '*' '%s' | jq -r .access_token)"`, tokenUrl)
+}
+
+// getCurlOptions returns the options of the functions calls, the function app of a private network is reached
+// through its private endpoint and never through the vms proxy
+func (d *AzureFuncDef) getCurlOptions() string {
+	options := getInstanceAuthHeader(d.instanceAuthAudience)
+	if functionUrl, err := url.Parse(d.baseFunctionUrl); err == nil && d.privateNetwork {
+		options += fmt.Sprintf(" --noproxy '%s'", functionUrl.Hostname())
+	}
+	return options
+}
+
 // each function takes json payload as an argument
 // e.g. "{\"hostname\": \"$HOSTNAME\", \"type\": \"$message_type\", \"message\": \"$message\"}"
 func (d *AzureFuncDef) GetFunctionCmdDefinition(name functions_def.FunctionName) string {
@@ -30,14 +63,61 @@ func (d *AzureFuncDef) GetFunctionCmdDefinition(name functions_def.FunctionName)
 		}
 		`
 		funcDef = fmt.Sprintf(funcDefTemplate, name, name)
+	} else if name == functions_def.Report {
+		// reports are enriched with the instance name and the script phase (REPORT_PHASE) for the deployment timeline
+		funcDefTemplate := `
+		function %s {
+			local json_data=$1
+			REPORT_INSTANCE=${REPORT_INSTANCE:-$(curl -s -H Metadata:true --noproxy '*' 'http://169.254.169.254/metadata/instance/compute/name?api-version=2021-02-01&format=text')}
+			json_data=$(echo "$json_data" | jq -c --arg instance "$REPORT_INSTANCE" --arg phase "${REPORT_PHASE:-}" '. + {instance: $instance, phase: $phase}' || echo "$json_data")
+			curl %s?code=%s %s -H 'Content-Type:application/json' -d "$json_data"
+		}
+		`
+		funcDef = fmt.Sprintf(funcDefTemplate, name, functionUrl, d.functionKey, d.getCurlOptions())
+	} else if (name == functions_def.Clusterize || name == functions_def.Deploy) && d.scriptSigning {
+		// the returned script is printed only when its signature is verified with the public key of the custom data
+		funcDefTemplate := `
+		function %s {
+			local json_data=$1
+			local script_file headers_file signature
+			script_file=$(mktemp)
+			headers_file=$(mktemp)
+			curl %s?code=%s %s -H 'Content-Type:application/json' -d "$json_data" -D "$headers_file" -o "$script_file"
+			signature=$(grep -i '^%s:' "$headers_file" | cut -d' ' -f2 | tr -d '\r')
+			if %s "$script_file" "$signature"; then
+				cat "$script_file"
+			else
+				echo 'echo "%s script signature verification failed" >&2; exit 1'
+			fi
+			rm -f "$script_file" "$headers_file"
+		}
+		`
+		funcDef = fmt.Sprintf(
+			funcDefTemplate, name, functionUrl, d.functionKey, d.getCurlOptions(), common.ScriptSignatureHeader, common.ScriptVerifierPath, name,
+		)
+	} else if name == MaintenanceWindow {
+		// the maintenance window script is returned in the data of the json response, it is printed to be run by the caller
+		funcDefTemplate := `
+		function %s {
+			local json_data=$1
+			local response
+			response=$(curl %s?code=%s %s -H 'Content-Type:application/json' -d "$json_data")
+			if ! echo "$response" | jq -e '.data' >/dev/null; then
+				echo "%s failed: $(echo "$response" | jq -r '.message' 2>/dev/null || echo "$response")" >&2
+				return 1
+			fi
+			echo "$response" | jq -r '.data'
+		}
+		`
+		funcDef = fmt.Sprintf(funcDefTemplate, name, functionUrl, d.functionKey, d.getCurlOptions(), name)
 	} else {
 		funcDefTemplate := `
 		function %s {
 			local json_data=$1
-			curl %s?code=%s -H 'Content-Type:application/json' -d "$json_data"
+			curl %s?code=%s %s -H 'Content-Type:application/json' -d "$json_data"
 		}
 		`
-		funcDef = fmt.Sprintf(funcDefTemplate, name, functionUrl, d.functionKey)
+		funcDef = fmt.Sprintf(funcDefTemplate, name, functionUrl, d.functionKey, d.getCurlOptions())
 	}
 
 	return funcDef
@@ -0,0 +1,157 @@
+package client_join_info
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"sort"
+	"time"
+	"weka-deployment/common"
+	"weka-deployment/functions/status"
+
+	"github.com/weka/go-cloud-lib/lib/weka"
+	"github.com/weka/go-cloud-lib/logging"
+)
+
+var errNotClusterized = errors.New("cluster is not clusterized yet")
+
+// ClientCredential is a short-lived weka access token of the client user, clients save it to a file and mount
+// with -o auth_token_path=<file>
+type ClientCredential struct {
+	Username    string    `json:"username"`
+	AccessToken string    `json:"access_token"`
+	TokenType   string    `json:"token_type"`
+	ExpiresAt   time.Time `json:"expires_at"`
+}
+
+// ClientJoinInfo is what a weka client needs to install the agent from a backend and mount the filesystems
+type ClientJoinInfo struct {
+	ClusterName string   `json:"cluster_name"`
+	BackendIps  []string `json:"backend_ips"`
+	// nil when no client user is configured, the clients then mount without authentication
+	Credential *ClientCredential `json:"credential,omitempty"`
+	// the -o options of the default filesystem mount, writecache when the default filesystem was created for it
+	MountOptions []string `json:"mount_options,omitempty"`
+}
+
+type JoinInfoParams struct {
+	SubscriptionId     string
+	ResourceGroupName  string
+	StateStorageName   string
+	StateContainerName string
+	KeyVaultUri        string
+	Prefix             string
+	ClusterName        string
+}
+
+// getClientCredential logs in as the client user, its refresh token is not handed out so the credential expires
+func getClientCredential(ctx context.Context, p JoinInfoParams, vmScaleSetNames []string) (credential *ClientCredential, err error) {
+	logger := logging.LoggerFromCtx(ctx)
+
+	username := common.GetWekaClientUsername(ctx)
+	if username == "" {
+		return
+	}
+	password, err := common.GetKeyVaultValue(ctx, p.KeyVaultUri, common.WekaClientPasswordSecretName)
+	if err != nil {
+		err = fmt.Errorf("failed to get the client user password: %w", err)
+		logger.Error().Err(err).Send()
+		return
+	}
+
+	jpool, err := status.GetScaleSetsJrpcPool(ctx, p.SubscriptionId, p.ResourceGroupName, vmScaleSetNames, p.KeyVaultUri)
+	if err != nil {
+		return
+	}
+	var token struct {
+		AccessToken  string `json:"access_token"`
+		ExpiresInSec int    `json:"expires_in"`
+		TokenType    string `json:"token_type"`
+	}
+	err = jpool.Call(weka.JrpcMethod("user_login"), []string{username, password}, &token)
+	if err != nil {
+		err = fmt.Errorf("client user %s login failed: %w", username, err)
+		logger.Error().Err(err).Send()
+		return
+	}
+	credential = &ClientCredential{
+		Username:    username,
+		AccessToken: token.AccessToken,
+		TokenType:   token.TokenType,
+		ExpiresAt:   time.Now().UTC().Add(time.Duration(token.ExpiresInSec) * time.Second),
+	}
+	return
+}
+
+func GetClientJoinInfo(ctx context.Context, p JoinInfoParams) (info ClientJoinInfo, err error) {
+	state, err := common.ReadState(ctx, p.StateStorageName, p.StateContainerName)
+	if err != nil {
+		return
+	}
+	if !state.Clusterized {
+		err = errNotClusterized
+		return
+	}
+
+	vmScaleSetNames := common.GetVmScaleSetNames(ctx, p.Prefix, p.ClusterName)
+	vmsPrivateIps, err := common.GetScaleSetsVmsPrivateIps(ctx, p.SubscriptionId, p.ResourceGroupName, vmScaleSetNames)
+	if err != nil {
+		return
+	}
+	// evicted spot vms may still be listed until azure deletes them, the idle warm pool vms are not in the cluster
+	evictions, err := common.GetEvictions(ctx, p.StateStorageName, p.StateContainerName)
+	if err != nil {
+		return
+	}
+	warmPool, err := common.GetWarmPool(ctx, p.StateStorageName, p.StateContainerName)
+	if err != nil {
+		return
+	}
+
+	info.ClusterName = p.ClusterName
+	info.BackendIps = []string{}
+	for vmName, ip := range vmsPrivateIps {
+		if _, evicted := evictions[vmName]; !evicted && !warmPool.IsIdle(vmName) {
+			info.BackendIps = append(info.BackendIps, ip)
+		}
+	}
+	sort.Strings(info.BackendIps)
+
+	if common.Getenv(ctx, "DEFAULT_FS_WRITECACHE_CONFIG") != "" {
+		info.MountOptions = []string{"writecache"}
+	}
+
+	info.Credential, err = getClientCredential(ctx, p, vmScaleSetNames)
+	return
+}
+
+func Handler(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	logger := logging.LoggerFromCtx(ctx)
+
+	if _, err := common.ParseInvokeRequest(r); err != nil {
+		logger.Error().Msg("Bad request")
+		common.WriteErrorResponse(w, http.StatusBadRequest, fmt.Errorf("cannot decode the request: %v", err))
+		return
+	}
+
+	p := JoinInfoParams{
+		SubscriptionId:     common.Getenv(ctx, "SUBSCRIPTION_ID"),
+		ResourceGroupName:  common.Getenv(ctx, "RESOURCE_GROUP_NAME"),
+		StateStorageName:   common.Getenv(ctx, "STATE_STORAGE_NAME"),
+		StateContainerName: common.Getenv(ctx, "STATE_CONTAINER_NAME"),
+		KeyVaultUri:        common.Getenv(ctx, "KEY_VAULT_URI"),
+		Prefix:             common.Getenv(ctx, "PREFIX"),
+		ClusterName:        common.Getenv(ctx, "CLUSTER_NAME"),
+	}
+	info, err := GetClientJoinInfo(ctx, p)
+	if errors.Is(err, errNotClusterized) {
+		common.WriteErrorResponse(w, http.StatusConflict, err)
+		return
+	} else if err != nil {
+		common.WriteErrorResponse(w, common.GetErrorStatusCode(err), err)
+		return
+	}
+	common.WriteResponse(w, http.StatusOK, fmt.Sprintf("%d backends", len(info.BackendIps)), info)
+}
@@ -0,0 +1,34 @@
+package clusterization_timeout
+
+import (
+	"encoding/json"
+	"net/http"
+	"weka-deployment/common"
+	"weka-deployment/functions/clusterize"
+
+	"github.com/weka/go-cloud-lib/logging"
+)
+
+func Handler(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	logger := logging.LoggerFromCtx(ctx)
+
+	var invokeRequest common.InvokeRequest
+	if err := json.NewDecoder(r.Body).Decode(&invokeRequest); err != nil {
+		logger.Error().Msg("Bad request")
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	if params, err := clusterize.GetClusterizationParams(ctx, ""); err != nil {
+		logger.Error().Err(err).Msg("clusterization timeout check failed")
+	} else if err = clusterize.CheckClusterizationTimeout(ctx, params); err != nil {
+		logger.Error().Err(err).Msg("clusterization timeout check failed")
+	}
+
+	invokeResponse := common.InvokeResponse{Outputs: map[string]interface{}{}, Logs: nil, ReturnValue: nil}
+	responseJson, _ := json.Marshal(invokeResponse)
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(responseJson)
+}
@@ -0,0 +1,73 @@
+package clusterize
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"time"
+	"weka-deployment/common"
+
+	"github.com/weka/go-cloud-lib/logging"
+)
+
+const (
+	auditRetentionDays = 365
+	redactedValue      = common.RedactedValue
+)
+
+// redactClusterizationParams returns a copy of the params that is safe to persist
+func redactClusterizationParams(params ClusterizationParams) ClusterizationParams {
+	// obs list is copied, the original params keep the keys
+	params.Obs = append([]AzureObsParams(nil), params.Obs...)
+	for i := range params.Obs {
+		redactValue(&params.Obs[i].AccessKey)
+		redactValue(&params.Obs[i].SasToken)
+		redactValue(&params.Obs[i].ServicePrincipalClientSecret)
+	}
+	redactValue(&params.Cluster.WekaPassword)
+	// the obs script embeds the obs credentials
+	redactValue(&params.Cluster.ObsScript)
+	// the configs are copied before they're redacted, the original params keep the secrets
+	if params.SmbDomainJoinConfig != nil {
+		smbDomainJoinConfig := *params.SmbDomainJoinConfig
+		redactValue(&smbDomainJoinConfig.Password)
+		params.SmbDomainJoinConfig = &smbDomainJoinConfig
+	}
+	return params
+}
+
+func redactValue(value *string) {
+	if *value != "" {
+		*value = redactedValue
+	}
+}
+
+// WriteDeploymentAudit uploads the (redacted) deployment configuration and its sha256 to blobs protected by a
+// time based immutability policy, the container must have version-level immutability enabled
+func WriteDeploymentAudit(ctx context.Context, storageAccountName, containerName string, params ClusterizationParams) error {
+	logger := logging.LoggerFromCtx(ctx)
+
+	auditConfig, err := json.Marshal(redactClusterizationParams(params))
+	if err != nil {
+		return fmt.Errorf("failed to serialize deployment audit config: %w", err)
+	}
+	hash := sha256.Sum256(auditConfig)
+
+	now := time.Now().UTC()
+	blobName := fmt.Sprintf("deployment-audit/%s-%s", params.Cluster.ClusterName, now.Format("20060102T150405Z"))
+	retainUntil := now.AddDate(0, 0, auditRetentionDays)
+
+	err = common.WriteImmutableBlob(ctx, storageAccountName, containerName, blobName+".json", auditConfig, retainUntil)
+	if err != nil {
+		return fmt.Errorf("failed to upload deployment audit config: %w", err)
+	}
+	checksum := fmt.Sprintf("%s  deployment.json\n", hex.EncodeToString(hash[:]))
+	err = common.WriteImmutableBlob(ctx, storageAccountName, containerName, blobName+".sha256", []byte(checksum), retainUntil)
+	if err != nil {
+		return fmt.Errorf("failed to upload deployment audit checksum: %w", err)
+	}
+	logger.Info().Msgf("deployment audit uploaded to %s%s/%s", common.GetBlobUrl(storageAccountName), containerName, blobName)
+	return nil
+}
@@ -0,0 +1,184 @@
+package clusterize
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+	"weka-deployment/common"
+	"weka-deployment/functions/azure_functions_def"
+
+	"github.com/weka/go-cloud-lib/logging"
+	"github.com/weka/go-cloud-lib/protocol"
+)
+
+var (
+	ErrAlreadyClusterized = errors.New("cluster is already clusterized")
+	ErrTooFewInstances    = errors.New("too few instances are ready for clusterization")
+	// all the instances called clusterize, the last one runs the clusterization
+	ErrAllInstancesReady = errors.New("all the instances are ready for clusterization")
+)
+
+// getClusterizationTimeout returns CLUSTERIZATION_TIMEOUT_MINUTES, 0 waits forever for all the instances
+func getClusterizationTimeout(ctx context.Context) time.Duration {
+	minutes, _ := strconv.Atoi(common.Getenv(ctx, "CLUSTERIZATION_TIMEOUT_MINUTES"))
+	if minutes <= 0 {
+		return 0
+	}
+	return time.Duration(minutes) * time.Minute
+}
+
+// getRequiredHostsNum returns the number of backends the data protection requires
+func getRequiredHostsNum(p ClusterizationParams) int {
+	dataProtection := p.Cluster.DataProtection
+	return dataProtection.StripeWidth + dataProtection.ProtectionLevel + dataProtection.Hotspare
+}
+
+// getClusterizationMinHosts returns CLUSTERIZATION_MIN_HOSTS, never fewer than the backends the data protection
+// requires
+func getClusterizationMinHosts(ctx context.Context, p ClusterizationParams) int {
+	minHosts, _ := strconv.Atoi(common.Getenv(ctx, "CLUSTERIZATION_MIN_HOSTS"))
+	if requiredHostsNum := getRequiredHostsNum(p); minHosts < requiredHostsNum {
+		return requiredHostsNum
+	}
+	return minHosts
+}
+
+// ForceClusterize clusterizes the instances which called clusterize so far, without waiting for the others. The
+// clusterization script runs on the last of them, the instances calling clusterize afterwards are shut down until
+// the cluster is clusterized, they join it then
+func ForceClusterize(ctx context.Context, p ClusterizationParams, reason string) (vmName string, err error) {
+	logger := logging.LoggerFromCtx(ctx)
+
+	state, err := common.ReadState(ctx, p.StateStorageName, p.StateContainerName)
+	if err != nil {
+		return
+	}
+	checkInstances := func(state *protocol.ClusterState) error {
+		if state.Clusterized {
+			return ErrAlreadyClusterized
+		}
+		if len(state.Instances) >= state.InitialSize {
+			return fmt.Errorf("%w, the last one runs the clusterization", ErrAllInstancesReady)
+		}
+		if requiredHostsNum := getRequiredHostsNum(p); len(state.Instances) == 0 || len(state.Instances) < requiredHostsNum {
+			return fmt.Errorf("%w: %d instances are ready, the data protection requires %d", ErrTooFewInstances, len(state.Instances), requiredHostsNum)
+		}
+		return nil
+	}
+	if err = checkInstances(&state); err != nil {
+		logger.Error().Err(err).Send()
+		return
+	}
+
+	// the cluster size is limited to the instances ready, so no other instance is added while they are clusterized
+	err = p.DryRun.Apply(ctx, fmt.Sprintf("limit the initial cluster size to the %d instances ready", len(state.Instances)), func() (updateErr error) {
+		state, updateErr = common.UpdateState(ctx, p.StateStorageName, p.StateContainerName, func(state *protocol.ClusterState) error {
+			if err := checkInstances(state); err != nil {
+				return err
+			}
+			state.InitialSize = len(state.Instances)
+			return nil
+		})
+		return
+	})
+	if err != nil {
+		logger.Error().Err(err).Send()
+		return
+	}
+
+	lastInstance := state.Instances[len(state.Instances)-1]
+	vmName = strings.Split(lastInstance, ":")[0]
+	p.VmName = lastInstance
+	p.Cluster.HostsNum = len(state.Instances)
+	logger.Info().Msgf("Clusterizing %d instances on %s: %s", len(state.Instances), vmName, reason)
+
+	if !p.DryRun.Enabled() {
+		_, err = common.TransitionDeploymentPhase(ctx, p.StateStorageName, p.StateContainerName, common.DeploymentPhaseClusterizing, reason)
+		if err != nil {
+			return
+		}
+	}
+
+	functionAppKey, err := common.GetKeyVaultValue(ctx, p.KeyVaultUri, "function-app-default-key")
+	if err != nil {
+		return
+	}
+	funcDef := azure_functions_def.NewFuncDef(ctx, common.GetFunctionAppBaseUrl(p.FunctionAppName), functionAppKey)
+
+	clusterizeScript, err := HandleLastClusterVm(ctx, state, p, funcDef)
+	if err == nil && p.FrontDoorConfig != nil {
+		var frontDoorScript string
+		frontDoorScript, err = getFrontDoorScript(ctx, p)
+		clusterizeScript += frontDoorScript
+	}
+	if err == nil {
+		err = p.DryRun.Apply(ctx, fmt.Sprintf("run the clusterization script on %s", vmName), func() error {
+			_, runErr := common.StartScaleSetVmRunCommand(
+				ctx, p.SubscriptionId, p.ResourceGroupName, common.GetVmScaleSetNameFromVmName(vmName), common.GetScaleSetVmIndex(vmName), clusterizeScript,
+			)
+			return runErr
+		})
+	}
+	if err != nil {
+		common.TrackEvent(ctx, common.EventClusterizeFailed, map[string]string{
+			"cluster_name": p.Cluster.ClusterName,
+			"vm_name":      vmName,
+			"error":        err.Error(),
+		})
+		common.Notify(ctx, common.NotificationSeverityCritical, common.NotificationClusterizeFailed, err.Error(), map[string]string{
+			"vm_name": vmName,
+		})
+		if !p.DryRun.Enabled() {
+			common.SetDeploymentPhase(ctx, p.StateStorageName, p.StateContainerName, common.DeploymentPhaseError, err.Error())
+		}
+	}
+	return
+}
+
+// CheckClusterizationTimeout clusterizes the instances ready when the collection took longer than
+// CLUSTERIZATION_TIMEOUT_MINUTES, when there are at least CLUSTERIZATION_MIN_HOSTS of them. The deployment fails
+// otherwise, an instance calling clusterize afterwards resumes the collection
+func CheckClusterizationTimeout(ctx context.Context, p ClusterizationParams) (err error) {
+	logger := logging.LoggerFromCtx(ctx)
+
+	timeout := getClusterizationTimeout(ctx)
+	if timeout == 0 {
+		return
+	}
+
+	state, err := common.ReadState(ctx, p.StateStorageName, p.StateContainerName)
+	if err != nil || state.Clusterized || len(state.Instances) == 0 {
+		return
+	}
+	phase, err := common.GetDeploymentPhase(ctx, p.StateStorageName, p.StateContainerName)
+	if err != nil {
+		return
+	}
+	// the phase start is set by the first clusterize call
+	if phase.Phase != common.DeploymentPhaseCollecting || phase.StartedAt.IsZero() || time.Since(phase.StartedAt) < timeout {
+		return
+	}
+
+	readyMsg := fmt.Sprintf("%d/%d instances called clusterize within %s", len(state.Instances), p.Cluster.HostsNum, timeout)
+	minHosts := getClusterizationMinHosts(ctx, p)
+	if len(state.Instances) < minHosts {
+		err = fmt.Errorf("clusterization timed out, %s, at least %d are required", readyMsg, minHosts)
+		logger.Error().Err(err).Send()
+		common.TrackEvent(ctx, common.EventClusterizeFailed, map[string]string{
+			"cluster_name": p.Cluster.ClusterName,
+			"error":        err.Error(),
+		})
+		common.Notify(ctx, common.NotificationSeverityCritical, common.NotificationClusterizeFailed, err.Error(), nil)
+		common.SetDeploymentPhase(ctx, p.StateStorageName, p.StateContainerName, common.DeploymentPhaseError, err.Error())
+		return
+	}
+
+	msg := fmt.Sprintf("clusterization timed out, %s, clusterizing them", readyMsg)
+	logger.Warn().Msg(msg)
+	common.Notify(ctx, common.NotificationSeverityWarning, common.NotificationClusterizeTimedOut, msg, nil)
+	_, err = ForceClusterize(ctx, p, msg)
+	return
+}
@@ -3,11 +3,13 @@ package clusterize
 import (
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"net/http"
-	"os"
+	"sort"
 	"strconv"
 	"strings"
+	"time"
 	"weka-deployment/common"
 	"weka-deployment/functions/azure_functions_def"
 
@@ -16,39 +18,299 @@ import (
 	"github.com/weka/go-cloud-lib/clusterize"
 	cloudCommon "github.com/weka/go-cloud-lib/common"
 	"github.com/weka/go-cloud-lib/functions_def"
+	"github.com/weka/go-cloud-lib/lib/weka"
 	"github.com/weka/go-cloud-lib/logging"
 	"github.com/weka/go-cloud-lib/protocol"
 )
 
+const (
+	ObsAuthMethodAccessKey       = "access_key"
+	ObsAuthMethodManagedIdentity = "managed_identity"
+	// sas token and service principal auth are for existing storage accounts, their keys are never read
+	ObsAuthMethodSasToken         = "sas_token"
+	ObsAuthMethodServicePrincipal = "service_principal"
+)
+
+const (
+	// the serial drives add of the coordinator takes too long for larger clusters
+	defaultSegmentThreshold = 100
+	// the coordinator adds the drives of the backends which didn't add them within the timeout
+	defaultSegmentTimeoutMinutes = 15
+)
+
 type AzureObsParams struct {
-	Name              string
-	ContainerName     string
-	AccessKey         string
-	TieringSsdPercent string
+	Name              string `json:"name"`
+	ContainerName     string `json:"container_name"`
+	AccessKey         string `json:"access_key"`
+	TieringSsdPercent string `json:"tiering_ssd_percent"`
+	// filesystem tiered to this obs, "default" when empty
+	FsName string `json:"fs_name"`
+	// access_key (default), managed_identity, sas_token or service_principal
+	AuthMethod string `json:"auth_method"`
+	// client id of a user assigned identity, the scale set system assigned identity is used when empty
+	ManagedIdentityClientId string `json:"managed_identity_client_id"`
+	// the storage account and container already exist, they are neither created nor locked
+	ExistingStorageAccount bool `json:"existing_storage_account"`
+	// container sas token, it must allow read, add, create, write, delete and list
+	SasToken                     string `json:"sas_token"`
+	ServicePrincipalTenantId     string `json:"service_principal_tenant_id"`
+	ServicePrincipalClientId     string `json:"service_principal_client_id"`
+	ServicePrincipalClientSecret string `json:"service_principal_client_secret"`
+	// when set, a created storage account is reachable only through a private endpoint in this subnet
+	PrivateEndpointSubnetId string `json:"private_endpoint_subnet_id"`
+	PrivateDnsZoneId        string `json:"private_dns_zone_id"`
+	// Hot (default), Cool or Cold, tiered blobs are moved to the tier after access_tier_after_days without modification
+	AccessTier          string `json:"access_tier"`
+	AccessTierAfterDays int    `json:"access_tier_after_days"`
+	// when set, a created storage account is encrypted with this key vault key
+	CustomerManagedKey *common.StorageCustomerManagedKey `json:"customer_managed_key"`
+}
+
+const defaultFsName = "default"
+
+// ObsTieringPolicy sets the default filesystem group, all the tiered filesystems belong to it. Zero keeps the weka default
+type ObsTieringPolicy struct {
+	// seconds data is kept on ssd after it was tiered to the obs, the drive retention period (--target-ssd-retention)
+	DriveRetentionPeriodSeconds int `json:"drive_retention_period_seconds"`
+	// seconds data is kept on ssd before it is tiered to the obs, the tiering cue (--start-demote)
+	TieringCueSeconds int `json:"tiering_cue_seconds"`
+}
+
+func validateObsTieringPolicy(policy ObsTieringPolicy) error {
+	if policy.DriveRetentionPeriodSeconds < 0 || policy.TieringCueSeconds < 0 {
+		return fmt.Errorf("obs drive retention period and tiering cue must not be negative")
+	}
+	// data must be tiered before it is released from the ssd
+	if policy.DriveRetentionPeriodSeconds > 0 && policy.TieringCueSeconds >= policy.DriveRetentionPeriodSeconds {
+		return fmt.Errorf("obs tiering cue %ds must be shorter than the drive retention period %ds", policy.TieringCueSeconds, policy.DriveRetentionPeriodSeconds)
+	}
+	return nil
+}
+
+func getObsTieringPolicyCmd(policy ObsTieringPolicy) string {
+	var flags string
+	if policy.DriveRetentionPeriodSeconds > 0 {
+		flags += fmt.Sprintf(" --target-ssd-retention %d", policy.DriveRetentionPeriodSeconds)
+	}
+	if policy.TieringCueSeconds > 0 {
+		flags += fmt.Sprintf(" --start-demote %d", policy.TieringCueSeconds)
+	}
+	if flags == "" {
+		return ""
+	}
+	return fmt.Sprintf("weka fs group update default%s\n", flags)
+}
+
+func getObsFsName(obsParams AzureObsParams) string {
+	if obsParams.FsName == "" {
+		return defaultFsName
+	}
+	return obsParams.FsName
+}
+
+// getTieredFsNames returns the filesystems an obs is attached to, the filesystems of the obs and the declared
+// filesystems with tiering
+func getTieredFsNames(p ClusterizationParams) (fsNames []string) {
+	tiered := make(map[string]bool)
+	for _, obsParams := range p.Obs {
+		tiered[getObsFsName(obsParams)] = true
+	}
+	for _, fs := range p.Filesystems {
+		if fs.TieringSsdPercent > 0 {
+			tiered[fs.Name] = true
+		}
+	}
+	for fsName := range tiered {
+		fsNames = append(fsNames, fsName)
+	}
+	sort.Strings(fsNames)
+	return
+}
+
+func isExistingStorageAccount(obsParams AzureObsParams) bool {
+	return obsParams.ExistingStorageAccount || obsParams.AuthMethod == ObsAuthMethodSasToken || obsParams.AuthMethod == ObsAuthMethodServicePrincipal
+}
+
+func validateObsAuth(obsParams AzureObsParams) error {
+	switch obsParams.AuthMethod {
+	case ObsAuthMethodAccessKey, "":
+		// the key of a created storage account is retrieved, an existing one must come with its key
+		if obsParams.ExistingStorageAccount && obsParams.AccessKey == "" {
+			return fmt.Errorf("obs %s: access key is required for an existing storage account", obsParams.Name)
+		}
+	case ObsAuthMethodManagedIdentity:
+	case ObsAuthMethodSasToken:
+		if obsParams.SasToken == "" {
+			return fmt.Errorf("obs %s: sas token is required for %s auth", obsParams.Name, ObsAuthMethodSasToken)
+		}
+	case ObsAuthMethodServicePrincipal:
+		if obsParams.ServicePrincipalTenantId == "" || obsParams.ServicePrincipalClientId == "" || obsParams.ServicePrincipalClientSecret == "" {
+			return fmt.Errorf("obs %s: tenant id, client id and client secret are required for %s auth", obsParams.Name, ObsAuthMethodServicePrincipal)
+		}
+	default:
+		return fmt.Errorf("obs %s: invalid auth method %s, allowed: %s, %s, %s, %s", obsParams.Name, obsParams.AuthMethod,
+			ObsAuthMethodAccessKey, ObsAuthMethodManagedIdentity, ObsAuthMethodSasToken, ObsAuthMethodServicePrincipal)
+	}
+	return nil
+}
+
+// each filesystem can be tiered to a single local obs
+func validateObsParams(obsParamsList []AzureObsParams) error {
+	fsNames := make(map[string]bool)
+	for _, obsParams := range obsParamsList {
+		fsName := getObsFsName(obsParams)
+		if fsNames[fsName] {
+			return fmt.Errorf("filesystem %s is set for more than one obs", fsName)
+		}
+		fsNames[fsName] = true
+		if err := common.ValidateBlobAccessTier(obsParams.AccessTier); err != nil {
+			return err
+		}
+		if err := validateObsAuth(obsParams); err != nil {
+			return err
+		}
+		if obsParams.CustomerManagedKey != nil {
+			// the encryption of an existing storage account is managed by its owner
+			if isExistingStorageAccount(obsParams) {
+				return fmt.Errorf("obs %s: customer managed key is set for an existing storage account", obsParams.Name)
+			}
+			if err := common.ValidateStorageCustomerManagedKey(*obsParams.CustomerManagedKey); err != nil {
+				return fmt.Errorf("obs %s: %w", obsParams.Name, err)
+			}
+		}
+	}
+	return nil
+}
+
+// GetObsScript attaches each obs to its filesystem, the ssd capacity of the default filesystem is split evenly
+// between all tiered filesystems, filesystems other than default are created tiered. The tiering policy is set
+// once, on the filesystem group of all the filesystems
+func GetObsScript(obsParamsList []AzureObsParams, tieringPolicy ObsTieringPolicy) string {
+	fsCount := 1
+	for _, obsParams := range obsParamsList {
+		if getObsFsName(obsParams) != defaultFsName {
+			fsCount++
+		}
+	}
+
+	template := `
+	OBS_FS_COUNT=%d
+	fs_ssd_capacity=$(echo "$full_capacity / $OBS_FS_COUNT" | bc)
+	if [[ $OBS_FS_COUNT -gt 1 ]]; then
+		weka fs update default --ssd-capacity "$fs_ssd_capacity"B
+	fi
+	`
+	obsScript := fmt.Sprintf(dedent.Dedent(template), fsCount) + getObsTieringPolicyCmd(tieringPolicy)
+
+	for i, obsParams := range obsParamsList {
+		obsScript += getSingleObsScript(obsParams, i)
+	}
+	return obsScript
 }
 
-func GetObsScript(obsParams AzureObsParams) string {
+// the first obs keeps the names used before multiple obs were supported
+func getObsNames(index int) (tierName, localObsName string) {
+	if index == 0 {
+		return "azure-obs", "default-local"
+	}
+	tierName = fmt.Sprintf("azure-obs-%d", index)
+	return tierName, tierName + "-local"
+}
+
+func getSingleObsScript(obsParams AzureObsParams, index int) string {
+	tierName, localObsName := getObsNames(index)
+	fsName := getObsFsName(obsParams)
+
+	attachTemplate := `
+	weka fs tier s3 attach default %s
+	weka fs update default --total-capacity "$tiering_capacity"B
+	`
+	if fsName != defaultFsName {
+		attachTemplate = `
+		weka fs create "$OBS_FS_NAME" default "$tiering_capacity"B --ssd-capacity "$fs_ssd_capacity"B --obs-name %s
+		`
+	}
+
 	template := `
 	TIERING_SSD_PERCENT=%s
 	OBS_NAME=%s
 	OBS_CONTAINER_NAME=%s
-	OBS_BLOB_KEY=%s
+	OBS_FS_NAME=%s
 
-	weka fs tier s3 add azure-obs --site local --obs-name default-local --obs-type AZURE --hostname $OBS_NAME.blob.core.windows.net --port 443 --bucket $OBS_CONTAINER_NAME --access-key-id $OBS_NAME --secret-key $OBS_BLOB_KEY --protocol https --auth-method AWSSignature4
-	weka fs tier s3 attach default azure-obs
-	tiering_percent=$(echo "$full_capacity * 100 / $TIERING_SSD_PERCENT" | bc)
-	weka fs update default --total-capacity "$tiering_percent"B
+	%s
+	tiering_capacity=$(echo "$fs_ssd_capacity * 100 / $TIERING_SSD_PERCENT" | bc)
+	%s
 	`
 	return fmt.Sprintf(
-		dedent.Dedent(template), obsParams.TieringSsdPercent, obsParams.Name, obsParams.ContainerName, obsParams.AccessKey,
+		dedent.Dedent(template), obsParams.TieringSsdPercent, obsParams.Name, obsParams.ContainerName, fsName,
+		getObsTierAddCmd(obsParams, tierName, localObsName), fmt.Sprintf(dedent.Dedent(attachTemplate), tierName),
 	)
 }
 
-func GetWekaDebugOverrideCmds() string {
+func getObsHostname(obsParams AzureObsParams) string {
+	return common.GetBlobHostname("$OBS_NAME", obsParams.PrivateEndpointSubnetId != "")
+}
+
+func getObsTierAddCmd(obsParams AzureObsParams, tierName, localObsName string) string {
+	tierAddCmd := fmt.Sprintf("weka fs tier s3 add %s --site local --obs-name %s --obs-type AZURE --hostname %s --port 443 --bucket $OBS_CONTAINER_NAME --protocol https", tierName, localObsName, getObsHostname(obsParams))
+	switch obsParams.AuthMethod {
+	case ObsAuthMethodManagedIdentity:
+		// the identity is granted "Storage Blob Data Contributor" on the container, no storage account key is involved
+		tierAddCmd += " --auth-method AzureManagedIdentity"
+		if obsParams.ManagedIdentityClientId != "" {
+			tierAddCmd += fmt.Sprintf(" --azure-client-id %s", obsParams.ManagedIdentityClientId)
+		}
+		return tierAddCmd
+	case ObsAuthMethodSasToken:
+		// the token query string holds '&', it must stay quoted
+		return fmt.Sprintf("OBS_SAS_TOKEN='%s'\n%s --access-key-id $OBS_NAME --secret-key \"$OBS_SAS_TOKEN\" --auth-method AzureSAS", obsParams.SasToken, tierAddCmd)
+	case ObsAuthMethodServicePrincipal:
+		return fmt.Sprintf("OBS_CLIENT_SECRET='%s'\n%s --auth-method AzureServicePrincipal --azure-tenant-id %s --azure-client-id %s --secret-key \"$OBS_CLIENT_SECRET\"",
+			obsParams.ServicePrincipalClientSecret, tierAddCmd, obsParams.ServicePrincipalTenantId, obsParams.ServicePrincipalClientId)
+	}
+	return fmt.Sprintf("OBS_BLOB_KEY=%s\n%s --access-key-id $OBS_NAME --secret-key $OBS_BLOB_KEY --auth-method AWSSignature4", obsParams.AccessKey, tierAddCmd)
+}
+
+// filesystems names must not collide with the default filesystem or the filesystems created by the obs script
+func validateFilesystems(filesystems []WekaFilesystem, obsParamsList []AzureObsParams, setObs bool) error {
+	fsNames := map[string]bool{defaultFsName: true}
+	if setObs {
+		for _, obsParams := range obsParamsList {
+			fsNames[getObsFsName(obsParams)] = true
+		}
+	}
+	for _, fs := range filesystems {
+		if fs.Name == "" {
+			return fmt.Errorf("filesystem name is required")
+		}
+		if fsNames[fs.Name] {
+			return fmt.Errorf("filesystem %s is already created", fs.Name)
+		}
+		fsNames[fs.Name] = true
+		if fs.CapacityGB <= 0 {
+			return fmt.Errorf("filesystem %s capacity must be positive", fs.Name)
+		}
+		if fs.TieringSsdPercent < 0 || fs.TieringSsdPercent > 100 {
+			return fmt.Errorf("filesystem %s tiering ssd percent must be between 0 and 100", fs.Name)
+		}
+		if fs.TieringSsdPercent > 0 && !setObs {
+			return fmt.Errorf("filesystem %s can't be tiered without obs integration", fs.Name)
+		}
+	}
+	return nil
+}
+
+// GetWekaDebugOverrideCmds returns the debug overrides of the vm security type, the uncomputed checksums are left
+// by the dpdk nics offload and are not allowed on confidential vms, which run weka in udp mode
+func GetWekaDebugOverrideCmds(vmSecurityType string) string {
 	s := `
-	weka debug override add --key allow_uncomputed_backend_checksum
 	weka debug override add --key allow_azure_auto_detection
 	`
+	if common.IsDpdkSupported(vmSecurityType) {
+		s += `
+		weka debug override add --key allow_uncomputed_backend_checksum
+		`
+	}
 	return dedent.Dedent(s)
 }
 
@@ -59,15 +321,101 @@ type ClusterizationParams struct {
 	Prefix            string
 	KeyVaultUri       string
 
+	AdminUsername      string
+	DeploymentUsername string
+	ClientUsername     string
+
+	// when set, operations changing azure resources or the state are recorded instead of applied
+	DryRun *common.DryRunPlan
+
 	StateContainerName string
 	StateStorageName   string
 	InstallDpdk        bool
+	// the backends have no public ip
+	PrivateNetwork bool
+	// weka falls back to udp mode when the security type doesn't support dpdk
+	VmSecurityType string
 
 	VmName  string
 	Cluster clusterize.ClusterParams
-	Obs     AzureObsParams
+	Obs     []AzureObsParams
+	// ssd retention of the tiered filesystems
+	ObsTieringPolicy ObsTieringPolicy
 
 	FunctionAppName string
+
+	ContainerNetworkConfig []WekaNetInterface
+	FlashCacheConfig       *FlashCacheConfig
+	CrashConsistencyConfig *CrashConsistencyConfig
+	// nil keeps the whole unprovisioned capacity for the default filesystem
+	DefaultFsWritecache *DefaultFsWritecacheConfig
+
+	OBSCompactionScheduleHours int
+
+	ConfigureAutoReimageRecovery bool
+	// the blob url of the script the scale sets re-run after reimaging, uploaded by the operator to a storage account
+	// of the resource group
+	ReimageRecoveryScriptUrl string
+
+	DNSSRVEnabled      bool
+	PrivateDnsZoneName string
+	PrivateDnsRgName   string
+
+	PerformanceBaselineEnabled        bool
+	PerformanceBaselineMinMBps        int
+	PerformanceBaselineStorageAccount string
+	PerformanceBaselineContainer      string
+
+	SentinelConfig *SentinelConfig
+	EDRConfig      *EDRConfig
+
+	BackupVaultName string
+
+	ApplyDeletionLock bool
+
+	AuditStorageAccount string
+	AuditContainer      string
+
+	NetworkSpeedTestEnabled         bool
+	NetworkSpeedTestProtocol        string
+	NetworkSpeedTestDurationSeconds int
+	NetworkSpeedTestMinGbps         int
+
+	FrontDoorConfig *FrontDoorConfig
+
+	ACLConfig *WekaACLConfig
+	// joins the smbw cluster to the active directory domain
+	SmbDomainJoinConfig *SmbDomainJoinConfig
+	// set as the weka default network when weka runs in udp mode
+	DefaultNetConfig *WekaDefaultNetConfig
+
+	StoragePools []WekaStoragePool
+
+	ContainerSizing WekaContainerSizing
+
+	Filesystems []WekaFilesystem
+
+	KmsConfig *WekaKmsConfig
+
+	// clusters of at least this many backends add their drives in parallel, each backend adding its own,
+	// 0 keeps the serial drives add of the coordinator
+	SegmentThreshold      int
+	SegmentTimeoutMinutes int
+
+	NfsEnabled            bool
+	NfsInterfaceGroupName string
+}
+
+// unmarshalEnv decodes a json encoded env var into v, v is left untouched when the env var is not set
+func unmarshalEnv(ctx context.Context, name string, v interface{}) error {
+	value := common.Getenv(ctx, name)
+	if value == "" {
+		return nil
+	}
+	if err := json.Unmarshal([]byte(value), v); err != nil {
+		return fmt.Errorf("cannot parse %s: %w", name, err)
+	}
+	return nil
 }
 
 type RequestBody struct {
@@ -92,207 +440,1099 @@ func GetShutdownScript() string {
 	return dedent.Dedent(s)
 }
 
-func HandleLastClusterVm(ctx context.Context, state protocol.ClusterState, p ClusterizationParams, funcDef functions_def.FunctionDef) (clusterizeScript string, err error) {
+// key vault uri has the form https://<name>.vault.azure.net/
+func getKeyVaultName(keyVaultUri string) string {
+	host := strings.TrimPrefix(keyVaultUri, "https://")
+	return strings.Split(host, ".")[0]
+}
+
+// registers an A record per backend and, for the dns service discovery, an SRV record pointing to all of them
+func registerDnsServiceDiscovery(ctx context.Context, p ClusterizationParams, backendsIps map[string]string) (err error) {
+	err = common.SyncBackendDnsRecords(ctx, backendsIps)
+	if err != nil || !p.DNSSRVEnabled {
+		return
+	}
+
+	targets := make([]string, 0, len(backendsIps))
+	for vmName := range backendsIps {
+		targets = append(targets, common.GetBackendDnsFqdn(ctx, vmName))
+	}
+	sort.Strings(targets)
+	return common.UpsertPrivateDNSSRVRecord(ctx, p.SubscriptionId, p.PrivateDnsRgName, p.PrivateDnsZoneName, wekaSrvRecordName, targets, weka.ManagementJrpcPort)
+}
+
+func getFrontDoorScript(ctx context.Context, p ClusterizationParams) (frontDoorScript string, err error) {
 	logger := logging.LoggerFromCtx(ctx)
-	logger.Info().Msg("This is the last instance in the cluster, creating obs and clusterization script")
 
-	vmScaleSetName := common.GetVmScaleSetName(p.Prefix, p.Cluster.ClusterName)
+	if p.FrontDoorConfig.PrivateLinkServiceId == "" || p.FrontDoorConfig.OriginHostName == "" {
+		err = errors.New("front door config requires private_link_service_id and origin_host_name, front door can't reach the backends private ips")
+		logger.Error().Err(err).Send()
+		return
+	}
+	privateLinkLocation := p.FrontDoorConfig.PrivateLinkLocation
+	if privateLinkLocation == "" {
+		privateLinkLocation = p.Location
+	}
+	origin := common.FrontDoorPrivateLinkOrigin{
+		HostName:             p.FrontDoorConfig.OriginHostName,
+		Port:                 p.FrontDoorConfig.Port,
+		PrivateLinkServiceId: p.FrontDoorConfig.PrivateLinkServiceId,
+		PrivateLinkLocation:  privateLinkLocation,
+	}
 
-	if p.Cluster.SetObs {
-		if p.Obs.AccessKey == "" {
-			p.Obs.AccessKey, err = common.CreateStorageAccount(
-				ctx, p.SubscriptionId, p.ResourceGroupName, p.Obs.Name, p.Location,
-			)
-			if err != nil {
-				err = fmt.Errorf("failed to create storage account: %w", err)
-				logger.Error().Err(err).Send()
-				return
-			}
+	endpointHostName := "<front-door-endpoint>"
+	err = p.DryRun.Apply(ctx, fmt.Sprintf("create front door endpoint on profile %s for private link service %s", p.FrontDoorConfig.ProfileName, origin.PrivateLinkServiceId), func() (err error) {
+		endpointHostName, err = common.CreateFrontDoorEndpoint(ctx, p.SubscriptionId, p.ResourceGroupName, p.FrontDoorConfig.ProfileName, origin)
+		return
+	})
+	if err != nil {
+		err = fmt.Errorf("failed to create front door endpoint: %w", err)
+		logger.Error().Err(err).Send()
+		return
+	}
 
-			err = common.CreateContainer(ctx, p.Obs.Name, p.Obs.ContainerName)
-			if err != nil {
-				err = fmt.Errorf("failed to create container: %w", err)
-				logger.Error().Err(err).Send()
-				return
+	frontDoorScript = GetWekaAzureFrontDoorScript(endpointHostName)
+	return
+}
+
+func setupObs(ctx context.Context, p ClusterizationParams, vmScaleSetNames []string, obsParams *AzureObsParams) (err error) {
+	logger := logging.LoggerFromCtx(ctx)
+
+	if !isExistingStorageAccount(*obsParams) && obsParams.AccessKey == "" {
+		var privateEndpoint *common.StoragePrivateEndpoint
+		if obsParams.PrivateEndpointSubnetId != "" {
+			privateEndpoint = &common.StoragePrivateEndpoint{
+				SubnetId:         obsParams.PrivateEndpointSubnetId,
+				PrivateDnsZoneId: obsParams.PrivateDnsZoneId,
 			}
 		}
+		var accessKey string
+		accessKey, err = common.CreateStorageAccount(
+			ctx, p.SubscriptionId, p.ResourceGroupName, obsParams.Name, p.Location, p.Cluster.ClusterName, privateEndpoint, obsParams.CustomerManagedKey,
+		)
+		if err != nil {
+			err = fmt.Errorf("failed to create storage account: %w", err)
+			logger.Error().Err(err).Send()
+			return
+		}
+		// with managed identity auth the key is not used for tiering
+		if obsParams.AuthMethod != ObsAuthMethodManagedIdentity {
+			obsParams.AccessKey = accessKey
+		}
+
+		err = common.CreateContainer(ctx, p.SubscriptionId, p.ResourceGroupName, obsParams.Name, obsParams.ContainerName, &common.ContainerLifecycle{
+			AccessTier:            obsParams.AccessTier,
+			DaysAfterModification: obsParams.AccessTierAfterDays,
+		})
+		if err != nil {
+			err = fmt.Errorf("failed to create container: %w", err)
+			logger.Error().Err(err).Send()
+			return
+		}
+	}
 
+	// sas token and service principal auth don't rely on the scale sets identity
+	if isExistingStorageAccount(*obsParams) && obsParams.AuthMethod != ObsAuthMethodManagedIdentity {
+		return
+	}
+	for _, vmScaleSetName := range vmScaleSetNames {
 		_, err = common.AssignStorageBlobDataContributorRoleToScaleSet(
-			ctx, p.SubscriptionId, p.ResourceGroupName, vmScaleSetName, p.Obs.Name, p.Obs.ContainerName,
+			ctx, p.SubscriptionId, p.ResourceGroupName, vmScaleSetName, obsParams.Name, obsParams.ContainerName,
 		)
 		if err != nil {
-			err = fmt.Errorf("failed to assign storage blob data contributor role to scale set: %w", err)
+			err = fmt.Errorf("failed to assign storage blob data contributor role to scale set %s: %w", vmScaleSetName, err)
 			logger.Error().Err(err).Send()
 			return
 		}
 	}
+	return
+}
 
-	wekaPassword, err := common.GetWekaClusterPassword(ctx, p.KeyVaultUri)
-	if err != nil {
-		err = fmt.Errorf("failed to get weka cluster password: %w", err)
-		logger.Error().Err(err).Send()
+// ApplyDeletionLocks locks the obs storage accounts the cluster created against deletion, it's applied once the cluster
+// is clusterized. The scale sets are not locked, a CanNotDelete lock blocks the instance removal of scale down, repair
+// and drive replacement. destroy_cleanup removes the locks
+func ApplyDeletionLocks(ctx context.Context, p ClusterizationParams) (err error) {
+	logger := logging.LoggerFromCtx(ctx)
+
+	if !p.ApplyDeletionLock || !p.Cluster.SetObs {
 		return
 	}
+	lockName := common.GetDeletionLockName(p.Prefix, p.Cluster.ClusterName)
+	for _, obsParams := range p.Obs {
+		if isExistingStorageAccount(obsParams) {
+			continue
+		}
+		resourceId := fmt.Sprintf("/subscriptions/%s/resourceGroups/%s/providers/Microsoft.Storage/storageAccounts/%s", p.SubscriptionId, p.ResourceGroupName, obsParams.Name)
+		err = p.DryRun.Apply(ctx, fmt.Sprintf("apply deletion lock on %s", resourceId), func() error {
+			return common.ApplyResourceManagerLock(ctx, p.SubscriptionId, p.ResourceGroupName, resourceId, lockName, "CanNotDelete")
+		})
+		if err != nil {
+			err = fmt.Errorf("failed to apply deletion lock: %w", err)
+			logger.Error().Err(err).Send()
+			return
+		}
+	}
+	return
+}
+
+// getFaultDomainsScript returns the script setting the containers failure domains to the azure fault domains of
+// their vms, empty when the vms span too few fault domains for the stripe, each vm is its own failure domain then
+func getFaultDomainsScript(ctx context.Context, p ClusterizationParams, state protocol.ClusterState, vmScaleSetNames []string) (script string, err error) {
+	logger := logging.LoggerFromCtx(ctx)
 
-	vmsPrivateIps, err := common.GetVmsPrivateIps(ctx, p.SubscriptionId, p.ResourceGroupName, vmScaleSetName)
+	vmsFaultDomains, err := common.GetScaleSetsVmsFaultDomains(ctx, p.SubscriptionId, p.ResourceGroupName, vmScaleSetNames)
 	if err != nil {
-		err = fmt.Errorf("failed to get vms private ips: %w", err)
+		err = fmt.Errorf("failed to get vms fault domains: %w", err)
 		logger.Error().Err(err).Send()
 		return
 	}
 
-	var vmNamesList []string
-	// we make the ips list compatible to vmNames
-	var ipsList []string
+	hostnamesFaultDomains := make(map[string]int, len(state.Instances))
+	distinctFaultDomains := make(map[int]bool)
 	for _, instance := range state.Instances {
 		vm := strings.Split(instance, ":")
-		ipsList = append(ipsList, vmsPrivateIps[vm[0]])
-		vmNamesList = append(vmNamesList, vm[1])
+		faultDomain, ok := vmsFaultDomains[vm[0]]
+		if !ok {
+			logger.Info().Msgf("Fault domain of vm %s is unknown, keeping a failure domain per vm", vm[0])
+			return
+		}
+		hostnamesFaultDomains[vm[1]] = faultDomain
+		distinctFaultDomains[faultDomain] = true
 	}
 
-	logger.Info().Msg("Generating clusterization script")
-
-	clusterParams := p.Cluster
-	clusterParams.VMNames = vmNamesList
-	clusterParams.IPs = ipsList
-	clusterParams.ObsScript = GetObsScript(p.Obs)
-	clusterParams.DebugOverrideCmds = GetWekaDebugOverrideCmds()
-	clusterParams.WekaPassword = wekaPassword
-	clusterParams.WekaUsername = "admin"
-	clusterParams.InstallDpdk = p.InstallDpdk
-	clusterParams.FindDrivesScript = common.FindDrivesScript
-
-	scriptGenerator := clusterize.ClusterizeScriptGenerator{
-		Params:  clusterParams,
-		FuncDef: funcDef,
+	dataProtection := p.Cluster.DataProtection
+	requiredFailureDomains := dataProtection.StripeWidth + dataProtection.ProtectionLevel + dataProtection.Hotspare
+	if len(distinctFaultDomains) < requiredFailureDomains {
+		logger.Info().Msgf(
+			"The vms span %d fault domains, fewer than the %d failure domains required by the stripe, keeping a failure domain per vm",
+			len(distinctFaultDomains), requiredFailureDomains,
+		)
+		return
 	}
-	clusterizeScript = scriptGenerator.GetClusterizeScript()
 
-	logger.Info().Msg("Clusterization script generated")
+	err = p.DryRun.Apply(ctx, "record the azure fault domains as the containers failure domains in the cluster settings", func() error {
+		_, updateErr := common.UpdateClusterSettings(ctx, p.StateStorageName, p.StateContainerName, func(settings *common.ClusterSettings) error {
+			settings.AzureFaultDomains = true
+			return nil
+		})
+		return updateErr
+	})
+	if err != nil {
+		err = fmt.Errorf("failed to update cluster settings: %w", err)
+		logger.Error().Err(err).Send()
+		return
+	}
+	script = GetWekaFaultDomainsScript(hostnamesFaultDomains)
 	return
 }
 
-func Clusterize(ctx context.Context, p ClusterizationParams) (clusterizeScript string) {
+// getWekaInstallDpdk validates that the nics of all the vms have accelerated networking before weka is clusterized
+// with dpdk, when they don't the clusterization fails with a per vm report, or falls back to udp mode when
+// DPDK_UDP_FALLBACK is set and none of the vms has accelerated networking
+func getWekaInstallDpdk(ctx context.Context, p ClusterizationParams, state protocol.ClusterState, vmScaleSetNames []string) (installDpdk bool, err error) {
 	logger := logging.LoggerFromCtx(ctx)
 
-	instanceName := strings.Split(p.VmName, ":")[0]
-	instanceId := common.GetScaleSetVmIndex(instanceName)
-	vmScaleSetName := common.GetVmScaleSetName(p.Prefix, p.Cluster.ClusterName)
-	vmName := p.VmName
+	installDpdk = common.GetWekaInstallDpdk(p.InstallDpdk, p.VmSecurityType)
+	if !installDpdk {
+		return
+	}
 
-	ip, err := common.GetPublicIp(ctx, p.SubscriptionId, p.ResourceGroupName, vmScaleSetName, p.Prefix, p.Cluster.ClusterName, instanceId)
+	vmsNics, err := common.GetScaleSetsVmsNicsWithoutAcceleratedNetworking(ctx, p.SubscriptionId, p.ResourceGroupName, vmScaleSetNames)
 	if err != nil {
-		logger.Error().Msg("Failed to fetch public ip")
-	} else {
-		vmName = fmt.Sprintf("%s:%s", vmName, ip)
+		err = fmt.Errorf("failed to get vms network interfaces: %w", err)
+		logger.Error().Err(err).Send()
+		return
 	}
 
-	state, err := common.AddInstanceToState(
-		ctx, p.SubscriptionId, p.ResourceGroupName, p.StateStorageName, p.StateContainerName, vmName,
-	)
-
-	if err != nil {
-		if _, ok := err.(*common.ShutdownRequired); ok {
-			clusterizeScript = GetShutdownScript()
-		} else {
-			clusterizeScript = GetErrorScript(err)
+	clusterVmsNics := make(map[string][]string)
+	for _, instance := range state.Instances {
+		vm := strings.Split(instance, ":")
+		if nics, ok := vmsNics[vm[0]]; ok {
+			clusterVmsNics[vm[0]] = nics
 		}
+	}
+	if len(clusterVmsNics) == 0 {
 		return
 	}
 
-	functionAppKey, err := common.GetKeyVaultValue(ctx, p.KeyVaultUri, "function-app-default-key")
-	if err != nil {
-		clusterizeScript = GetErrorScript(err)
+	report := common.GetAcceleratedNetworkingReport(clusterVmsNics)
+	// the deploy script of each vm already set its containers up in udp mode, the cluster can't mix both modes
+	if common.IsDpdkUdpFallbackEnabled(ctx) && len(clusterVmsNics) == len(state.Instances) {
+		logger.Warn().Msgf("Accelerated networking is disabled on the vms nics, falling back to udp mode:\n%s", report)
+		installDpdk = false
 		return
 	}
 
-	baseFunctionUrl := fmt.Sprintf("https://%s.azurewebsites.net/api/", p.FunctionAppName)
-	funcDef := azure_functions_def.NewFuncDef(baseFunctionUrl, functionAppKey)
-	reportFunction := funcDef.GetFunctionCmdDefinition(functions_def.Report)
-
-	if len(state.Instances) == p.Cluster.HostsNum {
-		clusterizeScript, err = HandleLastClusterVm(ctx, state, p, funcDef)
-		if err != nil {
-			clusterizeScript = cloudCommon.GetErrorScript(err, reportFunction)
-		}
-	} else {
-		msg := fmt.Sprintf("This (%s) is instance %d/%d that is ready for clusterization", instanceName, len(state.Instances), p.Cluster.HostsNum)
-		logger.Info().Msgf(msg)
-		clusterizeScript = cloudCommon.GetScriptWithReport(msg, reportFunction)
-	}
+	err = fmt.Errorf("weka is installed with dpdk, which requires accelerated networking, it is disabled on the nics of %d/%d vms:\n%s", len(clusterVmsNics), len(state.Instances), report)
+	logger.Error().Err(err).Send()
 	return
 }
 
-func Handler(w http.ResponseWriter, r *http.Request) {
-	stateContainerName := os.Getenv("STATE_CONTAINER_NAME")
-	stateStorageName := os.Getenv("STATE_STORAGE_NAME")
-	hostsNum, _ := strconv.Atoi(os.Getenv("HOSTS_NUM"))
-	clusterName := os.Getenv("CLUSTER_NAME")
-	subscriptionId := os.Getenv("SUBSCRIPTION_ID")
-	resourceGroupName := os.Getenv("RESOURCE_GROUP_NAME")
-	setObs, _ := strconv.ParseBool(os.Getenv("SET_OBS"))
-	smbwEnabled, _ := strconv.ParseBool(os.Getenv("SMBW_ENABLED"))
-	obsName := os.Getenv("OBS_NAME")
-	obsContainerName := os.Getenv("OBS_CONTAINER_NAME")
-	obsAccessKey := os.Getenv("OBS_ACCESS_KEY")
-	location := os.Getenv("LOCATION")
-	nvmesNum, _ := strconv.Atoi(os.Getenv("NVMES_NUM"))
-	tieringSsdPercent := os.Getenv("TIERING_SSD_PERCENT")
-	prefix := os.Getenv("PREFIX")
-	keyVaultUri := os.Getenv("KEY_VAULT_URI")
-	// data protection-related vars
-	stripeWidth, _ := strconv.Atoi(os.Getenv("STRIPE_WIDTH"))
-	protectionLevel, _ := strconv.Atoi(os.Getenv("PROTECTION_LEVEL"))
-	hotspare, _ := strconv.Atoi(os.Getenv("HOTSPARE"))
-	installDpdk, _ := strconv.ParseBool(os.Getenv("INSTALL_DPDK"))
-	addFrontendNum, _ := strconv.Atoi(os.Getenv("NUM_FRONTEND_CONTAINERS"))
-	functionAppName := os.Getenv("FUNCTION_APP_NAME")
-	proxyUrl := os.Getenv("PROXY_URL")
-	wekaHomeUrl := os.Getenv("WEKA_HOME_URL")
-
-	addFrontend := false
-	if addFrontendNum > 0 {
-		addFrontend = true
-	}
-
-	outputs := make(map[string]interface{})
-	resData := make(map[string]interface{})
-	var invokeRequest common.InvokeRequest
-
-	ctx := r.Context()
+func HandleLastClusterVm(ctx context.Context, state protocol.ClusterState, p ClusterizationParams, funcDef functions_def.FunctionDef) (clusterizeScript string, err error) {
 	logger := logging.LoggerFromCtx(ctx)
+	logger.Info().Msg("This is the last instance in the cluster, creating obs and clusterization script")
 
-	d := json.NewDecoder(r.Body)
-	err := d.Decode(&invokeRequest)
+	// with a zonal deployment the cluster spans a scale set per zone, the failure domain of each container
+	// is its zone and is set by the deploy script before the cluster is created
+	vmScaleSetNames := common.GetVmScaleSetNames(ctx, p.Prefix, p.Cluster.ClusterName)
+
+	err = common.ValidateVmSecurityType(p.VmSecurityType)
 	if err != nil {
-		logger.Error().Msg("Bad request")
+		logger.Error().Err(err).Send()
 		return
 	}
 
-	var reqData map[string]interface{}
-	err = json.Unmarshal(invokeRequest.Data["req"], &reqData)
+	// the nics are validated before any infrastructure changes, rather than failing deep inside the weka install
+	installDpdk, err := getWekaInstallDpdk(ctx, p, state, vmScaleSetNames)
 	if err != nil {
-		logger.Error().Msg("Bad request")
 		return
 	}
 
-	var data RequestBody
-
-	if json.Unmarshal([]byte(reqData["Body"].(string)), &data) != nil {
-		logger.Error().Msg("Bad request")
+	if p.NfsEnabled && !p.Cluster.AddFrontend {
+		err = fmt.Errorf("nfs requires frontend containers, set ADD_FRONTEND")
+		logger.Error().Err(err).Send()
 		return
 	}
 
-	params := ClusterizationParams{
-		SubscriptionId:     subscriptionId,
-		ResourceGroupName:  resourceGroupName,
+	if p.ACLConfig != nil {
+		err = ValidateACLModel(p.ACLConfig.ACLModel)
+		if err != nil {
+			logger.Error().Err(err).Send()
+			return
+		}
+	}
+
+	if p.DefaultNetConfig != nil {
+		err = ValidateWekaDefaultNetConfig(*p.DefaultNetConfig)
+		if err != nil {
+			logger.Error().Err(err).Send()
+			return
+		}
+	}
+
+	if p.SmbDomainJoinConfig != nil {
+		if !p.Cluster.SmbwEnabled {
+			err = fmt.Errorf("smb domain join requires SMBW_ENABLED")
+			logger.Error().Err(err).Send()
+			return
+		}
+		err = ValidateSmbDomainJoinConfig(*p.SmbDomainJoinConfig)
+		if err != nil {
+			logger.Error().Err(err).Send()
+			return
+		}
+		p.SmbDomainJoinConfig.Password, err = common.GetKeyVaultValue(ctx, p.KeyVaultUri, p.SmbDomainJoinConfig.PasswordSecretName)
+		if err != nil {
+			err = fmt.Errorf("failed to get smb domain join password: %w", err)
+			logger.Error().Err(err).Send()
+			return
+		}
+	}
+
+	err = validateFilesystems(p.Filesystems, p.Obs, p.Cluster.SetObs)
+	if err != nil {
+		logger.Error().Err(err).Send()
+		return
+	}
+
+	if p.DefaultFsWritecache != nil && (p.DefaultFsWritecache.SsdReservePercent < 0 || p.DefaultFsWritecache.SsdReservePercent > 50) {
+		err = fmt.Errorf("invalid default filesystem ssd reserve percent %d, expected 0-50", p.DefaultFsWritecache.SsdReservePercent)
+		logger.Error().Err(err).Send()
+		return
+	}
+
+	// the audit records the configuration as requested, it's written once validated and before any
+	// infrastructure changes
+	if p.AuditStorageAccount != "" && p.AuditContainer != "" {
+		err = p.DryRun.Apply(ctx, fmt.Sprintf("write deployment audit to storage account %s container %s", p.AuditStorageAccount, p.AuditContainer), func() error {
+			return WriteDeploymentAudit(ctx, p.AuditStorageAccount, p.AuditContainer, p)
+		})
+		if err != nil {
+			logger.Error().Err(err).Send()
+			return
+		}
+	}
+
+	if p.Cluster.SetObs {
+		err = validateObsParams(p.Obs)
+		if err == nil {
+			err = validateObsTieringPolicy(p.ObsTieringPolicy)
+		}
+		if err != nil {
+			logger.Error().Err(err).Send()
+			return
+		}
+
+		for i := range p.Obs {
+			obsParams := &p.Obs[i]
+			err = p.DryRun.Apply(ctx, fmt.Sprintf("set up obs storage account %s container %s for scale sets %v", obsParams.Name, obsParams.ContainerName, vmScaleSetNames), func() error {
+				return setupObs(ctx, p, vmScaleSetNames, obsParams)
+			})
+			if err != nil {
+				return
+			}
+			common.TrackEvent(ctx, common.EventObsCreated, map[string]string{
+				"cluster_name":    p.Cluster.ClusterName,
+				"storage_account": p.Obs[i].Name,
+				"container":       p.Obs[i].ContainerName,
+			})
+		}
+	}
+
+	var kmsKeyVaultUri string
+	if p.KmsConfig != nil {
+		keyVaultId := p.KmsConfig.KeyVaultId
+		if keyVaultId == "" {
+			keyVaultId = fmt.Sprintf("/subscriptions/%s/resourceGroups/%s/providers/Microsoft.KeyVault/vaults/%s", p.SubscriptionId, p.ResourceGroupName, getKeyVaultName(p.KeyVaultUri))
+			kmsKeyVaultUri = p.KeyVaultUri
+		}
+		err = p.DryRun.Apply(ctx, fmt.Sprintf("create key %s in key vault %s", p.KmsConfig.KeyName, keyVaultId), func() (keyErr error) {
+			kmsKeyVaultUri, keyErr = common.CreateKeyVaultKey(ctx, p.SubscriptionId, keyVaultId, p.KmsConfig.KeyName)
+			return
+		})
+		if err != nil {
+			err = fmt.Errorf("failed to create kms key: %w", err)
+			logger.Error().Err(err).Send()
+			return
+		}
+		for _, vmScaleSetName := range vmScaleSetNames {
+			vmScaleSetName := vmScaleSetName
+			err = p.DryRun.Apply(ctx, fmt.Sprintf("grant scale set %s access to key vault %s keys", vmScaleSetName, keyVaultId), func() error {
+				return common.GrantKeyVaultKeysAccessToScaleSet(ctx, p.SubscriptionId, p.ResourceGroupName, vmScaleSetName, keyVaultId)
+			})
+			if err != nil {
+				err = fmt.Errorf("failed to grant kms key access: %w", err)
+				logger.Error().Err(err).Send()
+				return
+			}
+		}
+	}
+
+	wekaPassword, err := common.GetWekaClusterPassword(ctx, p.KeyVaultUri)
+	if err != nil {
+		err = fmt.Errorf("failed to get weka cluster password: %w", err)
+		logger.Error().Err(err).Send()
+		return
+	}
+
+	vmsPrivateIps, err := common.GetScaleSetsVmsPrivateIps(ctx, p.SubscriptionId, p.ResourceGroupName, vmScaleSetNames)
+	if err != nil {
+		err = fmt.Errorf("failed to get vms private ips: %w", err)
+		logger.Error().Err(err).Send()
+		return
+	}
+
+	var vmNamesList []string
+	// we make the ips list compatible to vmNames
+	var ipsList []string
+	for _, instance := range state.Instances {
+		vm := strings.Split(instance, ":")
+		ipsList = append(ipsList, vmsPrivateIps[vm[0]])
+		vmNamesList = append(vmNamesList, vm[1])
+	}
+
+	if p.ConfigureAutoReimageRecovery {
+		var scriptExtensionConfig common.ScriptExtensionConfig
+		scriptExtensionConfig, err = common.ParseScriptExtensionBlobUrl(p.ReimageRecoveryScriptUrl)
+		if err != nil {
+			err = fmt.Errorf("invalid reimage recovery script url: %w", err)
+			logger.Error().Err(err).Send()
+			return
+		}
+		for _, vmScaleSetName := range vmScaleSetNames {
+			vmScaleSetName := vmScaleSetName
+			err = p.DryRun.Apply(ctx, fmt.Sprintf("grant scale set %s read access to %s", vmScaleSetName, scriptExtensionConfig.ScriptUrl()), func() (assignErr error) {
+				_, assignErr = common.AssignStorageBlobDataReaderRoleToScaleSet(
+					ctx, p.SubscriptionId, p.ResourceGroupName, vmScaleSetName, scriptExtensionConfig.StorageAccountName, scriptExtensionConfig.ContainerName,
+				)
+				return
+			})
+			if err == nil {
+				err = p.DryRun.Apply(ctx, fmt.Sprintf("configure custom script extension on scale set %s", vmScaleSetName), func() error {
+					return common.ConfigureVMSSCustomScriptExtension(ctx, p.SubscriptionId, p.ResourceGroupName, vmScaleSetName, scriptExtensionConfig)
+				})
+			}
+			if err != nil {
+				err = fmt.Errorf("failed to configure custom script extension: %w", err)
+				logger.Error().Err(err).Send()
+				return
+			}
+		}
+	}
+
+	if p.DNSSRVEnabled || common.IsBackendDnsEnabled(ctx) {
+		backendsIps := make(map[string]string)
+		for _, instance := range state.Instances {
+			vmName := strings.Split(instance, ":")[0]
+			backendsIps[vmName] = vmsPrivateIps[vmName]
+		}
+		err = p.DryRun.Apply(ctx, fmt.Sprintf("register dns records of %v in private dns zone %s", ipsList, p.PrivateDnsZoneName), func() error {
+			return registerDnsServiceDiscovery(ctx, p, backendsIps)
+		})
+		if err != nil {
+			err = fmt.Errorf("failed to register dns service discovery records: %w", err)
+			logger.Error().Err(err).Send()
+			return
+		}
+	}
+
+	// zonal deployments keep the zone as the failure domain
+	var faultDomainsScript string
+	if len(common.GetAvailabilityZones(ctx)) == 0 {
+		faultDomainsScript, err = getFaultDomainsScript(ctx, p, state, vmScaleSetNames)
+		if err != nil {
+			return
+		}
+	}
+
+	logger.Info().Msg("Generating clusterization script")
+
+	clusterParams := p.Cluster
+	clusterParams.VMNames = vmNamesList
+	clusterParams.IPs = ipsList
+	// the obs script runs after clusterize_finalization, its reports move the deployment phase
+	clusterParams.ObsScript = fmt.Sprintf("REPORT_PHASE=%s\n", common.DeploymentPhaseConfiguringObs)
+	clusterParams.ObsScript += GetObsScript(p.Obs, p.ObsTieringPolicy)
+	if len(p.Filesystems) > 0 {
+		tierName, _ := getObsNames(0)
+		clusterParams.ObsScript += GetWekaFilesystemsTieringScript(p.Filesystems, tierName)
+	}
+	clusterParams.DebugOverrideCmds = GetWekaDebugOverrideCmds(p.VmSecurityType)
+	clusterParams.WekaPassword = wekaPassword
+	// weka cluster create sets the password of the default admin user
+	clusterParams.WekaUsername = "admin"
+	clusterParams.InstallDpdk = installDpdk
+	clusterParams.FindDrivesScript = common.FindDrivesScript
+
+	scriptGenerator := clusterize.ClusterizeScriptGenerator{
+		Params:  clusterParams,
+		FuncDef: funcDef,
+	}
+	clusterizeScript = scriptGenerator.GetClusterizeScript()
+
+	// the other steps are injected around the drives add, it is replaced first
+	if p.SegmentThreshold > 0 && len(ipsList) >= p.SegmentThreshold {
+		logger.Info().Msgf("Clusterizing %d backends in segments, each backend adds its own drives", len(ipsList))
+		segmentsFuncDef := funcDef.GetFunctionCmdDefinition(azure_functions_def.ClusterizeSegments)
+		clusterizeScript = replaceDrivesAdd(clusterizeScript, GetWekaSegmentedDrivesAddScript(segmentsFuncDef, p.SegmentTimeoutMinutes))
+	} else {
+		clusterizeScript = replaceDrivesAdd(clusterizeScript, GetWekaDetectedDrivesAddScript())
+	}
+
+	if faultDomainsScript != "" {
+		clusterizeScript = injectAfterClusterCreate(clusterizeScript, faultDomainsScript)
+	}
+
+	if p.NetworkSpeedTestEnabled {
+		speedTestScript := GetWekaSpeedTestScript(ipsList, p.NetworkSpeedTestProtocol, p.NetworkSpeedTestDurationSeconds, p.NetworkSpeedTestMinGbps)
+		clusterizeScript = injectBeforeClusterCreate(clusterizeScript, "\nSPEED_TEST_STAGE=before_clusterization"+speedTestScript)
+		clusterizeScript += "\nSPEED_TEST_STAGE=after_clusterization" + speedTestScript
+	}
+
+	if len(p.StoragePools) > 0 {
+		clusterizeScript = injectAfterDrivesAdded(clusterizeScript, GetWekaStoragePoolScript(p.StoragePools))
+	}
+
+	if p.ContainerSizing.IsSet() {
+		clusterizeScript = injectAfterDrivesAdded(clusterizeScript, GetWekaContainerSizingScript(p.ContainerSizing))
+	}
+
+	if p.KmsConfig != nil {
+		clusterizeScript = injectAfterDrivesAdded(clusterizeScript, GetWekaKmsScript(kmsKeyVaultUri, p.KmsConfig.KeyName))
+	}
+
+	if len(p.Filesystems) > 0 {
+		clusterizeScript = injectBeforeDefaultFsCreate(clusterizeScript, GetWekaFilesystemsScript(p.Filesystems))
+	}
+
+	if p.DefaultFsWritecache != nil {
+		clusterizeScript = injectAfterDefaultFsCapacity(clusterizeScript, GetWekaDefaultFsWritecacheScript(p.DefaultFsWritecache.SsdReservePercent))
+	}
+
+	if p.CrashConsistencyConfig != nil {
+		clusterizeScript += GetWekaCrashConsistencyScript(p.CrashConsistencyConfig.EnableBarriers, p.CrashConsistencyConfig.CommitIntervalMs)
+	}
+
+	if p.NfsEnabled {
+		clusterizeScript += GetWekaNfsScript(p.NfsInterfaceGroupName)
+	}
+
+	if p.DeploymentUsername != "" || p.ClientUsername != "" || p.AdminUsername != "admin" {
+		var deploymentPassword, clientPassword string
+		if p.DeploymentUsername != "" {
+			deploymentPassword, err = common.GeneratePassword(20)
+			if err != nil {
+				err = fmt.Errorf("failed to generate deployment user password: %w", err)
+				logger.Error().Err(err).Send()
+				return
+			}
+			err = p.DryRun.Apply(ctx, fmt.Sprintf("store key vault secret %s", common.WekaDeploymentPasswordSecretName), func() error {
+				return common.SetKeyVaultValue(ctx, p.KeyVaultUri, common.WekaDeploymentPasswordSecretName, deploymentPassword)
+			})
+			if err != nil {
+				err = fmt.Errorf("failed to store deployment user password: %w", err)
+				logger.Error().Err(err).Send()
+				return
+			}
+		}
+		if p.ClientUsername != "" {
+			clientPassword, err = common.GeneratePassword(20)
+			if err != nil {
+				err = fmt.Errorf("failed to generate client user password: %w", err)
+				logger.Error().Err(err).Send()
+				return
+			}
+			err = p.DryRun.Apply(ctx, fmt.Sprintf("store key vault secret %s", common.WekaClientPasswordSecretName), func() error {
+				return common.SetKeyVaultValue(ctx, p.KeyVaultUri, common.WekaClientPasswordSecretName, clientPassword)
+			})
+			if err != nil {
+				err = fmt.Errorf("failed to store client user password: %w", err)
+				logger.Error().Err(err).Send()
+				return
+			}
+		}
+		clusterizeScript += GetWekaUsersScript(p.AdminUsername, p.DeploymentUsername, deploymentPassword, p.ClientUsername, clientPassword)
+	}
+
+	if p.DefaultNetConfig != nil {
+		if installDpdk {
+			logger.Info().Msg("Weka is installed with dpdk, the default network is not set")
+		} else {
+			clusterizeScript += GetWekaDefaultNetScript(*p.DefaultNetConfig)
+		}
+	}
+
+	if p.SmbDomainJoinConfig != nil {
+		clusterizeScript += GetWekaSmbDomainJoinScript(*p.SmbDomainJoinConfig)
+	}
+
+	if p.ACLConfig != nil {
+		clusterizeScript += GetWekaACLScript(p.ACLConfig.FsName, p.ACLConfig.ACLModel, p.ACLConfig.DefaultPermissions)
+	}
+
+	clusterizeScript = injectAfterScriptHeader(clusterizeScript, "REPORT_PHASE=clusterization")
+
+	if p.Cluster.SetObs && p.OBSCompactionScheduleHours > 0 {
+		for _, fsName := range getTieredFsNames(p) {
+			clusterizeScript += GetWekaObsCompactionScript(fsName, p.OBSCompactionScheduleHours)
+		}
+	}
+
+	if p.PerformanceBaselineEnabled {
+		clusterizeScript += fmt.Sprintf("\nPERF_BASELINE_MIN_MBPS=%d", p.PerformanceBaselineMinMBps)
+		clusterizeScript += GetWekaPerformanceBaselineScript("default", p.PerformanceBaselineStorageAccount, p.PerformanceBaselineContainer)
+	}
+
+	if p.SentinelConfig != nil {
+		sentinelConfig := *p.SentinelConfig
+		// the vms read the workspace key from the key vault, it must be stored there before the clusterization
+		_, err = common.GetKeyVaultValue(ctx, p.KeyVaultUri, sentinelPrimaryKeySecretName)
+		if err != nil {
+			err = fmt.Errorf("failed to get sentinel workspace key: %w", err)
+			logger.Error().Err(err).Send()
+			return
+		}
+		keyVaultId := fmt.Sprintf("/subscriptions/%s/resourceGroups/%s/providers/Microsoft.KeyVault/vaults/%s", p.SubscriptionId, p.ResourceGroupName, getKeyVaultName(p.KeyVaultUri))
+		for _, vmScaleSetName := range vmScaleSetNames {
+			vmScaleSetName := vmScaleSetName
+			err = p.DryRun.Apply(ctx, fmt.Sprintf("grant scale set %s access to key vault %s secrets", vmScaleSetName, keyVaultId), func() error {
+				return common.GrantKeyVaultSecretsAccessToScaleSet(ctx, p.SubscriptionId, p.ResourceGroupName, vmScaleSetName, keyVaultId)
+			})
+			if err != nil {
+				err = fmt.Errorf("failed to grant sentinel workspace key access: %w", err)
+				logger.Error().Err(err).Send()
+				return
+			}
+		}
+		logger.Info().Interface("sentinel_config", sentinelConfig).Msg("Adding sentinel forwarder")
+		clusterizeScript += GetWekaAzureSentinelScript(sentinelConfig.WorkspaceId, p.KeyVaultUri, sentinelPrimaryKeySecretName, sentinelConfig.LogType)
+	}
+
+	// weka cloud enable doesn't fail the clusterization, the weka home connectivity is validated once it ran
+	wekaHomeUrl := p.Cluster.WekaHomeUrl
+	if wekaHomeUrl == "" {
+		wekaHomeUrl = common.DefaultWekaHomeUrl
+	}
+	wekaHomeErr := p.DryRun.Apply(ctx, fmt.Sprintf("record weka home %s as pending validation", wekaHomeUrl), func() error {
+		_, updateErr := common.UpdateWekaHomeStatus(ctx, p.StateStorageName, p.StateContainerName, func(status *common.WekaHomeStatus) {
+			*status = common.WekaHomeStatus{
+				Url:         wekaHomeUrl,
+				ProxyUrl:    p.Cluster.ProxyUrl,
+				Status:      common.WekaHomeStatusPending,
+				RequestedAt: time.Now().UTC(),
+			}
+		})
+		return updateErr
+	})
+	if wekaHomeErr != nil {
+		logger.Error().Err(wekaHomeErr).Msg("failed to record the weka home configuration")
+	}
+	clusterizeScript += GetWekaHomeValidationScript(wekaHomeUrl, p.Cluster.ProxyUrl)
+	clusterizeScript += GetWekaMaintenanceWindowHelperScript(funcDef.GetFunctionCmdDefinition(azure_functions_def.MaintenanceWindow))
+
+	postClusterizeHook, err := common.GetScriptHook(ctx, p.StateStorageName, p.StateContainerName, common.ScriptHookPostClusterize)
+	if err != nil {
+		return
+	}
+	clusterizeScript += common.GetScriptHookScript(common.ScriptHookPostClusterize, postClusterizeHook)
+
+	if p.BackupVaultName != "" {
+		// backup is not required for cluster formation, failures are only logged
+		storageAccountId := fmt.Sprintf("/subscriptions/%s/resourceGroups/%s/providers/Microsoft.Storage/storageAccounts/%s", p.SubscriptionId, p.ResourceGroupName, p.StateStorageName)
+		keyVaultId := fmt.Sprintf("/subscriptions/%s/resourceGroups/%s/providers/Microsoft.KeyVault/vaults/%s", p.SubscriptionId, p.ResourceGroupName, getKeyVaultName(p.KeyVaultUri))
+		backupErr := p.DryRun.Apply(ctx, fmt.Sprintf("configure azure backup in vault %s", p.BackupVaultName), func() error {
+			return common.ConfigureAzureBackup(ctx, p.SubscriptionId, p.ResourceGroupName, p.BackupVaultName, storageAccountId, keyVaultId)
+		})
+		if backupErr != nil {
+			logger.Error().Err(backupErr).Msg("failed to configure azure backup")
+		}
+	}
+
+	// the secrets embedded in the script are redacted from the dry run response
+	secrets := []string{wekaPassword}
+	for _, obsParams := range p.Obs {
+		secrets = append(secrets, obsParams.AccessKey, obsParams.SasToken, obsParams.ServicePrincipalClientSecret)
+	}
+	if p.SmbDomainJoinConfig != nil {
+		secrets = append(secrets, p.SmbDomainJoinConfig.Password)
+	}
+	clusterizeScript = p.DryRun.Redact(clusterizeScript, secrets...)
+
+	logger.Info().Msg("Clusterization script generated")
+	common.TrackEvent(ctx, common.EventScriptGenerated, map[string]string{
+		"cluster_name": p.Cluster.ClusterName,
+		"hosts_num":    strconv.Itoa(p.Cluster.HostsNum),
+	})
+	return
+}
+
+// getDryRunState returns the state as if the instance was added to it, without writing the state
+func getDryRunState(ctx context.Context, p ClusterizationParams, vmName string) (state protocol.ClusterState, err error) {
+	state, err = common.ReadState(ctx, p.StateStorageName, p.StateContainerName)
+	if err != nil {
+		return
+	}
+	if state.Clusterized {
+		err = &common.ShutdownRequired{Message: "cluster is already clusterized"}
+		return
+	}
+	instanceName := strings.Split(vmName, ":")[0]
+	for _, instance := range state.Instances {
+		if strings.Split(instance, ":")[0] == instanceName {
+			return
+		}
+	}
+	p.DryRun.Record(ctx, fmt.Sprintf("add instance %s to state", instanceName))
+	state.Instances = append(state.Instances, vmName)
+	return
+}
+
+func getMaintenanceModeScript(ctx context.Context, p ClusterizationParams) (script string, err error) {
+	functionAppKey, err := common.GetKeyVaultValue(ctx, p.KeyVaultUri, "function-app-default-key")
+	if err != nil {
+		return
+	}
+	payload, err := json.Marshal(RequestBody{Vm: p.VmName})
+	if err != nil {
+		return
+	}
+	baseFunctionUrl := common.GetFunctionAppBaseUrl(p.FunctionAppName)
+	funcDef := azure_functions_def.NewFuncDef(ctx, baseFunctionUrl, functionAppKey)
+	script = common.GetMaintenanceModeScript(
+		funcDef.GetFunctionCmdDefinition(functions_def.Report),
+		funcDef.GetFunctionCmdDefinition(functions_def.Clusterize),
+		string(functions_def.Clusterize),
+		string(payload),
+	)
+	return
+}
+
+// getRejoinScript returns the script joining a reimaged or redeployed instance to the existing cluster, cloud-init
+// reruns on these instances and calls clusterize again
+func getRejoinScript(ctx context.Context, p ClusterizationParams) (script string, err error) {
+	functionAppKey, err := common.GetKeyVaultValue(ctx, p.KeyVaultUri, "function-app-default-key")
+	if err != nil {
+		return
+	}
+	payload, err := json.Marshal(RequestBody{Vm: p.VmName})
+	if err != nil {
+		return
+	}
+	baseFunctionUrl := common.GetFunctionAppBaseUrl(p.FunctionAppName)
+	funcDef := azure_functions_def.NewFuncDef(ctx, baseFunctionUrl, functionAppKey)
+	script = GetRejoinScript(
+		funcDef.GetFunctionCmdDefinition(functions_def.Report),
+		funcDef.GetFunctionCmdDefinition(functions_def.Deploy),
+		string(payload),
+	)
+	return
+}
+
+func Clusterize(ctx context.Context, p ClusterizationParams) (clusterizeScript string) {
+	logger := logging.LoggerFromCtx(ctx)
+
+	instanceName := strings.Split(p.VmName, ":")[0]
+	instanceId := common.GetScaleSetVmIndex(instanceName)
+	vmScaleSetName := common.GetVmScaleSetNameFromVmName(instanceName)
+	vmName := p.VmName
+
+	// checked before the instance is added to the state, so nothing changes while maintenance mode is enabled
+	maintenance, err := common.IsMaintenanceModeEnabled(ctx, p.StateStorageName, p.StateContainerName)
+	if err != nil {
+		clusterizeScript = GetErrorScript(err)
+		return
+	}
+	if maintenance {
+		logger.Info().Msgf("Maintenance mode is enabled, instance %s will call clusterize again", instanceName)
+		clusterizeScript, err = getMaintenanceModeScript(ctx, p)
+		if err != nil {
+			clusterizeScript = GetErrorScript(err)
+		}
+		return
+	}
+
+	if !p.DryRun.Enabled() {
+		// the saved response of the last instance would create the cluster again, the instance joins it instead
+		state, err := common.ReadState(ctx, p.StateStorageName, p.StateContainerName)
+		if err != nil {
+			clusterizeScript = GetErrorScript(err)
+			return
+		}
+		if state.Clusterized {
+			logger.Info().Msgf("Cluster is already clusterized, instance %s will join it", instanceName)
+			clusterizeScript, err = getRejoinScript(ctx, p)
+			if err != nil {
+				clusterizeScript = GetErrorScript(err)
+			}
+			return
+		}
+
+		response, found, err := common.GetClusterizeResponse(ctx, p.StateStorageName, p.StateContainerName, instanceName)
+		if err != nil {
+			clusterizeScript = GetErrorScript(err)
+			return
+		}
+		if found {
+			logger.Info().Msgf("Instance %s already called clusterize, returning the previous response", instanceName)
+			clusterizeScript = response
+			return
+		}
+	}
+
+	// the vms of a private network have no public ip, they are known by their host name only
+	if !p.PrivateNetwork {
+		ip, err := common.GetPublicIp(ctx, p.SubscriptionId, p.ResourceGroupName, vmScaleSetName, p.Prefix, p.Cluster.ClusterName, instanceId)
+		if err != nil {
+			logger.Error().Msg("Failed to fetch public ip")
+		} else if ip != "" {
+			vmName = fmt.Sprintf("%s:%s", vmName, ip)
+		}
+	}
+
+	var state protocol.ClusterState
+	if p.DryRun.Enabled() {
+		state, err = getDryRunState(ctx, p, vmName)
+	} else {
+		state, err = common.AddInstanceToState(
+			ctx, p.SubscriptionId, p.ResourceGroupName, p.StateStorageName, p.StateContainerName, vmName,
+		)
+	}
+
+	if err != nil {
+		if _, ok := err.(*common.ShutdownRequired); ok {
+			clusterizeScript = GetShutdownScript()
+		} else {
+			common.TrackEvent(ctx, common.EventClusterizeFailed, map[string]string{
+				"cluster_name": p.Cluster.ClusterName,
+				"vm_name":      instanceName,
+				"error":        err.Error(),
+			})
+			common.Notify(ctx, common.NotificationSeverityError, common.NotificationClusterizeFailed, err.Error(), map[string]string{
+				"vm_name": instanceName,
+			})
+			clusterizeScript = GetErrorScript(err)
+			if !p.DryRun.Enabled() {
+				common.SetDeploymentPhase(ctx, p.StateStorageName, p.StateContainerName, common.DeploymentPhaseError, err.Error())
+			}
+		}
+		return
+	}
+
+	common.TrackEvent(ctx, common.EventInstanceJoined, map[string]string{
+		"cluster_name": p.Cluster.ClusterName,
+		"vm_name":      instanceName,
+	})
+	common.TrackMetric(ctx, common.MetricInstancesJoined, float64(len(state.Instances)), map[string]string{
+		"cluster_name": p.Cluster.ClusterName,
+	})
+
+	functionAppKey, err := common.GetKeyVaultValue(ctx, p.KeyVaultUri, "function-app-default-key")
+	if err != nil {
+		clusterizeScript = GetErrorScript(err)
+		return
+	}
+
+	baseFunctionUrl := common.GetFunctionAppBaseUrl(p.FunctionAppName)
+	funcDef := azure_functions_def.NewFuncDef(ctx, baseFunctionUrl, functionAppKey)
+	reportFunction := funcDef.GetFunctionCmdDefinition(functions_def.Report)
+
+	// dry run always generates the clusterization script, with the instances which are ready so far
+	lastClusterVm := len(state.Instances) == p.Cluster.HostsNum
+	if lastClusterVm && !p.DryRun.Enabled() {
+		_, err = common.TransitionDeploymentPhase(
+			ctx, p.StateStorageName, p.StateContainerName, common.DeploymentPhaseClusterizing,
+			fmt.Sprintf("instance %s is the last of %d instances", instanceName, p.Cluster.HostsNum),
+		)
+		if err != nil {
+			clusterizeScript = cloudCommon.GetErrorScript(err, reportFunction)
+			return
+		}
+	}
+	if lastClusterVm || p.DryRun.Enabled() {
+		clusterizeScript, err = HandleLastClusterVm(ctx, state, p, funcDef)
+		if err == nil && p.FrontDoorConfig != nil {
+			var frontDoorScript string
+			frontDoorScript, err = getFrontDoorScript(ctx, p)
+			clusterizeScript += frontDoorScript
+		}
+		if err != nil {
+			common.TrackEvent(ctx, common.EventClusterizeFailed, map[string]string{
+				"cluster_name": p.Cluster.ClusterName,
+				"vm_name":      instanceName,
+				"error":        err.Error(),
+			})
+			// a failed clusterization leaves the cluster down, operators are alerted right away
+			common.Notify(ctx, common.NotificationSeverityCritical, common.NotificationClusterizeFailed, err.Error(), map[string]string{
+				"vm_name": instanceName,
+			})
+			clusterizeScript = cloudCommon.GetErrorScript(err, reportFunction)
+			if !p.DryRun.Enabled() {
+				common.SetDeploymentPhase(ctx, p.StateStorageName, p.StateContainerName, common.DeploymentPhaseError, err.Error())
+			}
+		}
+	} else {
+		msg := fmt.Sprintf("This (%s) is instance %d/%d that is ready for clusterization", instanceName, len(state.Instances), p.Cluster.HostsNum)
+		logger.Info().Msgf(msg)
+		clusterizeScript = cloudCommon.GetScriptWithReport(msg, reportFunction)
+		// an instance added after a failure resumes the collection
+		common.SetDeploymentPhase(ctx, p.StateStorageName, p.StateContainerName, common.DeploymentPhaseCollecting, msg)
+	}
+
+	// failures aren't saved, a retry may succeed
+	if err == nil && !p.DryRun.Enabled() {
+		if saveErr := common.SaveClusterizeResponse(ctx, p.StateStorageName, p.StateContainerName, instanceName, clusterizeScript); saveErr != nil {
+			logger.Error().Err(saveErr).Msg("failed to save clusterize response")
+		}
+	}
+	return
+}
+
+// GetClusterizationParams returns the clusterization parameters of the function app settings, for the vm calling
+// clusterize. The json settings which can't be decoded are returned as an error, the feature would be silently
+// disabled otherwise
+func GetClusterizationParams(ctx context.Context, vmName string) (p ClusterizationParams, err error) {
+	stateContainerName := common.Getenv(ctx, "STATE_CONTAINER_NAME")
+	stateStorageName := common.Getenv(ctx, "STATE_STORAGE_NAME")
+	hostsNum, _ := strconv.Atoi(common.Getenv(ctx, "HOSTS_NUM"))
+	clusterName := common.Getenv(ctx, "CLUSTER_NAME")
+	subscriptionId := common.Getenv(ctx, "SUBSCRIPTION_ID")
+	resourceGroupName := common.Getenv(ctx, "RESOURCE_GROUP_NAME")
+	setObs, _ := strconv.ParseBool(common.Getenv(ctx, "SET_OBS"))
+	smbwEnabled, _ := strconv.ParseBool(common.Getenv(ctx, "SMBW_ENABLED"))
+	nfsEnabled, _ := strconv.ParseBool(common.Getenv(ctx, "NFS_ENABLED"))
+	nfsInterfaceGroupName := common.Getenv(ctx, "NFS_INTERFACE_GROUP_NAME")
+	if nfsInterfaceGroupName == "" {
+		nfsInterfaceGroupName = "weka-ig"
+	}
+	obsName := common.Getenv(ctx, "OBS_NAME")
+	obsContainerName := common.Getenv(ctx, "OBS_CONTAINER_NAME")
+	obsAccessKey := common.Getenv(ctx, "OBS_ACCESS_KEY")
+	obsAuthMethod := common.Getenv(ctx, "OBS_AUTH_METHOD")
+	if obsAuthMethod == "" {
+		obsAuthMethod = ObsAuthMethodAccessKey
+	}
+	obsManagedIdentityClientId := common.Getenv(ctx, "OBS_MANAGED_IDENTITY_CLIENT_ID")
+	obsPrivateEndpointSubnetId := common.Getenv(ctx, "OBS_PRIVATE_ENDPOINT_SUBNET_ID")
+	obsPrivateDnsZoneId := common.Getenv(ctx, "OBS_PRIVATE_DNS_ZONE_ID")
+	obsAccessTier := common.Getenv(ctx, "OBS_ACCESS_TIER")
+	obsAccessTierAfterDays, _ := strconv.Atoi(common.Getenv(ctx, "OBS_ACCESS_TIER_AFTER_DAYS"))
+	obsDriveRetentionPeriod, _ := strconv.Atoi(common.Getenv(ctx, "OBS_DRIVE_RETENTION_PERIOD_SECONDS"))
+	obsTieringCue, _ := strconv.Atoi(common.Getenv(ctx, "OBS_TIERING_CUE_SECONDS"))
+	location := common.Getenv(ctx, "LOCATION")
+	nvmesNum, _ := strconv.Atoi(common.Getenv(ctx, "NVMES_NUM"))
+	segmentThreshold := defaultSegmentThreshold
+	if value, err := strconv.Atoi(common.Getenv(ctx, "CLUSTERIZE_SEGMENT_THRESHOLD")); err == nil && value >= 0 {
+		segmentThreshold = value
+	}
+	segmentTimeoutMinutes, _ := strconv.Atoi(common.Getenv(ctx, "CLUSTERIZE_SEGMENT_TIMEOUT_MINUTES"))
+	if segmentTimeoutMinutes <= 0 {
+		segmentTimeoutMinutes = defaultSegmentTimeoutMinutes
+	}
+	tieringSsdPercent := common.Getenv(ctx, "TIERING_SSD_PERCENT")
+	prefix := common.Getenv(ctx, "PREFIX")
+	keyVaultUri := common.Getenv(ctx, "KEY_VAULT_URI")
+	// data protection-related vars
+	stripeWidth, _ := strconv.Atoi(common.Getenv(ctx, "STRIPE_WIDTH"))
+	protectionLevel, _ := strconv.Atoi(common.Getenv(ctx, "PROTECTION_LEVEL"))
+	hotspare, _ := strconv.Atoi(common.Getenv(ctx, "HOTSPARE"))
+	installDpdk, _ := strconv.ParseBool(common.Getenv(ctx, "INSTALL_DPDK"))
+	addFrontendNum, _ := strconv.Atoi(common.Getenv(ctx, "NUM_FRONTEND_CONTAINERS"))
+	functionAppName := common.Getenv(ctx, "FUNCTION_APP_NAME")
+	proxyUrl := common.Getenv(ctx, "PROXY_URL")
+	wekaHomeUrl := common.Getenv(ctx, "WEKA_HOME_URL")
+	obsCompactionScheduleHours, _ := strconv.Atoi(common.Getenv(ctx, "OBS_COMPACTION_SCHEDULE_HOURS"))
+	configureAutoReimageRecovery, _ := strconv.ParseBool(common.Getenv(ctx, "CONFIGURE_AUTO_REIMAGE_RECOVERY"))
+	reimageRecoveryScriptUrl := common.Getenv(ctx, "REIMAGE_RECOVERY_SCRIPT_URL")
+	dnsSrvEnabled, _ := strconv.ParseBool(common.Getenv(ctx, "DNS_SRV_ENABLED"))
+	privateDnsZoneName := common.Getenv(ctx, "PRIVATE_DNS_ZONE_NAME")
+	privateDnsRgName := common.Getenv(ctx, "PRIVATE_DNS_RG_NAME")
+	performanceBaselineEnabled, _ := strconv.ParseBool(common.Getenv(ctx, "PERFORMANCE_BASELINE_ENABLED"))
+	performanceBaselineMinMBps, _ := strconv.Atoi(common.Getenv(ctx, "PERFORMANCE_BASELINE_MIN_MBPS"))
+	performanceBaselineStorageAccount := common.Getenv(ctx, "PERFORMANCE_BASELINE_STORAGE_ACCOUNT")
+	performanceBaselineContainer := common.Getenv(ctx, "PERFORMANCE_BASELINE_CONTAINER_NAME")
+	backupVaultName := common.Getenv(ctx, "BACKUP_VAULT_NAME")
+	applyDeletionLock, _ := strconv.ParseBool(common.Getenv(ctx, "APPLY_DELETION_LOCK"))
+	auditStorageAccount := common.Getenv(ctx, "AUDIT_STORAGE_ACCOUNT")
+	auditContainer := common.Getenv(ctx, "AUDIT_CONTAINER")
+	networkSpeedTestEnabled, _ := strconv.ParseBool(common.Getenv(ctx, "NETWORK_SPEED_TEST_ENABLED"))
+	networkSpeedTestProtocol := common.Getenv(ctx, "NETWORK_SPEED_TEST_PROTOCOL")
+	if networkSpeedTestProtocol == "" {
+		networkSpeedTestProtocol = SpeedTestProtocolTCP
+	}
+	networkSpeedTestDurationSeconds, _ := strconv.Atoi(common.Getenv(ctx, "NETWORK_SPEED_TEST_DURATION_SECONDS"))
+	if networkSpeedTestDurationSeconds == 0 {
+		networkSpeedTestDurationSeconds = 10
+	}
+	networkSpeedTestMinGbps, _ := strconv.Atoi(common.Getenv(ctx, "NETWORK_SPEED_TEST_MIN_GBPS"))
+
+	addFrontend := false
+	if addFrontendNum > 0 {
+		addFrontend = true
+	}
+
+	var settingsErrs []error
+	var containerNetworkConfig []WekaNetInterface
+	if err = unmarshalEnv(ctx, "CONTAINER_NETWORK_CONFIG", &containerNetworkConfig); err != nil {
+		settingsErrs = append(settingsErrs, err)
+	}
+	var flashCacheConfig *FlashCacheConfig
+	if err = unmarshalEnv(ctx, "FLASH_CACHE_CONFIG", &flashCacheConfig); err != nil {
+		settingsErrs = append(settingsErrs, err)
+	}
+	var crashConsistencyConfig *CrashConsistencyConfig
+	if err = unmarshalEnv(ctx, "CRASH_CONSISTENCY_CONFIG", &crashConsistencyConfig); err != nil {
+		settingsErrs = append(settingsErrs, err)
+	}
+	var defaultFsWritecache *DefaultFsWritecacheConfig
+	if err = unmarshalEnv(ctx, "DEFAULT_FS_WRITECACHE_CONFIG", &defaultFsWritecache); err != nil {
+		settingsErrs = append(settingsErrs, err)
+	}
+	var sentinelConfig *SentinelConfig
+	if err = unmarshalEnv(ctx, "SENTINEL_CONFIG", &sentinelConfig); err != nil {
+		settingsErrs = append(settingsErrs, err)
+	}
+	var edrConfig *EDRConfig
+	if err = unmarshalEnv(ctx, "EDR_CONFIG", &edrConfig); err != nil {
+		settingsErrs = append(settingsErrs, err)
+	}
+	var obsCustomerManagedKey *common.StorageCustomerManagedKey
+	if err = unmarshalEnv(ctx, "OBS_CUSTOMER_MANAGED_KEY", &obsCustomerManagedKey); err != nil {
+		settingsErrs = append(settingsErrs, err)
+	}
+	obsParamsList := []AzureObsParams{
+		{
+			Name:              obsName,
+			ContainerName:     obsContainerName,
+			AccessKey:         obsAccessKey,
+			TieringSsdPercent: tieringSsdPercent,
+
+			AuthMethod:              obsAuthMethod,
+			ManagedIdentityClientId: obsManagedIdentityClientId,
+			SasToken:                common.Getenv(ctx, "OBS_SAS_TOKEN"),
+			PrivateEndpointSubnetId: obsPrivateEndpointSubnetId,
+			PrivateDnsZoneId:        obsPrivateDnsZoneId,
+			AccessTier:              obsAccessTier,
+			AccessTierAfterDays:     obsAccessTierAfterDays,
+
+			ServicePrincipalTenantId:     common.Getenv(ctx, "OBS_SP_TENANT_ID"),
+			ServicePrincipalClientId:     common.Getenv(ctx, "OBS_SP_CLIENT_ID"),
+			ServicePrincipalClientSecret: common.Getenv(ctx, "OBS_SP_CLIENT_SECRET"),
+			CustomerManagedKey:           obsCustomerManagedKey,
+		},
+	}
+	var additionalObs []AzureObsParams
+	if err = unmarshalEnv(ctx, "ADDITIONAL_OBS", &additionalObs); err != nil {
+		settingsErrs = append(settingsErrs, err)
+	}
+	for i := range additionalObs {
+		// an empty percent would divide by zero in the tiering capacity of the obs script
+		if additionalObs[i].TieringSsdPercent == "" {
+			additionalObs[i].TieringSsdPercent = tieringSsdPercent
+		}
+	}
+	obsParamsList = append(obsParamsList, additionalObs...)
+	var frontDoorConfig *FrontDoorConfig
+	if err = unmarshalEnv(ctx, "FRONT_DOOR_CONFIG", &frontDoorConfig); err != nil {
+		settingsErrs = append(settingsErrs, err)
+	}
+	var aclConfig *WekaACLConfig
+	if err = unmarshalEnv(ctx, "ACL_CONFIG", &aclConfig); err != nil {
+		settingsErrs = append(settingsErrs, err)
+	}
+	var smbDomainJoinConfig *SmbDomainJoinConfig
+	if err = unmarshalEnv(ctx, "SMB_DOMAIN_JOIN_CONFIG", &smbDomainJoinConfig); err != nil {
+		settingsErrs = append(settingsErrs, err)
+	}
+	var defaultNetConfig *WekaDefaultNetConfig
+	if err = unmarshalEnv(ctx, "DEFAULT_NET_CONFIG", &defaultNetConfig); err != nil {
+		settingsErrs = append(settingsErrs, err)
+	}
+	if defaultNetConfig != nil {
+		subnet := common.Getenv(ctx, "SUBNET")
+		if defaultNetConfig.Gateway == "" {
+			defaultNetConfig.Gateway = common.GetSubnetGateway(subnet)
+		}
+		if defaultNetConfig.NetmaskBits == 0 {
+			defaultNetConfig.NetmaskBits = common.GetSubnetNetmaskBits(subnet)
+		}
+	}
+	if aclConfig != nil && aclConfig.FsName == "" {
+		aclConfig.FsName = "default"
+	}
+	computeContainerCores, _ := strconv.Atoi(common.Getenv(ctx, "COMPUTE_CONTAINER_CORES"))
+	driveContainerCores, _ := strconv.Atoi(common.Getenv(ctx, "DRIVE_CONTAINER_CORES"))
+	frontendContainerCores, _ := strconv.Atoi(common.Getenv(ctx, "FRONTEND_CONTAINER_CORES"))
+	var storagePools []WekaStoragePool
+	if err = unmarshalEnv(ctx, "STORAGE_POOLS", &storagePools); err != nil {
+		settingsErrs = append(settingsErrs, err)
+	}
+	var filesystems []WekaFilesystem
+	if err = unmarshalEnv(ctx, "FILESYSTEMS", &filesystems); err != nil {
+		settingsErrs = append(settingsErrs, err)
+	}
+	var kmsConfig *WekaKmsConfig
+	if kmsKeyName := common.Getenv(ctx, "KMS_KEY_NAME"); kmsKeyName != "" {
+		kmsConfig = &WekaKmsConfig{
+			KeyVaultId: common.Getenv(ctx, "KMS_KEY_VAULT_ID"),
+			KeyName:    kmsKeyName,
+		}
+	}
+
+	p = ClusterizationParams{
+		SubscriptionId:     subscriptionId,
+		ResourceGroupName:  resourceGroupName,
 		Location:           location,
 		Prefix:             prefix,
 		KeyVaultUri:        keyVaultUri,
+		AdminUsername:      common.GetWekaAdminUsername(ctx),
+		DeploymentUsername: common.GetWekaDeploymentUsername(ctx),
+		ClientUsername:     common.GetWekaClientUsername(ctx),
 		StateContainerName: stateContainerName,
 		StateStorageName:   stateStorageName,
-		VmName:             data.Vm,
+		VmName:             vmName,
 		InstallDpdk:        installDpdk,
+		VmSecurityType:     common.GetVmSecurityType(ctx),
+		PrivateNetwork:     common.IsPrivateNetwork(ctx),
 		Cluster: clusterize.ClusterParams{
 			HostsNum:    hostsNum,
 			ClusterName: clusterName,
@@ -308,26 +1548,144 @@ func Handler(w http.ResponseWriter, r *http.Request) {
 				Hotspare:        hotspare,
 			},
 		},
-		Obs: AzureObsParams{
-			Name:              obsName,
-			ContainerName:     obsContainerName,
-			AccessKey:         obsAccessKey,
-			TieringSsdPercent: tieringSsdPercent,
+		Obs: obsParamsList,
+		ObsTieringPolicy: ObsTieringPolicy{
+			DriveRetentionPeriodSeconds: obsDriveRetentionPeriod,
+			TieringCueSeconds:           obsTieringCue,
 		},
-		FunctionAppName: functionAppName,
+		FunctionAppName:        functionAppName,
+		ContainerNetworkConfig: containerNetworkConfig,
+		FlashCacheConfig:       flashCacheConfig,
+		CrashConsistencyConfig: crashConsistencyConfig,
+		DefaultFsWritecache:    defaultFsWritecache,
+
+		OBSCompactionScheduleHours: obsCompactionScheduleHours,
+
+		ConfigureAutoReimageRecovery: configureAutoReimageRecovery,
+		ReimageRecoveryScriptUrl:     reimageRecoveryScriptUrl,
+
+		DNSSRVEnabled:      dnsSrvEnabled,
+		PrivateDnsZoneName: privateDnsZoneName,
+		PrivateDnsRgName:   privateDnsRgName,
+
+		PerformanceBaselineEnabled:        performanceBaselineEnabled,
+		PerformanceBaselineMinMBps:        performanceBaselineMinMBps,
+		PerformanceBaselineStorageAccount: performanceBaselineStorageAccount,
+		PerformanceBaselineContainer:      performanceBaselineContainer,
+
+		SentinelConfig: sentinelConfig,
+		EDRConfig:      edrConfig,
+
+		BackupVaultName: backupVaultName,
+
+		ApplyDeletionLock: applyDeletionLock,
+
+		AuditStorageAccount: auditStorageAccount,
+		AuditContainer:      auditContainer,
+
+		NetworkSpeedTestEnabled:         networkSpeedTestEnabled,
+		NetworkSpeedTestProtocol:        networkSpeedTestProtocol,
+		NetworkSpeedTestDurationSeconds: networkSpeedTestDurationSeconds,
+		NetworkSpeedTestMinGbps:         networkSpeedTestMinGbps,
+
+		FrontDoorConfig: frontDoorConfig,
+
+		ACLConfig: aclConfig,
+
+		SmbDomainJoinConfig: smbDomainJoinConfig,
+		DefaultNetConfig:    defaultNetConfig,
+
+		StoragePools: storagePools,
+		ContainerSizing: WekaContainerSizing{
+			ComputeCores:   computeContainerCores,
+			DriveCores:     driveContainerCores,
+			FrontendCores:  frontendContainerCores,
+			ComputeMemory:  common.Getenv(ctx, "COMPUTE_CONTAINER_MEMORY"),
+			DriveMemory:    common.Getenv(ctx, "DRIVE_CONTAINER_MEMORY"),
+			FrontendMemory: common.Getenv(ctx, "FRONTEND_CONTAINER_MEMORY"),
+		},
+
+		Filesystems: filesystems,
+		KmsConfig:   kmsConfig,
+
+		SegmentThreshold:      segmentThreshold,
+		SegmentTimeoutMinutes: segmentTimeoutMinutes,
+
+		NfsEnabled:            nfsEnabled,
+		NfsInterfaceGroupName: nfsInterfaceGroupName,
+	}
+	err = errors.Join(settingsErrs...)
+	return
+}
+
+func Handler(w http.ResponseWriter, r *http.Request) {
+	outputs := make(map[string]interface{})
+	resData := make(map[string]interface{})
+	var invokeRequest common.InvokeRequest
+
+	ctx := r.Context()
+	logger := logging.LoggerFromCtx(ctx)
+
+	d := json.NewDecoder(r.Body)
+	err := d.Decode(&invokeRequest)
+	if err != nil {
+		logger.Error().Msg("Bad request")
+		return
+	}
+
+	var reqData map[string]interface{}
+	err = json.Unmarshal(invokeRequest.Data["req"], &reqData)
+	if err != nil {
+		logger.Error().Msg("Bad request")
+		return
 	}
 
-	if data.Vm == "" {
+	var data RequestBody
+
+	if json.Unmarshal([]byte(reqData["Body"].(string)), &data) != nil {
+		logger.Error().Msg("Bad request")
+		return
+	}
+
+	params, paramsErr := GetClusterizationParams(ctx, data.Vm)
+
+	// malformed settings would be read as zero values and break the cluster configuration
+	if err = common.ConfigIssuesError(common.ValidateConfig(ctx)); err != nil {
+		logger.Error().Err(err).Send()
+		resData["body"] = GetErrorScript(err)
+	} else if paramsErr != nil {
+		logger.Error().Err(paramsErr).Send()
+		resData["body"] = GetErrorScript(paramsErr)
+	} else if data.Vm == "" {
 		msg := "Cluster name wasn't supplied"
 		logger.Error().Msgf(msg)
 		resData["body"] = msg
-	} else {
+	} else if common.IsDryRun(reqData) {
+		params.DryRun = &common.DryRunPlan{}
 		clusterizeScript := Clusterize(ctx, params)
+		resData["body"] = params.DryRun.Response(clusterizeScript)
+	} else {
+		clusterizeScript, err := runClusterizeOnce(ctx, data.Vm, func() string {
+			return Clusterize(ctx, params)
+		})
+		if errors.Is(err, errClusterizeBusy) {
+			logger.Warn().Msgf("Instance %s clusterize call waited %s for a free run, it will call again", data.Vm, clusterizeQueueTimeout)
+			clusterizeScript, err = getBusyScript(ctx, params)
+		}
+		if err != nil {
+			clusterizeScript = GetErrorScript(err)
+		}
 		resData["body"] = clusterizeScript
 	}
+	// the error scripts are signed as well, so the vm reports the error instead of rejecting the script
+	if script, ok := resData["body"].(string); ok {
+		common.SetScriptSignatureHeader(ctx, params.KeyVaultUri, resData, script)
+	}
 	outputs["res"] = resData
 	invokeResponse := common.InvokeResponse{Outputs: outputs, Logs: nil, ReturnValue: nil}
 
+	// the body is the bash script the vm runs as is, not a common.Response, so failures are returned as an error
+	// script which reports them from the vm
 	responseJson, _ := json.Marshal(invokeResponse)
 
 	w.Header().Set("Content-Type", "application/json")
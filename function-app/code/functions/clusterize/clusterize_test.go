@@ -0,0 +1,92 @@
+package clusterize
+
+import (
+	"context"
+	"encoding/json"
+	"strings"
+	"testing"
+	"time"
+	"weka-deployment/common"
+	"weka-deployment/common/fakes"
+
+	"github.com/weka/go-cloud-lib/clusterize"
+	"github.com/weka/go-cloud-lib/protocol"
+)
+
+func Test_ClusterizeNotLastInstance(t *testing.T) {
+	clients := fakes.NewClients()
+	ctx := clients.Context(context.Background())
+
+	p := ClusterizationParams{
+		KeyVaultUri:        "https://weka-test-kv.vault.azure.net",
+		StateStorageName:   "wekateststorage",
+		StateContainerName: "weka-test-state",
+		PrivateNetwork:     true,
+		VmName:             "weka-test-backend-vmss_0",
+		Cluster:            clusterize.ClusterParams{ClusterName: "test", HostsNum: 3},
+		FunctionAppName:    "weka-test-function-app",
+	}
+	err := common.WriteState(ctx, p.StateStorageName, p.StateContainerName, protocol.ClusterState{InitialSize: 3, DesiredSize: 3})
+	if err != nil {
+		t.Fatalf("failed writing state: %s", err)
+	}
+	_ = clients.Secrets.SetSecret(ctx, p.KeyVaultUri, "function-app-default-key", "test-key")
+
+	script := Clusterize(ctx, p)
+	if !strings.Contains(script, "instance 1/3 that is ready for clusterization") {
+		t.Fatalf("unexpected clusterize script: %s", script)
+	}
+
+	// a retried call returns the saved response, the instance is not added again
+	if retried := Clusterize(ctx, p); retried != script {
+		t.Errorf("unexpected clusterize script on retry: %s", retried)
+	}
+	state, err := common.ReadState(ctx, p.StateStorageName, p.StateContainerName)
+	if err != nil {
+		t.Fatalf("failed reading state: %s", err)
+	}
+	if len(state.Instances) != 1 || state.Instances[0] != p.VmName {
+		t.Errorf("unexpected state instances: %v", state.Instances)
+	}
+
+	phase, err := common.GetDeploymentPhase(ctx, p.StateStorageName, p.StateContainerName)
+	if err != nil {
+		t.Fatalf("failed reading deployment phase: %s", err)
+	}
+	if phase.Phase != common.DeploymentPhaseCollecting {
+		t.Errorf("unexpected deployment phase: %s", phase.Phase)
+	}
+}
+
+func Test_CheckClusterizationTimeoutTooFewInstances(t *testing.T) {
+	t.Setenv("CLUSTERIZATION_TIMEOUT_MINUTES", "60")
+	clients := fakes.NewClients()
+	ctx := clients.Context(context.Background())
+
+	p := ClusterizationParams{
+		StateStorageName:   "wekateststorage",
+		StateContainerName: "weka-test-state",
+		Cluster: clusterize.ClusterParams{
+			ClusterName:    "test",
+			HostsNum:       6,
+			DataProtection: clusterize.DataProtectionParams{StripeWidth: 3, ProtectionLevel: 2, Hotspare: 1},
+		},
+	}
+	state := protocol.ClusterState{InitialSize: 6, DesiredSize: 6, Instances: []string{"vmss_0:host0", "vmss_1:host1"}}
+	if err := common.WriteState(ctx, p.StateStorageName, p.StateContainerName, state); err != nil {
+		t.Fatalf("failed writing state: %s", err)
+	}
+	phase, _ := json.Marshal(common.DeploymentPhase{Phase: common.DeploymentPhaseCollecting, StartedAt: time.Now().Add(-2 * time.Hour)})
+	_ = clients.Storage.WriteBlob(ctx, p.StateStorageName, p.StateContainerName, "phase", phase)
+
+	if err := CheckClusterizationTimeout(ctx, p); err == nil || !strings.Contains(err.Error(), "at least 6 are required") {
+		t.Fatalf("expected clusterization timeout error, got: %v", err)
+	}
+	deploymentPhase, err := common.GetDeploymentPhase(ctx, p.StateStorageName, p.StateContainerName)
+	if err != nil {
+		t.Fatalf("failed reading deployment phase: %s", err)
+	}
+	if deploymentPhase.Phase != common.DeploymentPhaseError || deploymentPhase.FailedPhase != common.DeploymentPhaseCollecting {
+		t.Errorf("unexpected deployment phase: %+v", deploymentPhase)
+	}
+}
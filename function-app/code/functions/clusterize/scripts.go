@@ -0,0 +1,1588 @@
+package clusterize
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+	"weka-deployment/common"
+
+	"github.com/lithammer/dedent"
+)
+
+// the clusterize script itself is generated by go-cloud-lib, optional configuration steps
+// are injected around its well known commands
+const clusterCreateCmd = "weka cluster create"
+
+func injectBeforeClusterCreate(clusterizeScript, script string) string {
+	return strings.Replace(clusterizeScript, clusterCreateCmd, script+"\n"+clusterCreateCmd, 1)
+}
+
+type WekaNetInterface struct {
+	Name      string `json:"name"`
+	IPAddress string `json:"ip_address"`
+	Netmask   string `json:"netmask"`
+}
+
+// GetWekaContainerNetworkScript binds the nics to the container, the deploy and join scripts of every backend run it
+// once the container is set up and apply restarts it with the nics
+func GetWekaContainerNetworkScript(containerName string, netInterfaces []WekaNetInterface) string {
+	var cmds []string
+	for _, netInterface := range netInterfaces {
+		cmd := fmt.Sprintf("weka local resources net add --name %s --interface %s", containerName, netInterface.Name)
+		if netInterface.IPAddress != "" {
+			cmd += fmt.Sprintf(" --ips %s", netInterface.IPAddress)
+		}
+		if netInterface.Netmask != "" {
+			cmd += fmt.Sprintf(" --netmask %s", netInterface.Netmask)
+		}
+		cmds = append(cmds, cmd)
+	}
+
+	template := `
+	# %s container network configuration
+	%s
+	weka local resources apply --container %s -f
+	`
+	return fmt.Sprintf(dedent.Dedent(template), containerName, strings.Join(cmds, "\n"), containerName)
+}
+
+type FlashCacheConfig struct {
+	Devices []string `json:"devices"`
+	// flash cache size of each device
+	SizeGiB int `json:"size_gib"`
+}
+
+// GetWekaFlashCacheScript adds cacheSizeGiB of flash cache on each device, the deploy and join scripts of every
+// backend run it and fail when a device is smaller than the size, so the sizes never exceed the ssds capacity
+func GetWekaFlashCacheScript(cacheDevices []string, cacheSizeGiB int) string {
+	template := `
+	# flash cache configuration
+	FC_DEVICES=(%s)
+	FC_SIZE_GIB=%d
+	for device in "${FC_DEVICES[@]}"; do
+		device_size_gib=$(( $(lsblk -b -dn -o SIZE "$device") / 1024 / 1024 / 1024 ))
+		if [ "$FC_SIZE_GIB" -gt "$device_size_gib" ]; then
+			report "{\"hostname\": \"$HOSTNAME\", \"type\": \"error\", \"message\": \"Flash cache size of $FC_SIZE_GIB GiB exceeds the $device_size_gib GiB of $device\"}"
+			exit 1
+		fi
+	done
+	for device in "${FC_DEVICES[@]}"; do
+		weka local resources fc add --device "$device" --size ${FC_SIZE_GIB}GiB
+	done
+	`
+	return fmt.Sprintf(dedent.Dedent(template), strings.Join(cacheDevices, " "), cacheSizeGiB)
+}
+
+type CrashConsistencyConfig struct {
+	EnableBarriers   bool `json:"enable_barriers"`
+	CommitIntervalMs int  `json:"commit_interval_ms"`
+}
+
+func GetWekaCrashConsistencyScript(enableBarriers bool, commitIntervalMs int) string {
+	barrierMode := "on"
+	warning := ""
+	if !enableBarriers {
+		barrierMode = "off"
+		// disks with volatile write cache may lose acknowledged writes on power loss when barriers are off
+		warning = "# WARNING: write barriers are disabled, this trades crash consistency for write performance"
+	}
+
+	template := `
+	# crash consistency configuration
+	%s
+	weka cluster configure --commit-interval %d --barrier-mode %s
+	`
+	return fmt.Sprintf(dedent.Dedent(template), warning, commitIntervalMs, barrierMode)
+}
+
+// minimal free ssd percentage of the filesystem required for running compaction
+const obsCompactionMinFreeSsdPercent = 10
+
+// GetWekaObsCompactionScript schedules the compaction of the filesystem every scheduleHours, an interval of a day
+// or more must be a whole number of days, common.ValidateConfig rejects the others
+func GetWekaObsCompactionScript(fsName string, scheduleHours int) string {
+	cronSchedule := fmt.Sprintf("0 */%d * * *", scheduleHours)
+	if scheduleHours >= 24 {
+		cronSchedule = fmt.Sprintf("0 0 */%d * *", scheduleHours/24)
+	}
+	// each filesystem has its own script and cron file, the cron file names are limited to letters, digits, - and _
+	jobName := "weka_obs_compaction_" + regexp.MustCompile(`[^A-Za-z0-9_-]`).ReplaceAllString(fsName, "_")
+
+	template := `
+	# obs compaction schedule of %s
+	cat >/opt/weka/tmp/%s.sh <<'EOL'
+	#!/bin/bash
+	FS_NAME=%s
+	MIN_FREE_SSD_PERCENT=%d
+	fs_info=$(weka fs --name "$FS_NAME" -J)
+	ssd_budget=$(echo "$fs_info" | jq '.[0].ssd_budget // 0')
+	used_ssd=$(echo "$fs_info" | jq '.[0].used_ssd // 0')
+	if [ "$ssd_budget" -le 0 ]; then
+		echo "$FS_NAME has no ssd budget, skipping"
+		exit 0
+	fi
+	free_ssd_percent=$(( (ssd_budget - used_ssd) * 100 / ssd_budget ))
+	if [ "$free_ssd_percent" -lt "$MIN_FREE_SSD_PERCENT" ]; then
+		echo "not enough free ssd capacity for compaction of $FS_NAME ($free_ssd_percent%%), skipping"
+		exit 0
+	fi
+	weka fs tier compact "$FS_NAME"
+	EOL
+	chmod +x /opt/weka/tmp/%s.sh
+	echo "%s root /opt/weka/tmp/%s.sh >> /var/log/%s.log 2>&1" > /etc/cron.d/%s
+	`
+	return fmt.Sprintf(
+		dedent.Dedent(template), fsName, jobName, fsName, obsCompactionMinFreeSsdPercent, jobName, cronSchedule, jobName, jobName, jobName,
+	)
+}
+
+// GetWekaGuestOSScriptExtensionScript returns the az cli equivalent of common.ConfigureVMSSCustomScriptExtension,
+// for operators who need to re-apply the extension manually
+func GetWekaGuestOSScriptExtensionScript(storageAccountName, containerName, scriptBlobName string) string {
+	config := common.ScriptExtensionConfig{
+		StorageAccountName: storageAccountName,
+		ContainerName:      containerName,
+		ScriptBlobName:     scriptBlobName,
+	}
+	template := `
+	#!/bin/bash
+	set -ex
+	VMSS_NAME=$1
+	RESOURCE_GROUP=$2
+	SCRIPT_URL="%s"
+
+	az vmss extension set \
+		--vmss-name "$VMSS_NAME" \
+		--resource-group "$RESOURCE_GROUP" \
+		--name CustomScript \
+		--publisher Microsoft.Azure.Extensions \
+		--version 2.1 \
+		--extension-instance-name weka-reimage-recovery \
+		--protected-settings "{\"fileUris\": [\"$SCRIPT_URL\"], \"commandToExecute\": \"%s\", \"managedIdentity\": {}}"
+	az vmss update-instances --instance-ids '*' --name "$VMSS_NAME" --resource-group "$RESOURCE_GROUP"
+	`
+	return fmt.Sprintf(dedent.Dedent(template), config.ScriptUrl(), config.ScriptCommand())
+}
+
+// GetWekaMaintenanceWindowHelperScript installs weka-maintenance-window on the clusterizing backend, it generates
+// the alerts suppression script of a maintenance window through the maintenance_window function and runs it
+func GetWekaMaintenanceWindowHelperScript(maintenanceWindowFuncDef string) string {
+	template := `
+	# maintenance window helper, usage: weka-maintenance-window <start_time> <end_time> <alert>...
+	cat > /usr/local/bin/weka-maintenance-window <<'EOF'
+	#!/bin/bash
+	set -e
+	%s
+	if [ $# -lt 3 ]; then
+		echo "usage: $0 <start_time> <end_time> <alert>..." >&2
+		exit 1
+	fi
+	json_data=$(jq -cn --arg start "$1" --arg end "$2" '{start_time: $start, end_time: $end, alerts: $ARGS.positional}' --args "${@:3}")
+	script=$(maintenance_window "$json_data")
+	bash -c "$script"
+	EOF
+	chmod 700 /usr/local/bin/weka-maintenance-window
+	`
+	return fmt.Sprintf(dedent.Dedent(template), dedent.Dedent(maintenanceWindowFuncDef))
+}
+
+const wekaSrvRecordName = "_weka._tcp"
+
+// GetWekaDNSServiceDiscoveryScript returns the az cli equivalent of the dns service discovery registration, srv
+// targets must be host names, so each ip gets an A record named after it, weka-backend-<ip with dashes>
+func GetWekaDNSServiceDiscoveryScript(dnsZone string, clusterIPs []string, port int) string {
+	var cmds []string
+	for _, ip := range clusterIPs {
+		recordName := fmt.Sprintf("weka-backend-%s", strings.ReplaceAll(ip, ".", "-"))
+		cmds = append(cmds, fmt.Sprintf("az network private-dns record-set a add-record -g \"$RESOURCE_GROUP\" -z %s -n %s -a %s", dnsZone, recordName, ip))
+		cmds = append(cmds, fmt.Sprintf("az network private-dns record-set srv add-record -g \"$RESOURCE_GROUP\" -z %s -n %s -t %s.%s -r %d -p 0 -w 10", dnsZone, wekaSrvRecordName, recordName, dnsZone, port))
+	}
+
+	template := `
+	#!/bin/bash
+	set -ex
+	RESOURCE_GROUP=$1
+	%s
+	`
+	return fmt.Sprintf(dedent.Dedent(template), strings.Join(cmds, "\n"))
+}
+
+// bash function uploading a local file to azure blob using the vm managed identity
+func getUploadBlobFunctionDef() string {
+	s := `
+	function upload_blob {
+		local file_path=$1
+		local blob_url=$2
+		local token=$(curl -s -H Metadata:true --noproxy "*" "http://169.254.169.254/metadata/identity/oauth2/token?api-version=2018-02-01&resource=https://storage.azure.com/" | jq -r .access_token)
+		curl -sf -X PUT -H "Authorization: Bearer $token" -H "x-ms-version: 2020-04-08" -H "x-ms-blob-type: BlockBlob" --data-binary @"$file_path" "$blob_url"
+	}
+	`
+	return dedent.Dedent(s)
+}
+
+// GetWekaPerformanceBaselineScript runs fio on the weka filesystem and uploads the results when a result container is given,
+// the baseline is skipped when there is no frontend container or fio is missing, and a failed or below PERF_BASELINE_MIN_MBPS
+// baseline is only reported, it never fails the clusterization
+func GetWekaPerformanceBaselineScript(fsName, resultStorageAccount, resultContainer string) string {
+	resultBlobUrl := ""
+	if resultStorageAccount != "" && resultContainer != "" {
+		resultBlobUrl = common.GetBlobUrl(resultStorageAccount) + resultContainer
+	}
+
+	template := `
+	# performance baseline
+	FS_NAME=%s
+	PERF_BASELINE_MIN_MBPS=${PERF_BASELINE_MIN_MBPS:-0}
+	PERF_BASELINE_RESULT_URL=%s
+	BASELINE_MOUNT=/mnt/weka-baseline
+	BASELINE_RESULTS=/opt/weka/tmp/performance_baseline.json
+	%s
+	function run_fio {
+		local name=$1
+		local rw=$2
+		local bs=$3
+		fio --name="$name" --directory=$BASELINE_MOUNT --rw="$rw" --bs="$bs" --size=1G --numjobs=4 --iodepth=32 \
+			--ioengine=libaio --direct=1 --time_based --runtime=60 --group_reporting --output-format=json
+	}
+
+	function run_performance_baseline {
+		if ! weka local ps --no-header -o name | grep -q frontend; then
+			report "{\"hostname\": \"$HOSTNAME\", \"type\": \"progress\", \"message\": \"Skipping performance baseline, no frontend container is running\"}"
+			return 0
+		fi
+		if ! command -v fio >/dev/null 2>&1; then
+			report "{\"hostname\": \"$HOSTNAME\", \"type\": \"progress\", \"message\": \"Skipping performance baseline, fio is not installed\"}"
+			return 0
+		fi
+
+		mkdir -p $BASELINE_MOUNT || return 1
+		mount -t wekafs "$FS_NAME" $BASELINE_MOUNT || return 1
+
+		local seq_read seq_write rand_read rand_write
+		seq_read=$(run_fio seq_read read 1M) && seq_write=$(run_fio seq_write write 1M) && \
+			rand_read=$(run_fio rand_read randread 4k) && rand_write=$(run_fio rand_write randwrite 4k)
+		local fio_status=$?
+		rm -rf $BASELINE_MOUNT/seq_* $BASELINE_MOUNT/rand_*
+		umount $BASELINE_MOUNT
+		[ $fio_status -eq 0 ] || return 1
+
+		jq -n --argjson seq_read "$seq_read" --argjson seq_write "$seq_write" \
+			--argjson rand_read "$rand_read" --argjson rand_write "$rand_write" \
+			'{seq_read: $seq_read, seq_write: $seq_write, rand_read: $rand_read, rand_write: $rand_write}' > $BASELINE_RESULTS || return 1
+
+		if [ -n "$PERF_BASELINE_RESULT_URL" ]; then
+			upload_blob $BASELINE_RESULTS "$PERF_BASELINE_RESULT_URL/performance-baseline/$(date -u +%%Y%%m%%dT%%H%%M%%SZ).json" || \
+				report "{\"hostname\": \"$HOSTNAME\", \"type\": \"error\", \"message\": \"Failed uploading performance baseline results\"}"
+		fi
+
+		local seq_read_mbps seq_write_mbps rand_read_iops rand_write_iops
+		seq_read_mbps=$(jq '.seq_read.jobs[0].read.bw / 1024 | floor' $BASELINE_RESULTS)
+		seq_write_mbps=$(jq '.seq_write.jobs[0].write.bw / 1024 | floor' $BASELINE_RESULTS)
+		rand_read_iops=$(jq '.rand_read.jobs[0].read.iops | floor' $BASELINE_RESULTS)
+		rand_write_iops=$(jq '.rand_write.jobs[0].write.iops | floor' $BASELINE_RESULTS)
+		report "{\"hostname\": \"$HOSTNAME\", \"type\": \"progress\", \"message\": \"Performance baseline: seq read ${seq_read_mbps}MB/s, seq write ${seq_write_mbps}MB/s, rand read ${rand_read_iops} iops, rand write ${rand_write_iops} iops\"}"
+		if [ "$PERF_BASELINE_MIN_MBPS" -gt 0 ] && { [ "$seq_read_mbps" -lt "$PERF_BASELINE_MIN_MBPS" ] || [ "$seq_write_mbps" -lt "$PERF_BASELINE_MIN_MBPS" ]; }; then
+			report "{\"hostname\": \"$HOSTNAME\", \"type\": \"error\", \"message\": \"Performance baseline is below the minimal threshold of ${PERF_BASELINE_MIN_MBPS}MB/s\"}"
+		fi
+	}
+
+	run_performance_baseline || \
+		report "{\"hostname\": \"$HOSTNAME\", \"type\": \"error\", \"message\": \"Failed running performance baseline\"}"
+	`
+	return fmt.Sprintf(dedent.Dedent(template), fsName, resultBlobUrl, getUploadBlobFunctionDef())
+}
+
+// the key vault secret holding the log analytics workspace key
+const sentinelPrimaryKeySecretName = "sentinel-primary-key"
+
+// SentinelConfig is the log analytics workspace the security events are forwarded to, its primary key is the
+// sentinel-primary-key secret of the key vault
+type SentinelConfig struct {
+	WorkspaceId string `json:"workspace_id"`
+	LogType     string `json:"log_type"`
+}
+
+// GetWekaAzureSentinelScript installs a daemon forwarding weka security events to the log analytics data collector api,
+// the workspace key is read from the key vault with the vm managed identity, so it's never part of the script
+// see https://learn.microsoft.com/en-us/azure/azure-monitor/logs/data-collector-api
+func GetWekaAzureSentinelScript(workspaceId, keyVaultUri, keySecretName, logType string) string {
+	template := `
+	# microsoft sentinel forwarder
+	mkdir -p /opt/weka/sentinel
+	cat >/opt/weka/sentinel/forwarder.sh <<'EOL'
+	#!/bin/bash
+	WORKSPACE_ID=%s
+	LOG_TYPE=%s
+	LOG_ANALYTICS_SUFFIX=%s
+	KEY_SECRET_URL=%s
+	KEY_VAULT_RESOURCE=%s
+	STATE_FILE=/opt/weka/sentinel/last_event_time
+	SHARED_KEY=""
+
+	function get_shared_key {
+		local token=$(curl -s -H Metadata:true --noproxy "*" "http://169.254.169.254/metadata/identity/oauth2/token?api-version=2018-02-01&resource=$KEY_VAULT_RESOURCE" | jq -r .access_token)
+		curl -sf -H "Authorization: Bearer $token" "$KEY_SECRET_URL?api-version=7.4" | jq -r .value
+	}
+
+	function post_events {
+		local body=$1
+		local date=$(date -u +"%%a, %%d %%b %%Y %%H:%%M:%%S GMT")
+		local content_length=$(printf "%%s" "$body" | wc -c)
+		local string_to_sign="POST\n${content_length}\napplication/json\nx-ms-date:${date}\n/api/logs"
+		local decoded_key=$(echo "$SHARED_KEY" | base64 -d | xxd -p -c 256)
+		local signature=$(printf "$string_to_sign" | openssl dgst -sha256 -mac HMAC -macopt "hexkey:$decoded_key" -binary | base64 -w 0)
+		curl -sf -X POST "https://$WORKSPACE_ID.$LOG_ANALYTICS_SUFFIX/api/logs?api-version=2016-04-01" \
+			-H "Content-Type: application/json" \
+			-H "Log-Type: $LOG_TYPE" \
+			-H "x-ms-date: $date" \
+			-H "Authorization: SharedKey $WORKSPACE_ID:$signature" \
+			-d "$body"
+	}
+
+	while true; do
+		# the key is fetched again after a failed post, it may have been rotated
+		if [ -z "$SHARED_KEY" ]; then
+			SHARED_KEY=$(get_shared_key) || SHARED_KEY=""
+		fi
+		start_time=$(cat $STATE_FILE 2>/dev/null || date -u -d "-5 minutes" +%%Y-%%m-%%dT%%H:%%M:%%S)
+		now=$(date -u +%%Y-%%m-%%dT%%H:%%M:%%S)
+		events=$(weka events --json --type security --start-time "$start_time" --end-time "$now")
+		if [ -n "$events" ] && [ "$events" != "[]" ]; then
+			if post_events "$events"; then
+				echo "$now" > $STATE_FILE
+			else
+				SHARED_KEY=""
+			fi
+		else
+			echo "$now" > $STATE_FILE
+		fi
+		sleep 60
+	done
+	EOL
+	chmod +x /opt/weka/sentinel/forwarder.sh
+
+	cat >/etc/systemd/system/weka-sentinel-forwarder.service <<EOL
+	[Unit]
+	Description=Weka security events forwarder to Microsoft Sentinel
+	After=network-online.target
+
+	[Service]
+	ExecStart=/opt/weka/sentinel/forwarder.sh
+	Restart=always
+	RestartSec=30
+
+	[Install]
+	WantedBy=multi-user.target
+	EOL
+	systemctl daemon-reload
+	systemctl enable --now weka-sentinel-forwarder.service
+	`
+	keySecretUrl := fmt.Sprintf("%s/secrets/%s", strings.TrimSuffix(keyVaultUri, "/"), keySecretName)
+	keyVaultResource := strings.TrimSuffix(common.GetCloudEnvironment().KeyVaultScope, "/.default")
+	return fmt.Sprintf(
+		dedent.Dedent(template), workspaceId, logType, common.GetCloudEnvironment().LogAnalyticsSuffix, keySecretUrl, keyVaultResource,
+	)
+}
+
+const clusterizeScriptHeader = "set -ex\n"
+
+// injects the script right after the clusterize script header, before any weka command runs
+func injectAfterScriptHeader(clusterizeScript, script string) string {
+	return strings.Replace(clusterizeScript, clusterizeScriptHeader, clusterizeScriptHeader+script+"\n", 1)
+}
+
+const (
+	EDRTypeCrowdstrike = "crowdstrike"
+	EDRTypeCarbonBlack = "carbonblack"
+)
+
+// EDRConfig is installed by the deploy and join scripts of every backend, the registration token is taken from the
+// key vault
+type EDRConfig struct {
+	Type      string `json:"type"`
+	ConfigUrl string `json:"config_url"`
+}
+
+func ValidateEDRType(edrType string) error {
+	if edrType != EDRTypeCrowdstrike && edrType != EDRTypeCarbonBlack {
+		return fmt.Errorf("unsupported edr type %s, supported types are: %s, %s", edrType, EDRTypeCrowdstrike, EDRTypeCarbonBlack)
+	}
+	return nil
+}
+
+func GetWekaEndpointDetectionScript(edrType, configUrl, registrationToken string) string {
+	var installTemplate string
+	switch edrType {
+	case EDRTypeCrowdstrike:
+		installTemplate = `
+		curl -sfL "$EDR_CONFIG_URL" -o /tmp/falcon-sensor.deb
+		dpkg -i /tmp/falcon-sensor.deb || apt-get install -f -y
+		set +x
+		/opt/CrowdStrike/falconctl -s -f --cid="$EDR_REGISTRATION_TOKEN"
+		set -x
+		systemctl enable --now falcon-sensor
+		`
+	case EDRTypeCarbonBlack:
+		installTemplate = `
+		mkdir -p /tmp/carbonblack
+		curl -sfL "$EDR_CONFIG_URL" -o /tmp/carbonblack/installer.tar.gz
+		tar -xzf /tmp/carbonblack/installer.tar.gz -C /tmp/carbonblack
+		set +x
+		/tmp/carbonblack/install.sh "$EDR_REGISTRATION_TOKEN"
+		set -x
+		systemctl enable --now cbagentd
+		`
+	default:
+		installTemplate = `
+		echo "unsupported edr type: $EDR_TYPE"
+		exit 1
+		`
+	}
+
+	template := `
+	# endpoint detection and response agent installation
+	EDR_TYPE=%s
+	EDR_CONFIG_URL="%s"
+	set +x
+	EDR_REGISTRATION_TOKEN="%s"
+	set -x
+	%s
+	echo "$EDR_TYPE edr agent installed"
+	`
+	return fmt.Sprintf(dedent.Dedent(template), edrType, configUrl, registrationToken, dedent.Dedent(installTemplate))
+}
+
+const (
+	SpeedTestProtocolTCP  = "tcp"
+	SpeedTestProtocolRDMA = "rdma"
+)
+
+// GetWekaSpeedTestServerScript starts the iperf3 (tcp) or ib_send_bw (rdma) server the speed test of the last
+// instance measures the backend with, the deploy script of every backend starts it before calling clusterize and
+// it's stopped after the timeout
+func GetWekaSpeedTestServerScript(protocol string, durationSeconds int, timeout time.Duration) string {
+	var serverTemplate string
+	switch protocol {
+	case SpeedTestProtocolRDMA:
+		serverTemplate = `
+		command -v ib_send_bw >/dev/null 2>&1 || apt-get install -y perftest
+		# ib_send_bw serves a single client and exits
+		nohup timeout "$SPEED_TEST_SERVER_TIMEOUT" bash -c 'while true; do ib_send_bw -D "$0" -F --report_gbits || sleep 1; done' "$SPEED_TEST_DURATION" >/dev/null 2>&1 &
+		`
+	default:
+		serverTemplate = `
+		command -v iperf3 >/dev/null 2>&1 || apt-get install -y iperf3
+		nohup timeout "$SPEED_TEST_SERVER_TIMEOUT" iperf3 -s >/dev/null 2>&1 &
+		`
+	}
+
+	template := `
+	# network speed test server
+	SPEED_TEST_DURATION=%d
+	SPEED_TEST_SERVER_TIMEOUT=%ds
+	%s
+	`
+	return fmt.Sprintf(dedent.Dedent(template), durationSeconds, int(timeout.Seconds()), dedent.Dedent(serverTemplate))
+}
+
+// GetWekaSpeedTestScript measures the bandwidth to each peer using iperf3 (tcp) or ib_send_bw (rdma) and fails
+// when it is below minBandwidthGbps, the peers run the server GetWekaSpeedTestServerScript started. Unreachable
+// peers are reported and skipped, the test fails when no peer could be measured. SPEED_TEST_STAGE is used to label
+// the results.
+func GetWekaSpeedTestScript(peerIPs []string, protocol string, durationSeconds, minBandwidthGbps int) string {
+	var measureTemplate string
+	switch protocol {
+	case SpeedTestProtocolRDMA:
+		measureTemplate = `
+		command -v ib_send_bw >/dev/null 2>&1 || apt-get install -y perftest
+		function measure_bandwidth {
+			ib_send_bw "$1" -D "$SPEED_TEST_DURATION" -F --report_gbits | awk '/^ *[0-9]/ {bw=$4} END {print bw}'
+		}
+		`
+	default:
+		measureTemplate = `
+		command -v iperf3 >/dev/null 2>&1 || apt-get install -y iperf3
+		function measure_bandwidth {
+			iperf3 -c "$1" -t "$SPEED_TEST_DURATION" -P 4 -J | jq '.end.sum_received.bits_per_second / 1000000000'
+		}
+		`
+	}
+
+	template := `
+	# network speed test
+	SPEED_TEST_PEERS=(%s)
+	SPEED_TEST_PROTOCOL=%s
+	SPEED_TEST_DURATION=%d
+	SPEED_TEST_MIN_GBPS=%d
+	SPEED_TEST_STAGE=${SPEED_TEST_STAGE:-clusterization}
+	%s
+	speed_test_failed=false
+	speed_test_measured=0
+	local_ips=$(hostname -I)
+	for peer in "${SPEED_TEST_PEERS[@]}"; do
+		if [[ " $local_ips " == *" $peer "* ]]; then
+			continue
+		fi
+		bw=$(measure_bandwidth "$peer" || true)
+		if [ -z "$bw" ]; then
+			report "{\"hostname\": \"$HOSTNAME\", \"type\": \"progress\", \"message\": \"$SPEED_TEST_STAGE $SPEED_TEST_PROTOCOL speed test to $peer skipped, peer is unreachable\"}"
+			continue
+		fi
+		speed_test_measured=$((speed_test_measured + 1))
+		report "{\"hostname\": \"$HOSTNAME\", \"type\": \"progress\", \"message\": \"$SPEED_TEST_STAGE $SPEED_TEST_PROTOCOL speed test to $peer: $bw Gbps\"}"
+		if awk -v bw="$bw" -v min="$SPEED_TEST_MIN_GBPS" 'BEGIN {exit !(bw < min)}'; then
+			report "{\"hostname\": \"$HOSTNAME\", \"type\": \"error\", \"message\": \"$SPEED_TEST_STAGE $SPEED_TEST_PROTOCOL bandwidth to $peer ($bw Gbps) is below the required $SPEED_TEST_MIN_GBPS Gbps\"}"
+			speed_test_failed=true
+		fi
+	done
+	if [[ $speed_test_measured -eq 0 ]]; then
+		report "{\"hostname\": \"$HOSTNAME\", \"type\": \"error\", \"message\": \"$SPEED_TEST_STAGE $SPEED_TEST_PROTOCOL speed test couldn't measure any peer\"}"
+		exit 1
+	fi
+	if [[ $speed_test_failed == true ]]; then
+		exit 1
+	fi
+	`
+	return fmt.Sprintf(
+		dedent.Dedent(template), strings.Join(peerIPs, " "), protocol, durationSeconds, minBandwidthGbps, dedent.Dedent(measureTemplate),
+	)
+}
+
+// FrontDoorConfig exposes the weka s3 through a premium front door profile, front door reaches the backends through
+// a private link service fronting a load balancer of the s3 port, origin_host_name is the load balancer frontend
+type FrontDoorConfig struct {
+	ProfileName          string `json:"profile_name"`
+	Port                 int    `json:"port"`
+	PrivateLinkServiceId string `json:"private_link_service_id"`
+	PrivateLinkLocation  string `json:"private_link_location"`
+	OriginHostName       string `json:"origin_host_name"`
+}
+
+// GetWekaAzureFrontDoorScript sets the front door endpoint as the weka s3 domain, so virtual hosted style
+// requests routed by front door are accepted by the s3 cluster
+func GetWekaAzureFrontDoorScript(endpointHostName string) string {
+	template := `
+	# azure front door endpoint for weka s3
+	FRONT_DOOR_HOSTNAME=%s
+	echo "$FRONT_DOOR_HOSTNAME" > /opt/weka/tmp/front_door_endpoint
+	if weka s3 cluster -J | jq -e '.active == true' >/dev/null 2>&1; then
+		weka s3 cluster update --domain "$FRONT_DOOR_HOSTNAME"
+		report "{\"hostname\": \"$HOSTNAME\", \"type\": \"progress\", \"message\": \"Weka s3 is exposed via front door endpoint https://$FRONT_DOOR_HOSTNAME\"}"
+	else
+		report "{\"hostname\": \"$HOSTNAME\", \"type\": \"progress\", \"message\": \"Weka s3 cluster is not configured, front door endpoint https://$FRONT_DOOR_HOSTNAME is not applied\"}"
+	fi
+	`
+	return fmt.Sprintf(dedent.Dedent(template), endpointHostName)
+}
+
+const (
+	ACLModelPosix = "posix"
+	ACLModelNFSv4 = "nfsv4"
+	// posix acls apply to the full uid range unless restricted later by the admin
+	aclPosixUidRange = "0-4294967294"
+)
+
+type WekaACLConfig struct {
+	FsName             string   `json:"fs_name"`
+	ACLModel           string   `json:"acl_model"`
+	DefaultPermissions []string `json:"default_permissions"`
+}
+
+func ValidateACLModel(aclModel string) error {
+	if aclModel != ACLModelPosix && aclModel != ACLModelNFSv4 {
+		return fmt.Errorf("unsupported acl model %s, supported models are: %s, %s", aclModel, ACLModelPosix, ACLModelNFSv4)
+	}
+	return nil
+}
+
+// GetWekaACLScript configures the filesystem acl model and sets its default permissions
+// permissions are posix acl entries (e.g. group::r-x) or nfsv4 aces (e.g. A::OWNER@:rwatTnNcCy) according to the model
+func GetWekaACLScript(fsName, aclModel string, defaultPermissions []string) string {
+	template := `
+	# filesystem acls
+	ACL_FS_NAME=%s
+	ACL_MODEL=%s
+	ACL_PERMISSIONS=(%s)
+	if [[ $ACL_MODEL == %s ]]; then
+		weka fs update "$ACL_FS_NAME" --posix-uid-range %s
+	fi
+	for permission in "${ACL_PERMISSIONS[@]}"; do
+		weka security acl set "$ACL_FS_NAME" --model "$ACL_MODEL" "$permission"
+	done
+	report "{\"hostname\": \"$HOSTNAME\", \"type\": \"progress\", \"message\": \"$ACL_MODEL acls configured on $ACL_FS_NAME\"}"
+	`
+	var quotedPermissions []string
+	for _, permission := range defaultPermissions {
+		quotedPermissions = append(quotedPermissions, fmt.Sprintf("\"%s\"", permission))
+	}
+	return fmt.Sprintf(
+		dedent.Dedent(template), fsName, aclModel, strings.Join(quotedPermissions, " "), ACLModelPosix, aclPosixUidRange,
+	)
+}
+
+// drives are added to the cluster right before the cluster name is updated
+const clusterNameUpdateCmd = `weka cluster update --cluster-name="$CLUSTER_NAME"`
+
+func injectAfterDrivesAdded(clusterizeScript, script string) string {
+	return strings.Replace(clusterizeScript, clusterNameUpdateCmd, script+"\n"+clusterNameUpdateCmd, 1)
+}
+
+type WekaStoragePool struct {
+	Name             string   `json:"name"`
+	DriveDevices     []string `json:"drive_devices"`
+	MaxIOPS          int      `json:"max_iops"`
+	MaxBandwidthMbps int      `json:"max_bandwidth_mbps"`
+}
+
+// GetWekaStoragePoolScript groups the cluster drives by device path into pools and applies the pool qos limits,
+// a zero limit leaves the pool unlimited
+func GetWekaStoragePoolScript(pools []WekaStoragePool) string {
+	poolTemplate := `
+	pool_drives=$(weka cluster drive -J | jq -r --argjson devices '%s' '[.[] | select(.device_path as $d | $devices | index($d)) | .uuid] | join(" ")')
+	weka cluster drive pool add %s $pool_drives
+	`
+	configureTemplate := `
+	weka cluster drive pool configure %s%s
+	`
+	var poolsScript strings.Builder
+	poolsScript.WriteString("\n# storage pools\n")
+	for _, pool := range pools {
+		devices, _ := json.Marshal(pool.DriveDevices)
+		poolsScript.WriteString(fmt.Sprintf(dedent.Dedent(poolTemplate), devices, pool.Name))
+
+		var limits string
+		if pool.MaxIOPS > 0 {
+			limits += fmt.Sprintf(" --max-iops %d", pool.MaxIOPS)
+		}
+		if pool.MaxBandwidthMbps > 0 {
+			limits += fmt.Sprintf(" --max-bandwidth %dMB", pool.MaxBandwidthMbps)
+		}
+		if limits != "" {
+			poolsScript.WriteString(fmt.Sprintf(dedent.Dedent(configureTemplate), pool.Name, limits))
+		}
+	}
+	return poolsScript.String()
+}
+
+// WekaContainerSizing overrides the default container resources, zero cores or empty memory keep the default
+type WekaContainerSizing struct {
+	ComputeCores   int    `json:"compute_cores"`
+	DriveCores     int    `json:"drive_cores"`
+	FrontendCores  int    `json:"frontend_cores"`
+	ComputeMemory  string `json:"compute_memory"`
+	DriveMemory    string `json:"drive_memory"`
+	FrontendMemory string `json:"frontend_memory"`
+}
+
+func (s WekaContainerSizing) IsSet() bool {
+	return s != WekaContainerSizing{}
+}
+
+// GetWekaContainerSizingScript resizes the containers of all backends, resources are applied before io is started
+func GetWekaContainerSizingScript(sizing WekaContainerSizing) string {
+	template := `
+	# container sizing
+	function resize_containers() {
+		container_name=$1
+		cores=$2
+		cores_flag=$3
+		memory=$4
+		container_ids=$(weka cluster container -J | jq -r --arg name "$container_name" '.[] | select(.container_name == $name) | .host_id' | sed 's/HostId<\(.*\)>/\1/')
+		for container_id in $container_ids; do
+			if [ "$cores" -gt 0 ]; then
+				weka cluster container cores "$container_id" "$cores" $cores_flag
+			fi
+			if [ -n "$memory" ]; then
+				weka cluster container memory "$container_id" "$memory"
+			fi
+		done
+	}
+	resize_containers compute0 %d --only-compute-cores "%s"
+	resize_containers drives0 %d --only-drives-cores "%s"
+	resize_containers frontend0 %d --only-frontend-cores "%s"
+	weka cluster container apply --all --force
+	report "{\"hostname\": \"$HOSTNAME\", \"type\": \"progress\", \"message\": \"Container resources applied\"}"
+	`
+	return fmt.Sprintf(
+		dedent.Dedent(template), sizing.ComputeCores, sizing.ComputeMemory, sizing.DriveCores, sizing.DriveMemory,
+		sizing.FrontendCores, sizing.FrontendMemory,
+	)
+}
+
+// GetWekaNfsScript creates an nfs interface group on the frontend containers primary nic,
+// the nfs service is served by the frontend (protocol) containers
+func GetWekaNfsScript(interfaceGroupName string) string {
+	template := `
+	# nfs protocol gateway
+	NFS_INTERFACE_GROUP_NAME=%s
+	NFS_NIC=eth0
+	nfs_netmask=$(python3 -c "import ipaddress,sys; print(ipaddress.ip_interface(sys.argv[1]).netmask)" "$(ip -o -f inet addr show $NFS_NIC | awk '{print $4}')")
+	nfs_gateway=$(ip route | awk '/default/ {print $3; exit}')
+	weka nfs interface-group add "$NFS_INTERFACE_GROUP_NAME" NFS --subnet "$nfs_netmask" --gateway "$nfs_gateway"
+	frontend_host_ids=$(weka cluster container -J | jq -r '.[] | select(.container_name == "frontend0") | .host_id' | sed 's/HostId<\(.*\)>/\1/')
+	for host_id in $frontend_host_ids; do
+		weka nfs interface-group port add "$NFS_INTERFACE_GROUP_NAME" "$host_id" $NFS_NIC
+	done
+	report "{\"hostname\": \"$HOSTNAME\", \"type\": \"progress\", \"message\": \"NFS interface group $NFS_INTERFACE_GROUP_NAME created\"}"
+	`
+	return fmt.Sprintf(dedent.Dedent(template), interfaceGroupName)
+}
+
+// GetWekaUsersScript creates the weka users, the cluster is created with the default admin user, the custom admin user
+// replaces it after formation. The deployment service account is used by the functions so the admin password can be
+// rotated independently, the regular client user only mounts filesystems. The passwords are not traced
+func GetWekaUsersScript(adminUsername, deploymentUsername, deploymentPassword, clientUsername, clientPassword string) string {
+	var script string
+	if clientUsername != "" {
+		template := `
+		CLIENT_USERNAME=%s
+		set +x
+		CLIENT_PASSWORD='%s'
+		weka user add "$CLIENT_USERNAME" regular "$CLIENT_PASSWORD"
+		set -x
+		report "{\"hostname\": \"$HOSTNAME\", \"type\": \"progress\", \"message\": \"Client user $CLIENT_USERNAME created\"}"
+		`
+		script += fmt.Sprintf(dedent.Dedent(template), clientUsername, clientPassword)
+	}
+	if deploymentUsername != "" {
+		template := `
+		DEPLOYMENT_USERNAME=%s
+		set +x
+		DEPLOYMENT_PASSWORD='%s'
+		weka user add "$DEPLOYMENT_USERNAME" clusteradmin "$DEPLOYMENT_PASSWORD"
+		set -x
+		report "{\"hostname\": \"$HOSTNAME\", \"type\": \"progress\", \"message\": \"Deployment user $DEPLOYMENT_USERNAME created\"}"
+		`
+		script += fmt.Sprintf(dedent.Dedent(template), deploymentUsername, deploymentPassword)
+	}
+	if adminUsername != "" && adminUsername != "admin" {
+		template := `
+		ADMIN_USERNAME=%s
+		set +x
+		weka user add "$ADMIN_USERNAME" clusteradmin "$WEKA_PASSWORD"
+		weka user login "$ADMIN_USERNAME" "$WEKA_PASSWORD"
+		set -x
+		weka user delete admin
+		report "{\"hostname\": \"$HOSTNAME\", \"type\": \"progress\", \"message\": \"Admin user $ADMIN_USERNAME replaced the default admin\"}"
+		`
+		script += fmt.Sprintf(dedent.Dedent(template), adminUsername)
+	}
+	return script
+}
+
+// WekaFilesystem is created at clusterization time next to the default filesystem,
+// a zero tiering ssd percent keeps the filesystem on ssd only
+type WekaFilesystem struct {
+	Name              string `json:"name"`
+	CapacityGB        int    `json:"capacity_gb"`
+	TieringSsdPercent int    `json:"tiering_ssd_percent"`
+	Encrypted         bool   `json:"encrypted"`
+}
+
+// the default filesystem gets the ssd capacity which is left unprovisioned at this point
+const defaultFsCapacityCmd = "full_capacity=$(weka status -J | jq .capacity.unprovisioned_bytes)"
+
+func injectBeforeDefaultFsCreate(clusterizeScript, script string) string {
+	return strings.Replace(clusterizeScript, defaultFsCapacityCmd, script+"\n"+defaultFsCapacityCmd, 1)
+}
+
+// DefaultFsWritecacheConfig creates the default filesystem for the writecache mount mode, the ssd reserve percent
+// of the unprovisioned capacity is left out of the default filesystem for the writes the clients cache
+type DefaultFsWritecacheConfig struct {
+	SsdReservePercent int `json:"ssd_reserve_percent"`
+}
+
+// the default filesystem capacity is set by the clusterize script right before it is created
+func injectAfterDefaultFsCapacity(clusterizeScript, script string) string {
+	return strings.Replace(clusterizeScript, defaultFsCapacityCmd, defaultFsCapacityCmd+"\n"+script, 1)
+}
+
+// GetWekaDefaultFsWritecacheScript reduces the default filesystem capacity by the ssd reserve
+func GetWekaDefaultFsWritecacheScript(ssdReservePercent int) string {
+	template := `
+	# default filesystem writecache ssd reserve
+	DEFAULT_FS_SSD_RESERVE_PERCENT=%d
+	ssd_reserve=$(( full_capacity * DEFAULT_FS_SSD_RESERVE_PERCENT / 100 ))
+	full_capacity=$(( full_capacity - ssd_reserve ))
+	report "{\"hostname\": \"$HOSTNAME\", \"type\": \"progress\", \"message\": \"Default filesystem is created for writecache, ${ssd_reserve}B of ssd are reserved\"}"
+	`
+	return fmt.Sprintf(dedent.Dedent(template), ssdReservePercent)
+}
+
+// GetWekaFilesystemsScript creates the filesystems in the default filesystem group
+func GetWekaFilesystemsScript(filesystems []WekaFilesystem) string {
+	template := `
+	weka fs create %s default %dGB%s
+	report "{\"hostname\": \"$HOSTNAME\", \"type\": \"progress\", \"message\": \"Filesystem %s created\"}"
+	`
+	var fsScript strings.Builder
+	fsScript.WriteString("\n# filesystems\n")
+	for _, fs := range filesystems {
+		var flags string
+		if fs.Encrypted {
+			flags = " --encrypted"
+		}
+		fsScript.WriteString(fmt.Sprintf(dedent.Dedent(template), fs.Name, fs.CapacityGB, flags, fs.Name))
+	}
+	return fsScript.String()
+}
+
+// GetWekaFilesystemsTieringScript attaches the tiered filesystems to the first obs,
+// the total capacity is derived from the ssd capacity the same way as for the default filesystem
+func GetWekaFilesystemsTieringScript(filesystems []WekaFilesystem, tierName string) string {
+	template := `
+	weka fs tier s3 attach %s %s
+	weka fs update %s --total-capacity %dGB
+	`
+	var tieringScript strings.Builder
+	for _, fs := range filesystems {
+		if fs.TieringSsdPercent == 0 {
+			continue
+		}
+		totalCapacityGB := fs.CapacityGB * 100 / fs.TieringSsdPercent
+		tieringScript.WriteString(fmt.Sprintf(dedent.Dedent(template), fs.Name, tierName, fs.Name, totalCapacityGB))
+	}
+	return tieringScript.String()
+}
+
+// WekaKmsConfig configures an azure key vault key as the weka kms master key,
+// the deployment key vault is used when the key vault id is empty
+type WekaKmsConfig struct {
+	KeyVaultId string
+	KeyName    string
+}
+
+// GetWekaKmsScript sets the key vault as the cluster kms, the backends access it with the scale set managed identity.
+// The kms must be set before encrypted filesystems are created
+func GetWekaKmsScript(keyVaultUri, keyName string) string {
+	template := `
+	# kms
+	KMS_KEY_VAULT_URI=%s
+	KMS_KEY_NAME=%s
+	weka security kms set azure "$KMS_KEY_VAULT_URI" "$KMS_KEY_NAME"
+	weka security kms
+	report "{\"hostname\": \"$HOSTNAME\", \"type\": \"progress\", \"message\": \"KMS set to key $KMS_KEY_NAME of $KMS_KEY_VAULT_URI\"}"
+	`
+	return fmt.Sprintf(dedent.Dedent(template), keyVaultUri, keyName)
+}
+
+// the cluster admin is logged in right after the cluster is created, before its drives are added
+const clusterLoginCmd = "weka user login $WEKA_USERNAME $WEKA_PASSWORD"
+
+func injectAfterClusterCreate(clusterizeScript, script string) string {
+	return strings.Replace(clusterizeScript, clusterLoginCmd, clusterLoginCmd+"\n"+script, 1)
+}
+
+// GetWekaFaultDomainsScript assigns the containers of each backend the failure domain of its azure fault domain,
+// weka cluster create has no failure domain option, so the containers are reassigned and applied before any
+// drive is added and io is started
+func GetWekaFaultDomainsScript(hostnamesFaultDomains map[string]int) string {
+	hostnames := make([]string, 0, len(hostnamesFaultDomains))
+	for hostname := range hostnamesFaultDomains {
+		hostnames = append(hostnames, hostname)
+	}
+	sort.Strings(hostnames)
+	var assignments []string
+	for _, hostname := range hostnames {
+		assignments = append(assignments, fmt.Sprintf("[%s]=fd%d", hostname, hostnamesFaultDomains[hostname]))
+	}
+
+	template := `
+	# azure fault domains
+	declare -A FAULT_DOMAINS=(%s)
+	for hostname in "${!FAULT_DOMAINS[@]}"; do
+		container_ids=$(weka cluster container -J | jq -r --arg hostname "$hostname" '.[] | select(.hostname == $hostname) | .host_id | capture("(?<id>[0-9]+)").id')
+		for container_id in $container_ids; do
+			weka cluster container failure-domain "$container_id" --name "${FAULT_DOMAINS[$hostname]}"
+		done
+	done
+	weka cluster container apply --all --force
+	while [ "$(weka cluster container -J | jq '[.[] | select(.status != "UP")] | length')" -gt 0 ]; do
+		echo "waiting for the containers to be up after the failure domains update"
+		sleep 10
+	done
+	report "{\"hostname\": \"$HOSTNAME\", \"type\": \"progress\", \"message\": \"Containers failure domains set to the azure fault domains\"}"
+	`
+	return fmt.Sprintf(dedent.Dedent(template), strings.Join(assignments, " "))
+}
+
+// SmbDomainJoinConfig joins the smbw cluster to the active directory domain, the password of the join account
+// is taken from the key vault secret
+type SmbDomainJoinConfig struct {
+	DomainName         string `json:"domain_name"`
+	OrganizationalUnit string `json:"organizational_unit"`
+	Username           string `json:"username"`
+	PasswordSecretName string `json:"password_secret_name"`
+	Password           string `json:"-"`
+}
+
+func ValidateSmbDomainJoinConfig(config SmbDomainJoinConfig) error {
+	if config.DomainName == "" || config.Username == "" || config.PasswordSecretName == "" {
+		return fmt.Errorf("smb domain join requires domain_name, username and password_secret_name")
+	}
+	return nil
+}
+
+// the smb cluster is created by the smb protocol gateways once the weka cluster is up
+const smbClusterWaitRetries = 60
+
+// GetWekaSmbDomainJoinScript joins the smb cluster to the domain in the background, once the smb protocol gateways
+// created it, so the shares are usable right after the deployment without blocking the clusterization
+func GetWekaSmbDomainJoinScript(config SmbDomainJoinConfig) string {
+	var ouFlag string
+	if config.OrganizationalUnit != "" {
+		ouFlag = fmt.Sprintf("--create-computer '%s'", config.OrganizationalUnit)
+	}
+
+	template := `
+	# smb active directory domain join
+	SMB_DOMAIN_NAME=%s
+	SMB_DOMAIN_USERNAME='%s'
+	set +x
+	SMB_DOMAIN_PASSWORD='%s'
+	set -x
+	smb_domain_join() {
+		for (( i=0; i<%d; i++ )); do
+			all_hosts=$(weka smb cluster status | grep -c 'Host' || true)
+			not_ready_hosts=$(weka smb cluster status | grep -c 'Not Ready' || true)
+			if (( all_hosts > 0 && not_ready_hosts == 0 )); then
+				break
+			fi
+			echo "$(date -u): waiting for the smb cluster to be ready"
+			sleep 30
+		done
+		if (( i == %d )); then
+			report "{\"hostname\": \"$HOSTNAME\", \"type\": \"error\", \"message\": \"Smb cluster is not ready, $SMB_DOMAIN_NAME domain is not joined\"}"
+			return 1
+		fi
+		set +x
+		if weka smb domain join "$SMB_DOMAIN_USERNAME" "$SMB_DOMAIN_PASSWORD" %s; then
+			report "{\"hostname\": \"$HOSTNAME\", \"type\": \"progress\", \"message\": \"Smb cluster joined the $SMB_DOMAIN_NAME domain\"}"
+		else
+			report "{\"hostname\": \"$HOSTNAME\", \"type\": \"error\", \"message\": \"Smb cluster failed to join the $SMB_DOMAIN_NAME domain\"}"
+		fi
+	}
+	smb_domain_join > /tmp/smb_domain_join.log 2>&1 &
+	disown
+	`
+	return fmt.Sprintf(
+		dedent.Dedent(template), config.DomainName, config.Username, config.Password, smbClusterWaitRetries, smbClusterWaitRetries, ouFlag,
+	)
+}
+
+// WekaDefaultNetConfig is the ip range weka assigns the containers and clients addresses from in udp mode,
+// the gateway and netmask bits default to the ones of the backends subnet
+type WekaDefaultNetConfig struct {
+	Range       string `json:"range"`
+	Gateway     string `json:"gateway"`
+	NetmaskBits int    `json:"netmask_bits"`
+}
+
+// ValidateWekaDefaultNetConfig accepts a single address or a range of addresses, e.g. 10.0.2.100-10.0.2.200
+func ValidateWekaDefaultNetConfig(config WekaDefaultNetConfig) error {
+	for _, ip := range strings.Split(config.Range, "-") {
+		if net.ParseIP(ip) == nil {
+			return fmt.Errorf("invalid default net range %q, expected an address or a range of addresses", config.Range)
+		}
+	}
+	if net.ParseIP(config.Gateway) == nil {
+		return fmt.Errorf("invalid default net gateway %q", config.Gateway)
+	}
+	if config.NetmaskBits < 1 || config.NetmaskBits > 32 {
+		return fmt.Errorf("invalid default net netmask bits %d, expected 1 to 32", config.NetmaskBits)
+	}
+	return nil
+}
+
+// GetWekaDefaultNetScript sets the cluster default network, without dpdk the containers and the clients don't
+// get their addresses from dedicated nics
+func GetWekaDefaultNetScript(config WekaDefaultNetConfig) string {
+	template := `
+	# udp default network
+	weka cluster default-net set --range %s --gateway %s --netmask-bits %d
+	report "{\"hostname\": \"$HOSTNAME\", \"type\": \"progress\", \"message\": \"Weka default network set to %s\"}"
+	`
+	return fmt.Sprintf(dedent.Dedent(template), config.Range, config.Gateway, config.NetmaskBits, config.Range)
+}
+
+// GetRejoinScript calls the deploy function again and runs the script it returns, once the cluster is clusterized
+// deploy returns the script joining the instance to the existing cluster
+func GetRejoinScript(reportFuncDef, deployFuncDef, payload string) string {
+	template := `
+	#!/bin/bash
+	set -ex
+
+	# report function definition
+	%s
+
+	# deploy function definition
+	%s
+
+	report "{\"hostname\": \"$HOSTNAME\", \"type\": \"progress\", \"message\": \"Cluster is already clusterized, joining the existing cluster\"}"
+	deploy '%s' > /tmp/rejoin.sh
+	chmod +x /tmp/rejoin.sh
+	exec /tmp/rejoin.sh
+	`
+	return fmt.Sprintf(dedent.Dedent(template), reportFuncDef, deployFuncDef, payload)
+}
+
+// the drives of the cluster created by the library are added by the coordinator, one container at a time
+const drivesAddCmd = "DRIVE_NUMS=( $(weka cluster container | grep drives | awk '{print $1;}') )"
+
+// replaceDrivesAdd replaces the serial drives add of the clusterize script, up to the cluster name update
+func replaceDrivesAdd(clusterizeScript, script string) string {
+	start := strings.Index(clusterizeScript, drivesAddCmd)
+	end := strings.Index(clusterizeScript, clusterNameUpdateCmd)
+	if start < 0 || end < start {
+		return clusterizeScript
+	}
+	return clusterizeScript[:start] + script + "\n" + clusterizeScript[end:]
+}
+
+// checkDrivesNumFunctionDef validates the nvme devices count of a backend: a backend without nvme devices fails the
+// drives add, a count differing from NVMES_NUM (or from the local count when NVMES_NUM is 0) is reported
+const checkDrivesNumFunctionDef = `
+function check_drives_num {
+	local host=$1
+	local drives_num=$2
+	if [ "$drives_num" -eq 0 ]; then
+		report "{\"hostname\": \"$HOSTNAME\", \"type\": \"error\", \"message\": \"No nvme devices were found on $host\"}"
+		return 1
+	fi
+	if [ "$NVMES_NUM" -gt 0 ] && [ "$drives_num" -ne "$NVMES_NUM" ]; then
+		report "{\"hostname\": \"$HOSTNAME\", \"type\": \"progress\", \"message\": \"nvme devices count mismatch: $host has $drives_num devices, $NVMES_NUM are expected\"}"
+	elif [ "$NVMES_NUM" -eq 0 ] && [ "$drives_num" -ne "${#devices[@]}" ]; then
+		report "{\"hostname\": \"$HOSTNAME\", \"type\": \"progress\", \"message\": \"nvme devices count mismatch: $host has $drives_num devices, $HOSTNAME has ${#devices[@]}\"}"
+	fi
+}
+`
+
+// addLocalDrivesFunctionDef adds the nvme devices found on the vm to its drives container in a single call
+const addLocalDrivesFunctionDef = `
+function add_local_drives {
+	local container_id=$(weka cluster container -J | jq -r --arg hostname "$HOSTNAME" '.[] | select(.hostname == $hostname and .container_name == "drives0") | .host_id | capture("(?<id>[0-9]+)").id')
+	if [ -z "$container_id" ]; then
+		echo "drives0 container of $HOSTNAME was not found"
+		return 1
+	fi
+	check_drives_num "$HOSTNAME" "${#devices[@]}" || return 1
+	for device in "${devices[@]}"; do
+		while ! lsblk "$device" >/dev/null 2>&1; do
+			echo "waiting for nvme to be ready"
+			sleep 5
+		done
+	done
+	weka cluster drive add "$container_id" "${devices[@]}"
+}
+`
+
+// hostDrivesFunctionDef detects the nvme devices of a drives container from its hardware info, so the backends of a
+// different vm size than the coordinator get their own devices, the coordinator devices are the fallback
+const hostDrivesFunctionDef = `
+cat >/opt/weka/tmp/find_host_drives.py <<EOL%sEOL
+
+function drives_container_host {
+	weka cluster container -J | jq -r --arg id "HostId<$1>" '.[] | select(.host_id == $id) | .hostname'
+}
+
+function host_drives {
+	local host_devices=$(weka cluster container info-hw "$1" -J | python3 /opt/weka/tmp/find_host_drives.py || true)
+	if [ -z "$host_devices" ]; then
+		echo "no nvme devices were found in the hardware info of container $1, using the devices of $HOSTNAME" >&2
+		echo "${devices[@]}"
+		return
+	fi
+	echo $host_devices
+}
+`
+
+func getDrivesDetectionFunctionDefs() string {
+	return fmt.Sprintf(dedent.Dedent(hostDrivesFunctionDef), common.FindHostDrivesScript) + dedent.Dedent(checkDrivesNumFunctionDef)
+}
+
+// GetWekaDetectedDrivesAddScript replaces the serial drives add of the coordinator, which adds NVMES_NUM devices of
+// its own to every backend, by adding the nvme devices detected on each backend
+func GetWekaDetectedDrivesAddScript() string {
+	template := `
+	# drives add of the detected nvme devices
+	%s
+	DRIVE_NUMS=( $(weka cluster container | grep drives | awk '{print $1;}') )
+
+	for drive_num in "${DRIVE_NUMS[@]}"; do
+		host=$(drives_container_host "$drive_num")
+		host_devices=( $(host_drives "$drive_num") )
+		check_drives_num "$host" "${#host_devices[@]}" || exit 1
+		if [ "$host" == "$HOSTNAME" ]; then
+			for device in "${host_devices[@]}"; do
+				while ! lsblk "$device" >/dev/null 2>&1; do
+					echo "waiting for nvme to be ready"
+					sleep 5
+				done
+			done
+		fi
+		weka cluster drive add "$drive_num" "${host_devices[@]}"
+	done
+	report "{\"hostname\": \"$HOSTNAME\", \"type\": \"progress\", \"message\": \"$(weka cluster drive -J | jq length) drives were added\"}"
+	`
+	return fmt.Sprintf(dedent.Dedent(template), getDrivesDetectionFunctionDefs())
+}
+
+// GetWekaDrivesSegmentScript adds the drives of a backend of a segmented clusterization, it is started on each
+// backend by the function app once the cluster is created. the weka credentials are run command parameters
+func GetWekaDrivesSegmentScript(nvmesNum int, reportFuncDef, findDrivesScript string) string {
+	template := `
+	#!/bin/bash
+	set -ex
+	NVMES_NUM=%d
+	REPORT_PHASE=clusterization
+
+	# report function definition
+	%s
+	%s
+	%s
+	mkdir -p /opt/weka/tmp
+	cat >/opt/weka/tmp/find_drives.py <<EOL%sEOL
+	# do not trace the weka credentials
+	set +x
+	weka user login "$WEKA_USERNAME" "$WEKA_PASSWORD"
+	WEKA_RUN_CREDS="-e WEKA_USERNAME=$WEKA_USERNAME -e WEKA_PASSWORD=$WEKA_PASSWORD"
+	devices=($(weka local run --container compute0 $WEKA_RUN_CREDS bash -ce 'wapi machine-query-info --info-types=DISKS -J | python3 /opt/weka/tmp/find_drives.py'))
+	set -x
+
+	if add_local_drives; then
+		report "{\"hostname\": \"$HOSTNAME\", \"type\": \"progress\", \"message\": \"Drives of $HOSTNAME were added\"}"
+	else
+		report "{\"hostname\": \"$HOSTNAME\", \"type\": \"error\", \"message\": \"Failed adding the drives of $HOSTNAME\"}"
+		exit 1
+	fi
+	`
+	return fmt.Sprintf(dedent.Dedent(template), nvmesNum, reportFuncDef, dedent.Dedent(checkDrivesNumFunctionDef), dedent.Dedent(addLocalDrivesFunctionDef), findDrivesScript)
+}
+
+// GetWekaSegmentedDrivesAddScript replaces the serial drives add of the coordinator (last vm): the function app
+// starts the drives add on the other backends, the coordinator adds its own drives and waits for the others,
+// the drives of the backends which didn't add them in time are added by the coordinator in parallel
+func GetWekaSegmentedDrivesAddScript(segmentsFuncDef string, timeoutMinutes int) string {
+	template := `
+	# segmented drives add
+	SEGMENT_TIMEOUT_SECONDS=%d
+
+	# clusterize_segments function definition
+	%s
+	%s
+	%s
+	DRIVE_NUMS=( $(weka cluster container | grep drives | awk '{print $1;}') )
+	expected_drives=0
+	for drive_num in "${DRIVE_NUMS[@]}"; do
+		host_devices=( $(host_drives "$drive_num") )
+		expected_drives=$(( expected_drives + ${#host_devices[@]} ))
+	done
+
+	report "{\"hostname\": \"$HOSTNAME\", \"type\": \"progress\", \"message\": \"Starting the drives add on ${#DRIVE_NUMS[@]} backends\"}"
+	clusterize_segments "{\"vm\": \"$HOSTNAME\"}" || \
+		report "{\"hostname\": \"$HOSTNAME\", \"type\": \"progress\", \"message\": \"Failed starting the drives add on the backends, adding the drives from $HOSTNAME\"}"
+	add_local_drives
+
+	segment_deadline=$(( $(date +%%s) + SEGMENT_TIMEOUT_SECONDS ))
+	added_drives=$(weka cluster drive -J | jq length)
+	while [ "$added_drives" -lt "$expected_drives" ] && [ "$(date +%%s)" -lt "$segment_deadline" ]; do
+		report "{\"hostname\": \"$HOSTNAME\", \"type\": \"progress\", \"message\": \"$added_drives/$expected_drives drives were added\"}"
+		sleep 30
+		added_drives=$(weka cluster drive -J | jq length)
+	done
+
+	# the drives of the backends which didn't add them are added by the coordinator
+	for drive_num in "${DRIVE_NUMS[@]}"; do
+		container_drives=$(weka cluster drive -J | jq --arg id "HostId<$drive_num>" '[.[] | select(.host_id == $id)] | length')
+		if [ "$container_drives" -eq 0 ]; then
+			echo "adding the drives of container $drive_num"
+			host_devices=( $(host_drives "$drive_num") )
+			check_drives_num "$(drives_container_host "$drive_num")" "${#host_devices[@]}" || continue
+			weka cluster drive add "$drive_num" "${host_devices[@]}" &
+		fi
+	done
+	wait
+
+	added_drives=$(weka cluster drive -J | jq length)
+	if [ "$added_drives" -lt "$expected_drives" ]; then
+		report "{\"hostname\": \"$HOSTNAME\", \"type\": \"error\", \"message\": \"Only $added_drives/$expected_drives drives were added\"}"
+		exit 1
+	fi
+	report "{\"hostname\": \"$HOSTNAME\", \"type\": \"progress\", \"message\": \"$added_drives drives were added\"}"
+	`
+	return fmt.Sprintf(dedent.Dedent(template), timeoutMinutes*60, segmentsFuncDef, getDrivesDetectionFunctionDefs(), dedent.Dedent(addLocalDrivesFunctionDef))
+}
+
+// GetWekaHomeValidationScript checks the backend reaches weka home, through the proxy if any, the result is reported
+// with the weka home phase and recorded by the report function
+func GetWekaHomeValidationScript(wekaHomeUrl, proxyUrl string) string {
+	template := `
+	# weka home validation
+	weka_home_url="%s"
+	weka_home_proxy="%s"
+	weka_home_proxy_option=""
+	if [ -n "$weka_home_proxy" ]; then
+		weka_home_proxy_option="--proxy $weka_home_proxy"
+	fi
+	weka_home_code=$(curl -s -o /dev/null -w "%%{http_code}" --max-time 30 $weka_home_proxy_option "$weka_home_url" || true)
+	if [[ -n "$weka_home_code" && "$weka_home_code" != "000" ]]; then
+		REPORT_PHASE=%s report "{\"hostname\": \"$HOSTNAME\", \"type\": \"progress\", \"reachable\": true, \"message\": \"Weka Home $weka_home_url is reachable (http $weka_home_code)\"}"
+	else
+		REPORT_PHASE=%s report "{\"hostname\": \"$HOSTNAME\", \"type\": \"progress\", \"reachable\": false, \"message\": \"Weka Home $weka_home_url is not reachable\"}"
+	fi
+	`
+	return fmt.Sprintf(dedent.Dedent(template), wekaHomeUrl, proxyUrl, common.WekaHomeReportPhase, common.WekaHomeReportPhase)
+}
+
+// GetWekaHomeScript validates the weka home connectivity of a live cluster, after setting its weka home
+// configuration on update. It runs on a backend with the weka credentials as parameters
+func GetWekaHomeScript(reportFuncDef, wekaHomeUrl, proxyUrl string, update bool) string {
+	template := `
+	#!/bin/bash
+	set -ex
+	WEKA_HOME_URL="%s"
+	PROXY_URL="%s"
+	UPDATE=%t
+
+	# report function definition
+	%s
+
+	if [[ $UPDATE == true ]]; then
+		# do not trace the weka credentials
+		set +x
+		weka user login "$WEKA_USERNAME" "$WEKA_PASSWORD"
+		set -x
+		if [ -n "$PROXY_URL" ]; then
+			weka cloud proxy --set "$PROXY_URL"
+		fi
+		weka cloud enable --cloud-url "$WEKA_HOME_URL"
+		report "{\"hostname\": \"$HOSTNAME\", \"type\": \"progress\", \"message\": \"Weka Home was set to $WEKA_HOME_URL\"}"
+	fi
+	%s
+	`
+	return fmt.Sprintf(dedent.Dedent(template), wekaHomeUrl, proxyUrl, update, reportFuncDef, GetWekaHomeValidationScript(wekaHomeUrl, proxyUrl))
+}
+
+// obsBytesScript exits successfully when the tier location of a file has bytes in the object store, the location
+// fields are searched for in the whole document
+const obsBytesScript = `
+import json
+import sys
+def obs_bytes(o):
+	if isinstance(o, dict):
+		for k, v in o.items():
+			if isinstance(v, (int, float)) and ('obs' in k.lower() or 'object' in k.lower()):
+				yield v
+			else:
+				yield from obs_bytes(v)
+	elif isinstance(o, list):
+		for v in o:
+			yield from obs_bytes(v)
+sys.exit(0 if any(b > 0 for b in obs_bytes(json.load(sys.stdin))) else 1)
+`
+
+// GetClusterValidationScript writes a test object to the filesystem from a backend mount and reads it back, with
+// obs the object is released from the ssds and its upload to the object store is awaited. It runs on a backend with
+// the weka credentials as parameters and reports the result in the cluster validation phase
+func GetClusterValidationScript(reportFuncDef, filesystem string, checkObs bool) string {
+	template := `
+	#!/bin/bash
+	set -ex
+	FILESYSTEM="%s"
+	CHECK_OBS=%t
+	export REPORT_PHASE=%s
+
+	# report function definition
+	%s
+
+	function report_validation {
+		report "{\"hostname\": \"$HOSTNAME\", \"type\": \"progress\", \"io_passed\": $1, \"obs_uploaded\": $2, \"message\": \"$3\"}"
+	}
+
+	cat >/tmp/weka_validation_obs_bytes.py <<EOL%sEOL
+
+	# do not trace the weka credentials
+	set +x
+	weka user login "$WEKA_USERNAME" "$WEKA_PASSWORD"
+	set -x
+
+	mount_point=$(mktemp -d /tmp/weka-validation.XXXXXX)
+	if ! mount -t wekafs "$FILESYSTEM" "$mount_point"; then
+		report_validation false null "Failed to mount filesystem $FILESYSTEM"
+		exit 1
+	fi
+	trap 'umount "$mount_point" || true; rmdir "$mount_point" || true' EXIT
+
+	test_data=/tmp/weka-validation-data
+	test_object="$mount_point/.weka-validation-$HOSTNAME-$(date +%%s)"
+	dd if=/dev/urandom of="$test_data" bs=1M count=64
+	written=$(sha256sum < "$test_data" | cut -d' ' -f1)
+	cp "$test_data" "$test_object"
+	sync
+	echo 3 > /proc/sys/vm/drop_caches
+	read_back=$(sha256sum < "$test_object" | cut -d' ' -f1 || true)
+	rm -f "$test_data"
+	if [[ "$written" != "$read_back" ]]; then
+		rm -f "$test_object"
+		report_validation false null "The test object read back from filesystem $FILESYSTEM differs from the written one"
+		exit 1
+	fi
+
+	obs_uploaded=null
+	if [[ $CHECK_OBS == true ]]; then
+		obs_uploaded=false
+		weka fs tier release "$test_object" || true
+		for i in {1..30}; do
+			if weka fs tier location "$test_object" -J | python3 /tmp/weka_validation_obs_bytes.py; then
+				obs_uploaded=true
+				break
+			fi
+			sleep 10
+		done
+	fi
+	rm -f "$test_object"
+
+	if [[ $obs_uploaded == false ]]; then
+		report_validation true false "The test object was written to and read from filesystem $FILESYSTEM, it was not uploaded to the object store within 5 minutes"
+		exit 1
+	fi
+	report_validation true $obs_uploaded "The test object was written to and read from filesystem $FILESYSTEM"
+	`
+	return fmt.Sprintf(dedent.Dedent(template), filesystem, checkObs, common.ClusterValidationReportPhase, reportFuncDef, obsBytesScript)
+}
+
+// the protocol gateways create the nfs client group and the smb cluster once the weka cluster is up
+const protocolsWaitRetries = 60
+
+// GetConfigureProtocolsScript creates the declared smb shares and nfs exports which are missing, updates the
+// permissions of the existing ones and removes the given shares. It runs on a backend with the weka credentials as
+// parameters and reports the result in the configure protocols phase
+func GetConfigureProtocolsScript(reportFuncDef string, declared, removed []common.ProtocolShare) string {
+	var waitSmb, waitNfs bool
+	var commands strings.Builder
+	for _, share := range removed {
+		if share.Protocol == common.ProtocolSMB {
+			waitSmb = true
+			commands.WriteString(fmt.Sprintf("remove_smb_share '%s'\n", share.Name))
+		} else {
+			waitNfs = true
+			commands.WriteString(fmt.Sprintf("remove_nfs_export '%s' '%s' '%s'\n", share.Filesystem, share.Path, share.ClientGroup))
+		}
+	}
+	for _, share := range declared {
+		if share.Protocol == common.ProtocolSMB {
+			waitSmb = true
+			commands.WriteString(fmt.Sprintf("apply_smb_share '%s' '%s' '%s' %s\n", share.Name, share.Filesystem, share.Path, share.Permissions))
+		} else {
+			waitNfs = true
+			commands.WriteString(fmt.Sprintf("apply_nfs_export '%s' '%s' '%s' %s\n", share.Filesystem, share.Path, share.ClientGroup, share.Permissions))
+		}
+	}
+
+	template := `
+	#!/bin/bash
+	set -x
+	export REPORT_PHASE=%s
+	WAIT_SMB=%t
+	WAIT_NFS=%t
+	RETRIES=%d
+
+	# report function definition
+	%s
+
+	# do not trace the weka credentials
+	set +x
+	weka user login "$WEKA_USERNAME" "$WEKA_PASSWORD"
+	set -x
+
+	failures=()
+
+	function smb_share_id() {
+		weka smb share -J | jq -r --arg name "$1" '.[] | select((.share_name // .name) == $name) | .id' | head -1
+	}
+
+	function nfs_export_exists() {
+		weka nfs permission -J | jq -e --arg fs "$1" --arg path "$2" --arg group "$3" \
+			'[.[] | select((.filesystem // .fs_name) == $fs and .path == $path and (.group // .client_group) == $group)] | length > 0' >/dev/null
+	}
+
+	function apply_smb_share() {
+		read_only=off
+		if [[ $4 == ro ]]; then
+			read_only=on
+		fi
+		share_id=$(smb_share_id "$1")
+		if [ -n "$share_id" ]; then
+			weka smb share update "$share_id" --read-only $read_only || failures+=("smb share $1 update")
+		else
+			weka smb share add "$1" "$2" --internal-path "$3" --read-only $read_only || failures+=("smb share $1 creation")
+		fi
+	}
+
+	function remove_smb_share() {
+		share_id=$(smb_share_id "$1")
+		if [ -n "$share_id" ]; then
+			weka smb share remove "$share_id" || failures+=("smb share $1 removal")
+		fi
+	}
+
+	function apply_nfs_export() {
+		if nfs_export_exists "$1" "$2" "$3"; then
+			weka nfs permission update "$1" "$3" --path "$2" --permission-type $4 || failures+=("nfs export $1:$2 update")
+		else
+			weka nfs permission add "$1" "$3" --path "$2" --permission-type $4 || failures+=("nfs export $1:$2 creation")
+		fi
+	}
+
+	function remove_nfs_export() {
+		if nfs_export_exists "$1" "$2" "$3"; then
+			weka nfs permission delete "$1" "$3" --path "$2" || failures+=("nfs export $1:$2 removal")
+		fi
+	}
+
+	if [[ $WAIT_SMB == true ]]; then
+		for (( i=0; i<RETRIES; i++ )); do
+			all_hosts=$(weka smb cluster status | grep -c 'Host' || true)
+			not_ready_hosts=$(weka smb cluster status | grep -c 'Not Ready' || true)
+			if (( all_hosts > 0 && not_ready_hosts == 0 )); then
+				break
+			fi
+			echo "$(date -u): waiting for the smb cluster to be ready"
+			sleep 30
+		done
+		if (( i == RETRIES )); then
+			report "{\"hostname\": \"$HOSTNAME\", \"type\": \"error\", \"message\": \"Smb cluster is not ready, the shares are not configured\"}"
+			exit 1
+		fi
+	fi
+	if [[ $WAIT_NFS == true ]]; then
+		for (( i=0; i<RETRIES; i++ )); do
+			if weka nfs interface-group | grep -q NFS; then
+				break
+			fi
+			echo "$(date -u): waiting for the nfs interface group"
+			sleep 30
+		done
+		if (( i == RETRIES )); then
+			report "{\"hostname\": \"$HOSTNAME\", \"type\": \"error\", \"message\": \"Nfs interface group is missing, the exports are not configured\"}"
+			exit 1
+		fi
+	fi
+
+	%s
+
+	if (( ${#failures[@]} > 0 )); then
+		report "{\"hostname\": \"$HOSTNAME\", \"type\": \"error\", \"message\": \"Failed protocol shares changes: ${failures[*]}\"}"
+		exit 1
+	fi
+	report "{\"hostname\": \"$HOSTNAME\", \"type\": \"progress\", \"message\": \"Protocol shares configured\"}"
+	`
+	return fmt.Sprintf(
+		dedent.Dedent(template), common.ProtocolSharesReportPhase, waitSmb, waitNfs, protocolsWaitRetries, reportFuncDef, commands.String(),
+	)
+}
+
+// the io control script waits up to 10 minutes for the cluster io and the backend containers
+const ioControlWaitRetries = 60
+
+// GetIoControlScript returns the script stopping or starting the io, run on every backend. On stop the leader
+// backend stops the cluster io and the others stop their containers once the io is stopped, the leader stops its
+// containers last. On start every backend starts its containers and the leader starts the cluster io once all the
+// backend containers are up
+func GetIoControlScript(reportFuncDef, action string) string {
+	template := `
+	#!/bin/bash
+	set -x
+	export REPORT_PHASE=%s
+	ACTION=%s
+	RETRIES=%d
+
+	# report function definition
+	%s
+
+	function report_io {
+		report "{\"hostname\": \"$HOSTNAME\", \"type\": \"$1\", \"message\": \"$2\"}"
+	}
+
+	function weka_login {
+		# do not trace the weka credentials
+		set +x
+		weka user login "$WEKA_USERNAME" "$WEKA_PASSWORD"
+		local rc=$?
+		set -x
+		return $rc
+	}
+
+	function wait_for {
+		for (( i=0; i<RETRIES; i++ )); do
+			if "$@"; then
+				return 0
+			fi
+			echo "$(date -u): waiting for $*"
+			sleep 10
+		done
+		return 1
+	}
+
+	function io_stopped {
+		[[ "$(weka status -J | jq -r .io_status)" == "STOPPED" ]]
+	}
+
+	function other_backends_stopped {
+		# the cluster can't be reached anymore once most of the backends are stopped
+		up=$(weka cluster container -b -J | jq --arg host "$HOSTNAME" '[.[] | select(.status == "UP" and .hostname != $host)] | length') || return 0
+		(( up == 0 ))
+	}
+
+	function backends_up {
+		down=$(weka cluster container -b -J | jq '[.[] | select(.status != "UP")] | length') || return 1
+		(( down == 0 ))
+	}
+
+	if [[ $ACTION == stop ]]; then
+		if ! weka_login; then
+			report_io error "Failed to log in to the cluster"
+			exit 1
+		fi
+		if [[ $LEADER == true ]]; then
+			if ! weka cluster stop-io; then
+				report_io error "Failed to stop the cluster io"
+				exit 1
+			fi
+			wait_for other_backends_stopped || echo "$(date -u): not all the backends stopped, stopping the local containers"
+		elif ! wait_for io_stopped; then
+			report_io error "The cluster io was not stopped, the local containers are left running"
+			exit 1
+		fi
+		if ! weka local stop; then
+			report_io error "Failed to stop the local containers"
+			exit 1
+		fi
+		report_io progress "Local containers stopped"
+		exit 0
+	fi
+
+	if ! weka local start; then
+		report_io error "Failed to start the local containers"
+		exit 1
+	fi
+	if [[ $LEADER == true ]]; then
+		if ! wait_for weka_login || ! wait_for backends_up; then
+			report_io error "The backend containers are not up, the cluster io is not started"
+			exit 1
+		fi
+		if ! weka cluster start-io; then
+			report_io error "Failed to start the cluster io"
+			exit 1
+		fi
+		report_io progress "Cluster io started"
+		exit 0
+	fi
+	report_io progress "Local containers started"
+	`
+	return fmt.Sprintf(dedent.Dedent(template), common.IoControlReportPhase, action, ioControlWaitRetries, reportFuncDef)
+}
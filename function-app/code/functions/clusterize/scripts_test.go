@@ -0,0 +1,106 @@
+package clusterize
+
+import (
+	"context"
+	"encoding/json"
+	"strings"
+	"testing"
+	"weka-deployment/functions/azure_functions_def"
+
+	"github.com/weka/go-cloud-lib/clusterize"
+)
+
+func Test_RedactClusterizationParams(t *testing.T) {
+	secrets := []string{
+		"obs-access-key", "obs-sas-token", "sp-client-secret", "weka-password", "obs-script-key",
+		"smb-join-password",
+	}
+	p := ClusterizationParams{
+		Cluster: clusterize.ClusterParams{WekaPassword: "weka-password", ObsScript: "ACCESS_KEY=obs-script-key"},
+		Obs: []AzureObsParams{
+			{Name: "obs0", AccessKey: "obs-access-key"},
+			{Name: "obs1", AuthMethod: "sas_token", SasToken: "obs-sas-token"},
+			{Name: "obs2", AuthMethod: "service_principal", ServicePrincipalClientSecret: "sp-client-secret"},
+		},
+		SmbDomainJoinConfig: &SmbDomainJoinConfig{DomainName: "weka.local", Password: "smb-join-password"},
+	}
+
+	redacted, err := json.Marshal(redactClusterizationParams(p))
+	if err != nil {
+		t.Fatalf("failed marshaling redacted params: %s", err)
+	}
+	for _, secret := range secrets {
+		if strings.Contains(string(redacted), secret) {
+			t.Errorf("secret %q was not redacted: %s", secret, redacted)
+		}
+	}
+
+	// the original params keep the secrets
+	if p.Obs[1].SasToken != "obs-sas-token" || p.SmbDomainJoinConfig.Password != "smb-join-password" {
+		t.Errorf("original params were modified: %+v", p)
+	}
+}
+
+// getTestClusterizeScript returns the clusterize script of the library, the optional steps are injected around its
+// commands
+func getTestClusterizeScript() string {
+	scriptGenerator := clusterize.ClusterizeScriptGenerator{
+		Params: clusterize.ClusterParams{
+			VMNames:      []string{"weka-test-vmss_0:host0", "weka-test-vmss_1:host1", "weka-test-vmss_2:host2"},
+			IPs:          []string{"10.0.0.4", "10.0.0.5", "10.0.0.6"},
+			ClusterName:  "test",
+			HostsNum:     3,
+			WekaUsername: "admin",
+		},
+		FuncDef: azure_functions_def.NewFuncDef(context.Background(), "https://weka-test-function-app.azurewebsites.net/api/", "test-key"),
+	}
+	return scriptGenerator.GetClusterizeScript()
+}
+
+// assertInOrder fails when the parts don't follow each other in the script
+func assertInOrder(t *testing.T, script string, parts ...string) {
+	t.Helper()
+	offset := 0
+	for _, part := range parts {
+		index := strings.Index(script[offset:], part)
+		if index < 0 {
+			t.Fatalf("%q is missing after offset %d of the script:\n%s", part, offset, script)
+		}
+		offset += index + len(part)
+	}
+}
+
+func Test_ClusterizeScriptInjectionPoints(t *testing.T) {
+	assertInOrder(t, getTestClusterizeScript(),
+		clusterizeScriptHeader, clusterCreateCmd, clusterLoginCmd, drivesAddCmd, clusterNameUpdateCmd, defaultFsCapacityCmd,
+	)
+}
+
+func Test_ClusterizeScriptSpeedTestOrder(t *testing.T) {
+	speedTestScript := GetWekaSpeedTestScript([]string{"10.0.0.5", "10.0.0.6"}, SpeedTestProtocolTCP, 10, 5)
+	// the steps are injected like in Clusterize
+	script := injectBeforeClusterCreate(getTestClusterizeScript(), "\nSPEED_TEST_STAGE=before_clusterization"+speedTestScript)
+	script += "\nSPEED_TEST_STAGE=after_clusterization" + speedTestScript
+	script = injectAfterScriptHeader(script, "REPORT_PHASE=clusterization")
+
+	assertInOrder(t, script,
+		"REPORT_PHASE=clusterization", "SPEED_TEST_STAGE=before_clusterization", "# network speed test", clusterCreateCmd,
+		defaultFsCapacityCmd, "SPEED_TEST_STAGE=after_clusterization", "# network speed test",
+	)
+	if strings.Count(script, "# network speed test") != 2 {
+		t.Errorf("expected the speed test to run twice:\n%s", script)
+	}
+}
+
+func Test_ClusterizeScriptDrivesSteps(t *testing.T) {
+	pools := []WekaStoragePool{{Name: "pool0", DriveDevices: []string{"/dev/nvme0n1"}}}
+	script := replaceDrivesAdd(getTestClusterizeScript(), GetWekaDetectedDrivesAddScript())
+	script = injectAfterClusterCreate(script, GetWekaFaultDomainsScript(map[string]int{"host0": 0, "host1": 1, "host2": 0}))
+	script = injectAfterDrivesAdded(script, GetWekaStoragePoolScript(pools))
+
+	// the fault domains are set before any drive is added, the pools are created from the added drives
+	assertInOrder(t, script, clusterCreateCmd, clusterLoginCmd, "weka cluster container failure-domain", drivesAddCmd, "pool0", clusterNameUpdateCmd)
+	if strings.Count(script, drivesAddCmd) != 1 {
+		t.Errorf("the drives add of the library was not replaced:\n%s", script)
+	}
+}
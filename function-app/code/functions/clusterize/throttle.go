@@ -0,0 +1,123 @@
+package clusterize
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+	"weka-deployment/common"
+	"weka-deployment/functions/azure_functions_def"
+
+	"github.com/weka/go-cloud-lib/functions_def"
+	"github.com/weka/go-cloud-lib/logging"
+)
+
+// the vms of a large scale set call clusterize at once, the runs of a function app instance are bounded so key vault
+// and arm don't throttle them, and the calls of a vm which is already being handled, curl retries, share its run
+const (
+	defaultClusterizeMaxConcurrency = 8
+	// a vm waiting longer for a free run is told to call clusterize again later
+	clusterizeQueueTimeout     = 2 * time.Minute
+	clusterizeBusyRetrySeconds = 30
+)
+
+var errClusterizeBusy = errors.New("too many concurrent clusterize calls")
+
+type clusterizeCall struct {
+	done   chan struct{}
+	script string
+	err    error
+}
+
+var (
+	clusterizeSlotsOnce sync.Once
+	clusterizeSlots     chan struct{}
+
+	clusterizeCallsLock sync.Mutex
+	clusterizeCalls     = make(map[string]*clusterizeCall)
+)
+
+func getClusterizeSlots(ctx context.Context) chan struct{} {
+	clusterizeSlotsOnce.Do(func() {
+		maxConcurrency, err := strconv.Atoi(common.Getenv(ctx, "CLUSTERIZE_MAX_CONCURRENCY"))
+		if err != nil || maxConcurrency < 1 {
+			maxConcurrency = defaultClusterizeMaxConcurrency
+		}
+		clusterizeSlots = make(chan struct{}, maxConcurrency)
+	})
+	return clusterizeSlots
+}
+
+// runClusterizeOnce runs clusterize when a run is free, a call of a vm which is already being handled waits for that
+// run and gets its script. errClusterizeBusy is returned when no run was free within the queue timeout
+func runClusterizeOnce(ctx context.Context, vmName string, run func() string) (script string, err error) {
+	logger := logging.LoggerFromCtx(ctx)
+	instanceName := strings.Split(vmName, ":")[0]
+
+	clusterizeCallsLock.Lock()
+	if call, ok := clusterizeCalls[instanceName]; ok {
+		clusterizeCallsLock.Unlock()
+		logger.Info().Msgf("Instance %s clusterize call is already in progress, waiting for its response", instanceName)
+		select {
+		case <-call.done:
+			return call.script, call.err
+		case <-ctx.Done():
+			return "", ctx.Err()
+		}
+	}
+	call := &clusterizeCall{done: make(chan struct{})}
+	clusterizeCalls[instanceName] = call
+	clusterizeCallsLock.Unlock()
+
+	defer func() {
+		call.script, call.err = script, err
+		clusterizeCallsLock.Lock()
+		delete(clusterizeCalls, instanceName)
+		clusterizeCallsLock.Unlock()
+		close(call.done)
+	}()
+
+	slots := getClusterizeSlots(ctx)
+	timer := time.NewTimer(clusterizeQueueTimeout)
+	defer timer.Stop()
+	select {
+	case slots <- struct{}{}:
+	case <-timer.C:
+		err = errClusterizeBusy
+		return
+	case <-ctx.Done():
+		err = ctx.Err()
+		return
+	}
+	defer func() { <-slots }()
+
+	script = run()
+	return
+}
+
+// getBusyScript returns the script calling clusterize again after a while, the instance wasn't added to the state
+func getBusyScript(ctx context.Context, p ClusterizationParams) (script string, err error) {
+	functionAppKey, err := common.GetKeyVaultValue(ctx, p.KeyVaultUri, "function-app-default-key")
+	if err != nil {
+		return
+	}
+	payload, err := json.Marshal(RequestBody{Vm: p.VmName})
+	if err != nil {
+		return
+	}
+	baseFunctionUrl := common.GetFunctionAppBaseUrl(p.FunctionAppName)
+	funcDef := azure_functions_def.NewFuncDef(ctx, baseFunctionUrl, functionAppKey)
+	script = common.GetRetryScript(
+		funcDef.GetFunctionCmdDefinition(functions_def.Report),
+		funcDef.GetFunctionCmdDefinition(functions_def.Clusterize),
+		string(functions_def.Clusterize),
+		string(payload),
+		fmt.Sprintf("Function app is busy (%s)", errClusterizeBusy),
+		clusterizeBusyRetrySeconds,
+	)
+	return
+}
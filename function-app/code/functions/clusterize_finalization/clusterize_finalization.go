@@ -1,34 +1,48 @@
 package clusterize_finalization
 
 import (
-	"encoding/json"
 	"net/http"
-	"os"
+	"strconv"
 	"weka-deployment/common"
+	"weka-deployment/functions/clusterize"
+	"weka-deployment/functions/configure_protocols"
+
+	"github.com/weka/go-cloud-lib/logging"
 )
 
 func Handler(w http.ResponseWriter, r *http.Request) {
-	outputs := make(map[string]interface{})
-	resData := make(map[string]interface{})
-
-	subscriptionId := os.Getenv("SUBSCRIPTION_ID")
-	resourceGroupName := os.Getenv("RESOURCE_GROUP_NAME")
-	stateContainerName := os.Getenv("STATE_CONTAINER_NAME")
-	stateStorageName := os.Getenv("STATE_STORAGE_NAME")
-
 	ctx := r.Context()
+	subscriptionId := common.Getenv(ctx, "SUBSCRIPTION_ID")
+	resourceGroupName := common.Getenv(ctx, "RESOURCE_GROUP_NAME")
+	stateContainerName := common.Getenv(ctx, "STATE_CONTAINER_NAME")
+	stateStorageName := common.Getenv(ctx, "STATE_STORAGE_NAME")
+
+	logger := logging.LoggerFromCtx(ctx)
 
 	state, err := common.UpdateClusterized(ctx, subscriptionId, resourceGroupName, stateStorageName, stateContainerName)
 	if err != nil {
-		resData["body"] = err.Error()
-	} else {
-		resData["body"] = state
+		common.WriteErrorResponse(w, http.StatusInternalServerError, err)
+		return
 	}
-	outputs["res"] = resData
-	invokeResponse := common.InvokeResponse{Outputs: outputs, Logs: nil, ReturnValue: nil}
-
-	responseJson, _ := json.Marshal(invokeResponse)
-
-	w.Header().Set("Content-Type", "application/json")
-	w.Write(responseJson)
+	// the obs is attached after the finalization, its completion report moves the deployment to ready
+	phase := common.DeploymentPhaseReady
+	if setObs, _ := strconv.ParseBool(common.Getenv(ctx, "SET_OBS")); setObs {
+		phase = common.DeploymentPhaseConfiguringObs
+	}
+	common.SetDeploymentPhase(ctx, stateStorageName, stateContainerName, phase, "cluster clusterized")
+	// the locks are applied once the cluster is formed, a failed clusterization leaves nothing locked behind
+	if params, paramsErr := clusterize.GetClusterizationParams(ctx, ""); paramsErr != nil {
+		logger.Error().Err(paramsErr).Msg("failed to apply the deletion locks")
+	} else if err = clusterize.ApplyDeletionLocks(ctx, params); err != nil {
+		logger.Error().Err(err).Msg("failed to apply the deletion locks")
+	}
+	// clusterize is not called anymore once the cluster is clusterized
+	if err = common.DeleteClusterizeResponses(ctx, stateStorageName, stateContainerName); err != nil {
+		logger.Error().Err(err).Msg("failed to delete clusterize responses")
+	}
+	// the declared shares are created once the protocol gateways set up the protocols, the script waits for them
+	if _, _, err = configure_protocols.ConfigureProtocols(ctx, configure_protocols.GetConfigureProtocolsParams(ctx), nil); err != nil {
+		logger.Error().Err(err).Msg("failed to start the protocol shares configuration")
+	}
+	common.WriteResponse(w, http.StatusOK, "cluster clusterized", state)
 }
@@ -0,0 +1,140 @@
+package clusterize_segments
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"weka-deployment/common"
+	"weka-deployment/functions/azure_functions_def"
+	"weka-deployment/functions/clusterize"
+
+	"github.com/weka/go-cloud-lib/functions_def"
+	"github.com/weka/go-cloud-lib/logging"
+)
+
+type RequestBody struct {
+	// host name of the coordinator, it adds its own drives
+	Vm string `json:"vm"`
+}
+
+type SegmentsParams struct {
+	SubscriptionId     string
+	ResourceGroupName  string
+	StateStorageName   string
+	StateContainerName string
+	KeyVaultUri        string
+	FunctionAppName    string
+	NvmesNum           int
+}
+
+type SegmentsResponse struct {
+	Started []string          `json:"started"`
+	Failed  map[string]string `json:"failed,omitempty"`
+}
+
+// StartSegments starts the drives add on each backend of the cluster but the coordinator, the coordinator adds the
+// drives of the backends whose segment failed to start
+func StartSegments(ctx context.Context, p SegmentsParams, coordinator string) (response SegmentsResponse, err error) {
+	logger := logging.LoggerFromCtx(ctx)
+
+	state, err := common.ReadState(ctx, p.StateStorageName, p.StateContainerName)
+	if err != nil {
+		return
+	}
+	if state.Clusterized {
+		err = fmt.Errorf("cluster is already clusterized")
+		logger.Error().Err(err).Send()
+		return
+	}
+
+	functionAppKey, err := common.GetKeyVaultValue(ctx, p.KeyVaultUri, "function-app-default-key")
+	if err != nil {
+		return
+	}
+	wekaPassword, err := common.GetWekaClusterPassword(ctx, p.KeyVaultUri)
+	if err != nil {
+		err = fmt.Errorf("failed to get weka cluster password: %w", err)
+		logger.Error().Err(err).Send()
+		return
+	}
+
+	funcDef := azure_functions_def.NewFuncDef(ctx, common.GetFunctionAppBaseUrl(p.FunctionAppName), functionAppKey)
+	script := clusterize.GetWekaDrivesSegmentScript(p.NvmesNum, funcDef.GetFunctionCmdDefinition(functions_def.Report), common.FindDrivesScript)
+	// weka cluster create sets the password of the default admin user
+	parameters := map[string]string{
+		"WEKA_USERNAME": "admin",
+		"WEKA_PASSWORD": wekaPassword,
+	}
+
+	// state instances have the form <vm name>:<host name>
+	var vmNames []string
+	for _, instance := range state.Instances {
+		names := strings.Split(instance, ":")
+		if len(names) < 2 || names[1] == coordinator {
+			continue
+		}
+		vmNames = append(vmNames, names[0])
+	}
+
+	var lock sync.Mutex
+	response.Failed = make(map[string]string)
+	_ = common.ForEachParallel(ctx, len(vmNames), common.AzureApiMaxParallelism, func(ctx context.Context, i int) error {
+		vmName := vmNames[i]
+		_, startErr := common.StartScaleSetVmRunCommandWithParameters(
+			ctx, p.SubscriptionId, p.ResourceGroupName, common.GetVmScaleSetNameFromVmName(vmName), common.GetScaleSetVmIndex(vmName), script, parameters,
+		)
+		lock.Lock()
+		defer lock.Unlock()
+		if startErr != nil {
+			response.Failed[vmName] = startErr.Error()
+		} else {
+			response.Started = append(response.Started, vmName)
+		}
+		// a backend whose segment failed is handled by the coordinator, the others are still started
+		return nil
+	})
+	sort.Strings(response.Started)
+	logger.Info().Msgf("Started the drives add on %d backends, %d failed", len(response.Started), len(response.Failed))
+	return
+}
+
+func Handler(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	logger := logging.LoggerFromCtx(ctx)
+
+	reqData, err := common.ParseInvokeRequest(r)
+	if err != nil {
+		logger.Error().Msg("Bad request")
+		common.WriteErrorResponse(w, http.StatusBadRequest, fmt.Errorf("cannot decode the request: %v", err))
+		return
+	}
+
+	var data RequestBody
+	if json.Unmarshal([]byte(common.GetRequestBody(reqData)), &data) != nil || data.Vm == "" {
+		logger.Error().Msg("Bad request")
+		common.WriteErrorResponse(w, http.StatusBadRequest, fmt.Errorf("wrong request format. 'vm' is required"))
+		return
+	}
+
+	nvmesNum, _ := strconv.Atoi(common.Getenv(ctx, "NVMES_NUM"))
+	p := SegmentsParams{
+		SubscriptionId:     common.Getenv(ctx, "SUBSCRIPTION_ID"),
+		ResourceGroupName:  common.Getenv(ctx, "RESOURCE_GROUP_NAME"),
+		StateStorageName:   common.Getenv(ctx, "STATE_STORAGE_NAME"),
+		StateContainerName: common.Getenv(ctx, "STATE_CONTAINER_NAME"),
+		KeyVaultUri:        common.Getenv(ctx, "KEY_VAULT_URI"),
+		FunctionAppName:    common.Getenv(ctx, "FUNCTION_APP_NAME"),
+		NvmesNum:           nvmesNum,
+	}
+	response, err := StartSegments(ctx, p, data.Vm)
+	if err != nil {
+		common.WriteErrorResponse(w, common.GetErrorStatusCode(err), err)
+		return
+	}
+	common.WriteResponse(w, http.StatusOK, fmt.Sprintf("drives add started on %d backends", len(response.Started)), response)
+}
@@ -0,0 +1,175 @@
+package configure_protocols
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+	"weka-deployment/common"
+	"weka-deployment/functions/azure_functions_def"
+	"weka-deployment/functions/clusterize"
+
+	"github.com/weka/go-cloud-lib/functions_def"
+	"github.com/weka/go-cloud-lib/logging"
+)
+
+const ActionApply = "apply"
+
+var errNotClusterized = errors.New("cluster is not clusterized yet")
+
+type RequestBody struct {
+	// an empty action returns the status of the last configuration
+	Action string `json:"action"`
+}
+
+type ConfigureProtocolsParams struct {
+	SubscriptionId     string
+	ResourceGroupName  string
+	StateStorageName   string
+	StateContainerName string
+	KeyVaultUri        string
+	FunctionAppName    string
+	Prefix             string
+	ClusterName        string
+}
+
+func GetConfigureProtocolsParams(ctx context.Context) ConfigureProtocolsParams {
+	return ConfigureProtocolsParams{
+		SubscriptionId:     common.Getenv(ctx, "SUBSCRIPTION_ID"),
+		ResourceGroupName:  common.Getenv(ctx, "RESOURCE_GROUP_NAME"),
+		StateStorageName:   common.Getenv(ctx, "STATE_STORAGE_NAME"),
+		StateContainerName: common.Getenv(ctx, "STATE_CONTAINER_NAME"),
+		KeyVaultUri:        common.Getenv(ctx, "KEY_VAULT_URI"),
+		FunctionAppName:    common.Getenv(ctx, "FUNCTION_APP_NAME"),
+		Prefix:             common.Getenv(ctx, "PREFIX"),
+		ClusterName:        common.Getenv(ctx, "CLUSTER_NAME"),
+	}
+}
+
+func describeShares(declared, removed []common.ProtocolShare) string {
+	var changes []string
+	for _, share := range declared {
+		changes = append(changes, fmt.Sprintf("apply %s (%s)", share.Key(), share.Permissions))
+	}
+	for _, share := range removed {
+		changes = append(changes, fmt.Sprintf("remove %s", share.Key()))
+	}
+	return strings.Join(changes, ", ")
+}
+
+// ConfigureProtocols reconciles the declared shares against the cluster on a backend, the shares applied by a
+// previous run which are not declared anymore are removed. Nothing is started when no share is declared or applied
+func ConfigureProtocols(ctx context.Context, p ConfigureProtocolsParams, plan *common.DryRunPlan) (status common.ProtocolSharesStatus, started bool, err error) {
+	state, err := common.ReadState(ctx, p.StateStorageName, p.StateContainerName)
+	if err != nil {
+		return
+	}
+	if !state.Clusterized {
+		err = errNotClusterized
+		return
+	}
+	declared, err := common.GetProtocolShares(ctx)
+	if err != nil {
+		return
+	}
+	status, err = common.GetProtocolSharesStatus(ctx, p.StateStorageName, p.StateContainerName)
+	if err != nil {
+		return
+	}
+	removed := common.GetRemovedProtocolShares(status.Applied, declared)
+	if len(declared) == 0 && len(removed) == 0 {
+		return
+	}
+
+	functionAppKey, err := common.GetKeyVaultValue(ctx, p.KeyVaultUri, "function-app-default-key")
+	if err != nil {
+		return
+	}
+	funcDef := azure_functions_def.NewFuncDef(ctx, common.GetFunctionAppBaseUrl(p.FunctionAppName), functionAppKey)
+	script := clusterize.GetConfigureProtocolsScript(funcDef.GetFunctionCmdDefinition(functions_def.Report), declared, removed)
+
+	err = plan.Apply(ctx, fmt.Sprintf("configure the protocol shares on a backend: %s", describeShares(declared, removed)), func() (applyErr error) {
+		// the status is pending before the script starts, so the reported result is not overwritten
+		status, applyErr = common.UpdateProtocolSharesStatus(ctx, p.StateStorageName, p.StateContainerName, func(s *common.ProtocolSharesStatus) {
+			s.Status = common.ProtocolSharesStatusPending
+			s.Message = ""
+			s.Declared = declared
+			s.Instance = ""
+			s.RequestedAt = time.Now().UTC()
+		})
+		if applyErr != nil {
+			return
+		}
+		vmName, applyErr := common.StartBackendScript(
+			ctx, p.SubscriptionId, p.ResourceGroupName, p.StateStorageName, p.StateContainerName, p.KeyVaultUri, p.Prefix, p.ClusterName, script,
+		)
+		if applyErr != nil {
+			_, _ = common.UpdateProtocolSharesStatus(ctx, p.StateStorageName, p.StateContainerName, func(s *common.ProtocolSharesStatus) {
+				s.Status = common.ProtocolSharesStatusUnknown
+				s.Message = applyErr.Error()
+			})
+			return
+		}
+		status.Instance = vmName
+		started = true
+		return
+	})
+	return
+}
+
+func Handler(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	logger := logging.LoggerFromCtx(ctx)
+
+	p := GetConfigureProtocolsParams(ctx)
+
+	reqData, err := common.ParseInvokeRequest(r)
+	if err != nil {
+		logger.Error().Msg("Bad request")
+		common.WriteErrorResponse(w, http.StatusBadRequest, fmt.Errorf("cannot decode the request: %v", err))
+		return
+	}
+
+	var data RequestBody
+	if body := common.GetRequestBody(reqData); body != "" {
+		if err = json.Unmarshal([]byte(body), &data); err != nil {
+			logger.Error().Err(err).Msg("cannot unmarshal the request body")
+			common.WriteErrorResponse(w, http.StatusBadRequest, fmt.Errorf("cannot unmarshal the request body: %v", err))
+			return
+		}
+	}
+
+	if data.Action == "" {
+		status, err := common.GetProtocolSharesStatus(ctx, p.StateStorageName, p.StateContainerName)
+		if err != nil {
+			common.WriteErrorResponse(w, http.StatusInternalServerError, err)
+			return
+		}
+		common.WriteResponse(w, http.StatusOK, fmt.Sprintf("protocol shares are %s", status.Status), status)
+		return
+	}
+	if data.Action != ActionApply {
+		common.WriteErrorResponse(w, http.StatusBadRequest, fmt.Errorf("invalid action %s, expected %s", data.Action, ActionApply))
+		return
+	}
+
+	var plan *common.DryRunPlan
+	if common.IsDryRun(reqData) {
+		plan = &common.DryRunPlan{}
+	}
+	status, started, err := ConfigureProtocols(ctx, p, plan)
+	if errors.Is(err, errNotClusterized) {
+		common.WriteErrorResponse(w, http.StatusConflict, err)
+	} else if err != nil {
+		common.WriteErrorResponse(w, common.GetErrorStatusCode(err), err)
+	} else if plan.Enabled() {
+		common.WriteResponse(w, http.StatusOK, "dry run", plan.Response(""))
+	} else if !started {
+		common.WriteResponse(w, http.StatusOK, "no protocol shares to configure", status)
+	} else {
+		common.WriteResponse(w, http.StatusOK, fmt.Sprintf("protocol shares configuration started on %s", status.Instance), status)
+	}
+}
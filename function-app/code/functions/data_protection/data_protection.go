@@ -0,0 +1,212 @@
+package data_protection
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"weka-deployment/common"
+	"weka-deployment/functions/hot_spare"
+	"weka-deployment/functions/status"
+
+	"github.com/weka/go-cloud-lib/lib/types"
+	"github.com/weka/go-cloud-lib/lib/weka"
+	"github.com/weka/go-cloud-lib/logging"
+	"github.com/weka/go-cloud-lib/protocol"
+)
+
+var (
+	errNotClusterized = errors.New("cluster is not clusterized yet")
+	ErrUnsafeChange   = errors.New("unsafe data protection change")
+)
+
+// RequestBody sets the data protection, the fields which are not set keep their desired value
+type RequestBody struct {
+	StripeWidth     *int `json:"stripe_width"`
+	ProtectionLevel *int `json:"protection_level"`
+	Hotspare        *int `json:"hotspare"`
+}
+
+type DataProtectionResponse struct {
+	// the data protection of the live weka cluster
+	Current common.DataProtection `json:"current"`
+	// the data protection the scale operations are validated with
+	Desired  common.DataProtection `json:"desired"`
+	Backends int                   `json:"backends"`
+}
+
+type DataProtectionParams struct {
+	SubscriptionId     string
+	ResourceGroupName  string
+	VmScaleSetNames    []string
+	StateStorageName   string
+	StateContainerName string
+	KeyVaultUri        string
+}
+
+func getDataProtection(ctx context.Context, p DataProtectionParams) (response DataProtectionResponse, err error) {
+	logger := logging.LoggerFromCtx(ctx)
+
+	state, err := common.ReadState(ctx, p.StateStorageName, p.StateContainerName)
+	if err != nil {
+		return
+	}
+	if !state.Clusterized {
+		err = errNotClusterized
+		return
+	}
+
+	response.Desired, err = common.GetDataProtection(ctx, p.StateStorageName, p.StateContainerName)
+	if err != nil {
+		return
+	}
+
+	vmsPrivateIps, err := common.GetScaleSetsVmsPrivateIps(ctx, p.SubscriptionId, p.ResourceGroupName, p.VmScaleSetNames)
+	if err != nil {
+		return
+	}
+	response.Backends = len(vmsPrivateIps)
+
+	jpool, err := status.GetScaleSetsJrpcPool(ctx, p.SubscriptionId, p.ResourceGroupName, p.VmScaleSetNames, p.KeyVaultUri)
+	if err != nil {
+		return
+	}
+	wekaStatus := protocol.WekaStatus{}
+	err = jpool.Call(weka.JrpcStatus, struct{}{}, &wekaStatus)
+	if err != nil {
+		logger.Error().Err(err).Send()
+		return
+	}
+	response.Current = common.DataProtection{
+		StripeWidth:     wekaStatus.StripeDataDrives,
+		ProtectionLevel: wekaStatus.StripeProtectionDrives,
+		Hotspare:        wekaStatus.HotSpare,
+	}
+	return
+}
+
+// SetDataProtection applies the hot spare on the live cluster and records the data protection in the settings.
+// Weka doesn't change the stripe of a cluster which started io, the stripe width and protection level must be the
+// live ones, recording them is needed when the cluster was created with other values than the app settings
+func SetDataProtection(ctx context.Context, p DataProtectionParams, body RequestBody, plan *common.DryRunPlan) (response DataProtectionResponse, err error) {
+	logger := logging.LoggerFromCtx(ctx)
+
+	response, err = getDataProtection(ctx, p)
+	if err != nil {
+		return
+	}
+
+	desired := response.Desired
+	if body.StripeWidth != nil {
+		desired.StripeWidth = *body.StripeWidth
+	}
+	if body.ProtectionLevel != nil {
+		desired.ProtectionLevel = *body.ProtectionLevel
+	}
+	if body.Hotspare != nil {
+		desired.Hotspare = *body.Hotspare
+	}
+
+	if desired.StripeWidth != response.Current.StripeWidth {
+		err = fmt.Errorf("%w: the stripe width of the live cluster is %d, it can't be changed to %d", ErrUnsafeChange, response.Current.StripeWidth, desired.StripeWidth)
+		return
+	}
+	if desired.ProtectionLevel != response.Current.ProtectionLevel {
+		err = fmt.Errorf("%w: the protection level of the live cluster is %d, it can't be changed to %d", ErrUnsafeChange, response.Current.ProtectionLevel, desired.ProtectionLevel)
+		return
+	}
+	if hotspareErr := common.ValidateHotspare(desired.Hotspare, desired.StripeWidth, desired.ProtectionLevel, response.Backends); hotspareErr != nil {
+		err = fmt.Errorf("%w: %v", ErrUnsafeChange, hotspareErr)
+		return
+	}
+
+	if desired.Hotspare != response.Current.Hotspare {
+		err = plan.Apply(ctx, fmt.Sprintf("set weka cluster hot spare from %d to %d", response.Current.Hotspare, desired.Hotspare), func() error {
+			jpool, jpoolErr := status.GetScaleSetsJrpcPool(ctx, p.SubscriptionId, p.ResourceGroupName, p.VmScaleSetNames, p.KeyVaultUri)
+			if jpoolErr != nil {
+				return jpoolErr
+			}
+			callErr := jpool.Call(hot_spare.JrpcClusterUpdate, types.JsonDict{"hot_spare": desired.Hotspare}, nil)
+			if callErr != nil {
+				logger.Error().Err(callErr).Send()
+			}
+			return callErr
+		})
+		if err != nil {
+			return
+		}
+	}
+
+	err = plan.Apply(ctx, fmt.Sprintf("record data protection %d+%d with %d hot spares", desired.StripeWidth, desired.ProtectionLevel, desired.Hotspare), func() error {
+		_, updateErr := common.UpdateClusterSettings(ctx, p.StateStorageName, p.StateContainerName, func(settings *common.ClusterSettings) error {
+			settings.StripeWidth = &desired.StripeWidth
+			settings.ProtectionLevel = &desired.ProtectionLevel
+			settings.Hotspare = &desired.Hotspare
+			return nil
+		})
+		return updateErr
+	})
+	if err != nil {
+		return
+	}
+
+	if !plan.Enabled() {
+		response.Current.Hotspare = desired.Hotspare
+		response.Desired = desired
+	}
+	return
+}
+
+func Handler(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	logger := logging.LoggerFromCtx(ctx)
+
+	reqData, err := common.ParseInvokeRequest(r)
+	if err != nil {
+		logger.Error().Msg("Bad request")
+		common.WriteErrorResponse(w, http.StatusBadRequest, fmt.Errorf("cannot decode the request: %v", err))
+		return
+	}
+
+	// an empty body queries the data protection
+	var data *RequestBody
+	if body := common.GetRequestBody(reqData); body != "" {
+		if err = json.Unmarshal([]byte(body), &data); err != nil {
+			logger.Error().Err(err).Msg("cannot unmarshal the request body")
+			common.WriteErrorResponse(w, http.StatusBadRequest, fmt.Errorf("cannot unmarshal the request body: %v", err))
+			return
+		}
+	}
+
+	p := DataProtectionParams{
+		SubscriptionId:     common.Getenv(ctx, "SUBSCRIPTION_ID"),
+		ResourceGroupName:  common.Getenv(ctx, "RESOURCE_GROUP_NAME"),
+		VmScaleSetNames:    common.GetVmScaleSetNames(ctx, common.Getenv(ctx, "PREFIX"), common.Getenv(ctx, "CLUSTER_NAME")),
+		StateStorageName:   common.Getenv(ctx, "STATE_STORAGE_NAME"),
+		StateContainerName: common.Getenv(ctx, "STATE_CONTAINER_NAME"),
+		KeyVaultUri:        common.Getenv(ctx, "KEY_VAULT_URI"),
+	}
+
+	var response DataProtectionResponse
+	var plan *common.DryRunPlan
+	if data == nil {
+		response, err = getDataProtection(ctx, p)
+	} else {
+		if common.IsDryRun(reqData) {
+			plan = &common.DryRunPlan{}
+		}
+		response, err = SetDataProtection(ctx, p, *data, plan)
+	}
+
+	if errors.Is(err, errNotClusterized) || errors.Is(err, ErrUnsafeChange) {
+		common.WriteErrorResponse(w, http.StatusConflict, err)
+	} else if err != nil {
+		common.WriteErrorResponse(w, common.GetErrorStatusCode(err), err)
+	} else if plan.Enabled() {
+		common.WriteResponse(w, http.StatusOK, "dry run", plan.Response(""))
+	} else {
+		current := response.Current
+		common.WriteResponse(w, http.StatusOK, fmt.Sprintf("data protection is %d+%d with %d hot spares", current.StripeWidth, current.ProtectionLevel, current.Hotspare), response)
+	}
+}
@@ -4,7 +4,6 @@ import (
 	"encoding/json"
 	"fmt"
 	"net/http"
-	"os"
 	"strconv"
 	"weka-deployment/common"
 	"weka-deployment/functions/azure_functions_def"
@@ -15,67 +14,54 @@ import (
 )
 
 func Handler(w http.ResponseWriter, r *http.Request) {
-	stateContainerName := os.Getenv("STATE_CONTAINER_NAME")
-	stateStorageName := os.Getenv("STATE_STORAGE_NAME")
-	hostsNum, _ := strconv.Atoi(os.Getenv("HOSTS_NUM"))
-	clusterName := os.Getenv("CLUSTER_NAME")
-	subscriptionId := os.Getenv("SUBSCRIPTION_ID")
-	resourceGroupName := os.Getenv("RESOURCE_GROUP_NAME")
-	setObs, _ := strconv.ParseBool(os.Getenv("SET_OBS"))
-	obsName := os.Getenv("OBS_NAME")
-	obsContainerName := os.Getenv("OBS_CONTAINER_NAME")
-	obsAccessKey := os.Getenv("OBS_ACCESS_KEY")
-	location := os.Getenv("LOCATION")
-	nvmesNum, _ := strconv.Atoi(os.Getenv("NVMES_NUM"))
-	tieringSsdPercent := os.Getenv("TIERING_SSD_PERCENT")
-	prefix := os.Getenv("PREFIX")
-	keyVaultUri := os.Getenv("KEY_VAULT_URI")
+	ctx := r.Context()
+	stateContainerName := common.Getenv(ctx, "STATE_CONTAINER_NAME")
+	stateStorageName := common.Getenv(ctx, "STATE_STORAGE_NAME")
+	hostsNum, _ := strconv.Atoi(common.Getenv(ctx, "HOSTS_NUM"))
+	clusterName := common.Getenv(ctx, "CLUSTER_NAME")
+	subscriptionId := common.Getenv(ctx, "SUBSCRIPTION_ID")
+	resourceGroupName := common.Getenv(ctx, "RESOURCE_GROUP_NAME")
+	setObs, _ := strconv.ParseBool(common.Getenv(ctx, "SET_OBS"))
+	obsName := common.Getenv(ctx, "OBS_NAME")
+	obsContainerName := common.Getenv(ctx, "OBS_CONTAINER_NAME")
+	obsAccessKey := common.Getenv(ctx, "OBS_ACCESS_KEY")
+	location := common.Getenv(ctx, "LOCATION")
+	nvmesNum, _ := strconv.Atoi(common.Getenv(ctx, "NVMES_NUM"))
+	tieringSsdPercent := common.Getenv(ctx, "TIERING_SSD_PERCENT")
+	prefix := common.Getenv(ctx, "PREFIX")
+	keyVaultUri := common.Getenv(ctx, "KEY_VAULT_URI")
 	// data protection-related vars
-	stripeWidth, _ := strconv.Atoi(os.Getenv("STRIPE_WIDTH"))
-	protectionLevel, _ := strconv.Atoi(os.Getenv("PROTECTION_LEVEL"))
-	hotspare, _ := strconv.Atoi(os.Getenv("HOTSPARE"))
+	stripeWidth, _ := strconv.Atoi(common.Getenv(ctx, "STRIPE_WIDTH"))
+	protectionLevel, _ := strconv.Atoi(common.Getenv(ctx, "PROTECTION_LEVEL"))
+	hotspare, _ := strconv.Atoi(common.Getenv(ctx, "HOTSPARE"))
 
 	vmScaleSetName := fmt.Sprintf("%s-%s-vmss", prefix, clusterName)
 
-	outputs := make(map[string]interface{})
-	resData := make(map[string]interface{})
-
-	ctx := r.Context()
 	logger := logging.LoggerFromCtx(ctx)
 
-	var invokeRequest common.InvokeRequest
-
 	var function struct {
 		Function *string `json:"function"`
 		IpIndex  *string `json:"ip_index"`
 	}
 
-	if err := json.NewDecoder(r.Body).Decode(&invokeRequest); err != nil {
-		err = fmt.Errorf("cannot decode the request: %v", err)
-		logger.Error().Err(err).Send()
-		w.WriteHeader(http.StatusBadRequest)
-		return
-	}
-
-	var reqData map[string]interface{}
-	err := json.Unmarshal(invokeRequest.Data["req"], &reqData)
+	reqData, err := common.ParseInvokeRequest(r)
 	if err != nil {
-		err = fmt.Errorf("cannot unmarshal the request data: %v", err)
+		err = fmt.Errorf("cannot decode the request: %v", err)
 		logger.Error().Err(err).Send()
-		w.WriteHeader(http.StatusBadRequest)
+		common.WriteErrorResponse(w, http.StatusBadRequest, err)
 		return
 	}
 
-	if json.Unmarshal([]byte(reqData["Body"].(string)), &function) != nil {
+	if err = json.Unmarshal([]byte(common.GetRequestBody(reqData)), &function); err != nil {
 		err = fmt.Errorf("cannot unmarshal the request body: %v", err)
 		logger.Error().Err(err).Send()
-		w.WriteHeader(http.StatusBadRequest)
+		common.WriteErrorResponse(w, http.StatusBadRequest, err)
 		return
 	}
 	if function.Function == nil {
-		err := fmt.Errorf("wrong request format. 'function' is required")
+		err = fmt.Errorf("wrong request format. 'function' is required")
 		logger.Error().Err(err).Send()
-		w.WriteHeader(http.StatusBadRequest)
+		common.WriteErrorResponse(w, http.StatusBadRequest, err)
 		return
 	}
 
@@ -106,11 +92,13 @@ func Handler(w http.ResponseWriter, r *http.Request) {
 					},
 					SetObs: setObs,
 				},
-				Obs: clusterizeFunc.AzureObsParams{
-					Name:              obsName,
-					ContainerName:     obsContainerName,
-					AccessKey:         obsAccessKey,
-					TieringSsdPercent: tieringSsdPercent,
+				Obs: []clusterizeFunc.AzureObsParams{
+					{
+						Name:              obsName,
+						ContainerName:     obsContainerName,
+						AccessKey:         obsAccessKey,
+						TieringSsdPercent: tieringSsdPercent,
+					},
 				},
 			}
 			result, err = clusterizeFunc.HandleLastClusterVm(ctx, state, params, &azure_functions_def.AzureFuncDef{})
@@ -134,10 +122,10 @@ func Handler(w http.ResponseWriter, r *http.Request) {
 			result = interfaces
 		}
 	} else if *function.Function == "ip" {
-		if function.Function == nil {
-			err := fmt.Errorf("wrong request format. 'ip_index' is required for fucntion 'ip'")
+		if function.IpIndex == nil {
+			err = fmt.Errorf("wrong request format. 'ip_index' is required for fucntion 'ip'")
 			logger.Error().Err(err).Send()
-			w.WriteHeader(http.StatusBadRequest)
+			common.WriteErrorResponse(w, http.StatusBadRequest, err)
 			return
 		}
 		ips, err1 := common.GetPublicIp(ctx, subscriptionId, resourceGroupName, vmScaleSetName, prefix, clusterName, *function.IpIndex)
@@ -146,16 +134,19 @@ func Handler(w http.ResponseWriter, r *http.Request) {
 		} else {
 			result = ips
 		}
+	} else if *function.Function == "script_extension" {
+		scriptExtensionConfig, err1 := common.ParseScriptExtensionBlobUrl(common.Getenv(ctx, "REIMAGE_RECOVERY_SCRIPT_URL"))
+		if err1 != nil {
+			result = err1.Error()
+		} else {
+			result = clusterizeFunc.GetWekaGuestOSScriptExtensionScript(
+				scriptExtensionConfig.StorageAccountName, scriptExtensionConfig.ContainerName, scriptExtensionConfig.ScriptBlobName,
+			)
+		}
 	} else {
-		result = "unsupported function"
+		common.WriteErrorResponse(w, http.StatusBadRequest, fmt.Errorf("unsupported function %s", *function.Function))
+		return
 	}
 
-	resData["body"] = result
-	outputs["res"] = resData
-	invokeResponse := common.InvokeResponse{Outputs: outputs, Logs: nil, ReturnValue: nil}
-
-	responseJson, _ := json.Marshal(invokeResponse)
-
-	w.Header().Set("Content-Type", "application/json")
-	w.Write(responseJson)
+	common.WriteResponse(w, http.StatusOK, *function.Function, result)
 }
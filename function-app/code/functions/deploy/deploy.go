@@ -4,16 +4,17 @@ import (
 	"context"
 	"encoding/json"
 	"fmt"
-	"net"
 	"net/http"
-	"os"
 	"strconv"
 	"strings"
+	"time"
 	"weka-deployment/common"
 	"weka-deployment/functions/azure_functions_def"
+	"weka-deployment/functions/clusterize"
 
 	"github.com/weka/go-cloud-lib/bash_functions"
 	"github.com/weka/go-cloud-lib/deploy"
+	"github.com/weka/go-cloud-lib/functions_def"
 	"github.com/weka/go-cloud-lib/join"
 	"github.com/weka/go-cloud-lib/logging"
 	"github.com/weka/go-cloud-lib/protocol"
@@ -25,6 +26,117 @@ func getAzureInstanceNameCmd() string {
 	return "curl -s -H Metadata:true --noproxy * http://169.254.169.254/metadata/instance?api-version=2021-02-01 | jq '.compute.name' | cut -c2- | rev | cut -c2- | rev"
 }
 
+// zonal deployments use the vm availability zone as the failure domain
+func getAzureZoneFailureDomainCmd() string {
+	return `echo "zone$(curl -s -H Metadata:true --noproxy * 'http://169.254.169.254/metadata/instance/compute/zone?api-version=2021-02-01&format=text')"`
+}
+
+// backends of a cluster created with the azure fault domains as failure domains join with their fault domain
+func getAzureFaultDomainFailureDomainCmd() string {
+	return `echo "fd$(curl -s -H Metadata:true --noproxy * 'http://169.254.169.254/metadata/instance/compute/platformFaultDomain?api-version=2021-02-01&format=text')"`
+}
+
+// getNicsNetStrForDpdkFunc overrides the getNetStrForDpdk bash function of the deploy and join scripts: the nets are
+// configured with the nics ips known by azure, as the secondary nics may get their address after the script started,
+// and a container can't use more nics than the vm has
+func getNicsNetStrForDpdkFunc(nicsNum int, nicsIps []string) string {
+	s := `
+	NICS_NUM=%d
+	NIC_IPS=(%s)
+	function getNetStrForDpdk() {
+		i=$1
+		j=$2
+		gateways=($3)
+
+		net=""
+		for ((i; i<$j; i++)); do
+			eth=eth$i
+			nic_ip=${NIC_IPS[$i]}
+			if [[ $i -ge $NICS_NUM || -z "$nic_ip" ]]; then
+				echo "$eth is needed by the containers layout, the vm has $NICS_NUM nics"
+				return 1
+			fi
+			for (( retry=0; retry<60; retry++ )); do
+				if ip -o -f inet addr show $eth | grep -q "inet $nic_ip/"; then
+					break
+				fi
+				echo "waiting for $eth to get address $nic_ip"
+				sleep 5
+			done
+			bits=$(ip -o -f inet addr show $eth | grep "inet $nic_ip/" | awk '{print $4}' | cut -d/ -f2)
+			if [ -z "$bits" ]; then
+				echo "$eth did not get address $nic_ip"
+				return 1
+			fi
+			enp=$(ls -l /sys/class/net/$eth/ | grep lower | awk -F"_" '{print $2}' | awk '{print $1}')
+			net="$net --net $enp/$nic_ip/$bits/${gateways[$i]}"
+		done
+	}
+	`
+	return dedent.Dedent(fmt.Sprintf(s, nicsNum, strings.Join(nicsIps, " ")))
+}
+
+// the deploy and join scripts report it before installing weka
+const installingWekaReport = `report "{\"hostname\": \"$HOSTNAME\", \"type\": \"progress\", \"message\": \"Installing weka\"}"`
+
+func injectBeforeWekaInstall(bashScript, script string) string {
+	return strings.Replace(bashScript, installingWekaReport, script+"\n"+installingWekaReport, 1)
+}
+
+// the deploy script waits for its containers to run before calling clusterize and the join script waits for them
+// to join the cluster, the containers resources are set before that
+const (
+	deployContainersWait = "# should not call 'clusterize' until all 2/3 containers are up"
+	joinContainersWait   = "while ! weka debug manhole -s 0 operational_status"
+)
+
+func injectBeforeContainersWait(bashScript, script string) string {
+	for _, containersWait := range []string{deployContainersWait, joinContainersWait} {
+		if strings.Contains(bashScript, containersWait) {
+			return strings.Replace(bashScript, containersWait, script+"\n"+containersWait, 1)
+		}
+	}
+	return bashScript
+}
+
+// getContainersSetupScript binds the configured nics to each container of the backend and adds its flash cache
+func getContainersSetupScript(p clusterize.ClusterizationParams, frontendContainerNum int) (script string) {
+	containerNames := []string{"drives0", "compute0"}
+	if frontendContainerNum > 0 {
+		containerNames = append(containerNames, "frontend0")
+	}
+	if len(p.ContainerNetworkConfig) > 0 {
+		for _, containerName := range containerNames {
+			script += clusterize.GetWekaContainerNetworkScript(containerName, p.ContainerNetworkConfig)
+		}
+	}
+	if p.FlashCacheConfig != nil && len(p.FlashCacheConfig.Devices) > 0 {
+		script += clusterize.GetWekaFlashCacheScript(p.FlashCacheConfig.Devices, p.FlashCacheConfig.SizeGiB)
+	}
+	return
+}
+
+// the speed test servers outlive the clusterization, the instances may wait long for the last one
+const speedTestServerTimeout = 24 * time.Hour
+
+// getEndpointDetectionScript installs the edr agent on every backend, before weka is installed so the agent sees
+// all of the weka activity
+func getEndpointDetectionScript(ctx context.Context, keyVaultUri string, edrConfig *clusterize.EDRConfig) (script, registrationToken string, err error) {
+	if edrConfig == nil {
+		return
+	}
+	if err = clusterize.ValidateEDRType(edrConfig.Type); err != nil {
+		return
+	}
+	registrationToken, err = common.GetKeyVaultValue(ctx, keyVaultUri, "edr-registration-token")
+	if err != nil {
+		err = fmt.Errorf("failed to get edr registration token: %w", err)
+		return
+	}
+	script = clusterize.GetWekaEndpointDetectionScript(edrConfig.Type, edrConfig.ConfigUrl, registrationToken)
+	return
+}
+
 func getWekaIoToken(ctx context.Context, keyVaultUri string) (token string, err error) {
 	token, err = common.GetKeyVaultValue(ctx, keyVaultUri, "get-weka-io-token")
 	return
@@ -35,6 +147,32 @@ func getFunctionKey(ctx context.Context, keyVaultUri string) (functionAppKey str
 	return
 }
 
+// getVmInstallDpdk falls back to udp mode when the nics of the vm don't have accelerated networking
+func getVmInstallDpdk(ctx context.Context, subscriptionId, resourceGroupName, vm string) (installDpdk bool, err error) {
+	logger := logging.LoggerFromCtx(ctx)
+
+	vmName := strings.Split(vm, ":")[0]
+	// scale set vm names are <scale set name>_<instance id>
+	separatorIndex := strings.LastIndex(vmName, "_")
+	if separatorIndex < 0 {
+		err = fmt.Errorf("unexpected vm name %s", vmName)
+		logger.Error().Err(err).Send()
+		return
+	}
+	vmScaleSetName := vmName[:separatorIndex]
+	vmsNics, err := common.GetScaleSetsVmsNicsWithoutAcceleratedNetworking(ctx, subscriptionId, resourceGroupName, []string{vmScaleSetName})
+	if err != nil {
+		err = fmt.Errorf("failed to get vm %s network interfaces: %w", vmName, err)
+		logger.Error().Err(err).Send()
+		return
+	}
+	if nics, ok := vmsNics[vmName]; ok {
+		logger.Warn().Msgf("Accelerated networking is disabled on nics %v of vm %s, falling back to udp mode", nics, vmName)
+		return false, nil
+	}
+	return true, nil
+}
+
 func GetDeployScript(
 	ctx context.Context,
 	subscriptionId,
@@ -52,12 +190,16 @@ func GetDeployScript(
 	frontendContainerNum int,
 	driveContainerNum int,
 	installDpdk bool,
-	nicsNum string,
+	nicsNum int,
 	functionAppName string,
 	gateways []string,
+	dryRun *common.DryRunPlan,
 ) (bashScript string, err error) {
 	logger := logging.LoggerFromCtx(ctx)
 
+	// the secrets embedded in the script are redacted from the dry run response
+	var secrets []string
+
 	state, err := common.ReadState(ctx, stateStorageName, stateContainerName)
 	if err != nil {
 		return
@@ -68,17 +210,35 @@ func GetDeployScript(
 	if err != nil {
 		return
 	}
-	baseFunctionUrl := fmt.Sprintf("https://%s.azurewebsites.net/api/", functionAppName)
-	funcDef := azure_functions_def.NewFuncDef(baseFunctionUrl, functionKey)
+	baseFunctionUrl := common.GetFunctionAppBaseUrl(functionAppName)
+	funcDef := azure_functions_def.NewFuncDef(ctx, baseFunctionUrl, functionKey)
 
+	var reportPhase string
 	instanceParams := protocol.BackendCoreCount{Compute: computeContainerNum, Frontend: frontendContainerNum, Drive: driveContainerNum, ComputeMemory: computeMemory}
-	if err != nil {
-		logger.Error().Err(err).Send()
-		return "", err
-	}
 
 	// used for getting failure domain
 	getHashedIpCommand := bash_functions.GetHashedPrivateIpBashCmd()
+	if len(common.GetAvailabilityZones(ctx)) > 0 {
+		getHashedIpCommand = getAzureZoneFailureDomainCmd()
+	}
+
+	if installDpdk && common.IsDpdkUdpFallbackEnabled(ctx) {
+		installDpdk, err = getVmInstallDpdk(ctx, subscriptionId, resourceGroupName, vm)
+		if err != nil {
+			return
+		}
+	}
+
+	var nicsNetStrForDpdkFunc string
+	if installDpdk {
+		vmName := strings.Split(vm, ":")[0]
+		var nicsIps []string
+		nicsIps, err = common.GetVmNicsPrivateIps(ctx, subscriptionId, resourceGroupName, common.GetVmScaleSetNameFromVmName(vmName), vmName)
+		if err != nil {
+			return
+		}
+		nicsNetStrForDpdkFunc = getNicsNetStrForDpdkFunc(nicsNum, nicsIps)
+	}
 
 	if !state.Clusterized {
 		var token string
@@ -86,6 +246,7 @@ func GetDeployScript(
 		if err != nil {
 			return
 		}
+		secrets = append(secrets, token)
 
 		deploymentParams := deploy.DeploymentParams{
 			VMName:         vm,
@@ -93,7 +254,7 @@ func GetDeployScript(
 			WekaInstallUrl: installUrl,
 			WekaToken:      token,
 			InstallDpdk:    installDpdk,
-			NicsNum:        nicsNum,
+			NicsNum:        strconv.Itoa(nicsNum),
 			Gateways:       gateways,
 			ProxyUrl:       proxyUrl,
 		}
@@ -103,15 +264,40 @@ func GetDeployScript(
 			FailureDomainCmd: getHashedIpCommand,
 		}
 		bashScript = deployScriptGenerator.GetDeployScript()
+		reportPhase = "deploy"
 	} else {
-		wekaPassword, err := common.GetWekaClusterPassword(ctx, keyVaultUri)
+		// joining changes the cluster, the instance waits while maintenance mode is enabled
+		var maintenance bool
+		maintenance, err = common.IsMaintenanceModeEnabled(ctx, stateStorageName, stateContainerName)
+		if err != nil {
+			logger.Error().Err(err).Send()
+			return "", err
+		}
+		if maintenance {
+			logger.Info().Msgf("Maintenance mode is enabled, instance %s will call deploy again", vm)
+			var payload []byte
+			payload, err = json.Marshal(RequestBody{Vm: vm})
+			if err != nil {
+				return "", err
+			}
+			bashScript = common.GetMaintenanceModeScript(
+				funcDef.GetFunctionCmdDefinition(functions_def.Report),
+				funcDef.GetFunctionCmdDefinition(functions_def.Deploy),
+				string(functions_def.Deploy),
+				string(payload),
+			)
+			return
+		}
+
+		wekaUsername, wekaPassword, err := common.GetWekaCredentials(ctx, keyVaultUri)
 		if err != nil {
 			logger.Error().Err(err).Send()
 			return "", err
 		}
+		secrets = append(secrets, wekaPassword)
 
-		vmScaleSetName := fmt.Sprintf("%s-%s-vmss", prefix, clusterName)
-		vmsPrivateIps, err := common.GetVmsPrivateIps(ctx, subscriptionId, resourceGroupName, vmScaleSetName)
+		vmScaleSetNames := common.GetVmScaleSetNames(ctx, prefix, clusterName)
+		vmsPrivateIps, err := common.GetScaleSetsVmsPrivateIps(ctx, subscriptionId, resourceGroupName, vmScaleSetNames)
 		if err != nil {
 			logger.Error().Err(err).Send()
 			return "", err
@@ -120,26 +306,85 @@ func GetDeployScript(
 		vmNameParts := strings.Split(vm, ":")
 		vmName := vmNameParts[0]
 
-		var ips []string
+		// evicted spot vms may still be listed until azure deletes them
+		evictions, err := common.GetEvictions(ctx, stateStorageName, stateContainerName)
+		if err != nil {
+			logger.Error().Err(err).Send()
+			return "", err
+		}
+
+		warmPool, err := common.GetWarmPool(ctx, stateStorageName, stateContainerName)
+		if err != nil {
+			logger.Error().Err(err).Send()
+			return "", err
+		}
+
+		var vmNames, ips []string
 		for ipVmName, ip := range vmsPrivateIps {
-			// exclude ip of the machine itself
-			if ipVmName != vmName {
+			if _, evicted := evictions[ipVmName]; evicted {
+				continue
+			}
+			vmNames = append(vmNames, ipVmName)
+			// exclude ip of the machine itself and of the warm pool vms which didn't join
+			if ipVmName != vmName && !warmPool.IsIdle(ipVmName) {
 				ips = append(ips, ip)
 			}
 		}
 		if len(ips) == 0 {
-			err = fmt.Errorf("no instances found for instance group %s, can't join", vmScaleSetName)
+			err = fmt.Errorf("no instances found for instance groups %v, can't join", vmScaleSetNames)
 			logger.Error().Err(err).Send()
 			return "", err
 		}
 
+		// the vms beyond the desired size prepare and wait deallocated in the warm pool, until the scale up starts them.
+		// A dry run doesn't add the vm, whether it would join is told from the pool read above
+		joinWarmPool := dryRun.Enabled() && warmPool.Joins(vmName, vmNames, state.DesiredSize, common.GetWarmPoolSize(ctx))
+		err = dryRun.Apply(ctx, fmt.Sprintf("add %s to the warm pool if it is short of members", vmName), func() (err error) {
+			joinWarmPool, err = common.JoinWarmPool(ctx, stateStorageName, stateContainerName, vmName, vmNames, state.DesiredSize)
+			return
+		})
 		if err != nil {
 			logger.Error().Err(err).Send()
 			return "", err
 		}
+		if joinWarmPool {
+			logger.Info().Msgf("instance %s joins the warm pool", vm)
+			var payload []byte
+			payload, err = json.Marshal(RequestBody{Vm: vm})
+			if err != nil {
+				return "", err
+			}
+			bashScript = common.GetWarmPoolScript(
+				funcDef.GetFunctionCmdDefinition(functions_def.Report),
+				funcDef.GetFunctionCmdDefinition(functions_def.Deploy),
+				string(payload),
+				proxyUrl,
+				ips,
+			)
+			return bashScript, nil
+		}
+		if _, ok := warmPool[vmName]; ok {
+			// the activated member leaves the warm pool, it is an active backend from now on
+			err = dryRun.Apply(ctx, fmt.Sprintf("remove %s from the warm pool", vmName), func() error {
+				return common.RemoveWarmPoolMember(ctx, stateStorageName, stateContainerName, vmName)
+			})
+			if err != nil {
+				logger.Error().Err(err).Send()
+				return "", err
+			}
+		}
+
+		settings, err := common.GetClusterSettings(ctx, stateStorageName, stateContainerName)
+		if err != nil {
+			logger.Error().Err(err).Send()
+			return "", err
+		}
+		if settings.AzureFaultDomains {
+			getHashedIpCommand = getAzureFaultDomainFailureDomainCmd()
+		}
 
 		joinParams := join.JoinParams{
-			WekaUsername:   "admin",
+			WekaUsername:   wekaUsername,
 			WekaPassword:   wekaPassword,
 			IPs:            ips,
 			InstallDpdk:    installDpdk,
@@ -162,8 +407,55 @@ func GetDeployScript(
 			FuncDef:            funcDef,
 		}
 		bashScript = joinScriptGenerator.GetJoinScript(ctx)
+		reportPhase = "join"
 	}
 	bashScript = dedent.Dedent(bashScript)
+	// the backend steps are read from the same settings as the clusterization
+	backendParams, err := clusterize.GetClusterizationParams(ctx, vm)
+	if err != nil {
+		logger.Error().Err(err).Send()
+		return
+	}
+	edrScript, edrRegistrationToken, err := getEndpointDetectionScript(ctx, keyVaultUri, backendParams.EDRConfig)
+	if err != nil {
+		logger.Error().Err(err).Send()
+		return
+	}
+	secrets = append(secrets, edrRegistrationToken)
+	if edrScript != "" {
+		bashScript = injectBeforeWekaInstall(bashScript, edrScript)
+	}
+	if containersSetupScript := getContainersSetupScript(backendParams, frontendContainerNum); containersSetupScript != "" {
+		bashScript = injectBeforeContainersWait(bashScript, containersSetupScript)
+	}
+	if reportPhase == "deploy" && backendParams.NetworkSpeedTestEnabled {
+		// the last instance measures the bandwidth to all the others before and after the clusterization
+		bashScript = injectBeforeContainersWait(bashScript, clusterize.GetWekaSpeedTestServerScript(
+			backendParams.NetworkSpeedTestProtocol, backendParams.NetworkSpeedTestDurationSeconds, speedTestServerTimeout,
+		))
+	}
+	preClusterizeHook, err := common.GetScriptHook(ctx, stateStorageName, stateContainerName, common.ScriptHookPreClusterize)
+	if err != nil {
+		return
+	}
+	if preClusterizeHook != "" {
+		bashScript = injectBeforeWekaInstall(bashScript, common.GetScriptHookScript(common.ScriptHookPreClusterize, preClusterizeHook))
+	}
+	if reportPhase == "join" {
+		var postClusterizeHook string
+		postClusterizeHook, err = common.GetScriptHook(ctx, stateStorageName, stateContainerName, common.ScriptHookPostClusterize)
+		if err != nil {
+			return
+		}
+		bashScript += common.GetScriptHookScript(common.ScriptHookPostClusterize, postClusterizeHook)
+	}
+	if nicsNetStrForDpdkFunc != "" {
+		// the override follows the definition of the script
+		bashScript = strings.Replace(bashScript, "# deviceNameCmd\n", nicsNetStrForDpdkFunc+"\n# deviceNameCmd\n", 1)
+	}
+	// the phase is reported along with the progress reports of the script
+	bashScript = strings.Replace(bashScript, "set -ex\n", fmt.Sprintf("set -ex\nREPORT_PHASE=%s\n", reportPhase), 1)
+	bashScript = dryRun.Redact(bashScript, secrets...)
 	return
 }
 
@@ -178,26 +470,15 @@ func writeResponse(w http.ResponseWriter, outputs, resData map[string]interface{
 	outputs["res"] = resData
 	invokeResponse := common.InvokeResponse{Outputs: outputs, Logs: nil, ReturnValue: nil}
 
+	// the body stays the raw bash script, user-data.sh saves it as /tmp/deploy.sh, verifies its signature and runs it
 	responseJson, _ := json.Marshal(invokeResponse)
 
 	w.Header().Set("Content-Type", "application/json")
 	w.Write(responseJson)
 }
 
-func getGateway(subnet string) string {
-	ip, ipNet, _ := net.ParseCIDR(subnet)
-	ip = ip.Mask(ipNet.Mask)
-	for i := len(ip) - 1; i >= 0; i-- {
-		ip[i]++
-		if ip[i] > 0 {
-			break
-		}
-	}
-	return ip.String()
-}
-
 func getGateways(subnet string, nicsNum int) (gateways []string) {
-	gateway := getGateway(subnet)
+	gateway := common.GetSubnetGateway(subnet)
 	gateways = make([]string, nicsNum)
 	for i := range gateways {
 		gateways[i] = gateway
@@ -206,31 +487,27 @@ func getGateways(subnet string, nicsNum int) (gateways []string) {
 }
 
 func Handler(w http.ResponseWriter, r *http.Request) {
-	stateContainerName := os.Getenv("STATE_CONTAINER_NAME")
-	stateStorageName := os.Getenv("STATE_STORAGE_NAME")
-	clusterName := os.Getenv("CLUSTER_NAME")
-	subscriptionId := os.Getenv("SUBSCRIPTION_ID")
-	resourceGroupName := os.Getenv("RESOURCE_GROUP_NAME")
-	prefix := os.Getenv("PREFIX")
-	keyVaultUri := os.Getenv("KEY_VAULT_URI")
-	computeMemory := os.Getenv("COMPUTE_MEMORY")
-	computeContainerNum, _ := strconv.Atoi(os.Getenv("NUM_COMPUTE_CONTAINERS"))
-	frontendContainerNum, _ := strconv.Atoi(os.Getenv("NUM_FRONTEND_CONTAINERS"))
-	driveContainerNum, _ := strconv.Atoi(os.Getenv("NUM_DRIVE_CONTAINERS"))
-	installDpdk, _ := strconv.ParseBool(os.Getenv("INSTALL_DPDK"))
-	nicsNum := os.Getenv("NICS_NUM")
-	nicsNumInt, _ := strconv.Atoi(nicsNum)
-	subnet := os.Getenv("SUBNET")
-	functionAppName := os.Getenv("FUNCTION_APP_NAME")
-
-	installUrl := os.Getenv("INSTALL_URL")
-	proxyUrl := os.Getenv("PROXY_URL")
+	ctx := r.Context()
+	stateContainerName := common.Getenv(ctx, "STATE_CONTAINER_NAME")
+	stateStorageName := common.Getenv(ctx, "STATE_STORAGE_NAME")
+	clusterName := common.Getenv(ctx, "CLUSTER_NAME")
+	subscriptionId := common.Getenv(ctx, "SUBSCRIPTION_ID")
+	resourceGroupName := common.Getenv(ctx, "RESOURCE_GROUP_NAME")
+	prefix := common.Getenv(ctx, "PREFIX")
+	keyVaultUri := common.Getenv(ctx, "KEY_VAULT_URI")
+	installDpdk, _ := strconv.ParseBool(common.Getenv(ctx, "INSTALL_DPDK"))
+	// weka falls back to udp mode when the vm security type doesn't support dpdk
+	installDpdk = common.GetWekaInstallDpdk(installDpdk, common.GetVmSecurityType(ctx))
+	subnet := common.Getenv(ctx, "SUBNET")
+	functionAppName := common.Getenv(ctx, "FUNCTION_APP_NAME")
+
+	installUrl := common.Getenv(ctx, "INSTALL_URL")
+	proxyUrl := common.Getenv(ctx, "PROXY_URL")
 
 	outputs := make(map[string]interface{})
 	resData := make(map[string]interface{})
 	var invokeRequest common.InvokeRequest
 
-	ctx := r.Context()
 	logger := logging.LoggerFromCtx(ctx)
 
 	d := json.NewDecoder(r.Body)
@@ -263,6 +540,19 @@ func Handler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	// the containers layout follows the vm size of the backend
+	vmScaleSetName := common.GetVmScaleSetNameFromVmName(strings.Split(data.Vm, ":")[0])
+	containers, err := common.GetBackendContainers(ctx, subscriptionId, resourceGroupName, vmScaleSetName)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		writeResponse(w, outputs, resData, err)
+		return
+	}
+
+	var plan *common.DryRunPlan
+	if common.IsDryRun(reqData) {
+		plan = &common.DryRunPlan{}
+	}
 	bashScript, err := GetDeployScript(
 		ctx,
 		subscriptionId,
@@ -275,20 +565,28 @@ func Handler(w http.ResponseWriter, r *http.Request) {
 		keyVaultUri,
 		proxyUrl,
 		data.Vm,
-		computeMemory,
-		computeContainerNum,
-		frontendContainerNum,
-		driveContainerNum,
+		containers.ComputeMemory,
+		containers.Compute,
+		containers.Frontend,
+		containers.Drive,
 		installDpdk,
-		nicsNum,
+		containers.Nics,
 		functionAppName,
-		getGateways(subnet, nicsNumInt),
+		getGateways(subnet, containers.Nics),
+		plan,
 	)
 
 	if err != nil {
+		common.Notify(ctx, common.NotificationSeverityError, common.NotificationDeployFailed, err.Error(), map[string]string{
+			"vm_name": data.Vm,
+		})
 		w.WriteHeader(http.StatusInternalServerError)
+	} else if plan.Enabled() {
+		// the script is returned for review with its secrets redacted
+		resData["body"] = plan.Response(bashScript)
 	} else {
 		resData["body"] = bashScript
+		common.SetScriptSignatureHeader(ctx, keyVaultUri, resData, bashScript)
 	}
 	writeResponse(w, outputs, resData, err)
 }
@@ -0,0 +1,92 @@
+package deploy
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"weka-deployment/functions/azure_functions_def"
+	"weka-deployment/functions/clusterize"
+
+	"github.com/lithammer/dedent"
+	"github.com/weka/go-cloud-lib/bash_functions"
+	"github.com/weka/go-cloud-lib/deploy"
+	"github.com/weka/go-cloud-lib/join"
+	"github.com/weka/go-cloud-lib/protocol"
+)
+
+// getTestBackendScripts returns the deploy and join scripts of the library, the backend steps are injected around
+// their commands
+func getTestBackendScripts() map[string]string {
+	funcDef := azure_functions_def.NewFuncDef(context.Background(), "https://weka-test-function-app.azurewebsites.net/api/", "test-key")
+	instanceParams := protocol.BackendCoreCount{Compute: 1, Drive: 1, Frontend: 1}
+	deployScriptGenerator := deploy.DeployScriptGenerator{
+		FuncDef:          funcDef,
+		Params:           deploy.DeploymentParams{VMName: "weka-test-vmss_0", InstanceParams: instanceParams, WekaInstallUrl: "https://get.weka.io/dist/v1/install/4.2.1/4.2.1", NicsNum: "2"},
+		FailureDomainCmd: bash_functions.GetHashedPrivateIpBashCmd(),
+	}
+	joinScriptGenerator := join.JoinScriptGenerator{
+		FailureDomainCmd:   bash_functions.GetHashedPrivateIpBashCmd(),
+		GetInstanceNameCmd: getAzureInstanceNameCmd(),
+		ScriptBase:         dedent.Dedent("\n#!/bin/bash\nset -ex\n"),
+		Params:             join.JoinParams{IPs: []string{"10.0.0.4"}, WekaUsername: "admin", InstanceParams: instanceParams},
+		FuncDef:            funcDef,
+	}
+	return map[string]string{
+		"deploy": dedent.Dedent(deployScriptGenerator.GetDeployScript()),
+		"join":   dedent.Dedent(joinScriptGenerator.GetJoinScript(context.Background())),
+	}
+}
+
+// assertInOrder fails when the parts don't follow each other in the script
+func assertInOrder(t *testing.T, name, script string, parts ...string) {
+	t.Helper()
+	offset := 0
+	for _, part := range parts {
+		index := strings.Index(script[offset:], part)
+		if index < 0 {
+			t.Fatalf("%s: %q is missing after offset %d of the script:\n%s", name, part, offset, script)
+		}
+		offset += index + len(part)
+	}
+}
+
+func Test_BackendScriptsEndpointDetectionBeforeWekaInstall(t *testing.T) {
+	edrScript := clusterize.GetWekaEndpointDetectionScript(clusterize.EDRTypeCrowdstrike, "https://edr.example.com/falcon-sensor.deb", "edr-token")
+	for name, script := range getTestBackendScripts() {
+		script = injectBeforeWekaInstall(script, edrScript)
+		assertInOrder(t, name, script, "# endpoint detection and response agent installation", installingWekaReport)
+	}
+}
+
+func Test_BackendScriptsContainersSetupBeforeContainersWait(t *testing.T) {
+	p := clusterize.ClusterizationParams{
+		ContainerNetworkConfig: []clusterize.WekaNetInterface{{Name: "eth2"}, {Name: "eth3", IPAddress: "10.1.0.5", Netmask: "24"}},
+		FlashCacheConfig:       &clusterize.FlashCacheConfig{Devices: []string{"/dev/sdc"}, SizeGiB: 128},
+	}
+	setupScript := getContainersSetupScript(p, 1)
+	// the nics are bound to every container before the flash cache is added
+	assertInOrder(t, "setup", setupScript,
+		"# drives0 container network configuration", "# compute0 container network configuration",
+		"# frontend0 container network configuration", "# flash cache configuration",
+	)
+	if !strings.Contains(setupScript, "--interface eth3 --ips 10.1.0.5 --netmask 24") {
+		t.Errorf("the nic address is missing from the setup script:\n%s", setupScript)
+	}
+
+	waits := map[string]string{"deploy": deployContainersWait, "join": joinContainersWait}
+	for name, script := range getTestBackendScripts() {
+		script = injectBeforeContainersWait(script, setupScript)
+		assertInOrder(t, name, script, installingWekaReport, "# flash cache configuration", waits[name])
+	}
+}
+
+func Test_ContainersSetupScriptWithoutFrontend(t *testing.T) {
+	p := clusterize.ClusterizationParams{ContainerNetworkConfig: []clusterize.WekaNetInterface{{Name: "eth2"}}}
+	setupScript := getContainersSetupScript(p, 0)
+	if strings.Contains(setupScript, "frontend0") || strings.Contains(setupScript, "flash cache") {
+		t.Errorf("unexpected setup script:\n%s", setupScript)
+	}
+	if getContainersSetupScript(clusterize.ClusterizationParams{}, 1) != "" {
+		t.Errorf("expected no setup script without network and flash cache config")
+	}
+}
@@ -0,0 +1,193 @@
+package destroy_cleanup
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"weka-deployment/common"
+
+	"github.com/weka/go-cloud-lib/connectors"
+	"github.com/weka/go-cloud-lib/lib/jrpc"
+	"github.com/weka/go-cloud-lib/lib/weka"
+	"github.com/weka/go-cloud-lib/logging"
+)
+
+const JrpcClusterStopIo weka.JrpcMethod = "cluster_stop_io"
+
+type CleanupResponse struct {
+	Completed []string `json:"completed"`
+	Errors    []string `json:"errors"`
+}
+
+type CleanupParams struct {
+	SubscriptionId     string
+	ResourceGroupName  string
+	Prefix             string
+	ClusterName        string
+	StateStorageName   string
+	StateContainerName string
+	KeyVaultUri        string
+
+	// when set, the cleanup steps are recorded instead of applied
+	DryRun *common.DryRunPlan
+}
+
+type cleanup struct {
+	ctx      context.Context
+	plan     *common.DryRunPlan
+	response CleanupResponse
+}
+
+// run applies a single cleanup step, a failed step doesn't stop the following ones so terraform destroy
+// is left with as few resources as possible to fail on
+func (c *cleanup) run(description string, step func() error) {
+	logger := logging.LoggerFromCtx(c.ctx)
+
+	err := c.plan.Apply(c.ctx, description, step)
+	if err != nil {
+		logger.Error().Err(err).Msgf("cleanup step failed: %s", description)
+		c.response.Errors = append(c.response.Errors, fmt.Sprintf("%s: %v", description, err))
+		return
+	}
+	if !c.plan.Enabled() {
+		c.response.Completed = append(c.response.Completed, description)
+	}
+}
+
+func stopIo(ctx context.Context, p CleanupParams, vmScaleSetNames []string) (err error) {
+	username, password, err := common.GetWekaCredentials(ctx, p.KeyVaultUri)
+	if err != nil {
+		return
+	}
+
+	vmIps, err := common.GetScaleSetsVmsPrivateIps(ctx, p.SubscriptionId, p.ResourceGroupName, vmScaleSetNames)
+	if err != nil {
+		return
+	}
+	ips := make([]string, 0, len(vmIps))
+	for _, ip := range vmIps {
+		ips = append(ips, ip)
+	}
+	if len(ips) == 0 {
+		return fmt.Errorf("no instances found in %v", vmScaleSetNames)
+	}
+
+	jpool := &jrpc.Pool{
+		Ips:     ips,
+		Clients: map[string]*jrpc.BaseClient{},
+		Active:  "",
+		Builder: func(ip string) *jrpc.BaseClient {
+			return connectors.NewJrpcClient(ctx, ip, weka.ManagementJrpcPort, username, password)
+		},
+		Ctx: ctx,
+	}
+	return jpool.Call(JrpcClusterStopIo, struct{}{}, nil)
+}
+
+func removeScaleSetProtection(ctx context.Context, p CleanupParams, vmScaleSetName string) (err error) {
+	instanceIds, err := common.GetScaleSetInstanceIds(ctx, p.SubscriptionId, p.ResourceGroupName, vmScaleSetName)
+	if err != nil {
+		return
+	}
+	for _, instanceId := range instanceIds {
+		err = common.SetDeletionProtection(ctx, p.SubscriptionId, p.ResourceGroupName, vmScaleSetName, instanceId, false)
+		if err != nil {
+			return
+		}
+	}
+	return
+}
+
+// Cleanup removes what the functions created outside of terraform, it is run right before terraform destroy:
+// io is stopped, deletion locks and scale in protection are removed, the scale sets role assignments and
+// the function created obs storage accounts are deleted and finally the state blob is deleted
+func Cleanup(ctx context.Context, p CleanupParams) CleanupResponse {
+	logger := logging.LoggerFromCtx(ctx)
+	logger.Info().Msgf("Cleaning up cluster %s resources", p.ClusterName)
+
+	c := &cleanup{ctx: ctx, plan: p.DryRun}
+	vmScaleSetNames := common.GetVmScaleSetNames(ctx, p.Prefix, p.ClusterName)
+
+	state, err := common.ReadState(ctx, p.StateStorageName, p.StateContainerName)
+	if err != nil {
+		c.response.Errors = append(c.response.Errors, fmt.Sprintf("read state: %v", err))
+	} else if state.Clusterized {
+		c.run("stop weka cluster io", func() error {
+			return stopIo(ctx, p, vmScaleSetNames)
+		})
+	}
+
+	lockName := common.GetDeletionLockName(p.Prefix, p.ClusterName)
+	c.run(fmt.Sprintf("remove deletion locks %s", lockName), func() error {
+		_, lockErr := common.RemoveResourceManagerLocks(ctx, p.SubscriptionId, p.ResourceGroupName, lockName)
+		return lockErr
+	})
+
+	for _, vmScaleSetName := range vmScaleSetNames {
+		vmScaleSetName := vmScaleSetName
+		c.run(fmt.Sprintf("remove scale in protection of scale set %s instances", vmScaleSetName), func() error {
+			return removeScaleSetProtection(ctx, p, vmScaleSetName)
+		})
+		c.run(fmt.Sprintf("delete role assignments of scale set %s identity", vmScaleSetName), func() error {
+			_, roleErr := common.DeleteScaleSetRoleAssignments(ctx, p.SubscriptionId, p.ResourceGroupName, vmScaleSetName)
+			return roleErr
+		})
+	}
+
+	storageAccountNames, err := common.ListFunctionCreatedStorageAccounts(ctx, p.SubscriptionId, p.ResourceGroupName, p.ClusterName)
+	if err != nil {
+		c.response.Errors = append(c.response.Errors, fmt.Sprintf("list obs storage accounts: %v", err))
+	}
+	for _, storageAccountName := range storageAccountNames {
+		storageAccountName := storageAccountName
+		c.run(fmt.Sprintf("delete obs storage account %s", storageAccountName), func() error {
+			return common.DeleteStorageAccount(ctx, p.SubscriptionId, p.ResourceGroupName, storageAccountName)
+		})
+	}
+
+	c.run("delete clusterize responses", func() error {
+		return common.DeleteClusterizeResponses(ctx, p.StateStorageName, p.StateContainerName)
+	})
+
+	// the state is deleted last, a failed cleanup can be re-run
+	if len(c.response.Errors) == 0 {
+		c.run("delete state blob", func() error {
+			return common.DeleteBlobObject(ctx, p.StateStorageName, p.StateContainerName, "state")
+		})
+	}
+	return c.response
+}
+
+func Handler(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	logger := logging.LoggerFromCtx(ctx)
+
+	reqData, err := common.ParseInvokeRequest(r)
+	if err != nil {
+		logger.Error().Msg("Bad request")
+		common.WriteErrorResponse(w, http.StatusBadRequest, fmt.Errorf("cannot decode the request: %v", err))
+		return
+	}
+
+	p := CleanupParams{
+		SubscriptionId:     common.Getenv(ctx, "SUBSCRIPTION_ID"),
+		ResourceGroupName:  common.Getenv(ctx, "RESOURCE_GROUP_NAME"),
+		Prefix:             common.Getenv(ctx, "PREFIX"),
+		ClusterName:        common.Getenv(ctx, "CLUSTER_NAME"),
+		StateStorageName:   common.Getenv(ctx, "STATE_STORAGE_NAME"),
+		StateContainerName: common.Getenv(ctx, "STATE_CONTAINER_NAME"),
+		KeyVaultUri:        common.Getenv(ctx, "KEY_VAULT_URI"),
+	}
+	if common.IsDryRun(reqData) {
+		p.DryRun = &common.DryRunPlan{}
+	}
+
+	response := Cleanup(ctx, p)
+	if p.DryRun.Enabled() {
+		common.WriteResponse(w, http.StatusOK, "dry run", p.DryRun.Response(""))
+	} else if len(response.Errors) > 0 {
+		common.WriteResponse(w, http.StatusInternalServerError, fmt.Sprintf("cleanup failed with %d errors", len(response.Errors)), response)
+	} else {
+		common.WriteResponse(w, http.StatusOK, "cleanup completed", response)
+	}
+}
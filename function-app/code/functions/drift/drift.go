@@ -0,0 +1,250 @@
+package drift
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+	"weka-deployment/common"
+	"weka-deployment/functions/clusterize"
+	"weka-deployment/functions/status"
+
+	"github.com/weka/go-cloud-lib/lib/weka"
+	"github.com/weka/go-cloud-lib/logging"
+	"github.com/weka/go-cloud-lib/protocol"
+)
+
+var errNotClusterized = errors.New("cluster is not clusterized yet")
+
+const jrpcFilesystemsList weka.JrpcMethod = "filesystems_list"
+
+type filesystemInfo struct {
+	Name       string `json:"name"`
+	ObsBuckets []struct {
+		Name string `json:"name"`
+	} `json:"obs_buckets"`
+}
+
+// DriftItem compares a declared parameter with the state blob, when it keeps it, and the live cluster
+type DriftItem struct {
+	Field    string      `json:"field"`
+	Declared interface{} `json:"declared"`
+	State    interface{} `json:"state,omitempty"`
+	Actual   interface{} `json:"actual"`
+	Drifted  bool        `json:"drifted"`
+}
+
+type FilesystemsDrift struct {
+	// declared filesystems which are not on the cluster, and cluster filesystems which are not declared
+	Missing []string `json:"missing"`
+	Extra   []string `json:"extra"`
+	// declared tiered filesystems which are not attached to an obs bucket, and the other way around
+	TieringMismatch []string `json:"tiering_mismatch"`
+	Drifted         bool     `json:"drifted"`
+}
+
+type DriftResponse struct {
+	Drifted     bool             `json:"drifted"`
+	Items       []DriftItem      `json:"items"`
+	Filesystems FilesystemsDrift `json:"filesystems"`
+	CheckedAt   time.Time        `json:"checked_at"`
+}
+
+type DriftParams struct {
+	SubscriptionId     string
+	ResourceGroupName  string
+	StateStorageName   string
+	StateContainerName string
+	KeyVaultUri        string
+	Prefix             string
+	ClusterName        string
+}
+
+func (r *DriftResponse) add(field string, declared, state, actual interface{}) {
+	item := DriftItem{Field: field, Declared: declared, State: state, Actual: actual}
+	item.Drifted = fmt.Sprint(declared) != fmt.Sprint(actual) || (state != nil && fmt.Sprint(declared) != fmt.Sprint(state))
+	r.Items = append(r.Items, item)
+	r.Drifted = r.Drifted || item.Drifted
+}
+
+func getEnvInt(ctx context.Context, name string) int {
+	value, _ := strconv.Atoi(common.Getenv(ctx, name))
+	return value
+}
+
+// getDeclaredFilesystems returns the filesystems created at clusterization time by their tiering, the default
+// filesystem is tiered when the obs is set
+func getDeclaredFilesystems(ctx context.Context) (filesystems map[string]bool, err error) {
+	setObs, _ := strconv.ParseBool(common.Getenv(ctx, "SET_OBS"))
+	filesystems = map[string]bool{common.DefaultFilesystemName: setObs}
+
+	var declared []clusterize.WekaFilesystem
+	if value := common.Getenv(ctx, "FILESYSTEMS"); value != "" {
+		if err = json.Unmarshal([]byte(value), &declared); err != nil {
+			err = fmt.Errorf("cannot parse FILESYSTEMS: %w", err)
+			return
+		}
+	}
+	for _, fs := range declared {
+		filesystems[fs.Name] = fs.TieringSsdPercent > 0
+	}
+	return
+}
+
+func compareFilesystems(declared map[string]bool, actual map[string]filesystemInfo) (drift FilesystemsDrift) {
+	drift.Missing = []string{}
+	drift.Extra = []string{}
+	drift.TieringMismatch = []string{}
+
+	actualByName := make(map[string]filesystemInfo, len(actual))
+	for _, fs := range actual {
+		// the hidden filesystems, like the smbw config filesystem, are created by the protocols setup
+		if strings.HasPrefix(fs.Name, ".") {
+			continue
+		}
+		actualByName[fs.Name] = fs
+		if _, ok := declared[fs.Name]; !ok {
+			drift.Extra = append(drift.Extra, fs.Name)
+		}
+	}
+	for name, tiered := range declared {
+		fs, ok := actualByName[name]
+		if !ok {
+			drift.Missing = append(drift.Missing, name)
+		} else if tiered != (len(fs.ObsBuckets) > 0) {
+			drift.TieringMismatch = append(drift.TieringMismatch, name)
+		}
+	}
+	sort.Strings(drift.Missing)
+	sort.Strings(drift.Extra)
+	sort.Strings(drift.TieringMismatch)
+	drift.Drifted = len(drift.Missing) > 0 || len(drift.Extra) > 0 || len(drift.TieringMismatch) > 0
+	return
+}
+
+// countUpFrontends returns the number of the given ips running an up frontend container
+func countUpFrontends(hosts weka.HostListResponse, ips map[string]string) int {
+	ipSet := make(map[string]bool, len(ips))
+	for _, ip := range ips {
+		ipSet[ip] = true
+	}
+	upIps := make(map[string]bool)
+	for _, host := range hosts {
+		if ipSet[host.HostIp] && strings.HasPrefix(host.ContainerName, "frontend") && host.Status == "UP" {
+			upIps[host.HostIp] = true
+		}
+	}
+	return len(upIps)
+}
+
+// GetDrift compares the parameters terraform declared, through the app settings, with the state blob and the live
+// cluster, the protocol gateways are compared by their vms and their frontend containers which joined the cluster
+func GetDrift(ctx context.Context, p DriftParams) (response DriftResponse, err error) {
+	logger := logging.LoggerFromCtx(ctx)
+	logger.Info().Msg("computing the cluster drift...")
+
+	state, err := common.ReadState(ctx, p.StateStorageName, p.StateContainerName)
+	if err != nil {
+		return
+	}
+	if !state.Clusterized {
+		err = errNotClusterized
+		return
+	}
+	declaredFilesystems, err := getDeclaredFilesystems(ctx)
+	if err != nil {
+		return
+	}
+
+	jpool, err := status.GetScaleSetsJrpcPool(ctx, p.SubscriptionId, p.ResourceGroupName, common.GetVmScaleSetNames(ctx, p.Prefix, p.ClusterName), p.KeyVaultUri)
+	if err != nil {
+		return
+	}
+	wekaStatus := protocol.WekaStatus{}
+	if err = jpool.Call(weka.JrpcStatus, struct{}{}, &wekaStatus); err != nil {
+		return
+	}
+	hosts := weka.HostListResponse{}
+	if err = jpool.Call(weka.JrpcHostList, struct{}{}, &hosts); err != nil {
+		return
+	}
+	filesystems := map[string]filesystemInfo{}
+	if err = jpool.Call(jrpcFilesystemsList, struct{}{}, &filesystems); err != nil {
+		return
+	}
+
+	backendIps := make(map[string]bool)
+	for _, host := range hosts {
+		if strings.HasPrefix(host.ContainerName, "drives") {
+			backendIps[host.HostIp] = true
+		}
+	}
+
+	response.add("hosts_num", getEnvInt(ctx, "HOSTS_NUM"), state.DesiredSize, len(backendIps))
+	response.add("stripe_width", getEnvInt(ctx, "STRIPE_WIDTH"), nil, wekaStatus.StripeDataDrives)
+	response.add("protection_level", getEnvInt(ctx, "PROTECTION_LEVEL"), nil, wekaStatus.StripeProtectionDrives)
+	response.add("hotspare", getEnvInt(ctx, "HOTSPARE"), nil, wekaStatus.HotSpare)
+
+	setObs, _ := strconv.ParseBool(common.Getenv(ctx, "SET_OBS"))
+	obsAttached := false
+	for _, fs := range filesystems {
+		obsAttached = obsAttached || len(fs.ObsBuckets) > 0
+	}
+	response.add("obs", setObs, nil, obsAttached)
+
+	for _, gateways := range []struct {
+		field      string
+		setting    string
+		nameSuffix string
+	}{
+		{"nfs_protocol_gateways_number", "NFS_PROTOCOL_GATEWAYS_NUM", common.NfsProtocolGatewaysNameSuffix},
+		{"smb_protocol_gateways_number", "SMB_PROTOCOL_GATEWAYS_NUM", common.SmbProtocolGatewaysNameSuffix},
+	} {
+		gatewaysName := common.GetProtocolGatewaysName(p.Prefix, p.ClusterName, gateways.nameSuffix)
+		var gatewaysIps map[string]string
+		gatewaysIps, err = common.GetProtocolGatewaysPrivateIps(ctx, p.SubscriptionId, p.ResourceGroupName, gatewaysName)
+		if err != nil {
+			return
+		}
+		// the state column holds the gateways vms, the actual one their containers in the cluster
+		response.add(gateways.field, getEnvInt(ctx, gateways.setting), len(gatewaysIps), countUpFrontends(hosts, gatewaysIps))
+	}
+
+	response.Filesystems = compareFilesystems(declaredFilesystems, filesystems)
+	response.Drifted = response.Drifted || response.Filesystems.Drifted
+	response.CheckedAt = time.Now().UTC()
+	return
+}
+
+func Handler(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+
+	p := DriftParams{
+		SubscriptionId:     common.Getenv(ctx, "SUBSCRIPTION_ID"),
+		ResourceGroupName:  common.Getenv(ctx, "RESOURCE_GROUP_NAME"),
+		StateStorageName:   common.Getenv(ctx, "STATE_STORAGE_NAME"),
+		StateContainerName: common.Getenv(ctx, "STATE_CONTAINER_NAME"),
+		KeyVaultUri:        common.Getenv(ctx, "KEY_VAULT_URI"),
+		Prefix:             common.Getenv(ctx, "PREFIX"),
+		ClusterName:        common.Getenv(ctx, "CLUSTER_NAME"),
+	}
+
+	response, err := GetDrift(ctx, p)
+	if errors.Is(err, errNotClusterized) {
+		common.WriteErrorResponse(w, http.StatusConflict, err)
+		return
+	} else if err != nil {
+		common.WriteErrorResponse(w, common.GetErrorStatusCode(err), err)
+		return
+	}
+	message := "no drift"
+	if response.Drifted {
+		message = "drift detected"
+	}
+	common.WriteResponse(w, http.StatusOK, message, response)
+}
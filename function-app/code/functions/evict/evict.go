@@ -0,0 +1,145 @@
+package evict
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"weka-deployment/common"
+	"weka-deployment/functions/status"
+
+	"github.com/google/uuid"
+	"github.com/weka/go-cloud-lib/lib/types"
+	"github.com/weka/go-cloud-lib/lib/weka"
+	"github.com/weka/go-cloud-lib/logging"
+)
+
+type RequestBody struct {
+	Vm string `json:"vm"`
+}
+
+// deactivateVmDrives deactivates the drives of all the weka containers running on the vm, so the rebuild starts
+// before azure deletes the spot vm instead of after the drives are found missing
+func deactivateVmDrives(ctx context.Context, subscriptionId, resourceGroupName string, vmScaleSetNames []string, vmName, keyVaultUri string) (deactivated int, err error) {
+	logger := logging.LoggerFromCtx(ctx)
+
+	vmsPrivateIps, err := common.GetScaleSetsVmsPrivateIps(ctx, subscriptionId, resourceGroupName, vmScaleSetNames)
+	if err != nil {
+		return
+	}
+	vmIp, ok := vmsPrivateIps[vmName]
+	if !ok {
+		err = fmt.Errorf("vm %s wasn't found in scale sets %v", vmName, vmScaleSetNames)
+		logger.Error().Err(err).Send()
+		return
+	}
+
+	jpool, err := status.GetScaleSetsJrpcPool(ctx, subscriptionId, resourceGroupName, vmScaleSetNames, keyVaultUri)
+	if err != nil {
+		return
+	}
+	// the evicted vm is going away, it must not be the one serving the calls
+	var ips []string
+	for _, ip := range jpool.Ips {
+		if ip != vmIp {
+			ips = append(ips, ip)
+		}
+	}
+	if len(ips) == 0 {
+		err = fmt.Errorf("no other instances found in scale sets %v", vmScaleSetNames)
+		logger.Error().Err(err).Send()
+		return
+	}
+	jpool.Ips = ips
+
+	hostsApiList := weka.HostListResponse{}
+	err = jpool.Call(weka.JrpcHostList, struct{}{}, &hostsApiList)
+	if err != nil {
+		logger.Error().Err(err).Send()
+		return
+	}
+	vmHostIds := make(map[weka.HostId]bool)
+	for hostId, host := range hostsApiList {
+		if host.HostIp == vmIp {
+			vmHostIds[hostId] = true
+		}
+	}
+	if len(vmHostIds) == 0 {
+		logger.Info().Msgf("vm %s (%s) is not part of the weka cluster", vmName, vmIp)
+		return
+	}
+
+	driveApiList := weka.DriveListResponse{}
+	err = jpool.Call(weka.JrpcDrivesList, struct{}{}, &driveApiList)
+	if err != nil {
+		logger.Error().Err(err).Send()
+		return
+	}
+	var driveUuids []uuid.UUID
+	for _, drive := range driveApiList {
+		if vmHostIds[drive.HostId] && drive.ShouldBeActive {
+			driveUuids = append(driveUuids, drive.Uuid)
+		}
+	}
+	if len(driveUuids) == 0 {
+		return
+	}
+
+	logger.Info().Msgf("deactivating %d drives of evicted vm %s", len(driveUuids), vmName)
+	err = jpool.Call(weka.JrpcDeactivateDrives, types.JsonDict{
+		"drive_uuids": driveUuids,
+	}, nil)
+	if err != nil {
+		logger.Error().Err(err).Send()
+		return
+	}
+	deactivated = len(driveUuids)
+	return
+}
+
+func Handler(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	logger := logging.LoggerFromCtx(ctx)
+
+	reqData, err := common.ParseInvokeRequest(r)
+	if err != nil {
+		logger.Error().Msg("Bad request")
+		common.WriteErrorResponse(w, http.StatusBadRequest, fmt.Errorf("cannot decode the request: %v", err))
+		return
+	}
+
+	var data RequestBody
+	if json.Unmarshal([]byte(common.GetRequestBody(reqData)), &data) != nil || !strings.Contains(data.Vm, ":") {
+		logger.Error().Msg("Bad request")
+		common.WriteErrorResponse(w, http.StatusBadRequest, fmt.Errorf("wrong request format. 'vm' is required as <vm name>:<hostname>"))
+		return
+	}
+
+	subscriptionId := common.Getenv(ctx, "SUBSCRIPTION_ID")
+	resourceGroupName := common.Getenv(ctx, "RESOURCE_GROUP_NAME")
+	stateContainerName := common.Getenv(ctx, "STATE_CONTAINER_NAME")
+	stateStorageName := common.Getenv(ctx, "STATE_STORAGE_NAME")
+	keyVaultUri := common.Getenv(ctx, "KEY_VAULT_URI")
+
+	vmNameParts := strings.Split(data.Vm, ":")
+	vmName, hostname := vmNameParts[0], vmNameParts[1]
+	vmScaleSetNames := common.GetVmScaleSetNames(ctx, common.Getenv(ctx, "PREFIX"), common.Getenv(ctx, "CLUSTER_NAME"))
+	logger.Info().Msgf("spot eviction notice received for vm %s (%s)", vmName, hostname)
+
+	var deactivated int
+	state, err := common.ReadState(ctx, stateStorageName, stateContainerName)
+	if err == nil && state.Clusterized {
+		deactivated, err = deactivateVmDrives(ctx, subscriptionId, resourceGroupName, vmScaleSetNames, vmName, keyVaultUri)
+	}
+	// the eviction is recorded even when the drives weren't deactivated, the scale down will remove the vm from the cluster
+	recordErr := common.AddEvictedInstance(ctx, stateStorageName, stateContainerName, vmName, hostname, deactivated)
+
+	if err != nil {
+		common.WriteErrorResponse(w, common.GetErrorStatusCode(err), err)
+	} else if recordErr != nil {
+		common.WriteErrorResponse(w, http.StatusInternalServerError, recordErr)
+	} else {
+		common.WriteResponse(w, http.StatusOK, fmt.Sprintf("eviction of %s recorded, %d drives deactivated", vmName, deactivated), nil)
+	}
+}
@@ -5,7 +5,6 @@ import (
 	"encoding/json"
 	"fmt"
 	"net/http"
-	"os"
 	"weka-deployment/common"
 )
 
@@ -20,21 +19,20 @@ type ScaleSetInfoResponse struct {
 }
 
 func Handler(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
 	outputs := make(map[string]interface{})
 	resData := make(map[string]interface{})
 
-	stateContainerName := os.Getenv("STATE_CONTAINER_NAME")
-	stateStorageName := os.Getenv("STATE_STORAGE_NAME")
-	subscriptionId := os.Getenv("SUBSCRIPTION_ID")
-	resourceGroupName := os.Getenv("RESOURCE_GROUP_NAME")
-	prefix := os.Getenv("PREFIX")
-	clusterName := os.Getenv("CLUSTER_NAME")
-	keyVaultUri := os.Getenv("KEY_VAULT_URI")
+	stateContainerName := common.Getenv(ctx, "STATE_CONTAINER_NAME")
+	stateStorageName := common.Getenv(ctx, "STATE_STORAGE_NAME")
+	subscriptionId := common.Getenv(ctx, "SUBSCRIPTION_ID")
+	resourceGroupName := common.Getenv(ctx, "RESOURCE_GROUP_NAME")
+	prefix := common.Getenv(ctx, "PREFIX")
+	clusterName := common.Getenv(ctx, "CLUSTER_NAME")
+	keyVaultUri := common.Getenv(ctx, "KEY_VAULT_URI")
 
 	vmScaleSetName := fmt.Sprintf("%s-%s-vmss", prefix, clusterName)
 
-	ctx := r.Context()
-
 	response, err := getScaleSetInfoResponse(
 		ctx, subscriptionId, resourceGroupName, vmScaleSetName, stateContainerName, stateStorageName, keyVaultUri,
 	)
@@ -47,6 +45,7 @@ func Handler(w http.ResponseWriter, r *http.Request) {
 	outputs["res"] = resData
 	invokeResponse := common.InvokeResponse{Outputs: outputs, Logs: nil, ReturnValue: nil}
 
+	// the body stays the raw scale set info, the logic app passes it to scale_down as its request body
 	responseJson, _ := json.Marshal(invokeResponse)
 
 	w.Header().Set("Content-Type", "application/json")
@@ -0,0 +1,66 @@
+package force_clusterize
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"weka-deployment/common"
+	"weka-deployment/functions/clusterize"
+
+	"github.com/weka/go-cloud-lib/logging"
+)
+
+type RequestBody struct {
+	Reason string `json:"reason"`
+}
+
+func Handler(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	logger := logging.LoggerFromCtx(ctx)
+
+	reqData, err := common.ParseInvokeRequest(r)
+	if err != nil {
+		logger.Error().Msg("Bad request")
+		common.WriteErrorResponse(w, http.StatusBadRequest, fmt.Errorf("cannot decode the request: %v", err))
+		return
+	}
+
+	var data RequestBody
+	if body := common.GetRequestBody(reqData); body != "" {
+		if err = json.Unmarshal([]byte(body), &data); err != nil {
+			logger.Error().Err(err).Msg("cannot unmarshal the request body")
+			common.WriteErrorResponse(w, http.StatusBadRequest, fmt.Errorf("cannot unmarshal the request body: %v", err))
+			return
+		}
+	}
+	reason := "clusterization forced by the operator"
+	if data.Reason != "" {
+		reason = fmt.Sprintf("%s: %s", reason, data.Reason)
+	}
+
+	// malformed settings would be read as zero values and break the cluster configuration
+	if err = common.ConfigIssuesError(common.ValidateConfig(ctx)); err != nil {
+		common.WriteErrorResponse(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	p, err := clusterize.GetClusterizationParams(ctx, "")
+	if err != nil {
+		common.WriteErrorResponse(w, http.StatusInternalServerError, err)
+		return
+	}
+	if common.IsDryRun(reqData) {
+		p.DryRun = &common.DryRunPlan{}
+	}
+	vmName, err := clusterize.ForceClusterize(ctx, p, reason)
+	if errors.Is(err, clusterize.ErrAlreadyClusterized) || errors.Is(err, clusterize.ErrAllInstancesReady) || errors.Is(err, clusterize.ErrTooFewInstances) {
+		common.WriteErrorResponse(w, http.StatusConflict, err)
+	} else if err != nil {
+		common.WriteErrorResponse(w, common.GetErrorStatusCode(err), err)
+	} else if p.DryRun.Enabled() {
+		common.WriteResponse(w, http.StatusOK, "dry run", p.DryRun.Response(""))
+	} else {
+		common.WriteResponse(w, http.StatusOK, fmt.Sprintf("clusterization started on %s", vmName), nil)
+	}
+}
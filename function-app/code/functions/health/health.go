@@ -0,0 +1,127 @@
+package health
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"weka-deployment/common"
+	"weka-deployment/functions/status"
+
+	"github.com/weka/go-cloud-lib/lib/weka"
+	"github.com/weka/go-cloud-lib/logging"
+	"github.com/weka/go-cloud-lib/protocol"
+)
+
+const (
+	ModeShallow = "shallow"
+	ModeDeep    = "deep"
+)
+
+type HealthResponse struct {
+	Mode           string `json:"mode"`
+	Healthy        bool   `json:"healthy"`
+	Reason         string `json:"reason,omitempty"`
+	IoStatus       string `json:"io_status,omitempty"`
+	ActiveBackends int    `json:"active_backends,omitempty"`
+	TotalBackends  int    `json:"total_backends,omitempty"`
+}
+
+func getMode(reqData map[string]interface{}) string {
+	if query, ok := reqData["Query"].(map[string]interface{}); ok {
+		if mode, ok := query["mode"].(string); ok && mode != "" {
+			return mode
+		}
+	}
+	return ModeShallow
+}
+
+// checkClusterHealth is healthy when the weka cluster is reachable, io is started and a majority of the backends is active,
+// the majority is required by the weka management quorum
+func checkClusterHealth(ctx context.Context, subscriptionId, resourceGroupName string, vmScaleSetNames []string, stateStorageName, stateContainerName, keyVaultUri string) (response HealthResponse) {
+	logger := logging.LoggerFromCtx(ctx)
+	response.Mode = ModeDeep
+
+	state, err := common.ReadState(ctx, stateStorageName, stateContainerName)
+	if err != nil {
+		response.Reason = fmt.Sprintf("failed to read state: %v", err)
+		return
+	}
+	if !state.Clusterized {
+		response.Reason = "cluster is not clusterized yet"
+		return
+	}
+
+	jpool, err := status.GetScaleSetsJrpcPool(ctx, subscriptionId, resourceGroupName, vmScaleSetNames, keyVaultUri)
+	if err != nil {
+		response.Reason = fmt.Sprintf("failed to connect to weka cluster: %v", err)
+		return
+	}
+
+	wekaStatus := protocol.WekaStatus{}
+	err = jpool.Call(weka.JrpcStatus, struct{}{}, &wekaStatus)
+	if err != nil {
+		logger.Error().Err(err).Send()
+		response.Reason = fmt.Sprintf("weka cluster is not reachable: %v", err)
+		return
+	}
+	response.IoStatus = wekaStatus.IoStatus
+	response.ActiveBackends = wekaStatus.Hosts.Backends.Active
+	response.TotalBackends = wekaStatus.Hosts.Backends.Total
+
+	if wekaStatus.IoStatus != "STARTED" {
+		response.Reason = fmt.Sprintf("io status is %s", wekaStatus.IoStatus)
+		return
+	}
+	if response.ActiveBackends*2 <= response.TotalBackends {
+		response.Reason = fmt.Sprintf("no quorum, %d of %d backends are active", response.ActiveBackends, response.TotalBackends)
+		return
+	}
+
+	response.Healthy = true
+	return
+}
+
+func Handler(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+
+	subscriptionId := common.Getenv(ctx, "SUBSCRIPTION_ID")
+	resourceGroupName := common.Getenv(ctx, "RESOURCE_GROUP_NAME")
+	stateContainerName := common.Getenv(ctx, "STATE_CONTAINER_NAME")
+	stateStorageName := common.Getenv(ctx, "STATE_STORAGE_NAME")
+	prefix := common.Getenv(ctx, "PREFIX")
+	clusterName := common.Getenv(ctx, "CLUSTER_NAME")
+	keyVaultUri := common.Getenv(ctx, "KEY_VAULT_URI")
+
+	logger := logging.LoggerFromCtx(ctx)
+
+	reqData, err := common.ParseInvokeRequest(r)
+	if err != nil {
+		logger.Error().Msg("Bad request")
+		common.WriteErrorResponse(w, http.StatusBadRequest, fmt.Errorf("cannot decode the request: %v", err))
+		return
+	}
+
+	var response HealthResponse
+	mode := getMode(reqData)
+	switch mode {
+	case ModeShallow:
+		response = HealthResponse{Mode: ModeShallow, Healthy: true}
+	case ModeDeep:
+		vmScaleSetNames := common.GetVmScaleSetNames(ctx, prefix, clusterName)
+		response = checkClusterHealth(ctx, subscriptionId, resourceGroupName, vmScaleSetNames, stateStorageName, stateContainerName, keyVaultUri)
+	default:
+		response = HealthResponse{Mode: mode, Reason: fmt.Sprintf("invalid mode %s, allowed modes: %s, %s", mode, ModeShallow, ModeDeep)}
+	}
+
+	// the status code of the http output binding is the one returned to the load balancer probe
+	if mode != ModeShallow && mode != ModeDeep {
+		common.WriteResponse(w, http.StatusBadRequest, response.Reason, response)
+		return
+	}
+	if !response.Healthy {
+		logger.Info().Msgf("cluster is unhealthy: %s", response.Reason)
+		common.WriteResponse(w, http.StatusServiceUnavailable, fmt.Sprintf("cluster is unhealthy: %s", response.Reason), response)
+		return
+	}
+	common.WriteResponse(w, http.StatusOK, "cluster is healthy", response)
+}
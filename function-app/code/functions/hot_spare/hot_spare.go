@@ -0,0 +1,176 @@
+package hot_spare
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"weka-deployment/common"
+	"weka-deployment/functions/status"
+
+	"github.com/weka/go-cloud-lib/lib/types"
+	"github.com/weka/go-cloud-lib/lib/weka"
+	"github.com/weka/go-cloud-lib/logging"
+	"github.com/weka/go-cloud-lib/protocol"
+)
+
+// same call as `weka cluster hot-spare`
+const JrpcClusterUpdate weka.JrpcMethod = "cluster_update"
+
+type HotspareResponse struct {
+	Hotspare        int `json:"hotspare"`
+	DesiredHotspare int `json:"desired_hotspare"`
+	Backends        int `json:"backends"`
+	StripeWidth     int `json:"stripe_width"`
+	ProtectionLevel int `json:"protection_level"`
+}
+
+type HotspareParams struct {
+	SubscriptionId     string
+	ResourceGroupName  string
+	VmScaleSetNames    []string
+	StateStorageName   string
+	StateContainerName string
+	KeyVaultUri        string
+}
+
+func getHotspare(ctx context.Context, p HotspareParams) (response HotspareResponse, err error) {
+	logger := logging.LoggerFromCtx(ctx)
+
+	state, err := common.ReadState(ctx, p.StateStorageName, p.StateContainerName)
+	if err != nil {
+		return
+	}
+	if !state.Clusterized {
+		err = fmt.Errorf("cluster is not clusterized yet")
+		return
+	}
+
+	settings, err := common.GetClusterSettings(ctx, p.StateStorageName, p.StateContainerName)
+	if err != nil {
+		return
+	}
+	// the hot spare set at clusterization until it is set post deployment
+	protection := settings.GetDataProtection(ctx)
+	response.DesiredHotspare = protection.Hotspare
+
+	vmsPrivateIps, err := common.GetScaleSetsVmsPrivateIps(ctx, p.SubscriptionId, p.ResourceGroupName, p.VmScaleSetNames)
+	if err != nil {
+		return
+	}
+	response.Backends = len(vmsPrivateIps)
+	response.StripeWidth = protection.StripeWidth
+	response.ProtectionLevel = protection.ProtectionLevel
+
+	jpool, err := status.GetScaleSetsJrpcPool(ctx, p.SubscriptionId, p.ResourceGroupName, p.VmScaleSetNames, p.KeyVaultUri)
+	if err != nil {
+		return
+	}
+	wekaStatus := protocol.WekaStatus{}
+	err = jpool.Call(weka.JrpcStatus, struct{}{}, &wekaStatus)
+	if err != nil {
+		logger.Error().Err(err).Send()
+		return
+	}
+	response.Hotspare = wekaStatus.HotSpare
+	return
+}
+
+// setHotspare updates the weka cluster hot spare and persists it, so it is validated by later resizes
+func setHotspare(ctx context.Context, p HotspareParams, hotspare int, plan *common.DryRunPlan) (response HotspareResponse, err error) {
+	logger := logging.LoggerFromCtx(ctx)
+
+	response, err = getHotspare(ctx, p)
+	if err != nil {
+		return
+	}
+	err = common.ValidateHotspare(hotspare, response.StripeWidth, response.ProtectionLevel, response.Backends)
+	if err != nil {
+		return
+	}
+
+	err = plan.Apply(ctx, fmt.Sprintf("set weka cluster hot spare to %d", hotspare), func() error {
+		jpool, jpoolErr := status.GetScaleSetsJrpcPool(ctx, p.SubscriptionId, p.ResourceGroupName, p.VmScaleSetNames, p.KeyVaultUri)
+		if jpoolErr != nil {
+			return jpoolErr
+		}
+		callErr := jpool.Call(JrpcClusterUpdate, types.JsonDict{"hot_spare": hotspare}, nil)
+		if callErr != nil {
+			logger.Error().Err(callErr).Send()
+		}
+		return callErr
+	})
+	if err != nil {
+		return
+	}
+
+	err = plan.Apply(ctx, fmt.Sprintf("persist desired hot spare %d", hotspare), func() error {
+		_, updateErr := common.UpdateClusterSettings(ctx, p.StateStorageName, p.StateContainerName, func(settings *common.ClusterSettings) error {
+			settings.Hotspare = &hotspare
+			return nil
+		})
+		return updateErr
+	})
+	if err != nil {
+		return
+	}
+
+	if !plan.Enabled() {
+		response.Hotspare = hotspare
+		response.DesiredHotspare = hotspare
+	}
+	return
+}
+
+func Handler(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	logger := logging.LoggerFromCtx(ctx)
+
+	reqData, err := common.ParseInvokeRequest(r)
+	if err != nil {
+		logger.Error().Msg("Bad request")
+		common.WriteErrorResponse(w, http.StatusBadRequest, fmt.Errorf("cannot decode the request: %v", err))
+		return
+	}
+
+	// an empty body queries the hot spare, {"value": N} sets it
+	var hotspare struct {
+		Value *int `json:"value"`
+	}
+	if body := common.GetRequestBody(reqData); body != "" {
+		if err = json.Unmarshal([]byte(body), &hotspare); err != nil {
+			logger.Error().Err(err).Msg("cannot unmarshal the request body")
+			common.WriteErrorResponse(w, http.StatusBadRequest, fmt.Errorf("cannot unmarshal the request body: %v", err))
+			return
+		}
+	}
+
+	p := HotspareParams{
+		SubscriptionId:     common.Getenv(ctx, "SUBSCRIPTION_ID"),
+		ResourceGroupName:  common.Getenv(ctx, "RESOURCE_GROUP_NAME"),
+		VmScaleSetNames:    common.GetVmScaleSetNames(ctx, common.Getenv(ctx, "PREFIX"), common.Getenv(ctx, "CLUSTER_NAME")),
+		StateStorageName:   common.Getenv(ctx, "STATE_STORAGE_NAME"),
+		StateContainerName: common.Getenv(ctx, "STATE_CONTAINER_NAME"),
+		KeyVaultUri:        common.Getenv(ctx, "KEY_VAULT_URI"),
+	}
+
+	var response HotspareResponse
+	var plan *common.DryRunPlan
+	if hotspare.Value == nil {
+		response, err = getHotspare(ctx, p)
+	} else {
+		logger.Info().Msgf("The requested hot spare is %d", *hotspare.Value)
+		if common.IsDryRun(reqData) {
+			plan = &common.DryRunPlan{}
+		}
+		response, err = setHotspare(ctx, p, *hotspare.Value, plan)
+	}
+
+	if err != nil {
+		common.WriteErrorResponse(w, common.GetErrorStatusCode(err), err)
+	} else if plan.Enabled() {
+		common.WriteResponse(w, http.StatusOK, "dry run", plan.Response(""))
+	} else {
+		common.WriteResponse(w, http.StatusOK, fmt.Sprintf("hot spare is %d", response.Hotspare), response)
+	}
+}
@@ -0,0 +1,149 @@
+package inventory
+
+import (
+	"context"
+	"net/http"
+	"sort"
+	"strings"
+	"weka-deployment/common"
+	"weka-deployment/functions/status"
+
+	"github.com/Azure/azure-sdk-for-go/sdk/resourcemanager/compute/armcompute"
+	"github.com/weka/go-cloud-lib/lib/weka"
+	"github.com/weka/go-cloud-lib/logging"
+)
+
+const (
+	JoinStatusJoined                 = "joined"
+	JoinStatusReadyForClusterization = "ready_for_clusterization"
+	JoinStatusPending                = "pending"
+)
+
+type WekaContainer struct {
+	Id     string `json:"id"`
+	Name   string `json:"name"`
+	Status string `json:"status"`
+}
+
+type BackendInventory struct {
+	InstanceId     string          `json:"instance_id"`
+	VmName         string          `json:"vm_name"`
+	PrivateIp      string          `json:"private_ip"`
+	PublicIp       string          `json:"public_ip,omitempty"`
+	WekaContainers []WekaContainer `json:"weka_containers"`
+	JoinStatus     string          `json:"join_status"`
+}
+
+type ClusterInventory struct {
+	Clusterized bool               `json:"clusterized"`
+	DesiredSize int                `json:"desired_size"`
+	Backends    []BackendInventory `json:"backends"`
+}
+
+// GetClusterInventory combines the scale set vms, the state blob and the weka containers into a single inventory,
+// weka containers are empty when the weka api is not reachable yet
+func GetClusterInventory(ctx context.Context, subscriptionId, resourceGroupName string, vmScaleSetNames []string, stateStorageName, stateContainerName, keyVaultUri string) (inventory ClusterInventory, err error) {
+	logger := logging.LoggerFromCtx(ctx)
+	logger.Info().Msg("fetching cluster inventory...")
+
+	state, err := common.ReadState(ctx, stateStorageName, stateContainerName)
+	if err != nil {
+		return
+	}
+	inventory.Clusterized = state.Clusterized
+	inventory.DesiredSize = state.DesiredSize
+
+	// the public ips are keyed by the instance id, which is only unique within a scale set
+	var vms []*armcompute.VirtualMachineScaleSetVM
+	publicIps := make(map[string]map[string]string)
+	for _, vmScaleSetName := range vmScaleSetNames {
+		var scaleSetVms []*armcompute.VirtualMachineScaleSetVM
+		scaleSetVms, err = common.GetScaleSetInstances(ctx, subscriptionId, resourceGroupName, vmScaleSetName, nil)
+		if err != nil {
+			return
+		}
+		vms = append(vms, scaleSetVms...)
+
+		if !common.IsPrivateNetwork(ctx) {
+			publicIps[vmScaleSetName], err = common.GetScaleSetVmsPublicIps(ctx, subscriptionId, resourceGroupName, vmScaleSetName)
+			if err != nil {
+				return
+			}
+		}
+	}
+
+	privateIps, err := common.GetScaleSetsVmsPrivateIps(ctx, subscriptionId, resourceGroupName, vmScaleSetNames)
+	if err != nil {
+		return
+	}
+
+	// state instances are "<vm name>:<host name>[:<public ip>]"
+	readyForClusterization := make(map[string]bool)
+	for _, instance := range state.Instances {
+		readyForClusterization[strings.Split(instance, ":")[0]] = true
+	}
+
+	containersByIp := make(map[string][]WekaContainer)
+	if state.Clusterized {
+		hosts := weka.HostListResponse{}
+		jpool, jpoolErr := status.GetScaleSetsJrpcPool(ctx, subscriptionId, resourceGroupName, vmScaleSetNames, keyVaultUri)
+		if jpoolErr == nil {
+			jpoolErr = jpool.Call(weka.JrpcHostList, struct{}{}, &hosts)
+		}
+		if jpoolErr != nil {
+			logger.Error().Err(jpoolErr).Msg("failed to list weka containers")
+		}
+		for hostId, host := range hosts {
+			containersByIp[host.HostIp] = append(containersByIp[host.HostIp], WekaContainer{
+				Id:     hostId.String(),
+				Name:   host.ContainerName,
+				Status: host.Status,
+			})
+		}
+	}
+
+	for _, vm := range vms {
+		instanceId := common.GetScaleSetVmId(*vm.ID)
+		vmName := *vm.Name
+		privateIp := privateIps[vmName]
+
+		backend := BackendInventory{
+			InstanceId:     instanceId,
+			VmName:         vmName,
+			PrivateIp:      privateIp,
+			PublicIp:       publicIps[common.GetVmScaleSetNameFromVmName(vmName)][instanceId],
+			WekaContainers: containersByIp[privateIp],
+			JoinStatus:     JoinStatusPending,
+		}
+		sort.Slice(backend.WekaContainers, func(i, j int) bool {
+			return backend.WekaContainers[i].Name < backend.WekaContainers[j].Name
+		})
+		if len(backend.WekaContainers) > 0 {
+			backend.JoinStatus = JoinStatusJoined
+		} else if readyForClusterization[vmName] {
+			backend.JoinStatus = JoinStatusReadyForClusterization
+		}
+		inventory.Backends = append(inventory.Backends, backend)
+	}
+	return
+}
+
+func Handler(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	stateContainerName := common.Getenv(ctx, "STATE_CONTAINER_NAME")
+	stateStorageName := common.Getenv(ctx, "STATE_STORAGE_NAME")
+	subscriptionId := common.Getenv(ctx, "SUBSCRIPTION_ID")
+	resourceGroupName := common.Getenv(ctx, "RESOURCE_GROUP_NAME")
+	prefix := common.Getenv(ctx, "PREFIX")
+	clusterName := common.Getenv(ctx, "CLUSTER_NAME")
+	keyVaultUri := common.Getenv(ctx, "KEY_VAULT_URI")
+
+	vmScaleSetNames := common.GetVmScaleSetNames(ctx, prefix, clusterName)
+
+	inventory, err := GetClusterInventory(ctx, subscriptionId, resourceGroupName, vmScaleSetNames, stateStorageName, stateContainerName, keyVaultUri)
+	if err != nil {
+		common.WriteErrorResponse(w, common.GetErrorStatusCode(err), err)
+		return
+	}
+	common.WriteResponse(w, http.StatusOK, "cluster inventory", inventory)
+}
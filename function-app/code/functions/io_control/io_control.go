@@ -0,0 +1,184 @@
+package io_control
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+	"weka-deployment/common"
+	"weka-deployment/functions/azure_functions_def"
+	"weka-deployment/functions/clusterize"
+
+	"github.com/weka/go-cloud-lib/functions_def"
+	"github.com/weka/go-cloud-lib/logging"
+)
+
+var errNotClusterized = errors.New("cluster is not clusterized yet")
+
+type RequestBody struct {
+	// returns the status of the last io stop or start without changing it
+	Status bool `json:"status"`
+}
+
+type IoControlParams struct {
+	SubscriptionId     string
+	ResourceGroupName  string
+	StateStorageName   string
+	StateContainerName string
+	KeyVaultUri        string
+	FunctionAppName    string
+	Prefix             string
+	ClusterName        string
+}
+
+func getIoControlParams(ctx context.Context) IoControlParams {
+	return IoControlParams{
+		SubscriptionId:     common.Getenv(ctx, "SUBSCRIPTION_ID"),
+		ResourceGroupName:  common.Getenv(ctx, "RESOURCE_GROUP_NAME"),
+		StateStorageName:   common.Getenv(ctx, "STATE_STORAGE_NAME"),
+		StateContainerName: common.Getenv(ctx, "STATE_CONTAINER_NAME"),
+		KeyVaultUri:        common.Getenv(ctx, "KEY_VAULT_URI"),
+		FunctionAppName:    common.Getenv(ctx, "FUNCTION_APP_NAME"),
+		Prefix:             common.Getenv(ctx, "PREFIX"),
+		ClusterName:        common.Getenv(ctx, "CLUSTER_NAME"),
+	}
+}
+
+// setIoMaintenanceMode enables the maintenance mode before the io is stopped, so scale up and repair don't replace the
+// stopped backends and joining instances wait, a maintenance mode enabled by hand is kept as is
+func setIoMaintenanceMode(ctx context.Context, p IoControlParams) (maintenanceSet bool, err error) {
+	_, err = common.UpdateClusterSettings(ctx, p.StateStorageName, p.StateContainerName, func(settings *common.ClusterSettings) error {
+		if settings.IsMaintenanceModeEnabled() {
+			return nil
+		}
+		settings.Maintenance = &common.MaintenanceMode{
+			Enabled:   true,
+			Reason:    common.IoStoppedMaintenanceReason,
+			UpdatedAt: time.Now().UTC(),
+		}
+		maintenanceSet = true
+		return nil
+	})
+	return
+}
+
+// runIoControl starts the io control script on all the backends, an io already stopped isn't stopped again and an io
+// already running isn't started again, a failed or interrupted run can be run again
+func runIoControl(ctx context.Context, p IoControlParams, action string, plan *common.DryRunPlan) (status common.IoControlStatus, err error) {
+	logger := logging.LoggerFromCtx(ctx)
+
+	state, err := common.ReadState(ctx, p.StateStorageName, p.StateContainerName)
+	if err != nil {
+		return
+	}
+	if !state.Clusterized {
+		err = errNotClusterized
+		return
+	}
+	status, err = common.GetIoControlStatus(ctx, p.StateStorageName, p.StateContainerName)
+	if err != nil {
+		return
+	}
+	if (action == common.IoActionStop && status.Status == common.IoStatusStopped) || (action == common.IoActionStart && status.Status == common.IoStatusRunning) {
+		logger.Info().Msgf("cluster io is already %s", status.Status)
+		return
+	}
+
+	functionAppKey, err := common.GetKeyVaultValue(ctx, p.KeyVaultUri, "function-app-default-key")
+	if err != nil {
+		return
+	}
+	funcDef := azure_functions_def.NewFuncDef(ctx, common.GetFunctionAppBaseUrl(p.FunctionAppName), functionAppKey)
+	script := clusterize.GetIoControlScript(funcDef.GetFunctionCmdDefinition(functions_def.Report), action)
+
+	err = plan.Apply(ctx, fmt.Sprintf("%s the cluster io and the containers of all the backends", action), func() (applyErr error) {
+		// the maintenance mode set by a previous stop is kept until the io is started
+		maintenanceSet := status.MaintenanceSet
+		if action == common.IoActionStop {
+			var set bool
+			set, applyErr = setIoMaintenanceMode(ctx, p)
+			if applyErr != nil {
+				return
+			}
+			maintenanceSet = maintenanceSet || set
+		}
+		_, applyErr = common.StartIoControlRun(ctx, p.StateStorageName, p.StateContainerName, action, maintenanceSet)
+		if applyErr != nil {
+			return
+		}
+
+		leader, started, failed, startErr := common.StartAllBackendsScript(
+			ctx, p.SubscriptionId, p.ResourceGroupName, p.StateStorageName, p.StateContainerName, p.KeyVaultUri, p.Prefix, p.ClusterName, script,
+		)
+		status, applyErr = common.SetIoControlRunBackends(ctx, p.StateStorageName, p.StateContainerName, leader, started, failed)
+		if applyErr == nil && startErr != nil {
+			applyErr = startErr
+			_, _ = common.UpdateIoControlStatus(ctx, p.StateStorageName, p.StateContainerName, func(s *common.IoControlStatus) {
+				s.Status = common.IoStatusFailed
+				s.Message = startErr.Error()
+			})
+		}
+		return
+	})
+	return
+}
+
+func handle(w http.ResponseWriter, r *http.Request, action string) {
+	ctx := r.Context()
+	logger := logging.LoggerFromCtx(ctx)
+
+	p := getIoControlParams(ctx)
+
+	reqData, err := common.ParseInvokeRequest(r)
+	if err != nil {
+		logger.Error().Msg("Bad request")
+		common.WriteErrorResponse(w, http.StatusBadRequest, fmt.Errorf("cannot decode the request: %v", err))
+		return
+	}
+
+	var data RequestBody
+	if body := common.GetRequestBody(reqData); body != "" {
+		if err = json.Unmarshal([]byte(body), &data); err != nil {
+			logger.Error().Err(err).Msg("cannot unmarshal the request body")
+			common.WriteErrorResponse(w, http.StatusBadRequest, fmt.Errorf("cannot unmarshal the request body: %v", err))
+			return
+		}
+	}
+
+	if data.Status {
+		status, err := common.GetIoControlStatus(ctx, p.StateStorageName, p.StateContainerName)
+		if err != nil {
+			common.WriteErrorResponse(w, http.StatusInternalServerError, err)
+			return
+		}
+		common.WriteResponse(w, http.StatusOK, fmt.Sprintf("cluster io is %s", status.Status), status)
+		return
+	}
+
+	var plan *common.DryRunPlan
+	if common.IsDryRun(reqData) {
+		plan = &common.DryRunPlan{}
+	}
+	status, err := runIoControl(ctx, p, action, plan)
+	if errors.Is(err, errNotClusterized) {
+		common.WriteErrorResponse(w, http.StatusConflict, err)
+	} else if err != nil {
+		common.WriteErrorResponse(w, common.GetErrorStatusCode(err), err)
+	} else if plan.Enabled() {
+		common.WriteResponse(w, http.StatusOK, "dry run", plan.Response(""))
+	} else {
+		common.WriteResponse(w, http.StatusOK, fmt.Sprintf("cluster io is %s", status.Status), status)
+	}
+}
+
+// StopHandler stops the cluster io and then the weka containers of all the backends, the vms keep running
+func StopHandler(w http.ResponseWriter, r *http.Request) {
+	handle(w, r, common.IoActionStop)
+}
+
+// StartHandler starts the weka containers of all the backends and then the cluster io
+func StartHandler(w http.ResponseWriter, r *http.Request) {
+	handle(w, r, common.IoActionStart)
+}
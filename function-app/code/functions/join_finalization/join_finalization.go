@@ -1,11 +1,12 @@
 package join_finalization
 
 import (
+	"context"
 	"encoding/json"
 	"fmt"
 	"github.com/weka/go-cloud-lib/logging"
 	"net/http"
-	"os"
+	"strconv"
 	"weka-deployment/common"
 )
 
@@ -13,53 +14,96 @@ type RequestBody struct {
 	Name string `json:"name"`
 }
 
-func Handler(w http.ResponseWriter, r *http.Request) {
-	outputs := make(map[string]interface{})
-	resData := make(map[string]interface{})
+// publishScaleUpCompleted publishes the scale up completion when the joined vm is the last one the desired size
+// waits for, the joined vms are the protected ones
+func publishScaleUpCompleted(ctx context.Context, subscriptionId, resourceGroupName, stateStorageName, stateContainerName, vmScaleSetName, vmName string) {
+	logger := logging.LoggerFromCtx(ctx)
 
-	var invokeRequest common.InvokeRequest
+	state, err := common.ReadState(ctx, stateStorageName, stateContainerName)
+	if err != nil || !state.Clusterized {
+		return
+	}
+	vms, err := common.GetScaleSetInstances(ctx, subscriptionId, resourceGroupName, vmScaleSetName, nil)
+	if err != nil {
+		logger.Error().Err(err).Msg("failed to count the joined vms")
+		return
+	}
+	joined := 0
+	for _, vm := range vms {
+		if vm.Properties == nil {
+			continue
+		}
+		policy := vm.Properties.ProtectionPolicy
+		if policy != nil && policy.ProtectFromScaleIn != nil && *policy.ProtectFromScaleIn {
+			joined++
+		}
+	}
+	if joined == state.DesiredSize {
+		common.PublishLifecycleEvent(ctx, common.LifecycleEventScaleUpCompleted, vmName, map[string]string{
+			"size": strconv.Itoa(joined),
+		})
+	}
+}
 
-	ctx := r.Context()
+// registerBackendDnsRecord registers the private dns record of the joined vm, the clients resolve the backends by it
+func registerBackendDnsRecord(ctx context.Context, subscriptionId, resourceGroupName, vmScaleSetName, vmName string) {
 	logger := logging.LoggerFromCtx(ctx)
 
-	d := json.NewDecoder(r.Body)
-	err := d.Decode(&invokeRequest)
+	vmsPrivateIps, err := common.GetVmsPrivateIps(ctx, subscriptionId, resourceGroupName, vmScaleSetName)
+	if err == nil {
+		ip, ok := vmsPrivateIps[vmName]
+		if !ok {
+			err = fmt.Errorf("private ip of %s not found", vmName)
+		} else {
+			err = common.RegisterBackendDnsRecords(ctx, map[string]string{vmName: ip})
+		}
+	}
 	if err != nil {
-		logger.Error().Msg("Bad request")
-		return
+		logger.Error().Err(err).Msgf("failed to register the dns record of %s", vmName)
 	}
+}
+
+func Handler(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	logger := logging.LoggerFromCtx(ctx)
 
-	var reqData map[string]interface{}
-	err = json.Unmarshal(invokeRequest.Data["req"], &reqData)
+	reqData, err := common.ParseInvokeRequest(r)
 	if err != nil {
 		logger.Error().Msg("Bad request")
+		common.WriteErrorResponse(w, http.StatusBadRequest, fmt.Errorf("cannot decode the request: %v", err))
 		return
 	}
 
 	var data RequestBody
-
-	if json.Unmarshal([]byte(reqData["Body"].(string)), &data) != nil {
+	if err = json.Unmarshal([]byte(common.GetRequestBody(reqData)), &data); err != nil {
 		logger.Error().Msg("Bad request")
+		common.WriteErrorResponse(w, http.StatusBadRequest, fmt.Errorf("cannot unmarshal the request body: %v", err))
 		return
 	}
 
-	subscriptionId := os.Getenv("SUBSCRIPTION_ID")
-	resourceGroupName := os.Getenv("RESOURCE_GROUP_NAME")
-	prefix := os.Getenv("PREFIX")
-	clusterName := os.Getenv("CLUSTER_NAME")
-	vmScaleSetName := fmt.Sprintf("%s-%s-vmss", prefix, clusterName)
+	subscriptionId := common.Getenv(ctx, "SUBSCRIPTION_ID")
+	resourceGroupName := common.Getenv(ctx, "RESOURCE_GROUP_NAME")
+	stateContainerName := common.Getenv(ctx, "STATE_CONTAINER_NAME")
+	stateStorageName := common.Getenv(ctx, "STATE_STORAGE_NAME")
+	vmScaleSetName := common.GetVmScaleSetNameFromVmName(data.Name)
+
+	protectErr := common.SetDeletionProtection(ctx, subscriptionId, resourceGroupName, vmScaleSetName, common.GetScaleSetVmIndex(data.Name), true)
 
-	err = common.SetDeletionProtection(ctx, subscriptionId, resourceGroupName, vmScaleSetName, common.GetScaleSetVmIndex(data.Name), true)
+	// a vm joining after a spot eviction is the replacement capacity of the evicted vm
+	replaced, err := common.ReplaceEvictedInstance(ctx, stateStorageName, stateContainerName, data.Name)
 	if err != nil {
-		resData["body"] = err.Error()
-	} else {
-		resData["body"] = "set protection successfully"
+		logger.Error().Err(err).Msg("failed to update evictions")
+	} else if replaced != "" {
+		logger.Info().Msgf("vm %s replaced evicted vm %s", data.Name, replaced)
 	}
-	outputs["res"] = resData
-	invokeResponse := common.InvokeResponse{Outputs: outputs, Logs: nil, ReturnValue: nil}
-
-	responseJson, _ := json.Marshal(invokeResponse)
 
-	w.Header().Set("Content-Type", "application/json")
-	w.Write(responseJson)
+	if protectErr != nil {
+		common.WriteErrorResponse(w, http.StatusInternalServerError, protectErr)
+		return
+	}
+	if common.IsBackendDnsEnabled(ctx) {
+		registerBackendDnsRecord(ctx, subscriptionId, resourceGroupName, vmScaleSetName, data.Name)
+	}
+	publishScaleUpCompleted(ctx, subscriptionId, resourceGroupName, stateStorageName, stateContainerName, vmScaleSetName, data.Name)
+	common.WriteResponse(w, http.StatusOK, "set protection successfully", nil)
 }
@@ -0,0 +1,92 @@
+package maintenance_mode
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+	"weka-deployment/common"
+
+	"github.com/weka/go-cloud-lib/logging"
+)
+
+type RequestBody struct {
+	Enabled *bool  `json:"enabled"`
+	Reason  string `json:"reason"`
+}
+
+func getMaintenanceMode(ctx context.Context, stateStorageName, stateContainerName string) (maintenance common.MaintenanceMode, err error) {
+	settings, err := common.GetClusterSettings(ctx, stateStorageName, stateContainerName)
+	if err != nil {
+		return
+	}
+	if settings.Maintenance != nil {
+		maintenance = *settings.Maintenance
+	}
+	return
+}
+
+// setMaintenanceMode persists the toggle, clusterize and deploy make the joining instances wait and
+// scale up and repair skip while it is enabled
+func setMaintenanceMode(ctx context.Context, stateStorageName, stateContainerName string, enabled bool, reason string, plan *common.DryRunPlan) (maintenance common.MaintenanceMode, err error) {
+	maintenance = common.MaintenanceMode{
+		Enabled:   enabled,
+		Reason:    reason,
+		UpdatedAt: time.Now().UTC(),
+	}
+
+	err = plan.Apply(ctx, fmt.Sprintf("set maintenance mode enabled to %t", enabled), func() error {
+		_, updateErr := common.UpdateClusterSettings(ctx, stateStorageName, stateContainerName, func(settings *common.ClusterSettings) error {
+			settings.Maintenance = &maintenance
+			return nil
+		})
+		return updateErr
+	})
+	return
+}
+
+func Handler(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	stateContainerName := common.Getenv(ctx, "STATE_CONTAINER_NAME")
+	stateStorageName := common.Getenv(ctx, "STATE_STORAGE_NAME")
+
+	logger := logging.LoggerFromCtx(ctx)
+
+	reqData, err := common.ParseInvokeRequest(r)
+	if err != nil {
+		logger.Error().Msg("Bad request")
+		common.WriteErrorResponse(w, http.StatusBadRequest, fmt.Errorf("cannot decode the request: %v", err))
+		return
+	}
+
+	// an empty body queries the maintenance mode, {"enabled": true, "reason": "..."} toggles it
+	var data RequestBody
+	if body := common.GetRequestBody(reqData); body != "" {
+		if err = json.Unmarshal([]byte(body), &data); err != nil {
+			logger.Error().Err(err).Msg("cannot unmarshal the request body")
+			common.WriteErrorResponse(w, http.StatusBadRequest, fmt.Errorf("cannot unmarshal the request body: %v", err))
+			return
+		}
+	}
+
+	var maintenance common.MaintenanceMode
+	var plan *common.DryRunPlan
+	if data.Enabled == nil {
+		maintenance, err = getMaintenanceMode(ctx, stateStorageName, stateContainerName)
+	} else {
+		logger.Info().Msgf("Setting maintenance mode enabled to %t: %s", *data.Enabled, data.Reason)
+		if common.IsDryRun(reqData) {
+			plan = &common.DryRunPlan{}
+		}
+		maintenance, err = setMaintenanceMode(ctx, stateStorageName, stateContainerName, *data.Enabled, data.Reason, plan)
+	}
+
+	if err != nil {
+		common.WriteErrorResponse(w, http.StatusInternalServerError, err)
+	} else if plan.Enabled() {
+		common.WriteResponse(w, http.StatusOK, "dry run", plan.Response(""))
+	} else {
+		common.WriteResponse(w, http.StatusOK, fmt.Sprintf("maintenance mode enabled: %t", maintenance.Enabled), maintenance)
+	}
+}
@@ -0,0 +1,93 @@
+package maintenance_window
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+	"weka-deployment/common"
+
+	"github.com/lithammer/dedent"
+	"github.com/weka/go-cloud-lib/logging"
+)
+
+type RequestBody struct {
+	StartTime string   `json:"start_time"`
+	EndTime   string   `json:"end_time"`
+	Alerts    []string `json:"alerts"`
+}
+
+func validateMaintenanceWindow(data RequestBody) error {
+	if len(data.Alerts) == 0 {
+		return errors.New("at least one alert type is required")
+	}
+	startTime, err := time.Parse(time.RFC3339, data.StartTime)
+	if err != nil {
+		return fmt.Errorf("invalid start_time, expected RFC3339: %w", err)
+	}
+	endTime, err := time.Parse(time.RFC3339, data.EndTime)
+	if err != nil {
+		return fmt.Errorf("invalid end_time, expected RFC3339: %w", err)
+	}
+	if !endTime.After(startTime) {
+		return errors.New("end_time must be after start_time")
+	}
+	return nil
+}
+
+// shellQuote single quotes the value for bash, the request values are never expanded by the script
+func shellQuote(value string) string {
+	return "'" + strings.ReplaceAll(value, "'", `'\''`) + "'"
+}
+
+// GetWekaAzureMaintenanceModeScript suppresses the given alerts for the maintenance window
+func GetWekaAzureMaintenanceModeScript(startTime, endTime string, suppressedAlerts []string) string {
+	template := `
+	#!/bin/bash
+	set -ex
+	MAINTENANCE_START=%s
+	MAINTENANCE_END=%s
+	SUPPRESSED_ALERTS=(%s)
+
+	for alert in "${SUPPRESSED_ALERTS[@]}"; do
+		weka alerts suppress create "$alert" --from "$MAINTENANCE_START" --to "$MAINTENANCE_END"
+	done
+	echo "suppressed ${SUPPRESSED_ALERTS[*]} from $MAINTENANCE_START to $MAINTENANCE_END"
+	`
+	quotedAlerts := make([]string, len(suppressedAlerts))
+	for i, alert := range suppressedAlerts {
+		quotedAlerts[i] = shellQuote(alert)
+	}
+	return fmt.Sprintf(dedent.Dedent(template), shellQuote(startTime), shellQuote(endTime), strings.Join(quotedAlerts, " "))
+}
+
+func Handler(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	logger := logging.LoggerFromCtx(ctx)
+
+	reqData, err := common.ParseInvokeRequest(r)
+	if err != nil {
+		logger.Error().Msg("Bad request")
+		common.WriteErrorResponse(w, http.StatusBadRequest, fmt.Errorf("cannot decode the request: %v", err))
+		return
+	}
+
+	var data RequestBody
+	if err = json.Unmarshal([]byte(common.GetRequestBody(reqData)), &data); err != nil {
+		logger.Error().Msg("Bad request")
+		common.WriteErrorResponse(w, http.StatusBadRequest, fmt.Errorf("wrong request format: %v", err))
+		return
+	}
+
+	err = validateMaintenanceWindow(data)
+	if err != nil {
+		logger.Error().Err(err).Send()
+		common.WriteErrorResponse(w, http.StatusBadRequest, err)
+		return
+	}
+
+	logger.Info().Msgf("Generating maintenance window script from %s to %s", data.StartTime, data.EndTime)
+	common.WriteResponse(w, http.StatusOK, "maintenance window script generated", GetWekaAzureMaintenanceModeScript(data.StartTime, data.EndTime, data.Alerts))
+}
@@ -0,0 +1,175 @@
+package metrics
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"weka-deployment/common"
+	"weka-deployment/functions/status"
+
+	"github.com/weka/go-cloud-lib/lib/weka"
+	"github.com/weka/go-cloud-lib/logging"
+	"github.com/weka/go-cloud-lib/protocol"
+)
+
+// prometheus text exposition format
+const contentType = "text/plain; version=0.0.4; charset=utf-8"
+
+type metric struct {
+	name  string
+	help  string
+	value float64
+}
+
+// weka status fields which are not part of protocol.WekaStatus, the activity is averaged by weka over the last seconds
+type activityStatus struct {
+	Activity struct {
+		NumOps           float64 `json:"num_ops"`
+		NumReads         float64 `json:"num_reads"`
+		NumWrites        float64 `json:"num_writes"`
+		SumBytesRead     float64 `json:"sum_bytes_read"`
+		SumBytesWritten  float64 `json:"sum_bytes_written"`
+		ObsUploadBytes   float64 `json:"obs_upload_bytes_per_second"`
+		ObsDownloadBytes float64 `json:"obs_download_bytes_per_second"`
+	} `json:"activity"`
+	Rebuild struct {
+		ProgressPercent float64 `json:"progressPercent"`
+		ProtectionState []struct {
+			MiB         float64 `json:"MiB"`
+			NumFailures int     `json:"numFailures"`
+		} `json:"protectionState"`
+	} `json:"rebuild"`
+}
+
+func boolValue(value bool) float64 {
+	if value {
+		return 1
+	}
+	return 0
+}
+
+func upMetric(up bool) metric {
+	return metric{"weka_up", "Whether the weka cluster could be queried", boolValue(up)}
+}
+
+// getMetrics returns weka_up 0 instead of an error when the cluster can't be queried, so scrapes keep succeeding
+func getMetrics(ctx context.Context, subscriptionId, resourceGroupName string, vmScaleSetNames []string, stateStorageName, stateContainerName, keyVaultUri string) (metrics []metric) {
+	logger := logging.LoggerFromCtx(ctx)
+
+	state, err := common.ReadState(ctx, stateStorageName, stateContainerName)
+	if err != nil {
+		return []metric{upMetric(false)}
+	}
+	metrics = append(metrics,
+		metric{"weka_clusterized", "Whether the weka cluster was clusterized", boolValue(state.Clusterized)},
+		metric{"weka_backends_desired", "Desired number of backend instances", float64(state.DesiredSize)},
+	)
+	if !state.Clusterized {
+		return append(metrics, upMetric(false))
+	}
+
+	jpool, err := status.GetScaleSetsJrpcPool(ctx, subscriptionId, resourceGroupName, vmScaleSetNames, keyVaultUri)
+	if err != nil {
+		return append(metrics, upMetric(false))
+	}
+	var rawWekaStatus json.RawMessage
+	err = jpool.Call(weka.JrpcStatus, struct{}{}, &rawWekaStatus)
+	if err != nil {
+		logger.Error().Err(err).Send()
+		return append(metrics, upMetric(false))
+	}
+	wekaStatus := protocol.WekaStatus{}
+	activity := activityStatus{}
+	if err = json.Unmarshal(rawWekaStatus, &wekaStatus); err == nil {
+		err = json.Unmarshal(rawWekaStatus, &activity)
+	}
+	if err != nil {
+		logger.Error().Err(err).Send()
+		return append(metrics, upMetric(false))
+	}
+
+	rebuilding := false
+	for _, protectionState := range activity.Rebuild.ProtectionState {
+		if protectionState.NumFailures > 0 && protectionState.MiB > 0 {
+			rebuilding = true
+		}
+	}
+
+	return append(metrics,
+		upMetric(true),
+		metric{"weka_io_started", "Whether the weka cluster io is started", boolValue(wekaStatus.IoStatus == "STARTED")},
+		metric{"weka_backends_active", "Number of active backend containers", float64(wekaStatus.Hosts.Backends.Active)},
+		metric{"weka_backends_total", "Number of backend containers", float64(wekaStatus.Hosts.Backends.Total)},
+		metric{"weka_clients_active", "Number of active client containers", float64(wekaStatus.Hosts.Clients.Active)},
+		metric{"weka_drives_active", "Number of active drives", float64(wekaStatus.Drives.Active)},
+		metric{"weka_drives_total", "Number of drives", float64(wekaStatus.Drives.Total)},
+		metric{"weka_hot_spare", "Number of hot spare failure domains", float64(wekaStatus.HotSpare)},
+		metric{"weka_active_alerts", "Number of active alerts", float64(wekaStatus.ActiveAlertsCount)},
+		metric{"weka_capacity_total_bytes", "Total capacity", float64(wekaStatus.Capacity.TotalBytes)},
+		metric{"weka_capacity_hot_spare_bytes", "Capacity reserved for the hot spare", float64(wekaStatus.Capacity.HotSpareBytes)},
+		metric{"weka_capacity_unprovisioned_bytes", "Capacity not provisioned to filesystems", float64(wekaStatus.Capacity.UnprovisionedBytes)},
+		metric{"weka_ops_per_second", "Operations per second", activity.Activity.NumOps},
+		metric{"weka_read_ops_per_second", "Read operations per second", activity.Activity.NumReads},
+		metric{"weka_write_ops_per_second", "Write operations per second", activity.Activity.NumWrites},
+		metric{"weka_read_bytes_per_second", "Read throughput", activity.Activity.SumBytesRead},
+		metric{"weka_write_bytes_per_second", "Write throughput", activity.Activity.SumBytesWritten},
+		metric{"weka_obs_upload_bytes_per_second", "Object store upload throughput", activity.Activity.ObsUploadBytes},
+		metric{"weka_obs_download_bytes_per_second", "Object store download throughput", activity.Activity.ObsDownloadBytes},
+		metric{"weka_rebuilding", "Whether the weka cluster is rebuilding", boolValue(rebuilding)},
+		metric{"weka_rebuild_progress_percent", "Rebuild progress", activity.Rebuild.ProgressPercent},
+	)
+}
+
+// formatMetrics renders the metrics as gauges in the prometheus text exposition format
+func formatMetrics(metrics []metric, clusterName string) string {
+	labels := fmt.Sprintf("{cluster=%q}", clusterName)
+
+	var sb strings.Builder
+	for _, m := range metrics {
+		sb.WriteString(fmt.Sprintf("# HELP %s %s\n", m.name, m.help))
+		sb.WriteString(fmt.Sprintf("# TYPE %s gauge\n", m.name))
+		sb.WriteString(fmt.Sprintf("%s%s %s\n", m.name, labels, strconv.FormatFloat(m.value, 'g', -1, 64)))
+	}
+	return sb.String()
+}
+
+func Handler(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	outputs := make(map[string]interface{})
+	resData := make(map[string]interface{})
+
+	subscriptionId := common.Getenv(ctx, "SUBSCRIPTION_ID")
+	resourceGroupName := common.Getenv(ctx, "RESOURCE_GROUP_NAME")
+	stateContainerName := common.Getenv(ctx, "STATE_CONTAINER_NAME")
+	stateStorageName := common.Getenv(ctx, "STATE_STORAGE_NAME")
+	prefix := common.Getenv(ctx, "PREFIX")
+	clusterName := common.Getenv(ctx, "CLUSTER_NAME")
+	keyVaultUri := common.Getenv(ctx, "KEY_VAULT_URI")
+
+	logger := logging.LoggerFromCtx(ctx)
+
+	if _, err := common.ParseInvokeRequest(r); err != nil {
+		logger.Error().Msg("Bad request")
+		common.WriteErrorResponse(w, http.StatusBadRequest, fmt.Errorf("cannot decode the request: %v", err))
+		return
+	}
+
+	vmScaleSetNames := common.GetVmScaleSetNames(ctx, prefix, clusterName)
+	metrics := getMetrics(ctx, subscriptionId, resourceGroupName, vmScaleSetNames, stateStorageName, stateContainerName, keyVaultUri)
+
+	// the scrapers expect the prometheus text format, not the json response of the other functions
+	resData["statusCode"] = http.StatusOK
+	resData["headers"] = map[string]string{"Content-Type": contentType}
+	resData["body"] = formatMetrics(metrics, clusterName)
+
+	outputs["res"] = resData
+	invokeResponse := common.InvokeResponse{Outputs: outputs, Logs: nil, ReturnValue: nil}
+
+	responseJson, _ := json.Marshal(invokeResponse)
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(responseJson)
+}
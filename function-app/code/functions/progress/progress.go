@@ -0,0 +1,19 @@
+package progress
+
+import (
+	"net/http"
+	"weka-deployment/common"
+)
+
+func Handler(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	stateContainerName := common.Getenv(ctx, "STATE_CONTAINER_NAME")
+	stateStorageName := common.Getenv(ctx, "STATE_STORAGE_NAME")
+
+	progress, err := common.GetDeploymentProgress(ctx, stateStorageName, stateContainerName)
+	if err != nil {
+		common.WriteErrorResponse(w, http.StatusInternalServerError, err)
+		return
+	}
+	common.WriteResponse(w, http.StatusOK, "deployment progress", progress)
+}
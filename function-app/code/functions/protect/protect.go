@@ -2,8 +2,8 @@ package protect
 
 import (
 	"encoding/json"
+	"fmt"
 	"net/http"
-	"os"
 	"strings"
 	"time"
 	"weka-deployment/common"
@@ -16,44 +16,31 @@ type RequestBody struct {
 }
 
 func Handler(w http.ResponseWriter, r *http.Request) {
-	subscriptionId := os.Getenv("SUBSCRIPTION_ID")
-	resourceGroupName := os.Getenv("RESOURCE_GROUP_NAME")
-	stateContainerName := os.Getenv("STATE_CONTAINER_NAME")
-	stateStorageName := os.Getenv("STATE_STORAGE_NAME")
-	prefix := os.Getenv("PREFIX")
-	clusterName := os.Getenv("CLUSTER_NAME")
-
-	outputs := make(map[string]interface{})
-	resData := make(map[string]interface{})
-	var invokeRequest common.InvokeRequest
-
 	ctx := r.Context()
-	logger := logging.LoggerFromCtx(ctx)
+	subscriptionId := common.Getenv(ctx, "SUBSCRIPTION_ID")
+	resourceGroupName := common.Getenv(ctx, "RESOURCE_GROUP_NAME")
+	stateContainerName := common.Getenv(ctx, "STATE_CONTAINER_NAME")
+	stateStorageName := common.Getenv(ctx, "STATE_STORAGE_NAME")
 
-	d := json.NewDecoder(r.Body)
-	err := d.Decode(&invokeRequest)
-	if err != nil {
-		logger.Error().Msg("Bad request")
-		return
-	}
+	logger := logging.LoggerFromCtx(ctx)
 
-	var reqData map[string]interface{}
-	err = json.Unmarshal(invokeRequest.Data["req"], &reqData)
+	reqData, err := common.ParseInvokeRequest(r)
 	if err != nil {
 		logger.Error().Msg("Bad request")
+		common.WriteErrorResponse(w, http.StatusBadRequest, fmt.Errorf("cannot decode the request: %v", err))
 		return
 	}
 
 	var data RequestBody
-
-	if json.Unmarshal([]byte(reqData["Body"].(string)), &data) != nil {
+	if json.Unmarshal([]byte(common.GetRequestBody(reqData)), &data) != nil || !strings.Contains(data.Vm, ":") {
 		logger.Error().Msg("Bad request")
+		common.WriteErrorResponse(w, http.StatusBadRequest, fmt.Errorf("wrong request format. 'vm' is required as <vm name>:<hostname>"))
 		return
 	}
 
-	vmScaleSetName := common.GetVmScaleSetName(prefix, clusterName)
-
 	instanceName := strings.Split(data.Vm, ":")[0]
+	// instances of zonal deployments belong to a scale set per zone
+	vmScaleSetName := common.GetVmScaleSetNameFromVmName(instanceName)
 	hostName := strings.Split(data.Vm, ":")[1]
 	instanceId := common.GetScaleSetVmIndex(instanceName)
 
@@ -62,16 +49,8 @@ func Handler(w http.ResponseWriter, r *http.Request) {
 
 	err = common.RetrySetDeletionProtectionAndReport(ctx, subscriptionId, resourceGroupName, stateContainerName, stateStorageName, vmScaleSetName, instanceId, hostName, maxAttempts, authSleepInterval)
 	if err != nil {
-		w.WriteHeader(http.StatusInternalServerError)
-		resData["body"] = err.Error()
-	} else {
-		resData["body"] = "protection was set successfully"
+		common.WriteErrorResponse(w, http.StatusInternalServerError, err)
+		return
 	}
-	outputs["res"] = resData
-	invokeResponse := common.InvokeResponse{Outputs: outputs, Logs: nil, ReturnValue: nil}
-
-	responseJson, _ := json.Marshal(invokeResponse)
-
-	w.Header().Set("Content-Type", "application/json")
-	w.Write(responseJson)
+	common.WriteResponse(w, http.StatusOK, "protection was set successfully", nil)
 }
@@ -0,0 +1,345 @@
+package repair
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+	"weka-deployment/common"
+	"weka-deployment/functions/status"
+
+	"github.com/google/uuid"
+	"github.com/weka/go-cloud-lib/lib/jrpc"
+	"github.com/weka/go-cloud-lib/lib/types"
+	"github.com/weka/go-cloud-lib/lib/weka"
+	"github.com/weka/go-cloud-lib/logging"
+)
+
+const defaultGracePeriod = 15 * time.Minute
+
+type RepairParams struct {
+	SubscriptionId     string
+	ResourceGroupName  string
+	VmScaleSetNames    []string
+	StateStorageName   string
+	StateContainerName string
+	KeyVaultUri        string
+	// more unhealthy backends than the protection level point to a wider outage, they are left to the operator
+	ProtectionLevel int
+	// a backend is replaced once it was unhealthy for this long
+	GracePeriod time.Duration
+}
+
+type RepairResponse struct {
+	// unhealthy backends by vm name
+	Unhealthy map[string]common.UnhealthyInstance `json:"unhealthy"`
+	Repaired  []string                            `json:"repaired"`
+	Skipped   string                              `json:"skipped,omitempty"`
+	Veto      *common.QuorumVeto                  `json:"veto,omitempty"`
+}
+
+// getUnhealthyVms returns the scale set vms with weka containers which are not up, by vm name
+func getUnhealthyVms(ctx context.Context, jpool *jrpc.Pool, vmsPrivateIps map[string]string) (unhealthy map[string]string, hostsApiList weka.HostListResponse, err error) {
+	logger := logging.LoggerFromCtx(ctx)
+
+	err = jpool.Call(weka.JrpcHostList, struct{}{}, &hostsApiList)
+	if err != nil {
+		logger.Error().Err(err).Send()
+		return
+	}
+
+	vmNames := make(map[string]string, len(vmsPrivateIps))
+	for vmName, ip := range vmsPrivateIps {
+		vmNames[ip] = vmName
+	}
+
+	reasons := make(map[string][]string)
+	for hostId, host := range hostsApiList {
+		vmName, ok := vmNames[host.HostIp]
+		// clients and removed instances are not repaired, neither are deactivated containers of a scale down
+		if !ok || host.State != "ACTIVE" {
+			continue
+		}
+		if host.Status != "UP" {
+			reasons[vmName] = append(reasons[vmName], fmt.Sprintf("container %s is %s", hostId.String(), host.Status))
+		}
+	}
+
+	unhealthy = make(map[string]string, len(reasons))
+	for vmName, vmReasons := range reasons {
+		sort.Strings(vmReasons)
+		unhealthy[vmName] = strings.Join(vmReasons, ", ")
+	}
+	return
+}
+
+// deactivateVm deactivates the drives and then the containers of the vm, so weka rebuilds its data and the
+// scale down removes the containers once the vm is gone
+func deactivateVm(ctx context.Context, jpool *jrpc.Pool, hostsApiList weka.HostListResponse, vmIp string) (err error) {
+	logger := logging.LoggerFromCtx(ctx)
+
+	vmHostIds := make(map[weka.HostId]bool)
+	var hostIds []weka.HostId
+	for hostId, host := range hostsApiList {
+		if host.HostIp == vmIp {
+			vmHostIds[hostId] = true
+			hostIds = append(hostIds, hostId)
+		}
+	}
+	if len(hostIds) == 0 {
+		return
+	}
+
+	driveApiList := weka.DriveListResponse{}
+	err = jpool.Call(weka.JrpcDrivesList, struct{}{}, &driveApiList)
+	if err != nil {
+		logger.Error().Err(err).Send()
+		return
+	}
+	var driveUuids []uuid.UUID
+	for _, drive := range driveApiList {
+		if vmHostIds[drive.HostId] && drive.ShouldBeActive {
+			driveUuids = append(driveUuids, drive.Uuid)
+		}
+	}
+	if len(driveUuids) > 0 {
+		err = jpool.Call(weka.JrpcDeactivateDrives, types.JsonDict{
+			"drive_uuids": driveUuids,
+		}, nil)
+		if err != nil {
+			logger.Error().Err(err).Send()
+			return
+		}
+	}
+
+	err = jpool.Call(weka.JrpcDeactivateHosts, types.JsonDict{
+		"host_ids":                 hostIds,
+		"skip_resource_validation": false,
+	}, nil)
+	if err != nil {
+		logger.Error().Err(err).Send()
+	}
+	return
+}
+
+func repairVm(ctx context.Context, p RepairParams, jpool *jrpc.Pool, hostsApiList weka.HostListResponse, vmName, vmIp string) (err error) {
+	err = deactivateVm(ctx, jpool, hostsApiList, vmIp)
+	if err != nil {
+		return
+	}
+
+	// the scale set capacity is restored to the desired size by scale_up, which creates the replacement
+	_, errs := common.TerminateScaleSetInstances(
+		ctx, p.SubscriptionId, p.ResourceGroupName, common.GetVmScaleSetNameFromVmName(vmName), []string{common.GetScaleSetVmIndex(vmName)},
+	)
+	if len(errs) > 0 {
+		err = errs[0]
+	}
+	return
+}
+
+// Repair replaces the backends whose weka containers were down for the grace period: their drives and containers
+// are deactivated and their vm deleted, scale_up then brings the scale set back to the desired size
+func Repair(ctx context.Context, p RepairParams) (response RepairResponse, err error) {
+	logger := logging.LoggerFromCtx(ctx)
+
+	state, err := common.ReadState(ctx, p.StateStorageName, p.StateContainerName)
+	if err != nil {
+		return
+	}
+	if !state.Clusterized {
+		response.Skipped = "cluster is not clusterized yet"
+		return
+	}
+	maintenance, err := common.IsMaintenanceModeEnabled(ctx, p.StateStorageName, p.StateContainerName)
+	if err != nil {
+		return
+	}
+	if maintenance {
+		response.Skipped = "maintenance mode is enabled"
+		return
+	}
+	// containers are down on purpose during an upgrade
+	upgradeState, err := common.GetUpgradeState(ctx, p.StateStorageName, p.StateContainerName)
+	if err != nil {
+		return
+	}
+	if upgradeState.Status == common.UpgradeStatusInProgress {
+		response.Skipped = fmt.Sprintf("upgrade to %s is in progress", upgradeState.ToVersion)
+		return
+	}
+
+	vmsPrivateIps, err := common.GetScaleSetsVmsPrivateIps(ctx, p.SubscriptionId, p.ResourceGroupName, p.VmScaleSetNames)
+	if err != nil {
+		return
+	}
+	jpool, err := status.GetScaleSetsJrpcPool(ctx, p.SubscriptionId, p.ResourceGroupName, p.VmScaleSetNames, p.KeyVaultUri)
+	if err != nil {
+		return
+	}
+	unhealthyVms, hostsApiList, err := getUnhealthyVms(ctx, jpool, vmsPrivateIps)
+	if err != nil {
+		return
+	}
+
+	now := time.Now().UTC()
+	// the vms which were healthy on the previous run
+	var failed []string
+	track := func(repairs *common.Repairs) error {
+		failed = nil
+		for vmName := range repairs.Unhealthy {
+			if _, ok := unhealthyVms[vmName]; !ok {
+				delete(repairs.Unhealthy, vmName)
+			}
+		}
+		for vmName, reason := range unhealthyVms {
+			instance, ok := repairs.Unhealthy[vmName]
+			if !ok {
+				instance.FirstSeenAt = now
+				failed = append(failed, vmName)
+			}
+			instance.Ip = vmsPrivateIps[vmName]
+			instance.Reason = reason
+			repairs.Unhealthy[vmName] = instance
+		}
+		return nil
+	}
+	repairs, err := common.UpdateRepairs(ctx, p.StateStorageName, p.StateContainerName, track)
+	if err != nil {
+		return
+	}
+	response.Unhealthy = repairs.Unhealthy
+	for _, vmName := range failed {
+		common.PublishLifecycleEvent(ctx, common.LifecycleEventHostFailed, vmName, map[string]string{
+			"ip":     repairs.Unhealthy[vmName].Ip,
+			"reason": repairs.Unhealthy[vmName].Reason,
+		})
+	}
+
+	var due []string
+	for vmName, instance := range repairs.Unhealthy {
+		if now.Sub(instance.FirstSeenAt) >= p.GracePeriod {
+			due = append(due, vmName)
+		}
+	}
+	sort.Strings(due)
+	if len(due) == 0 {
+		return
+	}
+	// the protection level recorded post deployment is the one of the live cluster
+	protectionLevel := p.ProtectionLevel
+	if settings, settingsErr := common.GetClusterSettings(ctx, p.StateStorageName, p.StateContainerName); settingsErr == nil && settings.ProtectionLevel != nil {
+		protectionLevel = *settings.ProtectionLevel
+	}
+	if len(repairs.Unhealthy) > protectionLevel {
+		response.Skipped = fmt.Sprintf("%d backends are unhealthy, more than the protection level %d, repair them manually", len(repairs.Unhealthy), protectionLevel)
+		logger.Error().Msg(response.Skipped)
+		return
+	}
+
+	// the calls must not be served by the vms being repaired
+	healthyIps := make([]string, 0, len(jpool.Ips))
+	for _, ip := range jpool.Ips {
+		healthy := true
+		for _, instance := range repairs.Unhealthy {
+			if instance.Ip == ip {
+				healthy = false
+			}
+		}
+		if healthy {
+			healthyIps = append(healthyIps, ip)
+		}
+	}
+	jpool.Ips = healthyIps
+
+	// the unhealthy backends are already down, the repair waits for weka to rebuild their data
+	downIps := make([]string, 0, len(repairs.Unhealthy))
+	for _, instance := range repairs.Unhealthy {
+		downIps = append(downIps, instance.Ip)
+	}
+	response.Veto, err = common.CheckQuorum(ctx, jpool, common.DestructiveOperation{
+		Name:    "repair",
+		DownIps: downIps,
+	})
+	if err != nil || response.Veto != nil {
+		return
+	}
+
+	for _, vmName := range due {
+		instance := repairs.Unhealthy[vmName]
+		logger.Info().Msgf("Repairing vm %s (%s), unhealthy since %s: %s", vmName, instance.Ip, instance.FirstSeenAt, instance.Reason)
+		err = repairVm(ctx, p, jpool, hostsApiList, vmName, instance.Ip)
+		if err != nil {
+			err = fmt.Errorf("failed to repair vm %s: %w", vmName, err)
+			logger.Error().Err(err).Send()
+			return
+		}
+		response.Repaired = append(response.Repaired, vmName)
+		_, err = common.UpdateRepairs(ctx, p.StateStorageName, p.StateContainerName, func(repairs *common.Repairs) error {
+			delete(repairs.Unhealthy, vmName)
+			repairs.Repaired = append(repairs.Repaired, common.RepairedInstance{
+				VmName:     vmName,
+				Ip:         instance.Ip,
+				Reason:     instance.Reason,
+				RepairedAt: time.Now().UTC(),
+			})
+			return nil
+		})
+		if err != nil {
+			return
+		}
+	}
+	return
+}
+
+func GetRepairParams(ctx context.Context) RepairParams {
+	protectionLevel, _ := strconv.Atoi(common.Getenv(ctx, "PROTECTION_LEVEL"))
+	gracePeriod := defaultGracePeriod
+	if minutes, err := strconv.Atoi(common.Getenv(ctx, "AUTO_REPAIR_GRACE_PERIOD_MINUTES")); err == nil && minutes > 0 {
+		gracePeriod = time.Duration(minutes) * time.Minute
+	}
+	return RepairParams{
+		SubscriptionId:     common.Getenv(ctx, "SUBSCRIPTION_ID"),
+		ResourceGroupName:  common.Getenv(ctx, "RESOURCE_GROUP_NAME"),
+		VmScaleSetNames:    common.GetVmScaleSetNames(ctx, common.Getenv(ctx, "PREFIX"), common.Getenv(ctx, "CLUSTER_NAME")),
+		StateStorageName:   common.Getenv(ctx, "STATE_STORAGE_NAME"),
+		StateContainerName: common.Getenv(ctx, "STATE_CONTAINER_NAME"),
+		KeyVaultUri:        common.Getenv(ctx, "KEY_VAULT_URI"),
+		ProtectionLevel:    protectionLevel,
+		GracePeriod:        gracePeriod,
+	}
+}
+
+// Handler is timer triggered, a dead backend is otherwise replaced manually
+func Handler(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	logger := logging.LoggerFromCtx(ctx)
+
+	var invokeRequest common.InvokeRequest
+	if err := json.NewDecoder(r.Body).Decode(&invokeRequest); err != nil {
+		logger.Error().Msg("Bad request")
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	if autoRepairEnabled, _ := strconv.ParseBool(common.Getenv(ctx, "AUTO_REPAIR_ENABLED")); autoRepairEnabled {
+		response, err := Repair(ctx, GetRepairParams(ctx))
+		if err != nil {
+			logger.Error().Err(err).Msg("repair failed")
+		} else if response.Skipped != "" {
+			logger.Info().Msgf("Repair skipped: %s", response.Skipped)
+		} else if len(response.Unhealthy) > 0 {
+			logger.Info().Msgf("Unhealthy vms: %v, repaired vms: %v", response.Unhealthy, response.Repaired)
+		}
+	}
+
+	invokeResponse := common.InvokeResponse{Outputs: map[string]interface{}{}, Logs: nil, ReturnValue: nil}
+	responseJson, _ := json.Marshal(invokeResponse)
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(responseJson)
+}
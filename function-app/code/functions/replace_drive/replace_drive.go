@@ -0,0 +1,221 @@
+package replace_drive
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"weka-deployment/common"
+	"weka-deployment/functions/status"
+
+	"github.com/google/uuid"
+	"github.com/weka/go-cloud-lib/lib/jrpc"
+	"github.com/weka/go-cloud-lib/lib/types"
+	"github.com/weka/go-cloud-lib/lib/weka"
+	"github.com/weka/go-cloud-lib/logging"
+)
+
+var ErrDriveNotFound = errors.New("drive not found")
+
+type RequestBody struct {
+	Vm string `json:"vm"`
+	// drive uuid or serial number
+	Drive string `json:"drive"`
+}
+
+type ReplaceDriveParams struct {
+	SubscriptionId     string
+	ResourceGroupName  string
+	VmScaleSetNames    []string
+	StateStorageName   string
+	StateContainerName string
+	KeyVaultUri        string
+}
+
+// drive is the disks_list entry, weka.Drive doesn't decode the serial number
+type drive struct {
+	HostId         weka.HostId `json:"host_id"`
+	Status         string      `json:"status"`
+	Uuid           uuid.UUID   `json:"uuid"`
+	ShouldBeActive bool        `json:"should_be_active"`
+	SerialNumber   string      `json:"serial_number"`
+}
+
+func getRemovedInstructions(vmName, driveUuid string) string {
+	return fmt.Sprintf(
+		"drive %s was removed from the cluster, the local nvme drives of azure vms can't be replaced in place: to restore the capacity delete vm %s from scale set %s, scale_up creates its replacement",
+		driveUuid, vmName, common.GetVmScaleSetNameFromVmName(vmName),
+	)
+}
+
+// findVmDrive returns the drive of the vm containers matching the uuid or serial number
+func findVmDrive(ctx context.Context, p ReplaceDriveParams, vmName, driveId string) (found *drive, jpool *jrpc.Pool, err error) {
+	logger := logging.LoggerFromCtx(ctx)
+
+	vmsPrivateIps, err := common.GetScaleSetsVmsPrivateIps(ctx, p.SubscriptionId, p.ResourceGroupName, p.VmScaleSetNames)
+	if err != nil {
+		return
+	}
+	vmIp, ok := vmsPrivateIps[vmName]
+	if !ok {
+		err = fmt.Errorf("vm %s wasn't found in scale sets %v", vmName, p.VmScaleSetNames)
+		logger.Error().Err(err).Send()
+		return
+	}
+
+	jpool, err = status.GetScaleSetsJrpcPool(ctx, p.SubscriptionId, p.ResourceGroupName, p.VmScaleSetNames, p.KeyVaultUri)
+	if err != nil {
+		return
+	}
+
+	hostsApiList := weka.HostListResponse{}
+	err = jpool.Call(weka.JrpcHostList, struct{}{}, &hostsApiList)
+	if err != nil {
+		logger.Error().Err(err).Send()
+		return
+	}
+	vmHostIds := make(map[weka.HostId]bool)
+	for hostId, host := range hostsApiList {
+		if host.HostIp == vmIp {
+			vmHostIds[hostId] = true
+		}
+	}
+
+	drives := make(map[string]drive)
+	err = jpool.Call(weka.JrpcDrivesList, struct{}{}, &drives)
+	if err != nil {
+		logger.Error().Err(err).Send()
+		return
+	}
+	for _, vmDrive := range drives {
+		if !vmHostIds[vmDrive.HostId] {
+			continue
+		}
+		if vmDrive.Uuid.String() == driveId || (vmDrive.SerialNumber != "" && vmDrive.SerialNumber == driveId) {
+			vmDrive := vmDrive
+			found = &vmDrive
+			return
+		}
+	}
+	return
+}
+
+// ReplaceDrive deactivates the drive, and removes it once weka rebuilt its data and it is inactive, the progress is
+// tracked so the operator calls it again until the drive is removed, a removed drive is not touched again
+func ReplaceDrive(ctx context.Context, p ReplaceDriveParams, vmName, driveId string) (replacement common.DriveReplacement, err error) {
+	logger := logging.LoggerFromCtx(ctx)
+
+	state, err := common.ReadState(ctx, p.StateStorageName, p.StateContainerName)
+	if err != nil {
+		return
+	}
+	if !state.Clusterized {
+		err = fmt.Errorf("weka cluster is not ready")
+		return
+	}
+
+	replacements, err := common.GetDriveReplacements(ctx, p.StateStorageName, p.StateContainerName)
+	if err != nil {
+		return
+	}
+	var existing *common.DriveReplacement
+	for _, r := range replacements {
+		if r.VmName == vmName && (r.DriveUuid == driveId || (r.Serial != "" && r.Serial == driveId)) {
+			r := r
+			existing = &r
+		}
+	}
+	if existing != nil && existing.Status == common.DriveReplacementStatusRemoved {
+		logger.Info().Msgf("Drive %s of vm %s was already removed", existing.DriveUuid, vmName)
+		replacement = *existing
+		return
+	}
+
+	vmDrive, jpool, err := findVmDrive(ctx, p, vmName, driveId)
+	if err != nil {
+		return
+	}
+	if vmDrive == nil {
+		if existing == nil {
+			err = fmt.Errorf("%w: vm %s has no drive %s", ErrDriveNotFound, vmName, driveId)
+			logger.Error().Err(err).Send()
+			return
+		}
+		// the deactivated drive was removed meanwhile, e.g. by the scale down
+		replacement = *existing
+		replacement.Status = common.DriveReplacementStatusRemoved
+		replacement.Instructions = getRemovedInstructions(vmName, replacement.DriveUuid)
+		err = common.UpdateDriveReplacement(ctx, p.StateStorageName, p.StateContainerName, replacement)
+		return
+	}
+
+	replacement = common.DriveReplacement{
+		VmName:    vmName,
+		DriveUuid: vmDrive.Uuid.String(),
+		Serial:    vmDrive.SerialNumber,
+		Status:    common.DriveReplacementStatusDeactivating,
+	}
+	switch {
+	case vmDrive.ShouldBeActive:
+		logger.Info().Msgf("Deactivating drive %s of vm %s", replacement.DriveUuid, vmName)
+		err = jpool.Call(weka.JrpcDeactivateDrives, types.JsonDict{
+			"drive_uuids": []uuid.UUID{vmDrive.Uuid},
+		}, nil)
+	case vmDrive.Status == "INACTIVE":
+		logger.Info().Msgf("Removing drive %s of vm %s", replacement.DriveUuid, vmName)
+		err = jpool.Call(weka.JrpcRemoveDrive, types.JsonDict{
+			"drive_uuids": []uuid.UUID{vmDrive.Uuid},
+		}, nil)
+		replacement.Status = common.DriveReplacementStatusRemoved
+		replacement.Instructions = getRemovedInstructions(vmName, replacement.DriveUuid)
+	default:
+		logger.Info().Msgf("Drive %s of vm %s is %s, waiting for it to be inactive", replacement.DriveUuid, vmName, vmDrive.Status)
+	}
+	if err != nil {
+		logger.Error().Err(err).Send()
+		return
+	}
+
+	err = common.UpdateDriveReplacement(ctx, p.StateStorageName, p.StateContainerName, replacement)
+	return
+}
+
+func Handler(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	logger := logging.LoggerFromCtx(ctx)
+
+	reqData, err := common.ParseInvokeRequest(r)
+	if err != nil {
+		logger.Error().Msg("Bad request")
+		common.WriteErrorResponse(w, http.StatusBadRequest, fmt.Errorf("cannot decode the request: %v", err))
+		return
+	}
+
+	var data RequestBody
+	if json.Unmarshal([]byte(common.GetRequestBody(reqData)), &data) != nil || data.Vm == "" || data.Drive == "" {
+		logger.Error().Msg("Bad request")
+		common.WriteErrorResponse(w, http.StatusBadRequest, fmt.Errorf("wrong request format. 'vm' and 'drive' (uuid or serial number) are required"))
+		return
+	}
+
+	p := ReplaceDriveParams{
+		SubscriptionId:     common.Getenv(ctx, "SUBSCRIPTION_ID"),
+		ResourceGroupName:  common.Getenv(ctx, "RESOURCE_GROUP_NAME"),
+		VmScaleSetNames:    common.GetVmScaleSetNames(ctx, common.Getenv(ctx, "PREFIX"), common.Getenv(ctx, "CLUSTER_NAME")),
+		StateStorageName:   common.Getenv(ctx, "STATE_STORAGE_NAME"),
+		StateContainerName: common.Getenv(ctx, "STATE_CONTAINER_NAME"),
+		KeyVaultUri:        common.Getenv(ctx, "KEY_VAULT_URI"),
+	}
+	replacement, err := ReplaceDrive(ctx, p, data.Vm, data.Drive)
+	if errors.Is(err, ErrDriveNotFound) {
+		common.WriteErrorResponse(w, http.StatusNotFound, err)
+	} else if err != nil {
+		common.WriteErrorResponse(w, common.GetErrorStatusCode(err), err)
+	} else if replacement.Status == common.DriveReplacementStatusRemoved {
+		common.WriteResponse(w, http.StatusOK, replacement.Instructions, replacement)
+	} else {
+		// the operator calls the function again to remove the drive once weka rebuilt its data
+		common.WriteResponse(w, http.StatusAccepted, fmt.Sprintf("drive %s is being deactivated, call again to remove it once it is inactive", replacement.DriveUuid), replacement)
+	}
+}
@@ -8,7 +8,6 @@ import (
 	"github.com/weka/go-cloud-lib/logging"
 	"github.com/weka/go-cloud-lib/protocol"
 	"net/http"
-	"os"
 	"time"
 	"weka-deployment/common"
 )
@@ -45,47 +44,48 @@ func UpdateStateReportingWithRetry(ctx context.Context, subscriptionId, resource
 	return
 }
 
-func Handler(w http.ResponseWriter, r *http.Request) {
-	outputs := make(map[string]interface{})
-	resData := make(map[string]interface{})
-
-	stateContainerName := os.Getenv("STATE_CONTAINER_NAME")
-	stateStorageName := os.Getenv("STATE_STORAGE_NAME")
-	subscriptionId := os.Getenv("SUBSCRIPTION_ID")
-	resourceGroupName := os.Getenv("RESOURCE_GROUP_NAME")
+// obsSetupCompletedMessage is reported by the clusterization script once the obs script succeeded
+const obsSetupCompletedMessage = "OBS setup completed successfully"
+
+// updateDeploymentPhase moves the deployment phase by the reports of the clusterization script
+func updateDeploymentPhase(ctx context.Context, stateStorageName, stateContainerName string, report common.ProgressReport) {
+	switch {
+	case report.Type == common.ReportTypeError && (report.Phase == "clusterization" || report.Phase == common.DeploymentPhaseConfiguringObs):
+		common.SetDeploymentPhase(ctx, stateStorageName, stateContainerName, common.DeploymentPhaseError, report.Message)
+	case report.Phase == common.DeploymentPhaseConfiguringObs && report.Message == obsSetupCompletedMessage:
+		common.PublishLifecycleEvent(ctx, common.LifecycleEventObsAttached, report.Hostname, nil)
+		common.SetDeploymentPhase(ctx, stateStorageName, stateContainerName, common.DeploymentPhaseReady, report.Message)
+	}
+}
 
+func Handler(w http.ResponseWriter, r *http.Request) {
 	ctx := r.Context()
-	logger := logging.LoggerFromCtx(ctx)
-
-	var invokeRequest common.InvokeRequest
+	stateContainerName := common.Getenv(ctx, "STATE_CONTAINER_NAME")
+	stateStorageName := common.Getenv(ctx, "STATE_STORAGE_NAME")
+	subscriptionId := common.Getenv(ctx, "SUBSCRIPTION_ID")
+	resourceGroupName := common.Getenv(ctx, "RESOURCE_GROUP_NAME")
 
-	var report protocol.Report
+	logger := logging.LoggerFromCtx(ctx)
 
-	if err := json.NewDecoder(r.Body).Decode(&invokeRequest); err != nil {
-		err = fmt.Errorf("cannot decode the request: %v", err)
-		logger.Error().Err(err).Send()
-		w.WriteHeader(http.StatusBadRequest)
-		return
-	}
+	var report common.ProgressReport
 
-	var reqData map[string]interface{}
-	err := json.Unmarshal(invokeRequest.Data["req"], &reqData)
+	reqData, err := common.ParseInvokeRequest(r)
 	if err != nil {
-		err = fmt.Errorf("cannot unmarshal the request data: %v", err)
+		err = fmt.Errorf("cannot decode the request: %v", err)
 		logger.Error().Err(err).Send()
-		w.WriteHeader(http.StatusBadRequest)
+		common.WriteErrorResponse(w, http.StatusBadRequest, err)
 		return
 	}
 
-	if json.Unmarshal([]byte(reqData["Body"].(string)), &report) != nil {
+	if err = json.Unmarshal([]byte(common.GetRequestBody(reqData)), &report); err != nil {
 		err = fmt.Errorf("cannot unmarshal the request body: %v", err)
 		logger.Error().Err(err).Send()
-		w.WriteHeader(http.StatusBadRequest)
+		common.WriteErrorResponse(w, http.StatusBadRequest, err)
 		return
 	}
 
 	logger.Info().Msgf("Updating state %s with %s", report.Type, report.Message)
-	err = common.UpdateStateReporting(ctx, subscriptionId, resourceGroupName, stateContainerName, stateStorageName, report)
+	err = common.UpdateStateReporting(ctx, subscriptionId, resourceGroupName, stateContainerName, stateStorageName, report.Report)
 
 	// Sometimes when we create a resource group and immediately run weka terraform deployment, the function-app
 	// permissions are not fully ready when we invoke this endpoint. It results in a blob read permissions issue.
@@ -97,22 +97,45 @@ func Handler(w http.ResponseWriter, r *http.Request) {
 		}
 		err2 := UpdateStateReportingWithRetry(ctx, subscriptionId, resourceGroupName, stateContainerName, stateStorageName, progressReport)
 		if err2 == nil {
-			err = common.UpdateStateReporting(ctx, subscriptionId, resourceGroupName, stateContainerName, stateStorageName, report)
+			err = common.UpdateStateReporting(ctx, subscriptionId, resourceGroupName, stateContainerName, stateStorageName, report.Report)
 		}
 	}
 
 	if err != nil {
-		w.WriteHeader(http.StatusInternalServerError)
-		resData["body"] = err.Error()
-	} else {
-		resData["body"] = fmt.Sprintf("The report was added successfully")
+		common.WriteErrorResponse(w, http.StatusInternalServerError, err)
+		return
 	}
 
-	outputs["res"] = resData
-	invokeResponse := common.InvokeResponse{Outputs: outputs, Logs: nil, ReturnValue: nil}
-
-	responseJson, _ := json.Marshal(invokeResponse)
-
-	w.Header().Set("Content-Type", "application/json")
-	w.Write(responseJson)
+	// the timeline is informative, the report is already stored in the state
+	timelineErr := common.AddProgressEntry(ctx, stateStorageName, stateContainerName, report)
+	if timelineErr != nil {
+		logger.Error().Err(timelineErr).Msg("failed to add the report to the deployment timeline")
+	}
+	updateDeploymentPhase(ctx, stateStorageName, stateContainerName, report)
+	if report.Phase == common.WekaHomeReportPhase {
+		if wekaHomeErr := common.RecordWekaHomeValidation(ctx, stateStorageName, stateContainerName, report); wekaHomeErr != nil {
+			logger.Error().Err(wekaHomeErr).Msg("failed to record the weka home validation")
+		}
+	}
+	if report.Phase == common.ClusterValidationReportPhase {
+		if validationErr := common.RecordClusterValidation(ctx, stateStorageName, stateContainerName, report); validationErr != nil {
+			logger.Error().Err(validationErr).Msg("failed to record the cluster validation")
+		}
+	}
+	if report.Phase == common.ProtocolSharesReportPhase {
+		if sharesErr := common.RecordProtocolSharesReport(ctx, stateStorageName, stateContainerName, report); sharesErr != nil {
+			logger.Error().Err(sharesErr).Msg("failed to record the protocol shares configuration")
+		}
+	}
+	if report.Phase == common.IoControlReportPhase {
+		if ioErr := common.RecordIoControlReport(ctx, stateStorageName, stateContainerName, report); ioErr != nil {
+			logger.Error().Err(ioErr).Msg("failed to record the io control report")
+		}
+	}
+	if report.Phase == common.WarmPoolReportPhase {
+		if warmPoolErr := common.RecordWarmPoolReport(ctx, subscriptionId, resourceGroupName, stateStorageName, stateContainerName, report); warmPoolErr != nil {
+			logger.Error().Err(warmPoolErr).Msg("failed to record the warm pool report")
+		}
+	}
+	common.WriteResponse(w, http.StatusOK, "The report was added successfully", nil)
 }
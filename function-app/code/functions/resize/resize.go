@@ -6,56 +6,42 @@ import (
 	"fmt"
 	"github.com/weka/go-cloud-lib/logging"
 	"net/http"
-	"os"
 	"weka-deployment/common"
 )
 
 func Handler(w http.ResponseWriter, r *http.Request) {
-	outputs := make(map[string]interface{})
-	resData := make(map[string]interface{})
-
-	stateContainerName := os.Getenv("STATE_CONTAINER_NAME")
-	stateStorageName := os.Getenv("STATE_STORAGE_NAME")
-	subscriptionId := os.Getenv("SUBSCRIPTION_ID")
-	resourceGroupName := os.Getenv("RESOURCE_GROUP_NAME")
-	prefix := os.Getenv("PREFIX")
-	clusterName := os.Getenv("CLUSTER_NAME")
-
 	ctx := r.Context()
-	logger := logging.LoggerFromCtx(ctx)
+	stateContainerName := common.Getenv(ctx, "STATE_CONTAINER_NAME")
+	stateStorageName := common.Getenv(ctx, "STATE_STORAGE_NAME")
+	subscriptionId := common.Getenv(ctx, "SUBSCRIPTION_ID")
+	resourceGroupName := common.Getenv(ctx, "RESOURCE_GROUP_NAME")
+	prefix := common.Getenv(ctx, "PREFIX")
+	clusterName := common.Getenv(ctx, "CLUSTER_NAME")
 
-	var invokeRequest common.InvokeRequest
+	logger := logging.LoggerFromCtx(ctx)
 
 	var size struct {
 		Value *int `json:"value"`
 	}
 
-	if err := json.NewDecoder(r.Body).Decode(&invokeRequest); err != nil {
-		err = fmt.Errorf("cannot decode the request: %v", err)
-		logger.Error().Err(err).Send()
-		w.WriteHeader(http.StatusBadRequest)
-		return
-	}
-
-	var reqData map[string]interface{}
-	err := json.Unmarshal(invokeRequest.Data["req"], &reqData)
+	reqData, err := common.ParseInvokeRequest(r)
 	if err != nil {
-		err = fmt.Errorf("cannot unmarshal the request data: %v", err)
+		err = fmt.Errorf("cannot decode the request: %v", err)
 		logger.Error().Err(err).Send()
-		w.WriteHeader(http.StatusBadRequest)
+		common.WriteErrorResponse(w, http.StatusBadRequest, err)
 		return
 	}
 
-	if json.Unmarshal([]byte(reqData["Body"].(string)), &size) != nil {
+	if err = json.Unmarshal([]byte(common.GetRequestBody(reqData)), &size); err != nil {
 		err = fmt.Errorf("cannot unmarshal the request body: %v", err)
 		logger.Error().Err(err).Send()
-		w.WriteHeader(http.StatusBadRequest)
+		common.WriteErrorResponse(w, http.StatusBadRequest, err)
 		return
 	}
 	if size.Value == nil {
-		err := fmt.Errorf("wrong request format. 'new_size' is required")
+		err = fmt.Errorf("wrong request format. 'value' is required")
 		logger.Error().Err(err).Send()
-		w.WriteHeader(http.StatusBadRequest)
+		common.WriteErrorResponse(w, http.StatusBadRequest, err)
 		return
 	}
 
@@ -65,55 +51,60 @@ func Handler(w http.ResponseWriter, r *http.Request) {
 	if *size.Value < minCusterSize {
 		err = fmt.Errorf("invalid size, minimal cluster size is %d", minCusterSize)
 		logger.Error().Err(err).Send()
+		common.WriteErrorResponse(w, http.StatusBadRequest, err)
+		return
 	}
 
-	if err == nil {
-		vmScaleSetName := fmt.Sprintf("%s-%s-vmss", prefix, clusterName)
-		err = updateDesiredClusterSize(ctx, *size.Value, subscriptionId, resourceGroupName, vmScaleSetName, stateContainerName, stateStorageName)
+	// the hot spare set post deployment must still fit the resized cluster
+	protection, err := common.GetDataProtection(ctx, stateStorageName, stateContainerName)
+	if err != nil {
+		common.WriteErrorResponse(w, http.StatusInternalServerError, err)
+		return
+	}
+	if err = common.ValidateHotspare(protection.Hotspare, protection.StripeWidth, protection.ProtectionLevel, *size.Value); err != nil {
+		err = fmt.Errorf("invalid size %d: %v", *size.Value, err)
+		logger.Error().Err(err).Send()
+		common.WriteErrorResponse(w, http.StatusBadRequest, err)
+		return
 	}
 
+	vmScaleSetNames := common.GetVmScaleSetNames(ctx, prefix, clusterName)
+	oldSize, err := updateDesiredClusterSize(ctx, *size.Value, subscriptionId, resourceGroupName, vmScaleSetNames, stateContainerName, stateStorageName)
 	if err != nil {
-		resData["body"] = err.Error()
-	} else {
-		resData["body"] = fmt.Sprintf("New cluster size: %d", *size.Value)
+		common.WriteErrorResponse(w, http.StatusInternalServerError, err)
+		return
 	}
-
-	outputs["res"] = resData
-	invokeResponse := common.InvokeResponse{Outputs: outputs, Logs: nil, ReturnValue: nil}
-
-	responseJson, _ := json.Marshal(invokeResponse)
-
-	w.Header().Set("Content-Type", "application/json")
-	w.Write(responseJson)
+	common.WriteResponse(w, http.StatusOK, fmt.Sprintf("cluster resized from %d to %d", oldSize, *size.Value), ResizeResponse{
+		OldSize: oldSize,
+		NewSize: *size.Value,
+	})
 }
 
-func updateDesiredClusterSize(ctx context.Context, newSize int, subscriptionId, resourceGroupName, vmScaleSetName, stateContainerName, stateStorageName string) error {
-	state, err := common.ReadState(ctx, stateStorageName, stateContainerName)
-	if err != nil {
-		return err
-	}
+type ResizeResponse struct {
+	OldSize int `json:"old_size"`
+	NewSize int `json:"new_size"`
+}
 
-	if !state.Clusterized {
-		err = fmt.Errorf("weka cluster is not ready")
-		logger := logging.LoggerFromCtx(ctx)
-		logger.Error().Err(err).Send()
-		return err
-	}
-	oldSize := state.DesiredSize
-	state.DesiredSize = newSize
+// updateDesiredClusterSize persists the new size and reconciles the scale set:
+// growing updates the scale set capacity right away, shrinking is done by the scale down workflow
+// which picks the backends to deactivate and terminates them before the capacity is reduced
+func updateDesiredClusterSize(ctx context.Context, newSize int, subscriptionId, resourceGroupName string, vmScaleSetNames []string, stateContainerName, stateStorageName string) (oldSize int, err error) {
+	logger := logging.LoggerFromCtx(ctx)
 
-	err = common.WriteState(ctx, stateStorageName, stateContainerName, state)
+	oldSize, err = common.UpdateDesiredSize(ctx, subscriptionId, resourceGroupName, stateStorageName, stateContainerName, newSize)
 	if err != nil {
 		err = fmt.Errorf("cannot update state to %d: %v", newSize, err)
-		return err
+		return
 	}
 
 	if oldSize < newSize {
-		err = common.UpdateVmScaleSetNum(ctx, subscriptionId, resourceGroupName, vmScaleSetName, int64(newSize))
+		err = common.UpdateScaleSetsCapacity(ctx, subscriptionId, resourceGroupName, vmScaleSetNames, common.GetScaleSetCapacity(ctx, newSize))
 		if err != nil {
-			err = fmt.Errorf("cannot increase scale set %s capacity from %d to %d: %v", vmScaleSetName, oldSize, newSize, err)
-			return err
+			err = fmt.Errorf("cannot increase scale sets %v capacity from %d to %d: %v", vmScaleSetNames, oldSize, newSize, err)
+			return
 		}
+	} else if oldSize > newSize {
+		logger.Info().Msgf("Cluster will be scaled down from %d to %d by the scale down workflow", oldSize, newSize)
 	}
-	return nil
+	return
 }
@@ -0,0 +1,71 @@
+package restore_state
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"weka-deployment/common"
+
+	"github.com/weka/go-cloud-lib/logging"
+	"github.com/weka/go-cloud-lib/protocol"
+)
+
+type RequestBody struct {
+	// name of the state backup to restore, as listed by an empty request
+	Backup string `json:"backup"`
+}
+
+func Handler(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	stateContainerName := common.Getenv(ctx, "STATE_CONTAINER_NAME")
+	stateStorageName := common.Getenv(ctx, "STATE_STORAGE_NAME")
+
+	logger := logging.LoggerFromCtx(ctx)
+
+	reqData, err := common.ParseInvokeRequest(r)
+	if err != nil {
+		logger.Error().Msg("Bad request")
+		common.WriteErrorResponse(w, http.StatusBadRequest, fmt.Errorf("cannot decode the request: %v", err))
+		return
+	}
+
+	// an empty body lists the state backups
+	var data RequestBody
+	if body := common.GetRequestBody(reqData); body != "" {
+		if err = json.Unmarshal([]byte(body), &data); err != nil {
+			logger.Error().Err(err).Msg("cannot unmarshal the request body")
+			common.WriteErrorResponse(w, http.StatusBadRequest, fmt.Errorf("cannot unmarshal the request body: %v", err))
+			return
+		}
+	}
+
+	if data.Backup == "" {
+		backups, err := common.ListStateBackups(ctx, stateStorageName, stateContainerName)
+		if err != nil {
+			common.WriteErrorResponse(w, http.StatusInternalServerError, err)
+			return
+		}
+		common.WriteResponse(w, http.StatusOK, fmt.Sprintf("%d state backups", len(backups)), backups)
+		return
+	}
+
+	var plan *common.DryRunPlan
+	if common.IsDryRun(reqData) {
+		plan = &common.DryRunPlan{}
+	}
+	var state protocol.ClusterState
+	err = plan.Apply(ctx, fmt.Sprintf("restore the state from backup %s", data.Backup), func() (restoreErr error) {
+		state, restoreErr = common.RestoreState(ctx, stateStorageName, stateContainerName, data.Backup)
+		return
+	})
+	if errors.Is(err, common.ErrStateBackupNotFound) {
+		common.WriteErrorResponse(w, http.StatusNotFound, err)
+	} else if err != nil {
+		common.WriteErrorResponse(w, http.StatusInternalServerError, err)
+	} else if plan.Enabled() {
+		common.WriteResponse(w, http.StatusOK, "dry run", plan.Response(""))
+	} else {
+		common.WriteResponse(w, http.StatusOK, fmt.Sprintf("state restored from backup %s", data.Backup), state)
+	}
+}
@@ -0,0 +1,128 @@
+package rotate_password
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"weka-deployment/common"
+
+	"github.com/weka/go-cloud-lib/connectors"
+	"github.com/weka/go-cloud-lib/lib/jrpc"
+	"github.com/weka/go-cloud-lib/lib/weka"
+	"github.com/weka/go-cloud-lib/logging"
+)
+
+const (
+	JrpcUserSetPassword weka.JrpcMethod = "user_set_password"
+	passwordLength                      = 20
+)
+
+type userSetPasswordParams struct {
+	Username string `json:"username"`
+	Password string `json:"password"`
+}
+
+func newJrpcPool(ctx context.Context, ips []string, username, password string) *jrpc.Pool {
+	return &jrpc.Pool{
+		Ips:     ips,
+		Clients: map[string]*jrpc.BaseClient{},
+		Active:  "",
+		Builder: func(ip string) *jrpc.BaseClient {
+			return connectors.NewJrpcClient(ctx, ip, weka.ManagementJrpcPort, username, password)
+		},
+		Ctx: ctx,
+	}
+}
+
+// RotateAdminPassword sets a new generated password for the weka admin user and stores it as a new key vault secret version,
+// the password is reverted when it can't be stored so the key vault always holds a working password
+func RotateAdminPassword(ctx context.Context, subscriptionId, resourceGroupName string, vmScaleSetNames []string, keyVaultUri string) (err error) {
+	logger := logging.LoggerFromCtx(ctx)
+
+	vmIps, err := common.GetScaleSetsVmsPrivateIps(ctx, subscriptionId, resourceGroupName, vmScaleSetNames)
+	if err != nil {
+		return
+	}
+	ips := make([]string, 0, len(vmIps))
+	for _, ip := range vmIps {
+		ips = append(ips, ip)
+	}
+	if len(ips) == 0 {
+		err = fmt.Errorf("no instances found in %v", vmScaleSetNames)
+		logger.Error().Err(err).Send()
+		return
+	}
+
+	adminUsername := common.GetWekaAdminUsername(ctx)
+	// the password may have been rotated through another function app instance
+	common.InvalidateKeyVaultValue(keyVaultUri, common.WekaPasswordSecretName)
+	oldPassword, err := common.GetWekaClusterPassword(ctx, keyVaultUri)
+	if err != nil {
+		return
+	}
+
+	newPassword, err := common.GeneratePassword(passwordLength)
+	if err != nil {
+		logger.Error().Err(err).Send()
+		return
+	}
+
+	logger.Info().Msgf("Rotating password of weka user %s", adminUsername)
+	err = newJrpcPool(ctx, ips, adminUsername, oldPassword).Call(JrpcUserSetPassword, userSetPasswordParams{
+		Username: adminUsername,
+		Password: newPassword,
+	}, nil)
+	if err != nil {
+		err = fmt.Errorf("failed to set weka user password: %w", err)
+		logger.Error().Err(err).Send()
+		return
+	}
+
+	newPasswordPool := newJrpcPool(ctx, ips, adminUsername, newPassword)
+	err = common.SetKeyVaultValue(ctx, keyVaultUri, common.WekaPasswordSecretName, newPassword)
+	if err != nil {
+		err = fmt.Errorf("failed to store the new password: %w", err)
+		logger.Error().Err(err).Send()
+		revertErr := newPasswordPool.Call(JrpcUserSetPassword, userSetPasswordParams{
+			Username: adminUsername,
+			Password: oldPassword,
+		}, nil)
+		if revertErr != nil {
+			logger.Error().Err(revertErr).Msg("failed to revert weka user password")
+		}
+		return
+	}
+
+	// validate the stored password, a fresh client logs in with the key vault value rather than the cached one
+	common.InvalidateKeyVaultValue(keyVaultUri, common.WekaPasswordSecretName)
+	storedPassword, err := common.GetWekaClusterPassword(ctx, keyVaultUri)
+	if err != nil {
+		return
+	}
+	err = newJrpcPool(ctx, ips, adminUsername, storedPassword).Call(weka.JrpcStatus, struct{}{}, nil)
+	if err != nil {
+		err = fmt.Errorf("failed to login with the rotated password: %w", err)
+		logger.Error().Err(err).Send()
+		return
+	}
+	logger.Info().Msgf("Password of weka user %s was rotated", adminUsername)
+	return
+}
+
+func Handler(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	subscriptionId := common.Getenv(ctx, "SUBSCRIPTION_ID")
+	resourceGroupName := common.Getenv(ctx, "RESOURCE_GROUP_NAME")
+	prefix := common.Getenv(ctx, "PREFIX")
+	clusterName := common.Getenv(ctx, "CLUSTER_NAME")
+	keyVaultUri := common.Getenv(ctx, "KEY_VAULT_URI")
+
+	vmScaleSetNames := common.GetVmScaleSetNames(ctx, prefix, clusterName)
+
+	err := RotateAdminPassword(ctx, subscriptionId, resourceGroupName, vmScaleSetNames, keyVaultUri)
+	if err != nil {
+		common.WriteErrorResponse(w, common.GetErrorStatusCode(err), err)
+		return
+	}
+	common.WriteResponse(w, http.StatusOK, "password rotated successfully", nil)
+}
@@ -0,0 +1,202 @@
+package s3_presigned_url
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+	"weka-deployment/common"
+
+	"github.com/lithammer/dedent"
+	"github.com/weka/go-cloud-lib/logging"
+)
+
+const (
+	signingAlgorithm = "AWS4-HMAC-SHA256"
+	defaultS3Region  = "us-east-1"
+	// maximal expiry allowed by sigv4 presigned urls
+	maxExpirySeconds = 7 * 24 * 60 * 60
+)
+
+type RequestBody struct {
+	Bucket        string `json:"bucket"`
+	ObjectKey     string `json:"object_key"`
+	ExpirySeconds int    `json:"expiry_seconds"`
+}
+
+type S3Credentials struct {
+	Endpoint  string
+	Region    string
+	AccessKey string
+	SecretKey string
+}
+
+// uriEncode encodes according to the sigv4 rules, '/' is kept when encoding object key paths
+func uriEncode(s string, encodeSlash bool) string {
+	var sb strings.Builder
+	for _, b := range []byte(s) {
+		if (b >= 'A' && b <= 'Z') || (b >= 'a' && b <= 'z') || (b >= '0' && b <= '9') || b == '-' || b == '_' || b == '.' || b == '~' || (b == '/' && !encodeSlash) {
+			sb.WriteByte(b)
+		} else {
+			sb.WriteString(fmt.Sprintf("%%%02X", b))
+		}
+	}
+	return sb.String()
+}
+
+func hmacSha256(key []byte, data string) []byte {
+	h := hmac.New(sha256.New, key)
+	h.Write([]byte(data))
+	return h.Sum(nil)
+}
+
+func sha256Hex(data string) string {
+	h := sha256.Sum256([]byte(data))
+	return hex.EncodeToString(h[:])
+}
+
+// GetPresignedUrl returns a sigv4 presigned GET url for a weka s3 object
+// see https://docs.aws.amazon.com/AmazonS3/latest/API/sigv4-query-string-auth.html
+func GetPresignedUrl(creds S3Credentials, bucket, objectKey string, expirySeconds int, now time.Time) (string, error) {
+	if expirySeconds <= 0 || expirySeconds > maxExpirySeconds {
+		return "", fmt.Errorf("expiry_seconds must be between 1 and %d", maxExpirySeconds)
+	}
+	endpoint, err := url.Parse(creds.Endpoint)
+	if err != nil {
+		return "", fmt.Errorf("invalid s3 endpoint %s: %w", creds.Endpoint, err)
+	}
+
+	amzDate := now.UTC().Format("20060102T150405Z")
+	date := now.UTC().Format("20060102")
+	scope := fmt.Sprintf("%s/%s/s3/aws4_request", date, creds.Region)
+	canonicalUri := "/" + uriEncode(bucket, true) + "/" + uriEncode(objectKey, false)
+
+	// query parameters must be sorted by name
+	canonicalQuery := strings.Join([]string{
+		"X-Amz-Algorithm=" + signingAlgorithm,
+		"X-Amz-Credential=" + uriEncode(creds.AccessKey+"/"+scope, true),
+		"X-Amz-Date=" + amzDate,
+		fmt.Sprintf("X-Amz-Expires=%d", expirySeconds),
+		"X-Amz-SignedHeaders=host",
+	}, "&")
+
+	canonicalRequest := strings.Join([]string{
+		http.MethodGet,
+		canonicalUri,
+		canonicalQuery,
+		"host:" + endpoint.Host + "\n",
+		"host",
+		"UNSIGNED-PAYLOAD",
+	}, "\n")
+	stringToSign := strings.Join([]string{signingAlgorithm, amzDate, scope, sha256Hex(canonicalRequest)}, "\n")
+
+	signingKey := hmacSha256([]byte("AWS4"+creds.SecretKey), date)
+	signingKey = hmacSha256(signingKey, creds.Region)
+	signingKey = hmacSha256(signingKey, "s3")
+	signingKey = hmacSha256(signingKey, "aws4_request")
+	signature := hex.EncodeToString(hmacSha256(signingKey, stringToSign))
+
+	return fmt.Sprintf("%s://%s%s?%s&X-Amz-Signature=%s", endpoint.Scheme, endpoint.Host, canonicalUri, canonicalQuery, signature), nil
+}
+
+// GetWekaS3PresignedURLScript returns the bash equivalent of GetPresignedUrl, it expects S3_ENDPOINT, S3_REGION,
+// AWS_ACCESS_KEY_ID and AWS_SECRET_ACCESS_KEY to be set
+func GetWekaS3PresignedURLScript(bucket, objectKey string, expirySeconds int) string {
+	template := `
+	#!/bin/bash
+	set -e
+	BUCKET="%s"
+	OBJECT_KEY="%s"
+	EXPIRES=%d
+	S3_REGION=${S3_REGION:-%s}
+	host=$(echo "$S3_ENDPOINT" | sed -e 's|^[^/]*//||' -e 's|/.*$||')
+	scheme=$(echo "$S3_ENDPOINT" | sed -e 's|://.*$||')
+
+	function hmac_sha256 {
+		printf "%%s" "$2" | openssl dgst -sha256 -mac HMAC -macopt "$1" | sed 's/^.* //'
+	}
+
+	amz_date=$(date -u +%%Y%%m%%dT%%H%%M%%SZ)
+	date_stamp=${amz_date:0:8}
+	scope="$date_stamp/$S3_REGION/s3/aws4_request"
+	credential=$(printf "%%s" "$AWS_ACCESS_KEY_ID/$scope" | sed 's|/|%%2F|g')
+	canonical_uri="/$BUCKET/$OBJECT_KEY"
+	canonical_query="X-Amz-Algorithm=%s&X-Amz-Credential=$credential&X-Amz-Date=$amz_date&X-Amz-Expires=$EXPIRES&X-Amz-SignedHeaders=host"
+	canonical_request=$(printf "GET\n%%s\n%%s\nhost:%%s\n\nhost\nUNSIGNED-PAYLOAD" "$canonical_uri" "$canonical_query" "$host")
+	hashed_request=$(printf "%%s" "$canonical_request" | openssl dgst -sha256 | sed 's/^.* //')
+	string_to_sign=$(printf "%s\n%%s\n%%s\n%%s" "$amz_date" "$scope" "$hashed_request")
+
+	k_date=$(hmac_sha256 "key:AWS4$AWS_SECRET_ACCESS_KEY" "$date_stamp")
+	k_region=$(hmac_sha256 "hexkey:$k_date" "$S3_REGION")
+	k_service=$(hmac_sha256 "hexkey:$k_region" "s3")
+	k_signing=$(hmac_sha256 "hexkey:$k_service" "aws4_request")
+	signature=$(hmac_sha256 "hexkey:$k_signing" "$string_to_sign")
+
+	echo "$scheme://$host$canonical_uri?$canonical_query&X-Amz-Signature=$signature"
+	`
+	return fmt.Sprintf(
+		dedent.Dedent(template), uriEncode(bucket, true), uriEncode(objectKey, false), expirySeconds, defaultS3Region,
+		signingAlgorithm, signingAlgorithm,
+	)
+}
+
+func getS3Credentials(ctx context.Context, keyVaultUri string) (creds S3Credentials, err error) {
+	creds.Endpoint = common.Getenv(ctx, "S3_ENDPOINT")
+	creds.Region = common.Getenv(ctx, "S3_REGION")
+	if creds.Region == "" {
+		creds.Region = defaultS3Region
+	}
+	creds.AccessKey, err = common.GetKeyVaultValue(ctx, keyVaultUri, "weka-s3-access-key")
+	if err != nil {
+		return
+	}
+	creds.SecretKey, err = common.GetKeyVaultValue(ctx, keyVaultUri, "weka-s3-secret-key")
+	return
+}
+
+func Handler(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	keyVaultUri := common.Getenv(ctx, "KEY_VAULT_URI")
+
+	logger := logging.LoggerFromCtx(ctx)
+
+	reqData, err := common.ParseInvokeRequest(r)
+	if err != nil {
+		err = fmt.Errorf("cannot decode the request: %v", err)
+		logger.Error().Err(err).Send()
+		common.WriteErrorResponse(w, http.StatusBadRequest, err)
+		return
+	}
+
+	var data RequestBody
+	if err = json.Unmarshal([]byte(common.GetRequestBody(reqData)), &data); err != nil {
+		err = fmt.Errorf("cannot unmarshal the request body: %v", err)
+		logger.Error().Err(err).Send()
+		common.WriteErrorResponse(w, http.StatusBadRequest, err)
+		return
+	}
+	if data.Bucket == "" || data.ObjectKey == "" {
+		err = fmt.Errorf("wrong request format. 'bucket' and 'object_key' are required")
+		logger.Error().Err(err).Send()
+		common.WriteErrorResponse(w, http.StatusBadRequest, err)
+		return
+	}
+
+	creds, err := getS3Credentials(ctx, keyVaultUri)
+	var presignedUrl string
+	if err == nil {
+		presignedUrl, err = GetPresignedUrl(creds, data.Bucket, data.ObjectKey, data.ExpirySeconds, time.Now())
+	}
+	if err != nil {
+		logger.Error().Err(err).Send()
+		common.WriteErrorResponse(w, http.StatusInternalServerError, err)
+		return
+	}
+	common.WriteResponse(w, http.StatusOK, "presigned url", presignedUrl)
+}
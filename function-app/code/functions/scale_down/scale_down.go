@@ -1,15 +1,73 @@
 package scale_down
 
 import (
+	"context"
 	"encoding/json"
+	"errors"
+	"fmt"
 	"net/http"
 	"weka-deployment/common"
 
+	"github.com/weka/go-cloud-lib/connectors"
+	"github.com/weka/go-cloud-lib/lib/jrpc"
+	"github.com/weka/go-cloud-lib/lib/weka"
 	"github.com/weka/go-cloud-lib/logging"
 	"github.com/weka/go-cloud-lib/protocol"
 	"github.com/weka/go-cloud-lib/scale_down"
 )
 
+// subset of weka status we need in order to know whether data is being rebuilt
+type rebuildStatusResponse struct {
+	Rebuild struct {
+		ProtectionState []struct {
+			MiB         float64 `json:"MiB"`
+			NumFailures int     `json:"numFailures"`
+		} `json:"protectionState"`
+	} `json:"rebuild"`
+}
+
+func getJrpcPool(ctx context.Context, info protocol.HostGroupInfoResponse) *jrpc.Pool {
+	return &jrpc.Pool{
+		Ips:     info.BackendIps,
+		Clients: map[string]*jrpc.BaseClient{},
+		Active:  "",
+		Builder: func(ip string) *jrpc.BaseClient {
+			return connectors.NewJrpcClient(ctx, ip, weka.ManagementJrpcPort, info.Username, info.Password)
+		},
+		Ctx: ctx,
+	}
+}
+
+func isRebuilding(ctx context.Context, info protocol.HostGroupInfoResponse) (rebuilding bool, err error) {
+	jpool := getJrpcPool(ctx, info)
+
+	var status rebuildStatusResponse
+	err = jpool.Call(weka.JrpcStatus, struct{}{}, &status)
+	if err != nil {
+		return
+	}
+	for _, state := range status.Rebuild.ProtectionState {
+		if state.NumFailures > 0 && state.MiB > 0 {
+			rebuilding = true
+			return
+		}
+	}
+	return
+}
+
+// postponeTermination keeps deactivated instances out of the termination step while the cluster is rebuilding,
+// terminate only removes instances that are not part of the scale response hosts
+func postponeTermination(response *protocol.ScaleResponse) {
+	for _, instance := range response.ToTerminate {
+		response.Hosts = append(response.Hosts, protocol.ScaleResponseHost{
+			InstanceId: instance.Id,
+			PrivateIp:  instance.PrivateIp,
+			State:      "PENDING_REBUILD",
+		})
+	}
+	response.ToTerminate = nil
+}
+
 func Handler(w http.ResponseWriter, r *http.Request) {
 	outputs := make(map[string]interface{})
 	resData := make(map[string]interface{})
@@ -39,15 +97,59 @@ func Handler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	scaleResponse, err := scale_down.ScaleDown(ctx, info)
-	if err != nil {
-		resData["body"] = err.Error()
+	if common.IsDryRun(reqData) {
+		// scale down deactivates the removed backends right away, so dry run only reports the planned change
+		plan := &common.DryRunPlan{}
+		if len(info.BackendIps) > info.DesiredCapacity {
+			plan.Record(ctx, fmt.Sprintf("deactivate and remove %d backends to reach desired capacity %d", len(info.BackendIps)-info.DesiredCapacity, info.DesiredCapacity))
+		}
+		resData["body"] = plan.Response("")
 	} else {
-		resData["body"] = scaleResponse
+		// the backends are kept when removing them would not keep the data protection, the scale down still
+		// cleans up the inactive and down containers
+		var vetoErr error
+		if len(info.BackendIps) > info.DesiredCapacity {
+			veto, checkErr := common.CheckQuorum(ctx, getJrpcPool(ctx, info), common.DestructiveOperation{
+				Name:            "scale_down",
+				RemovedBackends: len(info.BackendIps) - info.DesiredCapacity,
+			})
+			if checkErr != nil {
+				vetoErr = checkErr
+			} else if veto != nil {
+				vetoErr = errors.New(common.MarshalQuorumVeto(veto))
+			}
+			if vetoErr != nil {
+				info.DesiredCapacity = len(info.BackendIps)
+			}
+		}
+		scaleResponse, err := scale_down.ScaleDown(ctx, info)
+		if err == nil && vetoErr != nil {
+			scaleResponse.AddTransientError(vetoErr, "CheckQuorum")
+		}
+		if err == nil && len(scaleResponse.ToTerminate) > 0 {
+			// instances are deleted from the scale set only after the data protection is fully restored
+			rebuilding, rebuildErr := isRebuilding(ctx, info)
+			if rebuildErr != nil {
+				scaleResponse.AddTransientError(rebuildErr, "isRebuilding")
+			}
+			if rebuilding || rebuildErr != nil {
+				logger.Info().Msgf("Postponing termination of %d instances until rebuild is done", len(scaleResponse.ToTerminate))
+				postponeTermination(&scaleResponse)
+			}
+		}
+		if err != nil {
+			common.TrackEvent(ctx, common.EventScaleDownFailed, map[string]string{"error": err.Error()})
+			common.Notify(ctx, common.NotificationSeverityError, common.NotificationScaleDownFailed, err.Error(), nil)
+			resData["body"] = err.Error()
+		} else {
+			common.TrackMetric(ctx, common.MetricInstancesToRemove, float64(len(scaleResponse.ToTerminate)), nil)
+			resData["body"] = scaleResponse
+		}
 	}
 	outputs["res"] = resData
 	invokeResponse := common.InvokeResponse{Outputs: outputs, Logs: nil, ReturnValue: nil}
 
+	// the body stays the raw scale response, the logic app passes it to terminate as its request body
 	responseJson, _ := json.Marshal(invokeResponse)
 
 	w.Header().Set("Content-Type", "application/json")
@@ -1,47 +1,83 @@
 package scale_up
 
 import (
-	"encoding/json"
+	"context"
+	"fmt"
 	"net/http"
-	"os"
+	"strings"
 	"weka-deployment/common"
 )
 
+// activateWarmPool starts the warm pool vms the desired size misses, they join the cluster once started instead of
+// waiting for new vms to be created
+func activateWarmPool(ctx context.Context, subscriptionId, resourceGroupName, stateStorageName, stateContainerName, prefix, clusterName string, desiredSize int) (activated []string, err error) {
+	vmsPrivateIps, err := common.GetScaleSetsVmsPrivateIps(ctx, subscriptionId, resourceGroupName, common.GetVmScaleSetNames(ctx, prefix, clusterName))
+	if err != nil {
+		return
+	}
+	evictions, err := common.GetEvictions(ctx, stateStorageName, stateContainerName)
+	if err != nil {
+		return
+	}
+	var vmNames []string
+	for vmName := range vmsPrivateIps {
+		if _, evicted := evictions[vmName]; !evicted {
+			vmNames = append(vmNames, vmName)
+		}
+	}
+	return common.ActivateWarmPoolMembers(ctx, subscriptionId, resourceGroupName, stateStorageName, stateContainerName, vmNames, desiredSize)
+}
+
 func Handler(w http.ResponseWriter, r *http.Request) {
-	outputs := make(map[string]interface{})
-	resData := make(map[string]interface{})
+	ctx := r.Context()
+	stateContainerName := common.Getenv(ctx, "STATE_CONTAINER_NAME")
+	stateStorageName := common.Getenv(ctx, "STATE_STORAGE_NAME")
+	subscriptionId := common.Getenv(ctx, "SUBSCRIPTION_ID")
+	resourceGroupName := common.Getenv(ctx, "RESOURCE_GROUP_NAME")
+	prefix := common.Getenv(ctx, "PREFIX")
+	clusterName := common.Getenv(ctx, "CLUSTER_NAME")
 
-	stateContainerName := os.Getenv("STATE_CONTAINER_NAME")
-	stateStorageName := os.Getenv("STATE_STORAGE_NAME")
-	subscriptionId := os.Getenv("SUBSCRIPTION_ID")
-	resourceGroupName := os.Getenv("RESOURCE_GROUP_NAME")
-	prefix := os.Getenv("PREFIX")
-	clusterName := os.Getenv("CLUSTER_NAME")
+	vmScaleSetNames := common.GetVmScaleSetNames(ctx, prefix, clusterName)
 
-	ctx := r.Context()
-	vmScaleSetName := common.GetVmScaleSetName(prefix, clusterName)
+	// the timer trigger has no request body, dry run is only set by http requests
+	var dryRun bool
+	if reqData, err := common.ParseInvokeRequest(r); err == nil {
+		dryRun = common.IsDryRun(reqData)
+	}
 
 	state, err := common.ReadState(ctx, stateStorageName, stateContainerName)
+	var maintenance bool
+	if err == nil {
+		maintenance, err = common.IsMaintenanceModeEnabled(ctx, stateStorageName, stateContainerName)
+	}
 	if err != nil {
-		resData["body"] = err.Error()
+		common.WriteErrorResponse(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	if !state.Clusterized {
+		common.WriteResponse(w, http.StatusOK, "Not clusterized yet, skipping...", nil)
+	} else if maintenance {
+		common.WriteResponse(w, http.StatusOK, "Maintenance mode is enabled, skipping...", nil)
+	} else if dryRun {
+		plan := &common.DryRunPlan{}
+		plan.Record(ctx, fmt.Sprintf("update scale sets %v capacity to %d", vmScaleSetNames, common.GetScaleSetCapacity(ctx, state.DesiredSize)))
+		if common.GetWarmPoolSize(ctx) > 0 {
+			plan.Record(ctx, fmt.Sprintf("start the warm pool vms missing from the desired size %d", state.DesiredSize))
+		}
+		common.WriteResponse(w, http.StatusOK, "dry run", plan.Response(""))
 	} else {
-		if !state.Clusterized {
-			resData["body"] = "Not clusterized yet, skipping..."
+		err = common.UpdateScaleSetsCapacity(ctx, subscriptionId, resourceGroupName, vmScaleSetNames, common.GetScaleSetCapacity(ctx, state.DesiredSize))
+		var activated []string
+		if err == nil && common.GetWarmPoolSize(ctx) > 0 {
+			activated, err = activateWarmPool(ctx, subscriptionId, resourceGroupName, stateStorageName, stateContainerName, prefix, clusterName, state.DesiredSize)
+		}
+		if err != nil {
+			common.WriteErrorResponse(w, http.StatusInternalServerError, err)
+		} else if len(activated) > 0 {
+			common.WriteResponse(w, http.StatusOK, fmt.Sprintf("updated size successfully, started warm pool vms: %s", strings.Join(activated, ", ")), activated)
 		} else {
-			err = common.UpdateVmScaleSetNum(ctx, subscriptionId, resourceGroupName, vmScaleSetName, int64(state.DesiredSize))
-			if err != nil {
-				resData["body"] = err.Error()
-			} else {
-				resData["body"] = "updated size successfully"
-			}
+			common.WriteResponse(w, http.StatusOK, "updated size successfully", nil)
 		}
 	}
-
-	outputs["res"] = resData
-	invokeResponse := common.InvokeResponse{Outputs: outputs, Logs: nil, ReturnValue: nil}
-
-	responseJson, _ := json.Marshal(invokeResponse)
-
-	w.Header().Set("Content-Type", "application/json")
-	w.Write(responseJson)
 }
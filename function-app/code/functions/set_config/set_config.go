@@ -0,0 +1,125 @@
+package set_config
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"sort"
+	"time"
+	"weka-deployment/common"
+
+	"github.com/weka/go-cloud-lib/logging"
+)
+
+// RequestBody settings values are strings, numbers, booleans or json objects, null removes the setting
+// from the config blob so its app setting applies again
+type RequestBody struct {
+	Version  *int                       `json:"version"`
+	Settings map[string]json.RawMessage `json:"settings"`
+}
+
+// ClusterConfigSummary lists the names of the settings in the config blob, their values may hold secrets
+type ClusterConfigSummary struct {
+	Version   int       `json:"version"`
+	UpdatedAt time.Time `json:"updated_at"`
+	Settings  []string  `json:"settings"`
+}
+
+func getConfigSummary(config common.ClusterConfig) ClusterConfigSummary {
+	names := make([]string, 0, len(config.Settings))
+	for name := range config.Settings {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return ClusterConfigSummary{Version: config.Version, UpdatedAt: config.UpdatedAt, Settings: names}
+}
+
+func getSettingsValues(settings map[string]json.RawMessage) (values map[string]*string) {
+	values = make(map[string]*string, len(settings))
+	for name, raw := range settings {
+		if string(raw) == "null" {
+			values[name] = nil
+			continue
+		}
+		var value string
+		if json.Unmarshal(raw, &value) != nil {
+			// numbers, booleans and json objects are stored as their json text
+			value = string(raw)
+		}
+		values[name] = &value
+	}
+	return
+}
+
+func setConfig(ctx context.Context, stateStorageName, stateContainerName string, version *int, settings map[string]*string, plan *common.DryRunPlan) (config common.ClusterConfig, err error) {
+	names := make([]string, 0, len(settings))
+	for name := range settings {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	err = plan.Apply(ctx, fmt.Sprintf("update cluster config settings %v", names), func() (updateErr error) {
+		config, updateErr = common.UpdateClusterConfig(ctx, stateStorageName, stateContainerName, version, settings)
+		return
+	})
+	return
+}
+
+func Handler(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	stateContainerName := common.Getenv(ctx, "STATE_CONTAINER_NAME")
+	stateStorageName := common.Getenv(ctx, "STATE_STORAGE_NAME")
+
+	logger := logging.LoggerFromCtx(ctx)
+
+	reqData, err := common.ParseInvokeRequest(r)
+	if err != nil {
+		logger.Error().Msg("Bad request")
+		common.WriteErrorResponse(w, http.StatusBadRequest, fmt.Errorf("cannot decode the request: %v", err))
+		return
+	}
+
+	// an empty body queries the config version and settings names
+	var data RequestBody
+	if body := common.GetRequestBody(reqData); body != "" {
+		if err = json.Unmarshal([]byte(body), &data); err != nil {
+			logger.Error().Err(err).Msg("cannot unmarshal the request body")
+			common.WriteErrorResponse(w, http.StatusBadRequest, fmt.Errorf("cannot unmarshal the request body: %v", err))
+			return
+		}
+	}
+
+	if len(data.Settings) == 0 {
+		config, err := common.GetClusterConfig(ctx, stateStorageName, stateContainerName)
+		if err != nil {
+			common.WriteErrorResponse(w, http.StatusInternalServerError, err)
+			return
+		}
+		common.WriteResponse(w, http.StatusOK, fmt.Sprintf("cluster config version %d", config.Version), getConfigSummary(config))
+		return
+	}
+
+	settings := getSettingsValues(data.Settings)
+	if err = common.ConfigIssuesError(common.ValidateClusterConfigSettings(settings)); err != nil {
+		logger.Error().Err(err).Send()
+		common.WriteErrorResponse(w, http.StatusBadRequest, err)
+		return
+	}
+
+	var plan *common.DryRunPlan
+	if common.IsDryRun(reqData) {
+		plan = &common.DryRunPlan{}
+	}
+	config, err := setConfig(ctx, stateStorageName, stateContainerName, data.Version, settings, plan)
+	if errors.Is(err, common.ErrClusterConfigVersionConflict) {
+		common.WriteErrorResponse(w, http.StatusConflict, err)
+	} else if err != nil {
+		common.WriteErrorResponse(w, http.StatusInternalServerError, err)
+	} else if plan.Enabled() {
+		common.WriteResponse(w, http.StatusOK, "dry run", plan.Response(""))
+	} else {
+		common.WriteResponse(w, http.StatusOK, fmt.Sprintf("cluster config updated to version %d", config.Version), getConfigSummary(config))
+	}
+}
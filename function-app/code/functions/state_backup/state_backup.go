@@ -0,0 +1,32 @@
+package state_backup
+
+import (
+	"encoding/json"
+	"net/http"
+	"weka-deployment/common"
+
+	"github.com/weka/go-cloud-lib/logging"
+)
+
+// Handler is timer triggered, the state is snapshotted hourly so restore_state can roll it back
+func Handler(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	logger := logging.LoggerFromCtx(ctx)
+
+	var invokeRequest common.InvokeRequest
+	if err := json.NewDecoder(r.Body).Decode(&invokeRequest); err != nil {
+		logger.Error().Msg("Bad request")
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	if _, err := common.BackupState(ctx, common.Getenv(ctx, "STATE_STORAGE_NAME"), common.Getenv(ctx, "STATE_CONTAINER_NAME")); err != nil {
+		logger.Error().Err(err).Msg("state backup failed")
+	}
+
+	invokeResponse := common.InvokeResponse{Outputs: map[string]interface{}{}, Logs: nil, ReturnValue: nil}
+	responseJson, _ := json.Marshal(invokeResponse)
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(responseJson)
+}
@@ -11,7 +11,6 @@ import (
 	"github.com/weka/go-cloud-lib/protocol"
 	"math/rand"
 	"net/http"
-	"os"
 	"time"
 	"weka-deployment/common"
 )
@@ -32,48 +31,63 @@ func GetReports(ctx context.Context, stateStorageName, stateContainerName string
 	return
 }
 
-func GetClusterStatus(ctx context.Context, subscriptionId, resourceGroupName, vmScaleSetName, stateStorageName, stateContainerName, keyVaultUri string) (clusterStatus protocol.ClusterStatus, err error) {
-	logger := logging.LoggerFromCtx(ctx)
-	logger.Info().Msg("fetching cluster status...")
+func GetJrpcPool(ctx context.Context, subscriptionId, resourceGroupName, vmScaleSetName, keyVaultUri string) (jpool *jrpc.Pool, err error) {
+	return GetScaleSetsJrpcPool(ctx, subscriptionId, resourceGroupName, []string{vmScaleSetName}, keyVaultUri)
+}
 
-	state, err := common.ReadState(ctx, stateStorageName, stateContainerName)
-	if err != nil {
-		return
-	}
-	clusterStatus.InitialSize = state.InitialSize
-	clusterStatus.DesiredSize = state.DesiredSize
-	clusterStatus.Clusterized = state.Clusterized
-	if !state.Clusterized {
-		return
-	}
+// GetScaleSetsJrpcPool returns a pool over the instances of all the given scale sets
+func GetScaleSetsJrpcPool(ctx context.Context, subscriptionId, resourceGroupName string, vmScaleSetNames []string, keyVaultUri string) (jpool *jrpc.Pool, err error) {
+	logger := logging.LoggerFromCtx(ctx)
 
-	wekaPassword, err := common.GetWekaClusterPassword(ctx, keyVaultUri)
+	wekaUsername, wekaPassword, err := common.GetWekaCredentials(ctx, keyVaultUri)
 	if err != nil {
 		return
 	}
 
 	jrpcBuilder := func(ip string) *jrpc.BaseClient {
-		return connectors.NewJrpcClient(ctx, ip, weka.ManagementJrpcPort, "admin", wekaPassword)
+		return connectors.NewJrpcClient(ctx, ip, weka.ManagementJrpcPort, wekaUsername, wekaPassword)
 	}
 
-	vmIps, err := common.GetVmsPrivateIps(ctx, subscriptionId, resourceGroupName, vmScaleSetName)
+	vmIps, err := common.GetScaleSetsVmsPrivateIps(ctx, subscriptionId, resourceGroupName, vmScaleSetNames)
 	if err != nil {
 		return
 	}
-	ips := make([]string, len(vmIps))
+	ips := make([]string, 0, len(vmIps))
 	for _, ip := range vmIps {
 		ips = append(ips, ip)
 	}
 	rand.Seed(time.Now().UnixNano())
 	rand.Shuffle(len(ips), func(i, j int) { ips[i], ips[j] = ips[j], ips[i] })
 	logger.Info().Msgf("ips: %s", ips)
-	jpool := &jrpc.Pool{
+	jpool = &jrpc.Pool{
 		Ips:     ips,
 		Clients: map[string]*jrpc.BaseClient{},
 		Active:  "",
 		Builder: jrpcBuilder,
 		Ctx:     ctx,
 	}
+	return
+}
+
+func GetClusterStatus(ctx context.Context, subscriptionId, resourceGroupName string, vmScaleSetNames []string, stateStorageName, stateContainerName, keyVaultUri string) (clusterStatus protocol.ClusterStatus, err error) {
+	logger := logging.LoggerFromCtx(ctx)
+	logger.Info().Msg("fetching cluster status...")
+
+	state, err := common.ReadState(ctx, stateStorageName, stateContainerName)
+	if err != nil {
+		return
+	}
+	clusterStatus.InitialSize = state.InitialSize
+	clusterStatus.DesiredSize = state.DesiredSize
+	clusterStatus.Clusterized = state.Clusterized
+	if !state.Clusterized {
+		return
+	}
+
+	jpool, err := GetScaleSetsJrpcPool(ctx, subscriptionId, resourceGroupName, vmScaleSetNames, keyVaultUri)
+	if err != nil {
+		return
+	}
 
 	var rawWekaStatus json.RawMessage
 
@@ -91,73 +105,159 @@ func GetClusterStatus(ctx context.Context, subscriptionId, resourceGroupName, vm
 	return
 }
 
-func Handler(w http.ResponseWriter, r *http.Request) {
-	outputs := make(map[string]interface{})
-	resData := make(map[string]interface{})
+const jrpcFilesystemsList weka.JrpcMethod = "filesystems_list"
 
-	subscriptionId := os.Getenv("SUBSCRIPTION_ID")
-	resourceGroupName := os.Getenv("RESOURCE_GROUP_NAME")
-	stateContainerName := os.Getenv("STATE_CONTAINER_NAME")
-	stateStorageName := os.Getenv("STATE_STORAGE_NAME")
-	prefix := os.Getenv("PREFIX")
-	clusterName := os.Getenv("CLUSTER_NAME")
-	keyVaultUri := os.Getenv("KEY_VAULT_URI")
+type ClusterSummary struct {
+	Clusterized            bool                `json:"clusterized"`
+	InitialSize            int                 `json:"initial_size"`
+	DesiredSize            int                 `json:"desired_size"`
+	IoStatus               string              `json:"io_status"`
+	ActiveBackends         int                 `json:"active_backends"`
+	TotalBackends          int                 `json:"total_backends"`
+	ActiveDrives           int                 `json:"active_drives"`
+	TotalDrives            int                 `json:"total_drives"`
+	Rebuilding             bool                `json:"rebuilding"`
+	RebuildProgressPercent float64             `json:"rebuild_progress_percent"`
+	ObsBuckets             map[string][]string `json:"obs_buckets"`
+}
 
-	ctx := r.Context()
+// weka status fields which are not part of protocol.WekaStatus
+type rebuildStatus struct {
+	Rebuild struct {
+		ProgressPercent float64 `json:"progressPercent"`
+		ProtectionState []struct {
+			MiB         float64 `json:"MiB"`
+			NumFailures int     `json:"numFailures"`
+		} `json:"protectionState"`
+	} `json:"rebuild"`
+}
+
+type filesystemInfo struct {
+	Name       string `json:"name"`
+	ObsBuckets []struct {
+		Name string `json:"name"`
+	} `json:"obs_buckets"`
+}
+
+// GetClusterSummary aggregates the state blob and the weka api into a short cluster health summary
+func GetClusterSummary(ctx context.Context, subscriptionId, resourceGroupName string, vmScaleSetNames []string, stateStorageName, stateContainerName, keyVaultUri string) (summary ClusterSummary, err error) {
 	logger := logging.LoggerFromCtx(ctx)
+	logger.Info().Msg("fetching cluster summary...")
 
-	var invokeRequest common.InvokeRequest
+	state, err := common.ReadState(ctx, stateStorageName, stateContainerName)
+	if err != nil {
+		return
+	}
+	summary.InitialSize = state.InitialSize
+	summary.DesiredSize = state.DesiredSize
+	summary.Clusterized = state.Clusterized
+	if !state.Clusterized {
+		return
+	}
 
-	var requestBody struct {
-		Type string `json:"type"`
+	jpool, err := GetScaleSetsJrpcPool(ctx, subscriptionId, resourceGroupName, vmScaleSetNames, keyVaultUri)
+	if err != nil {
+		return
 	}
 
-	if err := json.NewDecoder(r.Body).Decode(&invokeRequest); err != nil {
-		err = fmt.Errorf("cannot decode the request: %v", err)
-		logger.Error().Err(err).Send()
-		w.WriteHeader(http.StatusBadRequest)
+	var rawWekaStatus json.RawMessage
+	err = jpool.Call(weka.JrpcStatus, struct{}{}, &rawWekaStatus)
+	if err != nil {
+		return
+	}
+
+	wekaStatus := protocol.WekaStatus{}
+	if err = json.Unmarshal(rawWekaStatus, &wekaStatus); err != nil {
+		return
+	}
+	summary.IoStatus = wekaStatus.IoStatus
+	summary.ActiveBackends = wekaStatus.Hosts.Backends.Active
+	summary.TotalBackends = wekaStatus.Hosts.Backends.Total
+	summary.ActiveDrives = wekaStatus.Drives.Active
+	summary.TotalDrives = wekaStatus.Drives.Total
+
+	rebuild := rebuildStatus{}
+	if err = json.Unmarshal(rawWekaStatus, &rebuild); err != nil {
+		return
+	}
+	summary.RebuildProgressPercent = rebuild.Rebuild.ProgressPercent
+	for _, protectionState := range rebuild.Rebuild.ProtectionState {
+		if protectionState.NumFailures > 0 && protectionState.MiB > 0 {
+			summary.Rebuilding = true
+		}
+	}
+
+	filesystems := map[string]filesystemInfo{}
+	err = jpool.Call(jrpcFilesystemsList, struct{}{}, &filesystems)
+	if err != nil {
 		return
 	}
+	summary.ObsBuckets = make(map[string][]string)
+	for _, fs := range filesystems {
+		for _, bucket := range fs.ObsBuckets {
+			summary.ObsBuckets[fs.Name] = append(summary.ObsBuckets[fs.Name], bucket.Name)
+		}
+	}
+
+	return
+}
 
-	var reqData map[string]interface{}
-	err := json.Unmarshal(invokeRequest.Data["req"], &reqData)
+func Handler(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	subscriptionId := common.Getenv(ctx, "SUBSCRIPTION_ID")
+	resourceGroupName := common.Getenv(ctx, "RESOURCE_GROUP_NAME")
+	stateContainerName := common.Getenv(ctx, "STATE_CONTAINER_NAME")
+	stateStorageName := common.Getenv(ctx, "STATE_STORAGE_NAME")
+	prefix := common.Getenv(ctx, "PREFIX")
+	clusterName := common.Getenv(ctx, "CLUSTER_NAME")
+	keyVaultUri := common.Getenv(ctx, "KEY_VAULT_URI")
+
+	logger := logging.LoggerFromCtx(ctx)
+
+	var requestBody struct {
+		Type string `json:"type"`
+	}
+
+	reqData, err := common.ParseInvokeRequest(r)
 	if err != nil {
-		err = fmt.Errorf("cannot unmarshal the request data: %v", err)
+		err = fmt.Errorf("cannot decode the request: %v", err)
 		logger.Error().Err(err).Send()
-		w.WriteHeader(http.StatusBadRequest)
+		common.WriteErrorResponse(w, http.StatusBadRequest, err)
 		return
 	}
 
-	if reqData["Body"] != nil {
-		if json.Unmarshal([]byte(reqData["Body"].(string)), &requestBody) != nil {
+	if body := common.GetRequestBody(reqData); body != "" {
+		if err = json.Unmarshal([]byte(body), &requestBody); err != nil {
 			err = fmt.Errorf("cannot unmarshal the request body: %v", err)
 			logger.Error().Err(err).Send()
-			w.WriteHeader(http.StatusBadRequest)
+			common.WriteErrorResponse(w, http.StatusBadRequest, err)
 			return
 		}
 	}
 
-	vmScaleSetName := common.GetVmScaleSetName(prefix, clusterName)
+	vmScaleSetNames := common.GetVmScaleSetNames(ctx, prefix, clusterName)
+	if requestBody.Type == "" {
+		requestBody.Type = "status"
+	}
 	var result interface{}
-	if requestBody.Type == "" || requestBody.Type == "status" {
-		result, err = GetClusterStatus(ctx, subscriptionId, resourceGroupName, vmScaleSetName, stateStorageName, stateContainerName, keyVaultUri)
+	if requestBody.Type == "status" {
+		result, err = GetClusterStatus(ctx, subscriptionId, resourceGroupName, vmScaleSetNames, stateStorageName, stateContainerName, keyVaultUri)
+	} else if requestBody.Type == "summary" {
+		result, err = GetClusterSummary(ctx, subscriptionId, resourceGroupName, vmScaleSetNames, stateStorageName, stateContainerName, keyVaultUri)
 	} else if requestBody.Type == "progress" {
 		result, err = GetReports(ctx, stateStorageName, stateContainerName)
+	} else if requestBody.Type == "phase" {
+		result, err = common.GetDeploymentPhase(ctx, stateStorageName, stateContainerName)
+	} else if requestBody.Type == "weka_home" {
+		result, err = common.GetWekaHomeStatus(ctx, stateStorageName, stateContainerName)
 	} else {
-		result = "Invalid status type"
+		common.WriteErrorResponse(w, http.StatusBadRequest, fmt.Errorf("invalid status type %s", requestBody.Type))
+		return
 	}
 
 	if err != nil {
-		resData["body"] = err.Error()
-	} else {
-
-		resData["body"] = result
+		common.WriteErrorResponse(w, common.GetErrorStatusCode(err), err)
+		return
 	}
-	outputs["res"] = resData
-	invokeResponse := common.InvokeResponse{Outputs: outputs, Logs: nil, ReturnValue: nil}
-
-	responseJson, _ := json.Marshal(invokeResponse)
-
-	w.Header().Set("Content-Type", "application/json")
-	w.Write(responseJson)
+	common.WriteResponse(w, http.StatusOK, fmt.Sprintf("cluster %s", requestBody.Type), result)
 }
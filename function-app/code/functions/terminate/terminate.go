@@ -6,7 +6,6 @@ import (
 	"errors"
 	"fmt"
 	"net/http"
-	"os"
 	"strings"
 	"time"
 	"weka-deployment/common"
@@ -90,6 +89,15 @@ func getInstancePowerState(instance *armcompute.VirtualMachineScaleSetVM) (power
 	return
 }
 
+func excludeWarmPoolInstances(instances []*armcompute.VirtualMachineScaleSetVM, warmPool common.WarmPool) (filtered []*armcompute.VirtualMachineScaleSetVM) {
+	for _, instance := range instances {
+		if _, ok := warmPool[*instance.Name]; !ok {
+			filtered = append(filtered, instance)
+		}
+	}
+	return
+}
+
 func terminateUnneededInstances(ctx context.Context, subscriptionId, resourceGroupName, vmScaleSetName string, instances []*armcompute.VirtualMachineScaleSetVM, explicitRemoval []protocol.HgInstance) (terminatedInstancesMap instancesMap, errs []error) {
 	logger := logging.LoggerFromCtx(ctx)
 
@@ -155,6 +163,24 @@ func getScaleSetVmsExpandedView(ctx context.Context, subscriptionId, resourceGro
 	return common.GetScaleSetInstances(ctx, subscriptionId, resourceGroupName, vmScaleSetName, &expand)
 }
 
+func isExcluded(instanceId string, excludeInstanceIds []string) bool {
+	for _, excludedId := range excludeInstanceIds {
+		if instanceId == excludedId {
+			return true
+		}
+	}
+	return false
+}
+
+// isProtected returns true only when both scale in and scale set actions protection are set
+func isProtected(vm *armcompute.VirtualMachineScaleSetVM) bool {
+	policy := vm.Properties.ProtectionPolicy
+	if policy == nil || policy.ProtectFromScaleIn == nil || policy.ProtectFromScaleSetActions == nil {
+		return false
+	}
+	return *policy.ProtectFromScaleIn && *policy.ProtectFromScaleSetActions
+}
+
 func setDeletionProtection(ctx context.Context, allVms []*armcompute.VirtualMachineScaleSetVM, excludeInstanceIds []string, subscriptionId, resourceGroupName, vmScaleSetName, stateContainerName, stateStorageName string) {
 	logger := logging.LoggerFromCtx(ctx)
 
@@ -162,17 +188,12 @@ func setDeletionProtection(ctx context.Context, allVms []*armcompute.VirtualMach
 	var vmsWithoutProtection []VmInfo
 
 	for _, vm := range allVms {
-		protectionPolicyExists := vm.Properties.ProtectionPolicy != nil && vm.Properties.ProtectionPolicy.ProtectFromScaleSetActions != nil
-		protected := protectionPolicyExists && *vm.Properties.ProtectionPolicy.ProtectFromScaleSetActions
 		instanceId := common.GetScaleSetVmId(*vm.ID)
-
-		for _, excludedId := range excludeInstanceIds {
-			if instanceId == excludedId {
-				logger.Debugf("Instance %s is chosen for termination, no need to protect", instanceId)
-				continue
-			}
+		if isExcluded(instanceId, excludeInstanceIds) {
+			logger.Debugf("Instance %s is chosen for termination, no need to protect", instanceId)
+			continue
 		}
-		if !protected {
+		if !isProtected(vm) {
 			vmInfo := VmInfo{HostName: *vm.Properties.OSProfile.ComputerName, InstanceId: instanceId}
 			vmsWithoutProtection = append(vmsWithoutProtection, vmInfo)
 		}
@@ -187,6 +208,22 @@ func setDeletionProtection(ctx context.Context, allVms []*armcompute.VirtualMach
 	}
 }
 
+// deregisterBackendDnsRecords deletes the private dns records of the terminated instances, failures are only logged
+func deregisterBackendDnsRecords(ctx context.Context, vmScaleSetName string, instanceIds []string) {
+	if !common.IsBackendDnsEnabled(ctx) || len(instanceIds) == 0 {
+		return
+	}
+	logger := logging.LoggerFromCtx(ctx)
+
+	var vmNames []string
+	for _, instanceId := range instanceIds {
+		vmNames = append(vmNames, fmt.Sprintf("%s_%s", vmScaleSetName, instanceId))
+	}
+	if err := common.DeregisterBackendDnsRecords(ctx, vmNames); err != nil {
+		logger.Error().Err(err).Msg("failed to delete the backend dns records")
+	}
+}
+
 func Terminate(ctx context.Context, scaleResponse protocol.ScaleResponse, subscriptionId, resourceGroupName, vmScaleSetName, stateContainerName, stateStorageName string) (response protocol.TerminatedInstancesResponse, err error) {
 	logger := logging.LoggerFromCtx(ctx)
 	logger.Info().Msg("Running termination function...")
@@ -219,6 +256,7 @@ func Terminate(ctx context.Context, scaleResponse protocol.ScaleResponse, subscr
 	unhealthyInstanceIds := getUnhealthyInstancesToTerminate(ctx, vms)
 	errs := terminateUnhealthyInstances(ctx, subscriptionId, resourceGroupName, vmScaleSetName, unhealthyInstanceIds)
 	response.AddTransientErrors(errs)
+	deregisterBackendDnsRecords(ctx, vmScaleSetName, unhealthyInstanceIds)
 
 	logger.Info().Msgf("Instances set for explicit removal: %s", scaleResponse.ToTerminate)
 	deltaInstanceIds, err := getDeltaInstancesIds(ctx, subscriptionId, resourceGroupName, vmScaleSetName, scaleResponse)
@@ -243,9 +281,23 @@ func Terminate(ctx context.Context, scaleResponse protocol.ScaleResponse, subscr
 		return
 	}
 
+	// the warm pool vms are not in the cluster on purpose
+	warmPool, err := common.GetWarmPool(ctx, stateStorageName, stateContainerName)
+	if err != nil {
+		logger.Error().Msgf("%s", err)
+		return
+	}
+	candidatesToTerminate = excludeWarmPoolInstances(candidatesToTerminate, warmPool)
+
 	terminatedInstancesMap, errs := terminateUnneededInstances(ctx, subscriptionId, resourceGroupName, vmScaleSetName, candidatesToTerminate, scaleResponse.ToTerminate)
 	response.AddTransientErrors(errs)
 
+	var terminatedInstanceIds []string
+	for instanceId := range terminatedInstancesMap {
+		terminatedInstanceIds = append(terminatedInstanceIds, instanceId)
+	}
+	deregisterBackendDnsRecords(ctx, vmScaleSetName, terminatedInstanceIds)
+
 	for instanceId, instance := range terminatedInstancesMap {
 		terminatedInstance := protocol.TerminatedInstance{
 			InstanceId: instanceId,
@@ -262,14 +314,14 @@ func Terminate(ctx context.Context, scaleResponse protocol.ScaleResponse, subscr
 }
 
 func Handler(w http.ResponseWriter, r *http.Request) {
-	subscriptionId := os.Getenv("SUBSCRIPTION_ID")
-	resourceGroupName := os.Getenv("RESOURCE_GROUP_NAME")
-	prefix := os.Getenv("PREFIX")
-	clusterName := os.Getenv("CLUSTER_NAME")
-	stateContainerName := os.Getenv("STATE_CONTAINER_NAME")
-	stateStorageName := os.Getenv("STATE_STORAGE_NAME")
-
 	ctx := r.Context()
+	subscriptionId := common.Getenv(ctx, "SUBSCRIPTION_ID")
+	resourceGroupName := common.Getenv(ctx, "RESOURCE_GROUP_NAME")
+	prefix := common.Getenv(ctx, "PREFIX")
+	clusterName := common.Getenv(ctx, "CLUSTER_NAME")
+	stateContainerName := common.Getenv(ctx, "STATE_CONTAINER_NAME")
+	stateStorageName := common.Getenv(ctx, "STATE_STORAGE_NAME")
+
 	logger := logging.LoggerFromCtx(ctx)
 
 	vmScaleSetName := fmt.Sprintf("%s-%s-vmss", prefix, clusterName)
@@ -308,6 +360,7 @@ func Handler(w http.ResponseWriter, r *http.Request) {
 	outputs["res"] = resData
 	invokeResponse := common.InvokeResponse{Outputs: outputs, Logs: nil, ReturnValue: nil}
 
+	// the body stays the raw terminate response, the logic app passes it to transient as its request body
 	responseJson, _ := json.Marshal(invokeResponse)
 
 	w.Header().Set("Content-Type", "application/json")
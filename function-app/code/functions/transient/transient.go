@@ -50,6 +50,8 @@ func Handler(w http.ResponseWriter, r *http.Request) {
 	outputs["res"] = resData
 	invokeResponse := common.InvokeResponse{Outputs: outputs, Logs: nil, ReturnValue: nil}
 
+	// the body stays raw like the bodies of the previous scale down steps, it shows the transient errors in the logic
+	// app run history
 	responseJson, _ := json.Marshal(invokeResponse)
 
 	w.Header().Set("Content-Type", "application/json")
@@ -0,0 +1,499 @@
+package upgrade
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+	"weka-deployment/common"
+	"weka-deployment/functions/status"
+	"weka-deployment/functions/version_migration"
+
+	"github.com/weka/go-cloud-lib/lib/weka"
+	"github.com/weka/go-cloud-lib/logging"
+	"github.com/weka/go-cloud-lib/protocol"
+)
+
+const (
+	// a vm whose containers didn't rejoin the cluster in time fails the upgrade
+	verifyTimeout = 30 * time.Minute
+	// a claimed vm whose run command token wasn't saved (the invocation died) is upgraded again
+	runCommandStartTimeout = 10 * time.Minute
+)
+
+type RequestBody struct {
+	// start (default when to_version is set), resume, abort or status (default)
+	Action      string `json:"action"`
+	FromVersion string `json:"from_version"`
+	ToVersion   string `json:"to_version"`
+	DownloadUrl string `json:"download_url"`
+}
+
+type UpgradeParams struct {
+	SubscriptionId     string
+	ResourceGroupName  string
+	VmScaleSetNames    []string
+	StateStorageName   string
+	StateContainerName string
+	KeyVaultUri        string
+}
+
+// hosts_list fields which are not part of weka.Host
+type upgradedHost struct {
+	HostIp          string `json:"host_ip"`
+	State           string `json:"state"`
+	Status          string `json:"status"`
+	SwReleaseString string `json:"sw_release_string"`
+}
+
+type rebuildStatus struct {
+	Rebuild struct {
+		ProtectionState []struct {
+			MiB         float64 `json:"MiB"`
+			NumFailures int     `json:"numFailures"`
+		} `json:"protectionState"`
+	} `json:"rebuild"`
+}
+
+func GetUpgradeParams(ctx context.Context) UpgradeParams {
+	return UpgradeParams{
+		SubscriptionId:     common.Getenv(ctx, "SUBSCRIPTION_ID"),
+		ResourceGroupName:  common.Getenv(ctx, "RESOURCE_GROUP_NAME"),
+		VmScaleSetNames:    common.GetVmScaleSetNames(ctx, common.Getenv(ctx, "PREFIX"), common.Getenv(ctx, "CLUSTER_NAME")),
+		StateStorageName:   common.Getenv(ctx, "STATE_STORAGE_NAME"),
+		StateContainerName: common.Getenv(ctx, "STATE_CONTAINER_NAME"),
+		KeyVaultUri:        common.Getenv(ctx, "KEY_VAULT_URI"),
+	}
+}
+
+// upgradeSucceeded looks for the success messages of the version migration script in the run command output
+func upgradeSucceeded(output string) bool {
+	return strings.Contains(output, "weka upgraded from") || strings.Contains(output, "weka is already running version")
+}
+
+// clusterReady checks the cluster io is started and no rebuild is running, when vmIp is set it also checks the
+// vm containers are up and active on the target version
+func clusterReady(ctx context.Context, p UpgradeParams, vmIp, version string) (ready bool, reason string, err error) {
+	logger := logging.LoggerFromCtx(ctx)
+
+	jpool, err := status.GetScaleSetsJrpcPool(ctx, p.SubscriptionId, p.ResourceGroupName, p.VmScaleSetNames, p.KeyVaultUri)
+	if err != nil {
+		return
+	}
+
+	var rawWekaStatus json.RawMessage
+	err = jpool.Call(weka.JrpcStatus, struct{}{}, &rawWekaStatus)
+	if err != nil {
+		logger.Error().Err(err).Send()
+		return
+	}
+	wekaStatus := protocol.WekaStatus{}
+	if err = json.Unmarshal(rawWekaStatus, &wekaStatus); err != nil {
+		return
+	}
+	if wekaStatus.IoStatus != "STARTED" {
+		reason = fmt.Sprintf("cluster io status is %s", wekaStatus.IoStatus)
+		return
+	}
+	rebuild := rebuildStatus{}
+	if err = json.Unmarshal(rawWekaStatus, &rebuild); err != nil {
+		return
+	}
+	for _, protectionState := range rebuild.Rebuild.ProtectionState {
+		if protectionState.NumFailures > 0 && protectionState.MiB > 0 {
+			reason = "cluster is rebuilding"
+			return
+		}
+	}
+
+	if vmIp != "" {
+		hosts := map[weka.HostId]upgradedHost{}
+		err = jpool.Call(weka.JrpcHostList, struct{}{}, &hosts)
+		if err != nil {
+			logger.Error().Err(err).Send()
+			return
+		}
+		containers := 0
+		for hostId, host := range hosts {
+			if host.HostIp != vmIp {
+				continue
+			}
+			containers++
+			if host.Status != "UP" || host.State != "ACTIVE" {
+				reason = fmt.Sprintf("container %s of %s is %s/%s", hostId, vmIp, host.Status, host.State)
+				return
+			}
+			if host.SwReleaseString != "" && host.SwReleaseString != version {
+				reason = fmt.Sprintf("container %s of %s runs version %s", hostId, vmIp, host.SwReleaseString)
+				return
+			}
+		}
+		if containers == 0 {
+			reason = fmt.Sprintf("no containers of %s joined the cluster", vmIp)
+			return
+		}
+	}
+
+	ready = true
+	return
+}
+
+func failUpgrade(ctx context.Context, p UpgradeParams, cause error) (common.UpgradeState, error) {
+	logger := logging.LoggerFromCtx(ctx)
+	logger.Error().Err(cause).Msg("weka upgrade failed")
+
+	return common.UpdateUpgradeState(ctx, p.StateStorageName, p.StateContainerName, func(state *common.UpgradeState) error {
+		state.Status = common.UpgradeStatusFailed
+		state.Error = cause.Error()
+		return nil
+	})
+}
+
+// startNextVm claims the next pending vm and starts the upgrade script on it once the cluster is healthy
+func startNextVm(ctx context.Context, p UpgradeParams, state common.UpgradeState) (common.UpgradeState, error) {
+	logger := logging.LoggerFromCtx(ctx)
+
+	if len(state.Pending) == 0 {
+		logger.Info().Msgf("Weka upgrade to %s completed", state.ToVersion)
+		return common.UpdateUpgradeState(ctx, p.StateStorageName, p.StateContainerName, func(s *common.UpgradeState) error {
+			if s.Status != common.UpgradeStatusInProgress || s.Phase != "" || len(s.Pending) > 0 {
+				return common.ErrUpgradeStateUnchanged
+			}
+			s.Status = common.UpgradeStatusCompleted
+			return nil
+		})
+	}
+
+	vmName := state.Pending[0]
+	vmsPrivateIps, err := common.GetScaleSetsVmsPrivateIps(ctx, p.SubscriptionId, p.ResourceGroupName, p.VmScaleSetNames)
+	if err != nil {
+		return state, err
+	}
+	if _, ok := vmsPrivateIps[vmName]; !ok {
+		logger.Info().Msgf("Vm %s no longer exists, skipping its upgrade", vmName)
+		return common.UpdateUpgradeState(ctx, p.StateStorageName, p.StateContainerName, func(s *common.UpgradeState) error {
+			if len(s.Pending) == 0 || s.Pending[0] != vmName {
+				return common.ErrUpgradeStateUnchanged
+			}
+			s.Pending = s.Pending[1:]
+			return nil
+		})
+	}
+
+	ready, reason, err := clusterReady(ctx, p, "", "")
+	if err != nil {
+		return state, err
+	}
+	if !ready {
+		logger.Info().Msgf("Waiting to upgrade %s: %s", vmName, reason)
+		return state, nil
+	}
+
+	// the vm containers are down during the upgrade
+	jpool, err := status.GetScaleSetsJrpcPool(ctx, p.SubscriptionId, p.ResourceGroupName, p.VmScaleSetNames, p.KeyVaultUri)
+	if err != nil {
+		return state, err
+	}
+	veto, err := common.CheckQuorum(ctx, jpool, common.DestructiveOperation{
+		Name:    fmt.Sprintf("upgrade of %s", vmName),
+		DownIps: []string{vmsPrivateIps[vmName]},
+	})
+	if err != nil {
+		return state, err
+	}
+	if veto != nil {
+		if state.Veto != nil && *state.Veto == *veto {
+			return state, nil
+		}
+		return common.UpdateUpgradeState(ctx, p.StateStorageName, p.StateContainerName, func(s *common.UpgradeState) error {
+			if s.Status != common.UpgradeStatusInProgress || s.Phase != "" {
+				return common.ErrUpgradeStateUnchanged
+			}
+			s.Veto = veto
+			return nil
+		})
+	}
+
+	// only the invocation claiming the vm starts the upgrade script
+	state, err = common.UpdateUpgradeState(ctx, p.StateStorageName, p.StateContainerName, func(s *common.UpgradeState) error {
+		if s.Status != common.UpgradeStatusInProgress || s.Phase != "" || len(s.Pending) == 0 || s.Pending[0] != vmName {
+			return common.ErrUpgradeStateUnchanged
+		}
+		s.Pending = s.Pending[1:]
+		s.Current = vmName
+		s.Phase = common.UpgradePhaseUpgrade
+		s.PhaseStartedAt = time.Now().UTC()
+		s.RunCommandToken = ""
+		s.Veto = nil
+		return nil
+	})
+	if err != nil {
+		return state, err
+	}
+
+	logger.Info().Msgf("Upgrading %s to weka %s", vmName, state.ToVersion)
+	script := version_migration.GetWekaVersionMigrationScript(state.FromVersion, state.ToVersion, state.DownloadUrl)
+	token, err := common.StartScaleSetVmRunCommand(
+		ctx, p.SubscriptionId, p.ResourceGroupName, common.GetVmScaleSetNameFromVmName(vmName), common.GetScaleSetVmIndex(vmName), script)
+	if err != nil {
+		return failUpgrade(ctx, p, fmt.Errorf("failed to start the upgrade of %s: %w", vmName, err))
+	}
+
+	return common.UpdateUpgradeState(ctx, p.StateStorageName, p.StateContainerName, func(s *common.UpgradeState) error {
+		if s.Current != vmName || s.Phase != common.UpgradePhaseUpgrade {
+			return common.ErrUpgradeStateUnchanged
+		}
+		s.RunCommandToken = token
+		return nil
+	})
+}
+
+// checkVmUpgrade moves the current vm to verification once its upgrade script is done
+func checkVmUpgrade(ctx context.Context, p UpgradeParams, state common.UpgradeState) (common.UpgradeState, error) {
+	logger := logging.LoggerFromCtx(ctx)
+	vmName := state.Current
+
+	if state.RunCommandToken == "" {
+		if time.Since(state.PhaseStartedAt) < runCommandStartTimeout {
+			return state, nil
+		}
+		// the script is safe to run again, it exits early when the vm already runs the target version
+		logger.Info().Msgf("The upgrade of %s was not started, retrying", vmName)
+		return common.UpdateUpgradeState(ctx, p.StateStorageName, p.StateContainerName, func(s *common.UpgradeState) error {
+			if s.Current != vmName || s.Phase != common.UpgradePhaseUpgrade || s.RunCommandToken != "" {
+				return common.ErrUpgradeStateUnchanged
+			}
+			s.Pending = append([]string{vmName}, s.Pending...)
+			s.Current = ""
+			s.Phase = ""
+			return nil
+		})
+	}
+
+	done, output, err := common.PollScaleSetVmRunCommand(
+		ctx, p.SubscriptionId, p.ResourceGroupName, common.GetVmScaleSetNameFromVmName(vmName), common.GetScaleSetVmIndex(vmName), state.RunCommandToken)
+	if !done {
+		// polling errors are retried by the next invocation
+		return state, err
+	}
+	if err != nil {
+		return failUpgrade(ctx, p, fmt.Errorf("upgrade of %s failed: %w", vmName, err))
+	}
+	if !upgradeSucceeded(output) {
+		return failUpgrade(ctx, p, fmt.Errorf("upgrade of %s failed: %s", vmName, output))
+	}
+
+	logger.Info().Msgf("Upgrade script of %s is done, verifying it rejoined the cluster", vmName)
+	return common.UpdateUpgradeState(ctx, p.StateStorageName, p.StateContainerName, func(s *common.UpgradeState) error {
+		if s.Current != vmName || s.Phase != common.UpgradePhaseUpgrade {
+			return common.ErrUpgradeStateUnchanged
+		}
+		s.Phase = common.UpgradePhaseVerify
+		s.PhaseStartedAt = time.Now().UTC()
+		s.RunCommandToken = ""
+		return nil
+	})
+}
+
+// verifyVm completes the current vm once its containers rejoined the cluster on the target version
+func verifyVm(ctx context.Context, p UpgradeParams, state common.UpgradeState) (common.UpgradeState, error) {
+	logger := logging.LoggerFromCtx(ctx)
+	vmName := state.Current
+
+	vmsPrivateIps, err := common.GetScaleSetsVmsPrivateIps(ctx, p.SubscriptionId, p.ResourceGroupName, p.VmScaleSetNames)
+	if err != nil {
+		return state, err
+	}
+	vmIp, ok := vmsPrivateIps[vmName]
+	if !ok {
+		return failUpgrade(ctx, p, fmt.Errorf("vm %s was removed during its upgrade", vmName))
+	}
+
+	ready, reason, err := clusterReady(ctx, p, vmIp, state.ToVersion)
+	if err != nil {
+		return state, err
+	}
+	if !ready {
+		if time.Since(state.PhaseStartedAt) > verifyTimeout {
+			return failUpgrade(ctx, p, fmt.Errorf("%s didn't rejoin the cluster after %s: %s", vmName, verifyTimeout, reason))
+		}
+		logger.Info().Msgf("Waiting for %s to rejoin the cluster: %s", vmName, reason)
+		return state, nil
+	}
+
+	logger.Info().Msgf("Vm %s was upgraded to weka %s", vmName, state.ToVersion)
+	return common.UpdateUpgradeState(ctx, p.StateStorageName, p.StateContainerName, func(s *common.UpgradeState) error {
+		if s.Current != vmName || s.Phase != common.UpgradePhaseVerify {
+			return common.ErrUpgradeStateUnchanged
+		}
+		s.Completed = append(s.Completed, vmName)
+		s.Current = ""
+		s.Phase = ""
+		return nil
+	})
+}
+
+// Advance moves the upgrade in progress one step forward, it is called by the upgrade_step timer and the upgrade
+// function, all the progress is kept in the upgrade blob so any invocation can continue the upgrade
+func Advance(ctx context.Context, p UpgradeParams) (state common.UpgradeState, err error) {
+	state, err = common.GetUpgradeState(ctx, p.StateStorageName, p.StateContainerName)
+	if err != nil || state.Status != common.UpgradeStatusInProgress {
+		return
+	}
+
+	switch state.Phase {
+	case "":
+		state, err = startNextVm(ctx, p, state)
+	case common.UpgradePhaseUpgrade:
+		state, err = checkVmUpgrade(ctx, p, state)
+	case common.UpgradePhaseVerify:
+		state, err = verifyVm(ctx, p, state)
+	}
+	if errors.Is(err, common.ErrUpgradeStateUnchanged) {
+		// another invocation already made this step
+		return common.GetUpgradeState(ctx, p.StateStorageName, p.StateContainerName)
+	}
+	return
+}
+
+// Start rolls the target version through the backends one vm (failure domain) at a time
+func Start(ctx context.Context, p UpgradeParams, body RequestBody) (state common.UpgradeState, err error) {
+	logger := logging.LoggerFromCtx(ctx)
+
+	clusterState, err := common.ReadState(ctx, p.StateStorageName, p.StateContainerName)
+	if err != nil {
+		return
+	}
+	if !clusterState.Clusterized {
+		err = errors.New("cluster is not clusterized yet")
+		return
+	}
+
+	vmsPrivateIps, err := common.GetScaleSetsVmsPrivateIps(ctx, p.SubscriptionId, p.ResourceGroupName, p.VmScaleSetNames)
+	if err != nil {
+		return
+	}
+	vmNames := make([]string, 0, len(vmsPrivateIps))
+	for vmName := range vmsPrivateIps {
+		vmNames = append(vmNames, vmName)
+	}
+	sort.Strings(vmNames)
+
+	state, err = common.UpdateUpgradeState(ctx, p.StateStorageName, p.StateContainerName, func(s *common.UpgradeState) error {
+		if s.Status == common.UpgradeStatusInProgress {
+			return fmt.Errorf("upgrade to %s is already in progress", s.ToVersion)
+		}
+		now := time.Now().UTC()
+		*s = common.UpgradeState{
+			FromVersion: body.FromVersion,
+			ToVersion:   body.ToVersion,
+			DownloadUrl: body.DownloadUrl,
+			Status:      common.UpgradeStatusInProgress,
+			Pending:     vmNames,
+			Completed:   []string{},
+			StartedAt:   now,
+		}
+		return nil
+	})
+	if err != nil {
+		return
+	}
+	logger.Info().Msgf("Started weka upgrade from %s to %s of %d vms", body.FromVersion, body.ToVersion, len(vmNames))
+
+	return Advance(ctx, p)
+}
+
+// Resume continues a failed upgrade, a vm which failed in its upgrade script is upgraded again
+func Resume(ctx context.Context, p UpgradeParams) (state common.UpgradeState, err error) {
+	state, err = common.UpdateUpgradeState(ctx, p.StateStorageName, p.StateContainerName, func(s *common.UpgradeState) error {
+		if s.Status != common.UpgradeStatusFailed {
+			return fmt.Errorf("only a failed upgrade can be resumed, upgrade status is %q", s.Status)
+		}
+		s.Status = common.UpgradeStatusInProgress
+		s.Error = ""
+		if s.Phase == common.UpgradePhaseUpgrade {
+			s.Pending = append([]string{s.Current}, s.Pending...)
+			s.Current = ""
+			s.Phase = ""
+			s.RunCommandToken = ""
+		}
+		s.PhaseStartedAt = time.Now().UTC()
+		return nil
+	})
+	if err != nil {
+		return
+	}
+	return Advance(ctx, p)
+}
+
+// Abort stops rolling the upgrade to the next vms, an upgrade script already running on a vm is not interrupted
+func Abort(ctx context.Context, p UpgradeParams) (common.UpgradeState, error) {
+	return common.UpdateUpgradeState(ctx, p.StateStorageName, p.StateContainerName, func(s *common.UpgradeState) error {
+		if s.Status != common.UpgradeStatusInProgress && s.Status != common.UpgradeStatusFailed {
+			return fmt.Errorf("no upgrade to abort, upgrade status is %q", s.Status)
+		}
+		s.Status = common.UpgradeStatusAborted
+		return nil
+	})
+}
+
+func Handler(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	logger := logging.LoggerFromCtx(ctx)
+
+	reqData, err := common.ParseInvokeRequest(r)
+	if err != nil {
+		logger.Error().Msg("Bad request")
+		common.WriteErrorResponse(w, http.StatusBadRequest, fmt.Errorf("cannot decode the request: %v", err))
+		return
+	}
+
+	var body RequestBody
+	if reqBody := common.GetRequestBody(reqData); reqBody != "" {
+		if err = json.Unmarshal([]byte(reqBody), &body); err != nil {
+			logger.Error().Err(err).Msg("cannot unmarshal the request body")
+			common.WriteErrorResponse(w, http.StatusBadRequest, fmt.Errorf("cannot unmarshal the request body: %v", err))
+			return
+		}
+	}
+	if body.Action == "" {
+		body.Action = "status"
+		if body.ToVersion != "" {
+			body.Action = "start"
+		}
+	}
+
+	p := GetUpgradeParams(ctx)
+
+	var state common.UpgradeState
+	switch body.Action {
+	case "start":
+		if body.FromVersion == "" || body.ToVersion == "" || body.DownloadUrl == "" {
+			common.WriteErrorResponse(w, http.StatusBadRequest, errors.New("from_version, to_version and download_url are required"))
+			return
+		}
+		state, err = Start(ctx, p, body)
+	case "resume":
+		state, err = Resume(ctx, p)
+	case "abort":
+		state, err = Abort(ctx, p)
+	case "status":
+		state, err = common.GetUpgradeState(ctx, p.StateStorageName, p.StateContainerName)
+	default:
+		common.WriteErrorResponse(w, http.StatusBadRequest, fmt.Errorf("unknown action %q, expected start, resume, abort or status", body.Action))
+		return
+	}
+
+	if err != nil {
+		common.WriteErrorResponse(w, common.GetErrorStatusCode(err), err)
+		return
+	}
+	// the download url may hold a get.weka.io token
+	state.DownloadUrl = ""
+	state.RunCommandToken = ""
+	common.WriteResponse(w, http.StatusOK, fmt.Sprintf("upgrade %s", body.Action), state)
+}
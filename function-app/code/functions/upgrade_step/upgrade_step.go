@@ -0,0 +1,38 @@
+package upgrade_step
+
+import (
+	"encoding/json"
+	"net/http"
+	"weka-deployment/common"
+	"weka-deployment/functions/upgrade"
+
+	"github.com/weka/go-cloud-lib/logging"
+)
+
+// Handler is timer triggered, it keeps an upgrade rolling after the invocation which started it returned
+// and resumes it after function restarts
+func Handler(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	logger := logging.LoggerFromCtx(ctx)
+
+	var invokeRequest common.InvokeRequest
+	if err := json.NewDecoder(r.Body).Decode(&invokeRequest); err != nil {
+		logger.Error().Msg("Bad request")
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	state, err := upgrade.Advance(ctx, upgrade.GetUpgradeParams(ctx))
+	if err != nil {
+		logger.Error().Err(err).Msg("failed to advance the weka upgrade")
+	} else if state.Status == common.UpgradeStatusInProgress {
+		logger.Info().Msgf("Weka upgrade to %s: current %s (%s), %d pending, %d completed",
+			state.ToVersion, state.Current, state.Phase, len(state.Pending), len(state.Completed))
+	}
+
+	invokeResponse := common.InvokeResponse{Outputs: map[string]interface{}{}, Logs: nil, ReturnValue: nil}
+	responseJson, _ := json.Marshal(invokeResponse)
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(responseJson)
+}
@@ -0,0 +1,156 @@
+package validate_cluster
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+	"weka-deployment/common"
+	"weka-deployment/functions/azure_functions_def"
+	"weka-deployment/functions/clusterize"
+
+	"github.com/weka/go-cloud-lib/functions_def"
+	"github.com/weka/go-cloud-lib/logging"
+)
+
+const ActionValidate = "validate"
+
+var errNotClusterized = errors.New("cluster is not clusterized yet")
+
+type RequestBody struct {
+	// an empty action returns the result of the last validation
+	Action string `json:"action"`
+	// the default filesystem is validated when not set
+	Filesystem string `json:"filesystem"`
+}
+
+type ValidateClusterParams struct {
+	SubscriptionId     string
+	ResourceGroupName  string
+	StateStorageName   string
+	StateContainerName string
+	KeyVaultUri        string
+	FunctionAppName    string
+	Prefix             string
+	ClusterName        string
+	SetObs             bool
+}
+
+// ValidateCluster starts the io validation of the filesystem on a backend, the object store upload is checked too
+// when obs is attached
+func ValidateCluster(ctx context.Context, p ValidateClusterParams, body RequestBody, plan *common.DryRunPlan) (validation common.ClusterValidation, err error) {
+	state, err := common.ReadState(ctx, p.StateStorageName, p.StateContainerName)
+	if err != nil {
+		return
+	}
+	if !state.Clusterized {
+		err = errNotClusterized
+		return
+	}
+
+	filesystem := body.Filesystem
+	if filesystem == "" {
+		filesystem = common.DefaultFilesystemName
+	}
+
+	functionAppKey, err := common.GetKeyVaultValue(ctx, p.KeyVaultUri, "function-app-default-key")
+	if err != nil {
+		return
+	}
+	funcDef := azure_functions_def.NewFuncDef(ctx, common.GetFunctionAppBaseUrl(p.FunctionAppName), functionAppKey)
+	script := clusterize.GetClusterValidationScript(funcDef.GetFunctionCmdDefinition(functions_def.Report), filesystem, p.SetObs)
+
+	validation.Filesystem = filesystem
+	err = plan.Apply(ctx, fmt.Sprintf("validate filesystem %s io (obs upload: %t) on a backend", filesystem, p.SetObs), func() (applyErr error) {
+		// the validation is pending before the script starts, so the reported result is not overwritten
+		validation, applyErr = common.UpdateClusterValidation(ctx, p.StateStorageName, p.StateContainerName, func(v *common.ClusterValidation) {
+			*v = common.ClusterValidation{
+				Status:      common.ClusterValidationStatusPending,
+				Filesystem:  filesystem,
+				RequestedAt: time.Now().UTC(),
+			}
+		})
+		if applyErr != nil {
+			return
+		}
+		vmName, applyErr := common.StartBackendScript(
+			ctx, p.SubscriptionId, p.ResourceGroupName, p.StateStorageName, p.StateContainerName, p.KeyVaultUri, p.Prefix, p.ClusterName, script,
+		)
+		if applyErr != nil {
+			_, _ = common.UpdateClusterValidation(ctx, p.StateStorageName, p.StateContainerName, func(v *common.ClusterValidation) {
+				v.Status = common.ClusterValidationStatusUnknown
+				v.Message = applyErr.Error()
+			})
+			return
+		}
+		validation.Instance = vmName
+		return
+	})
+	return
+}
+
+func Handler(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	logger := logging.LoggerFromCtx(ctx)
+
+	setObs, _ := strconv.ParseBool(common.Getenv(ctx, "SET_OBS"))
+	p := ValidateClusterParams{
+		SubscriptionId:     common.Getenv(ctx, "SUBSCRIPTION_ID"),
+		ResourceGroupName:  common.Getenv(ctx, "RESOURCE_GROUP_NAME"),
+		StateStorageName:   common.Getenv(ctx, "STATE_STORAGE_NAME"),
+		StateContainerName: common.Getenv(ctx, "STATE_CONTAINER_NAME"),
+		KeyVaultUri:        common.Getenv(ctx, "KEY_VAULT_URI"),
+		FunctionAppName:    common.Getenv(ctx, "FUNCTION_APP_NAME"),
+		Prefix:             common.Getenv(ctx, "PREFIX"),
+		ClusterName:        common.Getenv(ctx, "CLUSTER_NAME"),
+		SetObs:             setObs,
+	}
+
+	reqData, err := common.ParseInvokeRequest(r)
+	if err != nil {
+		logger.Error().Msg("Bad request")
+		common.WriteErrorResponse(w, http.StatusBadRequest, fmt.Errorf("cannot decode the request: %v", err))
+		return
+	}
+
+	var data RequestBody
+	if body := common.GetRequestBody(reqData); body != "" {
+		if err = json.Unmarshal([]byte(body), &data); err != nil {
+			logger.Error().Err(err).Msg("cannot unmarshal the request body")
+			common.WriteErrorResponse(w, http.StatusBadRequest, fmt.Errorf("cannot unmarshal the request body: %v", err))
+			return
+		}
+	}
+
+	if data.Action == "" {
+		validation, err := common.GetClusterValidation(ctx, p.StateStorageName, p.StateContainerName)
+		if err != nil {
+			common.WriteErrorResponse(w, http.StatusInternalServerError, err)
+			return
+		}
+		common.WriteResponse(w, http.StatusOK, fmt.Sprintf("cluster validation %s", validation.Status), validation)
+		return
+	}
+	if data.Action != ActionValidate {
+		common.WriteErrorResponse(w, http.StatusBadRequest, fmt.Errorf("invalid action %s, expected %s", data.Action, ActionValidate))
+		return
+	}
+
+	var plan *common.DryRunPlan
+	if common.IsDryRun(reqData) {
+		plan = &common.DryRunPlan{}
+	}
+	validation, err := ValidateCluster(ctx, p, data, plan)
+	if errors.Is(err, errNotClusterized) {
+		common.WriteErrorResponse(w, http.StatusConflict, err)
+	} else if err != nil {
+		common.WriteErrorResponse(w, common.GetErrorStatusCode(err), err)
+	} else if plan.Enabled() {
+		common.WriteResponse(w, http.StatusOK, "dry run", plan.Response(""))
+	} else {
+		common.WriteResponse(w, http.StatusOK, fmt.Sprintf("cluster validation started on %s", validation.Instance), validation)
+	}
+}
@@ -0,0 +1,34 @@
+package validate_config
+
+import (
+	"net/http"
+	"weka-deployment/common"
+
+	"github.com/weka/go-cloud-lib/logging"
+)
+
+type ValidateConfigResponse struct {
+	Valid  bool                 `json:"valid"`
+	Issues []common.ConfigIssue `json:"issues"`
+}
+
+func Handler(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	logger := logging.LoggerFromCtx(ctx)
+
+	issues := common.ValidateConfig(ctx)
+	for _, issue := range issues {
+		logger.Error().Msgf("invalid app setting %s", issue)
+	}
+	response := ValidateConfigResponse{
+		Valid:  len(issues) == 0,
+		Issues: issues,
+	}
+
+	// the response lists the issues, the status code lets provisioners fail on an invalid configuration
+	if !response.Valid {
+		common.WriteResponse(w, http.StatusInternalServerError, common.ConfigIssuesError(issues).Error(), response)
+		return
+	}
+	common.WriteResponse(w, http.StatusOK, "function app settings are valid", response)
+}
@@ -0,0 +1,92 @@
+package version_migration
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"weka-deployment/common"
+
+	"github.com/lithammer/dedent"
+	"github.com/weka/go-cloud-lib/logging"
+)
+
+type RequestBody struct {
+	FromVersion string `json:"from_version"`
+	ToVersion   string `json:"to_version"`
+	DownloadUrl string `json:"download_url"`
+}
+
+// GetWekaVersionMigrationScript upgrades the local weka host from fromVersion to toVersion,
+// the host is rolled back to fromVersion if any of the upgrade steps fails
+func GetWekaVersionMigrationScript(fromVersion, toVersion, downloadUrl string) string {
+	template := `
+	#!/bin/bash
+	set -ex
+	FROM_VERSION=%s
+	TO_VERSION=%s
+	DOWNLOAD_URL="%s"
+
+	current_version=$(weka version current)
+	if [[ "$current_version" == "$TO_VERSION" ]]; then
+		echo "weka is already running version $TO_VERSION"
+		exit 0
+	fi
+	if [[ "$current_version" != "$FROM_VERSION" ]]; then
+		echo "weka is running version $current_version, expected $FROM_VERSION"
+		exit 1
+	fi
+
+	# pre-upgrade check
+	cluster_status=$(weka status -J | jq -r .status)
+	if [[ "$cluster_status" != "OK" ]]; then
+		echo "cluster status is $cluster_status, upgrade requires a healthy cluster"
+		exit 1
+	fi
+
+	function rollback {
+		echo "upgrade to $TO_VERSION failed, rolling back to $FROM_VERSION"
+		trap - ERR
+		weka local upgrade --target-version "$FROM_VERSION" || weka version set "$FROM_VERSION"
+		weka local start || true
+		exit 1
+	}
+	trap rollback ERR
+
+	# download new version
+	mkdir -p /opt/weka/tmp/upgrade
+	curl -fL "$DOWNLOAD_URL" -o /opt/weka/tmp/upgrade/weka-$TO_VERSION.tar
+	tar -xf /opt/weka/tmp/upgrade/weka-$TO_VERSION.tar -C /opt/weka/tmp/upgrade
+	cd /opt/weka/tmp/upgrade/weka-$TO_VERSION
+	./install.sh
+
+	# management processes are upgraded first, io processes are upgraded by the local upgrade
+	weka version prepare "$TO_VERSION"
+	weka local upgrade --target-version "$TO_VERSION"
+
+	trap - ERR
+	echo "weka upgraded from $FROM_VERSION to $(weka version current)"
+	`
+	return fmt.Sprintf(dedent.Dedent(template), fromVersion, toVersion, downloadUrl)
+}
+
+func Handler(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	logger := logging.LoggerFromCtx(ctx)
+
+	reqData, err := common.ParseInvokeRequest(r)
+	if err != nil {
+		logger.Error().Msg("Bad request")
+		common.WriteErrorResponse(w, http.StatusBadRequest, fmt.Errorf("cannot decode the request: %v", err))
+		return
+	}
+
+	var data RequestBody
+	if json.Unmarshal([]byte(common.GetRequestBody(reqData)), &data) != nil || data.FromVersion == "" || data.ToVersion == "" || data.DownloadUrl == "" {
+		logger.Error().Msg("Bad request")
+		common.WriteErrorResponse(w, http.StatusBadRequest, fmt.Errorf("wrong request format. from_version, to_version and download_url are required"))
+		return
+	}
+
+	logger.Info().Msgf("Generating weka version migration script from %s to %s", data.FromVersion, data.ToVersion)
+	common.WriteResponse(w, http.StatusOK, "version migration script generated", GetWekaVersionMigrationScript(data.FromVersion, data.ToVersion, data.DownloadUrl))
+}
@@ -0,0 +1,164 @@
+package weka_home
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+	"weka-deployment/common"
+	"weka-deployment/functions/azure_functions_def"
+	"weka-deployment/functions/clusterize"
+
+	"github.com/weka/go-cloud-lib/functions_def"
+	"github.com/weka/go-cloud-lib/logging"
+)
+
+const (
+	ActionValidate = "validate"
+	ActionUpdate   = "update"
+)
+
+var errNotClusterized = errors.New("cluster is not clusterized yet")
+
+type RequestBody struct {
+	// an empty action returns the weka home status
+	Action string `json:"action"`
+	// the current configuration is kept for the fields which are not set on update
+	Url      string  `json:"url"`
+	ProxyUrl *string `json:"proxy_url"`
+}
+
+type WekaHomeParams struct {
+	SubscriptionId     string
+	ResourceGroupName  string
+	StateStorageName   string
+	StateContainerName string
+	KeyVaultUri        string
+	FunctionAppName    string
+	Prefix             string
+	ClusterName        string
+}
+
+// ValidateWekaHome starts the weka home validation on a backend, after setting the weka home configuration on update
+func ValidateWekaHome(ctx context.Context, p WekaHomeParams, body RequestBody, plan *common.DryRunPlan) (status common.WekaHomeStatus, err error) {
+	state, err := common.ReadState(ctx, p.StateStorageName, p.StateContainerName)
+	if err != nil {
+		return
+	}
+	if !state.Clusterized {
+		err = errNotClusterized
+		return
+	}
+	status, err = common.GetWekaHomeStatus(ctx, p.StateStorageName, p.StateContainerName)
+	if err != nil {
+		return
+	}
+
+	update := body.Action == ActionUpdate
+	if update {
+		if body.Url != "" {
+			status.Url = body.Url
+		}
+		if body.ProxyUrl != nil {
+			status.ProxyUrl = *body.ProxyUrl
+		}
+	}
+
+	functionAppKey, err := common.GetKeyVaultValue(ctx, p.KeyVaultUri, "function-app-default-key")
+	if err != nil {
+		return
+	}
+	funcDef := azure_functions_def.NewFuncDef(ctx, common.GetFunctionAppBaseUrl(p.FunctionAppName), functionAppKey)
+	script := clusterize.GetWekaHomeScript(funcDef.GetFunctionCmdDefinition(functions_def.Report), status.Url, status.ProxyUrl, update)
+
+	err = plan.Apply(ctx, fmt.Sprintf("%s weka home %s (proxy: %q) on a backend", body.Action, status.Url, status.ProxyUrl), func() (applyErr error) {
+		// the status is pending before the script starts, so the reported result is not overwritten
+		status, applyErr = common.UpdateWekaHomeStatus(ctx, p.StateStorageName, p.StateContainerName, func(s *common.WekaHomeStatus) {
+			s.Url = status.Url
+			s.ProxyUrl = status.ProxyUrl
+			s.Status = common.WekaHomeStatusPending
+			s.Message = ""
+			s.Instance = ""
+			s.RequestedAt = time.Now().UTC()
+		})
+		if applyErr != nil {
+			return
+		}
+		vmName, applyErr := common.StartBackendScript(
+			ctx, p.SubscriptionId, p.ResourceGroupName, p.StateStorageName, p.StateContainerName, p.KeyVaultUri, p.Prefix, p.ClusterName, script,
+		)
+		if applyErr != nil {
+			_, _ = common.UpdateWekaHomeStatus(ctx, p.StateStorageName, p.StateContainerName, func(s *common.WekaHomeStatus) {
+				s.Status = common.WekaHomeStatusUnknown
+				s.Message = applyErr.Error()
+			})
+			return
+		}
+		status.Instance = vmName
+		return
+	})
+	return
+}
+
+func Handler(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	logger := logging.LoggerFromCtx(ctx)
+
+	p := WekaHomeParams{
+		SubscriptionId:     common.Getenv(ctx, "SUBSCRIPTION_ID"),
+		ResourceGroupName:  common.Getenv(ctx, "RESOURCE_GROUP_NAME"),
+		StateStorageName:   common.Getenv(ctx, "STATE_STORAGE_NAME"),
+		StateContainerName: common.Getenv(ctx, "STATE_CONTAINER_NAME"),
+		KeyVaultUri:        common.Getenv(ctx, "KEY_VAULT_URI"),
+		FunctionAppName:    common.Getenv(ctx, "FUNCTION_APP_NAME"),
+		Prefix:             common.Getenv(ctx, "PREFIX"),
+		ClusterName:        common.Getenv(ctx, "CLUSTER_NAME"),
+	}
+
+	reqData, err := common.ParseInvokeRequest(r)
+	if err != nil {
+		logger.Error().Msg("Bad request")
+		common.WriteErrorResponse(w, http.StatusBadRequest, fmt.Errorf("cannot decode the request: %v", err))
+		return
+	}
+
+	var data RequestBody
+	if body := common.GetRequestBody(reqData); body != "" {
+		if err = json.Unmarshal([]byte(body), &data); err != nil {
+			logger.Error().Err(err).Msg("cannot unmarshal the request body")
+			common.WriteErrorResponse(w, http.StatusBadRequest, fmt.Errorf("cannot unmarshal the request body: %v", err))
+			return
+		}
+	}
+
+	if data.Action == "" {
+		status, err := common.GetWekaHomeStatus(ctx, p.StateStorageName, p.StateContainerName)
+		if err != nil {
+			common.WriteErrorResponse(w, http.StatusInternalServerError, err)
+			return
+		}
+		common.WriteResponse(w, http.StatusOK, fmt.Sprintf("weka home is %s", status.Status), status)
+		return
+	}
+	if data.Action != ActionValidate && data.Action != ActionUpdate {
+		common.WriteErrorResponse(w, http.StatusBadRequest, fmt.Errorf("invalid action %s, expected %s or %s", data.Action, ActionValidate, ActionUpdate))
+		return
+	}
+
+	var plan *common.DryRunPlan
+	if common.IsDryRun(reqData) {
+		plan = &common.DryRunPlan{}
+	}
+	status, err := ValidateWekaHome(ctx, p, data, plan)
+	if errors.Is(err, errNotClusterized) {
+		common.WriteErrorResponse(w, http.StatusConflict, err)
+	} else if err != nil {
+		common.WriteErrorResponse(w, common.GetErrorStatusCode(err), err)
+	} else if plan.Enabled() {
+		common.WriteResponse(w, http.StatusOK, "dry run", plan.Response(""))
+	} else {
+		common.WriteResponse(w, http.StatusOK, fmt.Sprintf("weka home %s started on %s", data.Action, status.Instance), status)
+	}
+}
@@ -0,0 +1,92 @@
+package windows_client_mpio
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"weka-deployment/common"
+
+	"github.com/lithammer/dedent"
+	"github.com/weka/go-cloud-lib/logging"
+)
+
+type RequestBody struct {
+	// "linux" or "windows"
+	OS string `json:"os"`
+}
+
+func GetWekaMPIOScript(wekaVIPs []string) string {
+	var quotedVips []string
+	for _, vip := range wekaVIPs {
+		quotedVips = append(quotedVips, fmt.Sprintf("\"%s\"", vip))
+	}
+
+	template := `
+	$ErrorActionPreference = "Stop"
+	$WekaVips = @(%s)
+
+	Install-WindowsFeature -Name Multipath-IO, NFS-Client
+	Enable-MSDSMAutomaticClaim -BusType iSCSI
+	Set-MSDSMGlobalDefaultLoadBalancePolicy -Policy RR
+	Set-MPIOSetting -NewPathVerificationState Enabled -NewPathVerificationPeriod 30 -NewPDORemovePeriod 20
+
+	foreach ($vip in $WekaVips) {
+		if (-not (Test-NetConnection -ComputerName $vip -Port 2049).TcpTestSucceeded) {
+			Write-Error "weka nfs target $vip is not reachable"
+		}
+	}
+	Write-Output "MPIO configured for weka targets: $($WekaVips -join ', ')"
+	`
+	return fmt.Sprintf(dedent.Dedent(template), strings.Join(quotedVips, ", "))
+}
+
+func Handler(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	subscriptionId := common.Getenv(ctx, "SUBSCRIPTION_ID")
+	resourceGroupName := common.Getenv(ctx, "RESOURCE_GROUP_NAME")
+	prefix := common.Getenv(ctx, "PREFIX")
+	clusterName := common.Getenv(ctx, "CLUSTER_NAME")
+	nfsVips := common.Getenv(ctx, "NFS_VIPS")
+
+	logger := logging.LoggerFromCtx(ctx)
+
+	reqData, err := common.ParseInvokeRequest(r)
+	if err != nil {
+		logger.Error().Msg("Bad request")
+		common.WriteErrorResponse(w, http.StatusBadRequest, fmt.Errorf("cannot decode the request: %v", err))
+		return
+	}
+
+	var data RequestBody
+	if err = json.Unmarshal([]byte(common.GetRequestBody(reqData)), &data); err != nil {
+		logger.Error().Msg("Bad request")
+		common.WriteErrorResponse(w, http.StatusBadRequest, fmt.Errorf("wrong request format: %v", err))
+		return
+	}
+
+	switch data.OS {
+	case "windows":
+		var vips []string
+		if nfsVips != "" {
+			vips = strings.Split(nfsVips, ",")
+		} else {
+			// no floating ips were configured, fall back to the backends private ips
+			vmScaleSetNames := common.GetVmScaleSetNames(ctx, prefix, clusterName)
+			vmsPrivateIps, err := common.GetScaleSetsVmsPrivateIps(ctx, subscriptionId, resourceGroupName, vmScaleSetNames)
+			if err != nil {
+				common.WriteErrorResponse(w, http.StatusInternalServerError, err)
+				return
+			}
+			for _, ip := range vmsPrivateIps {
+				vips = append(vips, ip)
+			}
+		}
+		common.WriteResponse(w, http.StatusOK, "windows client mpio script generated", GetWekaMPIOScript(vips))
+	case "", "linux":
+		// linux clients use the weka client multipathing, there is nothing to configure
+		common.WriteResponse(w, http.StatusOK, "mpio configuration is not required for linux clients", nil)
+	default:
+		common.WriteErrorResponse(w, http.StatusBadRequest, fmt.Errorf("unsupported os: %s", data.OS))
+	}
+}
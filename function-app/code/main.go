@@ -1,22 +1,61 @@
 package main
 
 import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
 	"net/http"
 	"os"
+	"strings"
+	"weka-deployment/common"
+	"weka-deployment/functions/adopt"
+	"weka-deployment/functions/client_join_info"
+	"weka-deployment/functions/clusterization_timeout"
 	"weka-deployment/functions/clusterize"
 	"weka-deployment/functions/clusterize_finalization"
+	"weka-deployment/functions/clusterize_segments"
+	"weka-deployment/functions/configure_protocols"
+	"weka-deployment/functions/data_protection"
 	"weka-deployment/functions/debug"
 	"weka-deployment/functions/deploy"
+	"weka-deployment/functions/destroy_cleanup"
+	"weka-deployment/functions/drift"
+	"weka-deployment/functions/evict"
 	"weka-deployment/functions/fetch"
+	"weka-deployment/functions/force_clusterize"
+	"weka-deployment/functions/health"
+	"weka-deployment/functions/hot_spare"
+	"weka-deployment/functions/inventory"
+	"weka-deployment/functions/io_control"
 	"weka-deployment/functions/join_finalization"
+	"weka-deployment/functions/maintenance_mode"
+	"weka-deployment/functions/maintenance_window"
+	"weka-deployment/functions/metrics"
+	"weka-deployment/functions/progress"
 	"weka-deployment/functions/protect"
+	"weka-deployment/functions/repair"
+	"weka-deployment/functions/replace_drive"
 	"weka-deployment/functions/report"
 	"weka-deployment/functions/resize"
+	"weka-deployment/functions/restore_state"
+	"weka-deployment/functions/rotate_password"
+	"weka-deployment/functions/s3_presigned_url"
 	"weka-deployment/functions/scale_down"
 	"weka-deployment/functions/scale_up"
+	"weka-deployment/functions/set_config"
+	"weka-deployment/functions/state_backup"
 	"weka-deployment/functions/status"
 	"weka-deployment/functions/terminate"
 	"weka-deployment/functions/transient"
+	"weka-deployment/functions/upgrade"
+	"weka-deployment/functions/upgrade_step"
+	"weka-deployment/functions/validate_cluster"
+	"weka-deployment/functions/validate_config"
+	"weka-deployment/functions/version_migration"
+	"weka-deployment/functions/weka_home"
+	"weka-deployment/functions/windows_client_mpio"
 
 	"github.com/weka/go-cloud-lib/logging"
 )
@@ -29,6 +68,135 @@ func init() {
 	logger = logging.NewLogger()
 }
 
+// directInvocationMiddleware accepts the requests sent to the handler without the functions host, their plain
+// payload is wrapped in the custom handler envelope and the "res" output of the function is returned unwrapped
+func directInvocationMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		payload, err := io.ReadAll(r.Body)
+		if err != nil {
+			http.Error(w, fmt.Sprintf("cannot read the request: %v", err), http.StatusBadRequest)
+			return
+		}
+		if common.IsInvokeRequest(payload) {
+			r.Body = io.NopCloser(bytes.NewReader(payload))
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		invokeRequest, err := common.NewDirectInvokeRequest(r, payload)
+		if err != nil {
+			http.Error(w, fmt.Sprintf("cannot wrap the request: %v", err), http.StatusBadRequest)
+			return
+		}
+		logger.Debug().Msgf("direct invocation of %s", r.URL.Path)
+		r.Body = io.NopCloser(bytes.NewReader(invokeRequest))
+		r.ContentLength = int64(len(invokeRequest))
+		directWriter := common.NewDirectResponseWriter(w)
+		next.ServeHTTP(directWriter, r)
+		directWriter.Finish()
+	})
+}
+
+// clusterConfigMiddleware passes the settings snapshot the function runs with, refreshed from the config blob
+func clusterConfigMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		config, err := common.LoadClusterConfig(r.Context())
+		if err != nil {
+			logger.Error().Err(err).Msg("failed to load the cluster config, keeping the current settings")
+		}
+		next.ServeHTTP(w, r.WithContext(common.ContextWithClusterConfig(r.Context(), config)))
+	})
+}
+
+// instanceAuthFunctions are the functions called by the backend vms, fetch is called by the scale down logic app
+// with the function key only
+var instanceAuthFunctions = map[string]bool{
+	"/clusterize":              true,
+	"/clusterize_finalization": true,
+	"/clusterize_segments":     true,
+	"/deploy":                  true,
+	"/evict":                   true,
+	"/join_finalization":       true,
+	"/report":                  true,
+}
+
+// instanceAuthMiddleware checks the managed identity token of the vms calling the functions, in audit mode the
+// failures are only logged
+func instanceAuthMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mode := common.GetInstanceAuthMode(r.Context())
+		if mode == common.InstanceAuthDisabled || !instanceAuthFunctions[r.URL.Path] {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		body, err := io.ReadAll(r.Body)
+		r.Body = io.NopCloser(bytes.NewReader(body))
+		if err == nil {
+			err = common.AuthenticateInstanceRequest(r.Context(), body)
+		}
+		if err != nil {
+			if mode == common.InstanceAuthEnforce {
+				logger.Error().Err(err).Msgf("rejected the %s request", r.URL.Path)
+				common.WriteErrorResponse(w, http.StatusUnauthorized, err)
+				return
+			}
+			logger.Warn().Err(err).Msgf("the %s request would be rejected", r.URL.Path)
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// operationLockFunctions are the functions changing the cluster, they never run concurrently, the timer and logic
+// app triggered ones run again on their next trigger when the lock is held
+var operationLockFunctions = map[string]bool{
+	"/adopt":                  true,
+	"/clusterization_timeout": true,
+	"/data_protection":        true,
+	"/destroy_cleanup":        true,
+	"/force_clusterize":       true,
+	"/hot_spare":              true,
+	"/maintenance_mode":       true,
+	"/protect":                true,
+	"/repair":                 true,
+	"/replace_drive":          true,
+	"/resize":                 true,
+	"/restore_state":          true,
+	"/rotate_password":        true,
+	"/scale_down":             true,
+	"/set_config":             true,
+	"/start_io":               true,
+	"/stop_io":                true,
+	"/terminate":              true,
+	"/upgrade":                true,
+	"/upgrade_step":           true,
+	"/version_migration":      true,
+}
+
+// operationLockMiddleware runs the functions changing the cluster under the operation lock, the function context
+// is cancelled when the lock is lost
+func operationLockMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !operationLockFunctions[r.URL.Path] {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		ctx := r.Context()
+		lock, err := common.AcquireOperationLock(ctx, common.Getenv(ctx, "STATE_STORAGE_NAME"), common.Getenv(ctx, "STATE_CONTAINER_NAME"), strings.TrimPrefix(r.URL.Path, "/"))
+		if errors.Is(err, common.ErrOperationLocked) {
+			common.WriteErrorResponse(w, http.StatusConflict, err)
+			return
+		} else if err != nil {
+			logger.Error().Err(err).Msgf("failed to acquire the operation lock of %s", r.URL.Path)
+			common.WriteErrorResponse(w, http.StatusInternalServerError, fmt.Errorf("failed to acquire the operation lock: %w", err))
+			return
+		}
+		defer lock.Release(ctx)
+		next.ServeHTTP(w, r.WithContext(lock.Context()))
+	})
+}
+
 func main() {
 	customHandlerPort, exists := os.LookupEnv("FUNCTIONS_CUSTOMHANDLER_PORT")
 	if !exists {
@@ -49,6 +217,50 @@ func main() {
 	mux.Handle("/resize", logging.LoggingMiddleware(resize.Handler))
 	mux.Handle("/report", logging.LoggingMiddleware(report.Handler))
 	mux.Handle("/protect", logging.LoggingMiddleware(protect.Handler))
+	mux.Handle("/s3_presigned_url", logging.LoggingMiddleware(s3_presigned_url.Handler))
+	mux.Handle("/windows_client_mpio", logging.LoggingMiddleware(windows_client_mpio.Handler))
+	mux.Handle("/version_migration", logging.LoggingMiddleware(version_migration.Handler))
+	mux.Handle("/maintenance_window", logging.LoggingMiddleware(maintenance_window.Handler))
+	mux.Handle("/rotate_password", logging.LoggingMiddleware(rotate_password.Handler))
+	mux.Handle("/inventory", logging.LoggingMiddleware(inventory.Handler))
+	mux.Handle("/health", logging.LoggingMiddleware(health.Handler))
+	mux.Handle("/progress", logging.LoggingMiddleware(progress.Handler))
+	mux.Handle("/destroy_cleanup", logging.LoggingMiddleware(destroy_cleanup.Handler))
+	mux.Handle("/evict", logging.LoggingMiddleware(evict.Handler))
+	mux.Handle("/hot_spare", logging.LoggingMiddleware(hot_spare.Handler))
+	mux.Handle("/validate_config", logging.LoggingMiddleware(validate_config.Handler))
+	mux.Handle("/upgrade", logging.LoggingMiddleware(upgrade.Handler))
+	mux.Handle("/upgrade_step", logging.LoggingMiddleware(upgrade_step.Handler))
+	mux.Handle("/metrics", logging.LoggingMiddleware(metrics.Handler))
+	mux.Handle("/repair", logging.LoggingMiddleware(repair.Handler))
+	mux.Handle("/maintenance_mode", logging.LoggingMiddleware(maintenance_mode.Handler))
+	mux.Handle("/set_config", logging.LoggingMiddleware(set_config.Handler))
+	mux.Handle("/replace_drive", logging.LoggingMiddleware(replace_drive.Handler))
+	mux.Handle("/clusterize_segments", logging.LoggingMiddleware(clusterize_segments.Handler))
+	mux.Handle("/state_backup", logging.LoggingMiddleware(state_backup.Handler))
+	mux.Handle("/restore_state", logging.LoggingMiddleware(restore_state.Handler))
+	mux.Handle("/client_join_info", logging.LoggingMiddleware(client_join_info.Handler))
+	mux.Handle("/weka_home", logging.LoggingMiddleware(weka_home.Handler))
+	mux.Handle("/force_clusterize", logging.LoggingMiddleware(force_clusterize.Handler))
+	mux.Handle("/clusterization_timeout", logging.LoggingMiddleware(clusterization_timeout.Handler))
+	mux.Handle("/adopt", logging.LoggingMiddleware(adopt.Handler))
+	mux.Handle("/data_protection", logging.LoggingMiddleware(data_protection.Handler))
+	mux.Handle("/validate_cluster", logging.LoggingMiddleware(validate_cluster.Handler))
+	mux.Handle("/configure_protocols", logging.LoggingMiddleware(configure_protocols.Handler))
+	mux.Handle("/drift", logging.LoggingMiddleware(drift.Handler))
+	mux.Handle("/stop_io", logging.LoggingMiddleware(io_control.StopHandler))
+	mux.Handle("/start_io", logging.LoggingMiddleware(io_control.StartHandler))
+
+	// the app settings are only the bootstrap configuration, the config blob set by set_config overrides them
+	ctx := context.Background()
+	if _, err := common.LoadClusterConfig(ctx); err != nil {
+		logger.Error().Err(err).Msg("failed to load the cluster config, using the app settings")
+	}
+
+	// the server is started anyway, the status and validate_config functions must stay reachable to debug the settings
+	for _, issue := range common.ValidateConfig(ctx) {
+		logger.Error().Msgf("invalid app setting %s", issue)
+	}
 	logger.Info().Msgf("Go server Listening on: %v", customHandlerPort)
-	logger.Fatal().Err(http.ListenAndServe(":"+customHandlerPort, mux)).Send()
+	logger.Fatal().Err(http.ListenAndServe(":"+customHandlerPort, directInvocationMiddleware(clusterConfigMiddleware(instanceAuthMiddleware(operationLockMiddleware(mux)))))).Send()
 }
@@ -18,6 +18,17 @@ locals {
   obs_scope                        = var.obs_name != "" ? "${data.azurerm_storage_account.obs_sa[0].id}/blobServices/default/containers/${local.obs_container_name}" : ""
   function_app_name                = "${local.alphanumeric_prefix_name}-${local.alphanumeric_cluster_name}-function-app"
   install_weka_url                 = var.install_weka_url != "" ? var.install_weka_url : "https://$TOKEN@get.weka.io/dist/v1/install/${var.weka_version}/${var.weka_version}"
+  cloud_storage_suffix             = lookup({ public = "core.windows.net", usgovernment = "core.usgovcloudapi.net", china = "core.chinacloudapi.cn" }, var.cloud_environment)
+  cloud_function_app_suffix        = lookup({ public = "azurewebsites.net", usgovernment = "azurewebsites.us", china = "chinacloudsites.cn" }, var.cloud_environment)
+  cloud_management_endpoint        = lookup({ public = "management.azure.com", usgovernment = "management.usgovcloudapi.net", china = "management.chinacloudapi.cn" }, var.cloud_environment)
+  # the function app falls back to the same resource manager audience when INSTANCE_AUTH_AUDIENCE is empty
+  instance_auth_audience           = var.instance_auth_audience != "" ? var.instance_auth_audience : lookup({ public = "https://management.core.windows.net/", usgovernment = "https://management.core.usgovcloudapi.net", china = "https://management.core.chinacloudapi.cn" }, var.cloud_environment)
+  obs_customer_managed_key = var.obs_customer_managed_key == null ? "" : jsonencode(merge(var.obs_customer_managed_key, {
+    user_assigned_identity_principal_id = length(data.azurerm_user_assigned_identity.obs_cmk) > 0 ? data.azurerm_user_assigned_identity.obs_cmk[0].principal_id : ""
+  }))
+  notification_event_grid_topic_endpoint = var.notification_event_grid_topic_id != "" ? data.azurerm_eventgrid_topic.notifications[0].endpoint : ""
+  lifecycle_event_grid_topic_endpoint    = var.lifecycle_event_grid_topic_id != "" ? data.azurerm_eventgrid_topic.lifecycle[0].endpoint : ""
+  state_table_name                       = var.state_backend == "table" ? azurerm_storage_table.state[0].name : ""
 
 }
 
@@ -120,45 +131,103 @@ resource "azurerm_linux_function_app" "function_app" {
   }
 
   app_settings = {
-    "APPINSIGHTS_INSTRUMENTATIONKEY" = azurerm_application_insights.application_insights.instrumentation_key
-    "STATE_STORAGE_NAME"             = local.deployment_storage_account_name
-    "STATE_CONTAINER_NAME"           = local.deployment_container_name
-    "HOSTS_NUM"                      = var.cluster_size
-    "CLUSTER_NAME"                   = var.cluster_name
-    "PROTECTION_LEVEL"               = var.protection_level
-    "STRIPE_WIDTH"                   = var.stripe_width != -1 ? var.stripe_width : local.stripe_width
-    "HOTSPARE"                       = var.hotspare
-    "VM_USERNAME"                    = var.vm_username
-    "SUBSCRIPTION_ID"                = data.azurerm_subscription.primary.subscription_id
-    "RESOURCE_GROUP_NAME"            = data.azurerm_resource_group.rg.name
-    "LOCATION"                       = data.azurerm_resource_group.rg.location
-    "SET_OBS"                        = var.set_obs_integration
-    "SMBW_ENABLED"                   = var.smbw_enabled
-    "OBS_NAME"                       = local.obs_storage_account_name
-    "OBS_CONTAINER_NAME"             = local.obs_container_name
-    "OBS_ACCESS_KEY"                 = var.blob_obs_access_key
+    "APPINSIGHTS_INSTRUMENTATIONKEY"        = azurerm_application_insights.application_insights.instrumentation_key
+    "APPLICATIONINSIGHTS_CONNECTION_STRING" = azurerm_application_insights.application_insights.connection_string
+    "STATE_STORAGE_NAME"                    = local.deployment_storage_account_name
+    "STATE_CONTAINER_NAME"                  = local.deployment_container_name
+    "STATE_BACKEND"                         = var.state_backend
+    "STATE_TABLE_NAME"                      = local.state_table_name
+    "HOSTS_NUM"                             = var.cluster_size
+    "WARM_POOL_SIZE"                        = var.warm_pool_size
+    "AVAILABILITY_ZONES"                    = join(",", var.availability_zones)
+    "CLUSTER_NAME"                          = var.cluster_name
+    "PROTECTION_LEVEL"                      = var.protection_level
+    "STRIPE_WIDTH"                          = var.stripe_width != -1 ? var.stripe_width : local.stripe_width
+    "HOTSPARE"                              = var.hotspare
+    "NFS_PROTOCOL_GATEWAYS_NUM"             = var.nfs_protocol_gateways_number
+    "SMB_PROTOCOL_GATEWAYS_NUM"             = var.smb_protocol_gateways_number
+    "AUTO_REPAIR_ENABLED"                   = var.auto_repair_enabled
+    "AUTO_REPAIR_GRACE_PERIOD_MINUTES"      = var.auto_repair_grace_period_minutes
+    "KEY_VAULT_CACHE_TTL_SECONDS"           = var.key_vault_cache_ttl_seconds
+    "VM_USERNAME"                           = var.vm_username
+    "WEKA_ADMIN_USERNAME"                   = var.weka_admin_username
+    "WEKA_DEPLOYMENT_USERNAME"              = var.weka_deployment_username
+    "WEKA_CLIENT_USERNAME"                  = var.weka_client_username
+    "SUBSCRIPTION_ID"                       = data.azurerm_subscription.primary.subscription_id
+    "RESOURCE_GROUP_NAME"                   = data.azurerm_resource_group.rg.name
+    "LOCATION"                              = data.azurerm_resource_group.rg.location
+    "AZURE_ENVIRONMENT"                     = var.cloud_environment
+    "SET_OBS"                               = var.set_obs_integration
+    "SMBW_ENABLED"                          = var.smbw_enabled
+    "OBS_NAME"                              = local.obs_storage_account_name
+    "OBS_CONTAINER_NAME"                    = local.obs_container_name
+    "OBS_ACCESS_KEY"                        = var.blob_obs_access_key
+    "OBS_AUTH_METHOD"                       = var.obs_auth_method
+    "OBS_SAS_TOKEN"                         = var.blob_obs_sas_token
+    "OBS_SP_TENANT_ID"                      = var.obs_service_principal != null ? var.obs_service_principal.tenant_id : ""
+    "OBS_SP_CLIENT_ID"                      = var.obs_service_principal != null ? var.obs_service_principal.client_id : ""
+    "OBS_SP_CLIENT_SECRET"                  = var.obs_service_principal != null ? var.obs_service_principal.client_secret : ""
+    "OBS_CUSTOMER_MANAGED_KEY"              = local.obs_customer_managed_key
+    "OBS_DRIVE_RETENTION_PERIOD_SECONDS"    = var.tiering_drive_retention_period
+    "OBS_TIERING_CUE_SECONDS"               = var.tiering_cue
+    "FILESYSTEMS"                           = jsonencode(var.filesystems)
+    "PROTOCOL_SHARES"                       = jsonencode(var.protocol_shares)
+    "DEFAULT_NET_CONFIG"                    = var.default_net == null ? "" : jsonencode(var.default_net)
+    "DEFAULT_FS_WRITECACHE_CONFIG"          = var.default_fs_writecache == null ? "" : jsonencode(var.default_fs_writecache)
+    "TAGS"                                  = jsonencode(var.tags_map)
+    "CLUSTERIZE_SEGMENT_THRESHOLD"          = var.clusterize_segment_threshold
+    "CLUSTERIZE_SEGMENT_TIMEOUT_MINUTES"    = var.clusterize_segment_timeout_minutes
+    "CLUSTERIZATION_TIMEOUT_MINUTES"        = var.clusterization_timeout_minutes
+    "CLUSTERIZATION_MIN_HOSTS"              = var.clusterization_min_hosts
+    "CLUSTERIZE_MAX_CONCURRENCY"            = var.clusterize_max_concurrency
+    "PRE_CLUSTERIZE_SCRIPT"                 = base64encode(var.pre_clusterize_script)
+    "PRE_CLUSTERIZE_SCRIPT_BLOB"            = var.pre_clusterize_script_blob
+    "POST_CLUSTERIZE_SCRIPT"                = base64encode(var.post_clusterize_script)
+    "POST_CLUSTERIZE_SCRIPT_BLOB"           = var.post_clusterize_script_blob
+    "NOTIFICATION_WEBHOOK_URL"              = var.notification_webhook_url
+    "NOTIFICATION_EVENT_GRID_ENDPOINT"      = local.notification_event_grid_topic_endpoint
+    "NOTIFICATION_MIN_SEVERITY"             = var.notification_min_severity
+    "NOTIFICATION_DEDUP_MINUTES"            = var.notification_dedup_minutes
+    "LIFECYCLE_EVENT_GRID_ENDPOINT"         = local.lifecycle_event_grid_topic_endpoint
+    "PRIVATE_DNS_ZONE_NAME"                 = local.private_dns_zone_name
+    "PRIVATE_DNS_RG_NAME"                   = local.private_dns_rg_name
+    "BACKEND_DNS_RECORDS_ENABLED"           = var.backend_dns_records_enabled
+    "INSTANCE_AUTH_MODE"                    = var.instance_auth_mode
+    "INSTANCE_AUTH_AUDIENCE"                = local.instance_auth_audience
+    "TENANT_ID"                             = data.azurerm_client_config.current.tenant_id
+    "STATE_BACKUP_RETENTION"                = var.state_backup_retention
+    "PRIVATE_NETWORK"                       = var.private_network || !var.assign_public_ip
+    "BACKEND_RESOURCES_OVERRIDE"            = jsonencode(var.backend_resources_override)
+    "KMS_KEY_NAME"                          = var.kms_key_name
+    "SCRIPT_SIGNING_KEY_NAME"               = var.script_signing_enabled ? azurerm_key_vault_key.script_signing[0].name : ""
+    "KMS_KEY_VAULT_ID"                      = var.kms_key_vault_id
     NUM_DRIVE_CONTAINERS             = var.container_number_map[var.instance_type].drive
     NUM_COMPUTE_CONTAINERS           = var.add_frontend_container == false ? var.container_number_map[var.instance_type].compute + 1 : var.container_number_map[var.instance_type].compute
     NUM_FRONTEND_CONTAINERS          = var.add_frontend_container == false ? 0 : var.container_number_map[var.instance_type].frontend
     COMPUTE_MEMORY                   = var.container_number_map[var.instance_type].memory[local.get_compute_memory_index]
-    "NVMES_NUM"                      = var.container_number_map[var.instance_type].nvme
-    "TIERING_SSD_PERCENT"            = var.tiering_ssd_percent
-    "PREFIX"                         = var.prefix
-    "KEY_VAULT_URI"                  = azurerm_key_vault.key_vault.vault_uri
-    "INSTALL_DPDK"                   = var.install_cluster_dpdk
-    "NICS_NUM"                       = var.container_number_map[var.instance_type].nics
-    "INSTALL_URL"                    = local.install_weka_url
-    "LOG_LEVEL"                      = var.function_app_log_level
-    "SUBNET"                         = data.azurerm_subnet.subnet.address_prefix
+    "NVMES_NUM"           = var.container_number_map[var.instance_type].nvme
+    "TIERING_SSD_PERCENT" = var.tiering_ssd_percent
+    "PREFIX"              = var.prefix
+    "KEY_VAULT_URI"       = azurerm_key_vault.key_vault.vault_uri
+    "INSTALL_DPDK"        = var.install_cluster_dpdk
+    "DPDK_UDP_FALLBACK"   = var.dpdk_udp_fallback
+    "VM_SECURITY_TYPE"    = var.vm_security_type
+    "NICS_NUM"            = var.container_number_map[var.instance_type].nics
+    "INSTALL_URL"         = local.install_weka_url
+    "LOG_LEVEL"           = var.function_app_log_level
+    "SUBNET"              = data.azurerm_subnet.subnet.address_prefix
     FUNCTION_APP_NAME                = local.function_app_name
     PROXY_URL                        = var.proxy_url
+    FUNCTION_APP_PROXY_URL           = var.function_app_proxy_url
+    FUNCTION_APP_NO_PROXY            = join(",", var.function_app_no_proxy)
+    KEY_VAULT_ENDPOINT               = var.key_vault_endpoint
     WEKA_HOME_URL                    = var.weka_home_url
 
     https_only               = true
     FUNCTIONS_WORKER_RUNTIME = "custom"
     FUNCTION_APP_EDIT_MODE   = "readonly"
     HASH                     = var.function_app_version
-    WEBSITE_RUN_FROM_PACKAGE = "https://${local.weka_sa}.blob.core.windows.net/${local.weka_sa_container}/${local.function_app_zip_name}"
+    WEBSITE_RUN_FROM_PACKAGE = "https://${local.weka_sa}.blob.${local.cloud_storage_suffix}/${local.weka_sa_container}/${local.function_app_zip_name}"
     WEBSITE_VNET_ROUTE_ALL   = true
   }
 
@@ -186,6 +255,14 @@ resource "azurerm_role_assignment" "storage-blob-data-contributor" {
   depends_on           = [azurerm_linux_function_app.function_app, azurerm_storage_account.deployment_sa]
 }
 
+resource "azurerm_role_assignment" "storage-table-data-contributor" {
+  count                = var.state_backend == "table" ? 1 : 0
+  scope                = "${local.deployment_storage_account_id}/tableServices/default/tables/${local.state_table_name}"
+  role_definition_name = "Storage Table Data Contributor"
+  principal_id         = azurerm_linux_function_app.function_app.identity[0].principal_id
+  depends_on           = [azurerm_linux_function_app.function_app, azurerm_storage_table.state]
+}
+
 resource "azurerm_role_assignment" "storage_account_contributor" {
   scope                = data.azurerm_resource_group.rg.id
   role_definition_name = "Storage Account Contributor"
@@ -215,6 +292,59 @@ resource "azurerm_role_assignment" "function-app-key-user-access-admin" {
   depends_on           = [azurerm_linux_function_app.function_app]
 }
 
+# the kms key is created and the backends are granted access to it at clusterization time
+resource "azurerm_role_assignment" "function-app-kms-key-vault-contributor" {
+  count                = var.kms_key_name != "" ? 1 : 0
+  scope                = var.kms_key_vault_id != "" ? var.kms_key_vault_id : azurerm_key_vault.key_vault.id
+  role_definition_name = "Key Vault Contributor"
+  principal_id         = azurerm_linux_function_app.function_app.identity[0].principal_id
+  depends_on           = [azurerm_linux_function_app.function_app]
+}
+
+data "azurerm_eventgrid_topic" "notifications" {
+  count               = var.notification_event_grid_topic_id != "" ? 1 : 0
+  name                = element(split("/", var.notification_event_grid_topic_id), 8)
+  resource_group_name = element(split("/", var.notification_event_grid_topic_id), 4)
+}
+
+resource "azurerm_role_assignment" "function-app-event-grid-data-sender" {
+  count                = var.notification_event_grid_topic_id != "" ? 1 : 0
+  scope                = var.notification_event_grid_topic_id
+  role_definition_name = "EventGrid Data Sender"
+  principal_id         = azurerm_linux_function_app.function_app.identity[0].principal_id
+  depends_on           = [azurerm_linux_function_app.function_app]
+}
+
+data "azurerm_eventgrid_topic" "lifecycle" {
+  count               = var.lifecycle_event_grid_topic_id != "" ? 1 : 0
+  name                = element(split("/", var.lifecycle_event_grid_topic_id), 8)
+  resource_group_name = element(split("/", var.lifecycle_event_grid_topic_id), 4)
+}
+
+# the notifications topic may be the lifecycle one, the role is assigned once
+resource "azurerm_role_assignment" "function-app-lifecycle-event-grid-data-sender" {
+  count                = var.lifecycle_event_grid_topic_id != "" && var.lifecycle_event_grid_topic_id != var.notification_event_grid_topic_id ? 1 : 0
+  scope                = var.lifecycle_event_grid_topic_id
+  role_definition_name = "EventGrid Data Sender"
+  principal_id         = azurerm_linux_function_app.function_app.identity[0].principal_id
+  depends_on           = [azurerm_linux_function_app.function_app]
+}
+
+data "azurerm_private_dns_zone" "backends" {
+  count               = var.backend_dns_records_enabled ? 1 : 0
+  name                = local.private_dns_zone_name
+  resource_group_name = local.private_dns_rg_name
+  depends_on          = [module.network]
+}
+
+resource "azurerm_role_assignment" "function-app-private-dns-zone-contributor" {
+  count                = var.backend_dns_records_enabled ? 1 : 0
+  scope                = data.azurerm_private_dns_zone.backends[0].id
+  role_definition_name = "Private DNS Zone Contributor"
+  principal_id         = azurerm_linux_function_app.function_app.identity[0].principal_id
+  depends_on           = [azurerm_linux_function_app.function_app]
+}
+
 resource "azurerm_role_assignment" "function-app-reader" {
   scope                = data.azurerm_resource_group.rg.id
   role_definition_name = "Reader"
@@ -223,8 +353,14 @@ resource "azurerm_role_assignment" "function-app-reader" {
 }
 
 resource "azurerm_role_assignment" "function-app-scale-set-machine-owner" {
-  scope                = azurerm_linux_virtual_machine_scale_set.vmss.id
+  for_each             = azurerm_linux_virtual_machine_scale_set.vmss
+  scope                = each.value.id
   role_definition_name = "Contributor"
   principal_id         = azurerm_linux_function_app.function_app.identity[0].principal_id
   depends_on           = [azurerm_linux_function_app.function_app, azurerm_linux_virtual_machine_scale_set.vmss]
 }
+
+moved {
+  from = azurerm_role_assignment.function-app-scale-set-machine-owner
+  to   = azurerm_role_assignment.function-app-scale-set-machine-owner["default"]
+}
@@ -20,7 +20,7 @@ resource "azurerm_key_vault_access_policy" "function-app-get-secret-permission"
   object_id    = azurerm_linux_function_app.function_app.identity[0].principal_id
 
   secret_permissions = [
-    "Get",
+    "Get", "Set",
   ]
 
   depends_on = [azurerm_key_vault.key_vault,azurerm_linux_function_app.function_app]
@@ -44,6 +44,34 @@ resource "azurerm_key_vault_access_policy" "key_vault_access_policy" {
   depends_on = [azurerm_key_vault.key_vault]
 }
 
+# the private key stays in the key vault, the function app signs the scripts the vms run with it
+resource "azurerm_key_vault_key" "script_signing" {
+  count        = var.script_signing_enabled ? 1 : 0
+  name         = "script-signing-key"
+  key_vault_id = azurerm_key_vault.key_vault.id
+  key_type     = "RSA"
+  key_size     = 2048
+  key_opts     = ["sign", "verify"]
+  tags         = merge(var.tags_map, {"weka_cluster": var.cluster_name})
+  lifecycle {
+    ignore_changes = [tags]
+  }
+  depends_on   = [azurerm_key_vault.key_vault, azurerm_key_vault_access_policy.key_vault_access_policy]
+}
+
+resource "azurerm_key_vault_access_policy" "function-app-script-signing-permission" {
+  count        = var.script_signing_enabled ? 1 : 0
+  key_vault_id = azurerm_key_vault.key_vault.id
+  tenant_id    = data.azurerm_client_config.current.tenant_id
+  object_id    = azurerm_linux_function_app.function_app.identity[0].principal_id
+
+  key_permissions = [
+    "Get", "Sign",
+  ]
+
+  depends_on = [azurerm_key_vault.key_vault,azurerm_linux_function_app.function_app]
+}
+
 resource "azurerm_key_vault_secret" "public-ssh-keys" {
   count        = var.ssh_public_key == null ? 1 : 0
   name         = "public-key"
@@ -40,7 +40,7 @@ resource "azurerm_resource_group_template_deployment" "api_connections_template_
         },
         "testLinks": [
           {
-            "requestUri": "[concat('https://management.azure.com:443/subscriptions/${var.subscription_id}/resourceGroups/${data.azurerm_resource_group.rg.name}/providers/Microsoft.Web/connections/', parameters('connections_keyvault_name'), '/extensions/proxy/testconnection?api-version=2016-06-01')]",
+            "requestUri": "[concat('https://${local.cloud_management_endpoint}:443/subscriptions/${var.subscription_id}/resourceGroups/${data.azurerm_resource_group.rg.name}/providers/Microsoft.Web/connections/', parameters('connections_keyvault_name'), '/extensions/proxy/testconnection?api-version=2016-06-01')]",
             "method": "get"
             }
           ]
@@ -1,21 +1,21 @@
 locals {
   key_vault_name       = azurerm_key_vault.key_vault.name
-  vm_ips               = var.private_network ? "az vmss nic list -g ${var.rg_name} --vmss-name ${azurerm_linux_virtual_machine_scale_set.vmss.name} --subscription ${var.subscription_id} --query \"[].ipConfigurations[]\" | jq -r '.[] | select(.name==\"ipconfig0\")'.privateIPAddress" : "az vmss list-instance-public-ips -g ${var.rg_name} --name ${azurerm_linux_virtual_machine_scale_set.vmss.name} --subscription ${var.subscription_id} --query \"[].ipAddress\" \n"
+  vm_ips               = join("", [for vmss in azurerm_linux_virtual_machine_scale_set.vmss : var.private_network ? "az vmss nic list -g ${var.rg_name} --vmss-name ${vmss.name} --subscription ${var.subscription_id} --query \"[].ipConfigurations[]\" | jq -r '.[] | select(.name==\"ipconfig0\")'.privateIPAddress\n" : "az vmss list-instance-public-ips -g ${var.rg_name} --name ${vmss.name} --subscription ${var.subscription_id} --query \"[].ipAddress\" \n"])
   ssh_keys_commands    = "########################################## Download ssh keys command from blob ###########################################################\n az keyvault secret download --file private.pem --encoding utf-8 --vault-name  ${local.key_vault_name} --name private-key --query \"value\" \n az keyvault secret download --file public.pub --encoding utf-8 --vault-name  ${local.key_vault_name} --name public-key --query \"value\"\n"
   blob_commands        = var.ssh_public_key == null ? local.ssh_keys_commands : ""
   private_ssh_key_path = var.ssh_public_key == null ? local.ssh_private_key_path : null
   resource_group_name  = data.azurerm_resource_group.rg.name
   functions_url = {
     progressing_status = {
-      url = "https://${local.function_app_name}.azurewebsites.net/api/status"
+      url = "https://${local.function_app_name}.${local.cloud_function_app_suffix}/api/status"
       body = {"type": "progress"}
     }
     status = {
-      url = "https://${local.function_app_name}.azurewebsites.net/api/status"
+      url = "https://${local.function_app_name}.${local.cloud_function_app_suffix}/api/status"
       body = {"type": "status"}
     }
     resize = {
-      uri  = "https://${local.function_app_name}.azurewebsites.net/api/resize"
+      uri  = "https://${local.function_app_name}.${local.cloud_function_app_suffix}/api/resize"
       body = {"value":7}
     }
   }
@@ -73,11 +73,32 @@ az functionapp keys list --name ${local.function_app_name} --resource-group ${lo
 
 ########################################## Get clusterization status #####################################################################
 function_key=$(az functionapp keys list --name ${local.function_app_name} --resource-group ${local.resource_group_name} --subscription ${var.subscription_id} --query functionKeys -o tsv)
-curl --fail https://${local.function_app_name}.azurewebsites.net/api/status?code=$function_key -H "Content-Type:application/json" -d '{"type": "progress"}'
+curl --fail https://${local.function_app_name}.${local.cloud_function_app_suffix}/api/status?code=$function_key -H "Content-Type:application/json" -d '{"type": "progress"}'
+
+########################################## Get deployment timeline per vm ################################################################
+function_key=$(az functionapp keys list --name ${local.function_app_name} --resource-group ${local.resource_group_name} --subscription ${var.subscription_id} --query functionKeys -o tsv)
+curl --fail https://${local.function_app_name}.${local.cloud_function_app_suffix}/api/progress?code=$function_key
+
+########################################## Get deployment phase ###########################################################################
+function_key=$(az functionapp keys list --name ${local.function_app_name} --resource-group ${local.resource_group_name} --subscription ${var.subscription_id} --query functionKeys -o tsv)
+curl --fail https://${local.function_app_name}.${local.cloud_function_app_suffix}/api/status?code=$function_key -H "Content-Type:application/json" -d '{"type": "phase"}'
+
+########################################## Force clusterization with the ready backends ####################################################
+function_key=$(az functionapp keys list --name ${local.function_app_name} --resource-group ${local.resource_group_name} --subscription ${var.subscription_id} --query functionKeys -o tsv)
+curl --fail https://${local.function_app_name}.${local.cloud_function_app_suffix}/api/force_clusterize?code=$function_key -X POST -H "Content-Type:application/json" -d '{"dry_run": true}'
+curl --fail https://${local.function_app_name}.${local.cloud_function_app_suffix}/api/force_clusterize?code=$function_key -X POST -H "Content-Type:application/json" -d '{"reason": "ENTER_REASON_HERE"}'
+
+########################################## Adopt an existing cluster running on the backends vms ###########################################
+function_key=$(az functionapp keys list --name ${local.function_app_name} --resource-group ${local.resource_group_name} --subscription ${var.subscription_id} --query functionKeys -o tsv)
+curl --fail https://${local.function_app_name}.${local.cloud_function_app_suffix}/api/adopt?code=$function_key -X POST -H "Content-Type:application/json" -d '{"backend_ips": ["ENTER_BACKEND_IP_HERE"], "password": "ENTER_WEKA_PASSWORD_HERE", "dry_run": true}'
+
+########################################## Validate function app settings ##################################################################
+function_key=$(az functionapp keys list --name ${local.function_app_name} --resource-group ${local.resource_group_name} --subscription ${var.subscription_id} --query functionKeys -o tsv)
+curl --fail https://${local.function_app_name}.${local.cloud_function_app_suffix}/api/validate_config?code=$function_key
 
 ########################################## Get cluster status ############################################################################
 function_key=$(az functionapp keys list --name ${local.function_app_name} --resource-group ${local.resource_group_name} --subscription ${var.subscription_id} --query functionKeys -o tsv)
-curl --fail https://${local.function_app_name}.azurewebsites.net/api/status?code=$function_key
+curl --fail https://${local.function_app_name}.${local.cloud_function_app_suffix}/api/status?code=$function_key
 
 ######################################### Fetch weka cluster password ####################################################################
 az keyvault secret show --vault-name ${local.key_vault_name} --name weka-password | jq .value
@@ -86,7 +107,84 @@ ${local.blob_commands}
 
 ########################################## Resize cluster #################################################################################
 function_key=$(az functionapp keys list --name ${local.function_app_name} --resource-group ${local.resource_group_name} --subscription ${var.subscription_id} --query functionKeys -o tsv)
-curl --fail https://${local.function_app_name}.azurewebsites.net/api/resize?code=$function_key -H "Content-Type:application/json" -d '{"value":ENTER_NEW_VALUE_HERE}'
+curl --fail https://${local.function_app_name}.${local.cloud_function_app_suffix}/api/resize?code=$function_key -H "Content-Type:application/json" -d '{"value":ENTER_NEW_VALUE_HERE}'
+
+########################################## Get / set hot spare ############################################################################
+function_key=$(az functionapp keys list --name ${local.function_app_name} --resource-group ${local.resource_group_name} --subscription ${var.subscription_id} --query functionKeys -o tsv)
+curl --fail https://${local.function_app_name}.${local.cloud_function_app_suffix}/api/hot_spare?code=$function_key
+curl --fail https://${local.function_app_name}.${local.cloud_function_app_suffix}/api/hot_spare?code=$function_key -H "Content-Type:application/json" -d '{"value":ENTER_NEW_VALUE_HERE}'
+
+########################################## Get / set data protection ######################################################################
+function_key=$(az functionapp keys list --name ${local.function_app_name} --resource-group ${local.resource_group_name} --subscription ${var.subscription_id} --query functionKeys -o tsv)
+curl --fail https://${local.function_app_name}.${local.cloud_function_app_suffix}/api/data_protection?code=$function_key
+curl --fail https://${local.function_app_name}.${local.cloud_function_app_suffix}/api/data_protection?code=$function_key -H "Content-Type:application/json" -d '{"stripe_width":CURRENT_STRIPE_WIDTH,"protection_level":CURRENT_PROTECTION_LEVEL,"hotspare":ENTER_NEW_VALUE_HERE}'
+
+########################################## Get / set maintenance mode #####################################################################
+function_key=$(az functionapp keys list --name ${local.function_app_name} --resource-group ${local.resource_group_name} --subscription ${var.subscription_id} --query functionKeys -o tsv)
+curl --fail https://${local.function_app_name}.${local.cloud_function_app_suffix}/api/maintenance_mode?code=$function_key
+curl --fail https://${local.function_app_name}.${local.cloud_function_app_suffix}/api/maintenance_mode?code=$function_key -H "Content-Type:application/json" -d '{"enabled":true,"reason":"ENTER_REASON_HERE"}'
+curl --fail https://${local.function_app_name}.${local.cloud_function_app_suffix}/api/maintenance_mode?code=$function_key -H "Content-Type:application/json" -d '{"enabled":false}'
+
+########################################## Get / set cluster config #######################################################################
+function_key=$(az functionapp keys list --name ${local.function_app_name} --resource-group ${local.resource_group_name} --subscription ${var.subscription_id} --query functionKeys -o tsv)
+curl --fail https://${local.function_app_name}.${local.cloud_function_app_suffix}/api/set_config?code=$function_key
+curl --fail https://${local.function_app_name}.${local.cloud_function_app_suffix}/api/set_config?code=$function_key -H "Content-Type:application/json" -d '{"version":CURRENT_VERSION,"settings":{"SETTING_NAME":"ENTER_NEW_VALUE_HERE"}}'
+
+########################################## Replace a failed drive #########################################################################
+function_key=$(az functionapp keys list --name ${local.function_app_name} --resource-group ${local.resource_group_name} --subscription ${var.subscription_id} --query functionKeys -o tsv)
+curl --fail https://${local.function_app_name}.${local.cloud_function_app_suffix}/api/replace_drive?code=$function_key -H "Content-Type:application/json" -d '{"vm":"ENTER_VM_NAME_HERE","drive":"ENTER_DRIVE_UUID_OR_SERIAL_HERE"}'
+
+########################################## List / restore state backups ###################################################################
+function_key=$(az functionapp keys list --name ${local.function_app_name} --resource-group ${local.resource_group_name} --subscription ${var.subscription_id} --query functionKeys -o tsv)
+curl --fail https://${local.function_app_name}.${local.cloud_function_app_suffix}/api/restore_state?code=$function_key
+curl --fail https://${local.function_app_name}.${local.cloud_function_app_suffix}/api/restore_state?code=$function_key -H "Content-Type:application/json" -d '{"backup":"ENTER_BACKUP_NAME_HERE"}'
+
+########################################## Client join info ###############################################################################
+function_key=$(az functionapp keys list --name ${local.function_app_name} --resource-group ${local.resource_group_name} --subscription ${var.subscription_id} --query functionKeys -o tsv)
+curl --fail https://${local.function_app_name}.${local.cloud_function_app_suffix}/api/client_join_info?code=$function_key
+
+########################################## Weka Home status / validate / update ###########################################################
+function_key=$(az functionapp keys list --name ${local.function_app_name} --resource-group ${local.resource_group_name} --subscription ${var.subscription_id} --query functionKeys -o tsv)
+curl --fail https://${local.function_app_name}.${local.cloud_function_app_suffix}/api/weka_home?code=$function_key
+curl --fail https://${local.function_app_name}.${local.cloud_function_app_suffix}/api/weka_home?code=$function_key -H "Content-Type:application/json" -d '{"action": "validate"}'
+curl --fail https://${local.function_app_name}.${local.cloud_function_app_suffix}/api/weka_home?code=$function_key -H "Content-Type:application/json" -d '{"action": "update", "url": "<weka home url>", "proxy_url": "<proxy url>"}'
+
+########################################## Validate cluster io / obs upload ###############################################################
+function_key=$(az functionapp keys list --name ${local.function_app_name} --resource-group ${local.resource_group_name} --subscription ${var.subscription_id} --query functionKeys -o tsv)
+curl --fail https://${local.function_app_name}.${local.cloud_function_app_suffix}/api/validate_cluster?code=$function_key
+curl --fail https://${local.function_app_name}.${local.cloud_function_app_suffix}/api/validate_cluster?code=$function_key -H "Content-Type:application/json" -d '{"action": "validate"}'
+curl --fail https://${local.function_app_name}.${local.cloud_function_app_suffix}/api/validate_cluster?code=$function_key -H "Content-Type:application/json" -d '{"action": "validate", "filesystem": "<filesystem name>"}'
+
+########################################## Protocol shares status / apply #############################################################
+function_key=$(az functionapp keys list --name ${local.function_app_name} --resource-group ${local.resource_group_name} --subscription ${var.subscription_id} --query functionKeys -o tsv)
+curl --fail https://${local.function_app_name}.${local.cloud_function_app_suffix}/api/configure_protocols?code=$function_key
+curl --fail https://${local.function_app_name}.${local.cloud_function_app_suffix}/api/configure_protocols?code=$function_key -H "Content-Type:application/json" -d '{"action": "apply"}'
+
+########################################## Drift between the declared config and the cluster ##########################################
+function_key=$(az functionapp keys list --name ${local.function_app_name} --resource-group ${local.resource_group_name} --subscription ${var.subscription_id} --query functionKeys -o tsv)
+curl --fail https://${local.function_app_name}.${local.cloud_function_app_suffix}/api/drift?code=$function_key
+
+########################################## Stop / start the cluster io ####################################################################
+function_key=$(az functionapp keys list --name ${local.function_app_name} --resource-group ${local.resource_group_name} --subscription ${var.subscription_id} --query functionKeys -o tsv)
+curl --fail https://${local.function_app_name}.${local.cloud_function_app_suffix}/api/stop_io?code=$function_key
+curl --fail https://${local.function_app_name}.${local.cloud_function_app_suffix}/api/start_io?code=$function_key
+curl --fail https://${local.function_app_name}.${local.cloud_function_app_suffix}/api/stop_io?code=$function_key -H "Content-Type:application/json" -d '{"status": true}'
+
+########################################## Prometheus metrics #############################################################################
+function_key=$(az functionapp keys list --name ${local.function_app_name} --resource-group ${local.resource_group_name} --subscription ${var.subscription_id} --query functionKeys -o tsv)
+curl --fail https://${local.function_app_name}.${local.cloud_function_app_suffix}/api/metrics?code=$function_key
+
+########################################## Upgrade weka version ###########################################################################
+function_key=$(az functionapp keys list --name ${local.function_app_name} --resource-group ${local.resource_group_name} --subscription ${var.subscription_id} --query functionKeys -o tsv)
+curl --fail https://${local.function_app_name}.${local.cloud_function_app_suffix}/api/upgrade?code=$function_key -H "Content-Type:application/json" -d '{"from_version":"CURRENT_VERSION","to_version":"TARGET_VERSION","download_url":"ENTER_DOWNLOAD_URL_HERE"}'
+curl --fail https://${local.function_app_name}.${local.cloud_function_app_suffix}/api/upgrade?code=$function_key
+curl --fail https://${local.function_app_name}.${local.cloud_function_app_suffix}/api/upgrade?code=$function_key -H "Content-Type:application/json" -d '{"action":"resume"}'
+curl --fail https://${local.function_app_name}.${local.cloud_function_app_suffix}/api/upgrade?code=$function_key -H "Content-Type:application/json" -d '{"action":"abort"}'
+
+########################################## Cleanup before destroy #########################################################################
+function_key=$(az functionapp keys list --name ${local.function_app_name} --resource-group ${local.resource_group_name} --subscription ${var.subscription_id} --query functionKeys -o tsv)
+curl --fail https://${local.function_app_name}.${local.cloud_function_app_suffix}/api/destroy_cleanup?code=$function_key -X POST -H "Content-Type:application/json" -d '{"dry_run": true}'
+curl --fail https://${local.function_app_name}.${local.cloud_function_app_suffix}/api/destroy_cleanup?code=$function_key -X POST
 
 EOT
   description = "Useful commands and script to interact with weka cluster"
@@ -18,13 +18,52 @@ function retry {
   return 0
 }
 
+# the function app checks the scale set managed identity token when the instance authentication is enabled
+function instance_auth_header {
+  local token
+  token=$(curl -s -H Metadata:true --noproxy "*" "http://169.254.169.254/metadata/identity/oauth2/token?api-version=2018-02-01&resource=${instance_auth_audience}" | jq -r .access_token)
+  echo "Authorization: Bearer $token"
+}
+
+# the scripts of the function app are signed with a key vault key when the script signing is enabled, a script is
+# run only when its signature header is verified with the public key
+%{ if script_signing_public_key != "" }
+mkdir -p /etc/weka
+cat >/etc/weka/script-signing.pem <<'EOF'
+${script_signing_public_key}
+EOF
+cat >/usr/sbin/weka-verify-script <<'EOF'
+#!/bin/bash
+# usage: weka-verify-script <script file> <base64 signature>
+if [ -z "$2" ]; then
+  echo "the script $1 is not signed" >&2
+  exit 1
+fi
+signature_file=$(mktemp)
+trap 'rm -f "$signature_file"' EXIT
+echo "$2" | base64 -d >"$signature_file" || exit 1
+openssl dgst -sha256 -verify /etc/weka/script-signing.pem -signature "$signature_file" "$1"
+EOF
+chmod +x /usr/sbin/weka-verify-script
+
+function verify_script {
+  local signature
+  signature=$(grep -i '^X-Weka-Script-Signature:' "$2" | cut -d' ' -f2 | tr -d '\r')
+  /usr/sbin/weka-verify-script "$1" "$signature"
+}
+%{ else }
+function verify_script {
+  return 0
+}
+%{ endif }
+
 # retry for 2 minutes
 # NOTE: in some cases it takes time for all access policies to be applied
-retry 12 10 curl --fail ${report_url}?code="${function_app_default_key}" -H "Content-Type:application/json" -d "{\"hostname\": \"$HOSTNAME\", \"type\": \"progress\", \"message\": \"Running init script\"}"
+retry 12 10 curl --fail ${report_url}?code="${function_app_default_key}" -H "$(instance_auth_header)" -H "Content-Type:application/json" -d "{\"hostname\": \"$HOSTNAME\", \"type\": \"progress\", \"message\": \"Running init script\"}"
 
 handle_error () {
   if [ "$1" -ne 0 ]; then
-    curl -i ${report_url}?code="${function_app_default_key}" -H "Content-Type:application/json" -d "{\"hostname\": \"$HOSTNAME\", \"type\": \"error\", \"message\": \"${2}\"}"
+    curl -i ${report_url}?code="${function_app_default_key}" -H "$(instance_auth_header)" -H "Content-Type:application/json" -d "{\"hostname\": \"$HOSTNAME\", \"type\": \"error\", \"message\": \"${2}\"}"
     exit 1
   fi
 }
@@ -113,6 +152,44 @@ systemctl start remove-routes.service
 systemctl status remove-routes.service || true # show status of remove-routes.service
 ip route # show routes after removing
 
+%{ if spot_instances }
+# spot eviction notices are published by the scheduled events service about 30 seconds before the vm is evicted
+cat >/usr/sbin/spot-eviction-watcher.sh <<'EOF'
+#!/bin/bash
+metadata_url="http://169.254.169.254/metadata/scheduledevents?api-version=2020-07-01"
+compute_name=$(curl -s -H Metadata:true --noproxy "*" "http://169.254.169.254/metadata/instance/compute/name?api-version=2021-02-01&format=text")
+while true; do
+  event_id=$(curl -s -H Metadata:true --noproxy "*" "$metadata_url" | jq -r --arg name "$compute_name" '.Events[] | select(.EventType == "Preempt" and (.Resources | index($name))) | .EventId' | head -1)
+  if [ -n "$event_id" ]; then
+    curl --fail --max-time 20 "${evict_url}?code=${function_app_default_key}" -H "$(instance_auth_header)" -H "Content-Type:application/json" -d "{\"vm\": \"$compute_name:$HOSTNAME\"}"
+    # approve the event, the drives are already deactivated
+    curl -s -H Metadata:true --noproxy "*" -X POST "$metadata_url" -d "{\"StartRequests\": [{\"EventId\": \"$event_id\"}]}"
+    exit 0
+  fi
+  sleep 5
+done
+EOF
+chmod +x /usr/sbin/spot-eviction-watcher.sh
+
+cat >/etc/systemd/system/spot-eviction-watcher.service <<EOF
+[Unit]
+Description=Report spot eviction notices to the weka function app
+After=network-online.target
+Wants=network-online.target
+
+[Service]
+ExecStart=/bin/bash /usr/sbin/spot-eviction-watcher.sh
+Restart=on-failure
+
+[Install]
+WantedBy=multi-user.target
+EOF
+
+systemctl daemon-reload
+systemctl enable spot-eviction-watcher.service
+systemctl start spot-eviction-watcher.service
+%{ endif }
+
 # attach disk
 while ! [ "$(lsblk | grep ${disk_size}G | awk '{print $1}')" ] ; do
   echo "waiting for disk to be ready"
@@ -136,7 +213,7 @@ rm -rf $INSTALLATION_PATH
 compute_name=$(curl -s -H Metadata:true --noproxy "*" "http://169.254.169.254/metadata/instance?api-version=2021-02-01" | jq '.compute.name')
 compute_name=$(echo "$compute_name" | cut -c2- | rev | cut -c2- | rev)
 retry=0
-while ! curl ${deploy_url}?code="${function_app_default_key}" --fail -H "Content-Type:application/json" -d "{\"vm\": \"$compute_name:$HOSTNAME\"}" > /tmp/deploy.sh; do
+while ! curl ${deploy_url}?code="${function_app_default_key}" --fail -H "$(instance_auth_header)" -H "Content-Type:application/json" -d "{\"vm\": \"$compute_name:$HOSTNAME\"}" -D /tmp/deploy.headers > /tmp/deploy.sh || ! verify_script /tmp/deploy.sh /tmp/deploy.headers; do
   echo "waiting for deploy script generation success"
   retry=$((retry + 1))
   sleep 5
@@ -145,7 +222,7 @@ done
 if [ $retry -gt 0 ]; then
   msg="Deploy script generation retried $retry times"
   echo "$msg"
-  curl -i "${report_url}?code=${function_app_default_key}" -H "Content-Type:application/json" -d "{\"hostname\": \"$HOSTNAME\", \"type\": \"debug\", \"message\": \"$msg\"}"
+  curl -i "${report_url}?code=${function_app_default_key}" -H "$(instance_auth_header)" -H "Content-Type:application/json" -d "{\"hostname\": \"$HOSTNAME\", \"type\": \"debug\", \"message\": \"$msg\"}"
 fi
 
 chmod +x /tmp/deploy.sh
@@ -49,12 +49,78 @@ variable "vm_username" {
   default     = "weka"
 }
 
+variable "weka_admin_username" {
+  type        = string
+  description = "Weka cluster admin username, replaces the default admin user after clusterization."
+  default     = "admin"
+}
+
+variable "weka_deployment_username" {
+  type        = string
+  description = "Weka service account username used by the function app, its password is generated and stored in the key vault. The admin user is used when empty."
+  default     = ""
+}
+
 variable "instance_type" {
   type        = string
   description = "The virtual machine type (sku) to deploy."
   default     = "Standard_L8s_v3"
 }
 
+variable "vm_priority" {
+  type        = string
+  description = "The backend virtual machines priority, Regular or Spot. Spot vms are evicted when azure needs the capacity back, their drives are deactivated on the eviction notice and the replacement vms rejoin the cluster."
+  default     = "Regular"
+  validation {
+    condition     = contains(["Regular", "Spot"], var.vm_priority)
+    error_message = "Allowed vm priorities: Regular, Spot."
+  }
+}
+
+variable "vm_security_type" {
+  type        = string
+  description = "The backend virtual machines security type, Standard, TrustedLaunch or ConfidentialVM. Trusted launch and confidential vms boot with secure boot and a vTPM, the instance type must support them. Confidential vms don't support DPDK, weka runs in UDP mode on them."
+  default     = "Standard"
+  validation {
+    condition     = contains(["Standard", "TrustedLaunch", "ConfidentialVM"], var.vm_security_type)
+    error_message = "Allowed vm security types: Standard, TrustedLaunch, ConfidentialVM."
+  }
+}
+
+variable "spot_eviction_policy" {
+  type        = string
+  description = "The eviction policy of spot vms, Delete or Deallocate. Only used when vm_priority is Spot."
+  default     = "Delete"
+  validation {
+    condition     = contains(["Delete", "Deallocate"], var.spot_eviction_policy)
+    error_message = "Allowed spot eviction policies: Delete, Deallocate."
+  }
+}
+
+variable "spot_max_bid_price" {
+  type        = number
+  description = "The maximum price per hour of a spot vm in US dollars, -1 means the vm isn't evicted for price reasons. Only used when vm_priority is Spot."
+  default     = -1
+}
+
+variable "auto_repair_enabled" {
+  type        = bool
+  description = "Replace backends whose weka containers are down for auto_repair_grace_period_minutes. Their drives and containers are deactivated and the vm is deleted, the scale set then creates a replacement. Nothing is repaired when more backends than the protection level are unhealthy."
+  default     = false
+}
+
+variable "auto_repair_grace_period_minutes" {
+  type        = number
+  description = "Minutes a backend must be unhealthy before it is replaced by the auto repair."
+  default     = 15
+}
+
+variable "key_vault_cache_ttl_seconds" {
+  type        = number
+  description = "Seconds the functions cache the key vault secrets, a cached secret is also used when the key vault can't be read. 0 disables the cache."
+  default     = 300
+}
+
 variable "vnet_name" {
   type        = string
   description = "The virtual network name."
@@ -78,6 +144,17 @@ variable "cluster_size" {
   }
 }
 
+variable "warm_pool_size" {
+  type        = number
+  description = "The number of deallocated backend virtual machines kept in the scale set on top of the cluster size, with the weka software installed. The scale up starts them instead of creating new virtual machines. 0 disables the warm pool."
+  default     = 0
+
+  validation {
+    condition     = var.warm_pool_size >= 0
+    error_message = "Warm pool size can't be negative."
+  }
+}
+
 variable "source_image_id" {
   type        = string
   default     = "/communityGalleries/WekaIO-d7d3f308-d5a1-4c45-8e8a-818aed57375a/images/ubuntu20.04/versions/latest"
@@ -173,6 +250,12 @@ variable "private_dns_rg_name" {
   default     = ""
 }
 
+variable "backend_dns_records_enabled" {
+  type        = bool
+  description = "Register an A record per backend (weka-backend-<index>) in the private DNS zone, the records are removed when the backends are terminated."
+  default     = false
+}
+
 variable "vnet_to_peering" {
   type = list(object({
     vnet = string
@@ -253,6 +336,17 @@ variable "subscription_id" {
   description = "The subscription id for the deployment."
 }
 
+variable "cloud_environment" {
+  type        = string
+  description = "The azure cloud of the deployment: public, usgovernment or china. The azurerm provider environment must match it."
+  default     = "public"
+
+  validation {
+    condition     = contains(["public", "usgovernment", "china"], var.cloud_environment)
+    error_message = "Allowed values for cloud_environment are public, usgovernment and china."
+  }
+}
+
 variable "protection_level" {
   type = number
   default = 2
@@ -325,6 +419,34 @@ variable "install_cluster_dpdk" {
   description = "Install weka cluster with DPDK"
 }
 
+variable "default_fs_writecache" {
+  type = object({
+    ssd_reserve_percent = optional(number, 10)
+  })
+  description = "Creates the default filesystem for the writecache mount mode, for latency sensitive workloads. The ssd_reserve_percent of the SSD capacity is left out of the default filesystem for the write cache, and client_join_info returns the writecache mount option. Null gives the whole SSD capacity to the default filesystem."
+  default     = null
+  validation {
+    condition     = var.default_fs_writecache == null ? true : var.default_fs_writecache.ssd_reserve_percent >= 0 && var.default_fs_writecache.ssd_reserve_percent <= 50
+    error_message = "The SSD reserve percent of the default filesystem should be between 0 and 50."
+  }
+}
+
+variable "default_net" {
+  type = object({
+    range        = string
+    gateway      = optional(string, "")
+    netmask_bits = optional(number, 0)
+  })
+  description = "Weka default network set at clusterization when DPDK is disabled, range is an address range of the subnet which is not used by azure, e.g. 10.0.2.100-10.0.2.200. The gateway and netmask bits default to the ones of the subnet."
+  default     = null
+}
+
+variable "dpdk_udp_fallback" {
+  type        = bool
+  default     = false
+  description = "Fall back to UDP mode when the backend vms nics don't have accelerated networking, rather than failing the clusterization. Only used when install_cluster_dpdk is true."
+}
+
 variable "add_frontend_container" {
   type        = bool
   default     = true
@@ -357,12 +479,98 @@ variable "blob_obs_access_key" {
   default = ""
 }
 
+variable "obs_auth_method" {
+  type        = string
+  default     = "access_key"
+  description = "How weka authenticates to the obs container: access_key, managed_identity, sas_token or service_principal. sas_token and service_principal require an existing storage account (obs_name), its key is never read."
+  validation {
+    condition     = contains(["access_key", "managed_identity", "sas_token", "service_principal"], var.obs_auth_method)
+    error_message = "Allowed obs auth methods: access_key, managed_identity, sas_token, service_principal."
+  }
+}
+
+variable "blob_obs_sas_token" {
+  type        = string
+  description = "SAS token of the existing obs container, used with obs_auth_method sas_token. It must allow read, add, create, write, delete and list."
+  sensitive   = true
+  default     = ""
+}
+
+variable "obs_service_principal" {
+  type = object({
+    tenant_id     = string
+    client_id     = string
+    client_secret = string
+  })
+  description = "Service principal with Storage Blob Data Contributor on the existing obs container, used with obs_auth_method service_principal."
+  sensitive   = true
+  default     = null
+}
+
+variable "obs_customer_managed_key" {
+  type = object({
+    key_vault_id              = string
+    key_name                  = string
+    key_version               = optional(string, "")
+    user_assigned_identity_id = optional(string, "")
+  })
+  description = "Key vault key encrypting the obs storage account created by the function app. The latest key version is used when key_version is empty. The storage account system assigned identity accesses the key unless user_assigned_identity_id is set, the identity is granted access to the key vault."
+  default     = null
+}
+
 variable "tiering_ssd_percent" {
   type = number
   default = 20
   description = "When set_obs_integration is true, this variable sets the capacity percentage of the filesystem that resides on SSD. For example, for an SSD with a total capacity of 20GB, and the tiering_ssd_percent is set to 20, the total available capacity is 100GB."
 }
 
+variable "filesystems" {
+  type = list(object({
+    name                = string
+    capacity_gb         = number
+    tiering_ssd_percent = optional(number, 0)
+    encrypted           = optional(bool, false)
+  }))
+  default     = []
+  description = "Filesystems created at clusterization time in addition to the default filesystem, the default filesystem gets the remaining SSD capacity. A non zero tiering_ssd_percent tiers the filesystem to the obs and requires set_obs_integration."
+}
+
+variable "protocol_shares" {
+  type = list(object({
+    name         = optional(string, "")
+    filesystem   = optional(string, "default")
+    path         = optional(string, "/")
+    protocol     = string
+    permissions  = optional(string, "rw")
+    client_group = optional(string, "")
+  }))
+  default     = []
+  description = "Shares declared on the cluster by the configure_protocols function after the clusterization and on demand: SMB shares (name is required) and NFS exports (granted to client_group, weka-cg by default). Permissions are rw or ro. The shares applied by a previous run which are not declared anymore are removed, the shares created by hand are left alone."
+
+  validation {
+    condition     = alltrue([for share in var.protocol_shares : contains(["SMB", "NFS"], upper(share.protocol)) && contains(["rw", "ro"], lower(share.permissions))])
+    error_message = "Allowed values for protocol: SMB, NFS, and for permissions: rw, ro."
+  }
+}
+
+variable "kms_key_name" {
+  type        = string
+  default     = ""
+  description = "Name of the Azure Key Vault key used as the Weka KMS master key for encrypted filesystems, the key is created when missing. Empty disables the KMS."
+}
+
+variable "kms_key_vault_id" {
+  type        = string
+  default     = ""
+  description = "Resource id of the key vault holding the KMS key, the deployment key vault is used when empty."
+}
+
+variable "script_signing_enabled" {
+  type        = bool
+  default     = false
+  description = "Sign the scripts the function app returns to the vms with a key vault key, the vms run only the scripts whose signature is verified with its public key."
+}
+
 ############################### clients ############################
 variable "clients_number" {
   type        = number
@@ -406,6 +614,16 @@ variable "deployment_container_name" {
   description = "Name of exising deployment container"
 }
 
+variable "state_backend" {
+  type        = string
+  description = "Where the function app keeps the cluster state: blob, the state blob of the deployment container, or table, a table of the deployment storage account with a row per instance and per reporting host, which lets the backends of large clusters report concurrently. The state blob seeds the table on its first use."
+  default     = "blob"
+  validation {
+    condition     = contains(["blob", "table"], var.state_backend)
+    error_message = "Allowed values: blob, table."
+  }
+}
+
 variable "deployment_storage_account_access_key" {
   type        = string
   description = "The access key of the existing Blob object store container."
@@ -419,6 +637,12 @@ variable "zone"{
   default     = "1"
 }
 
+variable "availability_zones" {
+  type        = list(string)
+  description = "Spread the backends over these availability zones, with a scale set per zone and the zone as the weka failure domain. The backends are not placed in a proximity placement group then. The zone variable is used when empty."
+  default     = []
+}
+
 ############################################### nfs protocol gateways variables ###################################################
 variable "nfs_protocol_gateways_number" {
   type = number
@@ -552,8 +776,170 @@ variable "proxy_url" {
   default     = ""
 }
 
+variable "function_app_proxy_url" {
+  type        = string
+  description = "HTTP(S) proxy url used by the function app for azure api calls, e.g. http://proxy.example.com:3128. Empty means no proxy."
+  default     = ""
+}
+
+variable "function_app_no_proxy" {
+  type        = list(string)
+  description = "Hosts, domains or CIDRs the function app reaches without the proxy, the managed identity endpoint is always excluded."
+  default     = []
+}
+
+variable "key_vault_endpoint" {
+  type        = string
+  description = "Endpoint the function app reaches the key vault at instead of its uri, e.g. a custom dns name of its private endpoint. When set, the key vault is reached through the vnet without the function app proxy. Empty uses the key vault uri."
+  default     = ""
+}
+
 variable "weka_home_url" {
   type        = string
   description = "Weka Home url"
   default     = ""
 }
+
+variable "notification_webhook_url" {
+  type        = string
+  description = "Webhook url the function app posts deployment and clusterization failures to, e.g. a Slack or Teams incoming webhook. Empty means no webhook notifications."
+  default     = ""
+  sensitive   = true
+}
+
+variable "lifecycle_event_grid_topic_id" {
+  type        = string
+  description = "Resource id of an existing Event Grid topic with the CloudEvents v1.0 input schema, the function app publishes the cluster lifecycle events to it: Weka.Cluster.Ready, Weka.Cluster.ObsAttached, Weka.Cluster.ScaleUpCompleted and Weka.Cluster.HostFailed. The function app is granted the EventGrid Data Sender role on it. Empty means no lifecycle events."
+  default     = ""
+}
+
+variable "notification_event_grid_topic_id" {
+  type        = string
+  description = "Resource id of an existing Event Grid topic the function app publishes deployment and clusterization failures to, the function app is granted the EventGrid Data Sender role on it. Empty means no Event Grid notifications."
+  default     = ""
+}
+
+variable "notification_min_severity" {
+  type        = string
+  description = "Minimal severity of the notifications sent: info, warning, error or critical."
+  default     = "error"
+
+  validation {
+    condition     = contains(["info", "warning", "error", "critical"], var.notification_min_severity)
+    error_message = "Allowed values for notification_min_severity are info, warning, error and critical."
+  }
+}
+
+variable "notification_dedup_minutes" {
+  type        = number
+  description = "Repeated notifications of the same failure are dropped for this number of minutes."
+  default     = 30
+}
+
+variable "clusterize_segment_threshold" {
+  type        = number
+  description = "Clusters of at least this many backends are clusterized in segments, each backend adding its own drives in parallel instead of the last vm adding all the drives. 0 disables the segmented clusterization."
+  default     = 100
+}
+
+variable "clusterize_segment_timeout_minutes" {
+  type        = number
+  description = "Time the last vm waits for the backends to add their drives in a segmented clusterization, it then adds the missing drives itself."
+  default     = 15
+}
+
+variable "clusterization_timeout_minutes" {
+  type        = number
+  description = "Time the deployment waits for all the backends to call clusterize after the first one did, when some vms fail to provision. The cluster is then clusterized with the backends present if there are at least clusterization_min_hosts, the deployment fails otherwise. 0 waits forever."
+  default     = 60
+}
+
+variable "clusterization_min_hosts" {
+  type        = number
+  description = "Minimum number of backends clusterized when the clusterization timeout expires. 0 means the stripe width + protection level + hot spare backends the data protection requires."
+  default     = 0
+}
+
+variable "clusterize_max_concurrency" {
+  type        = number
+  description = "Maximum number of clusterize calls a function app instance handles at once, the backends calling it while all runs are busy for two minutes call it again later."
+  default     = 8
+}
+
+variable "pre_clusterize_script" {
+  type        = string
+  description = "Bash snippet each backend runs before weka is installed on it, e.g. os hardening or agent installs. A failure fails the backend deployment."
+  default     = ""
+}
+
+variable "pre_clusterize_script_blob" {
+  type        = string
+  description = "Name of a blob of the state container holding the pre clusterize bash snippet, for snippets too large for an app setting. Ignored when pre_clusterize_script is set."
+  default     = ""
+}
+
+variable "post_clusterize_script" {
+  type        = string
+  description = "Bash snippet run once a backend is part of the cluster: on the backend running the clusterization at its end, and on each backend joining the cluster afterwards."
+  default     = ""
+}
+
+variable "post_clusterize_script_blob" {
+  type        = string
+  description = "Name of a blob of the state container holding the post clusterize bash snippet. Ignored when post_clusterize_script is set."
+  default     = ""
+}
+
+variable "instance_auth_mode" {
+  type        = string
+  description = "Authentication of the vms calling the function app in addition to the function key: disabled, audit (only log the requests which are not signed by the managed identity of a cluster scale set) or enforce (reject them)."
+  default     = "disabled"
+
+  validation {
+    condition     = contains(["disabled", "audit", "enforce"], var.instance_auth_mode)
+    error_message = "Allowed values for instance_auth_mode are disabled, audit and enforce."
+  }
+}
+
+variable "instance_auth_audience" {
+  type        = string
+  description = "Resource the vms request their managed identity token for when calling the function app. Defaults to the resource manager audience of the cloud environment."
+  default     = ""
+}
+
+variable "state_backup_retention" {
+  type        = number
+  description = "Number of hourly snapshots of the cluster state blob kept in the state container, a snapshot is only taken when the state changed."
+  default     = 48
+}
+
+variable "tiering_drive_retention_period" {
+  type        = number
+  default     = 0
+  description = "When set_obs_integration is true, seconds the data is kept on SSD after it was tiered to the obs, before it is released from the SSD. 0 keeps the weka default."
+}
+
+variable "tiering_cue" {
+  type        = number
+  default     = 0
+  description = "When set_obs_integration is true, seconds the data is kept on SSD before it is tiered to the obs, it must be shorter than tiering_drive_retention_period. 0 keeps the weka default."
+}
+
+variable "backend_resources_override" {
+  type = map(object({
+    compute  = number
+    drive    = number
+    frontend = number
+    nvme     = number
+    nics     = number
+    memory   = list(string)
+  }))
+  description = "Weka containers layout per vm size, in the container_number_map format. The function app picks the layout of the backends vm size from this map, then from its built-in layouts of the Lsv3 and Lasv3 sizes, and uses the instance_type layout of container_number_map otherwise."
+  default     = {}
+}
+
+variable "weka_client_username" {
+  type        = string
+  description = "Weka regular user the clients mount with, its password is generated and stored in the key vault and client_join_info returns a short-lived token of it. The clients mount without authentication when empty."
+  default     = ""
+}
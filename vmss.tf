@@ -10,19 +10,44 @@ locals {
   alphanumeric_prefix_name  = "${random_id.id.hex}"
   # lower(replace(var.prefix, "/\\W|_|\\s/", ""))
   subnet_range              = data.azurerm_subnet.subnet.address_prefix
-  nics_numbers              = var.install_cluster_dpdk ? var.container_number_map[var.instance_type].nics : 1
+  # confidential vms don't support dpdk, weka falls back to udp mode on a single nic
+  install_cluster_dpdk      = var.install_cluster_dpdk && var.vm_security_type != "ConfidentialVM"
+  nics_numbers              = local.install_cluster_dpdk ? var.container_number_map[var.instance_type].nics : 1
+  secure_boot_enabled       = var.vm_security_type != "Standard"
+  spot_instances            = var.vm_priority == "Spot"
   custom_data_script        = templatefile("${path.module}/user-data.sh", {
-    apt_repo_server          = var.apt_repo_server
-    user                     = var.vm_username
-    install_cluster_dpdk     = var.install_cluster_dpdk
-    subnet_range             = local.subnet_range
-    nics_num                 = local.nics_numbers
-    deploy_url               = "https://${azurerm_linux_function_app.function_app.name}.azurewebsites.net/api/deploy"
-    report_url               = "https://${azurerm_linux_function_app.function_app.name}.azurewebsites.net/api/report"
-    function_app_default_key = data.azurerm_function_app_host_keys.function_keys.default_function_key
-    disk_size                = local.disk_size
+    apt_repo_server           = var.apt_repo_server
+    user                      = var.vm_username
+    install_cluster_dpdk      = local.install_cluster_dpdk
+    subnet_range              = local.subnet_range
+    nics_num                  = local.nics_numbers
+    deploy_url                = "https://${azurerm_linux_function_app.function_app.name}.${local.cloud_function_app_suffix}/api/deploy"
+    report_url                = "https://${azurerm_linux_function_app.function_app.name}.${local.cloud_function_app_suffix}/api/report"
+    evict_url                 = "https://${azurerm_linux_function_app.function_app.name}.${local.cloud_function_app_suffix}/api/evict"
+    spot_instances            = local.spot_instances
+    function_app_default_key  = data.azurerm_function_app_host_keys.function_keys.default_function_key
+    disk_size                 = local.disk_size
+    instance_auth_audience    = urlencode(local.instance_auth_audience)
+    script_signing_public_key = var.script_signing_enabled ? azurerm_key_vault_key.script_signing[0].public_key_pem : ""
   })
   placement_group_id = var.placement_group_id != "" ? var.placement_group_id : azurerm_proximity_placement_group.ppg[0].id
+  # a zonal deployment has a scale set per availability zone, the cluster size is spread over them
+  zonal_deployment   = length(var.availability_zones) > 0
+  backend_scale_sets = local.zonal_deployment ? {
+    for i, zone in var.availability_zones : "zone${zone}" => {
+      name                 = "${var.prefix}-${var.cluster_name}-vmss-zone${zone}"
+      zone                 = zone
+      instances            = floor(var.cluster_size / length(var.availability_zones)) + (i < var.cluster_size % length(var.availability_zones) ? 1 : 0)
+      computer_name_prefix = "${var.prefix}-${var.cluster_name}-backend-zone${zone}"
+    }
+  } : {
+    default = {
+      name                 = "${var.prefix}-${var.cluster_name}-vmss"
+      zone                 = var.zone
+      instances            = var.cluster_size
+      computer_name_prefix = "${var.prefix}-${var.cluster_name}-backend"
+    }
+  }
 }
 
 # ===================== SSH key ++++++++++++++++++++++++= #
@@ -60,27 +85,35 @@ resource "azurerm_proximity_placement_group" "ppg" {
 }
 
 resource "azurerm_linux_virtual_machine_scale_set" "vmss" {
-  name                            = "${var.prefix}-${var.cluster_name}-vmss"
+  for_each                        = local.backend_scale_sets
+  name                            = each.value.name
   location                        = data.azurerm_resource_group.rg.location
-  zones                           = [var.zone]
+  zones                           = [each.value.zone]
   resource_group_name             = var.rg_name
   sku                             = var.instance_type
   upgrade_mode                    = "Manual"
   health_probe_id                 = azurerm_lb_probe.backend_lb_probe.id
   admin_username                  = var.vm_username
-  instances                       = var.cluster_size
-  computer_name_prefix            = "${var.prefix}-${var.cluster_name}-backend"
+  instances                       = each.value.instances
+  computer_name_prefix            = each.value.computer_name_prefix
   custom_data                     = base64encode(local.custom_data_script)
   disable_password_authentication = true
-  proximity_placement_group_id    = local.placement_group_id
+  # a proximity placement group is bound to a single zone
+  proximity_placement_group_id    = local.zonal_deployment ? null : local.placement_group_id
   source_image_id                 = var.source_image_id
+  priority                        = var.vm_priority
+  eviction_policy                 = local.spot_instances ? var.spot_eviction_policy : null
+  max_bid_price                   = local.spot_instances ? var.spot_max_bid_price : null
+  secure_boot_enabled             = local.secure_boot_enabled
+  vtpm_enabled                    = local.secure_boot_enabled
   tags                            = merge(var.tags_map, {
     "weka_cluster" : var.cluster_name, "user_id" : data.azurerm_client_config.current.object_id
   })
 
   os_disk {
-    caching              = "ReadWrite"
-    storage_account_type = "Premium_LRS"
+    caching                  = "ReadWrite"
+    storage_account_type     = "Premium_LRS"
+    security_encryption_type = var.vm_security_type == "ConfidentialVM" ? "VMGuestStateOnly" : null
   }
   data_disk {
     lun                  = 0
@@ -158,10 +191,15 @@ resource "azurerm_linux_virtual_machine_scale_set" "vmss" {
   ]
 }
 
+moved {
+  from = azurerm_linux_virtual_machine_scale_set.vmss
+  to   = azurerm_linux_virtual_machine_scale_set.vmss["default"]
+}
 
 resource "null_resource" "force-delete-vmss" {
+  for_each = azurerm_linux_virtual_machine_scale_set.vmss
   triggers = {
-    vmss_name       = azurerm_linux_virtual_machine_scale_set.vmss.name
+    vmss_name       = each.value.name
     rg_name         = data.azurerm_resource_group.rg.name
     subscription_id = var.subscription_id
   }
@@ -171,3 +209,8 @@ resource "null_resource" "force-delete-vmss" {
   }
   depends_on = [azurerm_linux_virtual_machine_scale_set.vmss]
 }
+
+moved {
+  from = null_resource.force-delete-vmss
+  to   = null_resource.force-delete-vmss["default"]
+}